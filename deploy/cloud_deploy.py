@@ -11,7 +11,7 @@ Key features:
 1. Tags and pushes Docker images to Artifact Registry for all services.
 2. Optionally provisions infrastructure (buckets, datasets, APIs) with --check-infra.
 3. Deploys `trigger` first with placeholder config to enable early availability.
-4. Deploys all other services (`extractor`, `cleaner`, `loader-json`, `loader-parquet`) 
+4. Deploys all other services (`extractor`, `cleaner`, `loader-json`, `loader-parquet`, `features`) 
    with the real `TRIGGER_URL` from the running trigger service.
 5. Rebuilds and redeploys `trigger` with full SERVICE_CONFIG_B64 after collecting all service URLs.
 
@@ -250,6 +250,10 @@ def main():
         "cleaner": get_service_url("cleaner") + "/clean",
         "loader": get_service_url("loader-json") + "/load",
         "loader_parquet": get_service_url("loader-parquet") + "/load",
+        "features": get_service_url("features") + "/features",
+        "prediction": get_service_url("features") + "/predict",
+        "drift": get_service_url("features") + "/drift",
+        "export": get_service_url("features") + "/export",
         "trigger": get_service_url("trigger") + "/clean"
     }
     config_json = json.dumps({k: {"url": v} for k, v in urls.items()})
@@ -19,6 +19,10 @@ def main():
         "cleaner": get_service_url("cleaner") + "/clean",
         "loader": get_service_url("loader-json") + "/load",
         "loader_parquet": get_service_url("loader-parquet") + "/load",
+        "features": get_service_url("features") + "/features",
+        "prediction": get_service_url("features") + "/predict",
+        "drift": get_service_url("features") + "/drift",
+        "export": get_service_url("features") + "/export",
         "trigger": get_service_url("trigger") + "/clean"
     }
 
@@ -67,6 +71,9 @@ def main():
         "BQ_DATASET=HygienePredictionColumn,BQ_TABLE=CleanedInspectionColumn,"
         "HTTP_MODE=true")
 
+    deploy("features", "features",
+        "BQ_DATASET=HygienePredictionRow,BQ_SOURCE_TABLE=CleanedInspectionRow,BQ_FEATURES_TABLE=Features")
+
 
 if __name__ == "__main__":
     main()
@@ -7,6 +7,7 @@ SERVICES = [
     "cleaner",
     "loader-json",
     "loader-parquet",
+    "features",
     "trigger",
     "eda-dashboard"
 ]
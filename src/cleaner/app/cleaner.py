@@ -1,5 +1,7 @@
 import polars as pl
 import re
+import hmac
+import hashlib
 from difflib import get_close_matches
 
 # === cleaner_1_drop ===
@@ -286,3 +288,188 @@ def cleaner_9_tokenize_violations(df: pl.DataFrame, logger=None) -> pl.DataFrame
 
     log("✅ cleaner_9_tokenize_violations completed.")
     return df
+
+# === Violation parsing ===
+# Raw violations are " | "-separated entries such as
+# "32. FOOD AND NON-FOOD CONTACT SURFACES ... - Comments: FLOOR UNDER ...".
+# parse_violations runs on the raw rows, since cleaner_3 strips the " - " the
+# comments are split on.
+VIOLATION_PATTERN = re.compile(r"^\s*(\d{1,3})\.\s*(.*?)(?:\s+-\s+comments:\s*(.*))?\s*$", re.IGNORECASE | re.DOTALL)
+
+VIOLATION_SCHEMA = {
+    "inspection_id": pl.Utf8,
+    "violation_index": pl.Int64,
+    "code": pl.Int64,
+    "description": pl.Utf8,
+    "comment": pl.Utf8,
+    "parsed": pl.Boolean,
+}
+
+def parse_violations(df: pl.DataFrame, logger=None):
+    """
+    Splits each inspection's violations into one record per entry with its
+    code, description and comment. An entry that doesn't match keeps its text
+    as the description, with a null code and parsed = False.
+
+    Returns:
+        (pl.DataFrame, dict): the records and their parse counts
+    """
+    def log(msg):
+        if logger:
+            logger.info(msg)
+        else:
+            print(msg)
+
+    records = []
+    if "violations" in df.columns and "inspection_id" in df.columns:
+        for inspection_id, text in df.select(["inspection_id", "violations"]).iter_rows():
+            if not text:
+                continue
+            entries = [e for e in str(text).split("|") if e.strip()]
+            for index, entry in enumerate(entries):
+                match = VIOLATION_PATTERN.match(entry)
+                record = {"inspection_id": str(inspection_id), "violation_index": index}
+                if match:
+                    comment = (match.group(3) or "").strip().lower()
+                    record.update(code=int(match.group(1)), description=match.group(2).strip().lower(), comment=comment or None, parsed=True)
+                else:
+                    record.update(code=None, description=entry.strip().lower(), comment=None, parsed=False)
+                records.append(record)
+
+    violations = pl.DataFrame(records, schema=VIOLATION_SCHEMA)
+    failed = violations.filter(~pl.col("parsed")).height
+    stats = {
+        "violations_parsed": violations.height - failed,
+        "violation_parse_failures": failed,
+    }
+    log(f"Parsed {stats['violations_parsed']} violations, {failed} unparseable")
+    return violations, stats
+
+# === cleaner_10_anonymize ===
+# Optional pass for sharing the dataset, e.g. in class. A policy maps columns
+# to rules: "hash" replaces values with a keyed hash (equal values hash alike,
+# so counts and joins still work), "block" rounds an address's house number
+# down to its hundred block, "truncate" keeps the first `length` characters,
+# "round" keeps `digits` decimals and "drop" removes the column.
+ANONYMIZE_ACTIONS = {"hash", "block", "truncate", "round", "drop"}
+
+DEFAULT_ANONYMIZE_POLICY = {
+    "address": {"action": "block"},
+    "license_": {"action": "hash"},
+    # Exact coordinates would give the address away; 3 decimals is about 100 m
+    "latitude": {"action": "round", "digits": 3},
+    "longitude": {"action": "round", "digits": 3},
+}
+
+def validate_anonymize_policy(policy) -> dict:
+    if not isinstance(policy, dict):
+        raise ValueError("anonymization policy must be a JSON object of column: rule")
+    for col, rule in policy.items():
+        action = rule.get("action") if isinstance(rule, dict) else None
+        if action not in ANONYMIZE_ACTIONS:
+            raise ValueError(f"anonymization rule for {col!r} needs an action among {sorted(ANONYMIZE_ACTIONS)}")
+        if action == "truncate" and not (isinstance(rule.get("length"), int) and rule["length"] >= 0):
+            raise ValueError(f"truncate rule for {col!r} needs a non-negative integer length")
+        if action == "round" and not isinstance(rule.get("digits"), int):
+            raise ValueError(f"round rule for {col!r} needs an integer digits")
+    return policy
+
+def cleaner_10_anonymize(df: pl.DataFrame, logger=None, policy=None, salt: str = "") -> pl.DataFrame:
+    def log(msg):
+        if logger:
+            logger.info(msg)
+        else:
+            print(msg)
+
+    key = salt.encode()
+
+    def keyed_hash(value):
+        return hmac.new(key, str(value).encode(), hashlib.sha256).hexdigest()[:16]
+
+    def hundred_block(address):
+        match = re.match(r"^\s*(\d+)(.*)$", address)
+        if not match:
+            return address
+        return f"{int(match.group(1)) // 100 * 100}{match.group(2)}"
+
+    for col, rule in (policy or DEFAULT_ANONYMIZE_POLICY).items():
+        if col not in df.columns:
+            continue
+        action = rule["action"]
+        if action == "drop":
+            df = df.drop(col)
+        elif action == "hash":
+            df = df.with_columns(pl.col(col).map_elements(keyed_hash, return_dtype=pl.Utf8).alias(col))
+        elif action == "block":
+            df = df.with_columns(pl.col(col).cast(pl.Utf8).map_elements(hundred_block, return_dtype=pl.Utf8).alias(col))
+        elif action == "truncate":
+            df = df.with_columns(pl.col(col).cast(pl.Utf8).str.slice(0, rule["length"]).alias(col))
+        elif action == "round":
+            df = df.with_columns(pl.col(col).cast(pl.Float64, strict=False).round(rule["digits"]).alias(col))
+        log(f"Anonymized {col}: {action}")
+    return df
+
+# === Column lineage ===
+# Where each output column comes from: the raw fields it is computed from and
+# the steps that change it, in order. The cleaner writes this next to its
+# outputs as _lineage.json and the loaders carry it on to their tables, so an
+# audit can trace e.g. risk back to the portal's risk field.
+TEXT_NORMALIZATION = "cleaner_3_text_normalization: lowercased, trimmed, '/' and '-' replaced by spaces"
+VIOLATION_TOKENS = "cleaner_9_tokenize_violations: violation numbers found in the text"
+
+COLUMN_LINEAGE = {
+    "inspection_id": (["inspection_id"], ["cleaner_2_inspection_id: deduplicated, ids that are not 7 digits dropped"]),
+    "dba_name": (["dba_name"], [TEXT_NORMALIZATION]),
+    "facility_type": (["facility_type"], [TEXT_NORMALIZATION]),
+    "facility_category": (["facility_type"], [TEXT_NORMALIZATION, "cleaner_5_facility_type: keyword category, unknown when none matches"]),
+    "risk": (["risk"], [TEXT_NORMALIZATION, "cleaner_4_values_consolidation: 'risk 1 high', 'risk 2 medium', 'risk 3 low' mapped to high, medium, low"]),
+    "address": (["address"], [TEXT_NORMALIZATION]),
+    "city": (["city"], [TEXT_NORMALIZATION, "cleaner_4_values_consolidation: misspellings of chicago and berwyn fixed by fuzzy match"]),
+    "state": (["state"], [TEXT_NORMALIZATION]),
+    "zip": (["zip"], ["cleaner_8_geolocation: zero-padded to 5 digits, other rows dropped"]),
+    "inspection_type": (["inspection_type"], [TEXT_NORMALIZATION, "cleaner_6_inspection_type: 'license reinspection' shortened to 'license'"]),
+    "results": (["results"], [TEXT_NORMALIZATION, "cleaner_7_results: 'pass w conditions' renamed 'pass_w_conditions'"]),
+    "violations": (["violations"], [TEXT_NORMALIZATION]),
+    "latitude": (["latitude"], ["cleaner_8_geolocation: cast to float and rounded to 5 decimals, rows without one dropped"]),
+    "longitude": (["longitude"], ["cleaner_8_geolocation: cast to float and rounded to 5 decimals, rows without one dropped"]),
+    "violation_codes": (["violations"], [TEXT_NORMALIZATION, VIOLATION_TOKENS]),
+    "violation_count": (["violations"], [TEXT_NORMALIZATION, VIOLATION_TOKENS, "cleaner_9_tokenize_violations: number of violation numbers"]),
+}
+
+# The has_violation_N and has_*_violation flags all come from the same text
+VIOLATION_FLAG_LINEAGE = (["violations"], [TEXT_NORMALIZATION, VIOLATION_TOKENS, "cleaner_9_tokenize_violations: 1 when the numbers include the flag's codes"])
+
+VIOLATION_RECORD_LINEAGE = {
+    "inspection_id": (["inspection_id"], []),
+    "violation_index": (["violations"], ["parse_violations: position of the entry in the ' | '-separated list"]),
+    "code": (["violations"], ["parse_violations: entry number"]),
+    "description": (["violations"], ["parse_violations: entry title, lowercased; the whole entry when it doesn't parse"]),
+    "comment": (["violations"], ["parse_violations: inspector comments after ' - Comments:', lowercased"]),
+    "parsed": (["violations"], ["parse_violations: whether the entry matched VIOLATION_PATTERN"]),
+}
+
+def column_lineage(columns, lineage=None, policy=None) -> list:
+    """
+    Lineage records for the output columns: the column, its raw source fields,
+    the transformations applied and a transformation type (IDENTITY for values
+    copied as is, MASKED for anonymized ones, TRANSFORMATION otherwise).
+    Columns with no entry in lineage are taken to be copied from the raw field
+    of the same name.
+    """
+    lineage = COLUMN_LINEAGE if lineage is None else lineage
+    records = []
+    for col in columns:
+        if col in lineage:
+            sources, transformations = lineage[col]
+        elif lineage is COLUMN_LINEAGE and col.startswith("has_"):
+            sources, transformations = VIOLATION_FLAG_LINEAGE
+        else:
+            sources, transformations = [col], []
+        transformations = list(transformations)
+        kind = "TRANSFORMATION" if transformations else "IDENTITY"
+        rule = (policy or {}).get(col)
+        if rule:
+            transformations.append(f"cleaner_10_anonymize: {rule['action']}")
+            kind = "MASKED"
+        records.append({"column": col, "sources": list(sources), "transformations": transformations, "type": kind})
+    return records
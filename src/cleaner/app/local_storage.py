@@ -0,0 +1,60 @@
+"""Buckets as directories, for running the pipeline without a cloud account.
+
+LocalBucket stands in for a google.cloud.storage bucket with the subset of
+its API the cleaner uses. Objects live at {root}/{bucket}/{name}, the layout
+the extractor writes with LOCAL_DATA_DIR set, so the cleaner reads its chunks
+and the loaders read the cleaner's output from the same tree.
+"""
+import os
+
+
+class LocalBlob:
+    def __init__(self, bucket, name: str):
+        self.bucket = bucket
+        self.name = name
+        self.path = os.path.join(bucket.path, *name.split("/"))
+
+    def exists(self) -> bool:
+        return os.path.isfile(self.path)
+
+    def download_as_bytes(self) -> bytes:
+        with open(self.path, "rb") as f:
+            return f.read()
+
+    def download_as_text(self) -> str:
+        return self.download_as_bytes().decode("utf-8")
+
+    def upload_from_string(self, data, content_type=None):
+        if isinstance(data, str):
+            data = data.encode("utf-8")
+        os.makedirs(os.path.dirname(self.path), exist_ok=True)
+        # Written through a temporary file so a reader never sees half an object
+        tmp = f"{self.path}.tmp"
+        with open(tmp, "wb") as f:
+            f.write(data)
+        os.replace(tmp, self.path)
+
+    def upload_from_file(self, file_obj, content_type=None):
+        self.upload_from_string(file_obj.read(), content_type)
+
+    def delete(self):
+        os.remove(self.path)
+
+
+class LocalBucket:
+    def __init__(self, root: str, name: str):
+        self.name = name
+        self.path = os.path.join(root, name)
+
+    def exists(self) -> bool:
+        return os.path.isdir(self.path)
+
+    def blob(self, name: str) -> LocalBlob:
+        return LocalBlob(self, name)
+
+    def list_blobs(self, prefix: str = ""):
+        for dirpath, _, filenames in os.walk(self.path):
+            for filename in filenames:
+                name = os.path.relpath(os.path.join(dirpath, filename), self.path).replace(os.sep, "/")
+                if name.startswith(prefix) and not name.endswith(".tmp"):
+                    yield LocalBlob(self, name)
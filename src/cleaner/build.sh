@@ -3,10 +3,10 @@ set -e
 
 echo "=== 🧼 Building Cleaner ==="
 
-# Go to project root
-cd "$(dirname "$0")/../.."
+# Build from src/ so the shared pyconfigure package is available
+cd "$(dirname "$0")/.."
 
 # Build Docker image from cleaner Dockerfile
-docker build --no-cache -t cleaner -f src/cleaner/Dockerfile .
+docker build --no-cache -t cleaner -f cleaner/Dockerfile .
 
 echo "✅ Docker image built: cleaner"
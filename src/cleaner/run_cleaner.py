@@ -3,21 +3,35 @@ import base64
 import sys
 import time
 import json
-import logging
-import requests
+import threading
 import io
+import itertools
+import math
+import google_crc32c
+from concurrent.futures import FIRST_COMPLETED, ThreadPoolExecutor, wait
 from io import BytesIO
 from datetime import datetime
 from google.cloud import storage
 import polars as pl
-from werkzeug.wrappers import Request, Response
 
-# === Logging Setup ===
-logging.basicConfig(
-    level=logging.INFO,
-    format='[%(asctime)s] %(message)s'
+# === Shared with the loaders (see src/pyconfigure) ===
+from pyconfigure import errcategory, logs, publish, readiness, wsgi
+from pyconfigure.jobs import handle_jobs, registry as jobs
+from pyconfigure.logs import admin_loglevel
+from pyconfigure.manifest import (
+    SCHEMA_VERSION as MANIFEST_SCHEMA_VERSION,
+    ManifestError,
+    check as check_manifest,
+    load as read_manifest,
+    validate as schema_violations,
 )
-logger = logging.getLogger(__name__)
+from pyconfigure.openlineage import post as post_openlineage
+from pyconfigure.problem import problem
+from pyconfigure.publish import EVENT_SCHEMA_VERSION, publish_event
+
+# === Logging Setup ===
+# LOG_LEVEL (debug, info or warn) sets the starting level; /admin/loglevel changes it
+logger = logs.setup(__name__, '[%(asctime)s] %(message)s')
 
 # === Cleaner Imports ===
 from app.cleaner import (
@@ -30,71 +44,180 @@ from app.cleaner import (
     cleaner_7_results,
     cleaner_8_geolocation,
     cleaner_9_tokenize_violations,
+    cleaner_10_anonymize,
+    parse_violations,
+    validate_anonymize_policy,
+    column_lineage,
+    DEFAULT_ANONYMIZE_POLICY,
+    VIOLATION_RECORD_LINEAGE,
 )
 
-# === Load TRIGGER_URL from env or SERVICE_CONFIG_B64 ===
-TRIGGER_URL = os.environ.get("TRIGGER_URL")
+from app.local_storage import LocalBucket
 
-if not TRIGGER_URL:
-    config_b64 = os.environ.get("SERVICE_CONFIG_B64")
-    if config_b64:
-        try:
-            decoded = base64.b64decode(config_b64).decode()
-            service_config = json.loads(decoded)
-            TRIGGER_URL = service_config.get("trigger", {}).get("url")
-        except Exception as e:
-            logger.error(f"❌ Failed to parse SERVICE_CONFIG_B64: {e}")
+# With LOCAL_DATA_DIR set the buckets are directories under it and no trigger
+# is needed: `python run_cleaner.py DATE` cleans one date on a laptop
+LOCAL_DATA_DIR = os.environ.get("LOCAL_DATA_DIR")
 
-if not TRIGGER_URL:
+# === Event publishing ===
+# EVENT_PUBLISHER and the trigger URL are read by pyconfigure.publish; the
+# cleaner can't run without somewhere to report to
+if not publish.configured():
     raise ValueError("❌ TRIGGER_URL is not set in env or SERVICE_CONFIG_B64")
 
+
+def classify_error(e: Exception) -> str:
+    """Maps an exception to an error category for failure events; polars errors are the data's."""
+    if isinstance(e, pl.exceptions.PolarsError):
+        return errcategory.DATA_FORMAT
+    return errcategory.of(e)
+
+
 # === Notify Trigger ===
-def post_back_to_trigger(payload, trigger_url):
-    if not trigger_url:
-        logger.warning("⚠️ Trigger URL not set — skipping POST back")
-        return
-    try:
-        logger.info(f"📤 Sending payload to trigger: {json.dumps(payload)}")
-        response = requests.post(trigger_url, json=payload)
-        logger.info(f"📤 POST to trigger returned: {response.status_code} {response.text}")
-    except Exception as e:
-        logger.error(f"❌ Failed to POST back to trigger: {e}")
+def notify_failure(date: str, run_id: str, error: Exception):
+    """Reports a failed run to the trigger, which fails the run immediately."""
+    event = publish.failure_event("cleaner_failed", "cleaner", date, run_id, error, classify_error(error))
+    event["manifest_problems"] = getattr(error, "problems", None)
+    publish_event(event)
+    post_openlineage("FAIL", "cleaner", run_id, date, lineage_inputs(), lineage_outputs(), error)
 
 
 # === Config (Cloud Native) ===
-BUCKET_NAME = os.environ["RAW_BUCKET"]
+BUCKET_NAME = os.environ["RAW_BUCKET"] if not LOCAL_DATA_DIR else os.environ.get("RAW_BUCKET", "raw-inspection-data")
 RAW_PREFIX = os.environ.get("RAW_PREFIX", "raw-data")
 CLEAN_PREFIX = os.environ.get("CLEAN_PREFIX", "clean-data")
 CLEAN_ROW_BUCKET_NAME = os.environ.get("CLEAN_ROW_BUCKET_NAME", "cleaned-inspection-data-row-434")
 CLEAN_COL_BUCKET_NAME = os.environ.get("CLEAN_COL_BUCKET_NAME", "cleaned-inspection-data-column-434")
+VERIFY_MANIFEST = os.environ.get("VERIFY_MANIFEST", "true").lower() != "false"
+
+# Chunk files are cleaned CLEAN_WORKERS at a time: downloads and uploads overlap
+# and polars releases the GIL while it works. A file is only started when a
+# worker frees up, so at most CLEAN_WORKERS files are held in memory at once
+CLEAN_WORKERS = max(1, int(os.environ.get("CLEAN_WORKERS", str(min(4, os.cpu_count() or 1)))))
+
+# Parsed violations are written next to the cleaned files under violations/;
+# a share of unparseable entries above VIOLATION_PARSE_WARN_RATE is logged as a warning
+WRITE_VIOLATIONS = os.environ.get("WRITE_VIOLATIONS", "true").lower() != "false"
+VIOLATION_PARSE_WARN_RATE = float(os.environ.get("VIOLATION_PARSE_WARN_RATE", "0.05"))
+
+# Optional anonymization before data reaches the published tables (see cleaner_10_anonymize):
+# ANONYMIZE=true applies the default policy, ANONYMIZE_POLICY sets the rules as JSON
+ANONYMIZE_POLICY = None
+if os.environ.get("ANONYMIZE_POLICY"):
+    ANONYMIZE_POLICY = validate_anonymize_policy(json.loads(os.environ["ANONYMIZE_POLICY"]))
+elif os.environ.get("ANONYMIZE", "false").lower() == "true":
+    ANONYMIZE_POLICY = DEFAULT_ANONYMIZE_POLICY
+ANONYMIZE_SALT = os.environ.get("ANONYMIZE_SALT", "")
+if ANONYMIZE_POLICY and not ANONYMIZE_SALT and any(r["action"] == "hash" for r in ANONYMIZE_POLICY.values()):
+    # License numbers are short enough that unkeyed hashes could be reversed by brute force
+    raise ValueError("❌ ANONYMIZE_SALT must be set when the anonymization policy hashes columns")
+
+# Column lineage is written next to the cleaned files as _lineage.json for the loaders,
+# and posted as an OpenLineage run event when OPENLINEAGE_URL is set (see pyconfigure.openlineage)
 
 # === GCS Clients ===
-storage_client = storage.Client()
-raw_bucket = storage_client.bucket(BUCKET_NAME)
-clean_row_bucket = storage_client.bucket(CLEAN_ROW_BUCKET_NAME)
-clean_col_bucket = storage_client.bucket(CLEAN_COL_BUCKET_NAME)
+if LOCAL_DATA_DIR:
+    logger.info(f"💻 Local mode: reading and writing buckets under {LOCAL_DATA_DIR}")
+    raw_bucket = LocalBucket(LOCAL_DATA_DIR, BUCKET_NAME)
+    clean_row_bucket = LocalBucket(LOCAL_DATA_DIR, CLEAN_ROW_BUCKET_NAME)
+    clean_col_bucket = LocalBucket(LOCAL_DATA_DIR, CLEAN_COL_BUCKET_NAME)
+else:
+    storage_client = storage.Client()
+    raw_bucket = storage_client.bucket(BUCKET_NAME)
+    clean_row_bucket = storage_client.bucket(CLEAN_ROW_BUCKET_NAME)
+    clean_col_bucket = storage_client.bucket(CLEAN_COL_BUCKET_NAME)
 
 # === Helper: Load Manifest ===
 def load_manifest(date: str):
-    manifest_path = f"{RAW_PREFIX}/{date}/_manifest.json"
-    blob = raw_bucket.blob(manifest_path)
-
-    if not blob.exists():
-        logger.warning(f"⚠️ No manifest found at {manifest_path}")
-        return []
-
+    # A manifest that breaks its schema fails the run instead of being skipped
     try:
-        manifest = json.loads(blob.download_as_text())
-    except Exception as e:
+        return read_manifest(raw_bucket, f"{RAW_PREFIX}/{date}/_manifest.json")
+    except ValueError as e:
         logger.error(f"❌ Failed to load or parse manifest: {e}")
-        return []
+        return None
+
+
+# === Helper: Verify Manifest ===
+# Mirrors configure/manifest in the Go services: each chunk must exist with the
+# size, CRC32C and row count the extractor recorded when writing it, and the
+# manifests the cleaner writes are checked against the schema the loaders read.
+# polars' default, named so the manifest records it
+PARQUET_COMPRESSION = "zstd"
+
+
+def crc32c_b64(data: bytes) -> str:
+    """CRC32C as GCS reports it: base64 of the big-endian checksum."""
+    return base64.b64encode(google_crc32c.value(data).to_bytes(4, "big")).decode()
 
-    if not manifest.get("upload_complete"):
-        logger.info(f"Manifest for {date} not marked complete. Skipping.")
-        return []
 
-    logger.info(f"📦 Loaded manifest with {len(manifest['files'])} files for {date}")
-    return manifest["files"]
+def count_rows(data: bytes) -> int:
+    return sum(1 for line in data.split(b"\n") if line.strip())
+
+
+def describe_object(name: str, data: bytes, rows: int, compression: str = "none") -> dict:
+    """A manifest entry for a written file, as configure/manifest records them."""
+    return {"name": name, "rows": rows, "size": len(data), "crc32c": crc32c_b64(data), "compression": compression}
+
+
+def build_manifest(date: str, objects: list, run_id: str = None, selftest: bool = False) -> dict:
+    """A complete manifest listing objects, with the totals downstream stages reconcile against.
+
+    The run ID (and a self-test flag) let loaders started by a GCS notification
+    on the manifest attribute their load to the run. Raises ManifestError
+    rather than build one the loaders would reject.
+    """
+    manifest = {
+        "schema_version": MANIFEST_SCHEMA_VERSION,
+        "status": "complete",
+        "date": date,
+        "files": [o["name"] for o in objects],
+        "objects": objects,
+        "totals": {
+            "files": len(objects),
+            "rows": sum(o["rows"] for o in objects),
+            "bytes": sum(o["size"] for o in objects),
+        },
+        "upload_complete": True,
+    }
+    if run_id:
+        manifest["run_id"] = run_id
+    if selftest:
+        manifest["selftest"] = True
+    violations = schema_violations(manifest)
+    if violations:
+        raise ManifestError(date, [{"file": "_manifest.json", "kind": "schema_violation", "actual": v} for v in violations])
+    return manifest
+
+
+def verify_manifest(date: str, manifest: dict):
+    """Raises ManifestError listing every chunk that is missing or differs from its manifest entry."""
+    folder = f"{RAW_PREFIX}/{date}"
+    objects = manifest.get("objects") or [{"name": name} for name in manifest.get("files") or []]
+    present = {blob.name[len(folder) + 1:] for blob in raw_bucket.list_blobs(prefix=f"{folder}/")}
+
+    problems = []
+    for want in objects:
+        name = want["name"]
+        if name not in present:
+            problems.append({"file": name, "kind": "missing"})
+            continue
+        # Manifests written before checksums were recorded can only be checked for missing files
+        if not want.get("crc32c"):
+            continue
+        try:
+            data = raw_bucket.blob(f"{folder}/{name}").download_as_bytes()
+        except Exception as e:
+            problems.append({"file": name, "kind": "unreadable", "actual": str(e)})
+            continue
+        if len(data) != want.get("size"):
+            problems.append({"file": name, "kind": "size_mismatch", "expected": str(want.get("size")), "actual": str(len(data))})
+        elif crc32c_b64(data) != want["crc32c"]:
+            problems.append({"file": name, "kind": "checksum_mismatch", "expected": want["crc32c"], "actual": crc32c_b64(data)})
+        elif count_rows(data) != want.get("rows"):
+            problems.append({"file": name, "kind": "row_count_mismatch", "expected": str(want.get("rows")), "actual": str(count_rows(data))})
+
+    if problems:
+        raise ManifestError(folder, problems)
+    logger.info(f"🔎 Verified {len(objects)} chunk(s) against the manifest for {date}")
 
 
 # === Helper: Download Raw File ===
@@ -107,9 +230,17 @@ def download_json_as_polars_blob(path: str):
 
     try:
         raw_bytes = blob.download_as_bytes()
+    except Exception as e:
+        logger.error(f"❌ Failed to download NDJSON from {path}: {e}")
+        return None
+    return ndjson_to_polars(raw_bytes, path)
+
+
+def ndjson_to_polars(raw_bytes: bytes, path: str):
+    try:
         df = pl.read_ndjson(BytesIO(raw_bytes))
     except Exception as e:
-        logger.error(f"❌ Failed to download or parse NDJSON from {path}: {e}")
+        logger.error(f"❌ Failed to parse NDJSON from {path}: {e}")
         return None
 
     if df.is_empty():
@@ -121,17 +252,24 @@ def download_json_as_polars_blob(path: str):
 
 # === Helper: Upload Cleaned File ===# === Helper: Upload Cleaned File ===
 # === Helper: Upload Cleaned File ===
-def upload_polars_to_gcs(df: pl.DataFrame, base_path: str):
-    json_path = f"{CLEAN_PREFIX}/{base_path}.json"
+def upload_polars_to_gcs(df: pl.DataFrame, base_path: str, prefix: str = CLEAN_PREFIX):
+    json_path = f"{prefix}/{base_path}.json"
     json_blob = clean_row_bucket.blob(json_path)
     
-    parquet_path = f"{CLEAN_PREFIX}/{base_path}.parquet"
+    parquet_path = f"{prefix}/{base_path}.parquet"
     parquet_blob = clean_col_bucket.blob(parquet_path)
+    bytes_written = 0
+
+    base_filename = base_path.split("/")[-1]
+    json_object = {"name": f"{base_filename}.json", "rows": df.height, "size": 0, "crc32c": "", "compression": "none"}
+    parquet_object = {"name": f"{base_filename}.parquet", "rows": df.height, "size": 0, "crc32c": "", "compression": PARQUET_COMPRESSION}
 
     # Upload NDJSON
     try:
-        ndjson_data = df.write_ndjson()
+        ndjson_data = df.write_ndjson().encode("utf-8")
         json_blob.upload_from_string(ndjson_data, content_type="application/x-ndjson")
+        bytes_written += len(ndjson_data)
+        json_object = describe_object(json_object["name"], ndjson_data, df.height)
         logger.info(f"✅ Uploaded NDJSON to: {json_path}")
     except Exception as e:
         logger.error(f"❌ Failed to upload NDJSON to {json_path}: {e}")
@@ -139,16 +277,18 @@ def upload_polars_to_gcs(df: pl.DataFrame, base_path: str):
     # Upload Parquet
     try:
         parquet_buffer = BytesIO()
-        df.write_parquet(parquet_buffer)
+        df.write_parquet(parquet_buffer, compression=PARQUET_COMPRESSION)
         parquet_buffer.seek(0)
         parquet_blob.upload_from_file(parquet_buffer, content_type="application/octet-stream")
+        parquet_data = parquet_buffer.getbuffer()
+        bytes_written += parquet_data.nbytes
+        parquet_object = describe_object(parquet_object["name"], parquet_data, df.height, PARQUET_COMPRESSION)
         logger.info(f"✅ Uploaded Parquet to: {parquet_path}")
     except Exception as e:
         logger.error(f"❌ Failed to upload Parquet to {parquet_path}: {e}")
 
-    # Return file names (not full GCS paths)
-    base_filename = base_path.split("/")[-1]
-    return f"{base_filename}.json", f"{base_filename}.parquet"
+    # Return manifest entries (file names, not full GCS paths) and the bytes uploaded
+    return json_object, parquet_object, bytes_written
 
 
 
@@ -169,133 +309,556 @@ def run_cleaning_pipeline(df: pl.DataFrame) -> pl.DataFrame:
 
     for step in steps:
         df = step(df, logger)
+    if ANONYMIZE_POLICY:
+        df = cleaner_10_anonymize(df, logger, ANONYMIZE_POLICY, ANONYMIZE_SALT)
     return df
 
 
-def notify_trigger(date: str, files_cleaned: int, total_files: int, duration: float, trigger_url: str):
+# === Per-File Cleaning ===
+def clean_file(date: str, filename: str, data: bytes = None, prefix: str = CLEAN_PREFIX) -> dict:
+    """Cleans one raw chunk file end to end on a worker thread.
+
+    data is the file's content when the extractor streamed it (see
+    clean_stream); otherwise the file is downloaded. The output goes under
+    prefix in the clean buckets. Returns its manifest
+    entries, violation output and per-step timings for complete_cleaning to
+    merge; json_object is None when the file had no rows to clean.
+    """
+    raw_path = f"{RAW_PREFIX}/{date}/{filename}"
+    base_name = filename.replace(".json", "")
+    timings = {"file": filename, "rows": 0}
+    result = {"rows_received": 0, "json_object": None, "timings": timings}
+    logger.info(f"📄 Processing file: {filename}")
+    start = step = time.perf_counter()
+
+    def lap(name):
+        nonlocal step
+        now = time.perf_counter()
+        timings[f"{name}_seconds"] = round(now - step, 3)
+        step = now
+
+    df = download_json_as_polars_blob(raw_path) if data is None else ndjson_to_polars(data, raw_path)
+    lap("download")
+    if df is None:
+        timings["seconds"] = round(time.perf_counter() - start, 3)
+        return result
+    result["rows_received"] = timings["rows"] = df.height
+
+    violations_df, stats = parse_violations(df, logger) if WRITE_VIOLATIONS else (None, {})
+    df_clean = run_cleaning_pipeline(df)
+    del df
+    if violations_df is not None:
+        # Only the violations of inspections that survived cleaning are published
+        kept_ids = df_clean.select(pl.col("inspection_id").cast(pl.Utf8))
+        violations_df = violations_df.join(kept_ids, on="inspection_id", how="semi")
+    lap("clean")
+
+    json_object, parquet_object, written = upload_polars_to_gcs(df_clean, f"{date}/{base_name}", prefix)
+    result.update(json_object=json_object, parquet_object=parquet_object, bytes_written=written,
+                  columns=df_clean.columns, violations=None)
+    if violations_df is not None:
+        v_json, v_parquet, v_written = upload_polars_to_gcs(violations_df, f"{date}/violations/{base_name}", prefix)
+        result["bytes_written"] += v_written
+        result["violations"] = (v_json, v_parquet, stats)
+    lap("upload")
+    timings["seconds"] = round(time.perf_counter() - start, 3)
+    return result
+
+
+def performance_stats(file_timings: list) -> dict:
+    """The completion event's performance fields: the worker count, each
+    file's timings and the spread of per-file durations."""
+    durations = sorted(t["seconds"] for t in file_timings)
+
+    def rank(p):
+        return durations[max(math.ceil(p * len(durations)) - 1, 0)] if durations else 0.0
+
+    return {
+        "workers": CLEAN_WORKERS,
+        "file_seconds_p50": rank(0.5),
+        "file_seconds_p90": rank(0.9),
+        "file_seconds_max": durations[-1] if durations else 0.0,
+        "file_timings": file_timings,
+    }
+
+
+def notify_trigger(date: str, files_cleaned: int, total_files: int, duration: float, run_id: str = None, gcs_bytes_written: int = 0, reconciliation: dict = None, violation_stats: dict = None, performance: dict = None, pipe: dict = None):
     payload = {
         "event": "cleaner_completed",
+        "schema_version": EVENT_SCHEMA_VERSION,
         "origin": "cleaner",
+        "run_id": run_id,
         "date": date,
         "status": "completed",
         "files_cleaned": files_cleaned,
         "total_files": total_files,
+        "gcs_bytes_written": gcs_bytes_written,
+        "anonymized": ANONYMIZE_POLICY is not None,
         "message": f"✅ Finished cleaning for {date} | Files cleaned: {files_cleaned}/{total_files}",
         "timestamp": datetime.utcnow().isoformat(),
-        "duration": str(round(duration, 3))
+        "duration": round(duration, 3),
+        **(reconciliation or {}),
+        **(violation_stats or {}),
+        **(performance or {}),
+        **(pipe or {}),
     }
+    publish_event(payload)
 
-    if not trigger_url:
-        logger.error("❌ No trigger URL provided — not notifying trigger.")
-        return
 
+
+
+# === Lineage ===
+def write_lineage(date: str, run_id: str, folder: str, columns: list, lineage: dict = None, prefix: str = CLEAN_PREFIX):
+    """Writes the column lineage of a cleaned folder to both clean buckets and returns its records."""
+    records = column_lineage(columns, lineage, ANONYMIZE_POLICY if lineage is None else None)
+    doc = {
+        "date": date,
+        "run_id": run_id,
+        "producer": "cleaner",
+        "source": f"gs://{BUCKET_NAME}/{RAW_PREFIX}/{date}",
+        "generated_at": datetime.utcnow().isoformat(),
+        "columns": records,
+    }
+    path = f"{prefix}/{date}/{folder}_lineage.json"
     try:
-        logger.info(f"📤 Sending payload to trigger: {payload}")
-        response = requests.post(trigger_url, json=payload, timeout=30)
-        logger.info(f"📤 POST to trigger returned: {response.status_code} {response.text}")
-    except requests.exceptions.Timeout:
-        logger.error("❌ Trigger POST timed out.")
+        for bucket in (clean_row_bucket, clean_col_bucket):
+            bucket.blob(path).upload_from_string(json.dumps(doc), content_type="application/json")
+        logger.info(f"🧬 Wrote lineage of {len(records)} columns to: {path}")
     except Exception as e:
-        logger.exception(f"❌ Unexpected error posting to trigger: {e}")
+        logger.error(f"❌ Failed to write lineage to {path}: {e}")
+    return records
+
+
+def lineage_inputs():
+    return [(f"gs://{BUCKET_NAME}", RAW_PREFIX)]
 
 
+def lineage_outputs(records=None, violation_records=None, prefix: str = CLEAN_PREFIX):
+    """The cleaned folders as OpenLineage outputs, with their column lineage when given."""
+    outputs = [(f"gs://{b}", prefix, records) for b in (CLEAN_ROW_BUCKET_NAME, CLEAN_COL_BUCKET_NAME)]
+    if WRITE_VIOLATIONS:
+        outputs += [(f"gs://{b}", f"{prefix}/violations", violation_records) for b in (CLEAN_ROW_BUCKET_NAME, CLEAN_COL_BUCKET_NAME)]
+    return outputs
+
+
+def readiness_problems():
+    """Checks the buckets the cleaner reads and writes; the trigger probes /readyz before starting a run."""
+    return readiness.bucket_problems(raw_bucket, clean_row_bucket, clean_col_bucket)
 
 
 # === Main ===
-def main(date: str):
+def main(date: str, run_id: str = None, job=None, selftest: bool = False, prefix: str = CLEAN_PREFIX):
     start = time.time()
-    ndjson_files = []
-    parquet_files = []
-
     logger.info(f"=== Starting cleaning for {date} ===")
-    files = load_manifest(date)
+    if ANONYMIZE_POLICY:
+        rules = ", ".join(f"{col}={rule['action']}" for col, rule in ANONYMIZE_POLICY.items())
+        logger.info(f"🕶️ Anonymizing columns: {rules}")
+    post_openlineage("START", "cleaner", run_id, date, lineage_inputs(), lineage_outputs(prefix=prefix))
+    manifest = load_manifest(date)
+    files = manifest.get("files") if manifest else None
     if not files:
         logger.warning(f"No files to process for {date}")
+        post_openlineage("COMPLETE", "cleaner", run_id, date, lineage_inputs(), lineage_outputs(prefix=prefix))
         return
+    if VERIFY_MANIFEST:
+        verify_manifest(date, manifest)
 
     cleaned_count = 0
-
+    rows_received = 0
+    results = {}
+    queued = iter(files)
+    running = {}
+    logger.info(f"🧵 Cleaning {len(files)} file(s) with {CLEAN_WORKERS} worker(s)")
+    with ThreadPoolExecutor(max_workers=CLEAN_WORKERS, thread_name_prefix="clean") as pool:
+        while True:
+            if job:
+                # Files already started finish before a cancellation takes effect
+                job.check()
+                job.progress(files_cleaned=cleaned_count, files_total=len(files), rows_received=rows_received)
+            for filename in itertools.islice(queued, CLEAN_WORKERS - len(running)):
+                running[pool.submit(clean_file, date, filename, None, prefix)] = filename
+            if not running:
+                break
+            done, _ = wait(running, return_when=FIRST_COMPLETED)
+            for future in done:
+                filename = running.pop(future)
+                try:
+                    result = future.result()
+                except Exception as e:
+                    logger.exception(f"❌ Error processing file {filename}: {e}")
+                    continue
+                results[filename] = result
+                rows_received += result["rows_received"]
+                if result["json_object"]:
+                    cleaned_count += 1
+
+    complete_cleaning(date, run_id, selftest, manifest, results, start, prefix=prefix)
+
+
+def complete_cleaning(date: str, run_id: str, selftest: bool, manifest: dict, results: dict, start: float, pipe: dict = None,
+                      prefix: str = CLEAN_PREFIX):
+    """Writes the output manifests and lineage of a cleaned date and reports it to the trigger.
+
+    results holds clean_file's result for each file of the raw manifest that
+    was cleaned; pipe adds clean_stream's fields to the completion event.
+    prefix is where clean_file wrote the date's files.
+    """
+    files = manifest["files"]
+    ndjson_files = []
+    parquet_files = []
+    cleaned_count = 0
+    gcs_bytes_written = 0
+    rows_received = 0
+    violation_json_files = []
+    violation_parquet_files = []
+    violation_stats = {"violations_parsed": 0, "violation_parse_failures": 0}
+    output_columns = []
+
+    # Merged in manifest order, so the output manifests don't depend on which worker finished first
+    file_timings = []
     for filename in files:
-        raw_path = f"{RAW_PREFIX}/{date}/{filename}"
-        base_name = filename.replace(".json", "")
-        try:
-            logger.info(f"📄 Processing file: {filename}")
-            df = download_json_as_polars_blob(raw_path)
-            if df is None:
-                continue
-
-            df_clean = run_cleaning_pipeline(df)
-            json_name, parquet_name = upload_polars_to_gcs(df_clean, f"{date}/{base_name}")
-            ndjson_files.append(json_name)
-            parquet_files.append(parquet_name)
-            cleaned_count += 1
-        except Exception as e:
-            logger.exception(f"❌ Error processing file {filename}: {e}")
+        result = results.get(filename)
+        if not result:
+            continue
+        file_timings.append(result["timings"])
+        rows_received += result["rows_received"]
+        if not result["json_object"]:
+            continue
+        cleaned_count += 1
+        gcs_bytes_written += result["bytes_written"]
+        output_columns = output_columns or result["columns"]
+        ndjson_files.append(result["json_object"])
+        parquet_files.append(result["parquet_object"])
+        if result["violations"]:
+            v_json, v_parquet, stats = result["violations"]
+            violation_json_files.append(v_json)
+            violation_parquet_files.append(v_parquet)
+            for key, value in stats.items():
+                violation_stats[key] += value
 
     # Write NDJSON manifest
-    ndjson_manifest_path = f"{CLEAN_PREFIX}/{date}/_manifest.json"
+    ndjson_manifest_path = f"{prefix}/{date}/_manifest.json"
     manifest_blob = clean_row_bucket.blob(ndjson_manifest_path)
     manifest_blob.upload_from_string(
-        json.dumps({"upload_complete": True, "files": ndjson_files}),
+        json.dumps(build_manifest(date, ndjson_files, run_id, selftest)),
         content_type="application/json"
     )
     logger.info(f"📝 Wrote NDJSON manifest to: {ndjson_manifest_path}")
 
     # Write Parquet manifest
-    parquet_manifest_path = f"{CLEAN_PREFIX}/{date}/_manifest.json"
+    parquet_manifest_path = f"{prefix}/{date}/_manifest.json"
     manifest_blob_col = clean_col_bucket.blob(parquet_manifest_path)
     manifest_blob_col.upload_from_string(
-        json.dumps({"upload_complete": True, "files": parquet_files}),
+        json.dumps(build_manifest(date, parquet_files, run_id, selftest)),
         content_type="application/json"
     )
     logger.info(f"📝 Wrote Parquet manifest to: {parquet_manifest_path}")
 
+    if WRITE_VIOLATIONS:
+        violations_manifest_path = f"{prefix}/{date}/violations/_manifest.json"
+        clean_row_bucket.blob(violations_manifest_path).upload_from_string(
+            json.dumps(build_manifest(date, violation_json_files, run_id, selftest)), content_type="application/json"
+        )
+        clean_col_bucket.blob(violations_manifest_path).upload_from_string(
+            json.dumps(build_manifest(date, violation_parquet_files, run_id, selftest)), content_type="application/json"
+        )
+        entries = violation_stats["violations_parsed"] + violation_stats["violation_parse_failures"]
+        rate = violation_stats["violation_parse_failures"] / entries if entries else 0.0
+        violation_stats["violation_parse_failure_rate"] = round(rate, 4)
+        logger.info(f"📝 Wrote violations manifests to: {violations_manifest_path}")
+        if rate > VIOLATION_PARSE_WARN_RATE:
+            logger.warning(f"⚠️ {rate:.1%} of {entries} violation entries could not be parsed")
+
+    records = violation_records = None
+    if output_columns:
+        records = write_lineage(date, run_id, "", output_columns, prefix=prefix)
+        if WRITE_VIOLATIONS:
+            violation_records = write_lineage(date, run_id, "violations/", list(VIOLATION_RECORD_LINEAGE), VIOLATION_RECORD_LINEAGE, prefix)
+    post_openlineage("COMPLETE", "cleaner", run_id, date, lineage_inputs(), lineage_outputs(records, violation_records, prefix))
+
     summary_msg = f"✅ Finished cleaning for {date} | Files cleaned: {cleaned_count}/{len(files)}"
     logger.info(f"=== {summary_msg} ===")
 
     duration = time.time() - start
+    performance = performance_stats(file_timings)
+    logger.info(f"⏱️ {len(file_timings)} file(s) in {duration:.1f}s on {CLEAN_WORKERS} worker(s) | "
+                f"per file p50 {performance['file_seconds_p50']}s, max {performance['file_seconds_max']}s")
+
+    # Rows the raw manifest says were extracted vs rows actually read; the
+    # trigger reports any shortfall as data loss
+    reconciliation = {"rows_received": rows_received, "rows_output": sum(o["rows"] for o in ndjson_files)}
+    totals = manifest.get("totals")
+    if totals:
+        reconciliation["rows_expected"] = totals.get("rows")
+        if rows_received != totals.get("rows"):
+            logger.warning(f"⚠️ Read {rows_received} rows but the manifest lists {totals.get('rows')}")
 
     notify_trigger(
         date=date,
         files_cleaned=cleaned_count,
         total_files=len(files),
         duration=duration,
-        trigger_url=TRIGGER_URL
+        run_id=run_id,
+        gcs_bytes_written=gcs_bytes_written,
+        reconciliation=reconciliation,
+        violation_stats=violation_stats if WRITE_VIOLATIONS else None,
+        performance=performance,
+        pipe=pipe,
     )
 
 
+# === Pipe Mode ===
+class PipeError(Exception):
+    """The extractor's stream broke off before its manifest; nothing was published."""
+
+
+def read_frame(stream) -> dict:
+    """Reads a frame's header line: a chunk's {"chunk", "size"} or the {"end", "manifest"} that ends the stream."""
+    try:
+        line = stream.readline()
+    except Exception as e:
+        raise PipeError(f"the stream broke off: {e}")
+    if not line.endswith(b"\n"):
+        raise PipeError("the stream ended before the manifest")
+    try:
+        frame = json.loads(line)
+        if not frame.get("end"):
+            frame["size"] = int(frame["size"])
+            frame["chunk"] = os.path.basename(frame["chunk"])
+    except (ValueError, KeyError, TypeError, AttributeError) as e:
+        raise PipeError(f"invalid frame {line[:200]!r}: {e}")
+    return frame
+
+
+def read_chunk(stream, size: int) -> bytes:
+    data = bytearray()
+    while len(data) < size:
+        try:
+            part = stream.read(size - len(data))
+        except Exception as e:
+            raise PipeError(f"the stream broke off: {e}")
+        if not part:
+            raise PipeError(f"the stream ended {size - len(data)} bytes into a chunk")
+        data += part
+    return bytes(data)
+
+
+def clean_stream(date: str, stream, run_id: str = None, job=None, selftest: bool = False) -> dict:
+    """Cleans the chunks the extractor streams to /stream while it writes them.
+
+    Each chunk is cleaned as it arrives, CLEAN_WORKERS at a time; while the
+    workers are busy the stream isn't read, and the extractor leaves the
+    chunks it can't send to the bucket. The raw manifest at the end of the
+    stream decides what is published, as for /clean: a streamed chunk that
+    doesn't match its manifest entry (e.g. a short chunk fetched again) is
+    cleaned again from the bucket, one the manifest doesn't list is left out,
+    and a listed file that wasn't streamed is cleaned from the bucket. Raises
+    PipeError, publishing nothing, when the stream ends without the manifest.
+    Returns the pipe fields of the completion event.
+    """
+    start = time.time()
+    logger.info(f"=== Cleaning the chunks piped for {date} ===")
+    post_openlineage("START", "cleaner", run_id, date, lineage_inputs(), lineage_outputs())
+
+    streamed = {}  # filename -> (crc32c, future)
+    manifest = None
+    with ThreadPoolExecutor(max_workers=CLEAN_WORKERS, thread_name_prefix="clean") as pool:
+        while manifest is None:
+            if job:
+                job.check()
+                job.progress(files_streamed=len(streamed))
+            frame = read_frame(stream)
+            if frame.get("end"):
+                manifest = check_manifest(frame.get("manifest") or {}, f"{RAW_PREFIX}/{date}")
+                continue
+            data = read_chunk(stream, frame["size"])
+            running = [f for _, f in streamed.values() if not f.done()]
+            if len(running) >= CLEAN_WORKERS:
+                wait(running, return_when=FIRST_COMPLETED)
+            name = frame["chunk"]
+            if name in streamed:
+                # Both would write the same cleaned files
+                wait([streamed[name][1]])
+            streamed[name] = (crc32c_b64(data), pool.submit(clean_file, date, name, data))
+
+        files = manifest.get("files") or []
+        if not files:
+            raise PipeError(f"the manifest for {date} lists no files")
+        objects = {o["name"]: o for o in manifest.get("objects") or []}
+        futures = {}
+        fetched = []
+        for filename in files:
+            crc, future = streamed.pop(filename, (None, None))
+            want = objects.get(filename)
+            if future is not None and (want is None or want.get("crc32c") == crc):
+                futures[filename] = future
+                continue
+            if future is not None:
+                wait([future])
+            fetched.append(filename)
+        if streamed:
+            # The loaders read the clean manifests, which don't list these
+            logger.warning(f"⚠️ Left out {len(streamed)} streamed chunk(s) the manifest doesn't list: {sorted(streamed)}")
+        # The streamed chunks were checked against their entries above
+        if VERIFY_MANIFEST and fetched:
+            verify_manifest(date, {"objects": [objects.get(f, {"name": f}) for f in fetched]})
+        for filename in fetched:
+            futures[filename] = pool.submit(clean_file, date, filename)
+
+        results = {}
+        for filename, future in futures.items():
+            try:
+                results[filename] = future.result()
+            except Exception as e:
+                logger.exception(f"❌ Error processing file {filename}: {e}")
+
+    pipe = {"piped": True, "files_streamed": len(files) - len(fetched), "files_fetched": len(fetched)}
+    logger.info(f"🚿 {pipe['files_streamed']} of {len(files)} file(s) streamed, {len(fetched)} read from the bucket")
+    complete_cleaning(date, run_id, selftest, manifest, results, start, pipe)
+    return pipe
+
+
+def handle_stream(request):
+    """POST /stream?date=&run_id=: an extraction piped to the cleaner, see clean_stream.
+
+    A failure isn't reported to the trigger: the extractor reports the run as
+    not piped and the trigger calls /clean, which reports its own.
+    """
+    if request.method != "POST":
+        return problem(request, 405, "method-not-allowed", "Only POST allowed")
+    date = request.args.get("date", "")
+    try:
+        datetime.strptime(date, "%Y-%m-%d")
+    except ValueError:
+        return problem(request, 400, "invalid-request", "Missing or invalid 'date'. Use YYYY-MM-DD.")
+    run_id = request.args.get("run_id")
+
+    job = jobs.start("clean", run_id, date)
+    try:
+        pipe = clean_stream(date, request.stream, run_id=run_id, job=job)
+        job.finish()
+    except PipeError as e:
+        job.finish(e)
+        logger.warning(f"⚠️ Discarded the chunks piped for {date}: {e}")
+        return problem(request, 400, "invalid-request", f"Incomplete stream: {e}")
+    except Exception as e:
+        job.finish(e)
+        logger.exception(f"❌ Piped cleaning failed for {date}: {e}")
+        return problem(request, 500, "internal", f"Server error: {e}", error_category=classify_error(e))
+    return (json.dumps(pipe), 200, {"Content-Type": "application/json"})
+
+
+# A /stream body carries a whole extraction; others are capped at HTTP_MAX_BODY_BYTES (see pyconfigure.wsgi)
+STREAM_MAX_BODY_BYTES = int(os.environ.get("STREAM_MAX_BODY_BYTES", str(2 << 30)))
+
+
 # === HTTP Entry Point ===
 # === HTTP Entry Point ===
 def http_entry_point(request):
     """Cloud Run / HTTP function entry point."""
     if request.path == "/health":
         return ("ok", 200, {"Content-Type": "text/plain"})
+
+    if request.path == "/admin/loglevel":
+        return admin_loglevel(request)
+
+    if request.path == "/jobs" or request.path.startswith("/jobs/"):
+        return handle_jobs(request)
+
+    if request.path == "/stream":
+        return handle_stream(request)
+
+    if request.path == "/readyz":
+        problems = readiness_problems()
+        status = 503 if problems else 200
+        return (json.dumps({"ready": not problems, "problems": problems}), status, {"Content-Type": "application/json"})
     
     try:
-        request_json = request.get_json()
+        request_json = request.get_json(silent=True)
         if not request_json:
-            return ("Invalid or missing JSON body", 400, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-json", "Invalid or missing JSON body")
 
         logger.info(f"📥 Received HTTP request: {request_json}")
         date = request_json.get("date")
         if not date:
-            return ("Missing 'date' in request JSON", 400, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-request", "Missing 'date' in request JSON")
 
         try:
             datetime.strptime(date, "%Y-%m-%d")
         except ValueError:
-            return ("Invalid 'date' format. Use YYYY-MM-DD.", 400, {"Content-Type": "text/plain"})
-
-        main(date)
-        return (f"✅ Cleaning started for {date}", 200, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-request", "Invalid 'date' format. Use YYYY-MM-DD.")
+
+        # The cleaning runs after the answer, so the trigger's call doesn't
+        # last as long as it does. A request repeated for a run already being
+        # cleaned gets that job back rather than starting a second one.
+        # Burst invocations write to a scratch prefix of their own, so they
+        # neither overwrite the date's cleaned files nor each other's.
+        run_id = request_json.get("run_id")
+        prefix = burst_prefix(run_id) if request_json.get("burst") else CLEAN_PREFIX
+        if prefix != CLEAN_PREFIX and not run_id:
+            return problem(request, 400, "invalid-request", "A burst invocation needs a 'run_id'")
+        with clean_start_lock:
+            running = [j for j in jobs.list("running") if j["kind"] == "clean" and j["date"] == date and j["run_id"] == run_id]
+            if run_id and running:
+                logger.info(f"♻️ Run {run_id} is already being cleaned by {running[0]['id']}")
+                return accepted(running[0]["id"], date, run_id)
+            job = jobs.start("clean", run_id, date)
+        threading.Thread(target=clean_in_background, args=(job, date, run_id, bool(request_json.get("selftest")), prefix),
+                         name=f"clean-{date}", daemon=True).start()
+        return accepted(job.id, date, run_id)
 
     except Exception as e:
         logger.exception(f"❌ HTTP request failed: {e}")
-        return (f"❌ Server error: {str(e)}", 500, {"Content-Type": "text/plain"})
+        return problem(request, 500, "internal", f"Server error: {e}", error_category=classify_error(e))
+
+
+# Held while /clean looks for a job of its run and starts one
+clean_start_lock = threading.Lock()
+
+
+def clean_in_background(job, date: str, run_id: str, selftest: bool, prefix: str = CLEAN_PREFIX):
+    """Cleans date for a /clean request that was already answered; a failure is reported to the trigger."""
+    try:
+        main(date, run_id=run_id, job=job, selftest=selftest, prefix=prefix)
+        job.finish()
+    except Exception as e:
+        logger.exception(f"❌ Cleaning failed for {date}: {e}")
+        job.finish(e)
+        notify_failure(date, run_id, e)
+    finally:
+        if prefix != CLEAN_PREFIX:
+            delete_scratch(prefix)
+
+
+def burst_prefix(run_id: str) -> str:
+    """Where a burst invocation of run_id writes its cleaned files instead of CLEAN_PREFIX."""
+    return f"scratch/burst/{run_id}/{CLEAN_PREFIX}"
+
+
+def delete_scratch(prefix: str):
+    """Deletes a burst invocation's output from both clean buckets once it has reported."""
+    deleted = 0
+    for bucket in (clean_row_bucket, clean_col_bucket):
+        try:
+            for blob in bucket.list_blobs(prefix=f"{prefix}/"):
+                blob.delete()
+                deleted += 1
+        except Exception as e:
+            logger.warning(f"⚠️ Could not delete scratch output under {bucket.name}/{prefix}: {e}")
+    logger.info(f"🧹 Deleted {deleted} scratch object(s) under {prefix}")
+
+
+def accepted(job_id: str, date: str, run_id: str):
+    """The 202 answer to /clean, pointing at the job to poll."""
+    body = {"message": f"✅ Cleaning started for {date}", "run_id": run_id, "date": date, "job": job_id}
+    return (json.dumps(body), 202, {"Content-Type": "application/json", "Location": f"/jobs/{job_id}"})
+
+
+wsgi_app = wsgi.app(http_entry_point, {"/stream": STREAM_MAX_BODY_BYTES})
 
 
-def wsgi_app(environ, start_response):
-    request = Request(environ)
-    response_text, status, headers = http_entry_point(request)
-    response = Response(response_text, status=status, headers=headers)
-    return response(environ, start_response)
+if __name__ == "__main__":
+    # Local mode: clean one date from the command line, e.g. python run_cleaner.py 2025-01-31
+    if len(sys.argv) != 2:
+        sys.exit("usage: run_cleaner.py YYYY-MM-DD")
+    main(sys.argv[1])
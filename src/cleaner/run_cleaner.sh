@@ -6,6 +6,6 @@ docker run --rm --name cleaner \
   -e BUCKET_NAME=raw-inspection-data-434 \
   -e CLEAN_ROW_BUCKET_NAME=cleaned-inspection-data-row-434 \
   -e CLEAN_COL_BUCKET_NAME=cleaned-inspection-data-column-434 \
-  -v "$HOME/gcp-creds/service-account.json:/app/creds.json" \
+  -v "${GCP_CREDENTIALS_FILE:-$HOME/gcp-creds/service-account.json}:/app/creds.json" \
   -e GOOGLE_APPLICATION_CREDENTIALS=/app/creds.json \
   cleaner
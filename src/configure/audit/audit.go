@@ -0,0 +1,206 @@
+// Package audit records admin and run operations (who called what, with which
+// payload, and how it went) to an append-only log that can be queried later.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"configure/logging"
+)
+
+// Record is one audited call.
+type Record struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Service  string          `json:"service"`
+	Action   string          `json:"action"`
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Caller   string          `json:"caller"`
+	CallerIP string          `json:"caller_ip,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Status   int             `json:"status"`
+	Outcome  string          `json:"outcome"` // ok | rejected | error
+	Response string          `json:"response,omitempty"`
+	Duration float64         `json:"duration_seconds"`
+}
+
+// Filter narrows a query; zero values match everything.
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Action string
+	Caller string
+	Limit  int
+}
+
+func (f Filter) match(r Record) bool {
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && r.Time.After(f.To) {
+		return false
+	}
+	if f.Action != "" && r.Action != f.Action {
+		return false
+	}
+	if f.Caller != "" && !strings.Contains(r.Caller, f.Caller) {
+		return false
+	}
+	return true
+}
+
+// Sink stores records. Implementations must never modify or drop earlier records.
+type Sink interface {
+	Append(ctx context.Context, r Record) error
+	Query(ctx context.Context, f Filter) ([]Record, error)
+}
+
+// Logger stamps records with the service name and writes them to a sink.
+// Every record is also logged as one JSON line so it reaches Cloud Logging
+// even when the sink is unavailable.
+type Logger struct {
+	Service string
+	Sink    Sink
+}
+
+func NewLogger(service string, sink Sink) *Logger {
+	return &Logger{Service: service, Sink: sink}
+}
+
+// Log appends r, filling in the ID, time and service.
+func (l *Logger) Log(ctx context.Context, r Record) {
+	r.ID = newID()
+	r.Service = l.Service
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+
+	line, _ := json.Marshal(map[string]interface{}{"audit": r})
+	log.Println(string(line))
+
+	if l.Sink == nil {
+		return
+	}
+	if err := l.Sink.Append(ctx, r); err != nil {
+		log.Printf("❌ Failed to append audit record %s: %v", r.ID, err)
+	}
+}
+
+// maxPayload caps how much of a request body is kept in a record.
+const maxPayload = 64 << 10
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.body.Len() < 512 {
+		s.body.Write(b[:min(len(b), 512-s.body.Len())])
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Wrap audits every call to next under action.
+func (l *Logger) Wrap(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		var payload json.RawMessage
+		if r.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, maxPayload))
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			payload = encodePayload(logging.Default().Bytes(body))
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		outcome := "ok"
+		switch {
+		case rec.status >= 500:
+			outcome = "error"
+		case rec.status >= 400:
+			outcome = "rejected"
+		}
+
+		l.Log(r.Context(), Record{
+			Time:     start.UTC(),
+			Action:   action,
+			Method:   r.Method,
+			Path:     r.URL.RequestURI(),
+			Caller:   Caller(r),
+			CallerIP: clientIP(r),
+			Payload:  payload,
+			Status:   rec.status,
+			Outcome:  outcome,
+			Response: logging.Redact(strings.TrimSpace(rec.body.String())),
+			Duration: time.Since(start).Seconds(),
+		})
+	}
+}
+
+// encodePayload keeps JSON bodies as-is and quotes anything else.
+func encodePayload(body []byte) json.RawMessage {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+// Caller identifies who made the request for the audit log, prefixing an
+// identity that couldn't be verified with Unverified; see Identity.
+func Caller(r *http.Request) string {
+	caller, _ := Identity(r)
+	return caller
+}
+
+// clientIP is the address the last proxy saw: the right-most entry of
+// X-Forwarded-For, as Cloud Run's front end appends it. Entries to its left
+// are whatever the client sent.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func newID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405.000000") + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"configure/logging"
+	"configure/problem"
+)
+
+// Handler serves GET /audit. Query parameters: from and to (RFC 3339 or
+// YYYY-MM-DD), action, caller (substring) and limit (default 100). The
+// records hold payloads and callers, so it needs the admin token.
+func (l *Logger) Handler() http.HandlerFunc {
+	return logging.RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only GET allowed")
+			return
+		}
+
+		q := r.URL.Query()
+		f := Filter{Action: q.Get("action"), Caller: q.Get("caller"), Limit: 100}
+		var err error
+		if f.From, err = parseTime(q.Get("from"), false); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid 'from': "+err.Error())
+			return
+		}
+		if f.To, err = parseTime(q.Get("to"), true); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid 'to': "+err.Error())
+			return
+		}
+		if v := q.Get("limit"); v != "" {
+			if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+				problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid 'limit'")
+				return
+			}
+		}
+
+		records, err := l.Sink.Query(r.Context(), f)
+		if err != nil {
+			log.Println("❌ Audit query failed:", err)
+			problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "Audit query failed: "+err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(records), "records": records})
+	})
+}
+
+// parseTime accepts RFC 3339 or a bare date; a bare "to" date covers the whole day.
+func parseTime(v string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"configure/gcp"
+)
+
+// GCSSink writes each record as its own object under
+// audit/YYYY-MM-DD/<service>/<id>.json. Objects are created with a
+// does-not-exist precondition, so existing records are never overwritten.
+type GCSSink struct {
+	Bucket string
+	Prefix string
+}
+
+func (s *GCSSink) Append(ctx context.Context, r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s/%s/%s/%s.json", s.Prefix, r.Time.Format("2006-01-02"), r.Service, r.ID)
+	return gcp.UploadObject(ctx, s.Bucket, name, data, "application/json", true)
+}
+
+// Query reads one day prefix at a time, newest day first; From defaults to a week ago.
+func (s *GCSSink) Query(ctx context.Context, f Filter) ([]Record, error) {
+	to := f.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	from := f.From
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -7)
+	}
+
+	var out []Record
+	for day := to.Truncate(24 * time.Hour); !day.Before(from.Truncate(24 * time.Hour)); day = day.AddDate(0, 0, -1) {
+		names, err := gcp.ListObjects(ctx, s.Bucket, fmt.Sprintf("%s/%s/", s.Prefix, day.Format("2006-01-02")))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			data, err := gcp.ReadObject(ctx, s.Bucket, name)
+			if err != nil {
+				return nil, err
+			}
+			var r Record
+			if err := json.Unmarshal(data, &r); err != nil {
+				log.Printf("⚠️ Skipping unreadable audit record %s: %v", name, err)
+				continue
+			}
+			if f.match(r) {
+				out = append(out, r)
+			}
+		}
+	}
+	return sortAndLimit(out, f.Limit), nil
+}
+
+// FileSink appends JSON lines to a local file; used when no bucket is configured.
+type FileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *FileSink) Append(ctx context.Context, r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileSink) Query(ctx context.Context, f Filter) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var out []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if f.match(r) {
+			out = append(out, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sortAndLimit(out, f.Limit), nil
+}
+
+func sortAndLimit(records []Record, limit int) []Record {
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.After(records[j].Time) })
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	if records == nil {
+		records = []Record{}
+	}
+	return records
+}
+
+// SinkFromEnv picks the sink from AUDIT_BUCKET (GCS) or AUDIT_LOG_PATH
+// (local file, default logs/audit.jsonl).
+func SinkFromEnv() Sink {
+	if bucket := os.Getenv("AUDIT_BUCKET"); bucket != "" {
+		prefix := os.Getenv("AUDIT_PREFIX")
+		if prefix == "" {
+			prefix = "audit"
+		}
+		return &GCSSink{Bucket: bucket, Prefix: prefix}
+	}
+	path := os.Getenv("AUDIT_LOG_PATH")
+	if path == "" {
+		path = "logs/audit.jsonl"
+	}
+	return &FileSink{Path: path}
+}
@@ -0,0 +1,303 @@
+package audit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys Google signs identities with: IAP's signed header assertions (ES256)
+// and the ID tokens Cloud Run invokers send (RS256).
+const (
+	iapKeysURL    = "https://www.gstatic.com/iap/verify/public_key-jwk"
+	googleKeysURL = "https://www.googleapis.com/oauth2/v3/certs"
+	iapIssuer     = "https://cloud.google.com/iap"
+
+	// keysTTL is how long fetched keys are used; Google rotates them over days
+	keysTTL = time.Hour
+	// clockSkew is allowed on a token's expiry and issue time
+	clockSkew = 30 * time.Second
+)
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// Unverified prefixes a caller named by a header Caller couldn't verify, so
+// the audit log never shows a claimed identity as an established one.
+const Unverified = "unverified:"
+
+// Identity is who made the request and whether Google vouched for it:
+//
+//   - the IAP user, from the X-Goog-IAP-JWT-Assertion header signed by IAP,
+//     checked against IAP_AUDIENCE when it is set;
+//   - else the email (or subject) of the Google-signed ID token in
+//     Authorization, issued for one of the comma-separated AUTH_AUDIENCES.
+//     Without them any Google-signed token would do, including one minted
+//     for another service, so the caller is recorded unverified;
+//   - else what X-Goog-Authenticated-User-Email, an unsigned bearer token or a
+//     Cloud Scheduler User-Agent claims, unverified;
+//   - else "anonymous".
+func Identity(r *http.Request) (caller string, verified bool) {
+	if assertion := r.Header.Get("X-Goog-IAP-JWT-Assertion"); assertion != "" {
+		c, err := verifyJWT(assertion, iapKeys, []string{iapIssuer}, audiences("IAP_AUDIENCE"))
+		if err == nil && c.Email != "" {
+			return c.Email, true
+		}
+	}
+	auds := audiences("AUTH_AUDIENCES")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && len(auds) > 0 {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if c, err := verifyJWT(token, googleKeys, googleIssuers, auds); err == nil {
+			if id := c.id(); id != "" {
+				return id, true
+			}
+		}
+	}
+
+	if email := r.Header.Get("X-Goog-Authenticated-User-Email"); email != "" {
+		return Unverified + strings.TrimPrefix(email, "accounts.google.com:"), false
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if c, err := readClaims(strings.TrimPrefix(auth, "Bearer ")); err == nil && c.id() != "" {
+			return Unverified + c.id(), false
+		}
+	}
+	if ua := r.Header.Get("User-Agent"); strings.HasPrefix(ua, "Google-Cloud-Scheduler") {
+		return Unverified + "cloud-scheduler", false
+	}
+	return "anonymous", false
+}
+
+func audiences(env string) []string {
+	var auds []string
+	for _, a := range strings.Split(os.Getenv(env), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			auds = append(auds, a)
+		}
+	}
+	return auds
+}
+
+type claims struct {
+	Issuer   string   `json:"iss"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	Email    string   `json:"email"`
+	Subject  string   `json:"sub"`
+}
+
+func (c claims) id() string {
+	if c.Email != "" {
+		return c.Email
+	}
+	if c.Subject != "" {
+		return "sub:" + c.Subject
+	}
+	return ""
+}
+
+// audience is a JWT "aud", a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// readClaims decodes a JWT's claims without checking its signature.
+func readClaims(token string) (claims, error) {
+	var c claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, errors.New("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(payload, &c)
+}
+
+// verifyJWT checks token's signature against keys, then its issuer, expiry
+// and, when auds is not empty, that it was issued for one of them.
+func verifyJWT(token string, keys *keySet, issuers, auds []string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims{}, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims{}, fmt.Errorf("header: %w", err)
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return claims{}, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims{}, fmt.Errorf("signature: %w", err)
+	}
+	key, err := keys.get(header.Kid)
+	if err != nil {
+		return claims{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return claims{}, errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return claims{}, errors.New("invalid signature")
+		}
+	default:
+		return claims{}, fmt.Errorf("unsupported key for %s", header.Alg)
+	}
+
+	c, err := readClaims(token)
+	if err != nil {
+		return c, err
+	}
+	now := time.Now()
+	switch {
+	case !slices.Contains(issuers, c.Issuer):
+		return c, fmt.Errorf("issuer %q not accepted", c.Issuer)
+	case now.After(time.Unix(c.Expiry, 0).Add(clockSkew)):
+		return c, errors.New("token expired")
+	case c.IssuedAt != 0 && time.Unix(c.IssuedAt, 0).After(now.Add(clockSkew)):
+		return c, errors.New("token issued in the future")
+	case len(auds) > 0 && !slices.ContainsFunc(c.Audience, func(a string) bool { return slices.Contains(auds, a) }):
+		return c, fmt.Errorf("audience %v not accepted", []string(c.Audience))
+	}
+	return c, nil
+}
+
+// keySet is a JSON Web Key Set fetched from url and kept for keysTTL. A key
+// ID it doesn't know fetches the set again, at most once a minute, so keys
+// Google adds are picked up before the TTL runs out.
+type keySet struct {
+	url string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var (
+	iapKeys    = &keySet{url: iapKeysURL}
+	googleKeys = &keySet{url: googleKeysURL}
+
+	keysClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+func (s *keySet) get(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	age := time.Since(s.fetched)
+	if key, ok := s.keys[kid]; ok && age < keysTTL {
+		return key, nil
+	}
+	if age > time.Minute {
+		// A failed fetch keeps the keys there are and is retried a minute later,
+		// so an unreachable key server doesn't slow every request down
+		keys, err := fetchKeys(s.url)
+		s.fetched = time.Now()
+		if err != nil && s.keys == nil {
+			return nil, fmt.Errorf("keys from %s: %w", s.url, err)
+		}
+		if err == nil {
+			s.keys = keys
+		}
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys downloads and parses a JSON Web Key Set.
+func fetchKeys(url string) (map[string]crypto.PublicKey, error) {
+	resp, err := keysClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(body)
+}
+
+// parseKeys reads the EC P-256 and RSA keys of a JSON Web Key Set.
+func parseKeys(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
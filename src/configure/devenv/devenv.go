@@ -0,0 +1,211 @@
+// Package devenv checks a developer machine for what the pipeline needs —
+// Application Default Credentials, the tools each stage is built or run
+// with, and the directories a local run writes to — the same way on
+// Windows, macOS and Linux. pipelinectl doctor reports on it.
+package devenv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// ErrNoCredentials is returned when no Application Default Credentials file is found.
+var ErrNoCredentials = errors.New("no application default credentials found")
+
+// Credentials is an Application Default Credentials file and what it is for.
+type Credentials struct {
+	Path    string // the file found
+	Source  string // GOOGLE_APPLICATION_CREDENTIALS or gcloud
+	Type    string // authorized_user, service_account, impersonated_service_account, ...
+	Account string // client_email, for a service account key
+	Project string // project_id or quota_project_id, when the file names one
+}
+
+// GcloudConfigDir is where gcloud keeps its configuration: CLOUDSDK_CONFIG,
+// else %APPDATA%\gcloud on Windows and ~/.config/gcloud elsewhere.
+func GcloudConfigDir() (string, error) {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	if runtime.GOOS == "windows" {
+		appData := os.Getenv("APPDATA")
+		if appData == "" {
+			return "", errors.New("APPDATA is not set")
+		}
+		return filepath.Join(appData, "gcloud"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "gcloud"), nil
+}
+
+// FindCredentials locates Application Default Credentials in the order the
+// client libraries do: the file GOOGLE_APPLICATION_CREDENTIALS names, then
+// the one gcloud auth application-default login writes. The metadata
+// server, which Cloud Run uses, isn't consulted.
+func FindCredentials() (*Credentials, error) {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return readCredentials(path, "GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	dir, err := GcloudConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoCredentials, err)
+	}
+	path := filepath.Join(dir, "application_default_credentials.json")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w (looked in %s)", ErrNoCredentials, path)
+	}
+	return readCredentials(path, "gcloud")
+}
+
+func readCredentials(path, source string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s credentials: %w", source, err)
+	}
+	var file struct {
+		Type           string `json:"type"`
+		ClientEmail    string `json:"client_email"`
+		ProjectID      string `json:"project_id"`
+		QuotaProjectID string `json:"quota_project_id"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s credentials %s: %w", source, path, err)
+	}
+	c := &Credentials{Path: path, Source: source, Type: file.Type, Account: file.ClientEmail, Project: file.ProjectID}
+	if c.Project == "" {
+		c.Project = file.QuotaProjectID
+	}
+	return c, nil
+}
+
+// Tool is a program a stage of the pipeline is built or run with. Commands
+// are the names it may go by, tried in order.
+type Tool struct {
+	Name     string
+	Commands []string
+	Required bool // needed for a local run, not just for containers or deploys
+	Purpose  string
+}
+
+// Tools are the programs pipelinectl doctor looks for.
+var Tools = []Tool{
+	{Name: "go", Commands: []string{"go"}, Required: true, Purpose: "builds and runs the extractor and trigger"},
+	{Name: "python", Commands: []string{"python3", "python", "py"}, Required: true, Purpose: "runs the cleaner and loaders"},
+	{Name: "docker", Commands: []string{"docker"}, Purpose: "runs the services with docker-compose"},
+	{Name: "gcloud", Commands: []string{"gcloud"}, Purpose: "deploys to Cloud Run and logs in for credentials"},
+}
+
+// Find returns the path of the first of t's commands on PATH.
+func (t Tool) Find() (string, bool) {
+	for _, name := range t.Commands {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// LocalBuckets are the bucket directories a local run reads and writes,
+// named for the services' default buckets.
+var LocalBuckets = []string{
+	"raw-inspection-data",
+	"cleaned-inspection-data-row-434",
+	"cleaned-inspection-data-column-434",
+}
+
+// DataDir is the root of a local run: LOCAL_DATA_DIR, else local-data in the
+// current directory, made absolute so every stage resolves it alike.
+func DataDir() (string, error) {
+	dir := os.Getenv("LOCAL_DATA_DIR")
+	if dir == "" {
+		dir = "local-data"
+	}
+	return filepath.Abs(dir)
+}
+
+// PrepareDataDir creates root and its bucket directories and checks that
+// root is writable.
+func PrepareDataDir(root string) error {
+	for _, bucket := range LocalBuckets {
+		if err := os.MkdirAll(filepath.Join(root, bucket), 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := os.CreateTemp(root, ".doctor-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", root, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Check is the outcome of one doctor check. A failed check that isn't
+// Required is only a warning.
+type Check struct {
+	Name     string
+	OK       bool
+	Required bool
+	Detail   string
+	Hint     string // how to fix a failed check
+}
+
+// Doctor checks the tools, credentials and local data directory under
+// dataDir, creating the directories as needed. Credentials are required only
+// for cloud, since a local run needs none.
+func Doctor(dataDir string, cloud bool) []Check {
+	var checks []Check
+	for _, t := range Tools {
+		c := Check{Name: t.Name, Required: t.Required || (cloud && t.Name == "gcloud")}
+		if path, ok := t.Find(); ok {
+			c.OK, c.Detail = true, path
+		} else {
+			c.Detail = "not found on PATH (" + t.Purpose + ")"
+			c.Hint = installHint(t.Name)
+		}
+		checks = append(checks, c)
+	}
+
+	creds := Check{Name: "credentials", Required: cloud}
+	if c, err := FindCredentials(); err != nil {
+		creds.Detail = err.Error()
+		creds.Hint = "run: gcloud auth application-default login (or set GOOGLE_APPLICATION_CREDENTIALS to a key file)"
+	} else {
+		creds.OK = true
+		creds.Detail = fmt.Sprintf("%s (%s via %s)", c.Path, c.Type, c.Source)
+		if c.Account != "" {
+			creds.Detail += " as " + c.Account
+		}
+	}
+	checks = append(checks, creds)
+
+	data := Check{Name: "data dir", Required: true}
+	if err := PrepareDataDir(dataDir); err != nil {
+		data.Detail = err.Error()
+		data.Hint = "set LOCAL_DATA_DIR to a writable directory"
+	} else {
+		data.OK, data.Detail = true, dataDir
+	}
+	return append(checks, data)
+}
+
+func installHint(tool string) string {
+	switch tool {
+	case "go":
+		return "install Go 1.23 or later from https://go.dev/dl/"
+	case "python":
+		return "install Python 3 and the packages in environment.yml (conda env create -f environment.yml)"
+	case "docker":
+		return "install Docker Desktop, or Docker Engine on Linux"
+	case "gcloud":
+		return "install the Google Cloud CLI from https://cloud.google.com/sdk/docs/install"
+	}
+	return ""
+}
@@ -0,0 +1,287 @@
+package devenv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"configure/gcp"
+	"configure/socrata"
+)
+
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+var probeClient = &http.Client{Timeout: 10 * time.Second}
+
+// EnvVar is a variable a service reads, and how to tell a bad value.
+type EnvVar struct {
+	Name     string
+	Services string // who reads it, for the report
+	Validate func(string) error
+}
+
+// EnvVars are the variables doctor checks. Unset ones are only warnings,
+// since which are needed depends on what is being run; a set but invalid
+// one fails, as the service would at startup or deep into a run.
+var EnvVars = []EnvVar{
+	{Name: "TRIGGER_URL", Services: "extractor, cleaner, loaders", Validate: absoluteURL},
+	{Name: "SERVICE_CONFIG_B64", Services: "trigger", Validate: base64JSON},
+	{Name: "BUCKET_NAME", Services: "extractor, loaders"},
+	{Name: "RAW_BUCKET", Services: "cleaner"},
+	{Name: "SOCRATA_HEADERS", Services: "extractor", Validate: jsonObject},
+	{Name: "GOOGLE_APPLICATION_CREDENTIALS", Services: "all, outside Cloud Run", Validate: existingFile},
+	{Name: "LOCAL_DATA_DIR", Services: "extractor, cleaner, loaders (local mode)"},
+}
+
+// CheckEnv checks each of EnvVars.
+func CheckEnv() []Check {
+	var checks []Check
+	for _, v := range EnvVars {
+		c := Check{Name: v.Name}
+		value, set := os.LookupEnv(v.Name)
+		switch {
+		case !set || value == "":
+			c.Detail = "not set (read by " + v.Services + ")"
+		case v.Validate != nil:
+			if err := v.Validate(value); err != nil {
+				c.Required = true
+				c.Detail = "invalid: " + err.Error()
+				c.Hint = "fix or unset " + v.Name
+				break
+			}
+			fallthrough
+		default:
+			c.OK = true
+			c.Detail = "set"
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func absoluteURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", s)
+	}
+	return nil
+}
+
+func base64JSON(s string) error {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("not base64: %w", err)
+	}
+	return jsonObject(string(data))
+}
+
+func jsonObject(s string) error {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return fmt.Errorf("not a JSON object: %w", err)
+	}
+	return nil
+}
+
+func existingFile(s string) error {
+	_, err := os.Stat(s)
+	return err
+}
+
+// AccessToken returns an OAuth access token for the developer's
+// credentials: GCP_ACCESS_TOKEN, else one gcloud mints from Application
+// Default Credentials. The configure/gcp calls use it once it is exported
+// as GCP_ACCESS_TOKEN.
+func AccessToken(ctx context.Context) (string, error) {
+	if t := os.Getenv("GCP_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+	out, err := exec.CommandContext(ctx, "gcloud", "auth", "application-default", "print-access-token").Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+			return "", fmt.Errorf("gcloud: %s", strings.TrimSpace(string(exit.Stderr)))
+		}
+		return "", fmt.Errorf("gcloud: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CheckToken asks Google whether token is valid, and for whom.
+func CheckToken(ctx context.Context, token string) Check {
+	c := Check{Name: "access token", Required: true}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenInfoURL+"?access_token="+url.QueryEscape(token), nil)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		c.Detail = "could not reach " + tokenInfoURL + ": " + err.Error()
+		c.Hint = "check the network connection or proxy settings"
+		return c
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Email     string `json:"email"`
+		ExpiresIn string `json:"expires_in"`
+		Error     string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&info)
+	if resp.StatusCode != http.StatusOK {
+		c.Detail = "rejected: " + resp.Status
+		if info.Error != "" {
+			c.Detail += " (" + info.Error + ")"
+		}
+		c.Hint = "run: gcloud auth application-default login"
+		return c
+	}
+	c.OK = true
+	c.Detail = "valid"
+	if info.Email != "" {
+		c.Detail += " for " + info.Email
+	}
+	if info.ExpiresIn != "" {
+		c.Detail += ", expires in " + info.ExpiresIn + "s"
+	}
+	return c
+}
+
+// BucketPermissions are what the pipeline's services do with a bucket.
+var BucketPermissions = []string{"storage.objects.list", "storage.objects.get", "storage.objects.create"}
+
+// CheckBucket checks that the credentials can list, read and write gs://bucket.
+func CheckBucket(ctx context.Context, bucket string) Check {
+	c := Check{Name: "gs://" + bucket, Required: true}
+	missing, err := gcp.MissingBucketPermissions(ctx, bucket, BucketPermissions)
+	switch {
+	case err != nil:
+		c.Detail = err.Error()
+		c.Hint = "check the bucket name, or create it with the trigger's /admin/bootstrap"
+	case len(missing) > 0:
+		c.Detail = "missing " + strings.Join(missing, ", ")
+		c.Hint = "grant roles/storage.objectAdmin on the bucket"
+	default:
+		c.OK, c.Detail = true, "read and write"
+	}
+	return c
+}
+
+// Table is a BigQuery table the pipeline loads or records into.
+type Table struct {
+	Dataset, Table string
+}
+
+// Tables are the tables doctor checks: the loaders' targets and the
+// monitoring tables every run writes.
+var Tables = []Table{
+	{"HygienePredictionRow", "CleanedInspectionRow"},
+	{"HygienePredictionColumn", "CleanedInspectionColumn"},
+	{"PipelineMonitoring", "chunk_metrics"},
+	{"PipelineMonitoring", "stage_metrics"},
+}
+
+// CheckTable checks that project.dataset.table exists and can be read.
+func CheckTable(ctx context.Context, project string, t Table) Check {
+	c := Check{Name: t.Dataset + "." + t.Table, Required: true}
+	cfg, err := gcp.GetTable(ctx, project, t.Dataset, t.Table)
+	switch {
+	case errors.Is(err, gcp.ErrNotFound):
+		c.Detail = "not found in " + project
+		c.Hint = "create it with the trigger's /admin/bootstrap, or run a load, which creates it"
+	case err != nil:
+		c.Detail = err.Error()
+		c.Hint = "grant roles/bigquery.dataEditor on the dataset"
+	default:
+		c.OK, c.Detail = true, fmt.Sprintf("%d columns", len(cfg.Columns))
+	}
+	return c
+}
+
+// CheckService GETs a service's health endpoint. A 401 or 403 still shows
+// the service is up, so it passes, noting that calls need an identity token.
+func CheckService(ctx context.Context, name, healthURL, audience string, required bool) Check {
+	c := Check{Name: name, Required: required}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	if audience != "" {
+		if token, err := gcp.IDToken(ctx, audience); err == nil {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	start := time.Now()
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "start the service, or fix its url in the service config"
+		return c
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start).Round(time.Millisecond)
+	switch {
+	case resp.StatusCode/100 == 2:
+		c.OK, c.Detail = true, fmt.Sprintf("%s in %s", healthURL, latency)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		c.OK, c.Detail = true, fmt.Sprintf("%s answered %s; calls need an identity token (GCP_ID_TOKEN)", healthURL, resp.Status)
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		c.Detail = fmt.Sprintf("%s answered %s %s", healthURL, resp.Status, strings.TrimSpace(string(msg)))
+		c.Hint = "check the service's logs"
+	}
+	return c
+}
+
+// CheckSocrata fetches one row from the dataset the extractor reads, with
+// the extractor's SOCRATA_USER_AGENT and SOCRATA_HEADERS.
+func CheckSocrata(ctx context.Context) Check {
+	c := Check{Name: "socrata", Required: true}
+	client := socrata.New(socrata.DatasetURL())
+	client.HTTP = probeClient
+	if ua := os.Getenv("SOCRATA_USER_AGENT"); ua != "" {
+		client.Header.Set("User-Agent", ua)
+	}
+	var headers map[string]string
+	if json.Unmarshal([]byte(os.Getenv("SOCRATA_HEADERS")), &headers) == nil {
+		for k, v := range headers {
+			client.Header.Set(k, v)
+		}
+	}
+	start := time.Now()
+	page, err := client.Get(ctx, socrata.Query{Limit: 1}, socrata.Validators{})
+	latency := time.Since(start).Round(time.Millisecond)
+	if err == nil {
+		_, err = page.Inspections()
+	}
+	switch {
+	case err == nil:
+		c.OK, c.Detail = true, fmt.Sprintf("%s in %s", client.Dataset, latency)
+	case page.Status == 0:
+		c.Detail = err.Error()
+		c.Hint = "check the network connection or proxy settings"
+	case page.Status == http.StatusTooManyRequests:
+		c.Detail = "throttled: " + http.StatusText(page.Status)
+		c.Hint = `set SOCRATA_HEADERS='{"X-App-Token":"..."}' with an app token from data.cityofchicago.org`
+	case page.Status == http.StatusOK:
+		c.Detail = "unexpected response: " + err.Error()
+		c.Hint = "the dataset's columns may have changed; compare with socrata.Inspection"
+	default:
+		c.Detail = fmt.Sprintf("answered %d %s", page.Status, http.StatusText(page.Status))
+		c.Hint = "check https://status.socrata.com, or SOCRATA_HEADERS if it sets a token"
+	}
+	return c
+}
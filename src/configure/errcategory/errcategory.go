@@ -0,0 +1,154 @@
+// Package errcategory sorts pipeline errors into a small set of categories so
+// failure events, metrics and alerts can be broken down by cause rather than
+// by free-text message.
+package errcategory
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Category is the kind of failure behind an error.
+type Category string
+
+const (
+	// TransientNetwork covers timeouts, resets and refused connections
+	TransientNetwork Category = "transient_network"
+	// Quota covers rate limiting and exhausted quotas
+	Quota Category = "quota"
+	// DataFormat covers records or responses that cannot be parsed or fail a contract
+	DataFormat Category = "data_format"
+	// Configuration covers missing settings, credentials, permissions and resources
+	Configuration Category = "configuration"
+	// Downstream covers a service or API that answered with an error of its own
+	Downstream Category = "downstream"
+	Unknown    Category = "unknown"
+)
+
+// Categorized is implemented by errors that know their own category.
+type Categorized interface {
+	ErrorCategory() Category
+}
+
+// Error attaches a category to an error without changing its message.
+type Error struct {
+	Category Category
+	Err      error
+}
+
+func (e *Error) Error() string           { return e.Err.Error() }
+func (e *Error) Unwrap() error           { return e.Err }
+func (e *Error) ErrorCategory() Category { return e.Category }
+
+// Wrap tags err with c. A nil err stays nil.
+func Wrap(c Category, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Category: c, Err: err}
+}
+
+// Errorf formats an error tagged with c; %w wraps as in fmt.Errorf.
+func Errorf(c Category, format string, args ...interface{}) error {
+	return &Error{Category: c, Err: fmt.Errorf(format, args...)}
+}
+
+// Of returns the category of err: the outermost explicit category in its
+// chain, else one inferred from well-known error types, else from its message.
+func Of(err error) Category {
+	if err == nil {
+		return ""
+	}
+	var c Categorized
+	if errors.As(err, &c) {
+		return c.ErrorCategory()
+	}
+
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var numErr *strconv.NumError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.As(err, &netErr):
+		return TransientNetwork
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.As(err, &numErr):
+		return DataFormat
+	}
+	return Classify(err.Error())
+}
+
+// Rules are the phrases Classify looks for, checked in order; the first
+// category with a matching phrase wins. The Python services read the same
+// file, so a message is categorised alike whichever service reports it.
+//
+//go:embed rules.json
+var Rules []byte
+
+var rules = func() []rule {
+	var r []rule
+	if err := json.Unmarshal(Rules, &r); err != nil {
+		panic("errcategory: invalid rules.json: " + err.Error())
+	}
+	return r
+}()
+
+type rule struct {
+	Category Category `json:"category"`
+	Phrases  []string `json:"phrases"`
+}
+
+// Classify infers a category from an error message, for errors that arrive as
+// text (e.g. from another service's failure event).
+func Classify(msg string) Category {
+	msg = strings.ToLower(msg)
+	for _, r := range rules {
+		for _, p := range r.Phrases {
+			if strings.Contains(msg, p) {
+				return r.Category
+			}
+		}
+	}
+	return Unknown
+}
+
+// FromStatus categorizes a non-2xx HTTP response.
+func FromStatus(code int) Category {
+	switch {
+	case code == 429:
+		return Quota
+	case code == 408:
+		return TransientNetwork
+	case code == 401 || code == 403 || code == 404:
+		return Configuration
+	case code == 400 || code == 413 || code == 415 || code == 422:
+		return DataFormat
+	}
+	return Downstream
+}
+
+// Parse accepts a category reported by another service; anything
+// unrecognised is Unknown.
+func Parse(s string) Category {
+	switch c := Category(s); c {
+	case TransientNetwork, Quota, DataFormat, Configuration, Downstream:
+		return c
+	}
+	return Unknown
+}
+
+// Retryable reports whether failures of category c may succeed if repeated.
+func Retryable(c Category) bool {
+	return c == TransientNetwork || c == Quota || c == Downstream
+}
@@ -0,0 +1,77 @@
+// Package eventschema versions the JSON payloads the services exchange: the
+// stage events posted to the trigger and the requests the trigger sends to
+// stages. Each payload carries schema_version, so a renamed or retyped field
+// can be read in both its old and new form while services are upgraded one
+// at a time.
+//
+// Version history:
+//
+//	1  no schema_version; durations and some counts sent as strings ("12.345")
+//	2  schema_version set; durations (seconds) and counts sent as JSON numbers
+package eventschema
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Field is the payload key holding the version.
+const Field = "schema_version"
+
+// Version is the version the services send.
+const Version = 2
+
+// Oldest is the oldest version Upgrade still reads.
+const Oldest = 1
+
+// Fields that version 1 payloads could send as strings.
+var numericV1 = []string{"duration", "files_processed", "files_cleaned", "total_files", "max_offset"}
+
+// Stamp sets the current version on payload and returns it.
+func Stamp(payload map[string]interface{}) map[string]interface{} {
+	payload[Field] = Version
+	return payload
+}
+
+// Seconds rounds a duration in seconds to milliseconds, as events report it.
+func Seconds(s float64) float64 {
+	return math.Round(s*1000) / 1000
+}
+
+// Of returns the version a payload was sent with; one without Field is version 1.
+func Of(payload map[string]interface{}) (int, error) {
+	v, ok := payload[Field]
+	if !ok || v == nil {
+		return 1, nil
+	}
+	n, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil || n != math.Trunc(n) {
+		return 0, fmt.Errorf("invalid %s %v", Field, v)
+	}
+	return int(n), nil
+}
+
+// Upgrade rewrites payload in place into the current version's form, leaving
+// Field as sent, and returns the version it was sent with. Versions older
+// than Oldest or newer than Version are an error, since their fields can't
+// be read reliably.
+func Upgrade(payload map[string]interface{}) (int, error) {
+	version, err := Of(payload)
+	if err != nil {
+		return 0, err
+	}
+	if version < Oldest || version > Version {
+		return version, fmt.Errorf("%s %d is not supported (this service reads %d to %d)", Field, version, Oldest, Version)
+	}
+	if version < 2 {
+		for _, key := range numericV1 {
+			if s, ok := payload[key].(string); ok {
+				if n, err := strconv.ParseFloat(s, 64); err == nil {
+					payload[key] = n
+				}
+			}
+		}
+	}
+	return version, nil
+}
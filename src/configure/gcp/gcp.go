@@ -0,0 +1,304 @@
+// Package gcp talks to the Cloud Storage JSON API over plain net/http so that
+// services without the Cloud SDK (the trigger) can still read and write objects.
+// It also covers the few BigQuery and IAM calls needed to provision a project.
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	metadataTokenURL    = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	metadataIdentityURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+	storageAPI          = "https://storage.googleapis.com/storage/v1"
+	uploadAPI           = "https://storage.googleapis.com/upload/storage/v1"
+)
+
+// ErrPreconditionFailed is returned when an object written with ifNotExists already exists.
+var ErrPreconditionFailed = errors.New("object already exists")
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+var (
+	tokenMu     sync.Mutex
+	cachedToken string
+	tokenExpiry time.Time
+)
+
+// Token returns an access token for the runtime service account. On Cloud Run
+// it comes from the metadata server; locally GCP_ACCESS_TOKEN can supply one.
+func Token(ctx context.Context) (string, error) {
+	if t := os.Getenv("GCP_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if cachedToken != "" && time.Now().Before(tokenExpiry) {
+		return cachedToken, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("metadata token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata token: %s", resp.Status)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("metadata token: %w", err)
+	}
+	cachedToken = tok.AccessToken
+	// Refresh a minute early so in-flight requests never carry an expired token
+	tokenExpiry = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return cachedToken, nil
+}
+
+var (
+	idTokenMu sync.Mutex
+	idTokens  = make(map[string]cachedIDToken)
+)
+
+type cachedIDToken struct {
+	token  string
+	expiry time.Time
+}
+
+// IDToken returns an OIDC identity token for audience, as Cloud Run expects on
+// calls to services that require authentication. Locally GCP_ID_TOKEN can supply one.
+func IDToken(ctx context.Context, audience string) (string, error) {
+	if t := os.Getenv("GCP_ID_TOKEN"); t != "" {
+		return t, nil
+	}
+
+	idTokenMu.Lock()
+	defer idTokenMu.Unlock()
+	if c, ok := idTokens[audience]; ok && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+
+	u := metadataIdentityURL + "?audience=" + url.QueryEscape(audience) + "&format=full"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("metadata identity token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata identity token: %s", resp.Status)
+	}
+	tok, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("metadata identity token: %w", err)
+	}
+	// Identity tokens live for an hour; refresh well before that
+	idTokens[audience] = cachedIDToken{token: string(bytes.TrimSpace(tok)), expiry: time.Now().Add(50 * time.Minute)}
+	return idTokens[audience].token, nil
+}
+
+func do(ctx context.Context, method, rawURL string, body []byte, contentType string) (*http.Response, error) {
+	token, err := Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return client.Do(req)
+}
+
+func apiError(op string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s: %s", op, resp.Status, bytes.TrimSpace(msg))
+}
+
+// UploadObject writes data to gs://bucket/name. With ifNotExists the write
+// fails with ErrPreconditionFailed instead of replacing an existing object.
+func UploadObject(ctx context.Context, bucket, name string, data []byte, contentType string, ifNotExists bool) error {
+	q := url.Values{"uploadType": {"media"}, "name": {name}}
+	if ifNotExists {
+		q.Set("ifGenerationMatch", "0")
+	}
+	resp, err := do(ctx, http.MethodPost, fmt.Sprintf("%s/b/%s/o?%s", uploadAPI, url.PathEscape(bucket), q.Encode()), data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
+	if resp.StatusCode != http.StatusOK {
+		return apiError("upload "+name, resp)
+	}
+	return nil
+}
+
+// ListObjects returns the names of all objects under prefix.
+func ListObjects(ctx context.Context, bucket, prefix string) ([]string, error) {
+	objects, err := ListObjectInfo(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = o.Name
+	}
+	return names, nil
+}
+
+// ObjectInfo is the listing metadata of one object.
+type ObjectInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size,string"`
+	Updated time.Time `json:"updated"`
+}
+
+// ListObjectInfo returns name, size and update time of the objects under prefix.
+func ListObjectInfo(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	pageToken := ""
+	for {
+		q := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		resp, err := do(ctx, http.MethodGet, fmt.Sprintf("%s/b/%s/o?%s", storageAPI, url.PathEscape(bucket), q.Encode()), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := apiError("list "+prefix, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var page struct {
+			Items         []ObjectInfo `json:"items"`
+			NextPageToken string       `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		objects = append(objects, page.Items...)
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// ListPrefixes returns the "folders" directly under prefix, each ending in
+// "/", without listing the objects inside them.
+func ListPrefixes(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var prefixes []string
+	pageToken := ""
+	for {
+		q := url.Values{"prefix": {prefix}, "delimiter": {"/"}, "fields": {"prefixes,nextPageToken"}}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		resp, err := do(ctx, http.MethodGet, fmt.Sprintf("%s/b/%s/o?%s", storageAPI, url.PathEscape(bucket), q.Encode()), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := apiError("list "+prefix, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var page struct {
+			Prefixes      []string `json:"prefixes"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		prefixes = append(prefixes, page.Prefixes...)
+		if page.NextPageToken == "" {
+			return prefixes, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// ReadObject downloads gs://bucket/name.
+func ReadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	resp, err := do(ctx, http.MethodGet, fmt.Sprintf("%s/b/%s/o/%s?alt=media", storageAPI, url.PathEscape(bucket), url.PathEscape(name)), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError("read "+name, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// DeleteObject removes gs://bucket/name; an object that is already gone is not an error.
+func DeleteObject(ctx context.Context, bucket, name string) error {
+	resp, err := do(ctx, http.MethodDelete, fmt.Sprintf("%s/b/%s/o/%s", storageAPI, url.PathEscape(bucket), url.PathEscape(name)), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return apiError("delete "+name, resp)
+	}
+	return nil
+}
+
+const pubsubAPI = "https://pubsub.googleapis.com/v1"
+
+// PublishMessage publishes data, with attributes, to a Pub/Sub topic given
+// as projects/{project}/topics/{topic}.
+func PublishMessage(ctx context.Context, topic string, data []byte, attributes map[string]string) error {
+	// data marshals to base64, as the API expects it
+	body, err := json.Marshal(map[string]any{
+		"messages": []map[string]any{{"data": data, "attributes": attributes}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := do(ctx, http.MethodPost, pubsubAPI+"/"+topic+":publish", body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError("publish to "+topic, resp)
+	}
+	return nil
+}
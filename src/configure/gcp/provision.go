@@ -0,0 +1,367 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	bigqueryAPI = "https://bigquery.googleapis.com/bigquery/v2"
+	projectsAPI = "https://cloudresourcemanager.googleapis.com/v1"
+)
+
+// CreateBucket creates gs://name in project with uniform bucket-level access
+// and, when deleteAfterDays is positive, a lifecycle rule deleting objects
+// that old. created is false when the bucket already exists.
+func CreateBucket(ctx context.Context, project, name, location string, deleteAfterDays int) (created bool, err error) {
+	bucket := map[string]any{
+		"name":             name,
+		"location":         location,
+		"iamConfiguration": map[string]any{"uniformBucketLevelAccess": map[string]bool{"enabled": true}},
+	}
+	if deleteAfterDays > 0 {
+		bucket["lifecycle"] = map[string]any{"rule": []map[string]any{{
+			"action":    map[string]string{"type": "Delete"},
+			"condition": map[string]int{"age": deleteAfterDays},
+		}}}
+	}
+	body, err := json.Marshal(bucket)
+	if err != nil {
+		return false, err
+	}
+	resp, err := do(ctx, http.MethodPost, fmt.Sprintf("%s/b?project=%s", storageAPI, url.QueryEscape(project)), body, "application/json")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, apiError("create bucket "+name, resp)
+}
+
+// MissingBucketPermissions returns the permissions in perms the runtime
+// service account lacks on gs://bucket.
+func MissingBucketPermissions(ctx context.Context, bucket string, perms []string) ([]string, error) {
+	q := url.Values{"permissions": perms}
+	resp, err := do(ctx, http.MethodGet, fmt.Sprintf("%s/b/%s/iam/testPermissions?%s", storageAPI, url.PathEscape(bucket), q.Encode()), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError("test permissions on "+bucket, resp)
+	}
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return nil, fmt.Errorf("test permissions on %s: %w", bucket, err)
+	}
+	return missing(perms, granted.Permissions), nil
+}
+
+// MissingProjectPermissions returns the permissions in perms the runtime
+// service account lacks on project.
+func MissingProjectPermissions(ctx context.Context, project string, perms []string) ([]string, error) {
+	body, err := json.Marshal(map[string][]string{"permissions": perms})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(ctx, http.MethodPost, fmt.Sprintf("%s/projects/%s:testIamPermissions", projectsAPI, url.PathEscape(project)), body, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError("test permissions on project "+project, resp)
+	}
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return nil, fmt.Errorf("test permissions on project %s: %w", project, err)
+	}
+	return missing(perms, granted.Permissions), nil
+}
+
+func missing(want, granted []string) []string {
+	have := make(map[string]bool, len(granted))
+	for _, p := range granted {
+		have[p] = true
+	}
+	var out []string
+	for _, p := range want {
+		if !have[p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// RunQuery runs a GoogleSQL statement, typically DDL, as a BigQuery job in
+// project and waits up to 25s for it to finish.
+func RunQuery(ctx context.Context, project, location, sql string) error {
+	_, err := query(ctx, project, location, sql)
+	return err
+}
+
+// QueryRows runs a GoogleSQL query like RunQuery and returns its rows, each
+// mapping a column name to its value as BigQuery sends it: a string, or nil
+// for NULL. Only the first page of results is read, so the query should
+// aggregate or LIMIT.
+func QueryRows(ctx context.Context, project, location, sql string) ([]map[string]any, error) {
+	result, err := query(ctx, project, location, sql)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]map[string]any, len(result.Rows))
+	for i, r := range result.Rows {
+		rows[i] = make(map[string]any, len(r.F))
+		for j, cell := range r.F {
+			if j < len(result.Schema.Fields) {
+				rows[i][result.Schema.Fields[j].Name] = cell.V
+			}
+		}
+	}
+	return rows, nil
+}
+
+type queryResult struct {
+	JobComplete bool `json:"jobComplete"`
+	Errors      []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Schema struct {
+		Fields []struct {
+			Name string `json:"name"`
+		} `json:"fields"`
+	} `json:"schema"`
+	Rows []struct {
+		F []struct {
+			V any `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+}
+
+func query(ctx context.Context, project, location, sql string) (queryResult, error) {
+	var result queryResult
+	body, err := json.Marshal(map[string]any{
+		"query":        sql,
+		"useLegacySql": false,
+		"location":     location,
+		"timeoutMs":    25000, // under the HTTP client timeout
+	})
+	if err != nil {
+		return result, err
+	}
+	resp, err := do(ctx, http.MethodPost, fmt.Sprintf("%s/projects/%s/queries", bigqueryAPI, url.PathEscape(project)), body, "application/json")
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result, apiError("query", resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("query: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		msgs := make([]string, len(result.Errors))
+		for i, e := range result.Errors {
+			msgs[i] = e.Message
+		}
+		return result, fmt.Errorf("query: %s", strings.Join(msgs, "; "))
+	}
+	if !result.JobComplete {
+		return result, fmt.Errorf("query: not finished after 25s")
+	}
+	return result, nil
+}
+
+// InsertRows streams rows, each marshalled to a JSON object, into
+// project.dataset.table, failing if any row is rejected.
+func InsertRows[T any](ctx context.Context, project, dataset, table string, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	type insertRow struct {
+		JSON T `json:"json"`
+	}
+	req := struct {
+		Rows []insertRow `json:"rows"`
+	}{Rows: make([]insertRow, len(rows))}
+	for i, r := range rows {
+		req.Rows[i].JSON = r
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	what := "insert into " + dataset + "." + table
+	resp, err := do(ctx, http.MethodPost, fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s/insertAll", bigqueryAPI,
+		url.PathEscape(project), url.PathEscape(dataset), url.PathEscape(table)), body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError(what, resp)
+	}
+	var result struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	if len(result.InsertErrors) > 0 {
+		e := result.InsertErrors[0]
+		msg := "rejected"
+		if len(e.Errors) > 0 {
+			msg = e.Errors[0].Message
+		}
+		return fmt.Errorf("%s: %d rows rejected, row %d: %s", what, len(result.InsertErrors), e.Index, msg)
+	}
+	return nil
+}
+
+// ErrNotFound is returned when a bucket, dataset or table does not exist.
+var ErrNotFound = errors.New("not found")
+
+// BucketConfig is the part of a bucket's configuration the pipeline depends on.
+type BucketConfig struct {
+	Location        string
+	UniformAccess   bool
+	DeleteAfterDays []int // ages of the lifecycle rules that delete objects
+}
+
+// GetBucket reads gs://bucket's configuration.
+func GetBucket(ctx context.Context, bucket string) (BucketConfig, error) {
+	var b struct {
+		Location         string `json:"location"`
+		IAMConfiguration struct {
+			UniformBucketLevelAccess struct {
+				Enabled bool `json:"enabled"`
+			} `json:"uniformBucketLevelAccess"`
+		} `json:"iamConfiguration"`
+		Lifecycle struct {
+			Rule []struct {
+				Action struct {
+					Type string `json:"type"`
+				} `json:"action"`
+				Condition struct {
+					Age *int `json:"age"`
+				} `json:"condition"`
+			} `json:"rule"`
+		} `json:"lifecycle"`
+	}
+	if err := getJSON(ctx, fmt.Sprintf("%s/b/%s", storageAPI, url.PathEscape(bucket)), "bucket "+bucket, &b); err != nil {
+		return BucketConfig{}, err
+	}
+	cfg := BucketConfig{Location: b.Location, UniformAccess: b.IAMConfiguration.UniformBucketLevelAccess.Enabled}
+	for _, r := range b.Lifecycle.Rule {
+		if r.Action.Type == "Delete" && r.Condition.Age != nil {
+			cfg.DeleteAfterDays = append(cfg.DeleteAfterDays, *r.Condition.Age)
+		}
+	}
+	return cfg, nil
+}
+
+// GetDatasetLocation returns where project.dataset stores its data.
+func GetDatasetLocation(ctx context.Context, project, dataset string) (string, error) {
+	var d struct {
+		Location string `json:"location"`
+	}
+	err := getJSON(ctx, fmt.Sprintf("%s/projects/%s/datasets/%s", bigqueryAPI, url.PathEscape(project), url.PathEscape(dataset)), "dataset "+dataset, &d)
+	return d.Location, err
+}
+
+// Regions and the dual-region inside the EU multi-region; London and Zurich
+// are in Europe but not in it.
+var euLocations = map[string]bool{
+	"EUROPE-WEST1": true, "EUROPE-WEST3": true, "EUROPE-WEST4": true, "EUROPE-WEST8": true,
+	"EUROPE-WEST9": true, "EUROPE-WEST10": true, "EUROPE-WEST12": true, "EUROPE-NORTH1": true,
+	"EUROPE-NORTH2": true, "EUROPE-CENTRAL2": true, "EUROPE-SOUTHWEST1": true, "EUR4": true,
+}
+
+// LoadableInto reports whether BigQuery can load from, or read external tables
+// over, a bucket in bucketLocation into a dataset in datasetLocation. The
+// bucket has to be in the dataset's location or inside its multi-region
+// (europe-west1 for EU), except that a dataset in the US multi-region takes
+// any bucket.
+func LoadableInto(bucketLocation, datasetLocation string) bool {
+	b, d := strings.ToUpper(bucketLocation), strings.ToUpper(datasetLocation)
+	switch {
+	case b == d, d == "US":
+		return true
+	case d == "EU":
+		return euLocations[b]
+	}
+	return false
+}
+
+// Column is one top-level column of a BigQuery table, with the legacy type
+// names the API reports (INTEGER, FLOAT, BOOLEAN, ...).
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// TableConfig is the part of a table's configuration the pipeline depends on.
+type TableConfig struct {
+	Columns        []Column
+	PartitionField string // empty when the table is not column-partitioned
+	View           bool   // a view over other tables rather than a table
+	ViewQuery      string // the view's SQL, when View
+}
+
+// GetTable reads project.dataset.table's schema and partitioning, and a
+// view's query.
+func GetTable(ctx context.Context, project, dataset, table string) (TableConfig, error) {
+	var t struct {
+		Schema struct {
+			Fields []Column `json:"fields"`
+		} `json:"schema"`
+		TimePartitioning struct {
+			Field string `json:"field"`
+		} `json:"timePartitioning"`
+		Type string `json:"type"`
+		View struct {
+			Query string `json:"query"`
+		} `json:"view"`
+	}
+	err := getJSON(ctx, fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s", bigqueryAPI, url.PathEscape(project), url.PathEscape(dataset), url.PathEscape(table)), "table "+dataset+"."+table, &t)
+	return TableConfig{Columns: t.Schema.Fields, PartitionField: t.TimePartitioning.Field, View: t.Type == "VIEW", ViewQuery: t.View.Query}, err
+}
+
+func getJSON(ctx context.Context, rawURL, what string, v any) error {
+	resp, err := do(ctx, http.MethodGet, rawURL, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", what, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return apiError("get "+what, resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("get %s: %w", what, err)
+	}
+	return nil
+}
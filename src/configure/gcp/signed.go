@@ -0,0 +1,164 @@
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataEmailURL  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/email"
+	iamCredentialsAPI = "https://iamcredentials.googleapis.com/v1"
+	storageHost       = "storage.googleapis.com"
+)
+
+// MaxSignedURLExpiry is the longest a V4 signed URL can be valid.
+const MaxSignedURLExpiry = 7 * 24 * time.Hour
+
+var (
+	emailMu     sync.Mutex
+	cachedEmail string
+)
+
+// ServiceAccountEmail returns the runtime service account's email: from the
+// metadata server on Cloud Run, or GCP_SERVICE_ACCOUNT locally.
+func ServiceAccountEmail(ctx context.Context) (string, error) {
+	if e := os.Getenv("GCP_SERVICE_ACCOUNT"); e != "" {
+		return e, nil
+	}
+
+	emailMu.Lock()
+	defer emailMu.Unlock()
+	if cachedEmail != "" {
+		return cachedEmail, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataEmailURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("metadata email: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata email: %s", resp.Status)
+	}
+	email, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("metadata email: %w", err)
+	}
+	cachedEmail = string(bytes.TrimSpace(email))
+	return cachedEmail, nil
+}
+
+// SignedURL returns a V4 signed URL that lets whoever holds it GET
+// gs://bucket/name for expires (at most MaxSignedURLExpiry). signer is the
+// service account that signs it, the runtime account when empty. The
+// signature comes from the IAM Credentials signBlob API, so no private key
+// is needed, but the caller needs roles/iam.serviceAccountTokenCreator on
+// signer (on itself, for the runtime account) and signer needs read access
+// to the object.
+func SignedURL(ctx context.Context, bucket, name, signer string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > MaxSignedURLExpiry {
+		return "", fmt.Errorf("signed URL expiry %s is not between 0 and %s", expires, MaxSignedURLExpiry)
+	}
+	if signer == "" {
+		var err error
+		if signer, err = ServiceAccountEmail(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    signer + "/" + scope,
+		"X-Goog-Date":          now.Format("20060102T150405Z"),
+		"X-Goog-Expires":       strconv.Itoa(int(expires.Seconds())),
+		"X-Goog-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = uriEscape(k, false) + "=" + uriEscape(query[k], false)
+	}
+	canonicalQuery := strings.Join(params, "&")
+	path := "/" + bucket + "/" + uriEscape(name, true)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		path,
+		canonicalQuery,
+		"host:" + storageHost + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", query["X-Goog-Date"], scope, hex.EncodeToString(digest[:])}, "\n")
+
+	signature, err := signBlob(ctx, signer, []byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+	return "https://" + storageHost + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// signBlob signs payload with a Google-managed key of serviceAccount.
+func signBlob(ctx context.Context, serviceAccount string, payload []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"payload": base64.StdEncoding.EncodeToString(payload)})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(ctx, http.MethodPost, fmt.Sprintf("%s/projects/-/serviceAccounts/%s:signBlob", iamCredentialsAPI, url.PathEscape(serviceAccount)), body, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError("sign as "+serviceAccount, resp)
+	}
+	var out struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("sign as %s: %w", serviceAccount, err)
+	}
+	return base64.StdEncoding.DecodeString(out.SignedBlob)
+}
+
+// uriEscape percent-encodes s as V4 signing expects: everything but the
+// unreserved characters, and "/" too unless keepSlash.
+func uriEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,3 @@
+module configure
+
+go 1.22
@@ -0,0 +1,321 @@
+// Package jobs tracks the work a service runs in the background, so each
+// service answers /jobs the same way: what is running, how far it got, how
+// it ended. A job is started with a context that Cancel cancels; the work
+// reports progress through the context and ends the job with its error.
+// Finished jobs are kept for a TTL (JOBS_TTL, default 24h) and then evicted.
+//
+// The registry is in memory, so it only knows this instance's jobs. The
+// Python services keep the same registry and JSON shape in their own code.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"configure/problem"
+)
+
+// State is where a job is in its lifecycle.
+type State string
+
+const (
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+	Cancelled State = "cancelled"
+)
+
+// Job is the reported state of one job.
+type Job struct {
+	ID         string         `json:"id"`
+	Kind       string         `json:"kind"` // e.g. extract, clean, load
+	RunID      string         `json:"run_id,omitempty"`
+	Date       string         `json:"date,omitempty"`
+	State      State          `json:"state"`
+	Progress   map[string]any `json:"progress,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+type entry struct {
+	job    Job
+	cancel context.CancelFunc
+}
+
+// Registry holds the jobs of one process. It is safe for concurrent use.
+type Registry struct {
+	mu     sync.Mutex
+	jobs   map[string]*entry
+	ttl    time.Duration
+	active atomic.Int64
+}
+
+// NewRegistry keeps finished jobs for ttl.
+func NewRegistry(ttl time.Duration) *Registry {
+	return &Registry{jobs: make(map[string]*entry), ttl: ttl}
+}
+
+// FromEnv keeps finished jobs for JOBS_TTL (a Go duration), default 24h.
+func FromEnv() *Registry {
+	ttl := 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("JOBS_TTL")); err == nil && d > 0 {
+		ttl = d
+	}
+	return NewRegistry(ttl)
+}
+
+// Handle is what the work uses to report on its job. A nil Handle does
+// nothing, so code can run with or without a registry.
+type Handle struct {
+	r  *Registry
+	id string
+}
+
+type handleKey struct{}
+
+// Start registers a running job and returns a context for the work, derived
+// from parent, that carries the job's handle and is cancelled by Cancel.
+func (r *Registry) Start(parent context.Context, kind, runID, date string) (context.Context, *Handle) {
+	ctx, cancel := context.WithCancel(parent)
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	now := time.Now().UTC()
+	job := Job{
+		ID:        kind + "-" + hex.EncodeToString(b),
+		Kind:      kind,
+		RunID:     runID,
+		Date:      date,
+		State:     Running,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+
+	r.mu.Lock()
+	r.evict(now)
+	r.jobs[job.ID] = &entry{job: job, cancel: cancel}
+	r.mu.Unlock()
+	r.active.Add(1)
+
+	h := &Handle{r: r, id: job.ID}
+	return context.WithValue(ctx, handleKey{}, h), h
+}
+
+// FromContext returns the handle of the job ctx belongs to, or nil.
+func FromContext(ctx context.Context) *Handle {
+	h, _ := ctx.Value(handleKey{}).(*Handle)
+	return h
+}
+
+// Progress merges fields into the progress of the job ctx belongs to.
+func Progress(ctx context.Context, fields map[string]any) {
+	FromContext(ctx).Progress(fields)
+}
+
+// ID returns the job's ID ("" for a nil Handle).
+func (h *Handle) ID() string {
+	if h == nil {
+		return ""
+	}
+	return h.id
+}
+
+// Progress merges fields into the job's progress.
+func (h *Handle) Progress(fields map[string]any) {
+	if h == nil {
+		return
+	}
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	e, ok := h.r.jobs[h.id]
+	if !ok || e.job.State != Running {
+		return
+	}
+	if e.job.Progress == nil {
+		e.job.Progress = make(map[string]any, len(fields))
+	}
+	for k, v := range fields {
+		e.job.Progress[k] = v
+	}
+	e.job.UpdatedAt = time.Now().UTC()
+}
+
+// Finish ends the job: succeeded without err, cancelled if err is or wraps
+// context.Canceled, failed otherwise. Only the first call counts.
+func (h *Handle) Finish(err error) {
+	if h == nil {
+		return
+	}
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	e, ok := h.r.jobs[h.id]
+	if !ok || e.job.State != Running {
+		return
+	}
+	now := time.Now().UTC()
+	switch {
+	case err == nil:
+		e.job.State = Succeeded
+	case errors.Is(err, context.Canceled):
+		e.job.State = Cancelled
+		e.job.Error = err.Error()
+	default:
+		e.job.State = Failed
+		e.job.Error = err.Error()
+	}
+	e.job.UpdatedAt, e.job.FinishedAt = now, &now
+	e.cancel()
+	h.r.active.Add(-1)
+}
+
+// PanicError is a panic recovered from a job's work.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+// Safely runs fn and returns its error, or a *PanicError if it panics, so a
+// bug in background work fails the job instead of the whole process. The
+// panic is logged with its stack.
+func Safely(fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			stack := debug.Stack()
+			log.Printf("🔥 Recovered panic: %v\n%s", v, stack)
+			err = &PanicError{Value: v, Stack: stack}
+		}
+	}()
+	return fn()
+}
+
+// Get returns a copy of job id.
+func (r *Registry) Get(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return snapshot(e.job), true
+}
+
+// List returns copies of the jobs, newest first.
+func (r *Registry) List() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evict(time.Now().UTC())
+	out := make([]Job, 0, len(r.jobs))
+	for _, e := range r.jobs {
+		out = append(out, snapshot(e.job))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+// Cancel cancels a running job's context. The job stays running until its
+// work notices and calls Finish. It reports whether the job was running.
+func (r *Registry) Cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.jobs[id]
+	if !ok || e.job.State != Running {
+		return false
+	}
+	e.cancel()
+	return true
+}
+
+// Active returns the number of running jobs.
+func (r *Registry) Active() int {
+	return int(r.active.Load())
+}
+
+// evict drops jobs that finished more than ttl ago; r.mu must be held.
+func (r *Registry) evict(now time.Time) {
+	for id, e := range r.jobs {
+		if e.job.FinishedAt != nil && now.Sub(*e.job.FinishedAt) > r.ttl {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+func snapshot(j Job) Job {
+	if j.Progress != nil {
+		p := make(map[string]any, len(j.Progress))
+		for k, v := range j.Progress {
+			p[k] = v
+		}
+		j.Progress = p
+	}
+	return j
+}
+
+// Register serves the registry on mux: GET /jobs lists the jobs (newest
+// first, ?state= filters), GET /jobs/{id} returns one and POST
+// /jobs/{id}/cancel cancels it. Cancelling needs the ADMIN_TOKEN secret in
+// X-Admin-Token, as the /admin endpoints do.
+func (r *Registry) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, req *http.Request) {
+		want := State(req.URL.Query().Get("state"))
+		list := []Job{}
+		for _, j := range r.List() {
+			if want == "" || j.State == want {
+				list = append(list, j)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"jobs": list, "active": r.Active()})
+	})
+	mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, req *http.Request) {
+		job, ok := r.Get(req.PathValue("id"))
+		if !ok {
+			problem.Write(w, req, http.StatusNotFound, problem.NotFound, "No job "+req.PathValue("id"))
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	})
+	mux.HandleFunc("POST /jobs/{id}/cancel", func(w http.ResponseWriter, req *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			problem.Write(w, req, http.StatusForbidden, problem.NotConfigured, "Cancelling jobs is disabled: ADMIN_TOKEN is not set")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+			problem.Write(w, req, http.StatusUnauthorized, problem.Unauthorized, "Missing or invalid admin token")
+			return
+		}
+		id := req.PathValue("id")
+		job, ok := r.Get(id)
+		if !ok {
+			problem.Write(w, req, http.StatusNotFound, problem.NotFound, "No job "+id)
+			return
+		}
+		if !r.Cancel(id) {
+			problem.Write(w, req, http.StatusConflict, problem.Conflict, "Job "+id+" already "+string(job.State))
+			return
+		}
+		job, _ = r.Get(id)
+		writeJSON(w, http.StatusAccepted, job)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
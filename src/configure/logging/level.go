@@ -0,0 +1,140 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"configure/problem"
+)
+
+// Level is the verbosity of the standard logger.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Warn:
+		return "warn"
+	}
+	return "info"
+}
+
+// ParseLevel accepts debug, info and warn (or warning), in any case.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return Debug, nil
+	case "info", "":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q (want debug, info or warn)", s)
+}
+
+// level starts from LOG_LEVEL and can be changed at runtime via /admin/loglevel.
+var level atomic.Int32
+
+func init() {
+	l, _ := ParseLevel(os.Getenv("LOG_LEVEL"))
+	level.Store(int32(l))
+}
+
+// CurrentLevel returns the process-wide log level.
+func CurrentLevel() Level { return Level(level.Load()) }
+
+// SetLevel changes the process-wide log level.
+func SetLevel(l Level) { level.Store(int32(l)) }
+
+// Debugf logs only at debug level, for detail like the fault-injection draws.
+func Debugf(format string, args ...interface{}) {
+	if CurrentLevel() <= Debug {
+		log.Printf(format, args...)
+	}
+}
+
+// Services log through the standard logger without levels; an entry carrying
+// one of the warning or error markers they use counts as warn, any other as info.
+var warnMarkers = [][]byte{[]byte("⚠️"), []byte("❌"), []byte("⛔"), []byte("🚨"), []byte("🔥")}
+
+func levelOf(p []byte) Level {
+	for _, m := range warnMarkers {
+		if bytes.Contains(p, m) {
+			return Warn
+		}
+	}
+	return Info
+}
+
+// AdminTokenHeader carries the admin token on /admin requests.
+const AdminTokenHeader = "X-Admin-Token"
+
+// RequireAdmin serves next only to callers sending the ADMIN_TOKEN secret in
+// X-Admin-Token (Authorization stays free for the Cloud Run invoker token);
+// without ADMIN_TOKEN the endpoint is off.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			problem.Write(w, r, http.StatusForbidden, problem.NotConfigured, "Admin endpoints are disabled: ADMIN_TOKEN is not set")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminTokenHeader)), []byte(token)) != 1 {
+			problem.Write(w, r, http.StatusUnauthorized, problem.Unauthorized, "Missing or invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// AdminHandler serves /admin/loglevel: GET reports the level, POST or PUT
+// sets it from ?level= or a {"level": "..."} body. Callers need the admin
+// token, see RequireAdmin.
+func AdminHandler() http.HandlerFunc {
+	return RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			want := r.URL.Query().Get("level")
+			if want == "" {
+				var body struct {
+					Level string `json:"level"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Body must be JSON with a 'level' or pass ?level=")
+					return
+				}
+				want = body.Level
+			}
+			l, err := ParseLevel(want)
+			if err != nil || want == "" {
+				problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, fmt.Sprintf("Invalid level %q: use debug, info or warn", want))
+				return
+			}
+			if previous := CurrentLevel(); previous != l {
+				SetLevel(l)
+				// Logged as a warning so the change shows at every level
+				log.Printf("⚠️ Log level changed from %s to %s", previous, l)
+			}
+		default:
+			problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only GET, POST or PUT allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"level": CurrentLevel().String()})
+	})
+}
@@ -0,0 +1,75 @@
+// Package logging is the shared log setup for the Go services. Everything
+// written through the standard logger passes a Redactor before it reaches
+// stdout (and so Cloud Logging).
+package logging
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	mu      sync.RWMutex
+	current = fromEnv()
+)
+
+// fromEnv reads LOG_REDACT_FIELDS (comma separated extra field names) and
+// LOG_REDACTION=off, which disables redaction for local debugging.
+func fromEnv() *Redactor {
+	var extra []string
+	if v := os.Getenv("LOG_REDACT_FIELDS"); v != "" {
+		extra = strings.Split(v, ",")
+	}
+	r := NewRedactor(extra)
+	r.disabled = strings.EqualFold(os.Getenv("LOG_REDACTION"), "off")
+	return r
+}
+
+// Default returns the process-wide redactor.
+func Default() *Redactor {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Redact masks secrets and configured fields in s using the default redactor.
+// Use it on error text that leaves the process some other way (HTTP responses, alerts).
+func Redact(s string) string {
+	return Default().String(s)
+}
+
+// Writer redacts each write before passing it on, dropping entries below
+// the current level. The standard logger issues one Write per entry, so
+// patterns never straddle two calls.
+type Writer struct {
+	Out io.Writer
+}
+
+func (w Writer) Write(p []byte) (int, error) {
+	if levelOf(p) < CurrentLevel() {
+		return len(p), nil
+	}
+	if _, err := w.Out.Write(Default().Bytes(p)); err != nil {
+		return 0, err
+	}
+	// Report the original length so log.Logger doesn't treat a shorter write as an error
+	return len(p), nil
+}
+
+// Setup re-reads the redaction config and routes the standard logger through it.
+func Setup() {
+	mu.Lock()
+	current = fromEnv()
+	mu.Unlock()
+
+	log.SetOutput(Writer{Out: os.Stdout})
+	if fields := os.Getenv("LOG_REDACT_FIELDS"); fields != "" {
+		log.Printf("🔒 Log redaction enabled for extra fields: %s", fields)
+	}
+	if _, err := ParseLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		log.Printf("⚠️ Ignoring LOG_LEVEL: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const Mask = "[REDACTED]"
+
+// DefaultFields are always redacted; LOG_REDACT_FIELDS adds to them.
+var DefaultFields = []string{
+	"password", "passwd", "secret", "client_secret", "token", "access_token",
+	"refresh_token", "id_token", "api_key", "apikey", "authorization",
+	"private_key", "credentials",
+}
+
+// Credentials that are recognisable by shape alone, wherever they appear.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), Mask},
+	{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`), "Bearer " + Mask},
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), Mask},
+	{regexp.MustCompile(`\bya29\.[0-9A-Za-z\-_]+`), Mask},
+	{regexp.MustCompile(`\bAIza[0-9A-Za-z\-_]{35}\b`), Mask},
+	{regexp.MustCompile(`https://hooks\.slack\.com/services/[A-Za-z0-9/]+`), "https://hooks.slack.com/services/" + Mask},
+	// user:password@ in URLs
+	{regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`), "://" + Mask + "@"},
+	// Signed URL and API key query parameters
+	{regexp.MustCompile(`(?i)([?&](?:token|key|sig|signature|x-goog-signature|x-goog-credential)=)[^&\s"]+`), "${1}" + Mask},
+}
+
+// Redactor masks secrets and configured fields in log lines and error text.
+type Redactor struct {
+	fields   []string
+	jsonRe   *regexp.Regexp
+	kvRe     *regexp.Regexp
+	disabled bool
+}
+
+// NewRedactor builds a redactor for DefaultFields plus extra field names
+// (matched case-insensitively, e.g. "address" or "dba_name").
+func NewRedactor(extra []string) *Redactor {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, f := range append(append([]string{}, DefaultFields...), extra...) {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f != "" && !seen[f] {
+			seen[f] = true
+			fields = append(fields, f)
+		}
+	}
+	// Longest first so "access_token" wins over "token"
+	sort.Slice(fields, func(i, j int) bool { return len(fields[i]) > len(fields[j]) })
+
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = regexp.QuoteMeta(f)
+	}
+	names := strings.Join(quoted, "|")
+	return &Redactor{
+		fields: fields,
+		// "field": "value" | "field": 123 — in JSON logs and payloads
+		jsonRe: regexp.MustCompile(fmt.Sprintf(`(?i)("(?:%s)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`, names)),
+		// field=value in text logs
+		kvRe: regexp.MustCompile(fmt.Sprintf(`(?i)\b((?:%s)=)("[^"]*"|[^\s,&]+)`, names)),
+	}
+}
+
+// Fields lists the field names being redacted.
+func (r *Redactor) Fields() []string { return r.fields }
+
+// String returns s with secrets and configured fields masked.
+func (r *Redactor) String(s string) string {
+	if r == nil || r.disabled {
+		return s
+	}
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	s = r.jsonRe.ReplaceAllString(s, `${1}"`+Mask+`"`)
+	s = r.kvRe.ReplaceAllString(s, "${1}"+Mask)
+	return s
+}
+
+// Bytes is String for byte slices.
+func (r *Redactor) Bytes(b []byte) []byte {
+	if r == nil || r.disabled {
+		return b
+	}
+	return []byte(r.String(string(b)))
+}
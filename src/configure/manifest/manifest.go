@@ -0,0 +1,257 @@
+// Package manifest describes the chunk files of an extraction (the
+// _manifest.json written next to them) and checks that every listed file is
+// in Cloud Storage with the checksum and row count it was written with.
+// Manifests are versioned; see schema.go.
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"configure/errcategory"
+	"configure/gcp"
+)
+
+// Manifest is the content of a _manifest.json.
+type Manifest struct {
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Status is StatusComplete once every file is written; UploadComplete says the same for version 1 readers
+	Status string   `json:"status,omitempty"`
+	Date   string   `json:"date"`
+	RunID  string   `json:"run_id,omitempty"` // the run that wrote the files
+	Files  []string `json:"files"`
+	// Objects describes Files one to one; manifests written before checksums were recorded have none
+	Objects        []Object `json:"objects,omitempty"`
+	Totals         Totals   `json:"totals"`
+	UploadComplete bool     `json:"upload_complete"`
+	Snapshot       bool     `json:"snapshot,omitempty"`
+	// Sample is the $where of a sample run, whose files hold only the rows matching it
+	Sample string `json:"sample,omitempty"`
+}
+
+// Totals sums Objects, so a stage can reconcile what it read without adding
+// up the entries itself.
+type Totals struct {
+	Files int   `json:"files"`
+	Rows  int   `json:"rows"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Object is what a chunk file looked like when it was written.
+type Object struct {
+	Name   string `json:"name"`
+	Rows   int    `json:"rows"`
+	Size   int64  `json:"size"`
+	CRC32C string `json:"crc32c"`
+	// Compression is empty in version 1 manifests
+	Compression string `json:"compression,omitempty"`
+}
+
+// Add lists a written chunk file, name being relative to the manifest's folder.
+func (m *Manifest) Add(name string, data []byte) {
+	m.AddObject(Describe(name, data))
+}
+
+// AddObject lists a chunk file described earlier, e.g. one kept from a previous run.
+func (m *Manifest) AddObject(o Object) {
+	m.Files = append(m.Files, o.Name)
+	m.Objects = append(m.Objects, o)
+	m.Totals.Files++
+	m.Totals.Rows += o.Rows
+	m.Totals.Bytes += o.Size
+}
+
+// Replace swaps the entry of a chunk file that was rewritten for o, keeping
+// Totals in step. It reports whether the file was listed.
+func (m *Manifest) Replace(o Object) bool {
+	for i, old := range m.Objects {
+		if old.Name != o.Name {
+			continue
+		}
+		m.Objects[i] = o
+		m.Totals.Rows += o.Rows - old.Rows
+		m.Totals.Bytes += o.Size - old.Size
+		return true
+	}
+	return false
+}
+
+// Describe records the size, checksum and row count of an NDJSON chunk.
+func Describe(name string, data []byte) Object {
+	return Object{Name: name, Rows: CountRows(data), Size: int64(len(data)), CRC32C: Checksum(data), Compression: Uncompressed}
+}
+
+// Checksum is the CRC32C of data, base64-encoded big-endian as Cloud Storage
+// reports it in object metadata.
+func Checksum(data []byte) string {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CountRows counts the non-blank lines of NDJSON data.
+func CountRows(data []byte) int {
+	rows := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			rows++
+		}
+	}
+	return rows
+}
+
+// Problem kinds.
+const (
+	Missing          = "missing"
+	SizeMismatch     = "size_mismatch"
+	ChecksumMismatch = "checksum_mismatch"
+	RowCountMismatch = "row_count_mismatch"
+	Unreadable       = "unreadable"
+	Incomplete       = "incomplete" // the manifest itself is not marked upload_complete
+)
+
+// Problem is one chunk file that doesn't match its manifest entry.
+type Problem struct {
+	File     string `json:"file"`
+	Kind     string `json:"kind"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// Error reports the problems found by Verify, or the SchemaViolations of a
+// manifest; a manifest that doesn't match its files or schema is a
+// DataFormat failure.
+type Error struct {
+	Folder   string
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	kinds := make([]string, 0, len(e.Problems))
+	var violations []string
+	for _, p := range e.Problems {
+		if p.Kind == SchemaViolation {
+			violations = append(violations, p.Actual)
+			continue
+		}
+		kinds = append(kinds, p.File+": "+p.Kind)
+	}
+	if len(violations) > 0 {
+		return fmt.Sprintf("manifest for %s does not match its schema: %s", e.Folder, strings.Join(violations, ", "))
+	}
+	return fmt.Sprintf("manifest for %s does not match %d chunk(s): %s", e.Folder, len(e.Problems), strings.Join(kinds, ", "))
+}
+
+func (e *Error) ErrorCategory() errcategory.Category { return errcategory.DataFormat }
+
+// Read downloads and parses gs://bucket/folder/_manifest.json; see Parse.
+func Read(ctx context.Context, bucket, folder string) (Manifest, error) {
+	data, err := gcp.ReadObject(ctx, bucket, folder+"/_manifest.json")
+	if err != nil {
+		return Manifest{}, err
+	}
+	m, err := Parse(data)
+	var invalid *Error
+	switch {
+	case errors.As(err, &invalid):
+		invalid.Folder = folder
+	case err != nil:
+		err = errcategory.Wrap(errcategory.DataFormat, fmt.Errorf("manifest for %s: %w", folder, err))
+	}
+	return m, err
+}
+
+// CheckListed is the cheap form of Verify: it checks m is marked complete and
+// that every object it lists is in gs://bucket/folder with the listed size,
+// from one listing and without downloading any object.
+func CheckListed(ctx context.Context, bucket, folder string, m Manifest) error {
+	listed, err := gcp.ListObjectInfo(ctx, bucket, folder+"/")
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64, len(listed))
+	for _, o := range listed {
+		sizes[strings.TrimPrefix(o.Name, folder+"/")] = o.Size
+	}
+
+	var problems []Problem
+	if !m.Complete() {
+		problems = append(problems, Problem{File: "_manifest.json", Kind: Incomplete})
+	}
+	objects := m.Objects
+	if len(objects) == 0 {
+		for _, name := range m.Files {
+			objects = append(objects, Object{Name: name})
+		}
+	}
+	for _, want := range objects {
+		size, ok := sizes[want.Name]
+		switch {
+		case !ok:
+			problems = append(problems, Problem{File: want.Name, Kind: Missing})
+		case want.Size > 0 && size != want.Size:
+			problems = append(problems, Problem{File: want.Name, Kind: SizeMismatch, Expected: fmt.Sprint(want.Size), Actual: fmt.Sprint(size)})
+		}
+	}
+	if len(problems) > 0 {
+		return &Error{Folder: folder, Problems: problems}
+	}
+	return nil
+}
+
+// Verify reads every object listed in m from gs://bucket/folder and compares
+// it with its entry. It returns an *Error listing the mismatches, or another
+// error if the folder could not be listed. A manifest without Objects can
+// only be checked for missing files.
+func Verify(ctx context.Context, bucket, folder string, m Manifest) error {
+	listed, err := gcp.ListObjectInfo(ctx, bucket, folder+"/")
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(listed))
+	for _, o := range listed {
+		present[strings.TrimPrefix(o.Name, folder+"/")] = true
+	}
+
+	objects := m.Objects
+	if len(objects) == 0 {
+		for _, name := range m.Files {
+			objects = append(objects, Object{Name: name})
+		}
+	}
+
+	var problems []Problem
+	for _, want := range objects {
+		if !present[want.Name] {
+			problems = append(problems, Problem{File: want.Name, Kind: Missing})
+			continue
+		}
+		if want.CRC32C == "" {
+			continue
+		}
+		data, err := gcp.ReadObject(ctx, bucket, folder+"/"+want.Name)
+		if err != nil {
+			problems = append(problems, Problem{File: want.Name, Kind: Unreadable, Actual: err.Error()})
+			continue
+		}
+		got := Describe(want.Name, data)
+		switch {
+		case got.Size != want.Size:
+			problems = append(problems, Problem{File: want.Name, Kind: SizeMismatch, Expected: fmt.Sprint(want.Size), Actual: fmt.Sprint(got.Size)})
+		case got.CRC32C != want.CRC32C:
+			problems = append(problems, Problem{File: want.Name, Kind: ChecksumMismatch, Expected: want.CRC32C, Actual: got.CRC32C})
+		case got.Rows != want.Rows:
+			problems = append(problems, Problem{File: want.Name, Kind: RowCountMismatch, Expected: fmt.Sprint(want.Rows), Actual: fmt.Sprint(got.Rows)})
+		}
+	}
+	if len(problems) > 0 {
+		return &Error{Folder: folder, Problems: problems}
+	}
+	return nil
+}
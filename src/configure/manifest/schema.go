@@ -0,0 +1,256 @@
+package manifest
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"configure/errcategory"
+)
+
+// Version history:
+//
+//	1  no schema_version; upload_complete marks the files written, objects have no compression
+//	2  schema_version and status set, every file in objects with its compression,
+//	   checked against manifest.v2.schema.json by the stages writing and reading it
+const (
+	SchemaVersion = 2
+	// Oldest is the oldest version Parse still reads, so data landed before
+	// version 2 can be cleaned and loaded again
+	Oldest = 1
+)
+
+// Statuses.
+const (
+	StatusComplete   = "complete"
+	StatusIncomplete = "incomplete"
+)
+
+// Compressions of a listed file.
+const (
+	Uncompressed = "none"
+	Gzip         = "gzip"
+	Snappy       = "snappy"
+	Zstd         = "zstd"
+)
+
+// SchemaViolation is the Problem kind of a manifest that doesn't match its
+// schema; the Problem's File is _manifest.json and Actual says where.
+const SchemaViolation = "schema_violation"
+
+// Schema is the JSON Schema of version 2. The cleaner and loaders read the
+// same file through src/pyconfigure, whose image copies it in; both checks
+// are tested against the manifests in testdata/manifests.json.
+//
+//go:embed manifest.v2.schema.json
+var Schema []byte
+
+var schemaV2 = func() jsonSchema {
+	var s jsonSchema
+	if err := json.Unmarshal(Schema, &s); err != nil {
+		panic("manifest: invalid manifest.v2.schema.json: " + err.Error())
+	}
+	return s
+}()
+
+// Finish marks m complete in the current version, as it is written once its
+// last file is. Entries described before compression was recorded (e.g.
+// kept from a stopped run) are NDJSON chunks, which are written uncompressed.
+func (m *Manifest) Finish() {
+	m.SchemaVersion = SchemaVersion
+	m.Status = StatusComplete
+	m.UploadComplete = true
+	for i := range m.Objects {
+		if m.Objects[i].Compression == "" {
+			m.Objects[i].Compression = Uncompressed
+		}
+	}
+}
+
+// Complete reports whether every file m lists was written.
+func (m Manifest) Complete() bool {
+	return m.Status == StatusComplete
+}
+
+// Marshal encodes m for writing as _manifest.json, refusing a manifest that
+// doesn't match the schema of its version: it would be rejected by every
+// stage reading it.
+func Marshal(m Manifest) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if m.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("manifest for %s has schema_version %d, not %d (call Finish)", m.Date, m.SchemaVersion, SchemaVersion)
+	}
+	if problems := Validate(data); len(problems) > 0 {
+		return nil, &Error{Folder: m.Date, Problems: problems}
+	}
+	return data, nil
+}
+
+// Parse decodes a _manifest.json. A version 2 manifest is checked against
+// Schema; a version 1 manifest is upgraded in place, keeping SchemaVersion
+// 1, so Status reads the same whichever version wrote it. A manifest that
+// doesn't match its schema is an *Error without a Folder.
+func Parse(data []byte) (Manifest, error) {
+	var m Manifest
+	var head struct {
+		SchemaVersion interface{} `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return m, errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	version := Oldest
+	if head.SchemaVersion != nil {
+		n, ok := head.SchemaVersion.(float64)
+		if !ok || n != math.Trunc(n) {
+			return m, errcategory.Errorf(errcategory.DataFormat, "invalid schema_version %v", head.SchemaVersion)
+		}
+		version = int(n)
+	}
+	switch version {
+	case 1:
+	case SchemaVersion:
+		// Checked before decoding, so a wrongly typed field is reported where it is
+		if problems := Validate(data); len(problems) > 0 {
+			return m, &Error{Problems: problems}
+		}
+	default:
+		return m, errcategory.Errorf(errcategory.DataFormat, "schema_version %d is not supported (this service reads %d to %d)", version, Oldest, SchemaVersion)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	if version == 1 {
+		m.SchemaVersion = 1
+		m.Status = StatusIncomplete
+		if m.UploadComplete {
+			m.Status = StatusComplete
+		}
+	}
+	m.UploadComplete = m.Complete()
+	return m, nil
+}
+
+// Validate checks a version 2 manifest against Schema, returning a
+// SchemaViolation for each field that breaks it.
+func Validate(data []byte) []Problem {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return []Problem{{File: "_manifest.json", Kind: SchemaViolation, Actual: err.Error()}}
+	}
+	var problems []Problem
+	schemaV2.check("", doc, func(at, msg string) {
+		if at == "" {
+			at = "manifest"
+		}
+		problems = append(problems, Problem{File: "_manifest.json", Kind: SchemaViolation, Actual: at + ": " + msg})
+	})
+	return problems
+}
+
+// jsonSchema is the part of JSON Schema the manifest schema uses.
+type jsonSchema struct {
+	Type       string                `json:"type"`
+	Const      interface{}           `json:"const"`
+	Enum       []interface{}         `json:"enum"`
+	Required   []string              `json:"required"`
+	Properties map[string]jsonSchema `json:"properties"`
+	Items      *jsonSchema           `json:"items"`
+	Minimum    *float64              `json:"minimum"`
+	MinLength  int                   `json:"minLength"`
+	Pattern    string                `json:"pattern"`
+}
+
+// check reports through fail each way v, found at path at, breaks s.
+func (s jsonSchema) check(at string, v interface{}, fail func(at, msg string)) {
+	if s.Type != "" && !isType(s.Type, v) {
+		fail(at, "must be "+s.Type)
+		return
+	}
+	if s.Const != nil && v != s.Const {
+		fail(at, fmt.Sprintf("must be %v", s.Const))
+	}
+	if len(s.Enum) > 0 {
+		allowed := make([]string, len(s.Enum))
+		ok := false
+		for i, e := range s.Enum {
+			allowed[i] = fmt.Sprint(e)
+			ok = ok || v == e
+		}
+		if !ok {
+			fail(at, "must be one of "+strings.Join(allowed, ", "))
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				fail(join(at, key), "required")
+			}
+		}
+		keys := make([]string, 0, len(s.Properties))
+		for key := range s.Properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if field, ok := v[key]; ok {
+				s.Properties[key].check(join(at, key), field, fail)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(fmt.Sprintf("%s[%d]", at, i), item, fail)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail(at, fmt.Sprintf("must be >= %v", *s.Minimum))
+		}
+	case string:
+		if len(v) < s.MinLength {
+			fail(at, fmt.Sprintf("must be at least %d character(s)", s.MinLength))
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(v) {
+			fail(at, "must match "+s.Pattern)
+		}
+	}
+}
+
+func isType(t string, v interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return true
+}
+
+func join(at, key string) string {
+	if at == "" {
+		return key
+	}
+	return at + "." + key
+}
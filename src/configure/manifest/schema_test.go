@@ -0,0 +1,122 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// vector is a case of testdata/manifests.json, which the Python services'
+// copy of these checks (src/pyconfigure) is tested against too: a manifest
+// is read with status, rejected with violations, or rejected with an error
+// mentioning error.
+type vector struct {
+	Name       string          `json:"name"`
+	Manifest   json.RawMessage `json:"manifest"`
+	Status     string          `json:"status"`
+	Violations []string        `json:"violations"`
+	Error      string          `json:"error"`
+}
+
+func vectors(t *testing.T) []vector {
+	t.Helper()
+	data, err := os.ReadFile("testdata/manifests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vs []vector
+	if err := json.Unmarshal(data, &vs); err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range vectors(t) {
+		t.Run(tt.Name, func(t *testing.T) {
+			m, err := Parse(tt.Manifest)
+			switch {
+			case tt.Status != "":
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m.Status != tt.Status || m.UploadComplete != (tt.Status == StatusComplete) {
+					t.Errorf("status %q, upload_complete %t; want %q", m.Status, m.UploadComplete, tt.Status)
+				}
+			case tt.Violations != nil:
+				var merr *Error
+				if !errors.As(err, &merr) {
+					t.Fatalf("error %v, want the schema violations", err)
+				}
+				if got := actuals(merr.Problems); !slices.Equal(got, tt.Violations) {
+					t.Errorf("violations %q, want %q", got, tt.Violations)
+				}
+			default:
+				if err == nil || !strings.Contains(err.Error(), tt.Error) {
+					t.Errorf("error %v, want one mentioning %q", err, tt.Error)
+				}
+			}
+		})
+	}
+}
+
+// A version 1 manifest keeps its version once upgraded, so a stage can tell
+// what wrote it.
+func TestParseUpgradeKeepsVersion(t *testing.T) {
+	m, err := Parse([]byte(`{"date": "2025-01-31", "files": ["chunk_000.json"], "upload_complete": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SchemaVersion != 1 || !m.Complete() {
+		t.Errorf("schema_version %d, complete %t; want 1, true", m.SchemaVersion, m.Complete())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	problems := Validate([]byte(`{"schema_version": 1`))
+	if len(problems) != 1 || problems[0].Kind != SchemaViolation {
+		t.Errorf("invalid JSON: %+v, want one schema violation", problems)
+	}
+	problems = Validate([]byte(`[]`))
+	if got := actuals(problems); !slices.Equal(got, []string{"manifest: must be object"}) {
+		t.Errorf("an array: %q", got)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	m := Manifest{Date: "2025-01-31"}
+	m.Add("chunk_000.json", []byte(`{"id": 1}`+"\n"))
+	if _, err := Marshal(m); err == nil || !strings.Contains(err.Error(), "call Finish") {
+		t.Errorf("error %v, want an unfinished manifest refused", err)
+	}
+
+	m.Finish()
+	data, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SchemaVersion != SchemaVersion || !got.Complete() || got.Objects[0].Compression != Uncompressed {
+		t.Errorf("read back %+v", got)
+	}
+
+	m.Date = "yesterday"
+	var merr *Error
+	if _, err := Marshal(m); !errors.As(err, &merr) || merr.Folder != "yesterday" {
+		t.Errorf("error %v, want the schema violations for the folder", err)
+	}
+}
+
+func actuals(problems []Problem) []string {
+	got := make([]string, len(problems))
+	for i, p := range problems {
+		got[i] = p.Actual
+	}
+	return got
+}
@@ -0,0 +1,161 @@
+// Package monitoring writes custom metrics to Cloud Monitoring
+// (custom.googleapis.com/hygiene/<name>), so alerting policies and dashboards
+// can be built on run durations, throughput and failures without querying
+// BigQuery. It is off unless MONITORING_PROJECT names the project to write to.
+//
+// Metrics are written against the global resource over the REST API with the
+// runtime service account's token (see configure/gcp), which needs
+// roles/monitoring.metricWriter. Writing is best effort: failures are logged
+// and never fail the caller.
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"configure/gcp"
+)
+
+// Prefix is prepended to every metric name.
+const Prefix = "custom.googleapis.com/hygiene/"
+
+// Cloud Monitoring rejects points written to a series more often than this.
+const minInterval = 5 * time.Second
+
+var (
+	client = &http.Client{Timeout: 15 * time.Second}
+	start  = time.Now().UTC()
+
+	mu       sync.Mutex
+	counters = make(map[string]int64)
+	written  = make(map[string]time.Time)
+)
+
+// Point is one value of a gauge metric.
+type Point struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Enabled reports whether MONITORING_PROJECT is set.
+func Enabled() bool {
+	return os.Getenv("MONITORING_PROJECT") != ""
+}
+
+// Gauge writes the current value of each point. A point for a series written
+// less than 5s ago is dropped, as Cloud Monitoring would reject it.
+func Gauge(ctx context.Context, points ...Point) {
+	if !Enabled() {
+		return
+	}
+	now := time.Now().UTC()
+	var series []map[string]any
+	mu.Lock()
+	for _, p := range points {
+		key := seriesKey(p.Name, p.Labels)
+		if now.Sub(written[key]) < minInterval {
+			continue
+		}
+		written[key] = now
+		series = append(series, timeSeries(p.Name, p.Labels, "GAUGE", "DOUBLE",
+			map[string]any{"endTime": now.Format(time.RFC3339Nano)},
+			map[string]any{"doubleValue": p.Value}))
+	}
+	mu.Unlock()
+	write(ctx, series)
+}
+
+// Count adds one to a counter kept since the process started and writes its
+// total as a cumulative metric, so alerting can use its rate.
+func Count(ctx context.Context, name string, labels map[string]string) {
+	if !Enabled() {
+		return
+	}
+	key := seriesKey(name, labels)
+	mu.Lock()
+	counters[key]++
+	total := counters[key]
+	mu.Unlock()
+	write(ctx, []map[string]any{timeSeries(name, labels, "CUMULATIVE", "INT64",
+		map[string]any{"startTime": start.Format(time.RFC3339Nano), "endTime": time.Now().UTC().Format(time.RFC3339Nano)},
+		map[string]any{"int64Value": strconv.FormatInt(total, 10)})})
+}
+
+func seriesKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("|" + k + "=" + labels[k])
+	}
+	return b.String()
+}
+
+func timeSeries(name string, labels map[string]string, kind, valueType string, interval, value map[string]any) map[string]any {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return map[string]any{
+		"metric":     map[string]any{"type": Prefix + name, "labels": labels},
+		"resource":   map[string]any{"type": "global", "labels": map[string]string{"project_id": os.Getenv("MONITORING_PROJECT")}},
+		"metricKind": kind,
+		"valueType":  valueType,
+		"points":     []map[string]any{{"interval": interval, "value": value}},
+	}
+}
+
+// write creates the series in one call; Cloud Monitoring takes up to 200.
+func write(ctx context.Context, series []map[string]any) {
+	if len(series) == 0 {
+		return
+	}
+	if err := create(ctx, series); err != nil {
+		log.Printf("⚠️ Failed to write %d Cloud Monitoring series: %v", len(series), err)
+	}
+}
+
+func create(ctx context.Context, series []map[string]any) error {
+	body, err := json.Marshal(map[string]any{"timeSeries": series})
+	if err != nil {
+		return err
+	}
+	token, err := gcp.Token(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	endpoint := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/timeSeries", os.Getenv("MONITORING_PROJECT"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
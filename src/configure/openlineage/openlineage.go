@@ -0,0 +1,180 @@
+// Package openlineage posts OpenLineage run events (https://openlineage.io),
+// so pipeline runs and the datasets they read and write show up in Marquez
+// and other catalogs that speak the standard. It is off unless
+// OPENLINEAGE_URL is set, e.g. http://marquez:5000/api/v1/lineage.
+//
+// Each stage reports itself as a job in OPENLINEAGE_NAMESPACE (default
+// hygiene-prediction) with a parent facet pointing at the trigger's
+// "pipeline" job, so a pipeline run groups the runs of its stages. Run IDs
+// are UUIDv5 of "<job>/<run id>", as the Python stages derive them, so a
+// stage's START and COMPLETE match even when sent from different processes.
+//
+// Posting is best effort: failures are logged and never fail a stage.
+package openlineage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Event types.
+const (
+	Start    = "START"
+	Complete = "COMPLETE"
+	Fail     = "FAIL"
+)
+
+// PipelineJob is the parent job of every stage run, reported by the trigger.
+const PipelineJob = "pipeline"
+
+const (
+	producer  = "https://github.com/malawley/hygiene_prediction_clean"
+	schemaURL = "https://openlineage.io/spec/2-0-2/OpenLineage.json#/$defs/RunEvent"
+)
+
+// Dataset is an input or output of a run, named as OpenLineage names them.
+type Dataset struct {
+	Namespace string         `json:"namespace"`
+	Name      string         `json:"name"`
+	Facets    map[string]any `json:"facets,omitempty"`
+}
+
+// GCS names a folder of objects, e.g. GCS("raw-bucket", "raw-data").
+func GCS(bucket, prefix string) Dataset {
+	return Dataset{Namespace: "gs://" + bucket, Name: strings.Trim(prefix, "/")}
+}
+
+// BigQuery names a table given as project.dataset.table.
+func BigQuery(table string) Dataset {
+	return Dataset{Namespace: "bigquery", Name: table}
+}
+
+// HTTP names an HTTP source such as a Socrata resource.
+func HTTP(rawURL string) Dataset {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return Dataset{Namespace: "http", Name: rawURL}
+	}
+	return Dataset{Namespace: u.Scheme + "://" + u.Host, Name: u.Path}
+}
+
+// Run describes one run of a job.
+type Run struct {
+	Job string
+	// RunID is the pipeline run; Date stands in for it when empty
+	RunID   string
+	Date    string
+	Inputs  []Dataset
+	Outputs []Dataset
+}
+
+// Enabled reports whether OPENLINEAGE_URL is set.
+func Enabled() bool {
+	return os.Getenv("OPENLINEAGE_URL") != ""
+}
+
+// Emit posts an event of eventType for run; err is reported on FAIL events.
+func Emit(ctx context.Context, eventType string, run Run, err error) {
+	endpoint := os.Getenv("OPENLINEAGE_URL")
+	if endpoint == "" {
+		return
+	}
+	body, merr := json.Marshal(event(eventType, run, err, time.Now().UTC()))
+	if merr != nil {
+		log.Printf("❌ Failed to encode OpenLineage event: %v", merr)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, rerr := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if rerr != nil {
+		log.Printf("❌ Invalid OPENLINEAGE_URL: %v", rerr)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := os.Getenv("OPENLINEAGE_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, herr := http.DefaultClient.Do(req)
+	if herr != nil {
+		log.Printf("❌ Failed to post OpenLineage %s event for %s: %v", eventType, run.Job, herr)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("⚠️ OpenLineage %s event for %s got %s", eventType, run.Job, resp.Status)
+		return
+	}
+	log.Printf("🧬 OpenLineage %s event for %s: %s", eventType, run.Job, resp.Status)
+}
+
+func event(eventType string, run Run, err error, now time.Time) map[string]any {
+	namespace := os.Getenv("OPENLINEAGE_NAMESPACE")
+	if namespace == "" {
+		namespace = "hygiene-prediction"
+	}
+	key := run.RunID
+	if key == "" {
+		key = run.Date
+	}
+
+	facets := map[string]any{}
+	if run.Job != PipelineJob && run.RunID != "" {
+		facets["parent"] = map[string]any{
+			"_producer":  producer,
+			"_schemaURL": "https://openlineage.io/spec/facets/1-0-1/ParentRunFacet.json",
+			"job":        map[string]string{"namespace": namespace, "name": PipelineJob},
+			"run":        map[string]string{"runId": RunUUID(PipelineJob, run.RunID)},
+		}
+	}
+	if eventType == Fail && err != nil {
+		facets["errorMessage"] = map[string]any{
+			"_producer":           producer,
+			"_schemaURL":          "https://openlineage.io/spec/facets/1-0-1/ErrorMessageRunFacet.json",
+			"message":             err.Error(),
+			"programmingLanguage": "go",
+		}
+	}
+
+	inputs, outputs := run.Inputs, run.Outputs
+	if inputs == nil {
+		inputs = []Dataset{}
+	}
+	if outputs == nil {
+		outputs = []Dataset{}
+	}
+	return map[string]any{
+		"eventType": eventType,
+		"eventTime": now.Format(time.RFC3339Nano),
+		"producer":  producer,
+		"schemaURL": schemaURL,
+		"run":       map[string]any{"runId": RunUUID(run.Job, key), "facets": facets},
+		"job":       map[string]string{"namespace": namespace, "name": run.Job},
+		"inputs":    inputs,
+		"outputs":   outputs,
+	}
+}
+
+// RunUUID is the OpenLineage run ID of job's run for a pipeline run: the
+// UUIDv5 of "<job>/<run id>" in the URL namespace, as Python's
+// uuid.uuid5(uuid.NAMESPACE_URL, ...) computes it.
+func RunUUID(job, runID string) string {
+	namespaceURL := []byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	h := sha1.New()
+	h.Write(namespaceURL)
+	h.Write([]byte(job + "/" + runID))
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
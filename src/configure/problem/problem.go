@@ -0,0 +1,137 @@
+// Package problem writes error responses as RFC 7807 application/problem+json
+// documents, so clients can tell failures apart by type rather than by
+// parsing messages, and quote a correlation ID that matches the service logs.
+package problem
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ContentType is the media type of a problem document.
+const ContentType = "application/problem+json"
+
+// CorrelationHeader carries the correlation ID on requests and responses.
+const CorrelationHeader = "X-Correlation-ID"
+
+// TypeBase prefixes a problem kind to form its type URI.
+const TypeBase = "urn:hygiene-prediction:problem:"
+
+// Problem kinds shared by the services.
+const (
+	MethodNotAllowed  = "method-not-allowed"
+	InvalidJSON       = "invalid-json"
+	InvalidRequest    = "invalid-request"
+	Unauthorized      = "unauthorized"
+	Forbidden         = "forbidden"
+	NotFound          = "not-found"
+	Conflict          = "conflict"
+	NotReady          = "not-ready"
+	NotConfigured     = "not-configured"
+	ManifestMismatch  = "manifest-mismatch"
+	UnsupportedSchema = "unsupported-schema"
+	PayloadTooLarge   = "payload-too-large"
+	Upstream          = "upstream-failure"
+	Internal          = "internal"
+)
+
+var titles = map[string]string{
+	MethodNotAllowed:  "Method not allowed",
+	InvalidJSON:       "Request body is not valid JSON",
+	InvalidRequest:    "Invalid request",
+	Unauthorized:      "Missing or invalid credentials",
+	Forbidden:         "Not allowed for this resource",
+	NotFound:          "Resource not found",
+	Conflict:          "Request conflicts with the resource's state",
+	NotReady:          "Dependencies not ready",
+	NotConfigured:     "Service not configured",
+	ManifestMismatch:  "Chunk files don't match their manifest",
+	UnsupportedSchema: "Payload schema version not supported",
+	PayloadTooLarge:   "Request body is too large",
+	Upstream:          "Upstream service failed",
+	Internal:          "Internal error",
+}
+
+// Details is a problem document. Extensions are added to the top-level
+// members, as RFC 7807 allows.
+type Details struct {
+	Type          string
+	Title         string
+	Status        int
+	Detail        string
+	Instance      string
+	CorrelationID string
+	Extensions    map[string]interface{}
+}
+
+func (d Details) MarshalJSON() ([]byte, error) {
+	doc := make(map[string]interface{}, len(d.Extensions)+6)
+	for k, v := range d.Extensions {
+		doc[k] = v
+	}
+	doc["type"] = d.Type
+	doc["title"] = d.Title
+	doc["status"] = d.Status
+	if d.Detail != "" {
+		doc["detail"] = d.Detail
+	}
+	if d.Instance != "" {
+		doc["instance"] = d.Instance
+	}
+	doc["correlation_id"] = d.CorrelationID
+	return json.Marshal(doc)
+}
+
+// New describes a problem of kind for r. The title is the kind's, or the
+// status text for kinds this package doesn't list.
+func New(r *http.Request, status int, kind, detail string) Details {
+	title, ok := titles[kind]
+	if !ok {
+		title = http.StatusText(status)
+	}
+	return Details{
+		Type:          TypeBase + kind,
+		Title:         title,
+		Status:        status,
+		Detail:        detail,
+		Instance:      r.URL.Path,
+		CorrelationID: CorrelationID(r),
+	}
+}
+
+// Write sends a problem of kind in place of http.Error.
+func Write(w http.ResponseWriter, r *http.Request, status int, kind, detail string) {
+	Send(w, New(r, status, kind, detail))
+}
+
+// Send writes d as the response and logs it under its correlation ID.
+func Send(w http.ResponseWriter, d Details) {
+	log.Printf("⚠️ %d %s at %s: %s (correlation %s)", d.Status, d.Type, d.Instance, d.Detail, d.CorrelationID)
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set(CorrelationHeader, d.CorrelationID)
+	w.WriteHeader(d.Status)
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		log.Println("❌ Failed to encode problem response:", err)
+	}
+}
+
+// CorrelationID is the ID the caller sent, else the Cloud Run trace ID so
+// the response can be matched to the request logs, else a new random one.
+// It is stored on r, so later calls return the same ID.
+func CorrelationID(r *http.Request) string {
+	if id := r.Header.Get(CorrelationHeader); id != "" {
+		return id
+	}
+	id, _, _ := strings.Cut(r.Header.Get("X-Cloud-Trace-Context"), "/")
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	r.Header.Set(CorrelationHeader, id)
+	return id
+}
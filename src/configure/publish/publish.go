@@ -0,0 +1,127 @@
+// Package publish delivers the events stages send the trigger (started,
+// progress, completed, failed) over the transport a deployment is set up
+// with, chosen by EVENT_PUBLISHER:
+//
+//	http    POST each event to TRIGGER_URL (the default)
+//	pubsub  publish each event to EVENT_TOPIC, projects/{project}/topics/{topic},
+//	        whose push subscription delivers it to the trigger's /clean
+//	log     only log each event, for local development without a trigger
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/gcp"
+)
+
+// EventPublisher delivers a stage event. Publish stamps the payload with the
+// event schema version; its errors carry an errcategory, so callers can
+// retry the transient ones.
+type EventPublisher interface {
+	Publish(ctx context.Context, payload map[string]any) error
+	// String says where events go, for logs
+	String() string
+}
+
+// FromEnv returns the publisher EVENT_PUBLISHER selects.
+func FromEnv() (EventPublisher, error) {
+	switch kind := strings.ToLower(os.Getenv("EVENT_PUBLISHER")); kind {
+	case "", "http":
+		url := os.Getenv("TRIGGER_URL")
+		if url == "" {
+			return nil, fmt.Errorf("TRIGGER_URL is not set")
+		}
+		return HTTP{URL: url}, nil
+	case "pubsub":
+		topic := os.Getenv("EVENT_TOPIC")
+		if !strings.HasPrefix(topic, "projects/") || !strings.Contains(topic, "/topics/") {
+			return nil, fmt.Errorf("EVENT_TOPIC %q is not projects/{project}/topics/{topic}", topic)
+		}
+		return PubSub{Topic: topic}, nil
+	case "log":
+		return Log{}, nil
+	default:
+		return nil, fmt.Errorf("unknown EVENT_PUBLISHER %q (want http, pubsub or log)", kind)
+	}
+}
+
+// HTTP posts events to the trigger. A nil Client is http.DefaultClient,
+// which carries the tlsconfig client settings.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (p HTTP) Publish(ctx context.Context, payload map[string]any) error {
+	body, err := json.Marshal(eventschema.Stamp(payload))
+	if err != nil {
+		return errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return errcategory.Wrap(errcategory.Configuration, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errcategory.Wrap(errcategory.TransientNetwork, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errcategory.Errorf(errcategory.FromStatus(resp.StatusCode), "trigger answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (p HTTP) String() string { return p.URL }
+
+// PubSub publishes events to a topic, the payload as the message data. The
+// event, run_id, date and origin fields are copied to message attributes so
+// subscriptions can filter on them.
+type PubSub struct {
+	Topic string
+}
+
+func (p PubSub) Publish(ctx context.Context, payload map[string]any) error {
+	data, err := json.Marshal(eventschema.Stamp(payload))
+	if err != nil {
+		return errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	attributes := map[string]string{}
+	for _, key := range []string{"event", "run_id", "date", "origin"} {
+		if v, ok := payload[key].(string); ok && v != "" {
+			attributes[key] = v
+		}
+	}
+	// gcp errors name the HTTP status, which errcategory reads
+	return gcp.PublishMessage(ctx, p.Topic, data, attributes)
+}
+
+func (p PubSub) String() string { return "pubsub:" + p.Topic }
+
+// Log only logs events. Nothing downstream sees them.
+type Log struct{}
+
+func (Log) Publish(ctx context.Context, payload map[string]any) error {
+	body, err := json.Marshal(eventschema.Stamp(payload))
+	if err != nil {
+		return errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	log.Printf("📭 Event %v: %s", payload["event"], body)
+	return nil
+}
+
+func (Log) String() string { return "log" }
@@ -0,0 +1,104 @@
+// Package retry runs an operation until it succeeds, backing off
+// exponentially with jitter between attempts and stopping early when the
+// error is not worth retrying or the context is done.
+package retry
+
+import (
+	"configure/errcategory"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy says how often and how patiently to retry. The zero value makes a
+// single attempt.
+type Policy struct {
+	// Attempts is the total number of tries, including the first
+	Attempts int
+	// Initial is the delay before the second attempt
+	Initial time.Duration
+	// Max caps any single delay; 0 means no cap
+	Max time.Duration
+	// Multiplier grows the delay after each attempt; below 1 means 2
+	Multiplier float64
+	// Jitter randomizes this fraction of each delay (0 fixed, 1 anywhere from 0 to the full delay)
+	Jitter float64
+	// RetryIf decides whether an error is worth another attempt; nil retries all
+	RetryIf func(error) bool
+	// OnRetry is called before each wait, with the attempt that just failed (1-based)
+	OnRetry func(attempt int, err error, delay time.Duration)
+}
+
+type permanent struct{ err error }
+
+func (p *permanent) Error() string { return p.err.Error() }
+func (p *permanent) Unwrap() error { return p.err }
+
+// Permanent marks err as final: Do returns it without further attempts.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanent{err: err}
+}
+
+// Transient reports whether err's category (see configure/errcategory) is
+// one that may succeed if repeated. It suits most RetryIf uses.
+func Transient(err error) bool {
+	return errcategory.Retryable(errcategory.Of(err))
+}
+
+// Do calls fn with the 1-based attempt number until it returns nil, returns a
+// Permanent or non-retryable error, the attempts run out, or ctx is done.
+// It returns fn's last error, joined with ctx's error if waiting was cut short.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context, attempt int) error) error {
+	attempts := max(p.Attempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx, attempt)
+		if err == nil {
+			return nil
+		}
+		var perm *permanent
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if attempt >= attempts || (p.RetryIf != nil && !p.RetryIf(err)) {
+			return err
+		}
+
+		delay := p.Delay(attempt)
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// Delay is the wait after failed attempt n (1-based), jitter included.
+func (p Policy) Delay(n int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	d := float64(p.Initial)
+	for i := 1; i < n; i++ {
+		d *= mult
+		if p.Max > 0 && d >= float64(p.Max) {
+			break
+		}
+	}
+	if p.Max > 0 && d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if j := min(max(p.Jitter, 0), 1); j > 0 {
+		d -= d * j * rand.Float64()
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,212 @@
+// Package schemas defines the BigQuery tables the pipeline's Go services
+// write or read, once: a typed row struct for the tables Go writes, and each
+// table's schema as a list of fields.
+//
+// The package stays free of the BigQuery client so the trigger can use it;
+// services with the client convert a Schema to a bigquery.Schema themselves.
+// A Schema marshals to BigQuery's JSON schema format, for bq mk --schema.
+package schemas
+
+import (
+	"fmt"
+	"time"
+)
+
+// Field is one column, with the legacy type names the BigQuery API uses
+// (STRING, INTEGER, FLOAT, BOOLEAN, TIMESTAMP, RECORD).
+type Field struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"`
+	Mode   string  `json:"mode,omitempty"` // NULLABLE (default), REQUIRED or REPEATED
+	Fields []Field `json:"fields,omitempty"`
+}
+
+// SQLTypes are the GoogleSQL names of the legacy types the API reports.
+var SQLTypes = map[string]string{"INTEGER": "INT64", "FLOAT": "FLOAT64", "BOOLEAN": "BOOL"}
+
+// DDL is the column's name and GoogleSQL type as DDL declares it.
+func (f Field) DDL() string {
+	typ := f.Type
+	if sql, ok := SQLTypes[typ]; ok {
+		typ = sql
+	}
+	if f.Mode == "REPEATED" {
+		typ = "ARRAY<" + typ + ">"
+	}
+	return fmt.Sprintf("`%s` %s", f.Name, typ)
+}
+
+// Schema is a table's columns in order.
+type Schema []Field
+
+// Names lists the top-level column names.
+func (s Schema) Names() []string {
+	names := make([]string, len(s))
+	for i, f := range s {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// Missing returns the columns of s not among have, the column names of a
+// live table, in s's order.
+func (s Schema) Missing(have []string) Schema {
+	present := make(map[string]bool, len(have))
+	for _, name := range have {
+		present[name] = true
+	}
+	var out Schema
+	for _, f := range s {
+		if !present[f.Name] {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// ChunkMetric is one row of PipelineMonitoring.chunk_metrics, written by the
+// extractor per chunk.
+type ChunkMetric struct {
+	Offset               int       `bigquery:"offset"`
+	RowsExtracted        int       `bigquery:"rows_extracted"`
+	RowsDropped          int       `bigquery:"rows_dropped"`
+	ChunkDurationSeconds float64   `bigquery:"chunk_duration_seconds"`
+	DelayApplied         bool      `bigquery:"delay_applied"`
+	FetchSkipped         bool      `bigquery:"fetch_skipped"`
+	GCSWriteSkipped      bool      `bigquery:"gcs_write_skipped"`
+	ChunkSize            int       `bigquery:"chunk_size"`
+	SkippedUnchanged     bool      `bigquery:"skipped_unchanged"`
+	Timestamp            time.Time `bigquery:"timestamp"`
+	RunID                string    `bigquery:"run_id"`
+	FetchError           string    `bigquery:"fetch_error"`    // what the data API sent instead of rows
+	FetchAttempts        int       `bigquery:"fetch_attempts"` // requests made for the page, 1 when none was retried
+	StatusCode           int       `bigquery:"status_code"`    // of the last request
+	PageBytes            int       `bigquery:"page_bytes"`
+	FetchSeconds         float64   `bigquery:"fetch_seconds"` // the last request
+	RetrySeconds         float64   `bigquery:"retry_seconds"` // failed requests and backoff before it
+}
+
+// ChunkMetrics is the schema of PipelineMonitoring.chunk_metrics, partitioned on timestamp.
+var ChunkMetrics = Schema{
+	{Name: "offset", Type: "INTEGER"},
+	{Name: "rows_extracted", Type: "INTEGER"},
+	{Name: "rows_dropped", Type: "INTEGER"},
+	{Name: "chunk_duration_seconds", Type: "FLOAT"},
+	{Name: "delay_applied", Type: "BOOLEAN"},
+	{Name: "fetch_skipped", Type: "BOOLEAN"},
+	{Name: "gcs_write_skipped", Type: "BOOLEAN"},
+	{Name: "chunk_size", Type: "INTEGER"},
+	{Name: "skipped_unchanged", Type: "BOOLEAN"},
+	{Name: "timestamp", Type: "TIMESTAMP"},
+	{Name: "run_id", Type: "STRING"},
+	{Name: "fetch_error", Type: "STRING"},
+	{Name: "fetch_attempts", Type: "INTEGER"},
+	{Name: "status_code", Type: "INTEGER"},
+	{Name: "page_bytes", Type: "INTEGER"},
+	{Name: "fetch_seconds", Type: "FLOAT"},
+	{Name: "retry_seconds", Type: "FLOAT"},
+}
+
+// StageMetric is one row of PipelineMonitoring.stage_metrics: a stage's
+// outcome in a run, written by the trigger when the run finishes.
+type StageMetric struct {
+	RunID           string    `bigquery:"run_id" json:"run_id"`
+	Date            string    `bigquery:"date" json:"date"`
+	Stage           string    `bigquery:"stage" json:"stage"`
+	Status          string    `bigquery:"status" json:"status"` // completed | failed
+	DurationSeconds float64   `bigquery:"duration_seconds" json:"duration_seconds"`
+	RowsExpected    int       `bigquery:"rows_expected" json:"rows_expected,omitempty"`
+	RowsReceived    int       `bigquery:"rows_received" json:"rows_received,omitempty"`
+	ErrorCategory   string    `bigquery:"error_category" json:"error_category,omitempty"`
+	RecordedAt      time.Time `bigquery:"recorded_at" json:"recorded_at"`
+}
+
+// StageMetrics is the schema of PipelineMonitoring.stage_metrics, partitioned on recorded_at.
+var StageMetrics = Schema{
+	{Name: "run_id", Type: "STRING"},
+	{Name: "date", Type: "STRING"},
+	{Name: "stage", Type: "STRING"},
+	{Name: "status", Type: "STRING"},
+	{Name: "duration_seconds", Type: "FLOAT"},
+	{Name: "rows_expected", Type: "INTEGER"},
+	{Name: "rows_received", Type: "INTEGER"},
+	{Name: "error_category", Type: "STRING"},
+	{Name: "recorded_at", Type: "TIMESTAMP"},
+}
+
+// CleanedInspection is one inspection as the cleaner writes it and
+// CleanedInspectionRow holds it.
+type CleanedInspection struct {
+	InspectionID     string    `bigquery:"inspection_id"`
+	DBAName          string    `bigquery:"dba_name"`
+	FacilityType     string    `bigquery:"facility_type"`
+	FacilityCategory string    `bigquery:"facility_category"`
+	Risk             string    `bigquery:"risk"`
+	Address          string    `bigquery:"address"`
+	City             string    `bigquery:"city"`
+	State            string    `bigquery:"state"`
+	Zip              string    `bigquery:"zip"`
+	InspectionDate   time.Time `bigquery:"inspection_date"`
+	InspectionType   string    `bigquery:"inspection_type"`
+	Results          string    `bigquery:"results"`
+	Violations       string    `bigquery:"violations"`
+	Latitude         float64   `bigquery:"latitude"`
+	Longitude        float64   `bigquery:"longitude"`
+	ViolationCodes   []int64   `bigquery:"violation_codes"`
+	ViolationCount   int64     `bigquery:"violation_count"`
+
+	HasViolation1  int64 `bigquery:"has_violation_1"`
+	HasViolation2  int64 `bigquery:"has_violation_2"`
+	HasViolation3  int64 `bigquery:"has_violation_3"`
+	HasViolation4  int64 `bigquery:"has_violation_4"`
+	HasViolation6  int64 `bigquery:"has_violation_6"`
+	HasViolation7  int64 `bigquery:"has_violation_7"`
+	HasViolation38 int64 `bigquery:"has_violation_38"`
+
+	HasSupervisionViolation    int64 `bigquery:"has_supervision_violation"`
+	HasEmployeeHealthViolation int64 `bigquery:"has_employee_health_violation"`
+	HasContaminationViolation  int64 `bigquery:"has_contamination_violation"`
+	HasTempControlViolation    int64 `bigquery:"has_temp_control_violation"`
+	HasFoodSourceViolation     int64 `bigquery:"has_food_source_violation"`
+	HasEquipmentViolation      int64 `bigquery:"has_equipment_violation"`
+}
+
+// CleanedInspectionRow is the schema of HygienePredictionRow.CleanedInspectionRow,
+// loaded from the cleaner's NDJSON, where inspection_date is detected as a TIMESTAMP.
+var CleanedInspectionRow = cleaned("TIMESTAMP")
+
+// CleanedInspectionColumn is the schema of
+// HygienePredictionColumn.CleanedInspectionColumn, loaded from the cleaner's
+// Parquet, which keeps inspection_date as the source's string.
+var CleanedInspectionColumn = cleaned("STRING")
+
+func cleaned(inspectionDate string) Schema {
+	s := Schema{
+		{Name: "inspection_id", Type: "STRING"},
+		{Name: "dba_name", Type: "STRING"},
+		{Name: "facility_type", Type: "STRING"},
+		{Name: "facility_category", Type: "STRING"},
+		{Name: "risk", Type: "STRING"},
+		{Name: "address", Type: "STRING"},
+		{Name: "city", Type: "STRING"},
+		{Name: "state", Type: "STRING"},
+		{Name: "zip", Type: "STRING"},
+		{Name: "inspection_date", Type: inspectionDate},
+		{Name: "inspection_type", Type: "STRING"},
+		{Name: "results", Type: "STRING"},
+		{Name: "violations", Type: "STRING"},
+		{Name: "latitude", Type: "FLOAT"},
+		{Name: "longitude", Type: "FLOAT"},
+		{Name: "violation_codes", Type: "INTEGER", Mode: "REPEATED"},
+		{Name: "violation_count", Type: "INTEGER"},
+	}
+	for _, name := range []string{
+		"has_violation_1", "has_violation_2", "has_violation_3", "has_violation_4",
+		"has_violation_6", "has_violation_7", "has_violation_38",
+		"has_supervision_violation", "has_employee_health_violation", "has_contamination_violation",
+		"has_temp_control_violation", "has_food_source_violation", "has_equipment_violation",
+	} {
+		s = append(s, Field{Name: name, Type: "INTEGER"})
+	}
+	return s
+}
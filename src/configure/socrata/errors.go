@@ -0,0 +1,78 @@
+package socrata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"configure/errcategory"
+)
+
+// maxErrorBody is how much of an error response is kept on an APIError.
+const maxErrorBody = 2048
+
+// APIError is an error payload from SODA: a JSON object such as
+// {"error": true, "code": "query.soql.no-such-column", "message": "..."} in
+// place of the array of rows, sent with a failing status or, for some query
+// errors, with a 200.
+type APIError struct {
+	Status  int
+	Code    string // SODA's error code; older endpoints send it as errorCode
+	Message string
+	Body    string // the payload as sent, cut to maxErrorBody bytes
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("socrata status %d", e.Status)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// ErrorCategory sorts the error by its code, falling back on the status: a
+// query SODA can't run (bad SoQL, an unknown column or dataset, missing
+// credentials) fails the same way every time, while its timeouts and
+// internal errors may pass if repeated.
+func (e *APIError) ErrorCategory() errcategory.Category {
+	code := strings.ToLower(e.Code)
+	switch {
+	case strings.Contains(code, "timeout"):
+		return errcategory.TransientNetwork
+	case strings.Contains(code, "throttl") || strings.Contains(code, "rate"):
+		return errcategory.Quota
+	case strings.HasPrefix(code, "query.") || strings.Contains(code, "not-found") ||
+		strings.Contains(code, "authentication") || strings.Contains(code, "permission"):
+		return errcategory.Configuration
+	case e.Status != http.StatusOK:
+		return errcategory.FromStatus(e.Status)
+	}
+	return errcategory.Downstream
+}
+
+// parseError reads body as a SODA error payload. It returns nil when body
+// is not a JSON object, as for a page of rows.
+func parseError(status int, body []byte) *APIError {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil
+	}
+	var doc struct {
+		Code      string `json:"code"`
+		ErrorCode string `json:"errorCode"`
+		Message   string `json:"message"`
+	}
+	_ = json.Unmarshal(trimmed, &doc)
+	if doc.Code == "" {
+		doc.Code = doc.ErrorCode
+	}
+	if len(trimmed) > maxErrorBody {
+		trimmed = trimmed[:maxErrorBody]
+	}
+	return &APIError{Status: status, Code: doc.Code, Message: doc.Message, Body: string(trimmed)}
+}
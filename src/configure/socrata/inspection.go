@@ -0,0 +1,39 @@
+package socrata
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// FloatingTimestamp is how SODA writes a floating_timestamp column, such as
+// inspection_date: no zone, milliseconds always present.
+const FloatingTimestamp = "2006-01-02T15:04:05.000"
+
+// Inspection is one row of the food inspections dataset. SODA sends every
+// value as a string, numbers included, and leaves out empty columns.
+type Inspection struct {
+	InspectionID   string `json:"inspection_id"`
+	DBAName        string `json:"dba_name,omitempty"`
+	AKAName        string `json:"aka_name,omitempty"`
+	License        string `json:"license_,omitempty"`
+	FacilityType   string `json:"facility_type,omitempty"`
+	Risk           string `json:"risk,omitempty"`
+	Address        string `json:"address,omitempty"`
+	City           string `json:"city,omitempty"`
+	State          string `json:"state,omitempty"`
+	Zip            string `json:"zip,omitempty"`
+	InspectionDate string `json:"inspection_date,omitempty"`
+	InspectionType string `json:"inspection_type,omitempty"`
+	Results        string `json:"results,omitempty"`
+	Violations     string `json:"violations,omitempty"`
+	Latitude       string `json:"latitude,omitempty"`
+	Longitude      string `json:"longitude,omitempty"`
+	// Location is the point column, kept as sent: its shape differs
+	// between SODA versions, and Latitude and Longitude carry the same
+	Location json.RawMessage `json:"location,omitempty"`
+}
+
+// Date parses InspectionDate.
+func (i Inspection) Date() (time.Time, error) {
+	return time.Parse(FloatingTimestamp, i.InspectionDate)
+}
@@ -0,0 +1,299 @@
+// Package socrata is a client for the Socrata Open Data API (SODA) the
+// pipeline reads the Chicago food inspections from: a typed query, the
+// inspection record, and one place for the request headers, conditional
+// requests, retries and rate limiting.
+package socrata
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"configure/errcategory"
+	"configure/retry"
+)
+
+// FoodInspections is the SODA endpoint of the food inspections dataset.
+const FoodInspections = "https://data.cityofchicago.org/resource/qizy-d2wf.json"
+
+// DatasetURL is the endpoint to read the inspections from: SOCRATA_URL when
+// set, e.g. the mock served by pipelinectl synth -serve, else FoodInspections.
+func DatasetURL() string {
+	if u := os.Getenv("SOCRATA_URL"); u != "" {
+		return u
+	}
+	return FoodInspections
+}
+
+// Query is a SoQL query. Zero fields are left out, except that $offset is
+// always sent with $limit so every page of a scan has the same URL shape.
+type Query struct {
+	Select []string
+	Where  string
+	Order  string
+	Limit  int
+	Offset int
+}
+
+// Encode renders q as a query string, without the leading "?".
+func (q Query) Encode() string {
+	var parts []string
+	add := func(name, value string) {
+		parts = append(parts, name+"="+url.QueryEscape(value))
+	}
+	if len(q.Select) > 0 {
+		add("$select", strings.Join(q.Select, ","))
+	}
+	if q.Where != "" {
+		add("$where", q.Where)
+	}
+	if q.Order != "" {
+		add("$order", q.Order)
+	}
+	if q.Limit > 0 || q.Offset > 0 {
+		if q.Limit > 0 {
+			parts = append(parts, "$limit="+strconv.Itoa(q.Limit))
+		}
+		parts = append(parts, "$offset="+strconv.Itoa(q.Offset))
+	}
+	return strings.Join(parts, "&")
+}
+
+// Validators are the response validators Socrata sent with a page; sent
+// back, they make the request conditional on the page having changed.
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (v Validators) Empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+func (v Validators) setOn(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// Page is one response.
+type Page struct {
+	// Status is 200, 304 when a conditional request found the page
+	// unchanged, or the failing status alongside an error
+	Status     int
+	Body       []byte // the JSON array as sent, decompressed; empty for a 304
+	Validators Validators
+}
+
+// NotModified reports whether the page is unchanged since the validators
+// the request was made with.
+func (p Page) NotModified() bool {
+	return p.Status == http.StatusNotModified
+}
+
+// Records decodes the page as untyped rows, keeping every field the dataset sends.
+func (p Page) Records() ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	if err := json.Unmarshal(p.Body, &records); err != nil {
+		return nil, errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	return records, nil
+}
+
+// Inspections decodes the page as Inspection records.
+func (p Page) Inspections() ([]Inspection, error) {
+	var records []Inspection
+	if err := json.Unmarshal(p.Body, &records); err != nil {
+		return nil, errcategory.Wrap(errcategory.DataFormat, err)
+	}
+	return records, nil
+}
+
+// Client queries one dataset. Its fields are read on every request and may
+// be set up front; it is safe for concurrent use once set.
+type Client struct {
+	// Dataset is the resource URL, e.g. FoodInspections
+	Dataset string
+	// Header is sent on every request: User-Agent, an X-App-Token, ...
+	// Accept-Encoding is set to gzip, and the body decompressed by Get
+	Header http.Header
+	// HTTP makes the requests; nil uses http.DefaultClient
+	HTTP *http.Client
+	// Retry is the policy Fetch and Count retry Get under
+	Retry retry.Policy
+	// MinInterval spaces requests at least this far apart; 0 for none.
+	// A 429's Retry-After also holds back the next request
+	MinInterval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // earliest the next request may be sent
+}
+
+// New returns a client for dataset that retries transient failures.
+func New(dataset string) *Client {
+	return &Client{
+		Dataset: dataset,
+		Header:  http.Header{"Accept-Encoding": {"gzip"}},
+		Retry:   retry.Policy{Attempts: 5, Initial: 2 * time.Second, Max: 30 * time.Second, Jitter: 0.5, RetryIf: retry.Transient},
+	}
+}
+
+// URL is the request URL for q.
+func (c *Client) URL(q Query) string {
+	if s := q.Encode(); s != "" {
+		return c.Dataset + "?" + s
+	}
+	return c.Dataset
+}
+
+// Get makes one request, conditional on cached when it holds validators,
+// and categorizes a failure (see configure/errcategory) so a retry policy
+// only repeats the ones that may succeed. An error payload in place of the
+// rows, whatever the status, is returned as an *APIError.
+func (c *Client) Get(ctx context.Context, q Query, cached Validators) (Page, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL(q), nil)
+	if err != nil {
+		return Page{}, retry.Permanent(err)
+	}
+	req.Header = c.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	cached.setOn(req)
+
+	if err := c.wait(ctx); err != nil {
+		return Page{}, err
+	}
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Page{}, errcategory.Wrap(errcategory.TransientNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	page := Page{Status: resp.StatusCode}
+	if resp.StatusCode == http.StatusNotModified && !cached.Empty() {
+		page.Validators = cached
+		return page, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.holdOff(resp.Header.Get("Retry-After"))
+	}
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return page, errcategory.Wrap(errcategory.TransientNetwork, fmt.Errorf("gzip body: %w", err))
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(body)
+	if resp.StatusCode != http.StatusOK {
+		if apiErr := parseError(resp.StatusCode, data); apiErr != nil {
+			return page, apiErr
+		}
+		return page, errcategory.Errorf(errcategory.FromStatus(resp.StatusCode), "status %d", resp.StatusCode)
+	}
+	if err != nil {
+		return page, errcategory.Wrap(errcategory.TransientNetwork, fmt.Errorf("read body: %w", err))
+	}
+	if apiErr := parseError(resp.StatusCode, data); apiErr != nil {
+		return page, apiErr
+	}
+	page.Body = data
+	page.Validators = Validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	return page, nil
+}
+
+// Fetch is Get under c.Retry.
+func (c *Client) Fetch(ctx context.Context, q Query, cached Validators) (Page, error) {
+	var page Page
+	err := c.Retry.Do(ctx, func(ctx context.Context, attempt int) error {
+		var err error
+		page, err = c.Get(ctx, q, cached)
+		return err
+	})
+	return page, err
+}
+
+// Count returns how many rows match where (all rows when it is empty).
+func (c *Client) Count(ctx context.Context, where string) (int, error) {
+	page, err := c.Fetch(ctx, Query{Select: []string{"count(*)"}, Where: where}, Validators{})
+	if err != nil {
+		return 0, err
+	}
+	// SODA returns the aggregate as a string: [{"count":"276543"}]
+	var rows []map[string]string
+	if err := json.Unmarshal(page.Body, &rows); err != nil || len(rows) != 1 || len(rows[0]) != 1 {
+		return 0, errcategory.Errorf(errcategory.DataFormat, "unexpected count(*) response: %.200s", page.Body)
+	}
+	for _, v := range rows[0] {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, errcategory.Errorf(errcategory.DataFormat, "unexpected count(*) value %q", v)
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+// wait blocks until the client may send its next request and books the
+// slot after it.
+func (c *Client) wait(ctx context.Context) error {
+	c.mu.Lock()
+	now := time.Now()
+	at := c.next
+	if at.Before(now) {
+		at = now
+	}
+	c.next = at.Add(c.MinInterval)
+	c.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// holdOff delays the next request by a 429's Retry-After, in seconds or as
+// an HTTP date.
+func (c *Client) holdOff(retryAfter string) {
+	var until time.Time
+	if secs, err := strconv.Atoi(retryAfter); err == nil {
+		until = time.Now().Add(time.Duration(secs) * time.Second)
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		until = t
+	} else {
+		return
+	}
+	c.mu.Lock()
+	if until.After(c.next) {
+		c.next = until
+	}
+	c.mu.Unlock()
+}
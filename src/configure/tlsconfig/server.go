@@ -0,0 +1,110 @@
+package tlsconfig
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"configure/problem"
+)
+
+// Limits bound how long a client may take over a request and how much it
+// may send, so a slow or oversized request can't tie up a service:
+//
+//	HTTP_READ_HEADER_TIMEOUT  time to send the headers (default 10s)
+//	HTTP_READ_TIMEOUT         time to send the whole request (default 1m)
+//	HTTP_WRITE_TIMEOUT        time to answer, from the end of the headers (default 20m,
+//	                          above the trigger's 15m self-test wait)
+//	HTTP_IDLE_TIMEOUT         how long a keep-alive connection may sit idle (default 2m)
+//	HTTP_MAX_BODY_BYTES       largest request body (default 10 MiB)
+type Limits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxBodyBytes      int64
+}
+
+// LimitsFromEnv reads the HTTP_* variables. Unset or invalid values keep
+// their defaults; an invalid one is logged.
+func LimitsFromEnv() Limits {
+	l := Limits{
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", time.Minute),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 20*time.Minute),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		MaxBodyBytes:      10 << 20,
+	}
+	if v := os.Getenv("HTTP_MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			log.Printf("⚠️ Invalid HTTP_MAX_BODY_BYTES %q, using %d", v, l.MaxBodyBytes)
+		} else {
+			l.MaxBodyBytes = n
+		}
+	}
+	return l
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("⚠️ Invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// ListenAddr is where a service listens: BIND_ADDR (default all interfaces)
+// and PORT (default 8080; Cloud Run sets it). An invalid PORT is logged and
+// 8080 used.
+func ListenAddr() string {
+	port := os.Getenv("PORT")
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		if port != "" {
+			log.Printf("⚠️ Invalid PORT %q, using 8080", port)
+		}
+		port = "8080"
+	}
+	return net.JoinHostPort(os.Getenv("BIND_ADDR"), port)
+}
+
+// Server returns an http.Server for handler (http.DefaultServeMux when nil)
+// with the limits applied.
+func (l Limits) Server(addr string, handler http.Handler) *http.Server {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           l.LimitBody(handler),
+		ReadHeaderTimeout: l.ReadHeaderTimeout,
+		ReadTimeout:       l.ReadTimeout,
+		WriteTimeout:      l.WriteTimeout,
+		IdleTimeout:       l.IdleTimeout,
+	}
+}
+
+// LimitBody caps request bodies at MaxBodyBytes. A request that declares a
+// larger body is answered 413 straight away; one that sends more than it
+// declared (or streams without a length) has its read fail at the cap, which
+// handlers report as a bad body.
+func (l Limits) LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > l.MaxBodyBytes {
+			problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.PayloadTooLarge,
+				fmt.Sprintf("Request body is %d bytes; the limit is %d", r.ContentLength, l.MaxBodyBytes))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,196 @@
+// Package tlsconfig adds optional TLS and mutual TLS to the services' HTTP
+// servers and clients when they are self-hosted (docker-compose, GKE without a
+// mesh). On Cloud Run none of the variables are set, TLS is terminated by the
+// platform and everything stays plain HTTP inside the container.
+//
+// Server side:
+//
+//	TLS_CERT_FILE, TLS_KEY_FILE  serve HTTPS with this certificate
+//	TLS_CLIENT_CA_FILE           require client certificates signed by this CA (mTLS)
+//	TLS_CLIENT_AUTH              "require" (default when a client CA is set) or
+//	                             "optional" to verify certificates only when presented
+//
+// Client side (calls to other services):
+//
+//	TLS_CA_FILE                  trust this CA in addition to the system roots
+//	TLS_CLIENT_CERT_FILE/KEY     certificate presented to peers; defaults to the server pair
+//
+// Peer URLs in services.json need the https:// scheme once those peers serve TLS.
+// The Python stages read the same variables through src/pyconfigure (tls.py and
+// gunicorn_conf.py), so mTLS can be turned on for the whole pipeline at once.
+//
+// ListenAndServe also applies the timeouts and body size limit in Limits,
+// whether or not TLS is on.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Config is the TLS setup read from the environment.
+type Config struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ClientAuth     string
+	CAFile         string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// FromEnv reads the TLS_* variables.
+func FromEnv() Config {
+	c := Config{
+		CertFile:       os.Getenv("TLS_CERT_FILE"),
+		KeyFile:        os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+		ClientAuth:     strings.ToLower(os.Getenv("TLS_CLIENT_AUTH")),
+		CAFile:         os.Getenv("TLS_CA_FILE"),
+		ClientCertFile: os.Getenv("TLS_CLIENT_CERT_FILE"),
+		ClientKeyFile:  os.Getenv("TLS_CLIENT_KEY_FILE"),
+	}
+	if c.ClientCertFile == "" && c.ClientKeyFile == "" {
+		c.ClientCertFile, c.ClientKeyFile = c.CertFile, c.KeyFile
+	}
+	return c
+}
+
+// ServerEnabled reports whether the server should listen with TLS.
+func (c Config) ServerEnabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// ClientEnabled reports whether outgoing calls need a custom TLS setup.
+func (c Config) ClientEnabled() bool {
+	return c.CAFile != "" || (c.ClientCertFile != "" && c.ClientKeyFile != "")
+}
+
+// Server returns the server TLS config, or nil when TLS is off.
+func (c Config) Server() (*tls.Config, error) {
+	if !c.ServerEnabled() {
+		if c.ClientCAFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE is set but TLS_CERT_FILE/TLS_KEY_FILE are not")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCAFile == "" {
+		return cfg, nil
+	}
+	pool, err := loadPool(c.ClientCAFile, false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	switch c.ClientAuth {
+	case "", "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH %q (want require or optional)", c.ClientAuth)
+	}
+	return cfg, nil
+}
+
+// Client returns the TLS config for outgoing calls, or nil when the defaults apply.
+func (c Config) Client() (*tls.Config, error) {
+	if !c.ClientEnabled() {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		// Keep the system roots so calls to public APIs (GCS, BigQuery, the city portal) still verify
+		pool, err := loadPool(c.CAFile, true)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.ClientCertFile != "" && c.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		// Only sent when the peer asks for one
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadPool(path string, withSystem bool) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if withSystem {
+		if sys, err := x509.SystemCertPool(); err == nil {
+			pool = sys
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Setup applies the client config to http.DefaultTransport, so http.Post and
+// http.DefaultClient calls to other services verify and present certificates.
+func Setup() error {
+	cfg, err := FromEnv().Client()
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return nil
+	}
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = cfg
+	log.Printf("🔐 Outgoing service calls use TLS (custom CA: %t, client cert: %t)", cfg.RootCAs != nil, len(cfg.Certificates) > 0)
+	return nil
+}
+
+// ListenAndServe serves handler on addr (see ListenAddr), over TLS (and mTLS when a client CA is
+// configured) or plain HTTP when no certificate is set, within LimitsFromEnv.
+func ListenAndServe(addr string, handler http.Handler) error {
+	cfg, err := FromEnv().Server()
+	if err != nil {
+		return err
+	}
+	limits := LimitsFromEnv()
+	srv := limits.Server(addr, handler)
+	srv.TLSConfig = cfg
+	log.Printf("⏱️ HTTP limits: header %s, request %s, response %s, idle %s, body %d bytes",
+		limits.ReadHeaderTimeout, limits.ReadTimeout, limits.WriteTimeout, limits.IdleTimeout, limits.MaxBodyBytes)
+	if cfg == nil {
+		log.Printf("🌐 Serving HTTP on %s", addr)
+		return srv.ListenAndServe()
+	}
+	log.Printf("🔐 Serving HTTPS on %s (client certificates: %s)", addr, clientAuthName(cfg.ClientAuth))
+	// Certificates are already in TLSConfig
+	return srv.ListenAndServeTLS("", "")
+}
+
+func clientAuthName(a tls.ClientAuthType) string {
+	switch a {
+	case tls.RequireAndVerifyClientCert:
+		return "required"
+	case tls.VerifyClientCertIfGiven:
+		return "verified if presented"
+	}
+	return "not requested"
+}
@@ -7,8 +7,10 @@ It monitors key pipeline components including:
 
 - GCS buckets: file counts and last update timestamps
 - BigQuery tables: row counts and last modified times
+- Resource drift: bucket and table settings that no longer match the bootstrap spec
 - Cloud Run services: dashboard and API availability status
 - Trigger control: manual pipeline activation via /run
+- Run cost: estimated spend of a run from the trigger's /runs/{id}/summary
 - Reset functions: clear GCS, truncate BQ tables, purge trigger cache
 
 """
@@ -22,6 +24,15 @@ st.set_page_config(page_title="Pipeline Monitor", layout="centered")
 st.title("📊 Pipeline Activity Monitor")
 
 
+def describe_error(response):
+    """Formats a failed service response, using its problem+json fields when present."""
+    if response.headers.get("Content-Type", "").startswith("application/problem+json"):
+        p = response.json()
+        message = f"{p.get('title', 'Request failed')} ({p.get('status', response.status_code)}): {p.get('detail', '')}"
+        return f"{message} — correlation ID {p.get('correlation_id', 'n/a')}"
+    return f"status {response.status_code}: {response.text}"
+
+
 # === PIPELINE SERVICE STATUS ===
 
 st.header("⚙️ Pipeline Service Status")
@@ -104,6 +115,26 @@ for label, full_table_id in BQ_TABLES.items():
     except Exception as e:
         st.error(f"Failed to fetch info for {label}: {e}")
 
+# === RESOURCE DRIFT ===
+
+st.header("🧭 Resource Drift")
+
+try:
+    response = requests.get("https://trigger-931515156181.us-central1.run.app/readyz", timeout=10)
+    readyz = response.json()
+    warnings = readyz.get("warnings", [])
+    checked = readyz.get("drift_checked_at")
+    if not checked:
+        st.info("No drift check has run yet.")
+    elif warnings:
+        for warning in warnings:
+            st.warning(warning)
+        st.caption(f"Checked at {checked}")
+    else:
+        st.success(f"✅ Buckets and tables match the bootstrap spec (checked at {checked})")
+except Exception as e:
+    st.error(f"Failed to fetch drift status: {e}")
+
 if "refresh" not in st.session_state:
     st.session_state.refresh = False
 
@@ -161,9 +192,50 @@ if submitted:
     try:
         response = requests.post(trigger_url, json=payload)
         if response.status_code == 200:
+            st.session_state["last_run_id"] = response.json().get("run_id", "")
             st.success(f"✅ Pipeline triggered for {date} with max_offset={max_offset}")
         else:
-            st.error(f"❌ Failed with status {response.status_code}: {response.text}")
+            st.error(f"❌ Failed with {describe_error(response)}")
+    except Exception as e:
+        st.error(f"🚨 Error: {e}")
+
+
+
+# === RUN COST ===
+
+st.header("💰 Run Cost Estimate")
+
+run_id = st.text_input("Run ID", value=st.session_state.get("last_run_id", ""))
+if st.button("Estimate Cost") and run_id:
+    try:
+        summary_url = f"https://trigger-931515156181.us-central1.run.app/runs/{run_id}/summary"
+        response = requests.get(summary_url, timeout=60)
+        if response.status_code == 200:
+            summary = response.json()
+            cost = summary.get("cost", {})
+            st.metric("Estimated cost (USD)", f"${cost.get('total_usd', 0):.4f}")
+            st.caption(cost.get("estimate", ""))
+            st.table([
+                {
+                    "Item": line["item"],
+                    "Quantity": f"{line['quantity']:.6f} {line['unit']}",
+                    "Unit price": f"${line['unit_price_usd']}",
+                    "Cost": f"${line['usd']:.6f}",
+                }
+                for line in cost.get("lines", [])
+            ])
+            if summary.get("error"):
+                st.error(f"Run failed ({summary.get('error_category', 'unknown')}): {summary['error']}")
+            failures = {
+                name.split(".", 1)[1]: int(count)
+                for name, count in summary.get("metrics", {}).items()
+                if name.startswith("failures.")
+            }
+            if failures:
+                st.subheader("Failures by category")
+                st.bar_chart(failures)
+        else:
+            st.error(f"❌ Failed with {describe_error(response)}")
     except Exception as e:
         st.error(f"🚨 Error: {e}")
 
@@ -216,6 +288,6 @@ if st.button("🧹 Purge Trigger Cache"):
         if response.status_code == 200:
             st.success("✅ Trigger cache cleared.")
         else:
-            st.error(f"❌ Failed with status {response.status_code}: {response.text}")
+            st.error(f"❌ Failed with {describe_error(response)}")
     except Exception as e:
         st.error(f"🚨 Error: {e}")
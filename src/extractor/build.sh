@@ -9,6 +9,6 @@ cd "$SCRIPT_DIR"
 
 # Step 2: Build Docker image using multi-stage Dockerfile
 echo "--- Building Docker image (multi-stage)..."
-docker build -t hygiene_prediction-extractor -f Dockerfile .
+docker build -t hygiene_prediction-extractor -f Dockerfile ..
 
 echo "✅ Docker image built: hygiene_prediction-extractor"
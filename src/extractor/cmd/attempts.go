@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"configure/socrata"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Attempt outcomes recorded in the ledger.
+const (
+	outcomeSuccess = "success"
+	outcomeRetry   = "retry"   // failed, another attempt follows
+	outcomeFailed  = "failed"  // failed, no attempts left
+	outcomeSkipped = "skipped" // an injected fault skipped the chunk
+)
+
+// ChunkAttempt is one row of the chunk_attempts ledger: a single fetch of a
+// chunk from the API, or the write of a fetched chunk to GCS.
+type ChunkAttempt struct {
+	RunID          string    `bigquery:"run_id"`
+	Date           string    `bigquery:"date"`
+	Mode           string    `bigquery:"mode"`
+	Offset         int       `bigquery:"offset"`
+	Operation      string    `bigquery:"operation"` // fetch | gcs_write
+	Attempt        int       `bigquery:"attempt"`
+	Outcome        string    `bigquery:"outcome"`
+	ErrorClass     string    `bigquery:"error_class"`
+	Error          string    `bigquery:"error"`
+	StatusCode     int       `bigquery:"status_code"`
+	LatencySeconds float64   `bigquery:"latency_seconds"`
+	Timestamp      time.Time `bigquery:"timestamp"`
+}
+
+// attemptLedger buffers a run's chunk attempts and streams them to BigQuery
+// once per chunk. A ledger whose table cannot be prepared only logs.
+type attemptLedger struct {
+	ctx     context.Context
+	table   *bigquery.Table
+	runID   string
+	date    string
+	mode    string
+	pending []ChunkAttempt
+	// Written counts streamed rows, reported as billable usage
+	Written int
+}
+
+// newAttemptLedger opens PipelineMonitoring.chunk_attempts (CHUNK_ATTEMPTS_TABLE
+// overrides the table name), creating it partitioned by day on first use.
+func newAttemptLedger(ctx context.Context, bqClient *bigquery.Client, runID, date, mode string) *attemptLedger {
+	l := &attemptLedger{ctx: ctx, runID: runID, date: date, mode: mode}
+	if bqClient == nil {
+		return l
+	}
+	tableID := os.Getenv("CHUNK_ATTEMPTS_TABLE")
+	if tableID == "" {
+		tableID = "chunk_attempts"
+	}
+	table := bqClient.Dataset("PipelineMonitoring").Table(tableID)
+	if _, err := table.Metadata(ctx); err != nil {
+		schema, err := bigquery.InferSchema(ChunkAttempt{})
+		if err == nil {
+			err = table.Create(ctx, &bigquery.TableMetadata{
+				Schema:           schema,
+				TimePartitioning: &bigquery.TimePartitioning{Field: "timestamp"},
+			})
+		}
+		if err != nil {
+			log.Printf("⚠️ chunk_attempts ledger disabled: %v", err)
+			return l
+		}
+		log.Printf("🆕 Created BigQuery table PipelineMonitoring.%s", tableID)
+	}
+	l.table = table
+	return l
+}
+
+// record adds one attempt to the pending rows.
+func (l *attemptLedger) record(offset int, operation string, attempt int, outcome, errorClass string, err error, statusCode int, latency time.Duration) {
+	a := ChunkAttempt{
+		RunID:          l.runID,
+		Date:           l.date,
+		Mode:           l.mode,
+		Offset:         offset,
+		Operation:      operation,
+		Attempt:        attempt,
+		Outcome:        outcome,
+		ErrorClass:     errorClass,
+		StatusCode:     statusCode,
+		LatencySeconds: latency.Seconds(),
+		Timestamp:      time.Now(),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	if outcome != outcomeSuccess {
+		log.Printf("📒 chunk_attempt: offset=%d %s #%d %s (%s)", offset, operation, attempt, outcome, errorClass)
+	}
+	l.pending = append(l.pending, a)
+}
+
+// flush streams the pending rows.
+func (l *attemptLedger) flush() {
+	if len(l.pending) == 0 {
+		return
+	}
+	rows := l.pending
+	l.pending = nil
+	if l.table == nil {
+		return
+	}
+	// Insert IDs identify each attempt, so a retried insert that had landed is deduplicated
+	savers := make([]*bigquery.StructSaver, len(rows))
+	for i := range rows {
+		a := rows[i]
+		savers[i] = &bigquery.StructSaver{Struct: a, InsertID: fmt.Sprintf("%s-%d-%s-%d-%d", a.RunID, a.Offset, a.Operation, a.Attempt, a.Timestamp.UnixNano())}
+	}
+	inserter := l.table.Inserter()
+	err := bqRetry.Do(l.ctx, func(ctx context.Context, attempt int) error {
+		return withBQTimeout(ctx, "chunk attempts insert", bqInsertTimeout, func(ctx context.Context) error {
+			return inserter.Put(ctx, savers)
+		})
+	})
+	if err != nil {
+		log.Printf("❌ Failed to insert chunk attempts into BigQuery: %v", err)
+		return
+	}
+	l.Written += len(rows)
+}
+
+// classifyFetchError names the kind of failure of one API fetch.
+func classifyFetchError(err error, statusCode int) string {
+	var netErr net.Error
+	var apiErr *socrata.APIError
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case statusCode == 429:
+		return "rate_limited"
+	case statusCode >= 500:
+		return "http_5xx"
+	case statusCode >= 400:
+		return "http_4xx"
+	case statusCode >= 300:
+		return fmt.Sprintf("http_%d", statusCode)
+	case errors.As(err, &apiErr):
+		// An error payload sent with a 200
+		return "api_error"
+	case err != nil:
+		return "network"
+	}
+	return ""
+}
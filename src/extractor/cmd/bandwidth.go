@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// uploadLimit is the run's GCS upload cap in KiB/s: upload_kbps, or
+// GCS_UPLOAD_KBPS when the request doesn't set one; 0 leaves uploads uncapped.
+func (req ExtractRequest) uploadLimit() (int, error) {
+	if req.UploadKBps < 0 {
+		return 0, fmt.Errorf("upload_kbps %d must not be negative", req.UploadKBps)
+	}
+	if req.UploadKBps > 0 {
+		return req.UploadKBps, nil
+	}
+	if v := os.Getenv("GCS_UPLOAD_KBPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid GCS_UPLOAD_KBPS %q", v)
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+// uploadThrottle paces a run's uploads with a token bucket, so an extraction
+// on a shared or constrained network doesn't saturate its egress, and
+// measures the throughput they actually got. A nil limiter doesn't pace.
+type uploadThrottle struct {
+	limiter *rate.Limiter
+	burst   int
+	bytes   atomic.Int64
+	nanos   atomic.Int64
+}
+
+func newUploadThrottle(kbps int) *uploadThrottle {
+	t := &uploadThrottle{}
+	if kbps > 0 {
+		perSecond := kbps << 10
+		// Pieces of at most 64 KiB keep the pace even within an object
+		t.burst = min(perSecond, 64<<10)
+		t.limiter = rate.NewLimiter(rate.Limit(perSecond), t.burst)
+	}
+	return t
+}
+
+// write sends data to w, waiting for tokens before each piece.
+func (t *uploadThrottle) write(ctx context.Context, w io.Writer, data []byte) error {
+	if t == nil || t.limiter == nil {
+		_, err := w.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		n := min(len(data), t.burst)
+		if err := t.limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// record counts an upload of n bytes that took d, retries included.
+func (t *uploadThrottle) record(n int, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.bytes.Add(int64(n))
+	t.nanos.Add(int64(d))
+}
+
+// bytesPerSecond is the throughput of the uploads so far, or 0 before any.
+func (t *uploadThrottle) bytesPerSecond() float64 {
+	if t == nil || t.nanos.Load() == 0 {
+		return 0
+	}
+	return float64(t.bytes.Load()) / time.Duration(t.nanos.Load()).Seconds()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"configure/schemas"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// migrateSchema adds the columns of want an existing table lacks, such as
+// fields added to a metrics row after the table was created, so inserts
+// carrying them aren't rejected. Only additive changes are made; a missing
+// REQUIRED column is reported instead, since BigQuery can't add one.
+func migrateSchema(ctx context.Context, bqClient *bigquery.Client, datasetID, tableID string, want schemas.Schema) {
+	if bqClient == nil {
+		return
+	}
+	table := bqClient.Dataset(datasetID).Table(tableID)
+	meta, err := table.Metadata(ctx)
+	if err != nil {
+		log.Printf("⚠️ Could not read %s.%s schema: %v", datasetID, tableID, err)
+		return
+	}
+	have := make([]string, len(meta.Schema))
+	for i, f := range meta.Schema {
+		have[i] = f.Name
+	}
+	schema := meta.Schema
+	var added []string
+	for _, f := range bigquerySchema(want.Missing(have)) {
+		if f.Required {
+			log.Printf("⚠️ %s.%s lacks REQUIRED column %s, which can't be added", datasetID, tableID, f.Name)
+			continue
+		}
+		schema = append(schema, f)
+		added = append(added, f.Name)
+	}
+	if len(added) == 0 {
+		return
+	}
+	if _, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, meta.ETag); err != nil {
+		log.Printf("⚠️ Could not add %v to %s.%s: %v", added, datasetID, tableID, err)
+		return
+	}
+	log.Printf("🆕 Added %v to %s.%s", added, datasetID, tableID)
+}
+
+// bigquerySchema converts a shared schema definition to the client's form.
+func bigquerySchema(s schemas.Schema) bigquery.Schema {
+	if len(s) == 0 {
+		return nil
+	}
+	out := make(bigquery.Schema, len(s))
+	for i, f := range s {
+		out[i] = &bigquery.FieldSchema{
+			Name:     f.Name,
+			Type:     bigquery.FieldType(f.Type),
+			Repeated: f.Mode == "REPEATED",
+			Required: f.Mode == "REQUIRED",
+			Schema:   bigquerySchema(f.Fields),
+		}
+	}
+	return out
+}
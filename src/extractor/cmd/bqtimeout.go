@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"configure/errcategory"
+)
+
+// Each BigQuery call gets its own deadline, so a hung insert or load job
+// can't stall a run whose context has none. BQ_CLIENT_TIMEOUT bounds client
+// creation (default 10s), BQ_INSERT_TIMEOUT each streaming insert attempt
+// (default 30s) and BQ_LOAD_TIMEOUT each load job, waiting included
+// (default 10m).
+var (
+	bqClientTimeout = bqTimeout("BQ_CLIENT_TIMEOUT", 10*time.Second)
+	bqInsertTimeout = bqTimeout("BQ_INSERT_TIMEOUT", 30*time.Second)
+	bqLoadTimeout   = bqTimeout("BQ_LOAD_TIMEOUT", 10*time.Minute)
+)
+
+func bqTimeout(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("⚠️ Invalid %s %q — using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// withBQTimeout runs one BigQuery operation under timeout. An operation cut
+// off by that deadline, rather than by ctx, fails as a TransientNetwork error
+// naming the operation, so bqRetry repeats it and the trigger sees why.
+func withBQTimeout(ctx context.Context, op string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(opCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+		return errcategory.Wrap(errcategory.TransientNetwork, fmt.Errorf("bigquery %s timed out after %s: %w", op, timeout, err))
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"configure/gcp"
+	"configure/manifest"
+	"configure/problem"
+
+	"cloud.google.com/go/storage"
+)
+
+// chunkListing is one chunk file of a date's folder as /data/{date} lists it.
+type chunkListing struct {
+	Offset  int       `json:"offset"`
+	Object  string    `json:"object"`
+	Size    int64     `json:"size"`
+	Rows    *int      `json:"rows,omitempty"` // from the manifest, once it is written
+	Updated time.Time `json:"updated"`
+}
+
+// requestFolder resolves the folder a /raw or /data request reads: the
+// date's raw-data folder, or its snapshot with ?snapshot=true. It writes
+// the problem and returns false when the date is malformed or no bucket is
+// configured.
+func requestFolder(w http.ResponseWriter, r *http.Request, date string) (bucket, folder string, ok bool) {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "date must be YYYY-MM-DD")
+		return "", "", false
+	}
+	bucket = os.Getenv("BUCKET_NAME")
+	if bucket == "" {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "BUCKET_NAME not set")
+		return "", "", false
+	}
+	folder = "raw-data/" + date
+	if r.URL.Query().Get("snapshot") == "true" {
+		folder = snapshotFolder(date)
+	}
+	return bucket, folder, true
+}
+
+// handleListChunks lists the chunk files written for a date by offset:
+// GET /data/{date}. Row counts come from the manifest, which an extraction
+// still in progress hasn't written yet.
+func handleListChunks(w http.ResponseWriter, r *http.Request) {
+	date := r.PathValue("date")
+	bucket, folder, ok := requestFolder(w, r, date)
+	if !ok {
+		return
+	}
+	objects, err := gcp.ListObjectInfo(r.Context(), bucket, folder+"/")
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "List "+folder+": "+err.Error())
+		return
+	}
+
+	chunks := []chunkListing{}
+	hasManifest := false
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Name, folder+"/")
+		if name == "_manifest.json" {
+			hasManifest = true
+		}
+		offset, ok := chunkOffset(name)
+		if !ok {
+			continue
+		}
+		chunks = append(chunks, chunkListing{Offset: offset, Object: name, Size: o.Size, Updated: o.Updated})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Offset < chunks[j].Offset })
+
+	body := map[string]interface{}{
+		"date":            date,
+		"folder":          folder,
+		"chunks":          chunks,
+		"upload_complete": false,
+	}
+	if hasManifest {
+		m, err := manifest.Read(r.Context(), bucket, folder)
+		if err != nil {
+			log.Printf("⚠️ Could not read manifest for %s: %v", folder, err)
+		} else {
+			rows := make(map[string]int, len(m.Objects))
+			for _, o := range m.Objects {
+				rows[o.Name] = o.Rows
+			}
+			for i := range chunks {
+				if n, ok := rows[chunks[i].Object]; ok {
+					chunks[i].Rows = &n
+				}
+			}
+			body["upload_complete"] = m.UploadComplete
+			body["schema_version"] = m.SchemaVersion
+			body["totals"] = m.Totals
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// chunkOffset parses the offset out of a chunk file name, offset_N.json.
+func chunkOffset(name string) (int, bool) {
+	if !strings.HasPrefix(name, "offset_") || !strings.HasSuffix(name, ".json") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "offset_"), ".json"))
+	return n, err == nil
+}
+
+// handleReadChunk streams back the chunk file written at an offset:
+// GET /data/{date}/{offset}. ?limit=N stops after N rows; ?pretty=true
+// answers with an indented JSON array instead of the NDJSON as written.
+func handleReadChunk(w http.ResponseWriter, r *http.Request) {
+	bucket, folder, ok := requestFolder(w, r, r.PathValue("date"))
+	if !ok {
+		return
+	}
+	offset, err := strconv.Atoi(r.PathValue("offset"))
+	if err != nil || offset < 0 {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "offset must be a non-negative integer")
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "limit must be a positive integer")
+			return
+		}
+	}
+	pretty := r.URL.Query().Get("pretty") == "true"
+
+	storageClient, err := NewGCSStorage()
+	if err != nil {
+		problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "GCS client: "+err.Error())
+		return
+	}
+	objectPath := fmt.Sprintf("%s/offset_%d.json", folder, offset)
+	reader, err := storageClient.Client.Bucket(bucket).Object(objectPath).NewReader(r.Context())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No chunk "+objectPath)
+		return
+	}
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Read "+objectPath+": "+err.Error())
+		return
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	if pretty {
+		records := []json.RawMessage{}
+		for (limit == 0 || len(records) < limit) && scanner.Scan() {
+			records = append(records, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+		}
+		if err := scanner.Err(); err != nil {
+			problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Read "+objectPath+": "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	for rows := 0; (limit == 0 || rows < limit) && scanner.Scan(); rows++ {
+		w.Write(scanner.Bytes())
+		w.Write([]byte("\n"))
+	}
+	// The status is already sent, so a failed read can only be logged
+	if err := scanner.Err(); err != nil {
+		log.Printf("⚠️ Reading %s stopped early: %v", objectPath, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chunkSizer picks the SODA $limit for each chunk. After every fetch it
+// re-estimates the seconds and bytes one row costs and sizes the next chunk
+// to take about target seconds and stay under maxBytes, moving at most 2x
+// either way per chunk and staying within [min, max].
+type chunkSizer struct {
+	size     int
+	min, max int
+	adaptive bool
+	target   float64 // seconds per fetch
+	maxBytes int
+
+	// Smoothed per-row cost of recent chunks; 0 until the first observation
+	secsPerRow  float64
+	bytesPerRow float64
+}
+
+// newChunkSizer reads CHUNK_SIZE (the starting size), CHUNK_SIZE_MIN,
+// CHUNK_SIZE_MAX, CHUNK_TARGET_SECONDS and CHUNK_MAX_BYTES.
+// CHUNK_ADAPTIVE=false keeps every chunk at CHUNK_SIZE.
+func newChunkSizer() *chunkSizer {
+	c := &chunkSizer{
+		size:     envInt("CHUNK_SIZE", 1000),
+		min:      envInt("CHUNK_SIZE_MIN", 250),
+		max:      envInt("CHUNK_SIZE_MAX", 10000),
+		adaptive: !strings.EqualFold(os.Getenv("CHUNK_ADAPTIVE"), "false"),
+		target:   float64(envInt("CHUNK_TARGET_SECONDS", 5)),
+		maxBytes: envInt("CHUNK_MAX_BYTES", 8<<20),
+	}
+	if c.min > c.max {
+		c.min, c.max = c.max, c.min
+	}
+	if c.adaptive {
+		c.size = c.clamp(c.size)
+	}
+	return c
+}
+
+// Size is the $limit for the next chunk.
+func (c *chunkSizer) Size() int { return c.size }
+
+// restore continues from the size a previous window had settled on.
+func (c *chunkSizer) restore(size int) {
+	if c.adaptive && size > 0 {
+		c.size = c.clamp(size)
+	}
+}
+
+// observe adjusts the size after a successful fetch of rows rows in seconds
+// seconds and bytes bytes.
+func (c *chunkSizer) observe(rows int, seconds float64, bytes int) {
+	// A short page is the end of the data and says little about the cost of a full one
+	if !c.adaptive || rows == 0 || rows < c.size {
+		return
+	}
+	c.secsPerRow = smooth(c.secsPerRow, seconds/float64(rows))
+	c.bytesPerRow = smooth(c.bytesPerRow, float64(bytes)/float64(rows))
+
+	next := c.target / c.secsPerRow
+	if c.bytesPerRow > 0 {
+		next = math.Min(next, float64(c.maxBytes)/c.bytesPerRow)
+	}
+	next = math.Max(math.Min(next, 2*float64(c.size)), float64(c.size)/2)
+	c.resize(int(next), "%.2fs, %d bytes for %d rows", seconds, bytes, rows)
+}
+
+// failed halves the size after a fetch attempt timed out, so the retry asks
+// for a page more likely to arrive within the deadline.
+func (c *chunkSizer) failed(class string) {
+	if !c.adaptive || class != "timeout" {
+		return
+	}
+	c.resize(c.size/2, "fetch timed out")
+}
+
+func (c *chunkSizer) resize(next int, reason string, args ...interface{}) {
+	// Round to 50 rows so the size doesn't jitter on every chunk
+	next = c.clamp(int(math.Round(float64(next)/50)) * 50)
+	if next == c.size {
+		return
+	}
+	log.Printf("📏 Chunk size %d → %d ("+reason+")", append([]interface{}{c.size, next}, args...)...)
+	c.size = next
+}
+
+func (c *chunkSizer) clamp(n int) int {
+	return min(max(n, c.min), c.max)
+}
+
+// smooth is an exponentially weighted average that gives the newest value half the weight.
+func smooth(prev, v float64) float64 {
+	if prev == 0 {
+		return v
+	}
+	return (prev + v) / 2
+}
+
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"configure/manifest"
+	"configure/schemas"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// checkpointPath is where the checkpoint of date's extraction is kept. Each
+// date has its own, so runs for different dates going at once (see the
+// trigger's queue.max_concurrent) never resume from each other's.
+func checkpointPath(date string) string {
+	return fmt.Sprintf("checkpoints/%s.json", date)
+}
+
+// checkpoint is checkpoints/{date}.json: how far the date's extraction got
+// and what it had written by then, so a run that died part way picks up where
+// it stopped with the files before it still in its manifest. A completed run
+// resets it, so the next run for the date starts from the top again.
+type checkpoint struct {
+	Date          string            `json:"date,omitempty"`
+	LastOffset    int               `json:"last_offset"`
+	InitialOffset int               `json:"initial_offset"`
+	RowsFetched   int               `json:"rows_fetched"`
+	Written       []pageWrite       `json:"written,omitempty"`
+	Objects       []manifest.Object `json:"objects,omitempty"`
+	Pending       *chunkCommit      `json:"pending,omitempty"`
+}
+
+// chunkCommit is the chunk being committed. It is recorded before its file
+// is saved, recorded again with Committed set once the file is saved and the
+// offset moved past it, and cleared when the next chunk begins. Its metrics
+// row is fixed before the insert, insert ID and all, so whoever finds it
+// pending can tell whether the row landed.
+type chunkCommit struct {
+	Path      string              `json:"path,omitempty"` // in the bucket; empty for an unchanged page
+	Object    manifest.Object     `json:"object"`
+	Page      pageWrite           `json:"page"`
+	Committed bool                `json:"committed"`
+	Metrics   schemas.ChunkMetric `json:"metrics"`
+}
+
+// chunkCommits keeps the checkpoint of a date's extraction. A nil
+// *chunkCommits, as snapshots have, records nothing.
+type chunkCommits struct {
+	s      Storage
+	bucket string
+	cp     checkpoint
+}
+
+// loadCommits reads date's checkpoint. One that names another date doesn't
+// apply and starts from offset 0.
+func loadCommits(s Storage, bucket, date string) *chunkCommits {
+	c := &chunkCommits{s: s, bucket: bucket, cp: checkpoint{Date: date}}
+	data, err := s.ReadObject(bucket, checkpointPath(date))
+	if err != nil {
+		log.Println("No checkpoint found — starting from offset 0")
+		return c
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		log.Println("Failed to parse checkpoint — starting from offset 0")
+		return c
+	}
+	if cp.Date != date {
+		log.Printf("Checkpoint is for %q, not %s — starting from offset 0", cp.Date, date)
+		return c
+	}
+	c.cp = cp
+	return c
+}
+
+func (c *chunkCommits) save() {
+	data, err := json.MarshalIndent(c.cp, "", "  ")
+	if err == nil {
+		err = c.s.SaveObject(c.bucket, checkpointPath(c.cp.Date), data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to save %s: %v", checkpointPath(c.cp.Date), err)
+	}
+}
+
+// begin records the chunk about to be saved at offset, with the metrics it
+// would have if that were the last step.
+func (c *chunkCommits) begin(pending chunkCommit) {
+	if c == nil {
+		return
+	}
+	c.cp.Pending = &pending
+	c.save()
+}
+
+// commit moves the checkpoint past a saved chunk, with the run's progress
+// including it and the metrics row about to be inserted for it.
+func (c *chunkCommits) commit(done chunkCommit, next, initialOffset, rowsFetched int, written []pageWrite, chunks manifest.Manifest) {
+	if c == nil {
+		return
+	}
+	done.Committed = true
+	c.cp.LastOffset, c.cp.InitialOffset, c.cp.RowsFetched = next, initialOffset, rowsFetched
+	c.cp.Written, c.cp.Objects = written, chunks.Objects
+	c.cp.Pending = &done
+	c.save()
+}
+
+// finish resets the checkpoint once the date's manifest is written.
+func (c *chunkCommits) finish() {
+	if c == nil {
+		return
+	}
+	c.cp = checkpoint{Date: c.cp.Date}
+	c.save()
+}
+
+// reconcile settles the chunk a stopped run left pending. A chunk whose file
+// was saved in full, though the checkpoint never moved past it, is kept
+// instead of fetched again; a committed one gets its metrics row unless
+// chunk_metrics already has it.
+func (c *chunkCommits) reconcile(ctx context.Context, bqClient *bigquery.Client) {
+	p := c.cp.Pending
+	if p == nil {
+		return
+	}
+	if !p.Committed {
+		data, err := c.s.ReadObject(c.bucket, p.Path)
+		if err == nil && manifest.Describe(p.Object.Name, data) == p.Object {
+			log.Printf("♻️ %s was saved before the last run stopped — keeping it", p.Path)
+			c.cp.LastOffset = p.Page.Offset + p.Page.Limit
+			c.cp.RowsFetched += p.Page.Fetched
+			c.cp.Written = append(c.cp.Written, p.Page)
+			c.cp.Objects = append(c.cp.Objects, p.Object)
+			p.Committed = true
+		} else {
+			log.Printf("🔁 %s was not saved in full — fetching offset %d again", p.Path, p.Page.Offset)
+		}
+	}
+	if p.Committed {
+		recorded, err := chunkMetricRecorded(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", p.Metrics)
+		switch {
+		case err != nil:
+			log.Printf("⚠️ Could not look up metrics for offset %d, inserting them again: %v", p.Metrics.Offset, err)
+			putChunkMetric(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", p.Metrics)
+		case !recorded:
+			log.Printf("📊 Metrics for offset %d were not recorded — inserting them now", p.Metrics.Offset)
+			putChunkMetric(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", p.Metrics)
+		}
+	}
+	c.cp.Pending = nil
+	c.save()
+}
+
+// restore puts the checkpoint's progress back into a new run.
+func (c *chunkCommits) restore(chunks *manifest.Manifest) (offset, initialOffset, rowsFetched int, written []pageWrite) {
+	if c == nil {
+		return 0, 0, 0, nil
+	}
+	for _, o := range c.cp.Objects {
+		chunks.AddObject(o)
+	}
+	if c.cp.LastOffset > 0 {
+		log.Printf("⏯️ Resuming %s from offset %d (%d files kept from the stopped run)", c.cp.Date, c.cp.LastOffset, len(c.cp.Objects))
+	}
+	return c.cp.LastOffset, c.cp.InitialOffset, c.cp.RowsFetched, c.cp.Written
+}
+
+// chunkMetricRecorded reports whether chunk_metrics has row, matched on its
+// offset and timestamp. Streamed rows are visible to queries at once.
+func chunkMetricRecorded(ctx context.Context, bqClient *bigquery.Client, datasetID, tableID string, row schemas.ChunkMetric) (bool, error) {
+	if bqClient == nil {
+		return false, nil
+	}
+	q := bqClient.Query(fmt.Sprintf("SELECT COUNT(*) FROM `%s.%s` WHERE timestamp = @timestamp AND `offset` = @offset", datasetID, tableID))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "timestamp", Value: row.Timestamp},
+		{Name: "offset", Value: row.Offset},
+	}
+	var count []bigquery.Value
+	err := withBQTimeout(ctx, "chunk metrics lookup", bqInsertTimeout, func(ctx context.Context) error {
+		it, err := q.Read(ctx)
+		if err != nil {
+			return err
+		}
+		return it.Next(&count)
+	})
+	if err != nil {
+		return false, err
+	}
+	n, _ := count[0].(int64)
+	return n > 0, nil
+}
+
+// chunkFile is the manifest entry and page record of a chunk file saved at
+// objectName, as the loop adds them to the run.
+func chunkFile(objectName string, data []byte, offset, limit, fetched, dropped int) (manifest.Object, pageWrite) {
+	name := filepath.Base(objectName)
+	return manifest.Describe(name, data), pageWrite{Object: name, Offset: offset, Limit: limit, Fetched: fetched, Dropped: dropped}
+}
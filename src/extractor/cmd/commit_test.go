@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"configure/manifest"
+)
+
+// Runs for two dates going at once each resume from their own checkpoint,
+// and one finishing doesn't reset the other's.
+func TestCheckpointPerDate(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	first := loadCommits(s, "raw", "2025-01-30")
+	second := loadCommits(s, "raw", "2025-01-31")
+
+	var chunks manifest.Manifest
+	for i, c := range []*chunkCommits{first, second, first, second} {
+		offset := i * 1000
+		object, page := chunkFile(fmt.Sprintf("offset_%d.json", offset), []byte(`{"id": 1}`+"\n"), offset, 1000, 1, 0)
+		c.begin(chunkCommit{Object: object, Page: page})
+		chunks.AddObject(object)
+		c.commit(chunkCommit{Object: object, Page: page}, offset+1000, 0, offset+1, []pageWrite{page}, chunks)
+	}
+
+	tests := []struct {
+		date       string
+		wantOffset int
+	}{
+		{"2025-01-30", 3000},
+		{"2025-01-31", 4000},
+	}
+	for _, tt := range tests {
+		var m manifest.Manifest
+		offset, _, rows, written := loadCommits(s, "raw", tt.date).restore(&m)
+		if offset != tt.wantOffset || rows != tt.wantOffset-999 || len(written) != 1 {
+			t.Errorf("%s resumes at offset %d with %d rows and %d pages, want offset %d", tt.date, offset, rows, len(written), tt.wantOffset)
+		}
+	}
+
+	first.finish()
+	if offset, _, _, _ := loadCommits(s, "raw", "2025-01-30").restore(new(manifest.Manifest)); offset != 0 {
+		t.Errorf("finished date resumes at offset %d, want 0", offset)
+	}
+	if offset, _, _, _ := loadCommits(s, "raw", "2025-01-31").restore(new(manifest.Manifest)); offset != 4000 {
+		t.Errorf("the other date resumes at offset %d after the first finished, want 4000", offset)
+	}
+}
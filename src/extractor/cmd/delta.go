@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"configure/manifest"
+	"configure/problem"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// DeltaRecord is one inspection that differs between two snapshots.
+type DeltaRecord struct {
+	InspectionID string `json:"inspection_id" bigquery:"inspection_id"`
+	ChangeType   string `json:"change_type" bigquery:"change_type"` // added | removed | changed
+	OldHash      string `json:"old_hash,omitempty" bigquery:"old_hash"`
+	NewHash      string `json:"new_hash,omitempty" bigquery:"new_hash"`
+}
+
+// DeltaStats summarizes churn between two snapshots.
+type DeltaStats struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	FromRows  int     `json:"from_rows"`
+	ToRows    int     `json:"to_rows"`
+	Added     int     `json:"added"`
+	Removed   int     `json:"removed"`
+	Changed   int     `json:"changed"`
+	Unchanged int     `json:"unchanged"`
+	ChurnRate float64 `json:"churn_rate"`
+	DeltaFile string  `json:"delta_file"`
+	Table     string  `json:"table"`
+}
+
+// loadSnapshotHashes maps inspection_id → SHA-256 of the row's canonical JSON
+// (encoding/json sorts map keys, so equal rows hash equally).
+func loadSnapshotHashes(storageClient *GCSStorage, bucketName, date string) (map[string]string, error) {
+	folder := snapshotFolder(date)
+	reader, err := storageClient.Client.Bucket(bucketName).Object(folder + "/_manifest.json").NewReader(storageClient.Ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot manifest for %s: %w", date, err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot manifest for %s: %w", date, err)
+	}
+	chunks, err := manifest.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse snapshot manifest for %s: %w", date, err)
+	}
+	// A delta against a damaged snapshot would report its missing rows as deleted
+	if err := manifest.Verify(storageClient.Ctx, bucketName, folder, chunks); err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	for _, file := range chunks.Files {
+		r, err := storageClient.Client.Bucket(bucketName).Object(folder + "/" + file).NewReader(storageClient.Ctx)
+		if err != nil {
+			return nil, fmt.Errorf("read %s/%s: %w", folder, file, err)
+		}
+		dec := json.NewDecoder(r)
+		for {
+			var record map[string]interface{}
+			if err := dec.Decode(&record); err == io.EOF {
+				break
+			} else if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("decode %s/%s: %w", folder, file, err)
+			}
+			id, _ := record["inspection_id"].(string)
+			if id == "" {
+				continue
+			}
+			canonical, _ := json.Marshal(record)
+			sum := sha256.Sum256(canonical)
+			hashes[id] = hex.EncodeToString(sum[:])
+		}
+		r.Close()
+	}
+	return hashes, nil
+}
+
+// computeDelta compares two snapshots, writes the delta NDJSON and summary under
+// snapshots/deltas/, and loads the delta into RawSnapshots.delta_FROM_TO.
+func computeDelta(ctx context.Context, bqClient *bigquery.Client, from, to string) (*DeltaStats, error) {
+	storageClient, err := NewGCSStorage()
+	if err != nil {
+		return nil, err
+	}
+	bucketName := os.Getenv("BUCKET_NAME")
+	if bucketName == "" {
+		return nil, fmt.Errorf("BUCKET_NAME not set")
+	}
+
+	oldHashes, err := loadSnapshotHashes(storageClient, bucketName, from)
+	if err != nil {
+		return nil, err
+	}
+	newHashes, err := loadSnapshotHashes(storageClient, bucketName, to)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DeltaStats{From: from, To: to, FromRows: len(oldHashes), ToRows: len(newHashes)}
+	var delta []DeltaRecord
+	for id, newHash := range newHashes {
+		oldHash, ok := oldHashes[id]
+		switch {
+		case !ok:
+			stats.Added++
+			delta = append(delta, DeltaRecord{InspectionID: id, ChangeType: "added", NewHash: newHash})
+		case oldHash != newHash:
+			stats.Changed++
+			delta = append(delta, DeltaRecord{InspectionID: id, ChangeType: "changed", OldHash: oldHash, NewHash: newHash})
+		default:
+			stats.Unchanged++
+		}
+	}
+	for id, oldHash := range oldHashes {
+		if _, ok := newHashes[id]; !ok {
+			stats.Removed++
+			delta = append(delta, DeltaRecord{InspectionID: id, ChangeType: "removed", OldHash: oldHash})
+		}
+	}
+	sort.Slice(delta, func(i, j int) bool { return delta[i].InspectionID < delta[j].InspectionID })
+	if stats.FromRows > 0 {
+		stats.ChurnRate = float64(stats.Added+stats.Removed+stats.Changed) / float64(stats.FromRows)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, d := range delta {
+		if err := encoder.Encode(d); err != nil {
+			return nil, fmt.Errorf("encode delta: %w", err)
+		}
+	}
+
+	name := fmt.Sprintf("%s_%s", strings.ReplaceAll(from, "-", ""), strings.ReplaceAll(to, "-", ""))
+	stats.DeltaFile = fmt.Sprintf("snapshots/deltas/%s.json", name)
+	if err := storageClient.SaveObject(bucketName, stats.DeltaFile, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("write delta file: %w", err)
+	}
+
+	datasetID := os.Getenv("SNAPSHOT_DATASET")
+	if datasetID == "" {
+		datasetID = "RawSnapshots"
+	}
+	stats.Table = fmt.Sprintf("%s.delta_%s", datasetID, name)
+
+	schema, err := bigquery.InferSchema(DeltaRecord{})
+	if err != nil {
+		return nil, fmt.Errorf("infer delta schema: %w", err)
+	}
+	source := bigquery.NewGCSReference(fmt.Sprintf("gs://%s/%s", bucketName, stats.DeltaFile))
+	source.SourceFormat = bigquery.JSON
+	source.Schema = schema
+
+	loader := bqClient.Dataset(datasetID).Table("delta_" + name).LoaderFrom(source)
+	loader.WriteDisposition = bigquery.WriteTruncate
+	err = withBQTimeout(ctx, "delta load", bqLoadTimeout, func(ctx context.Context) error {
+		job, err := loader.Run(ctx)
+		if err != nil {
+			return fmt.Errorf("start delta load: %w", err)
+		}
+		status, err := job.Wait(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for delta load: %w", err)
+		}
+		if err := status.Err(); err != nil {
+			return fmt.Errorf("delta load failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary, _ := json.MarshalIndent(stats, "", "  ")
+	if err := storageClient.SaveObject(bucketName, fmt.Sprintf("snapshots/deltas/%s_summary.json", name), summary); err != nil {
+		log.Println("⚠️ Failed to write delta summary:", err)
+	}
+
+	log.Printf("🔀 Delta %s → %s: +%d -%d ~%d (churn %.2f%%)",
+		from, to, stats.Added, stats.Removed, stats.Changed, stats.ChurnRate*100)
+	return stats, nil
+}
+
+func handleDelta(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	var input struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.From == "" || input.To == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Body must be JSON with 'from' and 'to' snapshot dates")
+		return
+	}
+	// Both end up in object paths and table names
+	for _, date := range []string{input.From, input.To} {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, fmt.Sprintf("Invalid snapshot date %q (YYYY-MM-DD)", date))
+			return
+		}
+	}
+
+	stats, err := computeDelta(r.Context(), bqClient, input.From, input.To)
+	if err != nil {
+		log.Println("❌ Delta computation failed:", err)
+		var damaged *manifest.Error
+		if errors.As(err, &damaged) {
+			p := problem.New(r, http.StatusUnprocessableEntity, problem.ManifestMismatch, err.Error())
+			p.Extensions = map[string]interface{}{"problems": damaged.Problems}
+			problem.Send(w, p)
+			return
+		}
+		problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "Delta computation failed: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -10,20 +10,36 @@ import (
 	"math/rand/v2"
 	"net/http"
 	"os"
-	"path/filepath"
 	"time"
 
+	"configure/audit"
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/jobs"
+	"configure/logging"
+	"configure/manifest"
+	"configure/monitoring"
+	"configure/openlineage"
+	"configure/problem"
+	"configure/publish"
+	"configure/retry"
+	"configure/schemas"
+	"configure/socrata"
+	"configure/tlsconfig"
+
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/storage"
 	"github.com/joho/godotenv"
 )
 
-var triggerURL string
-var shutdownRequested = false
+// publisher delivers the extractor's events to the trigger; see EVENT_PUBLISHER
+var publisher publish.EventPublisher = publish.Log{}
 
 type GCSStorage struct {
 	Client *storage.Client
 	Ctx    context.Context
+	// Throttle paces and measures the uploads; nil sends them unmeasured at full speed
+	Throttle *uploadThrottle
 }
 
 func NewGCSStorage() (*GCSStorage, error) {
@@ -45,109 +61,249 @@ func (s *GCSStorage) EnsureBucketExists(bucketName string) error {
 }
 
 func (s *GCSStorage) SaveObject(bucket, objectPath string, data []byte) error {
-	writer := s.Client.Bucket(bucket).Object(objectPath).NewWriter(s.Ctx)
-	writer.ContentType = "application/json"
-	_, err := writer.Write(data)
-	if err != nil {
-		return err
+	return s.write(s.Client.Bucket(bucket).Object(objectPath), data)
+}
+
+// SaveNewObject writes objectPath only if it doesn't exist yet, so snapshot
+// objects can never be overwritten.
+func (s *GCSStorage) SaveNewObject(bucket, objectPath string, data []byte) error {
+	return s.write(s.Client.Bucket(bucket).Object(objectPath).If(storage.Conditions{DoesNotExist: true}), data)
+}
+
+// write uploads data to obj, retrying transient failures. A lost response to
+// a conditional write retries into a precondition failure, which is final.
+//
+// Objects up to GCS_RESUMABLE_THRESHOLD bytes go up in a single request.
+// Larger ones use a resumable upload sent in GCS_UPLOAD_CHUNK_SIZE pieces;
+// the client resends a failed piece for up to GCS_CHUNK_RETRY_SECONDS before
+// gcsRetry starts the object over.
+func (s *GCSStorage) write(obj *storage.ObjectHandle, data []byte) error {
+	// The same bytes are sent on every attempt, so even unconditional writes are safe to repeat
+	obj = obj.Retryer(storage.WithPolicy(storage.RetryAlways))
+	chunkSize := 0
+	if len(data) > envInt("GCS_RESUMABLE_THRESHOLD", 8<<20) {
+		// Resumable chunks must be a multiple of 256 KiB
+		const quantum = 256 << 10
+		chunkSize = (envInt("GCS_UPLOAD_CHUNK_SIZE", 16<<20) + quantum - 1) / quantum * quantum
 	}
-	return writer.Close()
+	start := time.Now()
+	defer func() { s.Throttle.record(len(data), time.Since(start)) }()
+	return gcsRetry.Do(s.Ctx, func(ctx context.Context, attempt int) error {
+		writer := obj.NewWriter(ctx)
+		writer.ContentType = "application/json"
+		writer.ChunkSize = chunkSize
+		writer.ChunkRetryDeadline = time.Duration(envInt("GCS_CHUNK_RETRY_SECONDS", 32)) * time.Second
+		if err := s.Throttle.write(ctx, writer, data); err != nil {
+			writer.Close()
+			return err
+		}
+		return writer.Close()
+	})
 }
 
-func (s *GCSStorage) ReadCheckpoint(bucket, path string) (int, error) {
-	reader, err := s.Client.Bucket(bucket).Object(path).NewReader(s.Ctx)
+// ReadObject downloads objectPath, failing with storage.ErrObjectNotExist if it isn't there.
+func (s *GCSStorage) ReadObject(bucket, objectPath string) ([]byte, error) {
+	reader, err := s.Client.Bucket(bucket).Object(objectPath).NewReader(s.Ctx)
 	if err != nil {
-		log.Println("No checkpoint found — starting from offset 0")
-		return 0, nil
+		return nil, err
 	}
 	defer reader.Close()
+	return io.ReadAll(reader)
+}
 
-	var checkpoint struct{ LastOffset int }
-	if err := json.NewDecoder(reader).Decode(&checkpoint); err != nil {
-		log.Println("Failed to parse checkpoint — starting from offset 0")
-		return 0, nil
+// DeleteObject removes objectPath; one that is already gone is not an error.
+func (s *GCSStorage) DeleteObject(bucket, objectPath string) error {
+	err := s.Client.Bucket(bucket).Object(objectPath).Delete(s.Ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
 	}
-	return checkpoint.LastOffset, nil
+	return err
 }
 
-func (s *GCSStorage) WriteCheckpoint(bucket, path string, offset int) error {
-	data, _ := json.MarshalIndent(map[string]int{"last_offset": offset}, "", "  ")
-	return s.SaveObject(bucket, path, data)
+func (s *GCSStorage) ObjectExists(bucket, objectPath string) (bool, error) {
+	_, err := s.Client.Bucket(bucket).Object(objectPath).Attrs(s.Ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func writeChunkMetrics(ctx context.Context, bqClient *bigquery.Client, datasetID, tableID string, offset int, metrics map[string]interface{}) {
-	metrics["timestamp"] = time.Now()
-	metrics["offset"] = offset
-
-	log.Printf("📊 chunk_metrics: %+v", metrics)
-
-	// Define a struct to match the BigQuery table schema
-	type ChunkMetric struct {
-		Offset               int       `bigquery:"offset"`
-		RowsExtracted        int       `bigquery:"rows_extracted"`
-		RowsDropped          int       `bigquery:"rows_dropped"`
-		ChunkDurationSeconds float64   `bigquery:"chunk_duration_seconds"`
-		DelayApplied         bool      `bigquery:"delay_applied"`
-		FetchSkipped         bool      `bigquery:"fetch_skipped"`
-		GCSWriteSkipped      bool      `bigquery:"gcs_write_skipped"`
-		Timestamp            time.Time `bigquery:"timestamp"`
-	}
-
-	// Safely extract timestamp
-	timestampVal, ok := metrics["timestamp"].(time.Time)
-	if !ok {
-		log.Printf("⚠️ Invalid timestamp format in metrics map")
-		timestampVal = time.Now()
-	}
+	putChunkMetric(ctx, bqClient, datasetID, tableID, chunkMetric(offset, metrics))
+}
 
-	row := ChunkMetric{
-		Offset:               metrics["offset"].(int),
+// chunkMetric is the chunk_metrics row for a chunk's metrics, stamped now.
+func chunkMetric(offset int, metrics map[string]interface{}) schemas.ChunkMetric {
+	// Chunks that were never fetched (an injected fetch error) have no fetch fields
+	fetchError, _ := metrics["fetch_error"].(string)
+	attempts, _ := metrics["fetch_attempts"].(int)
+	status, _ := metrics["status_code"].(int)
+	pageBytes, _ := metrics["page_bytes"].(int)
+	fetchSeconds, _ := metrics["fetch_seconds"].(float64)
+	retrySeconds, _ := metrics["retry_seconds"].(float64)
+	return schemas.ChunkMetric{
+		Offset:               offset,
 		RowsExtracted:        metrics["rows_extracted"].(int),
 		RowsDropped:          metrics["rows_dropped"].(int),
 		ChunkDurationSeconds: metrics["chunk_duration_seconds"].(float64),
 		DelayApplied:         metrics["delay_applied"].(bool),
 		FetchSkipped:         metrics["fetch_skipped"].(bool),
 		GCSWriteSkipped:      metrics["gcs_write_skipped"].(bool),
-		Timestamp:            timestampVal,
+		ChunkSize:            metrics["chunk_size"].(int),
+		SkippedUnchanged:     metrics["skipped_unchanged"].(bool),
+		Timestamp:            time.Now(),
+		RunID:                metrics["run_id"].(string),
+		FetchError:           fetchError,
+		FetchAttempts:        attempts,
+		StatusCode:           status,
+		PageBytes:            pageBytes,
+		FetchSeconds:         fetchSeconds,
+		RetrySeconds:         retrySeconds,
+	}
+}
+
+func putChunkMetric(ctx context.Context, bqClient *bigquery.Client, datasetID, tableID string, row schemas.ChunkMetric) {
+	log.Printf("📊 chunk_metrics: %+v", row)
+	if bqClient == nil {
+		return
 	}
 
+	// A fixed insert ID lets BigQuery drop the duplicate if a retried insert had landed
+	saver := &bigquery.StructSaver{Struct: row, InsertID: fmt.Sprintf("%d-%d", row.Offset, row.Timestamp.UnixNano())}
 	inserter := bqClient.Dataset(datasetID).Table(tableID).Inserter()
-	if err := inserter.Put(ctx, row); err != nil {
+	err := bqRetry.Do(ctx, func(ctx context.Context, attempt int) error {
+		return withBQTimeout(ctx, "chunk metrics insert", bqInsertTimeout, func(ctx context.Context) error {
+			return inserter.Put(ctx, saver)
+		})
+	})
+	if err != nil {
 		log.Printf("❌ Failed to insert metrics into BigQuery: %v", err)
 	} else {
-		log.Printf("✅ Chunk metrics inserted into BigQuery: offset=%d", offset)
+		log.Printf("✅ Chunk metrics inserted into BigQuery: offset=%d", row.Offset)
+	}
+
+	// Fetched chunks also go to Cloud Monitoring, for throughput alerts
+	if row.ChunkDurationSeconds > 0 && !row.FetchSkipped {
+		go monitoring.Gauge(context.Background(),
+			monitoring.Point{Name: "chunk_duration_seconds", Value: row.ChunkDurationSeconds},
+			monitoring.Point{Name: "chunk_rows_per_second", Value: float64(row.RowsExtracted) / row.ChunkDurationSeconds},
+		)
 	}
 }
 
-func RunExtractor(date string, maxOffset int, triggerURL string, bqClient *bigquery.Client,
-	apiErrorProb, gcsErrorProb, rowDropProb, delayProb float64) error {
+// Retry policies for the extractor's calls to the data API, GCS and BigQuery
+var (
+	fetchRetry = retry.Policy{Attempts: 5, Initial: 2 * time.Second, Max: 30 * time.Second, Jitter: 0.5, RetryIf: retry.Transient}
+	gcsRetry   = retry.Policy{Attempts: 3, Initial: 500 * time.Millisecond, Max: 5 * time.Second, Jitter: 0.5, RetryIf: retry.Transient}
+	bqRetry    = retry.Policy{Attempts: 3, Initial: time.Second, Max: 10 * time.Second, Jitter: 0.5, RetryIf: retry.Transient}
+)
+
+// ExtractRequest is the /extract payload forwarded by the trigger's /run.
+type ExtractRequest struct {
+	RunID     string `json:"run_id"`
+	Date      string `json:"date"`
+	MaxOffset int    `json:"max_offset"`
+	// The fault probabilities override the FAULT_* defaults when set, see faults.go
+	APIErrorProb *float64 `json:"api_error_prob,omitempty"`
+	GCSErrorProb *float64 `json:"gcs_error_prob,omitempty"`
+	RowDropProb  *float64 `json:"row_drop_prob,omitempty"`
+	DelayProb    *float64 `json:"delay_prob,omitempty"`
+	// Mode is "" for the normal incremental run, "snapshot" for a full,
+	// immutable copy or "sample" for a spread-out subset, see sampling.go
+	Mode string `json:"mode"`
+	// SampleEvery is how many inspections a "sample" run takes one of; default 20
+	SampleEvery int `json:"sample_every,omitempty"`
+	// MaxMinutes time-boxes each window of the run (0 = no limit); Continue
+	// resumes from the state the previous window left, see window.go
+	MaxMinutes int  `json:"max_minutes"`
+	Continue   bool `json:"continue"`
+	// UploadKBps caps the run's GCS uploads in KiB/s; defaults to
+	// GCS_UPLOAD_KBPS, 0 for no cap, see bandwidth.go
+	UploadKBps int `json:"upload_kbps,omitempty"`
+	// Pipe streams the chunks to the cleaner as they're written, see pipe.go
+	Pipe *PipeTarget `json:"pipe,omitempty"`
+	// Selftest marks the trigger's /selftest run, which keeps no checkpoint
+	Selftest bool `json:"selftest,omitempty"`
+}
+
+// RunExtractor extracts the rows req asks for into the raw bucket. It stops
+// with an error between chunks once runCtx is cancelled, and reports its
+// progress to the job runCtx belongs to, if any.
+func RunExtractor(runCtx context.Context, req ExtractRequest, publisher publish.EventPublisher, bqClient *bigquery.Client) error {
+	runID, date, maxOffset := req.RunID, req.Date, req.MaxOffset
+	injected, err := req.faults()
+	if err != nil {
+		return errcategory.Wrap(errcategory.Configuration, err)
+	}
+
+	snapshot := req.Mode == "snapshot"
+	if snapshot {
+		// A snapshot is a faithful full copy: no fault injection, no offset cap
+		injected = faults{}
+		maxOffset = 0
+		log.Println("📸 Snapshot mode: extracting the full dataset")
+	}
+	filter, err := req.sampleFilter()
+	if err != nil {
+		return errcategory.Wrap(errcategory.Configuration, err)
+	}
+	sampled := filter != ""
+	if sampled {
+		log.Printf("🎲 Sample mode: extracting the rows where %s", filter)
+	}
+	uploadKBps, err := req.uploadLimit()
+	if err != nil {
+		return errcategory.Wrap(errcategory.Configuration, err)
+	}
+	apiErrorProb, gcsErrorProb, rowDropProb, delayProb := injected.APIError, injected.GCSError, injected.RowDrop, injected.Delay
 
 	log.Println("➡️ RunExtractor started")
 	log.Printf("🔧 Config: api=%.3f gcs=%.3f drop=%.3f delay=%.3f",
 		apiErrorProb, gcsErrorProb, rowDropProb, delayProb)
+	jobs.Progress(runCtx, map[string]any{"faults": injected})
+	go monitoring.Gauge(context.Background(),
+		monitoring.Point{Name: "fault_probability", Labels: map[string]string{"fault": "api_error"}, Value: apiErrorProb},
+		monitoring.Point{Name: "fault_probability", Labels: map[string]string{"fault": "gcs_error"}, Value: gcsErrorProb},
+		monitoring.Point{Name: "fault_probability", Labels: map[string]string{"fault": "row_drop"}, Value: rowDropProb},
+		monitoring.Point{Name: "fault_probability", Labels: map[string]string{"fault": "delay"}, Value: delayProb},
+	)
 
 	startPayload := map[string]any{
 		"event":     "extractor_started",
+		"run_id":    runID,
 		"date":      date,
 		"timestamp": time.Now().Format(time.RFC3339),
 		"origin":    "extractor",
+		"faults":    injected,
+	}
+	notifyTrigger(publisher, startPayload)
+	if !req.Continue {
+		openlineage.Emit(context.Background(), openlineage.Start, lineageRun(req), nil)
 	}
-	startBody, _ := json.Marshal(startPayload)
-	_, _ = http.Post(triggerURL, "application/json", bytes.NewBuffer(startBody))
 
 	startTime := time.Now()
 
-	storageClient, err := NewGCSStorage()
+	storageClient, err := newStorage()
 	if err != nil {
 		log.Println("❌ Failed to create GCS client:", err)
 		return err
 	}
-	ctx := storageClient.Ctx
+	throttle := newUploadThrottle(uploadKBps)
+	if gcs, ok := storageClient.(*GCSStorage); ok {
+		gcs.Throttle = throttle
+		if uploadKBps > 0 {
+			log.Printf("🚰 Uploads capped at %d KiB/s", uploadKBps)
+		}
+	}
+	ctx := context.Background()
 
 	bucketName := os.Getenv("BUCKET_NAME")
 	if bucketName == "" {
 		log.Println("❌ BUCKET_NAME environment variable not set")
-		return fmt.Errorf("BUCKET_NAME not set")
+		return errcategory.Errorf(errcategory.Configuration, "BUCKET_NAME not set")
 	}
 
 	if err := storageClient.EnsureBucketExists(bucketName); err != nil {
@@ -160,24 +316,137 @@ func RunExtractor(date string, maxOffset int, triggerURL string, bqClient *bigqu
 	}
 	log.Printf("📅 Processing date: %s\n", date)
 
-	chunkSize := 1000
+	sizer := newChunkSizer()
+	migrateSchema(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", schemas.ChunkMetrics)
 	folder := fmt.Sprintf("raw-data/%s", date)
-	checkpointPath := "last_checkpoint.json"
+	saveObject := storageClient.SaveObject
+
+	// Snapshots always start at offset 0, never touch the shared checkpoint,
+	// and refuse to overwrite an existing snapshot for the same date.
+	var commits *chunkCommits
+	if snapshot {
+		folder = snapshotFolder(date)
+		saveObject = storageClient.SaveNewObject
+		exists, err := storageClient.ObjectExists(bucketName, folder+"/_manifest.json")
+		if err != nil {
+			log.Println("❌ Failed to check for existing snapshot:", err)
+			return err
+		}
+		if exists {
+			log.Printf("⛔ Snapshot for %s already exists — snapshots are immutable", date)
+			return errcategory.Errorf(errcategory.Configuration, "snapshot for %s already exists", date)
+		}
+	} else if req.Selftest {
+		// The checkpoint is one file for the whole bucket, so a self-test
+		// (one chunk of its own date, started outside the run queue) would
+		// replace a stopped real run's. One that stops is run again.
+		log.Println("🩺 Self-test: not reading or writing the checkpoint")
+	} else if sampled {
+		// A sample has a folder of its own, so the date's files and the
+		// checkpoint of a stopped run of it are left as they are. It keeps no
+		// checkpoint either: one that stops is run again.
+		folder = sampleFolder(date)
+		log.Printf("🎲 Sample: writing to %s, not reading or writing the checkpoint", folder)
+	} else {
+		commits = loadCommits(storageClient, bucketName, date)
+		commits.reconcile(ctx, bqClient)
+	}
 
-	offset, _ := storageClient.ReadCheckpoint(bucketName, checkpointPath)
-	initialOffset := offset
+	chunks := manifest.Manifest{Date: date, RunID: runID, Snapshot: snapshot, Sample: filter}
+	// Billable work, reported to the trigger for the run's cost estimate
+	var apiCalls, metricRows int
+	// Rows returned by the API, reconciled against the rows written to the manifest
+	// (rowsFetched), and pages written so far, checked for short chunk files
+	// before the manifest is written (written); both carry over from a run
+	// that stopped part way through the date.
+	offset, initialOffset, rowsFetched, written := commits.restore(&chunks)
+	// Rows in the dataset when the run started, 0 if the preflight count failed
+	var totalRows int
+
+	window := 1
+	if req.Continue {
+		state, err := readResume(storageClient, bucketName, folder)
+		if err != nil {
+			log.Println("❌ No resume state to continue from:", err)
+			return errcategory.Errorf(errcategory.Configuration, "continue run %s: read %s: %w", runID, resumePath(folder), err)
+		}
+		window = state.Window + 1
+		offset, initialOffset = state.NextOffset, state.InitialOffset
+		chunks, rowsFetched = state.Chunks, state.RowsFetched
+		totalRows, written = state.TotalRows, state.Written
+		sizer.restore(state.ChunkSize)
+		log.Printf("⏯️ Continuing run %s in window %d from offset %d (%d files so far)", runID, window, offset, len(chunks.Files))
+	}
+	if totalRows == 0 {
+		if n, err := countSourceRows(ctx, filter); err != nil {
+			log.Println("⚠️ Row count preflight failed — progress won't be reported:", err)
+		} else {
+			totalRows = n
+			log.Printf("🔢 Dataset has %d rows", totalRows)
+		}
+	}
+	planned := rowsPlanned(totalRows, initialOffset, maxOffset)
+	progress := newProgressReporter(publisher, runID, date, totalRows, planned)
+	progress.report(rowsFetched, offset, true)
 
-	var files []string
+	var deadline time.Time
+	if req.MaxMinutes > 0 {
+		deadline = startTime.Add(time.Duration(req.MaxMinutes) * time.Minute)
+	}
+	paused := false
+	var gcsBytes int64
+	ledger := newAttemptLedger(ctx, bqClient, runID, date, req.Mode)
+	injections := newFaultLog(ctx, bqClient, runID, jobs.FromContext(runCtx).ID(), date, req.Mode)
+	sampler := newRowSampler(ctx, bqClient, runID, date, req.Mode)
+
+	// Pages already written for this date are revalidated rather than
+	// downloaded again. Snapshots are written once, so they never have any,
+	// and a sample's pages aren't the full run's.
+	pages := make(pageCache)
+	if !snapshot && !sampled {
+		pages = loadPageCache(storageClient, bucketName, folder)
+	}
+	var skippedUnchanged int
+	rawIdx := loadRawIndex(storageClient, bucketName, folder, date)
+	// Snapshots and samples stay in their own folders, out of the source
+	// date partitions and the cleaner
+	var partitions *sourcePartitions
+	var pipe *cleanerPipe
+	if !snapshot && !sampled {
+		partitions = loadSourcePartitions(storageClient, bucketName, folder, date)
+		pipe = openCleanerPipe(req.Pipe, runID, date)
+	}
+	// Until finish hands over the manifest, the cleaner discards the stream
+	defer pipe.abort()
 
 	for {
-		url := fmt.Sprintf("https://data.cityofchicago.org/resource/qizy-d2wf.json?$limit=%d&$offset=%d", chunkSize, offset)
+		jobs.Progress(runCtx, map[string]any{"window": window, "offset": offset, "rows_fetched": rowsFetched, "files": len(chunks.Files)})
+		if err := runCtx.Err(); err != nil {
+			log.Printf("🛑 Extraction cancelled at offset %d", offset)
+			return fmt.Errorf("extraction cancelled at offset %d: %w", offset, err)
+		}
+		chunkSize := sizer.Size()
 		objectName := fmt.Sprintf("%s/offset_%d.json", folder, offset)
 		chunkStart := time.Now()
 		delayApplied := false
 		rowsDropped := 0
 
+		// A cached page is only worth revalidating if its chunk file is still
+		// there, and only with the limit it was fetched with.
+		cached, revalidate := pages[objectName]
+		if revalidate {
+			if exists, _ := storageClient.ObjectExists(bucketName, objectName); exists {
+				chunkSize = cached.Limit
+			} else {
+				revalidate = false
+			}
+		}
+
 		if rand.Float64() < apiErrorProb {
 			log.Printf("❌ simulated_fetch_error: skipping chunk at offset %d", offset)
+			ledger.record(offset, "fetch", 1, outcomeSkipped, "injected_fetch_error", nil, 0, time.Since(chunkStart))
+			injections.record(offset, faultAPIError, apiErrorProb, map[string]any{"chunk_size": chunkSize})
+			metricRows++
 			writeChunkMetrics(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", offset, map[string]interface{}{
 				"fetch_skipped":          true,
 				"gcs_write_skipped":      false,
@@ -185,53 +454,113 @@ func RunExtractor(date string, maxOffset int, triggerURL string, bqClient *bigqu
 				"rows_dropped":           0,
 				"chunk_duration_seconds": time.Since(chunkStart).Seconds(),
 				"delay_applied":          false,
+				"chunk_size":             chunkSize,
+				"skipped_unchanged":      false,
+				"run_id":                 runID,
 			})
+			ledger.flush()
+			injections.flush()
 			offset += chunkSize
 			continue
 		}
 
-		log.Println("🌐 Fetching:", url)
-
-		var raw []byte
-		delay := 2 * time.Second
-
-		for i := 0; i < 5; i++ {
-			resp, err := http.Get(url)
-			if err != nil {
-				log.Printf("⚠️ Fetch attempt %d failed: %v", i+1, err)
+		var page socrata.Page
+		var fetched fetchStats
+		fetchStart := time.Now()
+		fetchErr := fetchRetry.Do(ctx, func(ctx context.Context, attempt int) error {
+			var conditional pageValidators
+			if revalidate {
+				conditional = cached.Validators
 			} else {
-				defer resp.Body.Close()
-				if resp.StatusCode == http.StatusOK {
-					raw, err = io.ReadAll(resp.Body)
-					break
+				// A retry after a timeout may ask for a smaller page
+				chunkSize = sizer.Size()
+			}
+			query := socrata.Query{Where: filter, Limit: chunkSize, Offset: offset}
+			log.Println("🌐 Fetching:", source.URL(query))
+			apiCalls++
+			attemptStart := time.Now()
+			got, err := source.Get(ctx, query, conditional)
+			statusCode := got.Status
+			fetched.Attempts, fetched.Status = attempt, statusCode
+			fetched.FetchSeconds = time.Since(attemptStart).Seconds()
+			if err != nil {
+				log.Printf("⚠️ Fetch attempt %d failed: %v", attempt, err)
+				outcome := outcomeFailed
+				if attempt < fetchRetry.Attempts && retry.Transient(err) {
+					outcome = outcomeRetry
 				}
-				log.Printf("⚠️ Fetch attempt %d failed: status %d", i+1, resp.StatusCode)
+				class := classifyFetchError(err, statusCode)
+				ledger.record(offset, "fetch", attempt, outcome, class, err, statusCode, time.Since(attemptStart))
+				sizer.failed(class)
+				return err
 			}
-			time.Sleep(delay)
-			delay *= 2
+			ledger.record(offset, "fetch", attempt, outcomeSuccess, "", nil, statusCode, time.Since(attemptStart))
+			page = got
+			fetched.Bytes = len(got.Body)
+			return nil
+		})
+		fetched.RetrySeconds = time.Since(fetchStart).Seconds() - fetched.FetchSeconds
+		if fetchErr != nil {
+			// Ending here as if the data ran out would publish a partial extraction
+			return failChunk(ctx, bqClient, ledger, runID, offset, chunkSize, chunkStart, fetched, fetchErr, nil)
 		}
 
-		if len(raw) < 100 {
+		if page.NotModified() {
+			log.Printf("♻️ Page at offset %d unchanged — keeping %s", offset, objectName)
+			chunks.AddObject(cached.Object)
+			// Whatever it was short by when first written counts as dropped
+			written = append(written, pageWrite{Object: cached.Object.Name, Offset: offset, Limit: chunkSize, Fetched: cached.Object.Rows, Dropped: chunkSize - cached.Object.Rows})
+			rowsFetched += cached.Object.Rows
+			skippedUnchanged++
+			metricRows++
+			metric := chunkMetric(offset, fetched.addTo(map[string]interface{}{
+				"fetch_skipped":          false,
+				"gcs_write_skipped":      true,
+				"rows_extracted":         cached.Object.Rows,
+				"rows_dropped":           0,
+				"chunk_duration_seconds": time.Since(chunkStart).Seconds(),
+				"delay_applied":          false,
+				"chunk_size":             chunkSize,
+				"skipped_unchanged":      true,
+				"run_id":                 runID,
+			}))
+			commits.commit(chunkCommit{Object: cached.Object, Page: written[len(written)-1], Metrics: metric}, offset+chunkSize, initialOffset, rowsFetched, written, chunks)
+			putChunkMetric(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", metric)
+			ledger.flush()
+			injections.flush()
+			offset += chunkSize
+			progress.report(rowsFetched, offset, false)
+			continue
+		}
+
+		if len(page.Body) < 100 {
 			log.Println("✅ No more data to fetch.")
 			break
 		}
 
-		var records []map[string]interface{}
-		if err := json.Unmarshal(raw, &records); err != nil {
-			log.Println("❌ Failed to parse JSON array:", err)
-			break
+		records, err := page.Records()
+		if err != nil {
+			return failChunk(ctx, bqClient, ledger, runID, offset, chunkSize, chunkStart, fetched, err, page.Body)
 		}
+		sizer.observe(len(records), fetched.FetchSeconds, len(page.Body))
+		rowsFetched += len(records)
 
 		var retained []map[string]interface{}
-		log.Printf("🧪 rowDropProb just before row dropping is %.3f", rowDropProb)
+		var droppedIDs []interface{}
+		logging.Debugf("🧪 rowDropProb just before row dropping is %.3f", rowDropProb)
 
 		for _, r := range records {
 			if rand.Float64() > rowDropProb {
 				retained = append(retained, r)
+			} else {
+				droppedIDs = append(droppedIDs, r["inspection_id"])
 			}
 		}
 		rowsDropped = len(records) - len(retained)
-		log.Printf("🧪 Dropped %d out of %d rows", rowsDropped, len(records))
+		if rowsDropped > 0 {
+			injections.record(offset, faultRowDrop, rowDropProb, map[string]any{"rows_dropped": rowsDropped, "rows_fetched": len(records), "inspection_ids": droppedIDs})
+		}
+		logging.Debugf("🧪 Dropped %d out of %d rows", rowsDropped, len(records))
 		records = retained
 
 		var ndjsonBuf bytes.Buffer
@@ -239,52 +568,102 @@ func RunExtractor(date string, maxOffset int, triggerURL string, bqClient *bigqu
 		for _, record := range records {
 			if err := encoder.Encode(record); err != nil {
 				log.Println("❌ Failed to encode NDJSON:", err)
-				break
+				return fmt.Errorf("encode NDJSON at offset %d: %w", offset, err)
 			}
 		}
 
 		if rand.Float64() < gcsErrorProb {
 			log.Printf("❌ simulated_gcs_write_error: failed to save %s", objectName)
-			writeChunkMetrics(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", offset, map[string]interface{}{
+			ledger.record(offset, "gcs_write", 1, outcomeSkipped, "injected_gcs_error", nil, 0, 0)
+			injections.record(offset, faultGCSError, gcsErrorProb, map[string]any{"object": objectName, "rows": len(records)})
+			metricRows++
+			writeChunkMetrics(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", offset, fetched.addTo(map[string]interface{}{
 				"fetch_skipped":          false,
 				"gcs_write_skipped":      true,
 				"rows_extracted":         len(records),
 				"rows_dropped":           rowsDropped,
 				"chunk_duration_seconds": time.Since(chunkStart).Seconds(),
 				"delay_applied":          false,
-			})
+				"chunk_size":             chunkSize,
+				"skipped_unchanged":      false,
+				"run_id":                 runID,
+			}))
+			ledger.flush()
+			injections.flush()
 			offset += chunkSize
 			continue
 		}
 
-		log.Printf("🧪 delayProb just before possible delays is %.3f", delayProb)
+		logging.Debugf("🧪 delayProb just before possible delays is %.3f", delayProb)
 		if rand.Float64() < delayProb {
 			log.Printf("🐢 simulated_processing_delay: sleeping 2 seconds")
 			time.Sleep(2 * time.Second)
 			delayApplied = true
+			injections.record(offset, faultDelay, delayProb, map[string]any{"delay_seconds": 2})
 		}
 
-		err = storageClient.SaveObject(bucketName, objectName, ndjsonBuf.Bytes())
-		if err != nil {
-			log.Println("❌ Failed to save to GCS:", err)
-			break
-		}
-
-		files = append(files, filepath.Base(objectName))
-
-		writeChunkMetrics(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", offset, map[string]interface{}{
+		// The chunk is recorded as pending before its file is saved, so a run
+		// that stops before the checkpoint moves past it can keep the file
+		// rather than fetch it again.
+		object, pageWritten := chunkFile(objectName, ndjsonBuf.Bytes(), offset, chunkSize, len(records)+rowsDropped, rowsDropped)
+		chunkMetrics := fetched.addTo(map[string]interface{}{
 			"fetch_skipped":          false,
 			"gcs_write_skipped":      false,
 			"rows_extracted":         len(records),
 			"rows_dropped":           rowsDropped,
 			"chunk_duration_seconds": time.Since(chunkStart).Seconds(),
 			"delay_applied":          delayApplied,
+			"chunk_size":             chunkSize,
+			"skipped_unchanged":      false,
+			"run_id":                 runID,
 		})
+		commits.begin(chunkCommit{Path: objectName, Object: object, Page: pageWritten, Metrics: chunkMetric(offset, chunkMetrics)})
+
+		pipe.send(object.Name, ndjsonBuf.Bytes())
+		writeStart := time.Now()
+		err = saveObject(bucketName, objectName, ndjsonBuf.Bytes())
+		if err != nil {
+			log.Println("❌ Failed to save to GCS:", err)
+			ledger.record(offset, "gcs_write", 1, outcomeFailed, "gcs_error", err, 0, time.Since(writeStart))
+			ledger.flush()
+			// Like a failed fetch: completing without the chunk would publish a
+			// partial extraction, and a partial snapshot could never be replaced
+			return fmt.Errorf("save %s: %w", objectName, err)
+		}
+		ledger.record(offset, "gcs_write", 1, outcomeSuccess, "", nil, 0, time.Since(writeStart))
+		gcsBytes += int64(ndjsonBuf.Len())
+
+		chunks.AddObject(object)
+		rawIdx.add(object, records)
+		if err := partitions.add(object, records); err != nil {
+			// Retried when the run completes
+			log.Printf("⚠️ Failed to partition %s: %v", objectName, err)
+		}
+		sampler.sample(offset, object.Name, records)
+		written = append(written, pageWritten)
+		if !snapshot && !sampled {
+			if page.Validators.Empty() {
+				delete(pages, objectName)
+			} else {
+				pages[objectName] = cachedPage{Limit: chunkSize, Validators: page.Validators, Object: object}
+			}
+		}
+
+		// The checkpoint moves past the chunk with its metrics row fixed, and
+		// only then is the row inserted; a run that stops in between inserts
+		// it on startup if chunk_metrics doesn't have it.
+		metricRows++
+		chunkMetrics["chunk_duration_seconds"] = time.Since(chunkStart).Seconds()
+		metric := chunkMetric(offset, chunkMetrics)
+		commits.commit(chunkCommit{Path: objectName, Object: object, Page: pageWritten, Metrics: metric}, offset+chunkSize, initialOffset, rowsFetched, written, chunks)
+		putChunkMetric(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", metric)
+		ledger.flush()
+		injections.flush()
 
 		offset += chunkSize
-		storageClient.WriteCheckpoint(bucketName, checkpointPath, offset)
+		progress.report(rowsFetched, offset, false)
 
-		if shutdownRequested {
+		if stopRequested(runCtx) {
 			log.Println("🛑 Shutdown flag set — exiting after current chunk.")
 			break
 		}
@@ -292,74 +671,237 @@ func RunExtractor(date string, maxOffset int, triggerURL string, bqClient *bigqu
 			log.Println("⏹️ Reached maxOffset — stopping early.")
 			break
 		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Printf("⏸️ Window %d of %d minutes is over — pausing at offset %d", window, req.MaxMinutes, offset)
+			paused = true
+			break
+		}
 	}
 
-	manifest := map[string]interface{}{
-		"date":            date,
-		"files":           files,
-		"upload_complete": true,
-	}
-	manifestData, _ := json.MarshalIndent(manifest, "", "  ")
-	manifestName := fmt.Sprintf("raw-data/%s/_manifest.json", date)
-	_ = storageClient.SaveObject(bucketName, manifestName, manifestData)
-	log.Println("📦 Manifest written to:", manifestName)
+	ledger.flush()
+	injections.flush()
 
-	duration := time.Since(startTime).Seconds()
+	if paused {
+		if !snapshot {
+			pages.save(storageClient, bucketName, folder)
+		}
+		partitions.save(folder)
+		state := resumeState{
+			RunID:         runID,
+			Window:        window,
+			NextOffset:    offset,
+			InitialOffset: initialOffset,
+			ChunkSize:     sizer.Size(),
+			RowsFetched:   rowsFetched,
+			TotalRows:     totalRows,
+			Written:       written,
+			Chunks:        chunks,
+		}
+		if err := saveResume(storageClient, bucketName, folder, state); err != nil {
+			log.Println("❌ Failed to save resume state:", err)
+			return err
+		}
+		deliverEvent(ctx, publisher, map[string]any{
+			"event":             "extractor_paused",
+			"run_id":            runID,
+			"date":              date,
+			"mode":              req.Mode,
+			"origin":            "extractor",
+			"status":            "paused",
+			"window":            window,
+			"next_offset":       offset,
+			"files_so_far":      len(chunks.Files),
+			"duration":          eventschema.Seconds(time.Since(startTime).Seconds()),
+			"api_calls":         apiCalls,
+			"gcs_bytes_written": gcsBytes,
+			"bq_bytes_streamed": (metricRows + ledger.Written + sampler.Written + injections.Written) * 1024,
+		})
+		log.Println("⏸️ RunExtractor paused")
+		return nil
+	}
 
-	completionPayload := map[string]any{
-		"event":      "extractor_completed",
-		"date":       date,
-		"max_offset": maxOffset,
-		"origin":     "extractor",
-		"duration":   fmt.Sprintf("%.3f", duration),
+	recovery := recoverShortChunks(ctx, storageClient, bucketName, folder, &chunks, written, pages)
+	apiCalls += recovery.APICalls
+	gcsBytes += recovery.Bytes
+	rowsFetched += recovery.ExtraRows
+	if !snapshot {
+		pages.save(storageClient, bucketName, folder)
 	}
-	completionBody, _ := json.Marshal(completionPayload)
-	resp, err := http.Post(triggerURL, "application/json", bytes.NewBuffer(completionBody))
+
+	rawIdx.complete(storageClient, bucketName, folder, chunks)
+	rawIdx.save(saveObject, bucketName, folder)
+	partitions.complete(folder, chunks)
+	partitions.save(folder)
+
+	chunks.Finish()
+	manifestData, err := manifest.Marshal(chunks)
 	if err != nil {
-		log.Printf("❌ Failed to notify trigger: %v", err)
-	} else {
-		log.Printf("📤 Trigger notified: %s", resp.Status)
-		resp.Body.Close()
+		log.Println("❌ Not writing an invalid manifest:", err)
+		return err
+	}
+	manifestName := fmt.Sprintf("%s/_manifest.json", folder)
+	if err := saveObject(bucketName, manifestName, manifestData); err != nil {
+		log.Println("❌ Failed to write the manifest:", err)
+		return fmt.Errorf("save %s: %w", manifestName, err)
 	}
+	gcsBytes += int64(len(manifestData))
+	log.Println("📦 Manifest written to:", manifestName)
+	commits.finish()
+	if req.Continue {
+		clearResume(storageClient, bucketName, folder)
+	}
+
+	if snapshot && bqClient != nil {
+		if err := createSnapshotTable(ctx, bqClient, storageClient, bucketName, date); err != nil {
+			log.Println("❌ Failed to create BigQuery snapshot table:", err)
+			return err
+		}
+	}
+
+	piped := pipe.finish(chunks)
+	duration := time.Since(startTime).Seconds()
+	uploadRate := throttle.bytesPerSecond()
+	if uploadRate > 0 {
+		go monitoring.Gauge(context.Background(), monitoring.Point{Name: "gcs_upload_bytes_per_second", Value: uploadRate})
+	}
+
+	deliverEvent(ctx, publisher, map[string]any{
+		"event":             "extractor_completed",
+		"run_id":            runID,
+		"date":              date,
+		"bucket":            bucketName,
+		"folder":            folder,
+		"max_offset":        maxOffset,
+		"mode":              req.Mode,
+		"origin":            "extractor",
+		"duration":          eventschema.Seconds(duration),
+		"api_calls":         apiCalls,
+		"gcs_bytes_written": gcsBytes,
+		"rows_expected":     rowsFetched,
+		"rows_received":     chunks.Totals.Rows,
+		"total_rows":        totalRows,
+		"rows_planned":      planned,
+		// Streaming inserts are billed at a minimum of 1 KB per row
+		"bq_bytes_streamed": (metricRows + ledger.Written + sampler.Written + injections.Written) * 1024,
+		"windows":           window,
+		"skipped_unchanged": skippedUnchanged,
+		"short_chunks":      recovery.Short,
+		"chunks_refetched":  recovery.Refetched,
+		"faults":            injected,
+		"faults_injected":   injections.Counts,
+		"sample":            filter,
+		"upload_kbps":       uploadKBps,
+		// Measured over the time spent uploading; 0 for local storage
+		"upload_bytes_per_second": int64(uploadRate),
+		// The cleaner already cleaned the chunks streamed to it, see pipe.go
+		"piped": piped,
+	})
+	openlineage.Emit(ctx, openlineage.Complete, lineageRun(req), nil)
 
 	log.Printf("✅ rows_extracted: %d", offset-initialOffset)
-	log.Printf("📁 files_written_total: %d", len(files))
+	log.Printf("📁 files_written_total: %d", len(chunks.Files))
+	log.Printf("♻️ pages_skipped_unchanged: %d", skippedUnchanged)
+	log.Printf("🔬 raw_rows_sampled: %d", sampler.Written)
 	log.Printf("⏱️ extraction_duration_seconds: %.3f", duration)
+	if uploadRate > 0 {
+		log.Printf("🚰 gcs_upload_bytes_per_second: %.0f", uploadRate)
+	}
 	log.Println("✅ RunExtractor completed")
 	return nil
 }
 
-func handleExtract(w http.ResponseWriter, r *http.Request, triggerURL string, bqClient *bigquery.Client) {
+// notifyFailure reports a run the extractor gave up on, so the trigger fails
+// it straight away rather than waiting out the stage SLA.
+func notifyFailure(publisher publish.EventPublisher, req ExtractRequest, err error) {
+	payload := map[string]any{
+		"event":          "extractor_failed",
+		"run_id":         req.RunID,
+		"date":           req.Date,
+		"origin":         "extractor",
+		"status":         "failed",
+		"error":          err.Error(),
+		"error_category": errcategory.Of(err),
+	}
+	deliverEvent(context.Background(), publisher, payload)
+	openlineage.Emit(context.Background(), openlineage.Fail, lineageRun(req), err)
+}
+
+// lineageRun describes an extraction for OpenLineage: the Socrata dataset in,
+// the raw, snapshot or sample folders out.
+func lineageRun(req ExtractRequest) openlineage.Run {
+	prefix := "raw-data"
+	switch req.Mode {
+	case "snapshot":
+		prefix = "snapshots"
+	case "sample":
+		prefix = "samples"
+	}
+	return openlineage.Run{
+		Job:     "extractor",
+		RunID:   req.RunID,
+		Date:    req.Date,
+		Inputs:  []openlineage.Dataset{openlineage.HTTP(source.Dataset)},
+		Outputs: []openlineage.Dataset{openlineage.GCS(os.Getenv("BUCKET_NAME"), prefix)},
+	}
+}
+
+func handleExtract(w http.ResponseWriter, r *http.Request, publisher publish.EventPublisher, bqClient *bigquery.Client) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
 		return
 	}
 
-	var input struct {
-		Date         string  `json:"date"`
-		MaxOffset    int     `json:"max_offset"`
-		APIErrorProb float64 `json:"api_error_prob"`
-		GCSErrorProb float64 `json:"gcs_error_prob"`
-		RowDropProb  float64 `json:"row_drop_prob"`
-		DelayProb    float64 `json:"delay_prob"`
-	}
+	var input ExtractRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
 		return
 	}
 
-	// ✅ Log the incoming probabilities here (outside the goroutine)
-	log.Printf("🧪 Incoming: api=%.3f gcs=%.3f drop=%.3f delay=%.3f",
-		input.APIErrorProb, input.GCSErrorProb, input.RowDropProb, input.DelayProb)
+	// Bad overrides are the caller's mistake, so they're refused here rather than failing the run
+	injected, err := input.faults()
+	if err == nil {
+		_, err = input.sampleFilter()
+	}
+	if err == nil {
+		_, err = input.uploadLimit()
+	}
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, err.Error())
+		return
+	}
+	logging.Debugf("🧪 Effective: api=%.3f gcs=%.3f drop=%.3f delay=%.3f",
+		injected.APIError, injected.GCSError, injected.RowDrop, injected.Delay)
+
+	if jobMode() {
+		// The execution runs with the values resolved here, whatever its own FAULT_* say
+		input.APIErrorProb, input.GCSErrorProb, input.RowDropProb, input.DelayProb = &injected.APIError, &injected.GCSError, &injected.RowDrop, &injected.Delay
+		execution, err := startJob(r.Context(), input)
+		if err != nil {
+			log.Println("❌ Failed to start extraction job:", err)
+			problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Failed to start extraction job: "+err.Error())
+			return
+		}
+		log.Printf("🏗️ Extraction for run %s handed to job execution %s", input.RunID, execution)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message":   "Extractor job started",
+			"run_id":    input.RunID,
+			"execution": execution,
+		})
+		return
+	}
 
 	go func() {
-		log.Printf("Forwarding: api=%.3f gcs=%.3f drop=%.3f delay=%.3f",
-			input.APIErrorProb, input.GCSErrorProb, input.RowDropProb, input.DelayProb)
-		err := RunExtractor(input.Date, input.MaxOffset, triggerURL, bqClient,
-			input.APIErrorProb, input.GCSErrorProb, input.RowDropProb, input.DelayProb)
+		ctx, job := jobRegistry.Start(context.Background(), "extract", input.RunID, input.Date)
+		ctx, done := withStopFlag(ctx, input.RunID)
+		defer done()
+		// A panic fails the job and is reported like any other failure
+		err := jobs.Safely(func() error { return RunExtractor(ctx, input, publisher, bqClient) })
+		job.Finish(err)
 		if err != nil {
 			log.Println("❌ Extractor failed via HTTP:", err)
+			notifyFailure(publisher, input, err)
 		}
 	}()
 
@@ -371,23 +913,54 @@ func main() {
 	log.Println("📍 Extractor starting main()")
 
 	_ = godotenv.Load()
+	faultDefaults = faultsFromEnv()
 
-	// Setup context with timeout for BQ client creation
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	// Offline (LOCAL_DATA_DIR set) there is no BigQuery or trigger to talk to
+	local := os.Getenv("LOCAL_DATA_DIR") != ""
 
-	bqClient, err := bigquery.NewClient(ctx, "hygiene-prediction-434")
-	if err != nil {
-		log.Fatalf("❌ Failed to create BigQuery client: %v", err)
+	var bqClient *bigquery.Client
+	if !local {
+		// Setup context with timeout for BQ client creation
+		ctx, cancel := context.WithTimeout(context.Background(), bqClientTimeout)
+		defer cancel()
+
+		var err error
+		bqClient, err = bigquery.NewClient(ctx, "hygiene-prediction-434")
+		if err != nil {
+			log.Fatalf("❌ Failed to create BigQuery client: %v", err)
+		}
+
+		publisher, err = publish.FromEnv()
+		if err != nil {
+			log.Fatalf("❌ Invalid event publisher config: %v", err)
+		}
+		log.Printf("🔗 Events go to %s", publisher)
+	}
+
+	logging.Setup()
+	if err := tlsconfig.Setup(); err != nil {
+		log.Fatalf("❌ Invalid TLS client config: %v", err)
+	}
+	if err := configureSource(); err != nil {
+		log.Fatalf("❌ Invalid Socrata settings: %v", err)
+	}
+	log.Printf("🪪 Socrata User-Agent: %s", source.Header.Get("User-Agent"))
+
+	if local {
+		runLocal()
+		return
 	}
 
-	triggerURL = os.Getenv("TRIGGER_URL")
-	if triggerURL == "" {
-		log.Fatal("❌ TRIGGER_URL environment variable not set")
+	// As a Cloud Run Job execution, extract once and exit instead of serving
+	if runAsJob(bqClient) {
+		return
 	}
-	log.Printf("🔗 Trigger service URL: %s\n", triggerURL)
 
-	log.SetOutput(os.Stdout)
+	// Redeliver events a previous instance stored but couldn't post
+	go jobs.Safely(func() error {
+		sweepOutbox(context.Background(), publisher)
+		return nil
+	})
 
 	// Optional local dev logging to file
 	// logFile, err := os.OpenFile("src/logs/extractor.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
@@ -399,21 +972,35 @@ func main() {
 	//     log.Println("⚠️ Could not open log file — using stdout only:", err)
 	// }
 
-	http.HandleFunc("/extract", func(w http.ResponseWriter, r *http.Request) {
-		handleExtract(w, r, triggerURL, bqClient)
+	auditLog := audit.NewLogger("extractor", audit.SinkFromEnv())
+
+	http.HandleFunc("/extract", auditLog.Wrap("extract", func(w http.ResponseWriter, r *http.Request) {
+		handleExtract(w, r, publisher, bqClient)
+	}))
+
+	http.HandleFunc("/extract/status", handleExtractStatus)
+	jobRegistry.Register(http.DefaultServeMux)
+	http.HandleFunc("GET /jobs/{id}/faults", func(w http.ResponseWriter, r *http.Request) {
+		handleJobFaults(w, r, bqClient)
 	})
 
-	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("🛑 Shutdown requested — will exit after current fetch.")
-		shutdownRequested = true
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Shutdown initiated."))
+	http.HandleFunc("GET /raw/{id}", handleRawRecord)
+	http.HandleFunc("GET /data/{date}", handleListChunks)
+	http.HandleFunc("GET /data/{date}/{offset}", handleReadChunk)
+
+	http.HandleFunc("/snapshots/delta", func(w http.ResponseWriter, r *http.Request) {
+		handleDelta(w, r, bqClient)
 	})
 
+	http.HandleFunc("/shutdown", auditLog.Wrap("shutdown", handleShutdown))
+
+	http.HandleFunc("/audit", auditLog.Handler())
+	http.HandleFunc("/admin/loglevel", auditLog.Wrap("loglevel", logging.AdminHandler()))
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok"}`))
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(tlsconfig.ListenAndServe(tlsconfig.ListenAddr(), nil))
 }
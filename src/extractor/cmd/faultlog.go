@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"configure/problem"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Injected fault types, as named in the fault_log table.
+const (
+	faultAPIError = "api_error"
+	faultGCSError = "gcs_error"
+	faultRowDrop  = "row_drop"
+	faultDelay    = "delay"
+)
+
+// InjectedFault is one row of the fault_log table: a failure the extractor
+// injected, the ground truth to hold the anomalies monitoring detects against.
+type InjectedFault struct {
+	RunID       string  `bigquery:"run_id" json:"run_id"`
+	JobID       string  `bigquery:"job_id" json:"job_id,omitempty"`
+	Date        string  `bigquery:"date" json:"date"`
+	Mode        string  `bigquery:"mode" json:"mode,omitempty"`
+	Offset      int     `bigquery:"offset" json:"offset"`
+	Fault       string  `bigquery:"fault" json:"fault"`
+	Probability float64 `bigquery:"probability" json:"probability"`
+	// What the fault did as JSON, e.g. the inspection IDs of the dropped rows
+	Parameters string          `bigquery:"parameters" json:"-"`
+	Params     json.RawMessage `bigquery:"-" json:"parameters,omitempty"`
+	Timestamp  time.Time       `bigquery:"timestamp" json:"timestamp"`
+}
+
+// faultLog buffers a run's injected faults and streams them to BigQuery once
+// per chunk, counting them by type for the completion event. A log whose
+// table cannot be prepared only counts.
+type faultLog struct {
+	ctx     context.Context
+	table   *bigquery.Table
+	runID   string
+	jobID   string
+	date    string
+	mode    string
+	pending []InjectedFault
+	// Counts is the number of faults injected so far by type
+	Counts map[string]int
+	// Written counts streamed rows, reported as billable usage
+	Written int
+}
+
+// faultLogTable is PipelineMonitoring.fault_log, or FAULT_LOG_TABLE.
+func faultLogTable(bqClient *bigquery.Client) *bigquery.Table {
+	tableID := os.Getenv("FAULT_LOG_TABLE")
+	if tableID == "" {
+		tableID = "fault_log"
+	}
+	return bqClient.Dataset("PipelineMonitoring").Table(tableID)
+}
+
+// newFaultLog opens the fault_log table, creating it partitioned by day on
+// first use. jobID is the job the run reports to, if any.
+func newFaultLog(ctx context.Context, bqClient *bigquery.Client, runID, jobID, date, mode string) *faultLog {
+	l := &faultLog{ctx: ctx, runID: runID, jobID: jobID, date: date, mode: mode, Counts: make(map[string]int)}
+	if bqClient == nil {
+		return l
+	}
+	table := faultLogTable(bqClient)
+	if _, err := table.Metadata(ctx); err != nil {
+		schema, err := bigquery.InferSchema(InjectedFault{})
+		if err == nil {
+			err = table.Create(ctx, &bigquery.TableMetadata{
+				Schema:           schema,
+				TimePartitioning: &bigquery.TimePartitioning{Field: "timestamp"},
+			})
+		}
+		if err != nil {
+			log.Printf("⚠️ fault_log disabled: %v", err)
+			return l
+		}
+		log.Printf("🆕 Created BigQuery table PipelineMonitoring.%s", table.TableID)
+	}
+	l.table = table
+	return l
+}
+
+// record adds a fault injected into the chunk at offset with the given probability.
+func (l *faultLog) record(offset int, fault string, probability float64, params map[string]any) {
+	data, _ := json.Marshal(params)
+	l.pending = append(l.pending, InjectedFault{
+		RunID:       l.runID,
+		JobID:       l.jobID,
+		Date:        l.date,
+		Mode:        l.mode,
+		Offset:      offset,
+		Fault:       fault,
+		Probability: probability,
+		Parameters:  string(data),
+		Timestamp:   time.Now(),
+	})
+	l.Counts[fault]++
+}
+
+// flush streams the pending rows.
+func (l *faultLog) flush() {
+	if len(l.pending) == 0 {
+		return
+	}
+	rows := l.pending
+	l.pending = nil
+	if l.table == nil {
+		return
+	}
+	savers := make([]*bigquery.StructSaver, len(rows))
+	for i := range rows {
+		f := rows[i]
+		savers[i] = &bigquery.StructSaver{Struct: f, InsertID: fmt.Sprintf("%s-%d-%s-%d", f.RunID, f.Offset, f.Fault, f.Timestamp.UnixNano())}
+	}
+	inserter := l.table.Inserter()
+	err := bqRetry.Do(l.ctx, func(ctx context.Context, attempt int) error {
+		return withBQTimeout(ctx, "fault log insert", bqInsertTimeout, func(ctx context.Context) error {
+			return inserter.Put(ctx, savers)
+		})
+	})
+	if err != nil {
+		log.Printf("❌ Failed to insert injected faults into BigQuery: %v", err)
+		return
+	}
+	l.Written += len(rows)
+}
+
+// FaultReport is the answer to GET /jobs/{id}/faults.
+type FaultReport struct {
+	JobID  string          `json:"job_id"`
+	RunID  string          `json:"run_id,omitempty"`
+	Counts map[string]int  `json:"counts"`
+	Faults []InjectedFault `json:"faults"`
+}
+
+// handleJobFaults lists the faults an extraction job injected, in the order
+// it injected them: GET /jobs/{id}/faults. They're read back from fault_log,
+// so they outlive the job's entry in /jobs.
+func handleJobFaults(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client) {
+	id := r.PathValue("id")
+	if bqClient == nil {
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.NotConfigured, "No BigQuery client: the fault log isn't available")
+		return
+	}
+	job, known := jobRegistry.Get(id)
+
+	sql := fmt.Sprintf("SELECT * FROM `%s.%s` WHERE job_id = @job_id", "PipelineMonitoring", faultLogTable(bqClient).TableID)
+	params := []bigquery.QueryParameter{{Name: "job_id", Value: id}}
+	if known {
+		// Only the partitions since the job started
+		sql += " AND timestamp >= @since"
+		params = append(params, bigquery.QueryParameter{Name: "since", Value: job.StartedAt})
+	}
+	q := bqClient.Query(sql + " ORDER BY timestamp, `offset`")
+	q.Parameters = params
+
+	report := FaultReport{JobID: id, RunID: job.RunID, Counts: make(map[string]int), Faults: []InjectedFault{}}
+	err := withBQTimeout(r.Context(), "fault log query", bqInsertTimeout, func(ctx context.Context) error {
+		it, err := q.Read(ctx)
+		if err != nil {
+			return err
+		}
+		for {
+			var f InjectedFault
+			if err := it.Next(&f); err == iterator.Done {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			f.Params = json.RawMessage(f.Parameters)
+			report.Faults = append(report.Faults, f)
+		}
+	})
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Failed to read the fault log: "+err.Error())
+		return
+	}
+	if !known && len(report.Faults) == 0 {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No job "+id)
+		return
+	}
+	for _, f := range report.Faults {
+		report.Counts[f.Fault]++
+		report.RunID = f.RunID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
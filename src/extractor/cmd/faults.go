@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// faults are the probabilities of the failures the extractor injects for
+// demos and resilience tests: a failed data API fetch and a failed GCS write
+// per chunk, a dropped row per row, and an added delay per chunk.
+type faults struct {
+	APIError float64 `json:"api_error_prob"`
+	GCSError float64 `json:"gcs_error_prob"`
+	RowDrop  float64 `json:"row_drop_prob"`
+	Delay    float64 `json:"delay_prob"`
+}
+
+// faultDefaults apply to runs whose request leaves a probability unset, so
+// scheduled runs can inject faults too. main reads them with faultsFromEnv.
+var faultDefaults faults
+
+// faultsFromEnv reads FAULT_API_ERROR_PROB, FAULT_GCS_ERROR_PROB,
+// FAULT_ROW_DROP_PROB and FAULT_DELAY_PROB. Unset ones are 0; an invalid one
+// is logged and left at 0.
+func faultsFromEnv() faults {
+	read := func(name string) float64 {
+		v := os.Getenv(name)
+		if v == "" {
+			return 0
+		}
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 || p > 1 {
+			log.Printf("⚠️ Invalid %s %q (want a probability from 0 to 1), using 0", name, v)
+			return 0
+		}
+		return p
+	}
+	return faults{
+		APIError: read("FAULT_API_ERROR_PROB"),
+		GCSError: read("FAULT_GCS_ERROR_PROB"),
+		RowDrop:  read("FAULT_ROW_DROP_PROB"),
+		Delay:    read("FAULT_DELAY_PROB"),
+	}
+}
+
+// faults returns the probabilities the run uses: those the request sets,
+// and faultDefaults for the rest.
+func (req ExtractRequest) faults() (faults, error) {
+	f := faultDefaults
+	for _, o := range []struct {
+		name string
+		set  *float64
+		into *float64
+	}{
+		{"api_error_prob", req.APIErrorProb, &f.APIError},
+		{"gcs_error_prob", req.GCSErrorProb, &f.GCSError},
+		{"row_drop_prob", req.RowDropProb, &f.RowDrop},
+		{"delay_prob", req.DelayProb, &f.Delay},
+	} {
+		if o.set == nil {
+			continue
+		}
+		if *o.set < 0 || *o.set > 1 {
+			return f, fmt.Errorf("%s %v is not a probability from 0 to 1", o.name, *o.set)
+		}
+		*o.into = *o.set
+	}
+	return f, nil
+}
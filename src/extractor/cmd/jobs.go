@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"configure/gcp"
+	"configure/jobs"
+	"configure/problem"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Job mode (EXTRACT_MODE=job) hands each extraction to an execution of the
+// Cloud Run Job named by EXTRACT_JOB (projects/{p}/locations/{l}/jobs/{j}),
+// which runs this same image with the request in EXTRACT_REQUEST. The service
+// only starts and tracks executions, so Cloud Run scaling it to zero after the
+// response can't cut an extraction short.
+const (
+	cloudRunAPI   = "https://run.googleapis.com/v2"
+	jobRequestEnv = "EXTRACT_REQUEST"
+)
+
+var jobClient = &http.Client{Timeout: 30 * time.Second}
+
+// Extractions this instance runs itself (outside job mode), served on /jobs
+var jobRegistry = jobs.FromEnv()
+
+// Executions started by this instance, keyed by run ID. Each is also recorded
+// in BUCKET_NAME under extract-jobs/, so any instance can report on it.
+var (
+	executionsMu sync.Mutex
+	executions   = make(map[string]string)
+)
+
+// jobMode reports whether /extract should start a Cloud Run Job execution.
+func jobMode() bool {
+	return strings.EqualFold(os.Getenv("EXTRACT_MODE"), "job")
+}
+
+// JobStatus is the tracked state of one job execution.
+type JobStatus struct {
+	RunID      string `json:"run_id"`
+	Execution  string `json:"execution"`
+	State      string `json:"state"` // running | succeeded | failed | cancelled
+	Running    int    `json:"running_count"`
+	Succeeded  int    `json:"succeeded_count"`
+	Failed     int    `json:"failed_count"`
+	Cancelled  int    `json:"cancelled_count"`
+	StartTime  string `json:"start_time,omitempty"`
+	FinishTime string `json:"completion_time,omitempty"`
+	LogURI     string `json:"log_uri,omitempty"`
+}
+
+// startJob runs the extraction job with req as its input and returns the
+// execution's resource name.
+func startJob(ctx context.Context, req ExtractRequest) (string, error) {
+	job := os.Getenv("EXTRACT_JOB")
+	if job == "" {
+		return "", fmt.Errorf("EXTRACT_JOB not set")
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"overrides": map[string]interface{}{
+			"containerOverrides": []map[string]interface{}{{
+				"env": []map[string]string{{"name": jobRequestEnv, "value": string(input)}},
+			}},
+			"taskCount": 1,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var op struct {
+		Name     string `json:"name"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := callRunAPI(ctx, http.MethodPost, job+":run", body, &op); err != nil {
+		return "", fmt.Errorf("run job %s: %w", job, err)
+	}
+	if op.Metadata.Name == "" {
+		return "", fmt.Errorf("run job %s: operation %s did not name its execution", job, op.Name)
+	}
+
+	executionsMu.Lock()
+	executions[req.RunID] = op.Metadata.Name
+	executionsMu.Unlock()
+	record, _ := json.Marshal(map[string]string{"run_id": req.RunID, "execution": op.Metadata.Name})
+	if err := gcp.UploadObject(ctx, os.Getenv("BUCKET_NAME"), jobRecordPath(req.RunID), record, "application/json", false); err != nil {
+		log.Printf("⚠️ Failed to record job execution for run %s: %v", req.RunID, err)
+	}
+	return op.Metadata.Name, nil
+}
+
+func jobRecordPath(runID string) string {
+	return "extract-jobs/" + runID + ".json"
+}
+
+// executionFor finds the execution started for runID, here or by another instance.
+func executionFor(ctx context.Context, runID string) (string, bool) {
+	executionsMu.Lock()
+	name, ok := executions[runID]
+	executionsMu.Unlock()
+	if ok {
+		return name, true
+	}
+	data, err := gcp.ReadObject(ctx, os.Getenv("BUCKET_NAME"), jobRecordPath(runID))
+	if err != nil {
+		return "", false
+	}
+	var record struct {
+		Execution string `json:"execution"`
+	}
+	if json.Unmarshal(data, &record) != nil || record.Execution == "" {
+		return "", false
+	}
+	return record.Execution, true
+}
+
+// jobStatus fetches the state of the execution started for runID.
+func jobStatus(ctx context.Context, runID string) (JobStatus, bool, error) {
+	name, ok := executionFor(ctx, runID)
+	if !ok {
+		return JobStatus{}, false, nil
+	}
+
+	var ex struct {
+		RunningCount   int    `json:"runningCount"`
+		SucceededCount int    `json:"succeededCount"`
+		FailedCount    int    `json:"failedCount"`
+		CancelledCount int    `json:"cancelledCount"`
+		StartTime      string `json:"startTime"`
+		CompletionTime string `json:"completionTime"`
+		LogURI         string `json:"logUri"`
+	}
+	if err := callRunAPI(ctx, http.MethodGet, name, nil, &ex); err != nil {
+		return JobStatus{}, true, err
+	}
+
+	s := JobStatus{
+		RunID:      runID,
+		Execution:  name,
+		State:      "running",
+		Running:    ex.RunningCount,
+		Succeeded:  ex.SucceededCount,
+		Failed:     ex.FailedCount,
+		Cancelled:  ex.CancelledCount,
+		StartTime:  ex.StartTime,
+		FinishTime: ex.CompletionTime,
+		LogURI:     ex.LogURI,
+	}
+	if ex.CompletionTime != "" {
+		switch {
+		case ex.CancelledCount > 0:
+			s.State = "cancelled"
+		case ex.FailedCount > 0:
+			s.State = "failed"
+		default:
+			s.State = "succeeded"
+		}
+	}
+	return s, true, nil
+}
+
+// cancelJobs cancels the execution this instance started for runID, or every
+// one when runID is empty, if still running; a job can't see the service's
+// stop flags.
+func cancelJobs(ctx context.Context, runID string) {
+	executionsMu.Lock()
+	runIDs := make([]string, 0, len(executions))
+	for id := range executions {
+		if runID == "" || id == runID {
+			runIDs = append(runIDs, id)
+		}
+	}
+	executionsMu.Unlock()
+
+	for _, runID := range runIDs {
+		s, _, err := jobStatus(ctx, runID)
+		if err != nil || s.State != "running" {
+			continue
+		}
+		if err := callRunAPI(ctx, http.MethodPost, s.Execution+":cancel", []byte("{}"), nil); err != nil {
+			log.Printf("❌ Failed to cancel %s: %v", s.Execution, err)
+			continue
+		}
+		log.Printf("🛑 Cancelled job execution %s (run %s)", s.Execution, runID)
+	}
+}
+
+func callRunAPI(ctx context.Context, method, resource string, body []byte, out interface{}) error {
+	token, err := gcp.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudRunAPI+"/"+resource, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := jobClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runAsJob performs the extraction passed in EXTRACT_REQUEST when this binary
+// runs as a job execution. It reports whether it did, exiting non-zero on
+// failure so Cloud Run records the execution as failed.
+func runAsJob(bqClient *bigquery.Client) bool {
+	input := os.Getenv(jobRequestEnv)
+	if input == "" {
+		return false
+	}
+	var req ExtractRequest
+	if err := json.Unmarshal([]byte(input), &req); err != nil {
+		log.Fatalf("❌ Invalid %s: %v", jobRequestEnv, err)
+	}
+	log.Printf("🏗️ Running as job execution %s for run %s", os.Getenv("CLOUD_RUN_EXECUTION"), req.RunID)
+	err := jobs.Safely(func() error { return RunExtractor(context.Background(), req, publisher, bqClient) })
+	bqClient.Close()
+	if err != nil {
+		log.Printf("❌ Extraction job failed: %v", err)
+		notifyFailure(publisher, req, err)
+		os.Exit(1)
+	}
+	log.Println("✅ Extraction job finished")
+	return true
+}
+
+// handleExtractStatus reports the job execution for a run:
+// GET /extract/status?run_id=...
+func handleExtractStatus(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("run_id")
+	if runID == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Missing run_id")
+		return
+	}
+	s, ok, err := jobStatus(r.Context(), runID)
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No job execution tracked for run "+runID)
+		return
+	}
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Failed to get job status: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"configure/jobs"
+)
+
+// runLocal extracts once into LOCAL_DATA_DIR, laid out like the bucket
+// ({LOCAL_DATA_DIR}/{BUCKET_NAME}/raw-data/{date}), for running the pipeline
+// on a laptop. EXTRACT_REQUEST optionally holds the request as JSON; the
+// date defaults to today and the bucket to raw-inspection-data. Chunk
+// metrics, samples and trigger events are skipped, since there is no
+// BigQuery or trigger to send them to.
+func runLocal() {
+	var req ExtractRequest
+	if input := os.Getenv(jobRequestEnv); input != "" {
+		if err := json.Unmarshal([]byte(input), &req); err != nil {
+			log.Fatalf("❌ Invalid %s: %v", jobRequestEnv, err)
+		}
+	}
+	if req.Date == "" {
+		req.Date = time.Now().Format("2006-01-02")
+	}
+	if req.RunID == "" {
+		req.RunID = "local-" + time.Now().Format("20060102-150405")
+	}
+	if os.Getenv("BUCKET_NAME") == "" {
+		os.Setenv("BUCKET_NAME", "raw-inspection-data")
+	}
+
+	log.Printf("💻 Local mode: extracting %s into %s/%s", req.Date, os.Getenv("LOCAL_DATA_DIR"), os.Getenv("BUCKET_NAME"))
+	err := jobs.Safely(func() error { return RunExtractor(context.Background(), req, publisher, nil) })
+	if err != nil {
+		log.Fatalf("❌ Local extraction failed: %v", err)
+	}
+	log.Println("✅ Local extraction finished")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"configure/eventschema"
+	"configure/gcp"
+	"configure/publish"
+	"configure/retry"
+)
+
+// The events that end or pause a run go through an outbox: each is written
+// to gs://BUCKET_NAME/outbox/ before it is published and removed once the
+// publisher has accepted it. One the trigger never got is published again by
+// sweepOutbox when the extractor next starts, so a failed delivery can't
+// stall a run whose data is complete. The trigger drops redeliveries it has
+// handled.
+const outboxPrefix = "outbox/"
+
+type outboxEntry struct {
+	Payload   map[string]any `json:"payload"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+var deliveryRetry = retry.Policy{Attempts: 5, Initial: 2 * time.Second, Max: 30 * time.Second, Jitter: 0.5, RetryIf: retry.Transient}
+
+// deliverEvent records payload in the outbox, publishes it with retries and
+// clears it once delivered. An event that can't be recorded is still
+// published; one that can't be delivered stays for the next sweep.
+func deliverEvent(ctx context.Context, publisher publish.EventPublisher, payload map[string]any) {
+	eventschema.Stamp(payload)
+	if _, logOnly := publisher.(publish.Log); logOnly {
+		// Nothing is waiting for it, so there is nothing to redeliver
+		publisher.Publish(ctx, payload)
+		return
+	}
+	bucket := os.Getenv("BUCKET_NAME")
+	key := payload["run_id"]
+	if key == nil || key == "" {
+		key = payload["date"]
+	}
+	name := fmt.Sprintf("%s%v-%v-%d.json", outboxPrefix, key, payload["event"], time.Now().UnixNano())
+
+	stored := false
+	if bucket != "" {
+		data, _ := json.Marshal(outboxEntry{Payload: payload, CreatedAt: time.Now().UTC()})
+		if err := gcp.UploadObject(ctx, bucket, name, data, "application/json", false); err != nil {
+			log.Printf("⚠️ Failed to record %v in the outbox, posting it anyway: %v", payload["event"], err)
+		} else {
+			stored = true
+		}
+	}
+
+	if err := publishEvent(ctx, publisher, payload); err != nil {
+		if stored {
+			log.Printf("❌ Failed to deliver %v, left in gs://%s/%s for redelivery: %v", payload["event"], bucket, name, err)
+		} else {
+			log.Printf("❌ Failed to deliver %v: %v", payload["event"], err)
+		}
+		return
+	}
+	if stored {
+		if err := gcp.DeleteObject(ctx, bucket, name); err != nil {
+			log.Printf("⚠️ Delivered %v but could not clear %s: %v", payload["event"], name, err)
+		}
+	}
+}
+
+// publishEvent publishes an event until it is accepted. A rejection (4xx
+// other than timeouts and rate limits) is returned at once.
+func publishEvent(ctx context.Context, publisher publish.EventPublisher, payload map[string]any) error {
+	return deliveryRetry.Do(ctx, func(ctx context.Context, attempt int) error {
+		if err := publisher.Publish(ctx, payload); err != nil {
+			log.Printf("⚠️ Delivery attempt %d of %v failed: %v", attempt, payload["event"], err)
+			return err
+		}
+		log.Printf("📤 Published %v to %s", payload["event"], publisher)
+		return nil
+	})
+}
+
+// sweepOutbox redelivers the events earlier instances left in the outbox.
+// Entries younger than OUTBOX_MIN_AGE (default 2m) may still be in flight
+// from a running instance and are left alone. Entries the trigger rejects are
+// removed, since posting them again won't change the answer.
+func sweepOutbox(ctx context.Context, publisher publish.EventPublisher) {
+	bucket := os.Getenv("BUCKET_NAME")
+	if bucket == "" {
+		return
+	}
+	minAge := 2 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("OUTBOX_MIN_AGE")); err == nil {
+		minAge = d
+	}
+	objects, err := gcp.ListObjectInfo(ctx, bucket, outboxPrefix)
+	if err != nil {
+		log.Printf("⚠️ Could not list the outbox: %v", err)
+		return
+	}
+
+	var delivered, rejected, failed int
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Name, ".json") || time.Since(o.Updated) < minAge {
+			continue
+		}
+		data, err := gcp.ReadObject(ctx, bucket, o.Name)
+		if err != nil {
+			log.Printf("⚠️ Could not read %s: %v", o.Name, err)
+			failed++
+			continue
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Payload == nil {
+			log.Printf("⚠️ Dropping unreadable outbox entry %s: %v", o.Name, err)
+			gcp.DeleteObject(ctx, bucket, o.Name)
+			rejected++
+			continue
+		}
+
+		log.Printf("📮 Redelivering %v for run %v, queued %s", entry.Payload["event"], entry.Payload["run_id"], entry.CreatedAt.Format(time.RFC3339))
+		err = publishEvent(ctx, publisher, entry.Payload)
+		if err != nil && retry.Transient(err) {
+			log.Printf("❌ Redelivery of %s failed, keeping it: %v", o.Name, err)
+			failed++
+			continue
+		}
+		if err != nil {
+			log.Printf("❌ Trigger rejected %s, removing it: %v", o.Name, err)
+			rejected++
+		} else {
+			delivered++
+		}
+		if err := gcp.DeleteObject(ctx, bucket, o.Name); err != nil {
+			log.Printf("⚠️ Could not clear %s: %v", o.Name, err)
+		}
+	}
+	if delivered+rejected+failed > 0 {
+		log.Printf("📮 Outbox sweep: %d redelivered, %d rejected, %d kept for later", delivered, rejected, failed)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"configure/manifest"
+	"configure/socrata"
+)
+
+// pageValidators are the response validators Socrata sent with a page.
+type pageValidators = socrata.Validators
+
+// cachedPage is a page fetched by an earlier run for the same date: how it
+// was requested, its validators, and the chunk file it was written to.
+type cachedPage struct {
+	Limit      int             `json:"limit"`
+	Validators pageValidators  `json:"validators"`
+	Object     manifest.Object `json:"object"`
+}
+
+// pageCache holds the cachedPages of a date's folder, keyed by chunk object
+// name, in {folder}/_pages.json. A page whose validators still match is not
+// downloaded again; its existing chunk file goes into the new manifest.
+type pageCache map[string]cachedPage
+
+func pageCachePath(folder string) string {
+	return folder + "/_pages.json"
+}
+
+// loadPageCache reads the folder's cache; a missing or unreadable one is empty.
+func loadPageCache(s Storage, bucket, folder string) pageCache {
+	pages := make(pageCache)
+	data, err := s.ReadObject(bucket, pageCachePath(folder))
+	if err != nil {
+		return pages
+	}
+	if err := json.Unmarshal(data, &pages); err != nil {
+		log.Printf("⚠️ Ignoring unreadable %s: %v", pageCachePath(folder), err)
+		return make(pageCache)
+	}
+	log.Printf("🗃️ Loaded validators for %d cached page(s)", len(pages))
+	return pages
+}
+
+func (p pageCache) save(s Storage, bucket, folder string) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		err = s.SaveObject(bucket, pageCachePath(folder), data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to save %s: %v", pageCachePath(folder), err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"configure/manifest"
+
+	"cloud.google.com/go/storage"
+)
+
+// Rows without a usable source date go to Hive's partition for NULL keys.
+const nullPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// sourcePartitions copies a date's chunk files into Hive-style partitions by
+// the date each row describes rather than the date it was extracted:
+// raw-data/source_date=YYYY-MM-DD/extract_date=YYYY-MM-DD/offset_N.json, so
+// a BigQuery external table over raw-data/source_date=* can prune on either.
+// The date folder and its manifest stay as they are for the cleaner.
+// PARTITION_BY_SOURCE_DATE=true turns it on; SOURCE_DATE_FIELD names the
+// field read (inspection_date by default).
+//
+// Which partition files each chunk file went to is kept in
+// {folder}/_partitions.json with the chunk's CRC32C, so files of chunks that
+// changed or went away since an earlier run are removed rather than left to
+// duplicate rows.
+type sourcePartitions struct {
+	Date   string                      `json:"date"`
+	Chunks map[string]partitionedChunk `json:"chunks"`
+
+	field  string
+	bucket string
+	s      Storage
+	// Chunk files partitioned by this run
+	written map[string]bool
+}
+
+type partitionedChunk struct {
+	CRC32C string   `json:"crc32c"`
+	Files  []string `json:"files"`
+}
+
+func partitionsPath(folder string) string {
+	return folder + "/_partitions.json"
+}
+
+// loadSourcePartitions reads the folder's partition index to build on; a
+// missing or unreadable one starts empty. It returns nil when partitioning
+// is off.
+func loadSourcePartitions(s Storage, bucket, folder, date string) *sourcePartitions {
+	if !strings.EqualFold(os.Getenv("PARTITION_BY_SOURCE_DATE"), "true") {
+		return nil
+	}
+	p := &sourcePartitions{}
+	data, err := s.ReadObject(bucket, partitionsPath(folder))
+	if err == nil {
+		err = json.Unmarshal(data, p)
+	}
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		log.Printf("⚠️ Ignoring unreadable %s: %v", partitionsPath(folder), err)
+		p = &sourcePartitions{}
+	}
+	p.Date = date
+	if p.Chunks == nil {
+		p.Chunks = make(map[string]partitionedChunk)
+	}
+	p.field = os.Getenv("SOURCE_DATE_FIELD")
+	if p.field == "" {
+		p.field = "inspection_date"
+	}
+	p.bucket, p.s = bucket, s
+	p.written = make(map[string]bool)
+	return p
+}
+
+// sourceDate is the partition a row belongs in: the YYYY-MM-DD its source
+// date field starts with.
+func (p *sourcePartitions) sourceDate(row map[string]interface{}) string {
+	v, _ := row[p.field].(string)
+	if len(v) < 10 {
+		return nullPartition
+	}
+	if _, err := time.Parse("2006-01-02", v[:10]); err != nil {
+		return nullPartition
+	}
+	return v[:10]
+}
+
+// add writes the records of chunk file obj to their partitions and removes
+// the chunk's partition files it no longer has rows for.
+func (p *sourcePartitions) add(obj manifest.Object, records []map[string]interface{}) error {
+	if p == nil {
+		return nil
+	}
+	byDate := make(map[string]*bytes.Buffer)
+	for _, r := range records {
+		d := p.sourceDate(r)
+		if byDate[d] == nil {
+			byDate[d] = &bytes.Buffer{}
+		}
+		if err := json.NewEncoder(byDate[d]).Encode(r); err != nil {
+			return err
+		}
+	}
+
+	files := make([]string, 0, len(byDate))
+	for d, buf := range byDate {
+		name := fmt.Sprintf("raw-data/source_date=%s/extract_date=%s/%s", d, p.Date, obj.Name)
+		if err := p.s.SaveObject(p.bucket, name, buf.Bytes()); err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+		files = append(files, name)
+	}
+	slices.Sort(files)
+	p.remove(slices.DeleteFunc(slices.Clone(p.Chunks[obj.Name].Files), func(f string) bool {
+		return slices.Contains(files, f)
+	}))
+	p.Chunks[obj.Name] = partitionedChunk{CRC32C: obj.CRC32C, Files: files}
+	p.written[obj.Name] = true
+	return nil
+}
+
+// complete brings the partitions in line with the final manifest: chunk
+// files not partitioned as they are now (rewritten short chunks, files from
+// an earlier window) are read back and partitioned, and the partition files
+// of chunks no longer listed are removed.
+func (p *sourcePartitions) complete(folder string, chunks manifest.Manifest) {
+	if p == nil {
+		return
+	}
+	listed := make(map[string]bool, len(chunks.Objects))
+	for _, o := range chunks.Objects {
+		listed[o.Name] = true
+		if c, ok := p.Chunks[o.Name]; ok && c.CRC32C == o.CRC32C {
+			continue
+		}
+		records, err := chunkRecords(p.s, p.bucket, folder+"/"+o.Name)
+		if err == nil {
+			err = p.add(o, records)
+		}
+		if err != nil {
+			log.Printf("⚠️ Could not partition %s/%s: %v", folder, o.Name, err)
+		}
+	}
+	for name, c := range p.Chunks {
+		if !listed[name] {
+			p.remove(c.Files)
+			delete(p.Chunks, name)
+		}
+	}
+}
+
+func (p *sourcePartitions) remove(files []string) {
+	for _, f := range files {
+		if err := p.s.DeleteObject(p.bucket, f); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			log.Printf("⚠️ Could not remove stale partition file %s: %v", f, err)
+		}
+	}
+}
+
+// chunkRecords reads a chunk file back into its records.
+func chunkRecords(s Storage, bucket, objectPath string) ([]map[string]interface{}, error) {
+	data, err := s.ReadObject(bucket, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, err
+		}
+		records = append(records, row)
+	}
+	return records, scanner.Err()
+}
+
+func (p *sourcePartitions) save(folder string) {
+	if p == nil {
+		return
+	}
+	dates := make(map[string]bool)
+	for _, c := range p.Chunks {
+		for _, f := range c.Files {
+			d, _, _ := strings.Cut(strings.TrimPrefix(f, "raw-data/source_date="), "/")
+			dates[d] = true
+		}
+	}
+	data, err := json.Marshal(p)
+	if err == nil {
+		err = p.s.SaveObject(p.bucket, partitionsPath(folder), data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to save %s: %v", partitionsPath(folder), err)
+		return
+	}
+	log.Printf("🗃️ Partitioned %d chunk file(s) over %d source date(s), %d rewritten by this run", len(p.Chunks), len(dates), len(p.written))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"configure/gcp"
+	"configure/manifest"
+)
+
+// PipeTarget is where a piped run streams its chunks: the cleaner's /stream,
+// set by the trigger for a /run with "pipe": true.
+type PipeTarget struct {
+	URL      string `json:"url"`
+	Audience string `json:"audience,omitempty"`
+}
+
+const (
+	// Chunks waiting for the cleaner; once it falls this far behind, further
+	// chunks aren't streamed and the cleaner reads them from the bucket
+	pipeBuffer = 16
+	// How long the cleaner may take after the end of the stream
+	pipeWait = 10 * time.Minute
+)
+
+var errPipeAborted = errors.New("extraction stopped before its manifest was written")
+
+// cleanerPipe streams a run's chunks to the cleaner over one chunked POST
+// while they're written to the bucket, so a small daily run is cleaned as it
+// is extracted. Each chunk is a header line, {"chunk": name, "size": n},
+// followed by its n bytes of NDJSON; a last line, {"end": true, "manifest":
+// {...}}, hands over the manifest, which the cleaner holds the chunks to.
+// The cleaner discards a stream that ends without it. A nil pipe streams
+// nothing.
+type cleanerPipe struct {
+	frames   chan []byte
+	body     *io.PipeReader
+	w        *io.PipeWriter
+	result   chan error
+	close    sync.Once
+	streamed int
+	skipped  int
+}
+
+// openCleanerPipe starts the POST to target, or returns nil (logging why)
+// when the run can't be piped.
+func openCleanerPipe(target *PipeTarget, runID, date string) *cleanerPipe {
+	if target == nil || target.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(target.URL)
+	if err != nil || u.Host == "" {
+		log.Printf("⚠️ Not piping to the cleaner: invalid url %q", target.URL)
+		return nil
+	}
+	q := u.Query()
+	q.Set("date", date)
+	q.Set("run_id", runID)
+	u.RawQuery = q.Encode()
+
+	body, w := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		log.Printf("⚠️ Not piping to the cleaner: %v", err)
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if target.Audience != "" {
+		token, err := gcp.IDToken(context.Background(), target.Audience)
+		if err != nil {
+			log.Printf("⚠️ Not piping to the cleaner: identity token for %s: %v", target.Audience, err)
+			return nil
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	p := &cleanerPipe{frames: make(chan []byte, pipeBuffer), body: body, w: w, result: make(chan error, 1)}
+	go p.stream()
+	go func() { p.result <- p.post(req) }()
+	log.Printf("🚿 Piping chunks to the cleaner at %s", target.URL)
+	return p
+}
+
+// stream writes the frames to the request body. Once a write fails the rest
+// are dropped; post reports the error.
+func (p *cleanerPipe) stream() {
+	var err error
+	for frame := range p.frames {
+		if err == nil {
+			_, err = p.w.Write(frame)
+		}
+	}
+	p.w.CloseWithError(err)
+}
+
+func (p *cleanerPipe) post(req *http.Request) error {
+	// Unblocks stream if the cleaner answers before reading the whole body
+	defer p.body.Close()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// send queues a chunk for the cleaner without waiting for it.
+func (p *cleanerPipe) send(name string, data []byte) {
+	if p == nil {
+		return
+	}
+	header, _ := json.Marshal(map[string]any{"chunk": name, "size": len(data)})
+	frame := make([]byte, 0, len(header)+1+len(data))
+	frame = append(append(append(frame, header...), '\n'), data...)
+	select {
+	case p.frames <- frame:
+		p.streamed++
+	default:
+		p.skipped++
+	}
+}
+
+// finish sends the manifest and waits for the cleaner, reporting whether it
+// cleaned the run. When it didn't, the trigger starts it as usual.
+func (p *cleanerPipe) finish(m manifest.Manifest) bool {
+	if p == nil {
+		return false
+	}
+	end, _ := json.Marshal(map[string]any{"end": true, "manifest": m})
+	timeout := time.NewTimer(pipeWait)
+	defer timeout.Stop()
+
+	err := fmt.Errorf("no answer within %s", pipeWait)
+	select {
+	case p.frames <- append(end, '\n'):
+		p.close.Do(func() { close(p.frames) })
+		select {
+		case err = <-p.result:
+		case <-timeout.C:
+		}
+	case <-timeout.C:
+	}
+	if err != nil {
+		p.abort()
+		log.Printf("⚠️ The cleaner didn't finish the piped chunks — the trigger starts it instead: %v", err)
+		return false
+	}
+	log.Printf("🚿 Piped %d chunk(s) to the cleaner (%d left for it to read from the bucket)", p.streamed, p.skipped)
+	return true
+}
+
+// abort cuts the stream short, so the cleaner discards what it got; it does
+// nothing once finish has sent the manifest.
+func (p *cleanerPipe) abort() {
+	if p == nil {
+		return
+	}
+	p.w.CloseWithError(errPipeAborted)
+	p.close.Do(func() { close(p.frames) })
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"configure/publish"
+)
+
+// countSourceRows asks Socrata how many rows the dataset has, or how many
+// match where, before any page is fetched.
+func countSourceRows(ctx context.Context, where string) (int, error) {
+	return source.Count(ctx, where)
+}
+
+// rowsPlanned is how many of total rows a run starting at offset should
+// fetch, given its max_offset cap (0 for none).
+func rowsPlanned(total, offset, maxOffset int) int {
+	planned := max(total-offset, 0)
+	if maxOffset > 0 {
+		planned = min(planned, maxOffset)
+	}
+	return planned
+}
+
+// progressReporter sends extractor_progress events to the trigger, at most
+// once per PROGRESS_INTERVAL (default 30s) unless forced.
+type progressReporter struct {
+	publisher          publish.EventPublisher
+	runID, date        string
+	totalRows, planned int
+	interval           time.Duration
+	last               time.Time
+}
+
+func newProgressReporter(publisher publish.EventPublisher, runID, date string, totalRows, planned int) *progressReporter {
+	interval := 30 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("PROGRESS_INTERVAL")); err == nil {
+		interval = d
+	}
+	return &progressReporter{publisher: publisher, runID: runID, date: date, totalRows: totalRows, planned: planned, interval: interval}
+}
+
+func (p *progressReporter) report(rowsFetched, offset int, force bool) {
+	if p.totalRows == 0 || (!force && time.Since(p.last) < p.interval) {
+		return
+	}
+	p.last = time.Now()
+	notifyTrigger(p.publisher, map[string]any{
+		"event":        "extractor_progress",
+		"run_id":       p.runID,
+		"date":         p.date,
+		"origin":       "extractor",
+		"total_rows":   p.totalRows,
+		"rows_planned": p.planned,
+		"rows_fetched": rowsFetched,
+		"next_offset":  offset,
+		"percent":      fmt.Sprintf("%.1f", percentOf(rowsFetched, p.planned)),
+	})
+}
+
+// percentOf is done as a percentage of planned, capped at 100.
+func percentOf(done, planned int) float64 {
+	if planned <= 0 {
+		return 100
+	}
+	return min(100*float64(done)/float64(planned), 100)
+}
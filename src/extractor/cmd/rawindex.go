@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"configure/manifest"
+	"configure/problem"
+	"configure/socrata"
+
+	"cloud.google.com/go/storage"
+)
+
+// rawLocation is where a raw record sits in a date's folder: its chunk file
+// and 1-based line.
+type rawLocation struct {
+	Object string `json:"object"`
+	Line   int    `json:"line"`
+}
+
+// rawIndex maps inspection_id → rawLocation for a date's folder and is kept
+// in {folder}/_raw_index.json, so /raw/{id} can find a record without
+// scanning the chunk files. Objects holds the CRC32C of each chunk file as
+// indexed, so a later run only reads back files that changed. RAW_INDEX=false
+// turns it off.
+type rawIndex struct {
+	Date    string                 `json:"date"`
+	Records map[string]rawLocation `json:"records"`
+	Objects map[string]string      `json:"objects"`
+
+	// Chunk files indexed by this run, and the ids they hold
+	reindexed map[string]bool
+	touched   map[string]bool
+}
+
+func rawIndexPath(folder string) string {
+	return folder + "/_raw_index.json"
+}
+
+// loadRawIndex reads the folder's index to build on; a missing or unreadable
+// one starts empty. It returns nil when indexing is off.
+func loadRawIndex(s Storage, bucket, folder, date string) *rawIndex {
+	if strings.EqualFold(os.Getenv("RAW_INDEX"), "false") {
+		return nil
+	}
+	x, err := readRawIndex(s, bucket, folder)
+	if err != nil {
+		if !errors.Is(err, storage.ErrObjectNotExist) {
+			log.Printf("⚠️ Ignoring unreadable %s: %v", rawIndexPath(folder), err)
+		}
+		x = &rawIndex{}
+	}
+	x.Date = date
+	if x.Records == nil {
+		x.Records = make(map[string]rawLocation)
+	}
+	if x.Objects == nil {
+		x.Objects = make(map[string]string)
+	}
+	x.reindexed = make(map[string]bool)
+	x.touched = make(map[string]bool)
+	return x
+}
+
+func readRawIndex(s Storage, bucket, folder string) (*rawIndex, error) {
+	data, err := s.ReadObject(bucket, rawIndexPath(folder))
+	if err != nil {
+		return nil, err
+	}
+	var x rawIndex
+	if err := json.Unmarshal(data, &x); err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+// add indexes the records of chunk file obj, in the order they were written.
+func (x *rawIndex) add(obj manifest.Object, records []map[string]interface{}) {
+	if x == nil {
+		return
+	}
+	ids := make([]string, len(records))
+	for i, r := range records {
+		ids[i], _ = r["inspection_id"].(string)
+	}
+	x.set(obj, ids)
+}
+
+func (x *rawIndex) set(obj manifest.Object, ids []string) {
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		x.Records[id] = rawLocation{Object: obj.Name, Line: i + 1}
+		x.touched[id] = true
+	}
+	x.Objects[obj.Name] = obj.CRC32C
+	x.reindexed[obj.Name] = true
+}
+
+// complete brings the index in line with the final manifest: chunk files it
+// hasn't indexed as they are now — rewritten short chunks, files from an
+// earlier window or an index written before them — are read back, and
+// entries for files no longer listed or for ids a re-indexed file no longer
+// holds are dropped.
+func (x *rawIndex) complete(s Storage, bucket, folder string, chunks manifest.Manifest) {
+	if x == nil {
+		return
+	}
+	listed := make(map[string]bool, len(chunks.Objects))
+	for _, o := range chunks.Objects {
+		listed[o.Name] = true
+		if crc, ok := x.Objects[o.Name]; ok && crc == o.CRC32C {
+			continue
+		}
+		ids, err := chunkIDs(s, bucket, folder+"/"+o.Name)
+		if err != nil {
+			log.Printf("⚠️ Could not index %s/%s: %v", folder, o.Name, err)
+			delete(x.Objects, o.Name)
+			continue
+		}
+		x.set(o, ids)
+	}
+	for name := range x.Objects {
+		if !listed[name] {
+			delete(x.Objects, name)
+		}
+	}
+	for id, loc := range x.Records {
+		if !listed[loc.Object] || (x.reindexed[loc.Object] && !x.touched[id]) {
+			delete(x.Records, id)
+		}
+	}
+}
+
+// chunkIDs reads a chunk file back and returns the inspection_id of each line.
+func chunkIDs(s Storage, bucket, objectPath string) ([]string, error) {
+	data, err := s.ReadObject(bucket, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row socrata.Inspection
+		json.Unmarshal(scanner.Bytes(), &row)
+		ids = append(ids, row.InspectionID)
+	}
+	return ids, scanner.Err()
+}
+
+func (x *rawIndex) save(save func(bucket, path string, data []byte) error, bucket, folder string) {
+	if x == nil {
+		return
+	}
+	data, err := json.Marshal(x)
+	if err == nil {
+		err = save(bucket, rawIndexPath(folder), data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to save %s: %v", rawIndexPath(folder), err)
+		return
+	}
+	log.Printf("🗂️ Indexed %d raw records in %s", len(x.Records), rawIndexPath(folder))
+}
+
+// handleRawRecord returns a record as the extractor wrote it, for debugging:
+// GET /raw/{id}?date=YYYY-MM-DD looks inspection id up in the date's raw
+// index (today's when no date is given; ?snapshot=true for the date's
+// snapshot) and answers with its chunk file, line and raw JSON.
+func handleRawRecord(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	}
+	bucketName, folder, ok := requestFolder(w, r, date)
+	if !ok {
+		return
+	}
+	storageClient, err := NewGCSStorage()
+	if err != nil {
+		problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "GCS client: "+err.Error())
+		return
+	}
+
+	x, err := readRawIndex(storageClient, bucketName, folder)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No raw index for "+folder)
+		return
+	}
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Read "+rawIndexPath(folder)+": "+err.Error())
+		return
+	}
+	loc, ok := x.Records[id]
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No raw record for inspection "+id+" in "+folder)
+		return
+	}
+
+	objectPath := folder + "/" + loc.Object
+	reader, err := storageClient.Client.Bucket(bucketName).Object(objectPath).NewReader(storageClient.Ctx)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Read "+objectPath+": "+err.Error())
+		return
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Read "+objectPath+": "+err.Error())
+		return
+	}
+	// The chunk file may have been rewritten since the index was
+	var record socrata.Inspection
+	lines := bytes.Split(data, []byte("\n"))
+	if loc.Line > len(lines) || json.Unmarshal(lines[loc.Line-1], &record) != nil || record.InspectionID != id {
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, "Index is stale: line "+strconv.Itoa(loc.Line)+" of "+objectPath+" is not inspection "+id)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"inspection_id": id,
+		"date":          date,
+		"object":        objectPath,
+		"line":          loc.Line,
+		"record":        json.RawMessage(lines[loc.Line-1]),
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// RawRowSample is one row of the raw_row_samples table: a row as written to
+// a chunk file, kept so cleaning bugs can be traced without downloading the
+// run's objects from GCS.
+type RawRowSample struct {
+	RunID     string    `bigquery:"run_id"`
+	Date      string    `bigquery:"date"`
+	Mode      string    `bigquery:"mode"`
+	Offset    int       `bigquery:"offset"`
+	Object    string    `bigquery:"object"`    // chunk file name in the run's folder
+	RowIndex  int       `bigquery:"row_index"` // line of the row in the chunk file
+	Row       string    `bigquery:"row"`       // the row as JSON
+	Timestamp time.Time `bigquery:"timestamp"`
+}
+
+// rowSampler streams a random sample of each chunk's rows to BigQuery.
+// It is off unless RAW_SAMPLE_RATE is a fraction above 0, e.g. 0.01 for 1%.
+type rowSampler struct {
+	ctx   context.Context
+	table *bigquery.Table
+	rate  float64
+	runID string
+	date  string
+	mode  string
+	// Written counts streamed rows, reported as billable usage
+	Written int
+}
+
+// newRowSampler opens PipelineMonitoring.raw_row_samples (RAW_SAMPLES_TABLE
+// overrides the table name), creating it partitioned by day on first use.
+func newRowSampler(ctx context.Context, bqClient *bigquery.Client, runID, date, mode string) *rowSampler {
+	s := &rowSampler{ctx: ctx, runID: runID, date: date, mode: mode}
+	rate, err := strconv.ParseFloat(os.Getenv("RAW_SAMPLE_RATE"), 64)
+	if err != nil || rate <= 0 || bqClient == nil {
+		return s
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	tableID := os.Getenv("RAW_SAMPLES_TABLE")
+	if tableID == "" {
+		tableID = "raw_row_samples"
+	}
+	table := bqClient.Dataset("PipelineMonitoring").Table(tableID)
+	if _, err := table.Metadata(ctx); err != nil {
+		schema, err := bigquery.InferSchema(RawRowSample{})
+		if err == nil {
+			err = table.Create(ctx, &bigquery.TableMetadata{
+				Schema:           schema,
+				TimePartitioning: &bigquery.TimePartitioning{Field: "timestamp"},
+			})
+		}
+		if err != nil {
+			log.Printf("⚠️ raw row sampling disabled: %v", err)
+			return s
+		}
+		log.Printf("🆕 Created BigQuery table PipelineMonitoring.%s", tableID)
+	}
+	s.table, s.rate = table, rate
+	log.Printf("🔬 Sampling %.2f%% of raw rows into PipelineMonitoring.%s", rate*100, tableID)
+	return s
+}
+
+// sample streams a share of the rows written to object at offset.
+func (s *rowSampler) sample(offset int, object string, records []map[string]interface{}) {
+	if s.table == nil {
+		return
+	}
+	now := time.Now()
+	var savers []*bigquery.StructSaver
+	for i, record := range records {
+		if rand.Float64() >= s.rate {
+			continue
+		}
+		row, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		savers = append(savers, &bigquery.StructSaver{
+			Struct: RawRowSample{
+				RunID:     s.runID,
+				Date:      s.date,
+				Mode:      s.mode,
+				Offset:    offset,
+				Object:    object,
+				RowIndex:  i,
+				Row:       string(row),
+				Timestamp: now,
+			},
+			// A row is sampled at most once per run and object, so a retried insert is deduplicated
+			InsertID: fmt.Sprintf("%s-%s-%d", s.runID, object, i),
+		})
+	}
+	if len(savers) == 0 {
+		return
+	}
+	inserter := s.table.Inserter()
+	err := bqRetry.Do(s.ctx, func(ctx context.Context, attempt int) error {
+		return withBQTimeout(ctx, "raw row samples insert", bqInsertTimeout, func(ctx context.Context) error {
+			return inserter.Put(ctx, savers)
+		})
+	})
+	if err != nil {
+		log.Printf("❌ Failed to insert raw row samples into BigQuery: %v", err)
+		return
+	}
+	s.Written += len(savers)
+}
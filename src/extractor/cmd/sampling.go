@@ -0,0 +1,34 @@
+package main
+
+import "fmt"
+
+// defaultSampleEvery is how sparse a "sample" run is when its request
+// doesn't say.
+const defaultSampleEvery = 20
+
+// sampleFilter is the $where of a "sample" run, and "" for any other: every
+// sample_every-th inspection by ID. IDs were handed out as inspections took
+// place, so the sample spans the dataset's dates, facility types and results
+// evenly, where a run capped by max_offset only sees the rows of its first
+// pages. The same filter picks the same rows every time.
+//
+// A sample is written to sampleFolder, never to the date's raw-data folder,
+// so it can't stand in for the date's data downstream.
+func (req ExtractRequest) sampleFilter() (string, error) {
+	if req.Mode != "sample" {
+		return "", nil
+	}
+	n := req.SampleEvery
+	if n == 0 {
+		n = defaultSampleEvery
+	}
+	if n < 2 {
+		return "", fmt.Errorf("sample_every %d must be at least 2", n)
+	}
+	return fmt.Sprintf("inspection_id %% %d = 0", n), nil
+}
+
+// sampleFolder is where a "sample" run for date writes its files.
+func sampleFolder(date string) string {
+	return fmt.Sprintf("samples/%s", date)
+}
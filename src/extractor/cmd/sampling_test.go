@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"configure/publish"
+	"configure/socrata"
+)
+
+// fakeSocrata serves rows as one page, an empty page after it, and their
+// count, as the dataset does.
+func fakeSocrata(t *testing.T, rows []map[string]interface{}) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case strings.Contains(q.Get("$select"), "count(*)"):
+			json.NewEncoder(w).Encode([]map[string]string{{"count": "2"}})
+		case q.Get("$offset") == "0":
+			json.NewEncoder(w).Encode(rows)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	saved := source
+	source = socrata.New(srv.URL + "/resource/qizy-d2wf.json")
+	t.Cleanup(func() { source = saved })
+}
+
+// A sample run writes to samples/{date}/ and leaves the date's raw-data
+// folder and a stopped run's checkpoint as they were.
+func TestSampleLeavesRawDataAndCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LOCAL_DATA_DIR", dir)
+	t.Setenv("BUCKET_NAME", "raw")
+	fakeSocrata(t, []map[string]interface{}{
+		{"inspection_id": "20", "dba_name": "Sampled Diner", "inspection_date": "2025-01-02T00:00:00.000"},
+		{"inspection_id": "40", "dba_name": "Sampled Grill", "inspection_date": "2025-01-03T00:00:00.000"},
+	})
+
+	const date = "2025-01-31"
+	bucket := filepath.Join(dir, "raw")
+	existing := map[string][]byte{
+		checkpointPath(date):                  []byte(`{"date": "2025-01-31", "last_offset": 5000, "initial_offset": 0, "rows_fetched": 5000}`),
+		"raw-data/" + date + "/offset_0.json": []byte(`{"inspection_id": "1", "dba_name": "Real Cafe"}` + "\n"),
+	}
+	for name, data := range existing {
+		path := filepath.Join(bucket, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := ExtractRequest{RunID: "sample-run", Date: date, Mode: "sample", SampleEvery: 20}
+	if err := RunExtractor(context.Background(), req, publish.Log{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range existing {
+		got, err := os.ReadFile(filepath.Join(bucket, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s changed: %q, %v", name, got, err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(bucket, "raw-data", date)); len(entries) != 1 {
+		t.Errorf("raw-data/%s has %d files, want the 1 it had", date, len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(bucket, "samples", date, "_manifest.json")); err != nil {
+		t.Errorf("sample manifest: %v", err)
+	}
+}
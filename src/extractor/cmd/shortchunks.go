@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"configure/manifest"
+	"configure/socrata"
+)
+
+// pageWrite is a page that went into the run's manifest, kept so the
+// post-run check knows how many rows its chunk file should hold.
+type pageWrite struct {
+	Object  string `json:"object"` // name in the manifest
+	Offset  int    `json:"offset"`
+	Limit   int    `json:"limit"`
+	Fetched int    `json:"fetched"` // rows the API returned
+	Dropped int    `json:"dropped"` // rows removed by fault injection
+}
+
+// expected is the row count of a full page after injected drops.
+func (p pageWrite) expected() int {
+	return p.Limit - p.Dropped
+}
+
+// chunkRecovery sums up recoverShortChunks.
+type chunkRecovery struct {
+	Short     int   // chunk files found with fewer rows than a full page
+	Refetched int   // of those, rewritten from a fresh fetch
+	APICalls  int   // billable fetches made
+	Bytes     int64 // written to Cloud Storage
+	ExtraRows int   // rows the fresh fetches returned beyond the first ones
+}
+
+// recoverShortChunks reads back every chunk file but the last, which may
+// legitimately be short, and re-fetches the page of any holding fewer rows
+// than a full page: the API returned a short page, or the write was cut off.
+// Rewritten files replace their manifest entries and page cache validators.
+// VERIFY_CHUNKS=false skips the check. Snapshots are never checked: their
+// files are written once and not replaced, even when short.
+func recoverShortChunks(ctx context.Context, s Storage, bucket, folder string, chunks *manifest.Manifest, written []pageWrite, pages pageCache) chunkRecovery {
+	var rec chunkRecovery
+	if strings.EqualFold(os.Getenv("VERIFY_CHUNKS"), "false") || chunks.Snapshot || len(written) < 2 {
+		return rec
+	}
+	for _, p := range written[:len(written)-1] {
+		path := folder + "/" + p.Object
+		rows, err := countObjectRows(s, bucket, path)
+		if err != nil {
+			log.Printf("⚠️ Could not read back %s: %v", path, err)
+			continue
+		}
+		if rows >= p.expected() {
+			continue
+		}
+		rec.Short++
+		log.Printf("🩹 %s has %d of %d expected rows — re-fetching offset %d", path, rows, p.expected(), p.Offset)
+
+		data, fetched, validators, calls, err := refetchPage(ctx, chunks.Sample, p.Offset, p.Limit)
+		rec.APICalls += calls
+		if err != nil {
+			log.Printf("❌ Re-fetch of offset %d failed, keeping the short chunk: %v", p.Offset, err)
+			continue
+		}
+		if fetched <= rows {
+			log.Printf("⚠️ Re-fetch of offset %d returned only %d rows — keeping %s", p.Offset, fetched, path)
+			continue
+		}
+		if err := s.SaveObject(bucket, path, data); err != nil {
+			log.Printf("❌ Failed to rewrite %s: %v", path, err)
+			continue
+		}
+		obj := manifest.Describe(p.Object, data)
+		chunks.Replace(obj)
+		rec.Refetched++
+		rec.Bytes += int64(len(data))
+		rec.ExtraRows += fetched - p.Fetched
+		if chunks.Sample == "" && !validators.Empty() {
+			pages[path] = cachedPage{Limit: p.Limit, Validators: validators, Object: obj}
+		}
+		log.Printf("✅ Rewrote %s with %d rows", path, obj.Rows)
+	}
+	return rec
+}
+
+// countObjectRows reads an NDJSON object back and counts its rows.
+func countObjectRows(s Storage, bucket, objectPath string) (int, error) {
+	data, err := s.ReadObject(bucket, objectPath)
+	if err != nil {
+		return 0, err
+	}
+	return manifest.CountRows(data), nil
+}
+
+// refetchPage fetches one page of the rows matching where again, without
+// fault injection, and returns it as NDJSON with its row count.
+func refetchPage(ctx context.Context, where string, offset, limit int) (data []byte, rows int, validators pageValidators, apiCalls int, err error) {
+	var page socrata.Page
+	err = fetchRetry.Do(ctx, func(ctx context.Context, attempt int) error {
+		apiCalls++
+		var err error
+		if page, err = source.Get(ctx, socrata.Query{Where: where, Limit: limit, Offset: offset}, pageValidators{}); err != nil {
+			log.Printf("⚠️ Re-fetch attempt %d failed: %v", attempt, err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, pageValidators{}, apiCalls, err
+	}
+
+	records, err := page.Records()
+	if err != nil {
+		return nil, 0, pageValidators{}, apiCalls, fmt.Errorf("parse page: %w", err)
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, 0, pageValidators{}, apiCalls, fmt.Errorf("encode NDJSON: %w", err)
+		}
+	}
+	return buf.Bytes(), len(records), page.Validators, apiCalls, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// stopFlags holds a flag for each extraction this instance runs, set by
+// /shutdown and read by the extraction loop between chunks. Each run has its
+// own, so stopping one never carries over to, or is cleared by, another.
+var stopFlags = struct {
+	sync.Mutex
+	runs map[*atomic.Bool]string // flag → run ID
+}{runs: make(map[*atomic.Bool]string)}
+
+type stopKey struct{}
+
+// withStopFlag registers a stop flag for runID and returns a context carrying
+// it, and a function that unregisters it once the run is over.
+func withStopFlag(ctx context.Context, runID string) (context.Context, func()) {
+	flag := new(atomic.Bool)
+	stopFlags.Lock()
+	stopFlags.runs[flag] = runID
+	stopFlags.Unlock()
+	return context.WithValue(ctx, stopKey{}, flag), func() {
+		stopFlags.Lock()
+		delete(stopFlags.runs, flag)
+		stopFlags.Unlock()
+	}
+}
+
+// stopRequested reports whether /shutdown asked the run ctx belongs to to
+// stop. Runs without a flag (jobs, local runs) are never asked.
+func stopRequested(ctx context.Context) bool {
+	flag, _ := ctx.Value(stopKey{}).(*atomic.Bool)
+	return flag != nil && flag.Load()
+}
+
+// requestStop sets the flags of runID's extractions, or of every extraction
+// when runID is empty, and returns how many it set.
+func requestStop(runID string) int {
+	stopFlags.Lock()
+	defer stopFlags.Unlock()
+	n := 0
+	for flag, id := range stopFlags.runs {
+		if runID == "" || id == runID {
+			flag.Store(true)
+			n++
+		}
+	}
+	return n
+}
+
+// handleShutdown stops the extraction of ?run_id after its current chunk,
+// or every extraction running here when no run is named. In job mode the
+// matching executions are cancelled instead.
+func handleShutdown(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("run_id")
+	stopped := requestStop(runID)
+	if runID == "" {
+		log.Printf("🛑 Shutdown requested — %d extraction(s) will exit after the current fetch.", stopped)
+	} else {
+		log.Printf("🛑 Shutdown requested for run %s — %d extraction(s) will exit after the current fetch.", runID, stopped)
+	}
+	if jobMode() {
+		cancelJobs(r.Context(), runID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Shutdown initiated.",
+		"run_id":  runID,
+		"stopped": stopped,
+	})
+}
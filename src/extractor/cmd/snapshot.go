@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"configure/errcategory"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// snapshotFolder is where an immutable full-dataset copy for date lives.
+func snapshotFolder(date string) string {
+	return fmt.Sprintf("snapshots/%s", date)
+}
+
+// createSnapshotTable loads a snapshot's NDJSON chunks into their own BigQuery
+// table (RawSnapshots.inspections_YYYYMMDD). WriteEmpty makes the load fail
+// rather than append if the table already has rows, keeping snapshots immutable.
+// A missing dataset is created in snapshotLocation.
+func createSnapshotTable(ctx context.Context, bqClient *bigquery.Client, s Storage, bucketName, date string) error {
+	datasetID := os.Getenv("SNAPSHOT_DATASET")
+	if datasetID == "" {
+		datasetID = "RawSnapshots"
+	}
+	tableID := "inspections_" + strings.ReplaceAll(date, "-", "")
+
+	dataset := bqClient.Dataset(datasetID)
+	if _, err := dataset.Metadata(ctx); err != nil {
+		location, err := snapshotLocation(ctx, s, bucketName)
+		if err != nil {
+			return errcategory.Wrap(errcategory.Configuration, err)
+		}
+		log.Printf("🆕 Creating snapshot dataset %s in %s", datasetID, location)
+		if err := dataset.Create(ctx, &bigquery.DatasetMetadata{Location: location}); err != nil {
+			return fmt.Errorf("create dataset %s: %w", datasetID, err)
+		}
+	}
+
+	source := bigquery.NewGCSReference(fmt.Sprintf("gs://%s/%s/offset_*.json", bucketName, snapshotFolder(date)))
+	source.SourceFormat = bigquery.JSON
+	source.AutoDetect = true
+
+	loader := dataset.Table(tableID).LoaderFrom(source)
+	loader.WriteDisposition = bigquery.WriteEmpty
+
+	err := withBQTimeout(ctx, "snapshot load", bqLoadTimeout, func(ctx context.Context) error {
+		job, err := loader.Run(ctx)
+		if err != nil {
+			return fmt.Errorf("start snapshot load: %w", err)
+		}
+		status, err := job.Wait(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for snapshot load: %w", err)
+		}
+		if err := status.Err(); err != nil {
+			return fmt.Errorf("snapshot load failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("📸 Snapshot table ready: %s.%s", datasetID, tableID)
+	return nil
+}
+
+// snapshotLocation is SNAPSHOT_LOCATION, or else the location of the bucket
+// the snapshot is loaded from, which BigQuery requires the dataset to share.
+func snapshotLocation(ctx context.Context, s Storage, bucketName string) (string, error) {
+	if loc := os.Getenv("SNAPSHOT_LOCATION"); loc != "" {
+		return loc, nil
+	}
+	gcs, ok := s.(*GCSStorage)
+	if !ok {
+		return "", errors.New("SNAPSHOT_LOCATION not set")
+	}
+	attrs, err := gcs.Client.Bucket(bucketName).Attrs(ctx)
+	if err != nil {
+		return "", fmt.Errorf("SNAPSHOT_LOCATION not set and the location of gs://%s is unknown: %w", bucketName, err)
+	}
+	return attrs.Location, nil
+}
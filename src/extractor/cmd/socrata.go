@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"configure/socrata"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const defaultUserAgent = "hygiene-prediction-extractor/1.0 (+https://github.com/malawley/hygiene_prediction_clean)"
+
+// source is the dataset the extractor reads. Its Retry, fetchRetry with a
+// log line per retry, is what the row count uses; the page loop and
+// re-fetches drive fetchRetry themselves to record each attempt.
+var source = newSource()
+
+func newSource() *socrata.Client {
+	c := socrata.New(socrata.DatasetURL())
+	c.Header.Set("User-Agent", defaultUserAgent)
+	c.Retry = fetchRetry
+	c.Retry.OnRetry = func(attempt int, err error, delay time.Duration) {
+		log.Printf("⚠️ Socrata attempt %d failed: %v — retrying in %s", attempt, err, delay.Round(time.Millisecond))
+	}
+	return c
+}
+
+// fetchStats is how getting one page went: how many requests it took, the
+// last one's status and size, and its time apart from the failed requests
+// and backoff before it, so a slow chunk can be told apart as slow to
+// retry or slow to download.
+type fetchStats struct {
+	Attempts     int
+	Status       int
+	Bytes        int
+	FetchSeconds float64 // the last request
+	RetrySeconds float64 // the requests before it and the waits between them
+}
+
+// addTo adds the stats to a chunk's metrics.
+func (f fetchStats) addTo(metrics map[string]interface{}) map[string]interface{} {
+	metrics["fetch_attempts"] = f.Attempts
+	metrics["status_code"] = f.Status
+	metrics["page_bytes"] = f.Bytes
+	metrics["fetch_seconds"] = f.FetchSeconds
+	metrics["retry_seconds"] = f.RetrySeconds
+	return metrics
+}
+
+// failChunk ends the run at a page that couldn't be had: the fetch failed
+// for good, or what came back wasn't an array of rows. What was sent instead
+// (SODA's error payload, or the start of body) goes into the chunk's
+// chunk_metrics row. The returned error keeps the failure's category, so the
+// trigger retries the stage only when that may help; the checkpoint still
+// points at the page, so a retry starts there.
+func failChunk(ctx context.Context, bqClient *bigquery.Client, ledger *attemptLedger, runID string, offset, chunkSize int, started time.Time, fetched fetchStats, err error, body []byte) error {
+	sent := fmt.Sprintf("%.2048s", body)
+	var apiErr *socrata.APIError
+	if errors.As(err, &apiErr) {
+		sent = apiErr.Body
+	}
+	if sent == "" {
+		sent = err.Error()
+	}
+	log.Printf("❌ Page at offset %d failed: %v", offset, err)
+	writeChunkMetrics(ctx, bqClient, "PipelineMonitoring", "chunk_metrics", offset, fetched.addTo(map[string]interface{}{
+		"fetch_skipped":          true,
+		"gcs_write_skipped":      false,
+		"rows_extracted":         0,
+		"rows_dropped":           0,
+		"chunk_duration_seconds": time.Since(started).Seconds(),
+		"delay_applied":          false,
+		"chunk_size":             chunkSize,
+		"skipped_unchanged":      false,
+		"run_id":                 runID,
+		"fetch_error":            sent,
+	}))
+	ledger.flush()
+	return fmt.Errorf("page at offset %d: %w", offset, err)
+}
+
+// configureSource applies SOCRATA_USER_AGENT, SOCRATA_HEADERS, a JSON object
+// of extra headers (e.g. {"X-App-Token":"..."}) that may also override the
+// defaults, and SOCRATA_MIN_INTERVAL, the least time between requests.
+func configureSource() error {
+	if ua := os.Getenv("SOCRATA_USER_AGENT"); ua != "" {
+		source.Header.Set("User-Agent", ua)
+	}
+	if raw := os.Getenv("SOCRATA_MIN_INTERVAL"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("SOCRATA_MIN_INTERVAL: %w", err)
+		}
+		source.MinInterval = d
+	}
+	raw := os.Getenv("SOCRATA_HEADERS")
+	if raw == "" {
+		return nil
+	}
+	var extra map[string]string
+	if err := json.Unmarshal([]byte(raw), &extra); err != nil {
+		return fmt.Errorf("SOCRATA_HEADERS: %w", err)
+	}
+	for name, value := range extra {
+		source.Header.Set(name, value)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+)
+
+// Storage is where an extraction writes its chunk files, manifest and state:
+// a GCS bucket, or with LOCAL_DATA_DIR set a directory on disk, so the
+// pipeline can run offline. A missing object reads as storage.ErrObjectNotExist
+// either way.
+type Storage interface {
+	EnsureBucketExists(bucket string) error
+	SaveObject(bucket, objectPath string, data []byte) error
+	// SaveNewObject fails if objectPath already exists
+	SaveNewObject(bucket, objectPath string, data []byte) error
+	ReadObject(bucket, objectPath string) ([]byte, error)
+	ObjectExists(bucket, objectPath string) (bool, error)
+	DeleteObject(bucket, objectPath string) error
+}
+
+// newStorage returns the local directory storage when LOCAL_DATA_DIR is
+// set, and GCS otherwise.
+func newStorage() (Storage, error) {
+	if dir := os.Getenv("LOCAL_DATA_DIR"); dir != "" {
+		return &LocalStorage{Root: dir}, nil
+	}
+	return NewGCSStorage()
+}
+
+// LocalStorage keeps objects as files under Root/{bucket}/{objectPath},
+// laid out like the bucket so the cleaner's local mode can read them.
+type LocalStorage struct {
+	Root string
+}
+
+func (s *LocalStorage) path(bucket, objectPath string) string {
+	return filepath.Join(s.Root, bucket, filepath.FromSlash(objectPath))
+}
+
+func (s *LocalStorage) EnsureBucketExists(bucket string) error {
+	dir := filepath.Join(s.Root, bucket)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	log.Printf("📁 Creating local bucket directory %s", dir)
+	return os.MkdirAll(dir, 0o755)
+}
+
+// SaveObject writes through a temporary file, so a reader never sees half an object.
+func (s *LocalStorage) SaveObject(bucket, objectPath string, data []byte) error {
+	path := s.path(bucket, objectPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStorage) SaveNewObject(bucket, objectPath string, data []byte) error {
+	path := s.path(bucket, objectPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s already exists", path)
+		}
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *LocalStorage) ReadObject(bucket, objectPath string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(bucket, objectPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, storage.ErrObjectNotExist
+	}
+	return data, err
+}
+
+func (s *LocalStorage) ObjectExists(bucket, objectPath string) (bool, error) {
+	_, err := os.Stat(s.path(bucket, objectPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) DeleteObject(bucket, objectPath string) error {
+	err := os.Remove(s.path(bucket, objectPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
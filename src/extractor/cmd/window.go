@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"configure/manifest"
+	"configure/publish"
+)
+
+// A run with max_minutes stops extracting once its window has passed and
+// leaves a resumeState next to its chunks. The trigger answers the
+// extractor_paused event by starting the extractor again with continue set,
+// until a window reaches the end of the data and writes the manifest.
+type resumeState struct {
+	RunID         string            `json:"run_id"`
+	Window        int               `json:"window"`
+	NextOffset    int               `json:"next_offset"`
+	InitialOffset int               `json:"initial_offset"`
+	ChunkSize     int               `json:"chunk_size"`
+	RowsFetched   int               `json:"rows_fetched"`
+	TotalRows     int               `json:"total_rows,omitempty"` // from the first window's preflight
+	Written       []pageWrite       `json:"written,omitempty"`    // pages behind Chunks, for the post-run check
+	Chunks        manifest.Manifest `json:"chunks"`               // written so far, stitched into the final manifest
+	SavedAt       time.Time         `json:"saved_at"`
+}
+
+func resumePath(folder string) string {
+	return folder + "/_resume.json"
+}
+
+// SaveResume records where a paused extraction stopped. It always overwrites,
+// snapshot folders included.
+func saveResume(s Storage, bucket, folder string, state resumeState) error {
+	state.SavedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.SaveObject(bucket, resumePath(folder), data)
+}
+
+// ReadResume loads the state left by the previous window of a run.
+func readResume(s Storage, bucket, folder string) (resumeState, error) {
+	var state resumeState
+	data, err := s.ReadObject(bucket, resumePath(folder))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// ClearResume removes the resume state once the extraction has finished.
+func clearResume(s Storage, bucket, folder string) {
+	if err := s.DeleteObject(bucket, resumePath(folder)); err != nil {
+		log.Printf("⚠️ Failed to remove %s: %v", resumePath(folder), err)
+	}
+}
+
+// notifyTrigger publishes a stage event to the trigger, once.
+func notifyTrigger(publisher publish.EventPublisher, payload map[string]any) {
+	if err := publisher.Publish(context.Background(), payload); err != nil {
+		log.Printf("❌ Failed to notify trigger of %v: %v", payload["event"], err)
+		return
+	}
+	log.Printf("📤 Published %v to %s", payload["event"], publisher)
+}
@@ -5,6 +5,6 @@ docker run --rm --name extractor \
   -e HTTP_MODE=true \
   -e SERVICE_CONFIG_PATH=/services.json \
   -e BUCKET_NAME=raw-inspection-data-434 \
-  -v "$HOME/gcp-creds/service-account.json:/app/creds.json" \
+  -v "${GCP_CREDENTIALS_FILE:-$HOME/gcp-creds/service-account.json}:/app/creds.json" \
   -e GOOGLE_APPLICATION_CREDENTIALS=/app/creds.json \
   extractor
@@ -0,0 +1,12 @@
+#!/bin/bash
+set -e
+
+echo "=== 🛠 Building Features ==="
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+cd "$SCRIPT_DIR"
+
+echo "--- Building Docker image (multi-stage)..."
+docker build -t hygiene_prediction-features -f Dockerfile ..
+
+echo "✅ Docker image built: hygiene_prediction-features"
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// bqClientOptions makes the BigQuery client act as the service account in
+// BQ_IMPERSONATE_SERVICE_ACCOUNT, when set, so the service can write to a
+// BQ_PROJECT its own account has no access to (e.g. the shared analytics
+// project). The runtime account needs roles/iam.serviceAccountTokenCreator
+// on the target, or on the first of BQ_IMPERSONATE_DELEGATES (comma
+// separated) when the grant goes through a chain of accounts.
+func bqClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	target := os.Getenv("BQ_IMPERSONATE_SERVICE_ACCOUNT")
+	if target == "" {
+		return nil, nil
+	}
+	var delegates []string
+	for _, d := range strings.Split(os.Getenv("BQ_IMPERSONATE_DELEGATES"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			delegates = append(delegates, d)
+		}
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+		Delegates:       delegates,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("impersonate %s: %w", target, err)
+	}
+	log.Printf("🎭 BigQuery calls impersonate %s", target)
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+func runQuery(ctx context.Context, q *bigquery.Query) error {
+	job, err := q.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	recordJob(ctx, status)
+	return status.Err()
+}
+
+// readQuery runs q and returns its rows, counting the job's bytes like runQuery.
+func readQuery(ctx context.Context, q *bigquery.Query) (*bigquery.RowIterator, error) {
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recordJob(ctx, status)
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return job.Read(ctx)
+}
+
+// loadJSONRows writes rows to dataset.table with a load job rather than
+// streaming inserts, so the rows can be deleted again by a re-run right away.
+func loadJSONRows[T any](ctx context.Context, bqClient *bigquery.Client, dataset, table string, rows []T, disposition bigquery.TableWriteDisposition) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return fmt.Errorf("encode %s row: %w", table, err)
+		}
+	}
+
+	source := bigquery.NewReaderSource(&buf)
+	source.SourceFormat = bigquery.JSON
+	loader := bqClient.Dataset(dataset).Table(table).LoaderFrom(source)
+	loader.WriteDisposition = disposition
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("start %s load: %w", table, err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("wait for %s load: %w", table, err)
+	}
+	recordJob(ctx, status)
+	return status.Err()
+}
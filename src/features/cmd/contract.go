@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	"configure/errcategory"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// ColumnContract describes what the model expects for one input column.
+type ColumnContract struct {
+	Name string `json:"name"`
+	// "string", "integer" or "float"
+	Type     string   `json:"type"`
+	Nullable bool     `json:"nullable"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	// Allowed values for categorical columns
+	Domain  []string `json:"domain,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+}
+
+type ModelContract struct {
+	Columns []ColumnContract `json:"columns"`
+}
+
+func bound(v float64) *float64 { return &v }
+
+// defaultContract matches the values the cleaner produces and the ranges the
+// Features query can emit. MODEL_CONTRACT_PATH overrides it for a given model.
+var defaultContract = ModelContract{Columns: []ColumnContract{
+	{Name: "facility_category", Type: "string", Domain: []string{
+		"condiments", "school", "butcher", "supportive_living", "event", "gas_station",
+		"restaurant", "mobile", "grocery", "coffee", "bakery", "bar", "cooking_school",
+		"child_services", "church", "commissary", "pantry", "hotel", "warehouse", "facility", "unknown",
+	}},
+	{Name: "risk", Type: "string", Domain: []string{"high", "medium", "low", "all"}},
+	{Name: "zip", Type: "string", Pattern: `^\d{5}$`},
+	{Name: "inspection_count", Type: "integer", Min: bound(1)},
+	{Name: "past_violation_count", Type: "integer", Min: bound(0)},
+	{Name: "past_failure_count", Type: "integer", Min: bound(0)},
+	{Name: "days_since_last_inspection", Type: "integer", Min: bound(0)},
+	{Name: "rolling_inspection_count", Type: "integer", Min: bound(0)},
+	// NULL when the facility had no inspections inside the window
+	{Name: "rolling_failure_rate", Type: "float", Nullable: true, Min: bound(0), Max: bound(1)},
+	{Name: "last_result", Type: "string", Domain: []string{
+		"pass", "pass_w_conditions", "fail", "out of business", "no entry", "not ready", "business not located",
+	}},
+}}
+
+func loadContract() (ModelContract, error) {
+	path := os.Getenv("MODEL_CONTRACT_PATH")
+	if path == "" {
+		return defaultContract, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ModelContract{}, fmt.Errorf("read model contract: %w", err)
+	}
+	var c ModelContract
+	if err := json.Unmarshal(data, &c); err != nil {
+		return ModelContract{}, fmt.Errorf("parse model contract: %w", err)
+	}
+	if len(c.Columns) == 0 {
+		return ModelContract{}, fmt.Errorf("model contract %s has no columns", path)
+	}
+	for _, col := range c.Columns {
+		if _, ok := schemaTypes[col.Type]; !ok {
+			return ModelContract{}, fmt.Errorf("column %s: unknown type %q", col.Name, col.Type)
+		}
+		if col.Pattern != "" {
+			if _, err := regexp.Compile(col.Pattern); err != nil {
+				return ModelContract{}, fmt.Errorf("column %s: invalid pattern: %w", col.Name, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Names lists the contract's columns in the order they are sent to the model.
+func (c ModelContract) Names() []string {
+	names := make([]string, len(c.Columns))
+	for i, col := range c.Columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// Violation is one broken rule, with a few offending facilities as examples.
+type Violation struct {
+	Column   string   `json:"column"`
+	Rule     string   `json:"rule"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples,omitempty"`
+}
+
+type ContractReport struct {
+	Date       string      `json:"date"`
+	Rows       int         `json:"rows"`
+	Violations []Violation `json:"violations"`
+}
+
+func (r ContractReport) OK() bool { return len(r.Violations) == 0 }
+
+// Summary is a one-line description suitable for an error message.
+func (r ContractReport) Summary() string {
+	parts := make([]string, len(r.Violations))
+	for i, v := range r.Violations {
+		parts[i] = fmt.Sprintf("%s %s ×%d", v.Column, v.Rule, v.Count)
+	}
+	return fmt.Sprintf("model input contract failed (%d rows): %s", r.Rows, strings.Join(parts, "; "))
+}
+
+// ContractError fails the prediction stage with the full report attached.
+type ContractError struct {
+	Report ContractReport
+}
+
+func (e *ContractError) Error() string { return e.Report.Summary() }
+
+func (e *ContractError) ErrorCategory() errcategory.Category { return errcategory.DataFormat }
+
+var schemaTypes = map[string][]bigquery.FieldType{
+	"string":  {bigquery.StringFieldType},
+	"integer": {bigquery.IntegerFieldType},
+	"float":   {bigquery.FloatFieldType, bigquery.NumericFieldType, bigquery.IntegerFieldType},
+}
+
+// CheckSchema confirms every contract column exists in the Features table with a compatible type.
+func CheckSchema(ctx context.Context, bqClient *bigquery.Client, cfg Config, c ModelContract) ([]Violation, error) {
+	md, err := bqClient.Dataset(cfg.Dataset).Table(cfg.FeaturesTable).Metadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read features schema: %w", err)
+	}
+	fields := make(map[string]bigquery.FieldType)
+	for _, f := range md.Schema {
+		fields[f.Name] = f.Type
+	}
+
+	var violations []Violation
+	for _, col := range c.Columns {
+		got, ok := fields[col.Name]
+		if !ok {
+			violations = append(violations, Violation{Column: col.Name, Rule: "missing", Count: 1})
+			continue
+		}
+		compatible := false
+		for _, t := range schemaTypes[col.Type] {
+			if got == t {
+				compatible = true
+			}
+		}
+		if !compatible {
+			violations = append(violations, Violation{
+				Column: col.Name, Rule: fmt.Sprintf("type %s, expected %s", got, col.Type), Count: 1,
+			})
+		}
+	}
+	return violations, nil
+}
+
+// ValidateRows checks nulls, NaNs, ranges, domains and patterns for every row.
+func ValidateRows(c ModelContract, date string, rows []map[string]bigquery.Value) ContractReport {
+	const maxExamples = 5
+
+	type key struct{ column, rule string }
+	found := make(map[key]*Violation)
+	var order []key
+	flag := func(column, rule, facility string) {
+		k := key{column, rule}
+		v, ok := found[k]
+		if !ok {
+			v = &Violation{Column: column, Rule: rule}
+			found[k] = v
+			order = append(order, k)
+		}
+		v.Count++
+		if len(v.Examples) < maxExamples {
+			v.Examples = append(v.Examples, facility)
+		}
+	}
+
+	patterns := make(map[string]*regexp.Regexp)
+	domains := make(map[string]map[string]bool)
+	for _, col := range c.Columns {
+		if col.Pattern != "" {
+			patterns[col.Name] = regexp.MustCompile(col.Pattern)
+		}
+		if len(col.Domain) > 0 {
+			domains[col.Name] = make(map[string]bool)
+			for _, d := range col.Domain {
+				domains[col.Name][d] = true
+			}
+		}
+	}
+
+	for _, row := range rows {
+		facility, _ := row["facility_id"].(string)
+		for _, col := range c.Columns {
+			val := row[col.Name]
+			if val == nil {
+				if !col.Nullable {
+					flag(col.Name, "null", facility)
+				}
+				continue
+			}
+
+			switch col.Type {
+			case "string":
+				s, ok := val.(string)
+				if !ok {
+					flag(col.Name, "not a string", facility)
+					continue
+				}
+				if d := domains[col.Name]; d != nil && !d[s] {
+					flag(col.Name, fmt.Sprintf("outside domain (%q)", s), facility)
+				}
+				if p := patterns[col.Name]; p != nil && !p.MatchString(s) {
+					flag(col.Name, "pattern mismatch", facility)
+				}
+			case "integer", "float":
+				var f float64
+				switch n := val.(type) {
+				case int64:
+					f = float64(n)
+				case float64:
+					f = n
+				default:
+					flag(col.Name, "not numeric", facility)
+					continue
+				}
+				if math.IsNaN(f) || math.IsInf(f, 0) {
+					flag(col.Name, "NaN/Inf", facility)
+					continue
+				}
+				if col.Min != nil && f < *col.Min {
+					flag(col.Name, fmt.Sprintf("below min %g", *col.Min), facility)
+				}
+				if col.Max != nil && f > *col.Max {
+					flag(col.Name, fmt.Sprintf("above max %g", *col.Max), facility)
+				}
+			}
+		}
+	}
+
+	report := ContractReport{Date: date, Rows: len(rows), Violations: []Violation{}}
+	for _, k := range order {
+		report.Violations = append(report.Violations, *found[k])
+	}
+	return report
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/problem"
+	"configure/publish"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	numericBuckets = 10
+	otherBucket    = "__other__"
+	nullBucket     = "__null__"
+	// Keeps PSI finite when a bucket is empty on one side
+	psiEpsilon = 1e-4
+)
+
+type DriftConfig struct {
+	BaselineTable string
+	ScoresTable   string
+	// PSI above WarnPSI is logged, above AlertPSI raises a trigger alert
+	WarnPSI  float64
+	AlertPSI float64
+}
+
+func loadDriftConfig() DriftConfig {
+	parse := func(key string, fallback float64) float64 {
+		v, err := strconv.ParseFloat(getenv(key, ""), 64)
+		if err != nil || v <= 0 {
+			return fallback
+		}
+		return v
+	}
+	return DriftConfig{
+		BaselineTable: getenv("BQ_DRIFT_BASELINE_TABLE", "DriftBaseline"),
+		ScoresTable:   getenv("BQ_DRIFT_SCORES_TABLE", "DriftScores"),
+		WarnPSI:       parse("DRIFT_WARN_PSI", 0.1),
+		AlertPSI:      parse("DRIFT_ALERT_PSI", 0.25),
+	}
+}
+
+// BaselineBucket is one row of the DriftBaseline table. Numeric buckets cover
+// [lower, upper); categorical buckets match label exactly.
+type BaselineBucket struct {
+	Column       string   `json:"column_name"`
+	BucketIndex  int64    `json:"bucket_index"`
+	Label        string   `json:"label"`
+	Lower        *float64 `json:"lower"`
+	Upper        *float64 `json:"upper"`
+	Fraction     float64  `json:"fraction"`
+	BaselineDate string   `json:"baseline_date"`
+	CreatedAt    string   `json:"created_at"`
+}
+
+// DriftScore is one row of the DriftScores table.
+type DriftScore struct {
+	AsOfDate     string  `json:"as_of_date"`
+	RunID        string  `json:"run_id"`
+	Column       string  `json:"column_name"`
+	PSI          float64 `json:"psi"`
+	Status       string  `json:"status"` // ok | warn | alert
+	BaselineDate string  `json:"baseline_date"`
+	// JSON of {"label": [expected, actual]} for inspecting the shift
+	Histogram  string `json:"histogram"`
+	ComputedAt string `json:"computed_at"`
+}
+
+func numericValue(v bigquery.Value) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, !math.IsNaN(n)
+	}
+	return 0, false
+}
+
+// buildBaseline derives decile buckets for numeric columns and value buckets
+// for categorical ones from the training rows.
+func buildBaseline(c ModelContract, date string, rows []map[string]bigquery.Value) []BaselineBucket {
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	total := float64(len(rows))
+	var buckets []BaselineBucket
+
+	for _, col := range c.Columns {
+		add := func(label string, lower, upper *float64, count int) {
+			buckets = append(buckets, BaselineBucket{
+				Column:       col.Name,
+				BucketIndex:  int64(len(buckets)),
+				Label:        label,
+				Lower:        lower,
+				Upper:        upper,
+				Fraction:     float64(count) / total,
+				BaselineDate: date,
+				CreatedAt:    createdAt,
+			})
+		}
+
+		if col.Type == "string" {
+			counts := make(map[string]int)
+			for _, row := range rows {
+				s, ok := row[col.Name].(string)
+				if !ok {
+					s = nullBucket
+				}
+				counts[s]++
+			}
+			labels := make([]string, 0, len(counts))
+			for label := range counts {
+				labels = append(labels, label)
+			}
+			sort.Strings(labels)
+			for _, label := range labels {
+				add(label, nil, nil, counts[label])
+			}
+			// Catch-all for values never seen in training
+			add(otherBucket, nil, nil, 0)
+			continue
+		}
+
+		var values []float64
+		nulls := 0
+		for _, row := range rows {
+			if f, ok := numericValue(row[col.Name]); ok {
+				values = append(values, f)
+			} else {
+				nulls++
+			}
+		}
+		sort.Float64s(values)
+
+		// Decile edges, deduplicated so low-cardinality columns get fewer buckets
+		var edges []float64
+		for i := 1; i < numericBuckets && len(values) > 0; i++ {
+			edge := values[i*len(values)/numericBuckets]
+			if len(edges) == 0 || edge > edges[len(edges)-1] {
+				edges = append(edges, edge)
+			}
+		}
+		var lower *float64
+		for i := 0; i <= len(edges); i++ {
+			var upper *float64
+			if i < len(edges) {
+				upper = bound(edges[i])
+			}
+			count := 0
+			for _, v := range values {
+				if (lower == nil || v >= *lower) && (upper == nil || v < *upper) {
+					count++
+				}
+			}
+			add(fmt.Sprintf("bucket_%d", i), lower, upper, count)
+			lower = upper
+		}
+		add(nullBucket, nil, nil, nulls)
+	}
+	return buckets
+}
+
+// bucketFor returns the index within buckets that val falls into.
+func bucketFor(buckets []BaselineBucket, numeric bool, val bigquery.Value) int {
+	if numeric {
+		f, ok := numericValue(val)
+		for i, b := range buckets {
+			if !ok {
+				if b.Label == nullBucket {
+					return i
+				}
+				continue
+			}
+			if b.Label != nullBucket && (b.Lower == nil || f >= *b.Lower) && (b.Upper == nil || f < *b.Upper) {
+				return i
+			}
+		}
+		return len(buckets) - 1
+	}
+
+	s, ok := val.(string)
+	if !ok {
+		s = nullBucket
+	}
+	other := -1
+	for i, b := range buckets {
+		if b.Label == s {
+			return i
+		}
+		if b.Label == otherBucket {
+			other = i
+		}
+	}
+	return other
+}
+
+// psi is the population stability index of actual against expected.
+func psi(expected, actual []float64) float64 {
+	total := 0.0
+	for i := range expected {
+		e := math.Max(expected[i], psiEpsilon)
+		a := math.Max(actual[i], psiEpsilon)
+		total += (a - e) * math.Log(a/e)
+	}
+	return total
+}
+
+// ScoreDrift compares rows against the baseline column by column.
+func ScoreDrift(c ModelContract, dcfg DriftConfig, baseline []BaselineBucket, rows []map[string]bigquery.Value, req FeaturesRequest) []DriftScore {
+	byColumn := make(map[string][]BaselineBucket)
+	for _, b := range baseline {
+		byColumn[b.Column] = append(byColumn[b.Column], b)
+	}
+
+	computedAt := time.Now().UTC().Format(time.RFC3339)
+	var scores []DriftScore
+	for _, col := range c.Columns {
+		buckets := byColumn[col.Name]
+		if len(buckets) == 0 {
+			log.Printf("⚠️ No baseline for column %s — skipping", col.Name)
+			continue
+		}
+
+		counts := make([]float64, len(buckets))
+		for _, row := range rows {
+			if i := bucketFor(buckets, col.Type != "string", row[col.Name]); i >= 0 {
+				counts[i]++
+			}
+		}
+		expected := make([]float64, len(buckets))
+		histogram := make(map[string][2]float64, len(buckets))
+		for i, b := range buckets {
+			expected[i] = b.Fraction
+			counts[i] /= float64(len(rows))
+			histogram[b.Label] = [2]float64{b.Fraction, counts[i]}
+		}
+
+		score := psi(expected, counts)
+		status := "ok"
+		switch {
+		case score >= dcfg.AlertPSI:
+			status = "alert"
+		case score >= dcfg.WarnPSI:
+			status = "warn"
+		}
+		hist, _ := json.Marshal(histogram)
+		scores = append(scores, DriftScore{
+			AsOfDate:     req.Date,
+			RunID:        req.RunID,
+			Column:       col.Name,
+			PSI:          score,
+			Status:       status,
+			BaselineDate: buckets[0].BaselineDate,
+			Histogram:    string(hist),
+			ComputedAt:   computedAt,
+		})
+	}
+	return scores
+}
+
+func readBaseline(ctx context.Context, bqClient *bigquery.Client, cfg Config, dcfg DriftConfig) ([]BaselineBucket, error) {
+	q := bqClient.Query(fmt.Sprintf(
+		"SELECT column_name, bucket_index, label, lower, upper, fraction, CAST(baseline_date AS STRING) AS baseline_date FROM `%s.%s.%s` ORDER BY column_name, bucket_index",
+		cfg.Project, cfg.Dataset, dcfg.BaselineTable))
+	it, err := readQuery(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("query drift baseline: %w", err)
+	}
+	var buckets []BaselineBucket
+	for {
+		row := make(map[string]bigquery.Value)
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read drift baseline: %w", err)
+		}
+		b := BaselineBucket{}
+		b.Column, _ = row["column_name"].(string)
+		b.BucketIndex, _ = row["bucket_index"].(int64)
+		b.Label, _ = row["label"].(string)
+		b.Fraction, _ = row["fraction"].(float64)
+		b.BaselineDate, _ = row["baseline_date"].(string)
+		if f, ok := row["lower"].(float64); ok {
+			b.Lower = bound(f)
+		}
+		if f, ok := row["upper"].(float64); ok {
+			b.Upper = bound(f)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// SaveBaseline replaces the stored baseline with histograms of the Features
+// partition the model was trained on.
+func SaveBaseline(ctx context.Context, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, dcfg DriftConfig, date string) (int, error) {
+	rows, err := readFeatureRows(ctx, bqClient, cfg, pcfg.Contract.Names(), date)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("no features found for %s", date)
+	}
+	buckets := buildBaseline(pcfg.Contract, date, rows)
+
+	ddl := bqClient.Query(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS `+"`%s.%s.%s`"+` (
+  column_name STRING,
+  bucket_index INT64,
+  label STRING,
+  lower FLOAT64,
+  upper FLOAT64,
+  fraction FLOAT64,
+  baseline_date DATE,
+  created_at TIMESTAMP
+);
+`, cfg.Project, cfg.Dataset, dcfg.BaselineTable))
+	if err := runQuery(ctx, ddl); err != nil {
+		return 0, fmt.Errorf("prepare drift baseline table: %w", err)
+	}
+	if err := loadJSONRows(ctx, bqClient, cfg.Dataset, dcfg.BaselineTable, buckets, bigquery.WriteTruncate); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// MeasureDrift scores req.Date's features against the baseline and replaces
+// that date's rows in the DriftScores table.
+func MeasureDrift(ctx context.Context, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, dcfg DriftConfig, req FeaturesRequest) ([]DriftScore, error) {
+	baseline, err := readBaseline(ctx, bqClient, cfg, dcfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(baseline) == 0 {
+		return nil, errcategory.Errorf(errcategory.Configuration, "no drift baseline stored — POST /drift/baseline first")
+	}
+
+	rows, err := readFeatureRows(ctx, bqClient, cfg, pcfg.Contract.Names(), req.Date)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no features found for %s", req.Date)
+	}
+
+	scores := ScoreDrift(pcfg.Contract, dcfg, baseline, rows, req)
+
+	table := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, dcfg.ScoresTable)
+	ddl := bqClient.Query(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS `+"`%[1]s`"+` (
+  as_of_date DATE,
+  run_id STRING,
+  column_name STRING,
+  psi FLOAT64,
+  status STRING,
+  baseline_date DATE,
+  histogram STRING,
+  computed_at TIMESTAMP
+)
+PARTITION BY as_of_date;
+
+DELETE FROM `+"`%[1]s`"+` WHERE as_of_date = CAST(@as_of AS DATE);
+`, table))
+	ddl.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: req.Date}}
+	if err := runQuery(ctx, ddl); err != nil {
+		return nil, fmt.Errorf("prepare drift scores table: %w", err)
+	}
+	if err := loadJSONRows(ctx, bqClient, cfg.Dataset, dcfg.ScoresTable, scores, bigquery.WriteAppend); err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
+
+func runDrift(bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, dcfg DriftConfig, publisher publish.EventPublisher, req FeaturesRequest) {
+	startTime := time.Now()
+	log.Printf("📈 Measuring drift for %s (run %s)", req.Date, req.RunID)
+
+	ctx, u := withUsage(context.Background())
+	scores, err := MeasureDrift(ctx, bqClient, cfg, pcfg, dcfg, req)
+	if err != nil {
+		log.Println("❌ Drift measurement failed:", err)
+		notifyTrigger(publisher, u.addTo(map[string]any{
+			"event":          "drift_failed",
+			"run_id":         req.RunID,
+			"date":           req.Date,
+			"origin":         "drift",
+			"status":         "failed",
+			"error":          err.Error(),
+			"error_category": errcategory.Of(err),
+		}))
+		return
+	}
+
+	var drifted []string
+	for _, s := range scores {
+		switch s.Status {
+		case "alert":
+			drifted = append(drifted, fmt.Sprintf("%s (PSI %.3f)", s.Column, s.PSI))
+			log.Printf("🚨 Drift on %s: PSI %.3f", s.Column, s.PSI)
+		case "warn":
+			log.Printf("⚠️ Drift on %s: PSI %.3f", s.Column, s.PSI)
+		}
+	}
+
+	duration := time.Since(startTime).Seconds()
+	log.Printf("✅ drift_columns_scored: %d", len(scores))
+	log.Printf("⏱️ drift_duration_seconds: %.3f", duration)
+
+	event := map[string]any{
+		"event":    "drift_completed",
+		"run_id":   req.RunID,
+		"date":     req.Date,
+		"origin":   "drift",
+		"columns":  len(scores),
+		"drifted":  drifted,
+		"duration": eventschema.Seconds(duration),
+	}
+	if len(drifted) > 0 {
+		event["status"] = "alert"
+		event["message"] = fmt.Sprintf("data drift above PSI %.2f: %v", dcfg.AlertPSI, drifted)
+	}
+	notifyTrigger(publisher, u.addTo(event))
+}
+
+func handleDrift(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, dcfg DriftConfig, publisher publish.EventPublisher) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	var input FeaturesRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if _, err := time.Parse("2006-01-02", input.Date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Missing or invalid 'date' (YYYY-MM-DD)")
+		return
+	}
+
+	runSafely(publisher, "drift", input, func() {
+		runDrift(bqClient, cfg, pcfg, dcfg, publisher, input)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Drift measurement started"))
+}
+
+// handleDriftBaseline stores the training baseline synchronously so the caller
+// knows it is in place before the next run.
+func handleDriftBaseline(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, dcfg DriftConfig) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	var input struct {
+		Date string `json:"date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if _, err := time.Parse("2006-01-02", input.Date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Missing or invalid 'date' (YYYY-MM-DD) of the training features")
+		return
+	}
+
+	rows, err := SaveBaseline(r.Context(), bqClient, cfg, pcfg, dcfg, input.Date)
+	if err != nil {
+		log.Println("❌ Failed to store drift baseline:", err)
+		problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "Failed to store drift baseline: "+err.Error())
+		return
+	}
+	log.Printf("📐 Drift baseline stored from %s (%d rows)", input.Date, rows)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"baseline_date": input.Date, "rows": rows})
+}
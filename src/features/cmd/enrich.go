@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"configure/errcategory"
+	"configure/retry"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Enrichment adds location columns to a Features partition: the coordinates
+// the query kept from the inspections, filled in from a geocoder where there
+// were none, and the community area and ward containing them.
+
+type EnrichConfig struct {
+	// Census-style one-line address geocoder; empty turns geocoding off
+	GeocoderURL string
+	// Addresses geocoded per run at most, so a backlog is worked off over several runs
+	MaxGeocodes int
+	// Addresses the geocoder couldn't place are retried after this long
+	MissTTLDays     int
+	CacheTable      string
+	BoundariesTable string
+	// Boundaries are loaded from these GeoJSON sources when their table is empty
+	Boundaries []boundarySource
+}
+
+// boundarySource is a set of areas published as GeoJSON. The first property
+// present among IDKeys and NameKeys names each area.
+type boundarySource struct {
+	Kind     string
+	URL      string
+	IDKeys   []string
+	NameKeys []string
+}
+
+func loadEnrichConfig() EnrichConfig {
+	maxGeocodes, err := strconv.Atoi(getenv("GEOCODE_MAX_PER_RUN", "200"))
+	if err != nil || maxGeocodes < 0 {
+		log.Printf("⚠️ Invalid GEOCODE_MAX_PER_RUN, using 200")
+		maxGeocodes = 200
+	}
+	missTTL, err := strconv.Atoi(getenv("GEOCODE_MISS_TTL_DAYS", "30"))
+	if err != nil || missTTL <= 0 {
+		log.Printf("⚠️ Invalid GEOCODE_MISS_TTL_DAYS, using 30")
+		missTTL = 30
+	}
+	geocoder := getenv("GEOCODER_URL", "https://geocoding.geo.census.gov/geocoder/locations/onelineaddress")
+	if geocoder == "off" {
+		geocoder = ""
+	}
+	return EnrichConfig{
+		GeocoderURL:     geocoder,
+		MaxGeocodes:     maxGeocodes,
+		MissTTLDays:     missTTL,
+		CacheTable:      getenv("BQ_GEOCODE_CACHE_TABLE", "GeocodeCache"),
+		BoundariesTable: getenv("BQ_BOUNDARIES_TABLE", "Boundaries"),
+		Boundaries: []boundarySource{
+			{
+				Kind:     "community_area",
+				URL:      getenv("COMMUNITY_AREAS_URL", "https://data.cityofchicago.org/resource/igwz-8jzy.geojson"),
+				IDKeys:   []string{"area_numbe", "area_num_1"},
+				NameKeys: []string{"community"},
+			},
+			{
+				Kind:     "ward",
+				URL:      getenv("WARDS_URL", "https://data.cityofchicago.org/resource/p293-wvbd.geojson"),
+				IDKeys:   []string{"ward", "ward_id"},
+				NameKeys: []string{"ward"},
+			},
+		},
+	}
+}
+
+// Chicago's bounding box; coordinates outside it are treated as missing.
+const (
+	minLatitude  = 41.6
+	maxLatitude  = 42.1
+	minLongitude = -88.0
+	maxLongitude = -87.5
+)
+
+func inChicago(lat, lon float64) bool {
+	return lat >= minLatitude && lat <= maxLatitude && lon >= minLongitude && lon <= maxLongitude
+}
+
+// EnrichStats counts the facilities of a partition by how they were located.
+type EnrichStats struct {
+	FromSource     int64 `json:"geo_from_source"`
+	Geocoded       int64 `json:"geo_geocoded"`
+	Unlocated      int64 `json:"geo_unlocated"`
+	CommunityAreas int64 `json:"geo_community_area_matched"`
+	Wards          int64 `json:"geo_ward_matched"`
+	GeocoderCalls  int   `json:"geocoder_calls"`
+}
+
+// GeocodeRow is one line of the geocode cache. Misses are cached too, with
+// NULL coordinates, so an address the geocoder can't place isn't asked for
+// again until MissTTLDays have passed.
+type GeocodeRow struct {
+	AddressKey     string   `json:"address_key"`
+	Address        string   `json:"address"`
+	Zip            string   `json:"zip"`
+	Latitude       *float64 `json:"latitude"`
+	Longitude      *float64 `json:"longitude"`
+	MatchedAddress string   `json:"matched_address"`
+	GeocodedAt     string   `json:"geocoded_at"`
+}
+
+// BoundaryRow is one area of the boundaries table, its geometry kept as GeoJSON.
+type BoundaryRow struct {
+	Kind     string `json:"kind"`
+	AreaID   string `json:"area_id"`
+	Name     string `json:"name"`
+	Geometry string `json:"geometry"`
+	LoadedAt string `json:"loaded_at"`
+}
+
+// EnrichFeatures locates the facilities of req.Date's Features partition. A
+// geocoder or boundary source that can't be reached leaves columns NULL
+// rather than failing the stage; BigQuery errors are returned.
+func EnrichFeatures(ctx context.Context, bqClient *bigquery.Client, cfg Config, ecfg EnrichConfig, req FeaturesRequest) (EnrichStats, error) {
+	var stats EnrichStats
+	features := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, cfg.FeaturesTable)
+	cache := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, ecfg.CacheTable)
+	boundaries := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, ecfg.BoundariesTable)
+
+	ddl := bqClient.Query(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS `+"`%s`"+` (
+  address_key STRING,
+  address STRING,
+  zip STRING,
+  latitude FLOAT64,
+  longitude FLOAT64,
+  matched_address STRING,
+  geocoded_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS `+"`%s`"+` (
+  kind STRING,
+  area_id STRING,
+  name STRING,
+  geometry STRING,
+  loaded_at TIMESTAMP
+);
+`, cache, boundaries))
+	if err := runQuery(ctx, ddl); err != nil {
+		return stats, fmt.Errorf("prepare enrichment tables: %w", err)
+	}
+	if err := ensureBoundaries(ctx, bqClient, cfg, ecfg, boundaries); err != nil {
+		return stats, err
+	}
+
+	if ecfg.GeocoderURL != "" && ecfg.MaxGeocodes > 0 {
+		calls, err := geocodeMissing(ctx, bqClient, cfg, ecfg, features, cache, req.Date)
+		stats.GeocoderCalls = calls
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	q := bqClient.Query(fmt.Sprintf(`
+DECLARE as_of DATE DEFAULT CAST(@as_of AS DATE);
+
+UPDATE `+"`%[1]s`"+` f
+SET latitude = c.latitude, longitude = c.longitude, geo_source = 'geocoded'
+FROM (
+  -- An update may match one cache row per facility, so take the latest hit
+  SELECT address_key, ARRAY_AGG(STRUCT(latitude, longitude) ORDER BY geocoded_at DESC LIMIT 1)[OFFSET(0)].*
+  FROM `+"`%[2]s`"+`
+  WHERE latitude IS NOT NULL
+  GROUP BY address_key
+) c
+WHERE f.as_of_date = as_of AND f.latitude IS NULL
+  AND c.address_key = CONCAT(f.address, '|', f.zip);
+
+UPDATE `+"`%[1]s`"+` f
+SET community_area = a.area_id, community_area_name = a.name, ward = a.ward
+FROM (
+  SELECT
+    p.facility_id,
+    ARRAY_AGG(IF(b.kind = 'community_area', b.area_id, NULL) IGNORE NULLS LIMIT 1)[SAFE_OFFSET(0)] AS area_id,
+    ARRAY_AGG(IF(b.kind = 'community_area', b.name, NULL) IGNORE NULLS LIMIT 1)[SAFE_OFFSET(0)] AS name,
+    ARRAY_AGG(IF(b.kind = 'ward', b.area_id, NULL) IGNORE NULLS LIMIT 1)[SAFE_OFFSET(0)] AS ward
+  FROM `+"`%[1]s`"+` p
+  JOIN `+"`%[3]s`"+` b
+    ON ST_CONTAINS(ST_GEOGFROMGEOJSON(b.geometry, make_valid => TRUE), ST_GEOGPOINT(p.longitude, p.latitude))
+  WHERE p.as_of_date = as_of AND p.latitude IS NOT NULL
+  GROUP BY p.facility_id
+) a
+WHERE f.as_of_date = as_of AND f.facility_id = a.facility_id;
+`, features, cache, boundaries))
+	q.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: req.Date}}
+	if err := runQuery(ctx, q); err != nil {
+		return stats, fmt.Errorf("enrich features: %w", err)
+	}
+
+	count := bqClient.Query(fmt.Sprintf(`
+SELECT
+  COUNTIF(geo_source = 'source'),
+  COUNTIF(geo_source = 'geocoded'),
+  COUNTIF(latitude IS NULL),
+  COUNTIF(community_area IS NOT NULL),
+  COUNTIF(ward IS NOT NULL)
+FROM `+"`%s`"+` WHERE as_of_date = CAST(@as_of AS DATE)`, features))
+	count.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: req.Date}}
+	it, err := readQuery(ctx, count)
+	if err != nil {
+		return stats, fmt.Errorf("count enriched features: %w", err)
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return stats, fmt.Errorf("count enriched features: %w", err)
+	}
+	if len(row) == 5 {
+		stats.FromSource, _ = row[0].(int64)
+		stats.Geocoded, _ = row[1].(int64)
+		stats.Unlocated, _ = row[2].(int64)
+		stats.CommunityAreas, _ = row[3].(int64)
+		stats.Wards, _ = row[4].(int64)
+	}
+	return stats, nil
+}
+
+// ensureBoundaries loads each boundary source whose kind has no rows yet.
+func ensureBoundaries(ctx context.Context, bqClient *bigquery.Client, cfg Config, ecfg EnrichConfig, table string) error {
+	it, err := readQuery(ctx, bqClient.Query(fmt.Sprintf("SELECT kind, COUNT(*) FROM `%s` GROUP BY kind", table)))
+	if err != nil {
+		return fmt.Errorf("read boundaries: %w", err)
+	}
+	loaded := map[string]bool{}
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read boundaries: %w", err)
+		}
+		kind, _ := row[0].(string)
+		loaded[kind] = true
+	}
+
+	for _, src := range ecfg.Boundaries {
+		if loaded[src.Kind] || src.URL == "" {
+			continue
+		}
+		rows, err := fetchBoundaries(ctx, src)
+		if err != nil {
+			log.Printf("⚠️ Could not load %s boundaries, leaving them unmatched: %v", src.Kind, err)
+			continue
+		}
+		if err := loadJSONRows(ctx, bqClient, cfg.Dataset, ecfg.BoundariesTable, rows, bigquery.WriteAppend); err != nil {
+			return fmt.Errorf("load %s boundaries: %w", src.Kind, err)
+		}
+		log.Printf("🗺️ Loaded %d %s boundaries from %s", len(rows), src.Kind, src.URL)
+	}
+	return nil
+}
+
+var sourceRetry = retry.Policy{Attempts: 3, Initial: time.Second, Max: 10 * time.Second, Jitter: 0.5, RetryIf: retry.Transient}
+
+var geoClient = &http.Client{Timeout: 30 * time.Second}
+
+// getJSON fetches rawURL into v with the given extra headers, retrying transient failures.
+func getJSON(ctx context.Context, rawURL string, header http.Header, v any) error {
+	return sourceRetry.Do(ctx, func(ctx context.Context, attempt int) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		recordAPICall(ctx)
+		resp, err := geoClient.Do(req)
+		if err != nil {
+			return errcategory.Wrap(errcategory.TransientNetwork, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			io.Copy(io.Discard, resp.Body)
+			return errcategory.Errorf(errcategory.FromStatus(resp.StatusCode), "GET %s: status %d", rawURL, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return retry.Permanent(errcategory.Wrap(errcategory.DataFormat, fmt.Errorf("decode %s: %w", rawURL, err)))
+		}
+		return nil
+	})
+}
+
+func fetchBoundaries(ctx context.Context, src boundarySource) ([]BoundaryRow, error) {
+	var collection struct {
+		Features []struct {
+			Properties map[string]any  `json:"properties"`
+			Geometry   json.RawMessage `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := getJSON(ctx, src.URL, nil, &collection); err != nil {
+		return nil, err
+	}
+	property := func(props map[string]any, keys []string) string {
+		for _, k := range keys {
+			if v, ok := props[k]; ok && v != nil {
+				return strings.TrimSpace(fmt.Sprint(v))
+			}
+		}
+		return ""
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var rows []BoundaryRow
+	for _, f := range collection.Features {
+		id := property(f.Properties, src.IDKeys)
+		if id == "" || len(f.Geometry) == 0 || string(f.Geometry) == "null" {
+			continue
+		}
+		rows = append(rows, BoundaryRow{
+			Kind:     src.Kind,
+			AreaID:   id,
+			Name:     strings.ToLower(property(f.Properties, src.NameKeys)),
+			Geometry: string(f.Geometry),
+			LoadedAt: now,
+		})
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s has no features with %s", src.URL, strings.Join(src.IDKeys, " or "))
+	}
+	return rows, nil
+}
+
+// geocodeMissing geocodes up to MaxGeocodes addresses of unlocated facilities
+// that the cache can't answer, appends the results to the cache and returns
+// the number of geocoder calls made.
+func geocodeMissing(ctx context.Context, bqClient *bigquery.Client, cfg Config, ecfg EnrichConfig, features, cache, date string) (int, error) {
+	q := bqClient.Query(fmt.Sprintf(`
+SELECT DISTINCT address, zip
+FROM `+"`%[1]s`"+` f
+WHERE f.as_of_date = CAST(@as_of AS DATE) AND f.latitude IS NULL AND f.address IS NOT NULL
+  AND NOT EXISTS (
+    SELECT 1 FROM `+"`%[2]s`"+` c
+    WHERE c.address_key = CONCAT(f.address, '|', f.zip)
+      AND (c.latitude IS NOT NULL OR c.geocoded_at > TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL @miss_ttl DAY))
+  )
+LIMIT @max_geocodes`, features, cache))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "as_of", Value: date},
+		{Name: "miss_ttl", Value: ecfg.MissTTLDays},
+		{Name: "max_geocodes", Value: ecfg.MaxGeocodes},
+	}
+	it, err := readQuery(ctx, q)
+	if err != nil {
+		return 0, fmt.Errorf("find unlocated facilities: %w", err)
+	}
+
+	var rows []GeocodeRow
+	calls, misses := 0, 0
+	for {
+		var r struct {
+			Address string `bigquery:"address"`
+			Zip     string `bigquery:"zip"`
+		}
+		err := it.Next(&r)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return calls, fmt.Errorf("find unlocated facilities: %w", err)
+		}
+
+		calls++
+		row := GeocodeRow{
+			AddressKey: r.Address + "|" + r.Zip,
+			Address:    r.Address,
+			Zip:        r.Zip,
+			GeocodedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		lat, lon, matched, err := geocode(ctx, ecfg.GeocoderURL, r.Address, r.Zip)
+		if err != nil {
+			// Not cached, so the address is tried again next run
+			log.Printf("⚠️ Geocoding %q failed: %v", r.Address, err)
+			continue
+		}
+		if matched != "" && inChicago(lat, lon) {
+			row.Latitude, row.Longitude, row.MatchedAddress = &lat, &lon, matched
+		} else {
+			misses++
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return calls, nil
+	}
+	if err := loadJSONRows(ctx, bqClient, cfg.Dataset, ecfg.CacheTable, rows, bigquery.WriteAppend); err != nil {
+		return calls, fmt.Errorf("save geocode cache: %w", err)
+	}
+	log.Printf("📍 Geocoded %d addresses (%d not found)", len(rows)-misses, misses)
+	return calls, nil
+}
+
+// geocode looks up one Chicago address with a Census-style geocoder. An
+// address it can't match comes back with an empty matched address.
+func geocode(ctx context.Context, geocoderURL, address, zip string) (lat, lon float64, matched string, err error) {
+	params := url.Values{}
+	params.Set("address", fmt.Sprintf("%s, chicago, il %s", address, zip))
+	params.Set("benchmark", "Public_AR_Current")
+	params.Set("format", "json")
+	var resp struct {
+		Result struct {
+			AddressMatches []struct {
+				MatchedAddress string `json:"matchedAddress"`
+				Coordinates    struct {
+					X float64 `json:"x"`
+					Y float64 `json:"y"`
+				} `json:"coordinates"`
+			} `json:"addressMatches"`
+		} `json:"result"`
+	}
+	if err := getJSON(ctx, geocoderURL+"?"+params.Encode(), nil, &resp); err != nil {
+		return 0, 0, "", err
+	}
+	if len(resp.Result.AddressMatches) == 0 {
+		return 0, 0, "", nil
+	}
+	m := resp.Result.AddressMatches[0]
+	return m.Coordinates.Y, m.Coordinates.X, m.MatchedAddress, nil
+}
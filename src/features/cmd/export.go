@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/openlineage"
+	"configure/problem"
+	"configure/publish"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// ExportConfig is where the CSV export for stakeholders goes. The export is
+// off until EXPORT_BUCKET is set.
+type ExportConfig struct {
+	Bucket string
+	// Files go under {Prefix}/{date}/ in Bucket
+	Prefix string
+	// Inspections from the WindowDays up to and including the run date are exported
+	WindowDays int
+	// Optional Slack/Chat-compatible webhook (or a mail relay) told where the files are
+	WebhookURL string
+}
+
+func loadExportConfig() ExportConfig {
+	window, err := strconv.Atoi(getenv("EXPORT_WINDOW_DAYS", "7"))
+	if err != nil || window <= 0 {
+		log.Printf("⚠️ Invalid EXPORT_WINDOW_DAYS, using 7")
+		window = 7
+	}
+	return ExportConfig{
+		Bucket:     getenv("EXPORT_BUCKET", ""),
+		Prefix:     getenv("EXPORT_PREFIX", "exports"),
+		WindowDays: window,
+		WebhookURL: getenv("EXPORT_WEBHOOK_URL", ""),
+	}
+}
+
+func (x ExportConfig) folder(date string) string {
+	return x.Prefix + "/" + date + "/"
+}
+
+// Link is where a person with access to the bucket can browse the date's files.
+func (x ExportConfig) Link(date string) string {
+	return "https://console.cloud.google.com/storage/browser/" + x.Bucket + "/" + x.folder(date)
+}
+
+// ExportStats is what one export wrote.
+type ExportStats struct {
+	Inspections int64  `json:"inspections"`
+	Predictions int64  `json:"predictions"`
+	Files       int64  `json:"files"`
+	Folder      string `json:"folder"`
+	Link        string `json:"link"`
+}
+
+// exportInspectionsSQL writes the window's cleaned inspections to a CSV URI
+// pattern (the first verb) from the source table (the second). The violation
+// code array has no CSV form; violation_count and the text stand in.
+const exportInspectionsSQL = `
+EXPORT DATA OPTIONS (uri = '%s', format = 'CSV', header = true, overwrite = true) AS
+SELECT
+  inspection_id,
+  PARSE_DATE('%%Y-%%m-%%d', SUBSTR(CAST(inspection_date AS STRING), 1, 10)) AS inspection_date,
+  dba_name,
+  facility_type,
+  facility_category,
+  risk,
+  address,
+  city,
+  state,
+  CAST(zip AS STRING) AS zip,
+  inspection_type,
+  results,
+  violation_count,
+  violations,
+  latitude,
+  longitude
+FROM ` + "`%s`" + `
+WHERE PARSE_DATE('%%Y-%%m-%%d', SUBSTR(CAST(inspection_date AS STRING), 1, 10))
+  BETWEEN DATE_SUB(CAST(@as_of AS DATE), INTERVAL @window_days - 1 DAY) AND CAST(@as_of AS DATE)
+ORDER BY inspection_date DESC, inspection_id;
+`
+
+// exportPredictionsSQL writes the date's predictions to a CSV URI pattern,
+// with the facility's name and address from the Features table beside its id.
+const exportPredictionsSQL = `
+EXPORT DATA OPTIONS (uri = '%s', format = 'CSV', header = true, overwrite = true) AS
+SELECT
+  p.as_of_date,
+  p.facility_id,
+  f.dba_name,
+  f.address,
+  f.zip,
+  f.facility_category,
+  f.risk,
+  p.score,
+  p.model_version,
+  p.run_id
+FROM ` + "`%s`" + ` p
+LEFT JOIN ` + "`%s`" + ` f
+  ON f.facility_id = p.facility_id AND f.as_of_date = p.as_of_date
+WHERE p.as_of_date = CAST(@as_of AS DATE)
+ORDER BY p.score DESC, p.facility_id;
+`
+
+// exportQuery runs one EXPORT DATA statement and returns the rows and files
+// it wrote. BigQuery splits a large result over several files, which is why
+// the URI has a wildcard.
+func exportQuery(ctx context.Context, bqClient *bigquery.Client, sql string, params ...bigquery.QueryParameter) (rows, files int64, err error) {
+	q := bqClient.Query(sql)
+	q.Parameters = params
+	job, err := q.Run(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	recordJob(ctx, status)
+	if err := status.Err(); err != nil {
+		return 0, 0, err
+	}
+	if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && qs.ExportDataStatistics != nil {
+		return qs.ExportDataStatistics.RowCount, qs.ExportDataStatistics.FileCount, nil
+	}
+	return 0, 0, nil
+}
+
+// tableExists reports whether dataset.table exists, so an export can leave
+// out what a disabled stage never created.
+func tableExists(ctx context.Context, bqClient *bigquery.Client, dataset, table string) (bool, error) {
+	_, err := bqClient.Dataset(dataset).Table(table).Metadata(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Export writes req.Date's CSVs to the export bucket: inspections-*.csv with
+// the cleaned inspections of the window ending that day and, when the
+// prediction stage has run, predictions-*.csv with that day's scores.
+func Export(ctx context.Context, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, xcfg ExportConfig, req FeaturesRequest) (ExportStats, error) {
+	if xcfg.Bucket == "" {
+		return ExportStats{}, errcategory.Errorf(errcategory.Configuration, "EXPORT_BUCKET not set")
+	}
+	stats := ExportStats{Folder: "gs://" + xcfg.Bucket + "/" + xcfg.folder(req.Date), Link: xcfg.Link(req.Date)}
+	asOf := bigquery.QueryParameter{Name: "as_of", Value: req.Date}
+
+	source := cfg.source()
+	rows, files, err := exportQuery(ctx, bqClient, fmt.Sprintf(exportInspectionsSQL, stats.Folder+"inspections-*.csv", source),
+		asOf, bigquery.QueryParameter{Name: "window_days", Value: xcfg.WindowDays})
+	if err != nil {
+		return stats, fmt.Errorf("export inspections: %w", err)
+	}
+	stats.Inspections, stats.Files = rows, files
+
+	exists, err := tableExists(ctx, bqClient, cfg.Dataset, pcfg.PredictionsTable)
+	if err != nil {
+		return stats, fmt.Errorf("look up predictions table: %w", err)
+	}
+	if !exists {
+		log.Printf("⏭️ No %s table — exporting inspections only", pcfg.PredictionsTable)
+		return stats, nil
+	}
+	predictions := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, pcfg.PredictionsTable)
+	features := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, cfg.FeaturesTable)
+	rows, files, err = exportQuery(ctx, bqClient, fmt.Sprintf(exportPredictionsSQL, stats.Folder+"predictions-*.csv", predictions, features), asOf)
+	if err != nil {
+		return stats, fmt.Errorf("export predictions: %w", err)
+	}
+	stats.Predictions = rows
+	stats.Files += files
+	return stats, nil
+}
+
+// announceExport posts the export's link to EXPORT_WEBHOOK_URL. A failed post
+// is only logged; the files are written either way.
+func announceExport(ctx context.Context, webhookURL, date string, stats ExportStats) {
+	if webhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"text":   fmt.Sprintf("📤 Inspection export for %s: %d inspections, %d predictions — %s", date, stats.Inspections, stats.Predictions, stats.Link),
+		"date":   date,
+		"export": stats,
+	})
+	if err != nil {
+		log.Printf("❌ Failed to marshal export notice: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("❌ Failed to build export notice: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("❌ Failed to deliver export notice: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("⚠️ Export webhook returned %s", resp.Status)
+	}
+}
+
+func runExport(bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, xcfg ExportConfig, publisher publish.EventPublisher, req FeaturesRequest) {
+	startTime := time.Now()
+	cfg = cfg.forLoader(req.Loader)
+	log.Printf("📤 Exporting CSVs for %s (run %s)", req.Date, req.RunID)
+
+	ctx, u := withUsage(context.Background())
+	lineage := openlineage.Run{
+		Job:     "export",
+		RunID:   req.RunID,
+		Date:    req.Date,
+		Inputs:  []openlineage.Dataset{openlineage.BigQuery(cfg.source()), bqTable(cfg, pcfg.PredictionsTable), bqTable(cfg, cfg.FeaturesTable)},
+		Outputs: []openlineage.Dataset{openlineage.GCS(xcfg.Bucket, xcfg.folder(req.Date))},
+	}
+	openlineage.Emit(ctx, openlineage.Start, lineage, nil)
+	stats, err := Export(ctx, bqClient, cfg, pcfg, xcfg, req)
+	if err != nil {
+		log.Println("❌ Export failed:", err)
+		openlineage.Emit(ctx, openlineage.Fail, lineage, err)
+		notifyTrigger(publisher, u.addTo(map[string]any{
+			"event":          "export_failed",
+			"run_id":         req.RunID,
+			"date":           req.Date,
+			"origin":         "export",
+			"status":         "failed",
+			"error":          err.Error(),
+			"error_category": errcategory.Of(err),
+		}))
+		return
+	}
+
+	duration := time.Since(startTime).Seconds()
+	log.Printf("✅ rows_exported: %d inspections, %d predictions in %d file(s) under %s", stats.Inspections, stats.Predictions, stats.Files, stats.Folder)
+	log.Printf("⏱️ export_duration_seconds: %.3f", duration)
+	openlineage.Emit(ctx, openlineage.Complete, lineage, nil)
+	announceExport(ctx, xcfg.WebhookURL, req.Date, stats)
+
+	notifyTrigger(publisher, u.addTo(map[string]any{
+		"event":    "export_completed",
+		"run_id":   req.RunID,
+		"date":     req.Date,
+		"origin":   "export",
+		"rows":     stats.Inspections + stats.Predictions,
+		"duration": eventschema.Seconds(duration),
+		"export":   stats,
+	}))
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, xcfg ExportConfig, publisher publish.EventPublisher) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	var input FeaturesRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if _, err := time.Parse("2006-01-02", input.Date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Missing or invalid 'date' (YYYY-MM-DD)")
+		return
+	}
+	if xcfg.Bucket == "" {
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.NotConfigured, "EXPORT_BUCKET not configured")
+		return
+	}
+
+	runSafely(publisher, "export", input, func() {
+		runExport(bqClient, cfg, pcfg, xcfg, publisher, input)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Export started"))
+}
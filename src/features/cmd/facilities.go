@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Facilities are resolved from the name, address and zip variants found in
+// the inspections. Each variant is stored once in the variants table with the
+// facility_id it was assigned, so IDs never change once given out. A new
+// variant joins an existing facility at the same zip and house number whose
+// normalized name and address are close enough; otherwise it starts a new
+// facility whose ID is the hash the Features query used to key facilities on.
+
+type FacilityConfig struct {
+	Table         string
+	VariantsTable string
+	// Minimum similarity (0-1) of normalized names, and of addresses, to match
+	NameThreshold    float64
+	AddressThreshold float64
+}
+
+func loadFacilityConfig() FacilityConfig {
+	threshold := func(key string, fallback float64) float64 {
+		v, err := strconv.ParseFloat(getenv(key, ""), 64)
+		if err != nil || v <= 0 || v > 1 {
+			return fallback
+		}
+		return v
+	}
+	return FacilityConfig{
+		Table:            getenv("BQ_FACILITIES_TABLE", "Facilities"),
+		VariantsTable:    getenv("BQ_FACILITY_VARIANTS_TABLE", "FacilityVariants"),
+		NameThreshold:    threshold("FACILITY_NAME_THRESHOLD", 0.85),
+		AddressThreshold: threshold("FACILITY_ADDRESS_THRESHOLD", 0.8),
+	}
+}
+
+// variantKeySQL is the key of an inspection's name/address/zip variant, and
+// the facility_id a new facility is given.
+const variantKeySQL = "TO_HEX(SHA256(CONCAT(%[1]sdba_name, '|', %[1]saddress, '|', CAST(%[1]szip AS STRING))))"
+
+func variantKey(alias string) string {
+	return fmt.Sprintf(variantKeySQL, alias)
+}
+
+// FacilityVariant is one line of the variants table.
+type FacilityVariant struct {
+	VariantKey  string `json:"variant_key"`
+	FacilityID  string `json:"facility_id"`
+	DBAName     string `json:"dba_name"`
+	Address     string `json:"address"`
+	Zip         string `json:"zip"`
+	NormName    string `json:"norm_name"`
+	NormAddress string `json:"norm_address"`
+	// Similarity of the names it was matched on; 1 for the variant that started the facility
+	MatchScore float64 `json:"match_score"`
+	ResolvedAt string  `json:"resolved_at"`
+}
+
+// FacilityStats sums up one run of ResolveFacilities.
+type FacilityStats struct {
+	NewVariants   int `json:"new_variants"`
+	Matched       int `json:"matched_to_existing"`
+	NewFacilities int `json:"new_facilities"`
+}
+
+// ResolveFacilities assigns facility IDs to variants not seen before and
+// rebuilds the Facilities dimension table.
+func ResolveFacilities(ctx context.Context, bqClient *bigquery.Client, cfg Config, fcfg FacilityConfig) (FacilityStats, error) {
+	var stats FacilityStats
+	source := cfg.source()
+	variants := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, fcfg.VariantsTable)
+	facilities := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, fcfg.Table)
+
+	ddl := bqClient.Query(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS `+"`%s`"+` (
+  variant_key STRING,
+  facility_id STRING,
+  dba_name STRING,
+  address STRING,
+  zip STRING,
+  norm_name STRING,
+  norm_address STRING,
+  match_score FLOAT64,
+  resolved_at TIMESTAMP
+);
+`, variants))
+	if err := runQuery(ctx, ddl); err != nil {
+		return stats, fmt.Errorf("prepare facility variants table: %w", err)
+	}
+
+	// Known variants, blocked by zip and house number
+	blocks := map[string][]FacilityVariant{}
+	it, err := readQuery(ctx, bqClient.Query(fmt.Sprintf("SELECT facility_id, norm_name, norm_address, zip FROM `%s`", variants)))
+	if err != nil {
+		return stats, fmt.Errorf("read facility variants: %w", err)
+	}
+	for {
+		var v struct {
+			FacilityID  string `bigquery:"facility_id"`
+			NormName    string `bigquery:"norm_name"`
+			NormAddress string `bigquery:"norm_address"`
+			Zip         string `bigquery:"zip"`
+		}
+		err := it.Next(&v)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("read facility variants: %w", err)
+		}
+		key := blockKey(v.NormAddress, v.Zip)
+		blocks[key] = append(blocks[key], FacilityVariant{FacilityID: v.FacilityID, NormName: v.NormName, NormAddress: v.NormAddress})
+	}
+
+	q := bqClient.Query(fmt.Sprintf(`
+SELECT DISTINCT `+variantKey("s.")+` AS variant_key, s.dba_name, s.address, CAST(s.zip AS STRING) AS zip
+FROM `+"`%s`"+` s
+WHERE s.dba_name IS NOT NULL AND s.address IS NOT NULL AND s.zip IS NOT NULL
+  AND `+variantKey("s.")+` NOT IN (SELECT variant_key FROM `+"`%s`"+`)
+ORDER BY variant_key`, source, variants))
+	it, err = readQuery(ctx, q)
+	if err != nil {
+		return stats, fmt.Errorf("find new facility variants: %w", err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var resolved []FacilityVariant
+	for {
+		var v struct {
+			VariantKey string `bigquery:"variant_key"`
+			DBAName    string `bigquery:"dba_name"`
+			Address    string `bigquery:"address"`
+			Zip        string `bigquery:"zip"`
+		}
+		err := it.Next(&v)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("find new facility variants: %w", err)
+		}
+
+		variant := FacilityVariant{
+			VariantKey:  v.VariantKey,
+			DBAName:     v.DBAName,
+			Address:     v.Address,
+			Zip:         v.Zip,
+			NormName:    normalizeFacilityName(v.DBAName),
+			NormAddress: normalizeAddress(v.Address),
+			ResolvedAt:  now,
+		}
+		key := blockKey(variant.NormAddress, variant.Zip)
+		if match, score := bestMatch(variant, blocks[key], fcfg); match != "" {
+			variant.FacilityID, variant.MatchScore = match, score
+			stats.Matched++
+		} else {
+			variant.FacilityID, variant.MatchScore = variant.VariantKey, 1
+			stats.NewFacilities++
+		}
+		// Later variants of this batch can match it too
+		blocks[key] = append(blocks[key], variant)
+		resolved = append(resolved, variant)
+	}
+	stats.NewVariants = len(resolved)
+
+	if len(resolved) > 0 {
+		if err := loadJSONRows(ctx, bqClient, cfg.Dataset, fcfg.VariantsTable, resolved, bigquery.WriteAppend); err != nil {
+			return stats, fmt.Errorf("save facility variants: %w", err)
+		}
+	}
+
+	dim := bqClient.Query(fmt.Sprintf(`
+CREATE OR REPLACE TABLE `+"`%[1]s`"+` AS
+WITH inspections AS (
+  SELECT
+    v.facility_id,
+    s.dba_name,
+    s.address,
+    CAST(s.zip AS STRING) AS zip,
+    PARSE_DATE('%%Y-%%m-%%d', SUBSTR(CAST(s.inspection_date AS STRING), 1, 10)) AS inspection_date
+  FROM `+"`%[2]s`"+` s
+  JOIN `+"`%[3]s`"+` v ON v.variant_key = `+variantKey("s.")+`
+)
+SELECT
+  facility_id,
+  -- The variant used most recently names the facility
+  ARRAY_AGG(dba_name ORDER BY inspection_date DESC LIMIT 1)[OFFSET(0)] AS dba_name,
+  ARRAY_AGG(address ORDER BY inspection_date DESC LIMIT 1)[OFFSET(0)] AS address,
+  ARRAY_AGG(zip ORDER BY inspection_date DESC LIMIT 1)[OFFSET(0)] AS zip,
+  COUNT(DISTINCT CONCAT(dba_name, '|', address, '|', zip)) AS variant_count,
+  COUNT(*) AS inspection_count,
+  MIN(inspection_date) AS first_inspection_date,
+  MAX(inspection_date) AS last_inspection_date,
+  CURRENT_TIMESTAMP() AS updated_at
+FROM inspections
+GROUP BY facility_id;
+`, facilities, source, variants))
+	if err := runQuery(ctx, dim); err != nil {
+		return stats, fmt.Errorf("rebuild facilities table: %w", err)
+	}
+	return stats, nil
+}
+
+// bestMatch returns the facility in candidates whose variant is most similar
+// to v, if both name and address clear their thresholds.
+func bestMatch(v FacilityVariant, candidates []FacilityVariant, fcfg FacilityConfig) (string, float64) {
+	best, bestScore := "", 0.0
+	for _, c := range candidates {
+		if similarity(v.NormAddress, c.NormAddress) < fcfg.AddressThreshold {
+			continue
+		}
+		score := similarity(v.NormName, c.NormName)
+		if score >= fcfg.NameThreshold && score > bestScore {
+			best, bestScore = c.FacilityID, score
+		}
+	}
+	return best, bestScore
+}
+
+// blockKey groups variants that may be the same facility: same zip and
+// house number.
+func blockKey(normAddress, zip string) string {
+	number, _, _ := strings.Cut(normAddress, " ")
+	return zip + "|" + number
+}
+
+// Words in names that don't tell facilities apart.
+var nameNoise = map[string]bool{
+	"the": true, "inc": true, "llc": true, "ltd": true, "co": true, "corp": true, "corporation": true, "company": true,
+}
+
+// Street words written out or abbreviated, mapped to one form.
+var addressWords = map[string]string{
+	"street": "st", "avenue": "ave", "av": "ave", "boulevard": "blvd", "road": "rd", "drive": "dr",
+	"place": "pl", "parkway": "pkwy", "court": "ct", "lane": "ln", "highway": "hwy", "terrace": "ter",
+	"north": "n", "south": "s", "east": "e", "west": "w",
+}
+
+// Unit designators; they and the word after them are dropped from addresses.
+var addressUnits = map[string]bool{"suite": true, "ste": true, "unit": true, "apt": true, "fl": true, "floor": true, "rm": true, "room": true}
+
+// words lowercases s, turns & into "and" and splits it on anything but letters and digits.
+func words(s string) []string {
+	s = strings.ReplaceAll(strings.ToLower(s), "&", " and ")
+	return strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+func normalizeFacilityName(name string) string {
+	var kept []string
+	for _, w := range words(strings.ReplaceAll(name, "'", "")) {
+		if !nameNoise[w] {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+func normalizeAddress(address string) string {
+	ws := words(address)
+	var kept []string
+	for i := 0; i < len(ws); i++ {
+		w := ws[i]
+		if addressUnits[w] {
+			i++
+			continue
+		}
+		if short, ok := addressWords[w]; ok {
+			w = short
+		}
+		kept = append(kept, w)
+	}
+	return strings.Join(kept, " ")
+}
+
+// similarity is the better of the edit-distance ratios of a and b as given
+// and with their words sorted, so reordered names still match.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	sorted := func(s string) string {
+		ws := strings.Fields(s)
+		sort.Strings(ws)
+		return strings.Join(ws, " ")
+	}
+	return max(editRatio(a, b), editRatio(sorted(a), sorted(b)))
+}
+
+// editRatio is 1 minus the Levenshtein distance over the longer length.
+func editRatio(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
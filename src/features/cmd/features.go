@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/jobs"
+	"configure/logging"
+	"configure/openlineage"
+	"configure/problem"
+	"configure/publish"
+	"configure/tlsconfig"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/joho/godotenv"
+	"google.golang.org/api/iterator"
+)
+
+type FeaturesRequest struct {
+	RunID string `json:"run_id"`
+	Date  string `json:"date"`
+	// Loader is the run's loader stage, whose table the cleaned inspections
+	// are read from; the trigger sets it
+	Loader string `json:"loader,omitempty"`
+}
+
+type Config struct {
+	Project string
+	Dataset string
+	// SourceTable is the cleaned inspections table, as dataset.table
+	SourceTable string
+	// SourceTables is the table each loader stage writes, see forLoader
+	SourceTables  map[string]string
+	FeaturesTable string
+	// Look-back used for rolling_failure_rate
+	WindowDays int
+}
+
+// forLoader returns cfg reading the table loader writes. Without a known
+// loader, or with BQ_SOURCE_TABLE set, it keeps SourceTable: by default the
+// Parquet loader's, the one enabled in the default topology.
+func (cfg Config) forLoader(loader string) Config {
+	if table, ok := cfg.SourceTables[loader]; ok {
+		cfg.SourceTable = table
+	}
+	return cfg
+}
+
+// source is the full name of SourceTable.
+func (cfg Config) source() string {
+	return cfg.Project + "." + cfg.SourceTable
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func loadConfig() Config {
+	window, err := strconv.Atoi(getenv("FEATURE_WINDOW_DAYS", "365"))
+	if err != nil || window <= 0 {
+		log.Printf("⚠️ Invalid FEATURE_WINDOW_DAYS, using 365")
+		window = 365
+	}
+	cfg := Config{
+		Project: getenv("BQ_PROJECT", "hygiene-prediction-434"),
+		Dataset: getenv("BQ_DATASET", "HygienePredictionRow"),
+		SourceTables: map[string]string{
+			"loader_parquet": getenv("BQ_PARQUET_SOURCE_TABLE", "HygienePredictionColumn.CleanedInspectionColumn"),
+			"loader_json":    getenv("BQ_JSON_SOURCE_TABLE", "HygienePredictionRow.CleanedInspectionRow"),
+		},
+		FeaturesTable: getenv("BQ_FEATURES_TABLE", "Features"),
+		WindowDays:    window,
+	}
+	cfg.SourceTable = cfg.SourceTables["loader_parquet"]
+	if table := os.Getenv("BQ_SOURCE_TABLE"); table != "" {
+		// One table for every run, whichever loader it has; a bare name is in BQ_DATASET
+		if !strings.Contains(table, ".") {
+			table = cfg.Dataset + "." + table
+		}
+		cfg.SourceTable, cfg.SourceTables = table, nil
+	}
+	return cfg
+}
+
+// featuresSQL rebuilds one as_of_date partition of the Features table from the
+// full inspection history. The cleaner drops license numbers, so facilities
+// are the ones ResolveFacilities assigned each name/address/zip variant to;
+// a variant not resolved yet is keyed on its own hash. Each keeps the latest coordinates inside
+// Chicago; the location columns are filled in by EnrichFeatures and the
+// calendar and weather ones by EnrichTemporal.
+const featuresSQL = `
+DECLARE as_of DATE DEFAULT CAST(@as_of AS DATE);
+
+CREATE TABLE IF NOT EXISTS ` + "`%[1]s`" + ` (
+  as_of_date DATE,
+  facility_id STRING,
+  dba_name STRING,
+  address STRING,
+  zip STRING,
+  facility_category STRING,
+  risk STRING,
+  inspection_count INT64,
+  past_violation_count INT64,
+  past_failure_count INT64,
+  days_since_last_inspection INT64,
+  rolling_inspection_count INT64,
+  rolling_failure_rate FLOAT64,
+  last_result STRING,
+  run_id STRING,
+  computed_at TIMESTAMP,
+  latitude FLOAT64,
+  longitude FLOAT64,
+  geo_source STRING,
+  community_area STRING,
+  community_area_name STRING,
+  ward STRING,
+  last_inspection_dow INT64,
+  last_inspection_holiday INT64,
+  last_inspection_tmax_c FLOAT64,
+  last_inspection_tmin_c FLOAT64,
+  last_inspection_prcp_mm FLOAT64,
+  as_of_dow INT64,
+  as_of_holiday INT64
+)
+PARTITION BY as_of_date;
+
+ALTER TABLE ` + "`%[1]s`" + `
+  ADD COLUMN IF NOT EXISTS latitude FLOAT64,
+  ADD COLUMN IF NOT EXISTS longitude FLOAT64,
+  ADD COLUMN IF NOT EXISTS geo_source STRING,
+  ADD COLUMN IF NOT EXISTS community_area STRING,
+  ADD COLUMN IF NOT EXISTS community_area_name STRING,
+  ADD COLUMN IF NOT EXISTS ward STRING,
+  ADD COLUMN IF NOT EXISTS last_inspection_dow INT64,
+  ADD COLUMN IF NOT EXISTS last_inspection_holiday INT64,
+  ADD COLUMN IF NOT EXISTS last_inspection_tmax_c FLOAT64,
+  ADD COLUMN IF NOT EXISTS last_inspection_tmin_c FLOAT64,
+  ADD COLUMN IF NOT EXISTS last_inspection_prcp_mm FLOAT64,
+  ADD COLUMN IF NOT EXISTS as_of_dow INT64,
+  ADD COLUMN IF NOT EXISTS as_of_holiday INT64;
+
+DELETE FROM ` + "`%[1]s`" + ` WHERE as_of_date = as_of;
+
+INSERT INTO ` + "`%[1]s`" + `
+WITH inspections AS (
+  SELECT
+    IFNULL(resolved_id, TO_HEX(SHA256(CONCAT(dba_name, '|', address, '|', CAST(zip AS STRING))))) AS facility_id,
+    dba_name,
+    address,
+    CAST(zip AS STRING) AS zip,
+    facility_category,
+    risk,
+    results,
+    IFNULL(ARRAY_LENGTH(violation_codes), 0) AS violation_count,
+    -- inspection_date is autodetected as TIMESTAMP or STRING depending on the load
+    PARSE_DATE('%%Y-%%m-%%d', SUBSTR(CAST(inspection_date AS STRING), 1, 10)) AS inspection_date,
+    -- Coordinates entered the wrong way round are swapped back, others outside Chicago dropped
+    CASE
+      WHEN SAFE_CAST(latitude AS FLOAT64) BETWEEN 41.6 AND 42.1 AND SAFE_CAST(longitude AS FLOAT64) BETWEEN -88.0 AND -87.5
+        THEN STRUCT(ROUND(SAFE_CAST(latitude AS FLOAT64), 5) AS lat, ROUND(SAFE_CAST(longitude AS FLOAT64), 5) AS lon)
+      WHEN SAFE_CAST(longitude AS FLOAT64) BETWEEN 41.6 AND 42.1 AND SAFE_CAST(latitude AS FLOAT64) BETWEEN -88.0 AND -87.5
+        THEN STRUCT(ROUND(SAFE_CAST(longitude AS FLOAT64), 5) AS lat, ROUND(SAFE_CAST(latitude AS FLOAT64), 5) AS lon)
+    END AS coords
+  FROM (
+    SELECT s.*, v.facility_id AS resolved_id
+    FROM ` + "`%[2]s`" + ` s
+    LEFT JOIN ` + "`%[3]s`" + ` v
+      ON v.variant_key = TO_HEX(SHA256(CONCAT(s.dba_name, '|', s.address, '|', CAST(s.zip AS STRING))))
+  )
+),
+history AS (
+  SELECT *, inspection_date > DATE_SUB(as_of, INTERVAL @window_days DAY) AS in_window
+  FROM inspections
+  WHERE inspection_date <= as_of
+)
+SELECT
+  as_of AS as_of_date,
+  facility_id,
+  ANY_VALUE(dba_name) AS dba_name,
+  ANY_VALUE(address) AS address,
+  ANY_VALUE(zip) AS zip,
+  ARRAY_AGG(facility_category ORDER BY inspection_date DESC LIMIT 1)[OFFSET(0)] AS facility_category,
+  ARRAY_AGG(risk ORDER BY inspection_date DESC LIMIT 1)[OFFSET(0)] AS risk,
+  COUNT(*) AS inspection_count,
+  SUM(violation_count) AS past_violation_count,
+  COUNTIF(results = 'fail') AS past_failure_count,
+  DATE_DIFF(as_of, MAX(inspection_date), DAY) AS days_since_last_inspection,
+  COUNTIF(in_window) AS rolling_inspection_count,
+  SAFE_DIVIDE(COUNTIF(in_window AND results = 'fail'), COUNTIF(in_window)) AS rolling_failure_rate,
+  ARRAY_AGG(results ORDER BY inspection_date DESC LIMIT 1)[OFFSET(0)] AS last_result,
+  @run_id AS run_id,
+  CURRENT_TIMESTAMP() AS computed_at,
+  ARRAY_AGG(coords IGNORE NULLS ORDER BY inspection_date DESC LIMIT 1)[SAFE_OFFSET(0)].lat AS latitude,
+  ARRAY_AGG(coords IGNORE NULLS ORDER BY inspection_date DESC LIMIT 1)[SAFE_OFFSET(0)].lon AS longitude,
+  IF(COUNT(coords) > 0, 'source', NULL) AS geo_source,
+  CAST(NULL AS STRING) AS community_area,
+  CAST(NULL AS STRING) AS community_area_name,
+  CAST(NULL AS STRING) AS ward,
+  CAST(NULL AS INT64) AS last_inspection_dow,
+  CAST(NULL AS INT64) AS last_inspection_holiday,
+  CAST(NULL AS FLOAT64) AS last_inspection_tmax_c,
+  CAST(NULL AS FLOAT64) AS last_inspection_tmin_c,
+  CAST(NULL AS FLOAT64) AS last_inspection_prcp_mm,
+  CAST(NULL AS INT64) AS as_of_dow,
+  CAST(NULL AS INT64) AS as_of_holiday
+FROM history
+GROUP BY facility_id;
+`
+
+// BuildFeatures recomputes the Features partition for req.Date and returns the
+// number of facilities written.
+func BuildFeatures(ctx context.Context, bqClient *bigquery.Client, cfg Config, fcfg FacilityConfig, req FeaturesRequest) (int64, error) {
+	featuresTable := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, cfg.FeaturesTable)
+	sourceTable := cfg.source()
+	variantsTable := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, fcfg.VariantsTable)
+
+	q := bqClient.Query(fmt.Sprintf(featuresSQL, featuresTable, sourceTable, variantsTable))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "as_of", Value: req.Date},
+		{Name: "window_days", Value: cfg.WindowDays},
+		{Name: "run_id", Value: req.RunID},
+	}
+	job, err := q.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("start features query: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("wait for features query: %w", err)
+	}
+	recordJob(ctx, status)
+	if err := status.Err(); err != nil {
+		return 0, fmt.Errorf("features query failed: %w", err)
+	}
+
+	count := bqClient.Query(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE as_of_date = CAST(@as_of AS DATE)", featuresTable))
+	count.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: req.Date}}
+	it, err := readQuery(ctx, count)
+	if err != nil {
+		return 0, fmt.Errorf("count features: %w", err)
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return 0, fmt.Errorf("count features: %w", err)
+	}
+	var rows int64
+	if len(row) > 0 {
+		rows, _ = row[0].(int64)
+	}
+	return rows, nil
+}
+
+// notifyTrigger publishes a stage event to the trigger.
+func notifyTrigger(publisher publish.EventPublisher, payload map[string]any) {
+	if err := publisher.Publish(context.Background(), payload); err != nil {
+		log.Printf("❌ Failed to notify trigger of %v: %v", payload["event"], err)
+		return
+	}
+	log.Printf("📤 Published %v to %s", payload["event"], publisher)
+}
+
+// runSafely runs a stage's work in the background. If it panics, the stage
+// is reported failed so the trigger doesn't wait out its SLA.
+func runSafely(publisher publish.EventPublisher, stage string, req FeaturesRequest, work func()) {
+	go func() {
+		err := jobs.Safely(func() error {
+			work()
+			return nil
+		})
+		if err == nil {
+			return
+		}
+		log.Printf("❌ %s crashed: %v", stage, err)
+		notifyTrigger(publisher, map[string]any{
+			"event":          stage + "_failed",
+			"run_id":         req.RunID,
+			"date":           req.Date,
+			"origin":         stage,
+			"status":         "failed",
+			"error":          err.Error(),
+			"error_category": errcategory.Of(err),
+		})
+	}()
+}
+
+func runFeatures(bqClient *bigquery.Client, cfg Config, fcfg FacilityConfig, ecfg EnrichConfig, tcfg TemporalConfig, publisher publish.EventPublisher, req FeaturesRequest) {
+	startTime := time.Now()
+	cfg = cfg.forLoader(req.Loader)
+	log.Printf("🧮 Building features for %s (run %s) from %s", req.Date, req.RunID, cfg.SourceTable)
+
+	ctx, u := withUsage(context.Background())
+	lineage := featuresLineage(cfg, fcfg, req)
+	openlineage.Emit(ctx, openlineage.Start, lineage, nil)
+	var rows int64
+	facilities, err := ResolveFacilities(ctx, bqClient, cfg, fcfg)
+	if err == nil {
+		rows, err = BuildFeatures(ctx, bqClient, cfg, fcfg, req)
+	}
+	var geo EnrichStats
+	if err == nil {
+		geo, err = EnrichFeatures(ctx, bqClient, cfg, ecfg, req)
+	}
+	var temporal TemporalStats
+	if err == nil && tcfg.Enabled {
+		temporal, err = EnrichTemporal(ctx, bqClient, cfg, tcfg, req)
+	}
+	if err != nil {
+		log.Println("❌ Feature build failed:", err)
+		openlineage.Emit(ctx, openlineage.Fail, lineage, err)
+		notifyTrigger(publisher, u.addTo(map[string]any{
+			"event":          "features_failed",
+			"run_id":         req.RunID,
+			"date":           req.Date,
+			"origin":         "features",
+			"status":         "failed",
+			"error":          err.Error(),
+			"error_category": errcategory.Of(err),
+		}))
+		return
+	}
+
+	duration := time.Since(startTime).Seconds()
+	log.Printf("🏷️ facility_variants_resolved: %d (%d matched to known facilities, %d new)", facilities.NewVariants, facilities.Matched, facilities.NewFacilities)
+	log.Printf("✅ features_written: %d", rows)
+	log.Printf("📍 features_located: %d from inspections, %d geocoded, %d unlocated (%d geocoder calls)", geo.FromSource, geo.Geocoded, geo.Unlocated, geo.GeocoderCalls)
+	log.Printf("🗺️ features_in_areas: %d community area, %d ward", geo.CommunityAreas, geo.Wards)
+	if tcfg.Enabled {
+		log.Printf("🌦️ daily_context_filled: %d days, %d with weather (%d NOAA calls)", temporal.DaysFilled, temporal.WeatherDays, temporal.NOAACalls)
+	}
+	log.Printf("⏱️ features_duration_seconds: %.3f", duration)
+	openlineage.Emit(ctx, openlineage.Complete, lineage, nil)
+
+	notifyTrigger(publisher, u.addTo(map[string]any{
+		"event":      "features_completed",
+		"run_id":     req.RunID,
+		"date":       req.Date,
+		"origin":     "features",
+		"rows":       rows,
+		"duration":   eventschema.Seconds(duration),
+		"facilities": facilities,
+		"geo":        geo,
+		"temporal":   temporal,
+	}))
+}
+
+// bqTable names a table of the features dataset for OpenLineage.
+func bqTable(cfg Config, table string) openlineage.Dataset {
+	return openlineage.BigQuery(fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, table))
+}
+
+// featuresLineage describes a features run for OpenLineage: the cleaned
+// inspections in, the Features table and the facility tables out.
+func featuresLineage(cfg Config, fcfg FacilityConfig, req FeaturesRequest) openlineage.Run {
+	return openlineage.Run{
+		Job:     "features",
+		RunID:   req.RunID,
+		Date:    req.Date,
+		Inputs:  []openlineage.Dataset{openlineage.BigQuery(cfg.source())},
+		Outputs: []openlineage.Dataset{bqTable(cfg, cfg.FeaturesTable), bqTable(cfg, fcfg.Table), bqTable(cfg, fcfg.VariantsTable)},
+	}
+}
+
+func handleFeatures(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client, cfg Config, fcfg FacilityConfig, ecfg EnrichConfig, tcfg TemporalConfig, publisher publish.EventPublisher) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	var input FeaturesRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if _, err := time.Parse("2006-01-02", input.Date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Missing or invalid 'date' (YYYY-MM-DD)")
+		return
+	}
+
+	runSafely(publisher, "features", input, func() {
+		runFeatures(bqClient, cfg, fcfg, ecfg, tcfg, publisher, input)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Features started"))
+}
+
+func main() {
+	log.Println("📍 Features starting main()")
+
+	_ = godotenv.Load()
+	logging.Setup()
+	if err := tlsconfig.Setup(); err != nil {
+		log.Fatalf("❌ Invalid TLS client config: %v", err)
+	}
+
+	cfg := loadConfig()
+	pcfg, err := loadPredictConfig()
+	if err != nil {
+		log.Fatalf("❌ Invalid prediction config: %v", err)
+	}
+	dcfg := loadDriftConfig()
+	xcfg := loadExportConfig()
+	fcfg := loadFacilityConfig()
+	ecfg := loadEnrichConfig()
+	tcfg, err := loadTemporalConfig()
+	if err != nil {
+		log.Fatalf("❌ Invalid temporal enrichment config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bqOpts, err := bqClientOptions(context.Background())
+	if err != nil {
+		log.Fatalf("❌ Invalid BigQuery credentials config: %v", err)
+	}
+	bqClient, err := bigquery.NewClient(ctx, cfg.Project, bqOpts...)
+	if err != nil {
+		log.Fatalf("❌ Failed to create BigQuery client: %v", err)
+	}
+
+	publisher, err := publish.FromEnv()
+	if err != nil {
+		log.Fatalf("❌ Invalid event publisher config: %v", err)
+	}
+	log.Printf("🔗 Events go to %s", publisher)
+	if pcfg.Endpoint == "" {
+		log.Println("⚠️ MODEL_ENDPOINT not set — /predict is disabled")
+	}
+	log.Printf("📚 Source: %s (or the run's loader's) → %s.%s (window %dd)", cfg.SourceTable, cfg.Dataset, cfg.FeaturesTable, cfg.WindowDays)
+	if ecfg.GeocoderURL == "" {
+		log.Println("⚠️ GEOCODER_URL is off — facilities without coordinates stay unlocated")
+	}
+	if tcfg.Enabled && tcfg.NOAAToken == "" {
+		log.Println("⚠️ NOAA_TOKEN not set — temporal enrichment adds calendar columns only")
+	}
+	if xcfg.Bucket == "" {
+		log.Println("⚠️ EXPORT_BUCKET not set — /export is disabled")
+	}
+
+	http.HandleFunc("/features", func(w http.ResponseWriter, r *http.Request) {
+		handleFeatures(w, r, bqClient, cfg, fcfg, ecfg, tcfg, publisher)
+	})
+
+	http.HandleFunc("/predict", func(w http.ResponseWriter, r *http.Request) {
+		handlePredict(w, r, bqClient, cfg, pcfg, publisher)
+	})
+
+	http.HandleFunc("/drift", func(w http.ResponseWriter, r *http.Request) {
+		handleDrift(w, r, bqClient, cfg, pcfg, dcfg, publisher)
+	})
+
+	http.HandleFunc("/drift/baseline", func(w http.ResponseWriter, r *http.Request) {
+		handleDriftBaseline(w, r, bqClient, cfg, pcfg, dcfg)
+	})
+
+	http.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		handleExport(w, r, bqClient, cfg, pcfg, xcfg, publisher)
+	})
+
+	http.HandleFunc("/admin/loglevel", logging.AdminHandler())
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+
+	log.Fatal(tlsconfig.ListenAndServe(tlsconfig.ListenAddr(), nil))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/openlineage"
+	"configure/problem"
+	"configure/publish"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+)
+
+type PredictConfig struct {
+	// Vertex AI :predict URL or an internal service speaking the same
+	// {"instances": [...]} → {"predictions": [...]} protocol
+	Endpoint string
+	// Used when the endpoint doesn't report a model version
+	ModelVersion     string
+	BatchSize        int
+	PredictionsTable string
+	// Inputs the model expects; rows are validated against it before any call
+	Contract ModelContract
+}
+
+func loadPredictConfig() (PredictConfig, error) {
+	batch, err := strconv.Atoi(getenv("PREDICTION_BATCH_SIZE", "500"))
+	if err != nil || batch <= 0 {
+		log.Printf("⚠️ Invalid PREDICTION_BATCH_SIZE, using 500")
+		batch = 500
+	}
+	contract, err := loadContract()
+	if err != nil {
+		return PredictConfig{}, err
+	}
+	return PredictConfig{
+		Endpoint:         getenv("MODEL_ENDPOINT", ""),
+		ModelVersion:     getenv("MODEL_VERSION", "unknown"),
+		BatchSize:        batch,
+		PredictionsTable: getenv("BQ_PREDICTIONS_TABLE", "Predictions"),
+		Contract:         contract,
+	}, nil
+}
+
+// PredictionRow is one line of the Predictions table.
+type PredictionRow struct {
+	AsOfDate     string   `json:"as_of_date"`
+	FacilityID   string   `json:"facility_id"`
+	Score        *float64 `json:"score"`
+	Prediction   string   `json:"prediction"`
+	ModelVersion string   `json:"model_version"`
+	RunID        string   `json:"run_id"`
+	PredictedAt  string   `json:"predicted_at"`
+}
+
+type predictResponse struct {
+	Predictions     []json.RawMessage `json:"predictions"`
+	DeployedModelID string            `json:"deployedModelId"`
+	ModelVersionID  string            `json:"modelVersionId"`
+}
+
+// modelClient returns an authorized client for Vertex AI endpoints and a plain one otherwise.
+func modelClient(ctx context.Context, endpoint string) (*http.Client, error) {
+	if strings.Contains(endpoint, "aiplatform.googleapis.com") {
+		return google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	}
+	return &http.Client{Timeout: 60 * time.Second}, nil
+}
+
+func callModel(ctx context.Context, client *http.Client, endpoint string, instances []map[string]bigquery.Value) (*predictResponse, error) {
+	body, err := json.Marshal(map[string]any{"instances": instances})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	recordAPICall(ctx)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errcategory.Errorf(errcategory.FromStatus(resp.StatusCode), "model returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var out predictResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode model response: %w", err)
+	}
+	if len(out.Predictions) != len(instances) {
+		return nil, fmt.Errorf("model returned %d predictions for %d instances", len(out.Predictions), len(instances))
+	}
+	return &out, nil
+}
+
+// predictionScore pulls a numeric score out of a prediction that is either a
+// bare number or an object with a "score" field.
+func predictionScore(raw json.RawMessage) *float64 {
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return &f
+	}
+	var obj struct {
+		Score *float64 `json:"score"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		return obj.Score
+	}
+	return nil
+}
+
+// readFeatureRows loads the given columns for one as_of_date, keyed by facility_id.
+func readFeatureRows(ctx context.Context, bqClient *bigquery.Client, cfg Config, columns []string, date string) ([]map[string]bigquery.Value, error) {
+	q := bqClient.Query(fmt.Sprintf(
+		"SELECT facility_id, %s FROM `%s.%s.%s` WHERE as_of_date = CAST(@as_of AS DATE) ORDER BY facility_id",
+		strings.Join(columns, ", "), cfg.Project, cfg.Dataset, cfg.FeaturesTable))
+	q.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: date}}
+	it, err := readQuery(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("query features: %w", err)
+	}
+
+	var rows []map[string]bigquery.Value
+	for {
+		row := make(map[string]bigquery.Value)
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read features: %w", err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// writePredictions replaces the date's predictions with rows, so a re-run
+// never leaves duplicates behind.
+func writePredictions(ctx context.Context, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, date string, rows []PredictionRow) error {
+	table := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, pcfg.PredictionsTable)
+	ddl := bqClient.Query(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS `+"`%[1]s`"+` (
+  as_of_date DATE,
+  facility_id STRING,
+  score FLOAT64,
+  prediction STRING,
+  model_version STRING,
+  run_id STRING,
+  predicted_at TIMESTAMP
+)
+PARTITION BY as_of_date;
+
+DELETE FROM `+"`%[1]s`"+` WHERE as_of_date = CAST(@as_of AS DATE);
+`, table))
+	ddl.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: date}}
+	if err := runQuery(ctx, ddl); err != nil {
+		return fmt.Errorf("prepare predictions table: %w", err)
+	}
+
+	return loadJSONRows(ctx, bqClient, cfg.Dataset, pcfg.PredictionsTable, rows, bigquery.WriteAppend)
+}
+
+// Predict scores every facility's features for req.Date in batches and writes
+// the results to the Predictions table. It returns the rows written and the
+// model version that produced them.
+func Predict(ctx context.Context, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, req FeaturesRequest) (int, string, error) {
+	if pcfg.Endpoint == "" {
+		return 0, "", errcategory.Errorf(errcategory.Configuration, "MODEL_ENDPOINT not set")
+	}
+
+	// Validate inputs before the model sees them: a schema or domain drift
+	// would otherwise come back as confident but meaningless scores.
+	violations, err := CheckSchema(ctx, bqClient, cfg, pcfg.Contract)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(violations) > 0 {
+		return 0, "", &ContractError{Report: ContractReport{Date: req.Date, Violations: violations}}
+	}
+
+	columns := pcfg.Contract.Names()
+	features, err := readFeatureRows(ctx, bqClient, cfg, columns, req.Date)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(features) == 0 {
+		return 0, "", fmt.Errorf("no features found for %s", req.Date)
+	}
+	if report := ValidateRows(pcfg.Contract, req.Date, features); !report.OK() {
+		return 0, "", &ContractError{Report: report}
+	}
+
+	client, err := modelClient(ctx, pcfg.Endpoint)
+	if err != nil {
+		return 0, "", fmt.Errorf("model client: %w", err)
+	}
+
+	predictedAt := time.Now().UTC().Format(time.RFC3339)
+	modelVersion := pcfg.ModelVersion
+	var rows []PredictionRow
+	for start := 0; start < len(features); start += pcfg.BatchSize {
+		end := min(start+pcfg.BatchSize, len(features))
+		batch := features[start:end]
+
+		instances := make([]map[string]bigquery.Value, len(batch))
+		for i, row := range batch {
+			instance := make(map[string]bigquery.Value, len(columns))
+			for _, col := range columns {
+				instance[col] = row[col]
+			}
+			instances[i] = instance
+		}
+
+		resp, err := callModel(ctx, client, pcfg.Endpoint, instances)
+		if err != nil {
+			return 0, "", fmt.Errorf("batch %d-%d: %w", start, end, err)
+		}
+		if resp.ModelVersionID != "" {
+			modelVersion = resp.ModelVersionID
+		} else if resp.DeployedModelID != "" {
+			modelVersion = resp.DeployedModelID
+		}
+
+		for i, raw := range resp.Predictions {
+			facilityID, _ := batch[i]["facility_id"].(string)
+			rows = append(rows, PredictionRow{
+				AsOfDate:    req.Date,
+				FacilityID:  facilityID,
+				Score:       predictionScore(raw),
+				Prediction:  string(raw),
+				RunID:       req.RunID,
+				PredictedAt: predictedAt,
+			})
+		}
+		log.Printf("🔮 Scored batch %d-%d of %d", start, end, len(features))
+	}
+	for i := range rows {
+		rows[i].ModelVersion = modelVersion
+	}
+
+	if err := writePredictions(ctx, bqClient, cfg, pcfg, req.Date, rows); err != nil {
+		return 0, "", err
+	}
+	return len(rows), modelVersion, nil
+}
+
+func runPrediction(bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, publisher publish.EventPublisher, req FeaturesRequest) {
+	startTime := time.Now()
+	log.Printf("🔮 Predicting for %s (run %s)", req.Date, req.RunID)
+
+	ctx, u := withUsage(context.Background())
+	lineage := openlineage.Run{
+		Job:     "prediction",
+		RunID:   req.RunID,
+		Date:    req.Date,
+		Inputs:  []openlineage.Dataset{bqTable(cfg, cfg.FeaturesTable)},
+		Outputs: []openlineage.Dataset{bqTable(cfg, pcfg.PredictionsTable)},
+	}
+	openlineage.Emit(ctx, openlineage.Start, lineage, nil)
+	rows, modelVersion, err := Predict(ctx, bqClient, cfg, pcfg, req)
+	if err != nil {
+		log.Println("❌ Prediction failed:", err)
+		openlineage.Emit(ctx, openlineage.Fail, lineage, err)
+		failure := map[string]any{
+			"event":          "prediction_failed",
+			"run_id":         req.RunID,
+			"date":           req.Date,
+			"origin":         "prediction",
+			"status":         "failed",
+			"error":          err.Error(),
+			"error_category": errcategory.Of(err),
+		}
+		var contractErr *ContractError
+		if errors.As(err, &contractErr) {
+			report, _ := json.MarshalIndent(contractErr.Report, "", "  ")
+			log.Printf("📋 Contract report:\n%s", report)
+			failure["report"] = contractErr.Report
+		}
+		notifyTrigger(publisher, u.addTo(failure))
+		return
+	}
+
+	duration := time.Since(startTime).Seconds()
+	log.Printf("✅ predictions_written: %d (model %s)", rows, modelVersion)
+	log.Printf("⏱️ prediction_duration_seconds: %.3f", duration)
+	openlineage.Emit(ctx, openlineage.Complete, lineage, nil)
+
+	notifyTrigger(publisher, u.addTo(map[string]any{
+		"event":         "prediction_completed",
+		"run_id":        req.RunID,
+		"date":          req.Date,
+		"origin":        "prediction",
+		"rows":          rows,
+		"model_version": modelVersion,
+		"duration":      eventschema.Seconds(duration),
+	}))
+}
+
+func handlePredict(w http.ResponseWriter, r *http.Request, bqClient *bigquery.Client, cfg Config, pcfg PredictConfig, publisher publish.EventPublisher) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	var input FeaturesRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if _, err := time.Parse("2006-01-02", input.Date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Missing or invalid 'date' (YYYY-MM-DD)")
+		return
+	}
+	if pcfg.Endpoint == "" {
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.NotConfigured, "MODEL_ENDPOINT not configured")
+		return
+	}
+
+	runSafely(publisher, "prediction", input, func() {
+		runPrediction(bqClient, cfg, pcfg, publisher, input)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Prediction started"))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Temporal enrichment keeps a table of calendar and weather facts per date,
+// exposes it joined onto the inspections as a view, and copies the facts for
+// each facility's last inspection and for the as_of date into the Features
+// partition. It is off unless TEMPORAL_ENRICHMENT=true; weather also needs a
+// NOAA Climate Data Online token in NOAA_TOKEN.
+
+type TemporalConfig struct {
+	Enabled   bool
+	NOAAToken string
+	NOAAURL   string
+	// GHCND station whose daily readings stand for the city (default O'Hare)
+	Station      string
+	ContextTable string
+	View         string
+	// Dates filled in per run at most; the history is backfilled over several runs
+	MaxDays int
+	// Deployment-specific days off on top of the federal holidays, from
+	// EXTRA_HOLIDAYS as "YYYY-MM-DD=name,..."
+	ExtraHolidays map[string]string
+}
+
+func loadTemporalConfig() (TemporalConfig, error) {
+	maxDays, err := strconv.Atoi(getenv("TEMPORAL_MAX_DAYS_PER_RUN", "366"))
+	if err != nil || maxDays <= 0 {
+		log.Printf("⚠️ Invalid TEMPORAL_MAX_DAYS_PER_RUN, using 366")
+		maxDays = 366
+	}
+	extra := map[string]string{}
+	for _, entry := range strings.Split(getenv("EXTRA_HOLIDAYS", ""), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		date, name, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return TemporalConfig{}, fmt.Errorf("EXTRA_HOLIDAYS: %q is not YYYY-MM-DD=name", entry)
+		}
+		if name == "" {
+			name = "holiday"
+		}
+		extra[date] = strings.ToLower(name)
+	}
+	return TemporalConfig{
+		Enabled:       strings.EqualFold(getenv("TEMPORAL_ENRICHMENT", "false"), "true"),
+		NOAAToken:     getenv("NOAA_TOKEN", ""),
+		NOAAURL:       getenv("NOAA_URL", "https://www.ncei.noaa.gov/cdo-web/api/v2/data"),
+		Station:       getenv("NOAA_STATION", "GHCND:USW00094846"),
+		ContextTable:  getenv("BQ_DAILY_CONTEXT_TABLE", "DailyContext"),
+		View:          getenv("BQ_INSPECTIONS_CONTEXT_VIEW", "InspectionsWithContext"),
+		MaxDays:       maxDays,
+		ExtraHolidays: extra,
+	}, nil
+}
+
+// DailyContextRow is one date of the daily context table. Weather columns
+// are NULL when no token is configured or NOAA has no reading (yet) for the
+// date; recent dates without one are filled again on later runs.
+type DailyContextRow struct {
+	Date      string `json:"date"`
+	DayOfWeek int    `json:"day_of_week"` // 1 = Monday … 7 = Sunday
+	IsWeekend bool   `json:"is_weekend"`
+	IsHoliday bool   `json:"is_holiday"`
+	Holiday   string `json:"holiday,omitempty"`
+	// Celsius and millimetres
+	TmaxC          *float64 `json:"tmax_c"`
+	TminC          *float64 `json:"tmin_c"`
+	PrcpMM         *float64 `json:"prcp_mm"`
+	WeatherStation *string  `json:"weather_station"`
+	LoadedAt       string   `json:"loaded_at"`
+}
+
+// TemporalStats sums up one run of EnrichTemporal.
+type TemporalStats struct {
+	DaysFilled  int `json:"days_filled"`
+	WeatherDays int `json:"weather_days"`
+	NOAACalls   int `json:"noaa_calls"`
+}
+
+// Re-checked for late NOAA readings for this many days
+const weatherLagDays = 30
+
+// EnrichTemporal fills in the daily context of dates the inspections or the
+// as_of date need, refreshes the inspections view and sets the temporal
+// columns of req.Date's Features partition. A NOAA outage leaves the weather
+// columns NULL rather than failing the stage; BigQuery errors are returned.
+func EnrichTemporal(ctx context.Context, bqClient *bigquery.Client, cfg Config, tcfg TemporalConfig, req FeaturesRequest) (TemporalStats, error) {
+	var stats TemporalStats
+	source := cfg.source()
+	features := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, cfg.FeaturesTable)
+	daily := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, tcfg.ContextTable)
+	view := fmt.Sprintf("%s.%s.%s", cfg.Project, cfg.Dataset, tcfg.View)
+
+	ddl := bqClient.Query(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS `+"`%s`"+` (
+  date DATE,
+  day_of_week INT64,
+  is_weekend BOOL,
+  is_holiday BOOL,
+  holiday STRING,
+  tmax_c FLOAT64,
+  tmin_c FLOAT64,
+  prcp_mm FLOAT64,
+  weather_station STRING,
+  loaded_at TIMESTAMP
+);
+`, daily))
+	if err := runQuery(ctx, ddl); err != nil {
+		return stats, fmt.Errorf("prepare daily context table: %w", err)
+	}
+
+	q := bqClient.Query(fmt.Sprintf(`
+WITH wanted AS (
+  SELECT DISTINCT PARSE_DATE('%%Y-%%m-%%d', SUBSTR(CAST(inspection_date AS STRING), 1, 10)) AS date
+  FROM `+"`%[1]s`"+`
+  UNION DISTINCT
+  SELECT CAST(@as_of AS DATE)
+)
+SELECT CAST(w.date AS STRING) AS date
+FROM wanted w
+LEFT JOIN `+"`%[2]s`"+` c ON c.date = w.date
+WHERE w.date IS NOT NULL AND w.date <= CAST(@as_of AS DATE)
+  AND (c.date IS NULL
+    OR (@weather AND c.weather_station IS NULL AND w.date >= DATE_SUB(CAST(@as_of AS DATE), INTERVAL @lag DAY)))
+ORDER BY w.date DESC
+LIMIT @max_days`, source, daily))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "as_of", Value: req.Date},
+		{Name: "weather", Value: tcfg.NOAAToken != ""},
+		{Name: "lag", Value: weatherLagDays},
+		{Name: "max_days", Value: tcfg.MaxDays},
+	}
+	it, err := readQuery(ctx, q)
+	if err != nil {
+		return stats, fmt.Errorf("find dates without context: %w", err)
+	}
+	var dates []string
+	for {
+		var r struct {
+			Date string `bigquery:"date"`
+		}
+		err := it.Next(&r)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("find dates without context: %w", err)
+		}
+		dates = append(dates, r.Date)
+	}
+
+	if len(dates) > 0 {
+		weather := map[string]dailyWeather{}
+		if tcfg.NOAAToken != "" {
+			weather, stats.NOAACalls, err = fetchWeather(ctx, tcfg, dates)
+			if err != nil {
+				log.Printf("⚠️ NOAA weather unavailable, leaving it NULL: %v", err)
+			}
+		}
+		rows := buildDailyContext(dates, weather, tcfg)
+		for _, r := range rows {
+			if r.WeatherStation != nil {
+				stats.WeatherDays++
+			}
+		}
+
+		del := bqClient.Query(fmt.Sprintf("DELETE FROM `%s` WHERE CAST(date AS STRING) IN UNNEST(@dates)", daily))
+		del.Parameters = []bigquery.QueryParameter{{Name: "dates", Value: dates}}
+		if err := runQuery(ctx, del); err != nil {
+			return stats, fmt.Errorf("replace daily context: %w", err)
+		}
+		if err := loadJSONRows(ctx, bqClient, cfg.Dataset, tcfg.ContextTable, rows, bigquery.WriteAppend); err != nil {
+			return stats, err
+		}
+		stats.DaysFilled = len(rows)
+	}
+
+	update := bqClient.Query(fmt.Sprintf(`
+DECLARE as_of DATE DEFAULT CAST(@as_of AS DATE);
+
+CREATE OR REPLACE VIEW `+"`%[3]s`"+` AS
+SELECT s.*, c.day_of_week, c.is_weekend, c.is_holiday, c.holiday, c.tmax_c, c.tmin_c, c.prcp_mm
+FROM `+"`%[1]s`"+` s
+LEFT JOIN `+"`%[4]s`"+` c
+  ON c.date = PARSE_DATE('%%Y-%%m-%%d', SUBSTR(CAST(s.inspection_date AS STRING), 1, 10));
+
+UPDATE `+"`%[2]s`"+` f
+SET
+  last_inspection_dow = x.day_of_week,
+  last_inspection_holiday = CAST(x.is_holiday AS INT64),
+  last_inspection_tmax_c = x.tmax_c,
+  last_inspection_tmin_c = x.tmin_c,
+  last_inspection_prcp_mm = x.prcp_mm,
+  as_of_dow = a.day_of_week,
+  as_of_holiday = CAST(a.is_holiday AS INT64)
+FROM (
+  SELECT p.facility_id, l.day_of_week, l.is_holiday, l.tmax_c, l.tmin_c, l.prcp_mm
+  FROM `+"`%[2]s`"+` p
+  LEFT JOIN `+"`%[4]s`"+` l ON l.date = DATE_SUB(as_of, INTERVAL p.days_since_last_inspection DAY)
+  WHERE p.as_of_date = as_of
+) x,
+(SELECT day_of_week, is_holiday FROM `+"`%[4]s`"+` WHERE date = as_of) a
+WHERE f.as_of_date = as_of AND f.facility_id = x.facility_id;
+`, source, features, view, daily))
+	update.Parameters = []bigquery.QueryParameter{{Name: "as_of", Value: req.Date}}
+	if err := runQuery(ctx, update); err != nil {
+		return stats, fmt.Errorf("set temporal features: %w", err)
+	}
+	return stats, nil
+}
+
+// buildDailyContext describes dates from the calendar and the readings found.
+func buildDailyContext(dates []string, weather map[string]dailyWeather, tcfg TemporalConfig) []DailyContextRow {
+	now := time.Now().UTC().Format(time.RFC3339)
+	holidays := map[int]map[string]string{}
+	rows := make([]DailyContextRow, 0, len(dates))
+	for _, date := range dates {
+		d, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			continue
+		}
+		// New Year's Day falling on a Saturday is observed on the Friday before
+		for _, y := range []int{d.Year(), d.Year() + 1} {
+			if holidays[y] == nil {
+				holidays[y] = federalHolidays(y)
+			}
+		}
+		name := holidays[d.Year()][date]
+		if name == "" {
+			name = holidays[d.Year()+1][date]
+		}
+		if extra, ok := tcfg.ExtraHolidays[date]; ok {
+			name = extra
+		}
+
+		dow := int(d.Weekday())
+		if dow == 0 {
+			dow = 7
+		}
+		row := DailyContextRow{
+			Date:      date,
+			DayOfWeek: dow,
+			IsWeekend: dow >= 6,
+			IsHoliday: name != "",
+			Holiday:   name,
+			LoadedAt:  now,
+		}
+		if w, ok := weather[date]; ok {
+			row.TmaxC, row.TminC, row.PrcpMM = w.TmaxC, w.TminC, w.PrcpMM
+			row.WeatherStation = &tcfg.Station
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// federalHolidays maps the observed dates of year's US federal holidays to
+// their names; one on a Saturday is observed the Friday before, one on a
+// Sunday the Monday after.
+func federalHolidays(year int) map[string]string {
+	h := map[string]string{}
+	fixed := func(month time.Month, day int, name string) {
+		d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		switch d.Weekday() {
+		case time.Saturday:
+			d = d.AddDate(0, 0, -1)
+		case time.Sunday:
+			d = d.AddDate(0, 0, 1)
+		}
+		h[d.Format("2006-01-02")] = name
+	}
+	// nth weekday of the month; n < 0 is the last one
+	nth := func(month time.Month, weekday time.Weekday, n int, name string) {
+		d := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		for d.Weekday() != weekday {
+			d = d.AddDate(0, 0, 1)
+		}
+		if n > 0 {
+			d = d.AddDate(0, 0, 7*(n-1))
+		} else {
+			for d.AddDate(0, 0, 7).Month() == month {
+				d = d.AddDate(0, 0, 7)
+			}
+		}
+		h[d.Format("2006-01-02")] = name
+	}
+
+	fixed(time.January, 1, "new year's day")
+	nth(time.January, time.Monday, 3, "martin luther king jr. day")
+	nth(time.February, time.Monday, 3, "washington's birthday")
+	nth(time.May, time.Monday, -1, "memorial day")
+	if year >= 2021 {
+		fixed(time.June, 19, "juneteenth")
+	}
+	fixed(time.July, 4, "independence day")
+	nth(time.September, time.Monday, 1, "labor day")
+	nth(time.October, time.Monday, 2, "columbus day")
+	fixed(time.November, 11, "veterans day")
+	nth(time.November, time.Thursday, 4, "thanksgiving day")
+	fixed(time.December, 25, "christmas day")
+	return h
+}
+
+type dailyWeather struct {
+	TmaxC, TminC, PrcpMM *float64
+}
+
+// fetchWeather reads the station's daily maximum and minimum temperature and
+// precipitation for dates from NOAA CDO, one request per year and page since
+// the API serves at most a year of daily data at a time. It returns what it
+// got before any error, with the number of calls made.
+func fetchWeather(ctx context.Context, tcfg TemporalConfig, dates []string) (map[string]dailyWeather, int, error) {
+	type span struct{ first, last string }
+	years := map[string]*span{}
+	for _, d := range dates {
+		s, ok := years[d[:4]]
+		if !ok {
+			years[d[:4]] = &span{d, d}
+			continue
+		}
+		if d < s.first {
+			s.first = d
+		}
+		if d > s.last {
+			s.last = d
+		}
+	}
+
+	header := http.Header{"Token": {tcfg.NOAAToken}}
+	weather := map[string]dailyWeather{}
+	calls := 0
+	for _, s := range years {
+		const pageSize = 1000
+		for offset := 1; ; offset += pageSize {
+			params := url.Values{}
+			params.Set("datasetid", "GHCND")
+			params.Set("stationid", tcfg.Station)
+			params.Set("startdate", s.first)
+			params.Set("enddate", s.last)
+			params["datatypeid"] = []string{"TMAX", "TMIN", "PRCP"}
+			params.Set("units", "metric")
+			params.Set("limit", strconv.Itoa(pageSize))
+			params.Set("offset", strconv.Itoa(offset))
+
+			var resp struct {
+				Results []struct {
+					Date     string  `json:"date"`
+					DataType string  `json:"datatype"`
+					Value    float64 `json:"value"`
+				} `json:"results"`
+			}
+			calls++
+			if err := getJSON(ctx, tcfg.NOAAURL+"?"+params.Encode(), header, &resp); err != nil {
+				return weather, calls, err
+			}
+			for _, r := range resp.Results {
+				if len(r.Date) < 10 {
+					continue
+				}
+				date := r.Date[:10]
+				w := weather[date]
+				v := r.Value
+				switch r.DataType {
+				case "TMAX":
+					w.TmaxC = &v
+				case "TMIN":
+					w.TminC = &v
+				case "PRCP":
+					w.PrcpMM = &v
+				}
+				weather[date] = w
+			}
+			if len(resp.Results) < pageSize {
+				break
+			}
+		}
+	}
+	return weather, calls, nil
+}
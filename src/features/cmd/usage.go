@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// usage tallies the billable work done for one request. It rides on the
+// context so every BigQuery job and model call made on its behalf is counted,
+// and is reported to the trigger for the run's cost estimate.
+type usage struct {
+	mu             sync.Mutex
+	bytesProcessed int64
+	bytesLoaded    int64
+	apiCalls       int
+}
+
+type usageKey struct{}
+
+func withUsage(ctx context.Context) (context.Context, *usage) {
+	u := &usage{}
+	return context.WithValue(ctx, usageKey{}, u), u
+}
+
+func usageFrom(ctx context.Context) *usage {
+	u, _ := ctx.Value(usageKey{}).(*usage)
+	return u
+}
+
+// recordJob adds a finished job's billed query bytes or loaded bytes.
+func recordJob(ctx context.Context, status *bigquery.JobStatus) {
+	u := usageFrom(ctx)
+	if u == nil || status == nil || status.Statistics == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch d := status.Statistics.Details.(type) {
+	case *bigquery.QueryStatistics:
+		// Billed bytes include the 10 MB per-query minimum
+		u.bytesProcessed += d.TotalBytesBilled
+	case *bigquery.LoadStatistics:
+		u.bytesLoaded += d.OutputBytes
+	default:
+		u.bytesProcessed += status.Statistics.TotalBytesProcessed
+	}
+}
+
+// recordAPICall counts one call to an external API (the model endpoint).
+func recordAPICall(ctx context.Context) {
+	if u := usageFrom(ctx); u != nil {
+		u.mu.Lock()
+		u.apiCalls++
+		u.mu.Unlock()
+	}
+}
+
+// addTo merges the usage fields into a trigger event.
+func (u *usage) addTo(event map[string]any) map[string]any {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	event["bq_bytes_processed"] = u.bytesProcessed
+	event["bq_bytes_loaded"] = u.bytesLoaded
+	event["api_calls"] = u.apiCalls
+	return event
+}
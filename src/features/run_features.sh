@@ -0,0 +1,9 @@
+#!/bin/bash
+docker run --rm --name features \
+  --network microservices-net \
+  -p 8087:8080 \
+  -e TRIGGER_URL=http://trigger:8080/clean \
+  -e BQ_DATASET=HygienePredictionRow \
+  -v "${GCP_CREDENTIALS_FILE:-$HOME/gcp-creds/service-account.json}:/app/creds.json" \
+  -e GOOGLE_APPLICATION_CREDENTIALS=/app/creds.json \
+  hygiene_prediction-features
@@ -1,223 +1,385 @@
 import json
-import logging
-import base64
-import requests
 import time
 import os
 from google.cloud import bigquery, storage
-from google.auth import default
 from google.cloud.exceptions import NotFound
 import argparse
-from datetime import datetime
-from werkzeug.wrappers import Request, Response
+from datetime import datetime, timedelta, timezone
+
+# === Shared with the cleaner (see src/pyconfigure) ===
+from pyconfigure import logs, publish, wsgi
+from pyconfigure.bqchecks import verify_run
+from pyconfigure.jobs import handle_jobs, registry as jobs
+from pyconfigure.logs import admin_loglevel
+from pyconfigure.manifest import check as check_manifest, load as read_manifest
+from pyconfigure.openlineage import post as post_openlineage
+from pyconfigure.problem import problem
+from pyconfigure.publish import EVENT_SCHEMA_VERSION, publish_event
+from pyconfigure.staging import (
+    BQ_PROJECT, LoadFailed, StagingCheckFailed, classify_error, create_staging, ensure_dataset_exists, expire_staging,
+    load_error, loaded_columns, log_active_credentials, new_bq_client, promote_staging, readiness_problems, reconcile,
+    record_lineage, run_load, staging_table_id, verify_date, verify_staging,
+)
+from pyconfigure.warehouse import write_sqlite
 
 # === Logging Setup (Cloud Native) ===
-logging.basicConfig(
-    level=logging.INFO,
-    format="%(asctime)s — %(levelname)s — %(message)s"
-)
-logger = logging.getLogger("bq_ndjson_loader")
+# LOG_LEVEL (debug, info or warn) sets the starting level; /admin/loglevel changes it
+logger = logs.setup("bq_ndjson_loader")
+
+# === Local Mode ===
+# With LOCAL_DATA_DIR set the loader runs once from the command line (python bq_jsonl_loader.py DATE),
+# reading the cleaner's files from {LOCAL_DATA_DIR}/{BUCKET_NAME}/{GCS_PREFIX}/{date} and
+# appending them to LOCAL_WAREHOUSE, a SQLite file, instead of BigQuery
+LOCAL_DATA_DIR = os.environ.get("LOCAL_DATA_DIR")
+LOCAL_WAREHOUSE = os.environ.get("LOCAL_WAREHOUSE") or os.path.join(LOCAL_DATA_DIR or ".", "warehouse.sqlite")
 
 # === Config from Environment ===
-BUCKET_NAME = os.environ["BUCKET_NAME"]
+BUCKET_NAME = os.environ["BUCKET_NAME"] if not LOCAL_DATA_DIR else os.environ.get("BUCKET_NAME", "cleaned-inspection-data-row-434")
 GCS_PREFIX = os.environ.get("GCS_PREFIX", "clean-data")
-BQ_PROJECT = os.environ.get("BQ_PROJECT", "hygiene-prediction-434")
 BQ_DATASET = os.environ.get("BQ_DATASET", "HygienePredictionRow")
 BQ_TABLE = os.environ.get("BQ_TABLE", "CleanedInspectionRow")
+# BQ_PROJECT, the BigQuery impersonation, LINEAGE_TABLE, the staging checks and the load
+# retries are read by pyconfigure.staging
 
-
-# === Trigger URL from environment or SERVICE_CONFIG_B64 ===
-trigger_url = os.environ.get("TRIGGER_URL")
-
-if not trigger_url:
-    config_b64 = os.environ.get("SERVICE_CONFIG_B64")
-    if config_b64:
-        try:
-            decoded = base64.b64decode(config_b64).decode()
-            service_config = json.loads(decoded)
-            trigger_url = service_config.get("trigger", {}).get("url")
-            logger.info(f"📡 Loaded trigger URL from SERVICE_CONFIG_B64: {trigger_url}")
-        except Exception as e:
-            logger.error(f"❌ Failed to parse SERVICE_CONFIG_B64: {e}")
-
-if not trigger_url:
+# === Event publishing ===
+# EVENT_PUBLISHER and the trigger URL are read by pyconfigure.publish
+if not publish.configured():
     logger.warning("⚠️ Trigger URL is not set — downstream notifications will be skipped")
 
 
-def log_active_credentials():
-    credentials, project = default()
-    logger.info(f"🔐 Using ADC credentials for project: {project}")
-    logger.info(f"Credentials type: {type(credentials)}")
-    if hasattr(credentials, "quota_project_id"):
-        logger.info(f"Quota project ID: {credentials.quota_project_id}")
-    if hasattr(credentials, "service_account_email"):
-        logger.info(f"Service Account: {credentials.service_account_email}")
-
-def ensure_dataset_exists(bq_client, dataset_id: str):
-    logger.info(f"🔍 Checking for dataset: {dataset_id}")
-    try:
-        bq_client.get_dataset(dataset_id)
-        logger.info(f"✅ Dataset exists: {dataset_id}")
-    except NotFound:
-        dataset = bigquery.Dataset(dataset_id)
-        dataset.location = "US"
-        bq_client.create_dataset(dataset)
-        logger.info(f"🆕 Created dataset: {dataset_id}")
-    except Exception as e:
-        logger.exception(f"❌ Error checking or creating dataset: {e}")
-        raise
-    
-def ensure_table(table_name: str, date: str):
-    """Ensures a BigQuery table exists. Creates it using the first NDJSON file if missing."""
-    logger.info(f"🔍 Checking BigQuery table: {table_name}")
-
-    client = bigquery.Client()
-    logger.info(f"👤 BigQuery client project: {client.project}")
-
-    storage_client = storage.Client()
-    logger.info(f"👤 Storage client project: {storage_client.project}")
-
-
-    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{table_name}"
-    dataset_id = f"{BQ_PROJECT}.{BQ_DATASET}"
-    logger.info(f"🔧 BQ_PROJECT: {BQ_PROJECT}")
-    logger.info(f"🔧 BQ_DATASET: {BQ_DATASET}")
-    logger.info(f"🔧 BQ_TABLE: {table_name}")
-    logger.info(f"🔧 Resolved dataset_id: {BQ_PROJECT}.{BQ_DATASET}")
-    logger.info(f"🔧 Resolved table_id: {BQ_PROJECT}.{BQ_DATASET}.{table_name}")
-
-
-    ensure_dataset_exists(client, dataset_id)
-
-    try:
-        client.get_table(table_id)
-        logger.info(f"✅ Table exists: {table_id}")
-        return
-    except NotFound:
-        logger.warning(f"🆕 Table not found: {table_id}, attempting to create...")
-
-    files = load_manifest(storage_client, date)
-    if not files:
-        logger.error(f"❌ No files found for {date}, cannot create table.")
-        return
-
-    source_uri = f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/{files[0]}"
-    job_config = bigquery.LoadJobConfig(
-        source_format=bigquery.SourceFormat.NEWLINE_DELIMITED_JSON,
-        autodetect=True
-    )
-
-    logger.info(f"📥 Creating table {table_id} from {source_uri}")
-    load_job = client.load_table_from_uri(source_uri, table_id, job_config=job_config)
-    load_job.result()
-    logger.info(f"✅ Created table: {table_id}")
-    
-
 def load_manifest(storage_client, date: str):
+    """The date's manifest, or {} if it is missing, incomplete or can't be read."""
     manifest_path = f"{GCS_PREFIX}/{date}/_manifest.json"
-    bucket = storage_client.bucket(BUCKET_NAME)
-    manifest_blob = bucket.blob(manifest_path)
-
-    if not manifest_blob.exists():
-        logger.warning(f"⚠️ No manifest found at: {manifest_path}")
-        return []
-
     try:
-        manifest = json.loads(manifest_blob.download_as_text())
+        return read_manifest(storage_client.bucket(BUCKET_NAME), manifest_path) or {}
     except Exception as e:
         logger.error(f"❌ Failed to parse manifest at {manifest_path}: {e}")
-        return []
-
-    if not manifest.get("upload_complete", False):
-        logger.info(f"⚠️ Manifest for {date} found but not marked complete.")
-        return []
-
-    logger.info(f"📦 Loaded manifest with {len(manifest['files'])} files for {date}")
-    return manifest["files"]
-
-def load_ndjson_to_bigquery(date: str):
+        return {}
+
+
+# === Run-scoped staging ===
+# A run's files go through a staging table of its own before they reach the target; see
+# pyconfigure.staging
+def stage_and_promote(bq_client, uris: list, table_id: str, run_id: str, date: str, manifest: dict, job=None) -> dict:
+    """Loads uris into the run's staging table for table_id and promotes it once it passes its
+    checks. Raises StagingCheckFailed, leaving table_id as it was, if any file fails to load or
+    a check fails. Returns the files, rows and bytes loaded and the bytes the queries processed."""
+    staging_id = staging_table_id(table_id, run_id, date)
+    since = datetime.now(timezone.utc)
+    target_exists = create_staging(bq_client, table_id, staging_id)
+    staged = target_exists
+    result = {"files": 0, "rows": 0, "bytes_loaded": 0, "bytes_processed": 0}
+    load_errors = []
+    for uri in uris:
+        if job:
+            job.check()
+            job.progress(files_loaded=result["files"], files_total=len(uris), rows_loaded=result["rows"])
+        logger.info(f"⏳ Loading {uri} into {staging_id}")
+        job_config = bigquery.LoadJobConfig(
+            source_format=bigquery.SourceFormat.NEWLINE_DELIMITED_JSON,
+            autodetect=True,
+            write_disposition=bigquery.WriteDisposition.WRITE_APPEND,
+            schema_update_options=["ALLOW_FIELD_ADDITION"] if staged else None,
+        )
+        try:
+            load_job = run_load(bq_client, uri, staging_id, job_config, f"load_{staging_id.split('.')[-1]}", since)
+        except Exception as e:
+            logger.exception(f"❌ Failed to load {uri}: {e}")
+            load_errors.append(load_error(uri, e))
+            continue
+        result["bytes_loaded"] += load_job.output_bytes or 0
+        result["rows"] += load_job.output_rows or 0
+        result["files"] += 1
+        if not staged:
+            expire_staging(bq_client, staging_id)
+            staged = True
+
+    if not result["files"]:
+        raise StagingCheckFailed(
+            f"none of the {len(uris)} file(s) for {date} loaded ({load_errors[0]['message']}); {table_id} was not changed",
+            load_errors, load_errors[0]["error_category"])
+    verification = verify_staging(bq_client, staging_id, manifest, result["files"], len(uris))
+    result["bytes_processed"] += verification["bq_bytes_processed"]
+    if not verification["passed"]:
+        failed = ", ".join(name for name, ok in verification["checks"].items() if not ok)
+        if load_errors and not verification["checks"].get("all_files_loaded", True):
+            raise StagingCheckFailed(
+                f"{staging_id} failed verification ({failed}): {len(load_errors)} file(s) did not load, "
+                f"first {load_errors[0]['message']}; {table_id} was not changed",
+                load_errors, load_errors[0]["error_category"])
+        raise StagingCheckFailed(f"{staging_id} failed verification ({failed}); {table_id} was not changed", load_errors)
+    result["bytes_processed"] += promote_staging(bq_client, staging_id, table_id, run_id, target_exists)
+    return result
+
+
+def load_ndjson_to_bigquery(date: str, run_id: str = None, job=None):
     EVENT_TYPE = "loader_json_completed"
     ORIGIN = "json_loader"
 
     logger.info(f"🚀 Starting BigQuery NDJSON load for {date}...")
     start = time.time()
+    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}"
+    lineage_inputs = [(f"gs://{BUCKET_NAME}", GCS_PREFIX)]
+    post_openlineage("START", ORIGIN, run_id, date, lineage_inputs, [("bigquery", table_id)])
 
     storage_client = storage.Client()
-    bq_client = bigquery.Client()
+    bq_client = new_bq_client()
 
     dataset_id = f"{BQ_PROJECT}.{BQ_DATASET}"
     ensure_dataset_exists(bq_client, dataset_id)
 
-    files = load_manifest(storage_client, date)
+    manifest = load_manifest(storage_client, date)
+    files = manifest.get("files", [])
     if not files:
         logger.info(f"⚠️ No NDJSON files found in manifest for {date} — skipping BigQuery load.")
+        post_openlineage("COMPLETE", ORIGIN, run_id, date, lineage_inputs, [("bigquery", table_id)])
         return 0, 0.0
 
+    uris = [f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/{filename}" for filename in files]
+    loaded = stage_and_promote(bq_client, uris, table_id, run_id, date, manifest, job)
+    count, rows_loaded = loaded["files"], loaded["rows"]
+    logger.info(f"✅ Loaded {rows_loaded} rows from {count} file(s) into {table_id}")
+
+    lineage = record_lineage(storage_client, bq_client, BUCKET_NAME, GCS_PREFIX, date, run_id, table_id, ORIGIN) if count else []
+    post_openlineage("COMPLETE", ORIGIN, run_id, date, lineage_inputs, [("bigquery", table_id, loaded_columns(lineage))])
+
+    duration = round(time.time() - start, 3)
+    logger.info(f"🎉 BigQuery NDJSON load complete: {count} file(s) processed in {duration} seconds.")
+
+    payload = {
+        "event": EVENT_TYPE,
+        "schema_version": EVENT_SCHEMA_VERSION,
+        "origin": ORIGIN,
+        "run_id": run_id,
+        "date": date,
+        "files_processed": count,
+        "bq_bytes_loaded": loaded["bytes_loaded"],
+        "bq_bytes_processed": loaded["bytes_processed"],
+        "lineage_columns": len(lineage),
+        "timestamp": datetime.utcnow().isoformat(),
+        "duration": duration,
+        **reconcile(manifest, rows_loaded),
+    }
+
+    publish_event(payload)
+
+    return count, duration
+
+   
+def load_selftest(date: str, run_id: str = None, job=None):
+    """Loads a trigger self-test's files into BQ_TABLE + "_selftest" rather than BQ_TABLE.
+
+    The scratch table is replaced on every self-test and expires an hour later;
+    no lineage is recorded. The completed event carries the usual row counts so
+    the trigger can check them.
+    """
+    start = time.time()
+    storage_client = storage.Client()
+    bq_client = new_bq_client()
+    ensure_dataset_exists(bq_client, f"{BQ_PROJECT}.{BQ_DATASET}")
+
+    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}_selftest"
+    since = datetime.now(timezone.utc)
+    bq_client.delete_table(table_id, not_found_ok=True)
+    logger.info(f"🩺 Self-test NDJSON load for run {run_id} into {table_id}")
+
+    manifest = load_manifest(storage_client, date)
+    files = manifest.get("files", [])
     count = 0
+    rows_loaded = 0
     for filename in files:
+        if job:
+            job.check()
+            job.progress(files_loaded=count, files_total=len(files), rows_loaded=rows_loaded)
         gcs_uri = f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/{filename}"
-        table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}"
-
-        logger.info(f"⏳ Loading NDJSON from: {gcs_uri}")
-
         job_config = bigquery.LoadJobConfig(
             source_format=bigquery.SourceFormat.NEWLINE_DELIMITED_JSON,
             autodetect=True,
             write_disposition=bigquery.WriteDisposition.WRITE_APPEND,
-            schema_update_options=["ALLOW_FIELD_ADDITION"],
+            schema_update_options=["ALLOW_FIELD_ADDITION"] if count else None,
         )
+        load_job = run_load(bq_client, gcs_uri, table_id, job_config, f"load_{BQ_TABLE}_selftest_{run_id or date}", since)
+        rows_loaded += load_job.output_rows or 0
+        count += 1
 
-        try:
-            load_job = bq_client.load_table_from_uri(gcs_uri, table_id, job_config=job_config)
-            load_job.result()
-            logger.info(f"✅ Loaded: {filename} into {table_id}")
-            count += 1
-        except Exception as e:
-            logger.exception(f"❌ Failed to load {filename}: {e}")
+    if count:
+        table = bq_client.get_table(table_id)
+        table.expires = datetime.now(timezone.utc) + timedelta(hours=1)
+        bq_client.update_table(table, ["expires"])
 
     duration = round(time.time() - start, 3)
-    logger.info(f"🎉 BigQuery NDJSON load complete: {count} file(s) processed in {duration} seconds.")
+    logger.info(f"🩺 Self-test loaded {rows_loaded} rows from {count} file(s) in {duration} seconds")
 
     payload = {
-        "event": EVENT_TYPE,
-        "origin": ORIGIN,
+        "event": "loader_json_completed",
+        "schema_version": EVENT_SCHEMA_VERSION,
+        "origin": "json_loader",
+        "run_id": run_id,
         "date": date,
-        "files_processed": str(count),
+        "selftest": True,
+        "files_processed": count,
         "timestamp": datetime.utcnow().isoformat(),
-        "duration": str(duration)
+        "duration": duration,
+        **reconcile(manifest, rows_loaded),
     }
-
-    if trigger_url:
-        try:
-            resp = requests.post(trigger_url, json=payload, timeout=30)
-            logger.info(f"📤 Notified trigger: {resp.status_code} {resp.text}")
-        except Exception as e:
-            logger.error(f"❌ Failed to notify trigger: {e}")
-    else:
-        logger.warning("⚠️ No valid trigger URL — skipping trigger notification.")
+    publish_event(payload)
 
     return count, duration
 
-   
+
+def notify_failure(date: str, run_id: str, error: Exception):
+    """Reports a failed run to the trigger, which fails the run immediately."""
+    payload = publish.failure_event("loader_json_failed", "json_loader", date, run_id, error, classify_error(error))
+    # The failed files' job ids and BigQuery errors, for what the message only summarises
+    load_errors = getattr(error, "load_errors", None) or ([load_error(error.uri, error)] if isinstance(error, LoadFailed) else [])
+    if load_errors:
+        payload["load_errors"] = load_errors
+    post_openlineage("FAIL", "json_loader", run_id, date, [(f"gs://{BUCKET_NAME}", GCS_PREFIX)],
+                     [("bigquery", f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}")], error)
+    publish_event(payload)
+
+
+# === GCS notifications ===
+# With the trigger's started_by "gcs_notification", a Pub/Sub push subscription
+# on BUCKET_NAME's OBJECT_FINALIZE notifications (object prefix GCS_PREFIX)
+# posts to /pubsub, and the cleaner's {GCS_PREFIX}/{date}/_manifest.json
+# starts the load in place of a call from the trigger. Every message is
+# acknowledged: a failed load is reported to the trigger, which may re-send the
+# stage over HTTP, rather than redelivered.
+def manifest_date(object_name: str):
+    """The date of a cleaned-data manifest object, or None for any other object."""
+    parts = object_name.split("/")
+    if len(parts) == 3 and parts[0] == GCS_PREFIX and parts[2] == "_manifest.json":
+        return parts[1]
+    return None
+
+
+def handle_notification(request):
+    envelope = request.get_json(silent=True) or {}
+    attributes = (envelope.get("message") or {}).get("attributes") or {}
+    if attributes.get("eventType") != "OBJECT_FINALIZE" or attributes.get("bucketId") != BUCKET_NAME:
+        return ("", 204, {})
+    date = manifest_date(attributes.get("objectId", ""))
+    if not date:
+        return ("", 204, {})
+
+    manifest = load_manifest(storage.Client(), date)
+    if not manifest:
+        return ("", 204, {})
+    run_id = manifest.get("run_id")
+    # Pub/Sub delivers at least once; a load already running or done here is not repeated
+    if any(j["date"] == date and j["run_id"] == run_id and j["state"] in ("running", "succeeded") for j in jobs.list()):
+        logger.info(f"📭 Manifest notification for {date} (run {run_id}) already handled")
+        return ("", 204, {})
+
+    logger.info(f"📬 Manifest notification for {date} (run {run_id}) — starting load")
+    job = jobs.start("load", run_id, date)
+    try:
+        if manifest.get("selftest"):
+            load_selftest(date, run_id=run_id, job=job)
+        else:
+            load_ndjson_to_bigquery(date, run_id=run_id, job=job)
+        job.finish()
+    except Exception as e:
+        logger.exception(f"❌ Load started by notification failed: {e}")
+        job.finish(e)
+        notify_failure(date, run_id, e)
+    return ("", 204, {})
+
+
+# === Local Mode ===
+def local_manifest(date: str, folder: str = ""):
+    """The cleaner's manifest for a date under LOCAL_DATA_DIR, or {} if it is missing or incomplete."""
+    path = os.path.join(LOCAL_DATA_DIR, BUCKET_NAME, GCS_PREFIX, date, folder, "_manifest.json")
+    if not os.path.isfile(path):
+        logger.warning(f"⚠️ No manifest found at: {path}")
+        return {}
+    with open(path) as f:
+        manifest = check_manifest(json.load(f), os.path.dirname(path))
+    if manifest["status"] != "complete":
+        logger.info(f"⚠️ Manifest for {date} found but not marked complete.")
+        return {}
+    return manifest
+
+
+def load_local(date: str) -> dict:
+    """Loads a date's NDJSON from LOCAL_DATA_DIR into LOCAL_WAREHOUSE and returns the reconciliation."""
+    manifest = local_manifest(date)
+    if not manifest:
+        raise RuntimeError(f"No complete manifest for {date} under {LOCAL_DATA_DIR}")
+    folder = os.path.join(LOCAL_DATA_DIR, BUCKET_NAME, GCS_PREFIX, date)
+    rows = []
+    for filename in manifest.get("files", []):
+        with open(os.path.join(folder, filename)) as f:
+            rows.extend(json.loads(line) for line in f if line.strip())
+    loaded = write_sqlite(LOCAL_WAREHOUSE, BQ_TABLE, rows)
+    logger.info(f"✅ Loaded {loaded} rows into {LOCAL_WAREHOUSE} table {BQ_TABLE}")
+    return reconcile(manifest, loaded)
+
+
 # === HTTP Entry Point ===
 def http_entry_point(request):
     if request.path == "/health":
         return ("ok", 200, {"Content-Type": "text/plain"})
+
+    if request.path == "/admin/loglevel":
+        return admin_loglevel(request)
+
+    if request.path == "/pubsub":
+        return handle_notification(request)
+
+    if request.path == "/jobs" or request.path.startswith("/jobs/"):
+        return handle_jobs(request)
+
+    if request.path == "/readyz":
+        problems = readiness_problems(BUCKET_NAME, f"{BQ_PROJECT}.{BQ_DATASET}")
+        status = 503 if problems else 200
+        return (json.dumps({"ready": not problems, "problems": problems}), status, {"Content-Type": "application/json"})
+
+    if request.path == "/verify":
+        # ?date= checks each run recorded loading the date; ?run_id= alone, or with it, one run
+        date, run_id = request.args.get("date"), request.args.get("run_id")
+        if not date and not run_id:
+            return problem(request, 400, "invalid-request", "Missing 'date' or 'run_id' query parameter")
+        try:
+            if date:
+                result = verify_date(new_bq_client(), f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}", date, run_id)
+            else:
+                result = verify_run(new_bq_client(), f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}", run_id)
+        except NotFound:
+            return problem(request, 404, "not-found", f"Table not found: {BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}")
+        except LookupError as e:
+            return problem(request, 404, "not-found", str(e))
+        except Exception as e:
+            logger.exception("❌ Verification failed")
+            return problem(request, 500, "internal", f"Verification error: {e}", error_category=classify_error(e))
+        return (json.dumps(result), 200, {"Content-Type": "application/json"})
   
     
     try:
-        request_json = request.get_json()
+        request_json = request.get_json(silent=True)
+        if not request_json:
+            return problem(request, 400, "invalid-json", "Invalid or missing JSON body")
         logger.info(f"📥 Received HTTP request: {request_json}")
 
         date = request_json.get("date")
         if not date:
-            return ("Missing 'date' in request", 400, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-request", "Missing 'date' in request")
 
         start = time.time()
         log_active_credentials()
 
-        ensure_table(BQ_TABLE, date)
-        files_processed, duration = load_ndjson_to_bigquery(date)
+        job = jobs.start("load", request_json.get("run_id"), date)
+        try:
+            if request_json.get("selftest"):
+                files_processed, duration = load_selftest(date, run_id=request_json.get("run_id"), job=job)
+            else:
+                files_processed, duration = load_ndjson_to_bigquery(date, run_id=request_json.get("run_id"), job=job)
+            job.finish()
+        except Exception as e:
+            job.finish(e)
+            notify_failure(date, request_json.get("run_id"), e)
+            raise
         total_duration = round(time.time() - start, 3)
 
         logger.info(f"✅ NDJSON load completed for {date} in {total_duration} seconds")
@@ -230,11 +392,14 @@ def http_entry_point(request):
 
     except Exception as e:
         logger.exception("❌ Loader failed")
-        return (f"❌ Server error: {str(e)}", 500, {"Content-Type": "text/plain"})
+        return problem(request, 500, "internal", f"Server error: {e}", error_category=classify_error(e))
+
 
+wsgi_app = wsgi.app(http_entry_point)
 
-def wsgi_app(environ, start_response):
-    request = Request(environ)
-    response_text, status, headers = http_entry_point(request)
-    response = Response(response_text, status=status, headers=headers)
-    return response(environ, start_response)
\ No newline at end of file
+if __name__ == "__main__":
+    # Local mode: load one date from the command line, e.g. python bq_jsonl_loader.py 2025-01-31
+    import sys
+    if not LOCAL_DATA_DIR or len(sys.argv) != 2:
+        sys.exit("usage: LOCAL_DATA_DIR=DIR python bq_jsonl_loader.py YYYY-MM-DD")
+    logger.info(f"📊 Reconciliation: {load_local(sys.argv[1])}")
@@ -2,7 +2,8 @@
 set -e
 
 echo "=== 🏗️  Building JSON Loader ==="
-cd "$(dirname "$0")"
+# Build from src/ so the shared pyconfigure package is available
+cd "$(dirname "$0")/../.."
 
-docker build -t loader-json .
+docker build -t loader-json -f loader/json/Dockerfile .
 echo "✅ Docker image built: loader-json"
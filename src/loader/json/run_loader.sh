@@ -2,6 +2,6 @@
 docker run --rm --name loader-json \
   --network microservices-net \
   -p 8084:8080 \
-  -v "$HOME/gcp-creds/service-account.json:/app/creds.json" \
+  -v "${GCP_CREDENTIALS_FILE:-$HOME/gcp-creds/service-account.json}:/app/creds.json" \
   -e GOOGLE_APPLICATION_CREDENTIALS=/app/creds.json \
   loader-json
@@ -1,223 +1,584 @@
 import json
-import logging
-import requests
+import uuid
 import time
 import os
+import re
 from google.cloud import bigquery, storage
-from google.auth import default
 from google.cloud.exceptions import NotFound
 import argparse
-from datetime import datetime
-from werkzeug.wrappers import Request, Response
+from datetime import datetime, timedelta, timezone
+from werkzeug.wrappers import Response
+
+# === Shared with the cleaner (see src/pyconfigure) ===
+from pyconfigure import logs, publish, wsgi
+from pyconfigure.bqchecks import LOAD_RUN_ID_COLUMN, verify_run
+from pyconfigure.jobs import handle_jobs, registry as jobs
+from pyconfigure.logs import admin_loglevel, require_admin
+from pyconfigure.manifest import check as check_manifest, load as read_manifest
+from pyconfigure.openlineage import post as post_openlineage
+from pyconfigure.problem import problem
+from pyconfigure.publish import EVENT_SCHEMA_VERSION, publish_event
+from pyconfigure.staging import (
+    BQ_PROJECT, LoadFailed, StagingCheckFailed, classify_error, create_staging, ensure_dataset_exists, expire_staging,
+    load_error, loaded_columns, log_active_credentials, new_bq_client, promote_staging, readiness_problems, reconcile,
+    record_lineage, run_load, staging_table_id, verify_date, verify_staging,
+)
+from pyconfigure.warehouse import write_sqlite
 
 # === Logging Setup (Cloud Native) ===
-logging.basicConfig(
-    level=logging.INFO,
-    format="%(asctime)s — %(levelname)s — %(message)s"
-)
-logger = logging.getLogger("bq_parquet_loader")
+# LOG_LEVEL (debug, info or warn) sets the starting level; /admin/loglevel changes it
+logger = logs.setup("bq_parquet_loader")
+
+# === Local Mode ===
+# With LOCAL_DATA_DIR set the loader runs once from the command line (python bq_parquet_loader.py DATE),
+# reading the cleaner's files from {LOCAL_DATA_DIR}/{BUCKET_NAME}/{GCS_PREFIX}/{date} and
+# appending them to LOCAL_WAREHOUSE, a SQLite file, instead of BigQuery
+LOCAL_DATA_DIR = os.environ.get("LOCAL_DATA_DIR")
+LOCAL_WAREHOUSE = os.environ.get("LOCAL_WAREHOUSE") or os.path.join(LOCAL_DATA_DIR or ".", "warehouse.sqlite")
 
 # === Config from Environment ===
-BUCKET_NAME = os.environ["BUCKET_NAME"]
+BUCKET_NAME = os.environ["BUCKET_NAME"] if not LOCAL_DATA_DIR else os.environ.get("BUCKET_NAME", "cleaned-inspection-data-column-434")
 GCS_PREFIX = os.environ.get("GCS_PREFIX", "clean-data")
-BQ_PROJECT = os.environ.get("BQ_PROJECT", "hygiene-prediction-434")
 BQ_DATASET = os.environ.get("BQ_DATASET", "HygienePredictionColumn")
 BQ_TABLE = os.environ.get("BQ_TABLE", "CleanedInspectionColumn")
-
-# === Trigger URL from environment or SERVICE_CONFIG_B64 ===
-trigger_url = os.environ.get("TRIGGER_URL")
-
-if not trigger_url:
-    config_b64 = os.environ.get("SERVICE_CONFIG_B64")
-    if config_b64:
-        try:
-            decoded = base64.b64decode(config_b64).decode()
-            service_config = json.loads(decoded)
-            trigger_url = service_config.get("trigger", {}).get("url")
-            logger.info(f"📡 Loaded trigger URL from SERVICE_CONFIG_B64: {trigger_url}")
-        except Exception as e:
-            logger.error(f"❌ Failed to parse SERVICE_CONFIG_B64: {e}")
-
-if not trigger_url:
+# Violations the cleaner parsed into (code, description, comment); empty skips them
+BQ_VIOLATIONS_TABLE = os.environ.get("BQ_VIOLATIONS_TABLE", "Violations")
+# BQ_PROJECT, the BigQuery impersonation, LINEAGE_TABLE, the staging checks and the load
+# retries are read by pyconfigure.staging
+
+# === Event publishing ===
+# EVENT_PUBLISHER and the trigger URL are read by pyconfigure.publish
+if not publish.configured():
     logger.warning("⚠️ Trigger URL is not set — downstream notifications will be skipped")
 
 
-
-def ensure_dataset_exists(bq_client, dataset_id: str):
+def load_manifest(storage_client, date: str, folder: str = ""):
+    """The date's manifest, or {} if it is missing, incomplete or can't be read."""
+    manifest_path = f"{GCS_PREFIX}/{date}/{folder}_manifest.json"
     try:
-        bq_client.get_dataset(dataset_id)
-        logger.info(f"✅ Dataset exists: {dataset_id}")
-    except NotFound:
-        dataset = bigquery.Dataset(dataset_id)
-        dataset.location = "US"
-        bq_client.create_dataset(dataset)
-        logger.info(f"🆕 Created dataset: {dataset_id}")
+        return read_manifest(storage_client.bucket(BUCKET_NAME), manifest_path) or {}
     except Exception as e:
-        logger.exception(f"❌ Error checking or creating dataset: {dataset_id}")
-        raise
+        logger.error(f"❌ Failed to parse manifest at {manifest_path}: {e}")
+        return {}
 
-def log_active_credentials():
-    credentials, project = default()
-    logger.info(f"🔐 Using ADC credentials for project: {project}")
-    logger.info(f"Credentials type: {type(credentials)}")
-    if hasattr(credentials, "quota_project_id"):
-        logger.info(f"Quota project ID: {credentials.quota_project_id}")
-    if hasattr(credentials, "service_account_email"):
-        logger.info(f"Service Account: {credentials.service_account_email}")
 
+def lineage_datasets(lineage: list = None, violations_lineage: list = None):
+    """The OpenLineage inputs and outputs of a load: the cleaned folders in, the tables out."""
+    inputs = [(f"gs://{BUCKET_NAME}", GCS_PREFIX)]
+    outputs = [("bigquery", f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}", loaded_columns(lineage or []))]
+    if BQ_VIOLATIONS_TABLE:
+        inputs.append((f"gs://{BUCKET_NAME}", f"{GCS_PREFIX}/violations"))
+        outputs.append(("bigquery", f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_VIOLATIONS_TABLE}", loaded_columns(violations_lineage or []), inputs[1]))
+    return inputs, outputs
 
-def ensure_table_parquet(table_name: str, date: str):
-    """Ensures a BigQuery table exists. Creates it using the first Parquet file if missing."""
-    logger.info(f"🔍 Checking BigQuery table: {table_name}")
 
-    client = bigquery.Client()
-    storage_client = storage.Client()
+# === Blue/green promotion ===
+# With BLUE_GREEN=true a run's checked staging table isn't appended to BQ_TABLE. It is promoted into
+# a new version, {BQ_TABLE}_v{run}, holding the live version's rows plus the run's, and BQ_TABLE is a
+# view over the live version. The view is flipped to the new version only once that has the rows it
+# should, so readers never see a half-built version, and a run that shipped a bad cleaning rule is
+# taken back out at once by pointing the view at the version before (POST /rollback). The newest
+# BLUE_GREEN_KEEP versions (3) are kept for that, along with the live one. A BQ_TABLE that is still a
+# plain table becomes the first version's base and is then replaced by the view. The violations
+# table is appended to as before
+BLUE_GREEN = os.environ.get("BLUE_GREEN", "false").lower() == "true"
+BLUE_GREEN_KEEP = max(2, int(os.environ.get("BLUE_GREEN_KEEP", "3")))
 
-    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{table_name}"
-    dataset_id = f"{BQ_PROJECT}.{BQ_DATASET}"
 
-    ensure_dataset_exists(client, dataset_id)
+def version_table_id(table_id: str, run_id: str, date: str) -> str:
+    """The version of table_id a run is promoted into; a load with no run id gets one for its date."""
+    key = re.sub(r"[^A-Za-z0-9_]", "_", run_id or f"{date}_{uuid.uuid4().hex[:8]}")
+    return f"{table_id}_v{key}"
+
 
+def live_version(bq_client, table_id: str):
+    """Returns the table table_id's rows are read from and whether table_id is already the view:
+    the version the view selects from, table_id itself while it is a plain table, or None."""
     try:
-        client.get_table(table_id)
-        logger.info(f"✅ Table exists: {table_id}")
-        return
+        table = bq_client.get_table(table_id)
     except NotFound:
-        logger.warning(f"🆕 Table not found: {table_id}, attempting to create...")
+        return None, False
+    if table.table_type != "VIEW":
+        return table_id, False
+    match = re.search(r"`([^`]+)`", table.view_query or "")
+    return (match.group(1) if match else None), True
+
+
+def point_view(bq_client, table_id: str, version_id: str, is_view: bool):
+    """Points the view table_id at version_id, replacing the plain table it was before if need be."""
+    if not is_view:
+        # A view can't replace a table in place; the table's rows are in the version by now
+        bq_client.delete_table(table_id, not_found_ok=True)
+    bq_client.query(f"CREATE OR REPLACE VIEW `{table_id}` AS SELECT * FROM `{version_id}`").result()
+    logger.info(f"🔀 {table_id} now reads {version_id}")
+
+
+def list_versions(bq_client, table_id: str) -> list:
+    """The versions of table_id, newest first."""
+    project, dataset, name = table_id.split(".")
+    versions = [t for t in bq_client.list_tables(f"{project}.{dataset}") if t.table_id.startswith(f"{name}_v")]
+    versions.sort(key=lambda t: t.created, reverse=True)
+    return [(f"{project}.{dataset}.{t.table_id}", t.created) for t in versions]
+
+
+def prune_versions(bq_client, table_id: str, live: str):
+    for version_id, _ in list_versions(bq_client, table_id)[BLUE_GREEN_KEEP:]:
+        if version_id != live:
+            bq_client.delete_table(version_id, not_found_ok=True)
+            logger.info(f"🧹 Dropped old version {version_id}")
+
+
+def promote_version(bq_client, staging_id: str, table_id: str, run_id: str, date: str):
+    """Promotes a checked staging table into a new version of table_id and flips the view to it.
+    Raises StagingCheckFailed, leaving the view as it was, if the version doesn't end up with the
+    live version's rows plus the staged ones. Returns the bytes processed and the version."""
+    version_id = version_table_id(table_id, run_id, date)
+    live, is_view = live_version(bq_client, table_id)
+    if live == version_id:
+        raise StagingCheckFailed(f"{version_id} is already live; roll {table_id} back before promoting run {run_id} again")
+    # A retried run builds its version again from the start
+    bq_client.delete_table(version_id, not_found_ok=True)
+    base_rows = 0
+    if live:
+        bq_client.copy_table(live, version_id).result()
+        # Rows the live version already has of this run are replaced, not added to
+        base_rows = (bq_client.get_table(version_id).num_rows or 0) - run_rows(bq_client, version_id, run_id)
+    staged_rows = bq_client.get_table(staging_id).num_rows or 0
+    processed = promote_staging(bq_client, staging_id, version_id, run_id, live is not None)
+
+    rows = bq_client.get_table(version_id).num_rows or 0
+    if rows != base_rows + staged_rows:
+        raise StagingCheckFailed(f"{version_id} has {rows} rows, not {base_rows} + {staged_rows}; {table_id} was not changed")
+    point_view(bq_client, table_id, version_id, is_view)
+    prune_versions(bq_client, table_id, version_id)
+    return processed, version_id
+
+
+def run_rows(bq_client, table_id: str, run_id: str) -> int:
+    """The rows of table_id an earlier promotion of run_id left."""
+    if not run_id or LOAD_RUN_ID_COLUMN not in {f.name for f in bq_client.get_table(table_id).schema}:
+        return 0
+    job_config = bigquery.QueryJobConfig(query_parameters=[bigquery.ScalarQueryParameter("run_id", "STRING", run_id)])
+    rows = bq_client.query(f"SELECT COUNT(*) AS n FROM `{table_id}` WHERE `{LOAD_RUN_ID_COLUMN}` = @run_id", job_config=job_config).result()
+    return next(iter(rows)).n
+
+
+def rollback_version(bq_client, table_id: str, to: str = None) -> dict:
+    """Points the view table_id at version to (a table name, or the suffix after _v), by default
+    the newest version older than the live one, and returns the versions before and after."""
+    live, is_view = live_version(bq_client, table_id)
+    if not is_view:
+        raise ValueError(f"{table_id} is not a blue/green view")
+    versions = [v for v, _ in list_versions(bq_client, table_id)]
+    if to:
+        target = to if "." in to else f"{table_id}_v{to}"
+    else:
+        older = versions[versions.index(live) + 1:] if live in versions else []
+        target = older[0] if older else None
+    if target not in versions:
+        raise LookupError(f"no version {to} of {table_id} to roll back to" if to else f"no version of {table_id} older than {live}")
+    point_view(bq_client, table_id, target, True)
+    logger.warning(f"⏪ Rolled {table_id} back from {live} to {target}")
+    return {"view": table_id, "from": live, "to": target}
+
+
+def stage_and_promote(bq_client, uris: list, table_id: str, run_id: str, date: str, manifest: dict, job=None, checks: bool = True, blue_green: bool = False) -> dict:
+    """Loads uris into the run's staging table for table_id and promotes it once it passes its
+    checks, only the file and row counts when checks is False, into a new version of table_id
+    when blue_green is set. Raises StagingCheckFailed, leaving table_id as it was, if any file
+    fails to load or a check fails. Returns the files, rows and bytes loaded, the bytes the
+    queries processed and, with blue_green, the version promoted."""
+    staging_id = staging_table_id(table_id, run_id, date)
+    since = datetime.now(timezone.utc)
+    target_exists = create_staging(bq_client, table_id, staging_id)
+    staged = target_exists
+    result = {"files": 0, "rows": 0, "bytes_loaded": 0, "bytes_processed": 0}
+    load_errors = []
+    for uri in uris:
+        if job:
+            job.check()
+            job.progress(files_loaded=result["files"], files_total=len(uris), rows_loaded=result["rows"])
+        logger.info(f"⏳ Loading {uri} into {staging_id}")
+        job_config = bigquery.LoadJobConfig(
+            source_format=bigquery.SourceFormat.PARQUET,
+            write_disposition=bigquery.WriteDisposition.WRITE_APPEND,
+            schema_update_options=["ALLOW_FIELD_ADDITION"] if staged else None,
+        )
+        try:
+            load_job = run_load(bq_client, uri, staging_id, job_config, f"load_{staging_id.split('.')[-1]}", since)
+        except Exception as e:
+            logger.exception(f"❌ Failed to load {uri}: {e}")
+            load_errors.append(load_error(uri, e))
+            continue
+        result["bytes_loaded"] += load_job.output_bytes or 0
+        result["rows"] += load_job.output_rows or 0
+        result["files"] += 1
+        if not staged:
+            expire_staging(bq_client, staging_id)
+            staged = True
+
+    if not result["files"]:
+        raise StagingCheckFailed(
+            f"none of the {len(uris)} file(s) for {date} loaded ({load_errors[0]['message']}); {table_id} was not changed",
+            load_errors, load_errors[0]["error_category"])
+    verification = verify_staging(bq_client, staging_id, manifest, result["files"], len(uris), checks)
+    result["bytes_processed"] += verification["bq_bytes_processed"]
+    if not verification["passed"]:
+        failed = ", ".join(name for name, ok in verification["checks"].items() if not ok)
+        if load_errors and not verification["checks"].get("all_files_loaded", True):
+            raise StagingCheckFailed(
+                f"{staging_id} failed verification ({failed}): {len(load_errors)} file(s) did not load, "
+                f"first {load_errors[0]['message']}; {table_id} was not changed",
+                load_errors, load_errors[0]["error_category"])
+        raise StagingCheckFailed(f"{staging_id} failed verification ({failed}); {table_id} was not changed", load_errors)
+    if blue_green:
+        processed, result["version"] = promote_version(bq_client, staging_id, table_id, run_id, date)
+        result["bytes_processed"] += processed
+    else:
+        result["bytes_processed"] += promote_staging(bq_client, staging_id, table_id, run_id, target_exists)
+    return result
+
 
-    files = load_manifest(storage_client, date)
+def load_violations(storage_client, bq_client, date: str, run_id: str = None):
+    """Loads the date's parsed violations into BQ_VIOLATIONS_TABLE through a staging table of their
+    own and returns what stage_and_promote loaded and their lineage. Violations have no
+    inspection-level checks to pass, only that every file loads and the manifest's row count."""
+    manifest = load_manifest(storage_client, date, "violations/")
+    files = manifest.get("files", [])
     if not files:
-        logger.error(f"❌ No files found for {date}, cannot create table.")
-        return
+        return {"files": 0, "rows": 0, "bytes_loaded": 0, "bytes_processed": 0}, []
+    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_VIOLATIONS_TABLE}"
+    uris = [f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/violations/{filename}" for filename in files]
+    loaded = stage_and_promote(bq_client, uris, table_id, run_id, date, manifest, checks=False)
+    logger.info(f"✅ Loaded {loaded['rows']} violations into {table_id}")
+    lineage = record_lineage(storage_client, bq_client, BUCKET_NAME, GCS_PREFIX, date, run_id, table_id, "parquet_loader", "violations/") if loaded["rows"] else []
+    return loaded, lineage
 
-    source_uri = f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/{files[0]}"
-    job_config = bigquery.LoadJobConfig(
-        source_format=bigquery.SourceFormat.PARQUET,
-        autodetect=True
-    )
 
-    logger.info(f"📥 Creating table {table_id} from {source_uri}")
-    load_job = client.load_table_from_uri(source_uri, table_id, job_config=job_config)
-    load_job.result()
-    logger.info(f"✅ Created table: {table_id}")
+def load_parquet_to_bigquery(date: str, run_id: str = None, job=None):
+    logger.info(f"🚀 Starting BigQuery Parquet load for {date}...")
+    start = time.time()
+    post_openlineage("START", "parquet_loader", run_id, date, *lineage_datasets())
 
+    storage_client = storage.Client()
+    bq_client = new_bq_client()
 
+    dataset_id = f"{BQ_PROJECT}.{BQ_DATASET}"
+    ensure_dataset_exists(bq_client, dataset_id)
 
-def load_manifest(storage_client, date: str):
-    manifest_path = f"{GCS_PREFIX}/{date}/_manifest.json"
-    bucket = storage_client.bucket(BUCKET_NAME)
-    manifest_blob = bucket.blob(manifest_path)
+    manifest = load_manifest(storage_client, date)
+    files = manifest.get("files", [])
+    if not files:
+        logger.info(f"⚠️ No files listed in manifest for {date}. Skipping load.")
+        post_openlineage("COMPLETE", "parquet_loader", run_id, date, *lineage_datasets())
+        return 0, 0.0
 
-    if not manifest_blob.exists():
-        logger.warning(f"⚠️ No manifest found at: gs://{BUCKET_NAME}/{manifest_path}")
-        return []
+    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}"
+    uris = [f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/{filename}" for filename in files]
+    loaded = stage_and_promote(bq_client, uris, table_id, run_id, date, manifest, job=job, blue_green=BLUE_GREEN)
+    count, rows_loaded = loaded["files"], loaded["rows"]
+    bytes_loaded, bytes_processed = loaded["bytes_loaded"], loaded["bytes_processed"]
+    logger.info(f"✅ Loaded {rows_loaded} rows from {count} file(s) into {table_id}")
 
-    try:
-        manifest = json.loads(manifest_blob.download_as_text())
-    except Exception as e:
-        logger.error(f"❌ Failed to parse manifest at {manifest_path}: {e}")
-        return []
+    lineage = record_lineage(storage_client, bq_client, BUCKET_NAME, GCS_PREFIX, date, run_id, table_id, "parquet_loader") if count else []
 
-    if not manifest.get("upload_complete", False):
-        logger.info(f"⚠️ Manifest for {date} found but not marked complete.")
-        return []
+    violations_loaded = 0
+    violations_lineage = []
+    if BQ_VIOLATIONS_TABLE:
+        violations, violations_lineage = load_violations(storage_client, bq_client, date, run_id)
+        violations_loaded = violations["rows"]
+        bytes_loaded += violations["bytes_loaded"]
+        bytes_processed += violations["bytes_processed"]
+    post_openlineage("COMPLETE", "parquet_loader", run_id, date, *lineage_datasets(lineage, violations_lineage))
 
-    file_count = len(manifest.get("files", []))
-    logger.info(f"📦 Loaded manifest for {date} with {file_count} file(s).")
+    duration = round(time.time() - start, 3)
+    logger.info(f"🎉 BigQuery Parquet load complete: {count} file(s) processed in {duration} seconds.")
 
-    return manifest.get("files", [])
+    payload = {
+        "event": "loader_parquet_completed",
+        "schema_version": EVENT_SCHEMA_VERSION,
+        "origin": "parquet_loader",
+        "run_id": run_id,
+        "date": date,
+        "files_processed": count,
+        "bq_bytes_loaded": bytes_loaded,
+        "bq_bytes_processed": bytes_processed,
+        "violations_loaded": violations_loaded,
+        "lineage_columns": len(lineage) + len(violations_lineage),
+        **({"table_version": loaded["version"]} if "version" in loaded else {}),
+        "timestamp": datetime.utcnow().isoformat(),
+        "duration": duration,
+        **reconcile(manifest, rows_loaded),
+    }
 
+    publish_event(payload)
 
-def load_parquet_to_bigquery(date: str):
-    logger.info(f"🚀 Starting BigQuery Parquet load for {date}...")
-    start = time.time()
+    return count, duration
+
+def load_selftest(date: str, run_id: str = None, job=None):
+    """Loads a trigger self-test's files into BQ_TABLE + "_selftest" rather than BQ_TABLE.
 
+    The scratch table is replaced on every self-test and expires an hour later;
+    no lineage is recorded. The completed event carries the usual row counts so
+    the trigger can check them.
+    """
+    start = time.time()
     storage_client = storage.Client()
-    bq_client = bigquery.Client()
+    bq_client = new_bq_client()
+    ensure_dataset_exists(bq_client, f"{BQ_PROJECT}.{BQ_DATASET}")
 
-    dataset_id = f"{BQ_PROJECT}.{BQ_DATASET}"
-    ensure_dataset_exists(bq_client, dataset_id)
-
-    files = load_manifest(storage_client, date)
-    if not files:
-        logger.info(f"⚠️ No files listed in manifest for {date}. Skipping load.")
-        return 0, 0.0
+    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}_selftest"
+    since = datetime.now(timezone.utc)
+    bq_client.delete_table(table_id, not_found_ok=True)
+    logger.info(f"🩺 Self-test Parquet load for run {run_id} into {table_id}")
 
+    manifest = load_manifest(storage_client, date)
+    files = manifest.get("files", [])
     count = 0
+    rows_loaded = 0
     for filename in files:
+        if job:
+            job.check()
+            job.progress(files_loaded=count, files_total=len(files), rows_loaded=rows_loaded)
         gcs_uri = f"gs://{BUCKET_NAME}/{GCS_PREFIX}/{date}/{filename}"
-        table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}"
-
-        logger.info(f"⏳ Loading Parquet file into BigQuery: {gcs_uri}")
-
         job_config = bigquery.LoadJobConfig(
             source_format=bigquery.SourceFormat.PARQUET,
             write_disposition=bigquery.WriteDisposition.WRITE_APPEND,
-            schema_update_options=["ALLOW_FIELD_ADDITION"],
+            schema_update_options=["ALLOW_FIELD_ADDITION"] if count else None,
         )
+        load_job = run_load(bq_client, gcs_uri, table_id, job_config, f"load_{BQ_TABLE}_selftest_{run_id or date}", since)
+        rows_loaded += load_job.output_rows or 0
+        count += 1
 
-        try:
-            load_job = bq_client.load_table_from_uri(gcs_uri, table_id, job_config=job_config)
-            load_job.result()
-            logger.info(f"✅ Loaded: {filename} into {table_id}")
-            count += 1
-        except Exception as e:
-            logger.exception(f"❌ Failed to load {filename} into BigQuery: {e}")
+    if count:
+        table = bq_client.get_table(table_id)
+        table.expires = datetime.now(timezone.utc) + timedelta(hours=1)
+        bq_client.update_table(table, ["expires"])
 
     duration = round(time.time() - start, 3)
-    logger.info(f"🎉 BigQuery Parquet load complete: {count} file(s) processed in {duration} seconds.")
+    logger.info(f"🩺 Self-test loaded {rows_loaded} rows from {count} file(s) in {duration} seconds")
 
     payload = {
         "event": "loader_parquet_completed",
+        "schema_version": EVENT_SCHEMA_VERSION,
         "origin": "parquet_loader",
+        "run_id": run_id,
         "date": date,
-        "files_processed": str(count),
+        "selftest": True,
+        "files_processed": count,
         "timestamp": datetime.utcnow().isoformat(),
-        "duration": str(duration),
+        "duration": duration,
+        **reconcile(manifest, rows_loaded),
     }
-
-    if trigger_url:
-        try:
-            logger.info(f"📤 Posting to trigger: {payload}")
-            response = requests.post(trigger_url, json=payload, timeout=30)
-            logger.info(f"📤 Trigger response: {response.status_code} {response.text}")
-        except Exception as e:
-            logger.error(f"❌ Failed to notify trigger: {e}")
-    else:
-        logger.warning("⚠️ No valid trigger URL — skipping trigger notification.")
+    publish_event(payload)
 
     return count, duration
 
+
+def notify_failure(date: str, run_id: str, error: Exception):
+    """Reports a failed run to the trigger, which fails the run immediately."""
+    payload = publish.failure_event("loader_parquet_failed", "parquet_loader", date, run_id, error, classify_error(error))
+    # The failed files' job ids and BigQuery errors, for what the message only summarises
+    load_errors = getattr(error, "load_errors", None) or ([load_error(error.uri, error)] if isinstance(error, LoadFailed) else [])
+    if load_errors:
+        payload["load_errors"] = load_errors
+    post_openlineage("FAIL", "parquet_loader", run_id, date, *lineage_datasets(), error=error)
+    publish_event(payload)
+
+
+# === GCS notifications ===
+# With the trigger's started_by "gcs_notification", a Pub/Sub push subscription
+# on BUCKET_NAME's OBJECT_FINALIZE notifications (object prefix GCS_PREFIX)
+# posts to /pubsub, and the cleaner's {GCS_PREFIX}/{date}/_manifest.json
+# starts the load in place of a call from the trigger. Every message is
+# acknowledged: a failed load is reported to the trigger, which may re-send the
+# stage over HTTP, rather than redelivered.
+def manifest_date(object_name: str):
+    """The date of a cleaned-data manifest object, or None for any other object."""
+    parts = object_name.split("/")
+    if len(parts) == 3 and parts[0] == GCS_PREFIX and parts[2] == "_manifest.json":
+        return parts[1]
+    return None
+
+
+def handle_notification(request):
+    envelope = request.get_json(silent=True) or {}
+    attributes = (envelope.get("message") or {}).get("attributes") or {}
+    if attributes.get("eventType") != "OBJECT_FINALIZE" or attributes.get("bucketId") != BUCKET_NAME:
+        return ("", 204, {})
+    date = manifest_date(attributes.get("objectId", ""))
+    if not date:
+        return ("", 204, {})
+
+    manifest = load_manifest(storage.Client(), date)
+    if not manifest:
+        return ("", 204, {})
+    run_id = manifest.get("run_id")
+    # Pub/Sub delivers at least once; a load already running or done here is not repeated
+    if any(j["date"] == date and j["run_id"] == run_id and j["state"] in ("running", "succeeded") for j in jobs.list()):
+        logger.info(f"📭 Manifest notification for {date} (run {run_id}) already handled")
+        return ("", 204, {})
+
+    logger.info(f"📬 Manifest notification for {date} (run {run_id}) — starting load")
+    job = jobs.start("load", run_id, date)
+    try:
+        if manifest.get("selftest"):
+            load_selftest(date, run_id=run_id, job=job)
+        else:
+            load_parquet_to_bigquery(date, run_id=run_id, job=job)
+        job.finish()
+    except Exception as e:
+        logger.exception(f"❌ Load started by notification failed: {e}")
+        job.finish(e)
+        notify_failure(date, run_id, e)
+    return ("", 204, {})
+
+
+# === Local Mode ===
+def local_manifest(date: str, folder: str = ""):
+    """The cleaner's manifest for a date under LOCAL_DATA_DIR, or {} if it is missing or incomplete."""
+    path = os.path.join(LOCAL_DATA_DIR, BUCKET_NAME, GCS_PREFIX, date, folder, "_manifest.json")
+    if not os.path.isfile(path):
+        logger.warning(f"⚠️ No manifest found at: {path}")
+        return {}
+    with open(path) as f:
+        manifest = check_manifest(json.load(f), os.path.dirname(path))
+    if manifest["status"] != "complete":
+        logger.info(f"⚠️ Manifest for {date} found but not marked complete.")
+        return {}
+    return manifest
+
+
+def read_local_parquet(date: str, folder: str = "") -> tuple:
+    """The manifest and rows of a date's Parquet files under LOCAL_DATA_DIR."""
+    import polars as pl  # only local mode reads the files itself
+    manifest = local_manifest(date, folder)
+    directory = os.path.join(LOCAL_DATA_DIR, BUCKET_NAME, GCS_PREFIX, date, folder)
+    rows = []
+    for filename in manifest.get("files", []):
+        rows.extend(pl.read_parquet(os.path.join(directory, filename)).to_dicts())
+    return manifest, rows
+
+
+def load_local(date: str) -> dict:
+    """Loads a date's Parquet, and its violations, from LOCAL_DATA_DIR into LOCAL_WAREHOUSE and
+    returns the reconciliation."""
+    manifest, rows = read_local_parquet(date)
+    if not manifest:
+        raise RuntimeError(f"No complete manifest for {date} under {LOCAL_DATA_DIR}")
+    loaded = write_sqlite(LOCAL_WAREHOUSE, BQ_TABLE, rows)
+    logger.info(f"✅ Loaded {loaded} rows into {LOCAL_WAREHOUSE} table {BQ_TABLE}")
+    if BQ_VIOLATIONS_TABLE:
+        _, violations = read_local_parquet(date, "violations/")
+        logger.info(f"✅ Loaded {write_sqlite(LOCAL_WAREHOUSE, BQ_VIOLATIONS_TABLE, violations)} violations into {LOCAL_WAREHOUSE} table {BQ_VIOLATIONS_TABLE}")
+    return reconcile(manifest, loaded)
+
+
+# === Blue/green versions ===
+def handle_versions(request):
+    """GET /versions lists BQ_TABLE's blue/green versions; POST /rollback points the view at the
+    version before the live one, or at {"version": ...} (needs ADMIN_TOKEN in X-Admin-Token)."""
+    table_id = f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}"
+    bq_client = new_bq_client()
+    if request.path == "/versions":
+        if request.method != "GET":
+            return problem(request, 405, "method-not-allowed", "Only GET allowed")
+        live, is_view = live_version(bq_client, table_id)
+        versions = [{"table": v, "created": created.isoformat(), "live": v == live}
+                    for v, created in list_versions(bq_client, table_id)]
+        body = {"view": table_id if is_view else None, "live": live, "versions": versions}
+        return (json.dumps(body), 200, {"Content-Type": "application/json"})
+
+    if request.method != "POST":
+        return problem(request, 405, "method-not-allowed", "Only POST allowed")
+    denied = require_admin(request, "Rollback is disabled")
+    if denied:
+        return denied
+    body = request.get_json(silent=True) or {}
+    try:
+        result = rollback_version(bq_client, table_id, body.get("version"))
+    except ValueError as e:
+        return problem(request, 409, "conflict", str(e))
+    except LookupError as e:
+        return problem(request, 404, "not-found", str(e))
+    return (json.dumps(result), 200, {"Content-Type": "application/json"})
+
+
 def http_entry_point(request):
     """Cloud Run / HTTP function entry point."""
     if request.path == "/health":
         return ("ok", 200, {"Content-Type": "text/plain"})
 
+    if request.path == "/admin/loglevel":
+        return admin_loglevel(request)
+
+    if request.path == "/pubsub":
+        return handle_notification(request)
+
+    if request.path == "/jobs" or request.path.startswith("/jobs/"):
+        return handle_jobs(request)
+
+    if request.path == "/readyz":
+        problems = readiness_problems(BUCKET_NAME, f"{BQ_PROJECT}.{BQ_DATASET}")
+        status = 503 if problems else 200
+        return (json.dumps({"ready": not problems, "problems": problems}), status, {"Content-Type": "application/json"})
+
+    if request.path in ("/versions", "/rollback"):
+        return handle_versions(request)
+
+    if request.path == "/verify":
+        # ?date= checks each run recorded loading the date; ?run_id= alone, or with it, one run
+        date, run_id = request.args.get("date"), request.args.get("run_id")
+        if not date and not run_id:
+            return problem(request, 400, "invalid-request", "Missing 'date' or 'run_id' query parameter")
+        try:
+            if date:
+                result = verify_date(new_bq_client(), f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}", date, run_id)
+            else:
+                result = verify_run(new_bq_client(), f"{BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}", run_id)
+        except NotFound:
+            return problem(request, 404, "not-found", f"Table not found: {BQ_PROJECT}.{BQ_DATASET}.{BQ_TABLE}")
+        except LookupError as e:
+            return problem(request, 404, "not-found", str(e))
+        except Exception as e:
+            logger.exception("❌ Verification failed")
+            return problem(request, 500, "internal", f"Verification error: {e}", error_category=classify_error(e))
+        return (json.dumps(result), 200, {"Content-Type": "application/json"})
+
     try:
-        request_json = request.get_json()
+        request_json = request.get_json(silent=True)
         if not request_json:
-            return ("Invalid or missing JSON body", 400, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-json", "Invalid or missing JSON body")
 
         logger.info(f"📥 Received HTTP request: {request_json}")
         date = request_json.get("date")
         if not date:
-            return ("Missing 'date' in request JSON", 400, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-request", "Missing 'date' in request JSON")
 
         # Optional: strict format check (same as cleaner)
         try:
             datetime.strptime(date, "%Y-%m-%d")
         except ValueError:
-            return ("Invalid 'date' format. Use YYYY-MM-DD.", 400, {"Content-Type": "text/plain"})
+            return problem(request, 400, "invalid-request", "Invalid 'date' format. Use YYYY-MM-DD.")
 
         log_active_credentials()
-        ensure_table_parquet(BQ_TABLE, date)
-        files_processed, duration = load_parquet_to_bigquery(date)
+        job = jobs.start("load", request_json.get("run_id"), date)
+        try:
+            if request_json.get("selftest"):
+                files_processed, duration = load_selftest(date, run_id=request_json.get("run_id"), job=job)
+            else:
+                files_processed, duration = load_parquet_to_bigquery(date, run_id=request_json.get("run_id"), job=job)
+            job.finish()
+        except Exception as e:
+            job.finish(e)
+            notify_failure(date, request_json.get("run_id"), e)
+            raise
 
         return (f"✅ Parquet load complete for {date}", 200, {"Content-Type": "text/plain"})
 
     except Exception as e:
         logger.exception("❌ HTTP request failed")
-        return (f"❌ Server error: {str(e)}", 500, {"Content-Type": "text/plain"})
+        return problem(request, 500, "internal", f"Server error: {e}", error_category=classify_error(e))
 
 def health_check(environ, start_response):
     response = Response("OK", status=200, content_type="text/plain")
@@ -232,11 +593,7 @@ def health_check(environ, start_response):
 #         response = Response(response_text, status=status, headers=headers)
 #         return response(environ, start_response)
 
-def wsgi_app(environ, start_response):
-    request = Request(environ)
-    response_text, status, headers = http_entry_point(request)
-    response = Response(response_text, status=status, headers=headers)
-    return response(environ, start_response)
+wsgi_app = wsgi.app(http_entry_point)
 
 
 # def wsgi_app(environ, start_response):
@@ -247,3 +604,11 @@ def wsgi_app(environ, start_response):
 # Trigger redeploy for demo
 # Trigger CI/CD test
 # Trigger redeploy for demo
+
+
+if __name__ == "__main__":
+    # Local mode: load one date from the command line, e.g. python bq_parquet_loader.py 2025-01-31
+    import sys
+    if not LOCAL_DATA_DIR or len(sys.argv) != 2:
+        sys.exit("usage: LOCAL_DATA_DIR=DIR python bq_parquet_loader.py YYYY-MM-DD")
+    logger.info(f"📊 Reconciliation: {load_local(sys.argv[1])}")
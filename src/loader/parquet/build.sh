@@ -2,7 +2,8 @@
 set -e
 
 echo "=== 🏗️  Building Parquet Loader ==="
-cd "$(dirname "$0")"
+# Build from src/ so the shared pyconfigure package is available
+cd "$(dirname "$0")/../.."
 
-docker build -t loader-parquet .
+docker build -t loader-parquet -f loader/parquet/Dockerfile .
 echo "✅ Docker image built: loader-parquet"
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"configure/devenv"
+	"configure/gcp"
+	"configure/schemas"
+)
+
+// statement is one DDL statement external runs, named for its report.
+type statement struct {
+	Name, SQL string
+}
+
+// Cleaned date folders, clean-data/YYYY-MM-DD/
+var cleanedFolder = regexp.MustCompile(`^clean-data/\d{4}-\d{2}-\d{2}/$`)
+
+// external creates or refreshes BigQuery external tables over the files the
+// pipeline lands in Cloud Storage, and curated views over them, so the data
+// can be queried before (or without) the loaders:
+//
+//	raw_inspections             the extractor's raw NDJSON by source_date and
+//	                            extract_date (PARTITION_BY_SOURCE_DATE on the extractor)
+//	cleaned_inspections_row     the cleaner's NDJSON, one URI per date folder
+//	cleaned_inspections_column  the cleaner's Parquet, one URI per date folder
+//	raw_latest_extraction       view: the raw rows of the latest extraction
+//	inspections                 view: the latest cleaned copy of each inspection
+//	daily_results               view: inspections per day and result
+//
+// The cleaned tables list each date folder's chunk files rather than a
+// wildcard over the bucket, which would take in manifests, lineage and
+// violations, so run it again after new dates land. Tables with no files
+// yet, and the views over them, are skipped.
+func external(args []string) int {
+	fs := flag.NewFlagSet("external", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("SERVICE_CONFIG_PATH"), "service config (services.json) whose bootstrap project and location to use; defaults to SERVICE_CONFIG_B64")
+	project := fs.String("project", "", "project of the dataset (default: the config's bootstrap project, else "+defaultProject+")")
+	location := fs.String("location", "", "location of the dataset, which must match the buckets' (default: the config's bootstrap location, else US)")
+	dataset := fs.String("dataset", "Landing", "dataset the tables and views go in")
+	rawBucket := fs.String("raw-bucket", envOr("RAW_BUCKET", "raw-inspection-data-434"), "the extractor's bucket")
+	rowBucket := fs.String("row-bucket", envOr("CLEAN_ROW_BUCKET_NAME", "cleaned-inspection-data-row-434"), "the cleaner's NDJSON bucket")
+	columnBucket := fs.String("column-bucket", envOr("CLEAN_COL_BUCKET_NAME", "cleaned-inspection-data-column-434"), "the cleaner's Parquet bucket")
+	dryRun := fs.Bool("dry-run", false, "print the statements without running them")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	if *project == "" {
+		*project = defaultProject
+		if cfg != nil && cfg.Bootstrap.Project != "" {
+			*project = cfg.Bootstrap.Project
+		}
+	}
+	if *location == "" {
+		*location = "US"
+		if cfg != nil && cfg.Bootstrap.Location != "" {
+			*location = cfg.Bootstrap.Location
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	token, err := devenv.AccessToken(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n   → run: gcloud auth application-default login (or set GCP_ACCESS_TOKEN)\n", err)
+		return 1
+	}
+	// configure/gcp authenticates with GCP_ACCESS_TOKEN off Cloud Run
+	os.Setenv("GCP_ACCESS_TOKEN", token)
+
+	stmts, skipped, err := externalStatements(ctx, *project, *location, *dataset, *rawBucket, *rowBucket, *columnBucket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	for _, s := range skipped {
+		fmt.Printf("⏭️  %s\n", s)
+	}
+	failed := 0
+	for _, s := range stmts {
+		if *dryRun {
+			fmt.Printf("-- %s\n%s;\n\n", s.Name, s.SQL)
+			continue
+		}
+		if err := gcp.RunQuery(ctx, *project, *location, s.SQL); err != nil {
+			fmt.Printf("❌ %-28s %v\n", s.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("✅ %s\n", s.Name)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "\n❌ %d of %d statements failed\n", failed, len(stmts))
+		return 1
+	}
+	return 0
+}
+
+// externalStatements builds the DDL for the tables whose files exist and the
+// views over them, and says what it left out.
+func externalStatements(ctx context.Context, project, location, dataset, rawBucket, rowBucket, columnBucket string) (stmts []statement, skipped []string, err error) {
+	name := func(table string) string { return fmt.Sprintf("`%s.%s.%s`", project, dataset, table) }
+	stmts = append(stmts, statement{dataset, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS `%s.%s` OPTIONS(location=%q)", project, dataset, location)})
+
+	partitions, err := gcp.ListPrefixes(ctx, rawBucket, "raw-data/source_date=")
+	if err != nil {
+		return nil, nil, fmt.Errorf("list gs://%s/raw-data: %w", rawBucket, err)
+	}
+	if len(partitions) > 0 {
+		// source_date stays a STRING so rows without one (Hive's default partition) still read
+		stmts = append(stmts,
+			statement{"raw_inspections", fmt.Sprintf("CREATE OR REPLACE EXTERNAL TABLE %s\n"+
+				"WITH PARTITION COLUMNS (source_date STRING, extract_date DATE)\n"+
+				"OPTIONS (\n  format = 'NEWLINE_DELIMITED_JSON',\n  uris = ['gs://%s/raw-data/source_date=*'],\n"+
+				"  hive_partition_uri_prefix = 'gs://%s/raw-data',\n  ignore_unknown_values = true\n)",
+				name("raw_inspections"), rawBucket, rawBucket)},
+			statement{"raw_latest_extraction", fmt.Sprintf("CREATE OR REPLACE VIEW %s AS\n"+
+				"SELECT * FROM %s\nWHERE extract_date = (SELECT MAX(extract_date) FROM %s)",
+				name("raw_latest_extraction"), name("raw_inspections"), name("raw_inspections"))},
+		)
+	} else {
+		skipped = append(skipped, fmt.Sprintf("raw_inspections: no gs://%s/raw-data/source_date=* partitions (set PARTITION_BY_SOURCE_DATE=true on the extractor)", rawBucket))
+	}
+
+	rowURIs, err := cleanedURIs(ctx, rowBucket, "json")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rowURIs) > 0 {
+		cols := make([]string, len(schemas.CleanedInspectionRow))
+		for i, c := range schemas.CleanedInspectionRow {
+			cols[i] = "  " + c.DDL()
+		}
+		stmts = append(stmts,
+			statement{"cleaned_inspections_row", fmt.Sprintf("CREATE OR REPLACE EXTERNAL TABLE %s (\n%s\n)\n"+
+				"OPTIONS (\n  format = 'NEWLINE_DELIMITED_JSON',\n  uris = [%s],\n  ignore_unknown_values = true\n)",
+				name("cleaned_inspections_row"), strings.Join(cols, ",\n"), strings.Join(rowURIs, ", "))},
+			// A date cleaned again replaces its files, so the latest folder holding an inspection wins
+			statement{"inspections", fmt.Sprintf("CREATE OR REPLACE VIEW %s AS\n"+
+				"SELECT * EXCEPT (copy) FROM (\n"+
+				"  SELECT *, ROW_NUMBER() OVER (PARTITION BY inspection_id ORDER BY cleaned_date DESC) AS copy\n"+
+				"  FROM (SELECT *, DATE(REGEXP_EXTRACT(_FILE_NAME, r'/clean-data/(\\d{4}-\\d{2}-\\d{2})/')) AS cleaned_date FROM %s)\n"+
+				")\nWHERE copy = 1",
+				name("inspections"), name("cleaned_inspections_row"))},
+			statement{"daily_results", fmt.Sprintf("CREATE OR REPLACE VIEW %s AS\n"+
+				"SELECT DATE(inspection_date) AS inspection_day, results, COUNT(*) AS inspections\n"+
+				"FROM %s\nGROUP BY inspection_day, results",
+				name("daily_results"), name("inspections"))},
+		)
+	} else {
+		skipped = append(skipped, fmt.Sprintf("cleaned_inspections_row, inspections, daily_results: no cleaned dates in gs://%s/clean-data", rowBucket))
+	}
+
+	columnURIs, err := cleanedURIs(ctx, columnBucket, "parquet")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(columnURIs) > 0 {
+		stmts = append(stmts, statement{"cleaned_inspections_column", fmt.Sprintf("CREATE OR REPLACE EXTERNAL TABLE %s\n"+
+			"OPTIONS (\n  format = 'PARQUET',\n  uris = [%s]\n)",
+			name("cleaned_inspections_column"), strings.Join(columnURIs, ", "))})
+	} else {
+		skipped = append(skipped, fmt.Sprintf("cleaned_inspections_column: no cleaned dates in gs://%s/clean-data", columnBucket))
+	}
+	return stmts, skipped, nil
+}
+
+// cleanedURIs returns a quoted URI for the chunk files of each date folder
+// the cleaner wrote to bucket.
+func cleanedURIs(ctx context.Context, bucket, ext string) ([]string, error) {
+	folders, err := gcp.ListPrefixes(ctx, bucket, "clean-data/")
+	if err != nil {
+		return nil, fmt.Errorf("list gs://%s/clean-data: %w", bucket, err)
+	}
+	var uris []string
+	for _, f := range folders {
+		if cleanedFolder.MatchString(f) {
+			uris = append(uris, fmt.Sprintf("'gs://%s/%soffset_*.%s'", bucket, f, ext))
+		}
+	}
+	return uris, nil
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,13 @@
+module pipelinectl
+
+go 1.22.3
+
+require (
+	app v0.0.0-00010101000000-000000000000
+	configure v0.0.0-00010101000000-000000000000
+)
+
+replace (
+	app => ../trigger
+	configure => ../configure
+)
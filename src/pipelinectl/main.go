@@ -0,0 +1,245 @@
+// Command pipelinectl is the developer's command line for the pipeline.
+//
+//	pipelinectl doctor [-data-dir DIR] [-config FILE] [-cloud] [-offline]
+//	pipelinectl external [-config FILE] [-project P] [-location L] [-dataset D] [-dry-run]
+//	pipelinectl synth [-rows N] [-seed S] [-violations V] [-fail-rate P] [-missing-rate P] [-serve ADDR | -date D [-gcs]]
+//
+// doctor checks this machine and what the pipeline talks to — tools,
+// environment variables, credentials, bucket and table access, the
+// services in the service config and the Socrata API — and prints a
+// pass/fail report with a hint for each failure. It also creates the local
+// data directories. It exits non-zero when a required check fails; -cloud
+// makes gcloud and credentials required, -offline skips the network checks.
+//
+// external creates or refreshes BigQuery external tables over the raw and
+// cleaned files in Cloud Storage, and curated views over them, so landed
+// data can be queried without waiting for the loaders; see external.go.
+//
+// synth generates fake inspections and writes them to a date's raw-data
+// folder, locally or in the raw bucket, or serves them as a mock Socrata
+// endpoint for the extractor; see synth.go.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"app/configure"
+	"configure/devenv"
+)
+
+const defaultProject = "hygiene-prediction-434"
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pipelinectl doctor [-data-dir DIR] [-config FILE] [-cloud] [-offline]")
+	fmt.Fprintln(os.Stderr, "       pipelinectl external [-config FILE] [-project P] [-location L] [-dataset D] [-dry-run]")
+	fmt.Fprintln(os.Stderr, "       pipelinectl synth [-rows N] [-seed S] [-violations V] [-fail-rate P] [-missing-rate P] [-serve ADDR | -date D [-gcs]]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "doctor":
+		os.Exit(doctor(os.Args[2:]))
+	case "external":
+		os.Exit(external(os.Args[2:]))
+	case "synth":
+		os.Exit(synth(os.Args[2:]))
+	default:
+		usage()
+	}
+}
+
+// report prints checks section by section and tallies them.
+type report struct {
+	passed, warned, failed int
+}
+
+func (r *report) section(title string, checks []devenv.Check) {
+	fmt.Printf("\n== %s ==\n", title)
+	for _, c := range checks {
+		mark := "✅"
+		switch {
+		case c.OK:
+			r.passed++
+		case c.Required:
+			mark = "❌"
+			r.failed++
+		default:
+			mark = "⚠️ "
+			r.warned++
+		}
+		fmt.Printf("%s %-24s %s\n", mark, c.Name, c.Detail)
+		if !c.OK && c.Hint != "" {
+			fmt.Printf("   %-24s → %s\n", "", c.Hint)
+		}
+	}
+}
+
+func (r *report) skip(title, why string) {
+	fmt.Printf("\n== %s ==\n⏭️  skipped: %s\n", title, why)
+}
+
+func doctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	defaultDir, err := devenv.DataDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	dataDir := fs.String("data-dir", defaultDir, "root of the local bucket directories (LOCAL_DATA_DIR)")
+	configPath := fs.String("config", os.Getenv("SERVICE_CONFIG_PATH"), "service config (services.json) whose services, buckets and project to check; defaults to SERVICE_CONFIG_B64")
+	cloud := fs.Bool("cloud", false, "also require gcloud and credentials, for working against GCP")
+	offline := fs.Bool("offline", false, "skip the checks that need the network")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var r report
+	r.section("Machine", devenv.Doctor(*dataDir, *cloud))
+	r.section("Environment", devenv.CheckEnv())
+
+	cfg, cfgErr := loadConfig(*configPath)
+	if cfgErr != nil {
+		r.section("Service config", []devenv.Check{{Name: "config", Required: true, Detail: cfgErr.Error(), Hint: "pass -config with a valid services.json"}})
+	}
+
+	if *offline {
+		r.skip("Network", "-offline")
+	} else {
+		r.section("Socrata API", []devenv.Check{devenv.CheckSocrata(ctx)})
+		gcpChecks(ctx, &r, cfg, *cloud)
+		serviceChecks(ctx, &r, cfg)
+	}
+
+	fmt.Printf("\n%d passed, %d warnings, %d failed\n", r.passed, r.warned, r.failed)
+	fmt.Println()
+	fmt.Println("# For a local run (make local):")
+	fmt.Printf("LOCAL_DATA_DIR=%s\n", *dataDir)
+	if creds, err := devenv.FindCredentials(); err == nil {
+		fmt.Println("# For docker-compose and the run_*.sh scripts:")
+		fmt.Printf("GCP_CREDENTIALS_FILE=%s\n", creds.Path)
+	}
+
+	if r.failed > 0 {
+		fmt.Fprintln(os.Stderr, "\n❌ Some required checks failed")
+		return 1
+	}
+	return 0
+}
+
+// loadConfig reads the service config from path, else SERVICE_CONFIG_B64.
+// It returns nil, nil when neither is given.
+func loadConfig(path string) (*configure.ServiceURLs, error) {
+	if path != "" {
+		return configure.LoadServiceConfig(path)
+	}
+	b64 := os.Getenv("SERVICE_CONFIG_B64")
+	if b64 == "" {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("SERVICE_CONFIG_B64: %w", err)
+	}
+	var cfg configure.ServiceURLs
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("SERVICE_CONFIG_B64: %w", err)
+	}
+	return &cfg, nil
+}
+
+// gcpChecks validates the credentials, then checks bucket and table access
+// with them. Failures are only required with -cloud.
+func gcpChecks(ctx context.Context, r *report, cfg *configure.ServiceURLs, cloud bool) {
+	token, err := devenv.AccessToken(ctx)
+	if err != nil {
+		r.section("Google Cloud", []devenv.Check{{
+			Name:     "access token",
+			Required: cloud,
+			Detail:   err.Error(),
+			Hint:     "run: gcloud auth application-default login (or set GCP_ACCESS_TOKEN)",
+		}})
+		return
+	}
+	tokenCheck := devenv.CheckToken(ctx, token)
+	tokenCheck.Required = cloud
+	if !tokenCheck.OK {
+		r.section("Google Cloud", []devenv.Check{tokenCheck})
+		return
+	}
+	// configure/gcp authenticates with GCP_ACCESS_TOKEN off Cloud Run
+	os.Setenv("GCP_ACCESS_TOKEN", token)
+
+	project := defaultProject
+	if cfg != nil && cfg.Bootstrap.Project != "" {
+		project = cfg.Bootstrap.Project
+	}
+	checks := []devenv.Check{tokenCheck}
+	for _, bucket := range buckets(cfg) {
+		checks = append(checks, devenv.CheckBucket(ctx, bucket))
+	}
+	for _, t := range devenv.Tables {
+		checks = append(checks, devenv.CheckTable(ctx, project, t))
+	}
+	for i := range checks {
+		checks[i].Required = checks[i].Required && cloud
+	}
+	r.section("Google Cloud ("+project+")", checks)
+}
+
+// buckets are the buckets to check: the service config's bootstrap buckets,
+// else those the services' environment names, else the defaults.
+func buckets(cfg *configure.ServiceURLs) []string {
+	if cfg != nil && len(cfg.Bootstrap.Buckets) > 0 {
+		return cfg.Bootstrap.Buckets
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, env := range []string{"BUCKET_NAME", "RAW_BUCKET", "CLEAN_ROW_BUCKET_NAME", "CLEAN_COL_BUCKET_NAME"} {
+		if b := os.Getenv(env); b != "" && !seen[b] {
+			seen[b] = true
+			names = append(names, b)
+		}
+	}
+	if len(names) == 0 {
+		return devenv.LocalBuckets
+	}
+	return names
+}
+
+// serviceChecks pings the health endpoint of every service in the config.
+func serviceChecks(ctx context.Context, r *report, cfg *configure.ServiceURLs) {
+	if cfg == nil {
+		r.skip("Services", "no service config (-config, SERVICE_CONFIG_PATH or SERVICE_CONFIG_B64)")
+		return
+	}
+	endpoints := cfg.Endpoints()
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var checks []devenv.Check
+	for _, name := range names {
+		e := endpoints[name]
+		healthURL, err := e.HealthURL()
+		if err != nil {
+			checks = append(checks, devenv.Check{Name: name, Required: !e.Optional, Detail: err.Error(), Hint: "fix its url in the service config"})
+			continue
+		}
+		checks = append(checks, devenv.CheckService(ctx, name, healthURL, e.Audience, !e.Optional))
+	}
+	r.section("Services", checks)
+}
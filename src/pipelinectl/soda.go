@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"configure/socrata"
+)
+
+// The one $where the mock understands: the extractor's sample filter
+var moduloFilter = regexp.MustCompile(`^\s*inspection_id\s*%\s*(\d+)\s*=\s*(\d+)\s*$`)
+
+// serveSODA serves records on addr the way SODA serves the inspections
+// dataset, for any path: pages by $limit (default 1000) and $offset,
+// $select=count(*), the sample $where, and an ETag of each page's content so
+// the extractor's conditional requests get a 304 for an unchanged page.
+// Anything else it doesn't understand is answered with a SODA query error.
+func serveSODA(addr string, records []socrata.Inspection) error {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		rows := records
+		if where := q.Get("$where"); where != "" {
+			m := moduloFilter.FindStringSubmatch(where)
+			if m == nil {
+				sodaError(w, "query.soql.unsupported", "the mock only supports $where=inspection_id % N = K")
+				return
+			}
+			n, _ := strconv.Atoi(m[1])
+			k, _ := strconv.Atoi(m[2])
+			if n == 0 {
+				sodaError(w, "query.soql.type-mismatch", "modulo by zero")
+				return
+			}
+			rows = nil
+			for _, rec := range records {
+				if id, _ := strconv.Atoi(rec.InspectionID); id%n == k {
+					rows = append(rows, rec)
+				}
+			}
+		}
+
+		switch sel := q.Get("$select"); {
+		case strings.EqualFold(strings.ReplaceAll(sel, " ", ""), "count(*)"):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode([]map[string]string{{"count": strconv.Itoa(len(rows))}})
+			return
+		case sel != "":
+			sodaError(w, "query.soql.unsupported", "the mock only supports $select=count(*)")
+			return
+		}
+
+		limit, offset := 1000, 0
+		var err error
+		if v := q.Get("$limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+		}
+		if v := q.Get("$offset"); v != "" && err == nil {
+			offset, err = strconv.Atoi(v)
+		}
+		if err != nil || limit < 0 || offset < 0 {
+			sodaError(w, "query.soql.invalid-limit", "$limit and $offset must be non-negative integers")
+			return
+		}
+		page := rows[min(offset, len(rows)):min(offset+limit, len(rows))]
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(page)
+		body := buf.Bytes()
+		sum := sha256.Sum256(body)
+		etag := fmt.Sprintf(`"%x"`, sum[:8])
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	host := addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	log.Printf("🧪 Serving the synthetic inspections on %s; point the extractor at it with SOCRATA_URL=http://%s/resource/qizy-d2wf.json", addr, host)
+	return http.ListenAndServe(addr, handler)
+}
+
+func sodaError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{"error": true, "code": code, "message": message})
+}
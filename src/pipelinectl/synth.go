@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"configure/devenv"
+	"configure/gcp"
+	"configure/manifest"
+	"configure/socrata"
+)
+
+// synthConfig shapes the generated inspections.
+type synthConfig struct {
+	Rows int
+	Seed int64
+	// Inspection dates run evenly from From to To, in ID order
+	From, To time.Time
+	// Mean violations listed on a failed inspection; passes list fewer
+	Violations float64
+	// Share of inspections that fail
+	FailRate float64
+	// Chance that each optional field of a row is left out, as SODA leaves out empty columns
+	MissingRate float64
+}
+
+// synth generates realistic fake inspections and either writes them to a
+// date's raw-data folder, as the extractor would, or serves them as a mock
+// Socrata endpoint the extractor reads with SOCRATA_URL, so load and
+// correctness tests don't go to the public API. The same flags generate
+// the same rows.
+func synth(args []string) int {
+	fs := flag.NewFlagSet("synth", flag.ExitOnError)
+	rows := fs.Int("rows", 10000, "inspections to generate")
+	seed := fs.Int64("seed", 1, "random seed; the same seed and flags give the same rows")
+	from := fs.String("from", "2018-07-01", "earliest inspection date")
+	to := fs.String("to", time.Now().Format("2006-01-02"), "latest inspection date")
+	violations := fs.Float64("violations", 4, "mean violations listed on a failed inspection")
+	failRate := fs.Float64("fail-rate", 0.2, "share of inspections that fail")
+	missingRate := fs.Float64("missing-rate", 0.02, "chance each optional field of a row is left out")
+	serve := fs.String("serve", "", "serve the rows as a mock Socrata endpoint on this address (e.g. :8089) instead of writing them")
+	date := fs.String("date", time.Now().Format("2006-01-02"), "date folder to write, raw-data/{date}/")
+	bucket := fs.String("bucket", envOr("BUCKET_NAME", "raw-inspection-data"), "raw bucket to write to")
+	toGCS := fs.Bool("gcs", false, "write to gs://{bucket} rather than the local data directory")
+	chunk := fs.Int("chunk", 1000, "rows per chunk file")
+	fs.Parse(args)
+
+	cfg := synthConfig{Rows: *rows, Seed: *seed, Violations: *violations, FailRate: *failRate, MissingRate: *missingRate}
+	var err error
+	if cfg.From, err = time.Parse("2006-01-02", *from); err == nil {
+		cfg.To, err = time.Parse("2006-01-02", *to)
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "❌ -from/-to: %v\n", err)
+		return 2
+	case cfg.Rows < 1 || *chunk < 1:
+		fmt.Fprintln(os.Stderr, "❌ -rows and -chunk must be at least 1")
+		return 2
+	case cfg.To.Before(cfg.From):
+		fmt.Fprintln(os.Stderr, "❌ -to is before -from")
+		return 2
+	case cfg.FailRate < 0 || cfg.FailRate > 1 || cfg.MissingRate < 0 || cfg.MissingRate > 1 || cfg.Violations < 0:
+		fmt.Fprintln(os.Stderr, "❌ -fail-rate and -missing-rate must be from 0 to 1, -violations at least 0")
+		return 2
+	}
+
+	records := generateInspections(cfg)
+	fmt.Printf("🧬 Generated %d inspections (seed %d) from %s to %s\n", len(records), cfg.Seed, *from, *to)
+	if *serve != "" {
+		if err := serveSODA(*serve, records); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	save := func(name string, data []byte) error {
+		return gcp.UploadObject(ctx, *bucket, name, data, "application/json", false)
+	}
+	where := "gs://" + *bucket
+	if *toGCS {
+		token, err := devenv.AccessToken(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n   → run: gcloud auth application-default login (or set GCP_ACCESS_TOKEN)\n", err)
+			return 1
+		}
+		// configure/gcp authenticates with GCP_ACCESS_TOKEN off Cloud Run
+		os.Setenv("GCP_ACCESS_TOKEN", token)
+	} else {
+		dataDir, err := devenv.DataDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		root := filepath.Join(dataDir, *bucket)
+		where = root
+		save = func(name string, data []byte) error {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			return os.WriteFile(path, data, 0o644)
+		}
+	}
+
+	folder := "raw-data/" + *date
+	m, err := writeChunks(records, *chunk, folder, *date, save)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	fmt.Printf("✅ Wrote %d chunk files (%d rows) and the manifest to %s/%s\n", m.Totals.Files, m.Totals.Rows, where, folder)
+	return 0
+}
+
+// writeChunks writes records to folder as offset_N.json chunk files of size
+// rows each, then the _manifest.json the cleaner checks them against.
+func writeChunks(records []socrata.Inspection, size int, folder, date string, save func(name string, data []byte) error) (manifest.Manifest, error) {
+	m := manifest.Manifest{Date: date}
+	for offset := 0; offset < len(records); offset += size {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		for _, r := range records[offset:min(offset+size, len(records))] {
+			if err := enc.Encode(r); err != nil {
+				return m, err
+			}
+		}
+		name := fmt.Sprintf("offset_%d.json", offset)
+		if err := save(folder+"/"+name, buf.Bytes()); err != nil {
+			return m, fmt.Errorf("write %s/%s: %w", folder, name, err)
+		}
+		m.Add(name, buf.Bytes())
+	}
+	m.Finish()
+	data, err := manifest.Marshal(m)
+	if err != nil {
+		return m, err
+	}
+	if err := save(folder+"/_manifest.json", data); err != nil {
+		return m, fmt.Errorf("write %s/_manifest.json: %w", folder, err)
+	}
+	return m, nil
+}
+
+// establishment is a place that is inspected, again and again.
+type establishment struct {
+	name, aka, license, facilityType, risk, address, zip string
+	lat, lon                                             float64
+}
+
+type weighted struct {
+	value  string
+	weight float64
+}
+
+var (
+	facilityTypes = []weighted{
+		{"Restaurant", 0.66}, {"Grocery Store", 0.13}, {"School", 0.06}, {"Children's Services Facility", 0.03},
+		{"Bakery", 0.02}, {"Daycare (2 - 6 Years)", 0.02}, {"Long Term Care", 0.01}, {"Catering", 0.01},
+		{"Liquor", 0.01}, {"Mobile Food Dispenser", 0.01}, {"Hospital", 0.01}, {"Wholesale", 0.01}, {"Tavern", 0.02},
+	}
+	risks           = []weighted{{"Risk 1 (High)", 0.72}, {"Risk 2 (Medium)", 0.19}, {"Risk 3 (Low)", 0.09}}
+	inspectionTypes = []weighted{
+		{"Canvass", 0.53}, {"License", 0.13}, {"Canvass Re-Inspection", 0.11}, {"Complaint", 0.09},
+		{"License Re-Inspection", 0.05}, {"Short Form Complaint", 0.04}, {"Complaint Re-Inspection", 0.04}, {"Consultation", 0.01},
+	}
+	// Outcomes other than a fail, by share
+	otherResults = []weighted{
+		{"Pass", 0.64}, {"Pass w/ Conditions", 0.19}, {"Out of Business", 0.09}, {"No Entry", 0.05}, {"Not Ready", 0.03},
+	}
+	nameFirst = []string{"GOLDEN", "LUCKY", "MAMA", "NEW", "OLD TOWN", "SUNRISE", "TAQUERIA", "WINDY CITY", "LAKESIDE", "CORNER", "PILSEN", "BIG", "LITTLE", "ROYAL", "HAPPY"}
+	nameLast  = []string{"GRILL", "KITCHEN", "DELI", "PIZZA", "CAFE", "MARKET", "BAKERY", "TACOS", "NOODLE HOUSE", "BBQ", "FOOD MART", "SUBS", "DINER", "BURGERS", "SUSHI"}
+	streets   = []string{"N CLARK ST", "W DIVISION ST", "S HALSTED ST", "N MILWAUKEE AVE", "W 26TH ST", "S ASHLAND AVE", "N BROADWAY", "W ARGYLE ST", "E 47TH ST", "W MADISON ST", "N LINCOLN AVE", "S COTTAGE GROVE AVE"}
+	// The violation codes and descriptions of the 2018 food code the dataset uses
+	violationCodes = []struct {
+		code        int
+		description string
+	}{
+		{1, "PERSON IN CHARGE PRESENT, DEMONSTRATES KNOWLEDGE, AND PERFORMS DUTIES"},
+		{2, "CITY OF CHICAGO FOOD SERVICE SANITATION CERTIFICATE"},
+		{3, "MANAGEMENT, FOOD EMPLOYEE AND CONDITIONAL EMPLOYEE; KNOWLEDGE, RESPONSIBILITIES AND REPORTING"},
+		{5, "PROCEDURES FOR RESPONDING TO VOMITING AND DIARRHEAL EVENTS"},
+		{10, "ADEQUATE HANDWASHING SINKS PROPERLY SUPPLIED AND ACCESSIBLE"},
+		{16, "FOOD-CONTACT SURFACES: CLEANED & SANITIZED"},
+		{22, "PROPER COLD HOLDING TEMPERATURES"},
+		{25, "CONSUMER ADVISORY PROVIDED FOR RAW/UNDERCOOKED FOOD"},
+		{37, "FOOD PROPERLY LABELED; ORIGINAL CONTAINER"},
+		{38, "INSECTS, RODENTS, & ANIMALS NOT PRESENT"},
+		{39, "CONTAMINATION PREVENTED DURING FOOD PREPARATION, STORAGE & DISPLAY"},
+		{41, "WIPING CLOTHS: PROPERLY USED & STORED"},
+		{47, "FOOD & NON-FOOD CONTACT SURFACES CLEANABLE, PROPERLY DESIGNED, CONSTRUCTED & USED"},
+		{49, "NON-FOOD/FOOD CONTACT SURFACES CLEAN"},
+		{51, "PLUMBING INSTALLED; PROPER BACKFLOW DEVICES"},
+		{53, "TOILET FACILITIES: PROPERLY CONSTRUCTED, SUPPLIED, & CLEANED"},
+		{55, "PHYSICAL FACILITIES INSTALLED, MAINTAINED & CLEAN"},
+		{56, "ADEQUATE VENTILATION & LIGHTING; DESIGNATED AREAS USED"},
+		{58, "ALLERGEN TRAINING AS REQUIRED"},
+	}
+	comments = []string{
+		"OBSERVED DEBRIS ON FLOORS ALONG WALLS. INSTRUCTED TO CLEAN AND MAINTAIN.",
+		"OBSERVED NO SOAP AT HANDWASHING SINK IN PREP AREA. INSTRUCTED TO PROVIDE.",
+		"OBSERVED 20 RODENT DROPPINGS IN STORAGE ROOM. INSTRUCTED TO REMOVE AND SANITIZE.",
+		"FOUND TCS FOODS IN COOLER AT 47F. INSTRUCTED TO HOLD AT 41F OR BELOW.",
+		"NO CERTIFIED FOOD MANAGER ON SITE DURING INSPECTION. INSTRUCTED TO COMPLY.",
+		"OBSERVED LEAKING PIPE UNDER THREE COMPARTMENT SINK. INSTRUCTED TO REPAIR.",
+		"MUST PROVIDE ALLERGEN TRAINING CERTIFICATES FOR FOOD HANDLERS.",
+		"OBSERVED WIPING CLOTHS STORED ON PREP TABLE. INSTRUCTED TO STORE IN SANITIZER.",
+	}
+)
+
+func pick(rng *rand.Rand, choices []weighted) string {
+	var total float64
+	for _, c := range choices {
+		total += c.weight
+	}
+	x := rng.Float64() * total
+	for _, c := range choices {
+		if x -= c.weight; x < 0 {
+			return c.value
+		}
+	}
+	return choices[len(choices)-1].value
+}
+
+// poisson draws a count with the given mean (Knuth's method; means here are small).
+func poisson(rng *rand.Rand, mean float64) int {
+	limit, p, n := math.Exp(-mean), 1.0, 0
+	for {
+		p *= rng.Float64()
+		if p <= limit {
+			return n
+		}
+		n++
+	}
+}
+
+// generateInspections makes cfg.Rows inspections of establishments each
+// inspected a few times, with IDs and dates rising together as in the
+// dataset. A failed inspection lists cfg.Violations violations on average, a
+// pass with conditions half as many and a pass a few minor ones.
+func generateInspections(cfg synthConfig) []socrata.Inspection {
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	places := make([]establishment, max(cfg.Rows/4, 1))
+	for i := range places {
+		name := nameFirst[rng.Intn(len(nameFirst))] + " " + nameLast[rng.Intn(len(nameLast))]
+		places[i] = establishment{
+			name:         name,
+			license:      fmt.Sprint(1000000 + rng.Intn(2000000)),
+			facilityType: pick(rng, facilityTypes),
+			risk:         pick(rng, risks),
+			address:      fmt.Sprintf("%d %s ", 100+rng.Intn(9800), streets[rng.Intn(len(streets))]),
+			zip:          fmt.Sprint(60601 + rng.Intn(60)),
+			// Chicago, give or take
+			lat: 41.65 + rng.Float64()*0.37,
+			lon: -87.84 + rng.Float64()*0.32,
+		}
+		if rng.Float64() < 0.3 {
+			places[i].aka = name + " #" + fmt.Sprint(1+rng.Intn(9))
+		}
+	}
+
+	span := cfg.To.Sub(cfg.From)
+	records := make([]socrata.Inspection, cfg.Rows)
+	id := 2000000
+	for i := range records {
+		id += 1 + rng.Intn(8)
+		p := places[rng.Intn(len(places))]
+		day := cfg.From.Add(time.Duration(float64(span) * float64(i) / float64(max(cfg.Rows-1, 1)))).Truncate(24 * time.Hour)
+
+		result := "Fail"
+		mean := cfg.Violations
+		if rng.Float64() >= cfg.FailRate {
+			result = pick(rng, otherResults)
+			switch result {
+			case "Pass":
+				mean /= 4
+			case "Pass w/ Conditions":
+				mean /= 2
+			default:
+				// Nobody got in to look
+				mean = 0
+			}
+		}
+
+		r := socrata.Inspection{
+			InspectionID:   fmt.Sprint(id),
+			DBAName:        p.name,
+			AKAName:        p.aka,
+			License:        p.license,
+			FacilityType:   p.facilityType,
+			Risk:           p.risk,
+			Address:        p.address,
+			City:           "CHICAGO",
+			State:          "IL",
+			Zip:            p.zip,
+			InspectionDate: day.Format(socrata.FloatingTimestamp),
+			InspectionType: pick(rng, inspectionTypes),
+			Results:        result,
+			Violations:     violationText(rng, poisson(rng, mean)),
+			Latitude:       fmt.Sprintf("%.9f", p.lat),
+			Longitude:      fmt.Sprintf("%.9f", p.lon),
+		}
+		r.Location, _ = json.Marshal(map[string]any{"type": "Point", "coordinates": []float64{p.lon, p.lat}})
+
+		for _, field := range []*string{&r.DBAName, &r.AKAName, &r.License, &r.FacilityType, &r.Risk, &r.Address, &r.City, &r.State, &r.Zip, &r.InspectionType, &r.Results} {
+			if rng.Float64() < cfg.MissingRate {
+				*field = ""
+			}
+		}
+		if rng.Float64() < cfg.MissingRate {
+			r.Latitude, r.Longitude, r.Location = "", "", nil
+		}
+		records[i] = r
+	}
+	return records
+}
+
+// violationText lists n distinct violations as the dataset does:
+// "CODE. DESCRIPTION - Comments: ..." entries separated by " | ".
+func violationText(rng *rand.Rand, n int) string {
+	n = min(n, len(violationCodes))
+	entries := make([]string, 0, n)
+	picked := rng.Perm(len(violationCodes))[:n]
+	slices.Sort(picked)
+	for _, i := range picked {
+		v := violationCodes[i]
+		entries = append(entries, fmt.Sprintf("%d. %s - Comments: %s", v.code, v.description, comments[rng.Intn(len(comments))]))
+	}
+	return strings.Join(entries, " | ")
+}
@@ -0,0 +1,19 @@
+"""Code the Python services (cleaner and loaders) share, as configure is for the Go ones.
+
+Each module follows the Go package of the same name, so a service answers, logs and
+reports the same way whichever language it is written in. Files both languages read,
+such as the error category rules and the manifest schema, live in the Go configure
+module and are copied beside this package when a service image installs it.
+"""
+import os
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+
+
+def shared_file(name: str, tree_path: str) -> str:
+    """The path of a file owned by the Go configure module: the copy installed beside this
+    package in a service image, else the one at configure/{tree_path} in the source tree."""
+    installed = os.path.join(_HERE, name)
+    if os.path.exists(installed):
+        return installed
+    return os.path.join(_HERE, "..", "..", "configure", tree_path)
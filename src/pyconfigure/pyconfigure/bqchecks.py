@@ -0,0 +1,81 @@
+"""Row checks the loaders run on BigQuery: on a run's staging table before it is promoted, and on
+/verify against the rows a run added to the target. Only the loaders import it, so
+google-cloud-bigquery is theirs to install.
+
+VERIFY_KEY_COLUMN must be unique and set; VERIFY_NOT_NULL (comma separated) lists the columns
+that must be set.
+"""
+import logging
+import os
+
+from google.cloud import bigquery
+
+logger = logging.getLogger(__name__)
+
+VERIFY_KEY_COLUMN = os.environ.get("VERIFY_KEY_COLUMN", "inspection_id")
+VERIFY_NOT_NULL = [c.strip() for c in os.environ.get(
+    "VERIFY_NOT_NULL", "inspection_id,dba_name,inspection_date,results").split(",") if c.strip()]
+
+# Promoted rows carry the id of the run that loaded them in this column
+LOAD_RUN_ID_COLUMN = "load_run_id"
+
+
+def row_checks(bq_client, table_id: str, where: str = "", params: list = None) -> dict:
+    """Runs count, duplicate and null checks against table_id, or its rows matching where."""
+    null_checks = ",\n".join(
+        f"  COUNTIF(`{col}` IS NULL) AS null_{col}" for col in VERIFY_NOT_NULL
+    )
+    # COUNT skips NULLs, so rows without a key are counted on their own rather than as duplicates
+    query = f"""
+SELECT
+  COUNT(*) AS row_count,
+  COUNT(DISTINCT `{VERIFY_KEY_COLUMN}`) AS distinct_keys,
+  COUNT(`{VERIFY_KEY_COLUMN}`) - COUNT(DISTINCT `{VERIFY_KEY_COLUMN}`) AS duplicate_rows,
+  COUNTIF(`{VERIFY_KEY_COLUMN}` IS NULL) AS null_keys,
+{null_checks}
+FROM `{table_id}`
+{where}
+"""
+    job_config = bigquery.QueryJobConfig(query_parameters=params or [])
+    job = bq_client.query(query, job_config=job_config)
+    row = list(job.result())[0]
+
+    nulls = {col: row[f"null_{col}"] for col in VERIFY_NOT_NULL}
+    return {
+        "row_count": row["row_count"],
+        "distinct_keys": row["distinct_keys"],
+        "duplicate_rows": row["duplicate_rows"],
+        "null_keys": row["null_keys"],
+        "null_counts": nulls,
+        "checks": {
+            "rows_present": row["row_count"] > 0,
+            "no_duplicates": row["duplicate_rows"] == 0,
+            "no_null_keys": row["null_keys"] == 0,
+            "no_nulls": all(n == 0 for n in nulls.values()),
+        },
+        "bq_bytes_processed": job.total_bytes_processed or 0,
+    }
+
+
+def verify_run(bq_client, table_id: str, run_id: str) -> dict:
+    """Runs row_checks against the rows run_id added to table_id. Raises LookupError when the
+    table has no LOAD_RUN_ID_COLUMN, so holds no promoted run."""
+    if LOAD_RUN_ID_COLUMN not in {f.name for f in bq_client.get_table(table_id).schema}:
+        raise LookupError(f"{table_id} has no {LOAD_RUN_ID_COLUMN} column, so no run was promoted into it")
+
+    logger.info(f"🔎 Verifying the rows run {run_id} loaded into {table_id}")
+    checks = row_checks(
+        bq_client, table_id,
+        f"WHERE `{LOAD_RUN_ID_COLUMN}` = @run_id",
+        [bigquery.ScalarQueryParameter("run_id", "STRING", run_id)],
+    )
+    result = {
+        "table": table_id,
+        "run_id": run_id,
+        "run_column": LOAD_RUN_ID_COLUMN,
+        "key_column": VERIFY_KEY_COLUMN,
+        **checks,
+        "passed": all(checks["checks"].values()),
+    }
+    logger.info(f"{'✅' if result['passed'] else '⚠️'} Verification of run {run_id}: {result}")
+    return result
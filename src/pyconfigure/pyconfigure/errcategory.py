@@ -0,0 +1,60 @@
+"""Error categories for failure events, as configure/errcategory in the Go services.
+
+The phrases messages are matched against are configure/errcategory/rules.json, which
+the Go package embeds, so both languages categorise a message alike.
+"""
+import json
+
+import requests
+
+from . import shared_file
+
+TRANSIENT_NETWORK = "transient_network"
+QUOTA = "quota"
+DATA_FORMAT = "data_format"
+CONFIGURATION = "configuration"
+DOWNSTREAM = "downstream"
+UNKNOWN = "unknown"
+CATEGORIES = (TRANSIENT_NETWORK, QUOTA, DATA_FORMAT, CONFIGURATION, DOWNSTREAM)
+
+with open(shared_file("rules.json", "errcategory/rules.json"), encoding="utf-8") as f:
+    RULES = [(r["category"], tuple(r["phrases"])) for r in json.load(f)]
+
+
+def classify(message: str) -> str:
+    """Infers a category from an error message; the first rule with a matching phrase wins."""
+    message = message.lower()
+    for category, phrases in RULES:
+        if any(p in message for p in phrases):
+            return category
+    return UNKNOWN
+
+
+def from_status(code: int) -> str:
+    """Categorises a failed HTTP call by its status."""
+    if code == 429:
+        return QUOTA
+    if code == 408:
+        return TRANSIENT_NETWORK
+    if code in (401, 403, 404):
+        return CONFIGURATION
+    if code in (400, 413, 415, 422):
+        return DATA_FORMAT
+    return DOWNSTREAM
+
+
+def of(e: Exception) -> str:
+    """The category of e: its own category attribute when it has one, else one inferred from
+    its type or HTTP status, else from its message."""
+    category = getattr(e, "category", None)
+    if category in CATEGORIES:
+        return category
+    if isinstance(e, (requests.exceptions.Timeout, requests.exceptions.ConnectionError, TimeoutError, ConnectionError)):
+        return TRANSIENT_NETWORK
+    if isinstance(e, (json.JSONDecodeError, UnicodeDecodeError)):
+        return DATA_FORMAT
+    # google.api_core exceptions carry the HTTP status of the failed call
+    code = getattr(e, "code", None)
+    if isinstance(code, int) and code >= 400:
+        return from_status(code)
+    return classify(str(e))
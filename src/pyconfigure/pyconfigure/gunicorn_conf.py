@@ -0,0 +1,13 @@
+"""gunicorn settings the Python services share: gunicorn -c python:pyconfigure.gunicorn_conf.
+
+Serves HTTPS, and asks for client certificates, from the TLS_* variables (see tls); gunicorn
+then logs that it listens on https://.
+"""
+from pyconfigure import tls
+
+_tls = tls.server_settings()
+certfile = _tls.get("certfile")
+keyfile = _tls.get("keyfile")
+ca_certs = _tls.get("ca_certs")
+if "cert_reqs" in _tls:
+    cert_reqs = _tls["cert_reqs"]
@@ -0,0 +1,136 @@
+"""Background jobs served on /jobs, as configure/jobs in the Go services.
+
+A service's cleanings or loads start a Job on registry and report progress on it. Finished
+jobs are kept for JOBS_TTL_SECONDS (default a day). Requests run in gunicorn worker threads
+(see the Dockerfiles), so /jobs still answers while a job runs.
+"""
+import json
+import os
+import threading
+import time
+import uuid
+from datetime import datetime
+
+from .logs import require_admin
+from .problem import problem
+
+JOBS_TTL_SECONDS = float(os.environ.get("JOBS_TTL_SECONDS", "86400"))
+
+
+class JobCancelled(Exception):
+    """Raised by Job.check once the job has been cancelled."""
+
+
+class Job:
+    """One job's state; the work reports progress on it and checks for cancellation."""
+
+    def __init__(self, registry, kind: str, run_id: str, date: str):
+        now = datetime.utcnow().isoformat() + "Z"
+        self.registry = registry
+        self.id = f"{kind}-{uuid.uuid4().hex[:12]}"
+        self.cancelled = threading.Event()
+        self.finished = None  # time.monotonic() at finish, for eviction
+        self.state = {"id": self.id, "kind": kind, "run_id": run_id, "date": date, "state": "running",
+                      "progress": {}, "started_at": now, "updated_at": now}
+
+    def progress(self, **fields):
+        with self.registry.lock:
+            if self.state["state"] == "running":
+                self.state["progress"].update(fields)
+                self.state["updated_at"] = datetime.utcnow().isoformat() + "Z"
+
+    def check(self):
+        """Raises JobCancelled if the job was cancelled; called between units of work."""
+        if self.cancelled.is_set():
+            raise JobCancelled(f"job {self.id} cancelled")
+
+    def finish(self, error: Exception = None):
+        """Ends the job: succeeded without error, cancelled on JobCancelled, failed otherwise."""
+        with self.registry.lock:
+            if self.state["state"] != "running":
+                return
+            now = datetime.utcnow().isoformat() + "Z"
+            if error is None:
+                self.state["state"] = "succeeded"
+            else:
+                self.state["state"] = "cancelled" if isinstance(error, JobCancelled) else "failed"
+                self.state["error"] = str(error)
+            self.state["updated_at"] = self.state["finished_at"] = now
+            self.finished = time.monotonic()
+
+
+class JobRegistry:
+    def __init__(self, ttl: float):
+        self.lock = threading.Lock()
+        self.jobs = {}
+        self.ttl = ttl
+
+    def start(self, kind: str, run_id: str, date: str) -> Job:
+        job = Job(self, kind, run_id, date)
+        with self.lock:
+            self._evict()
+            self.jobs[job.id] = job
+        return job
+
+    def get(self, job_id: str):
+        with self.lock:
+            job = self.registry.get(job_id)
+            return json.loads(json.dumps(job.state)) if job else None
+
+    def list(self, state: str = None) -> list:
+        with self.lock:
+            self._evict()
+            found = [json.loads(json.dumps(j.state)) for j in self.jobs.values() if not state or j.state["state"] == state]
+        return sorted(found, key=lambda j: j["started_at"], reverse=True)
+
+    def cancel(self, job_id: str) -> bool:
+        """Asks a running job to stop; it stays running until its work next calls check."""
+        with self.lock:
+            job = self.registry.get(job_id)
+            if not job or job.state["state"] != "running":
+                return False
+            job.cancelled.set()
+            return True
+
+    def active(self) -> int:
+        with self.lock:
+            return sum(1 for j in self.jobs.values() if j.state["state"] == "running")
+
+    def _evict(self):
+        now = time.monotonic()
+        for job_id in [i for i, j in self.jobs.items() if j.finished is not None and now - j.finished > self.ttl]:
+            del self.jobs[job_id]
+
+
+registry = JobRegistry(JOBS_TTL_SECONDS)
+
+
+def handle_jobs(request):
+    """GET /jobs (?state= filters), GET /jobs/<id>, POST /jobs/<id>/cancel (needs ADMIN_TOKEN in X-Admin-Token)."""
+    parts = request.path.strip("/").split("/")
+    if len(parts) == 1:
+        if request.method != "GET":
+            return problem(request, 405, "method-not-allowed", "Only GET allowed")
+        body = {"jobs": registry.list(request.args.get("state")), "active": registry.active()}
+        return (json.dumps(body), 200, {"Content-Type": "application/json"})
+
+    job = registry.get(parts[1])
+    if len(parts) == 2:
+        if request.method != "GET":
+            return problem(request, 405, "method-not-allowed", "Only GET allowed")
+        if not job:
+            return problem(request, 404, "not-found", f"No job {parts[1]}")
+        return (json.dumps(job), 200, {"Content-Type": "application/json"})
+
+    if len(parts) != 3 or parts[2] != "cancel":
+        return problem(request, 404, "not-found", f"No route {request.path}")
+    if request.method != "POST":
+        return problem(request, 405, "method-not-allowed", "Only POST allowed")
+    denied = require_admin(request, "Cancelling jobs is disabled")
+    if denied:
+        return denied
+    if not job:
+        return problem(request, 404, "not-found", f"No job {parts[1]}")
+    if not registry.cancel(parts[1]):
+        return problem(request, 409, "conflict", f"Job {parts[1]} already {job['state']}")
+    return (json.dumps(registry.get(parts[1])), 202, {"Content-Type": "application/json"})
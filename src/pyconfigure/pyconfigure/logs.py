@@ -0,0 +1,129 @@
+"""Logging setup and the admin endpoints, as configure/logging in the Go services.
+
+Everything logged passes a redactor before it is written: the same credential patterns and
+field names as the Go services', plus the fields in LOG_REDACT_FIELDS (comma separated).
+LOG_REDACTION=off turns it off for local debugging.
+"""
+import hmac
+import json
+import logging
+import os
+import re
+
+from .problem import problem
+
+logger = logging.getLogger(__name__)
+
+# LOG_LEVEL (debug, info or warn) sets the starting level; /admin/loglevel changes it
+LEVELS = {"debug": logging.DEBUG, "info": logging.INFO, "warn": logging.WARNING, "warning": logging.WARNING}
+
+
+MASK = "[REDACTED]"
+
+# Always redacted; LOG_REDACT_FIELDS adds to them
+DEFAULT_FIELDS = [
+    "password", "passwd", "secret", "client_secret", "token", "access_token",
+    "refresh_token", "id_token", "api_key", "apikey", "authorization",
+    "private_key", "credentials",
+]
+
+# Credentials that are recognisable by shape alone, wherever they appear
+SECRET_PATTERNS = [
+    (re.compile(r"-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----"), MASK),
+    (re.compile(r"(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*"), "Bearer " + MASK),
+    (re.compile(r"\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+"), MASK),
+    (re.compile(r"\bya29\.[0-9A-Za-z\-_]+"), MASK),
+    (re.compile(r"\bAIza[0-9A-Za-z\-_]{35}\b"), MASK),
+    (re.compile(r"https://hooks\.slack\.com/services/[A-Za-z0-9/]+"), "https://hooks.slack.com/services/" + MASK),
+    # user:password@ in URLs
+    (re.compile(r"://[^/\s:@]+:[^/\s@]+@"), "://" + MASK + "@"),
+    # Signed URL and API key query parameters
+    (re.compile(r"(?i)([?&](?:token|key|sig|signature|x-goog-signature|x-goog-credential)=)[^&\s\"]+"), r"\g<1>" + MASK),
+]
+
+
+class Redactor:
+    """Masks secrets and the given field names (matched case-insensitively) in log lines and
+    error text, as configure/logging.Redactor."""
+
+    def __init__(self, extra: list = (), disabled: bool = False):
+        fields = []
+        for f in DEFAULT_FIELDS + list(extra):
+            f = f.strip().lower()
+            if f and f not in fields:
+                fields.append(f)
+        # Longest first so "access_token" wins over "token"
+        self.fields = sorted(fields, key=len, reverse=True)
+        self.disabled = disabled
+        names = "|".join(re.escape(f) for f in self.fields)
+        # "field": "value" | "field": 123 — in JSON logs and payloads
+        self.json_re = re.compile(rf'(?i)("(?:{names})"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}}\]\s]+)')
+        # field=value in text logs
+        self.kv_re = re.compile(rf'(?i)\b((?:{names})=)("[^"]*"|[^\s,&]+)')
+
+    def __call__(self, s: str) -> str:
+        if self.disabled:
+            return s
+        for pattern, repl in SECRET_PATTERNS:
+            s = pattern.sub(repl, s)
+        s = self.json_re.sub(rf'\g<1>"{MASK}"', s)
+        return self.kv_re.sub(rf"\g<1>{MASK}", s)
+
+
+redact = Redactor(os.environ.get("LOG_REDACT_FIELDS", "").split(","),
+                  os.environ.get("LOG_REDACTION", "").lower() == "off")
+
+
+class RedactFilter(logging.Filter):
+    """Redacts each record's message, and its traceback, before a handler writes it."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        record.msg = redact(record.getMessage())
+        record.args = None
+        if record.exc_info and not record.exc_text:
+            record.exc_text = logging.Formatter().formatException(record.exc_info)
+        if record.exc_text:
+            record.exc_text = redact(record.exc_text)
+        return True
+
+
+def setup(name: str, fmt: str = "%(asctime)s — %(levelname)s — %(message)s") -> logging.Logger:
+    """Configures the root logger at LOG_LEVEL, redacting what it writes, and returns the
+    service's logger."""
+    logging.basicConfig(level=LEVELS.get(os.environ.get("LOG_LEVEL", "info").lower(), logging.INFO), format=fmt)
+    # On the handlers, so records of every logger that propagates to the root pass it
+    for handler in logging.getLogger().handlers:
+        if not any(isinstance(f, RedactFilter) for f in handler.filters):
+            handler.addFilter(RedactFilter())
+    if os.environ.get("LOG_REDACT_FIELDS"):
+        logging.getLogger(__name__).info(f"🔒 Log redaction enabled for extra fields: {os.environ['LOG_REDACT_FIELDS']}")
+    return logging.getLogger(name)
+
+
+def require_admin(request, disabled: str = "Admin endpoints are disabled"):
+    """The problem response for a request without the ADMIN_TOKEN secret in X-Admin-Token, or None
+    if it has it. disabled says what is turned off while ADMIN_TOKEN is not set."""
+    token = os.environ.get("ADMIN_TOKEN")
+    if not token:
+        return problem(request, 403, "not-configured", f"{disabled}: ADMIN_TOKEN is not set")
+    if not hmac.compare_digest(request.headers.get("X-Admin-Token", ""), token):
+        return problem(request, 401, "unauthorized", "Missing or invalid admin token")
+    return None
+
+
+def admin_loglevel(request):
+    """GET reports the log level, POST/PUT sets it; needs ADMIN_TOKEN in X-Admin-Token."""
+    denied = require_admin(request)
+    if denied:
+        return denied
+    if request.method in ("POST", "PUT"):
+        body = request.get_json(silent=True) or {}
+        want = str(request.args.get("level") or body.get("level") or "").lower()
+        if want not in LEVELS:
+            return problem(request, 400, "invalid-request", f"Invalid level {want!r}: use debug, info or warn")
+        logging.getLogger().setLevel(LEVELS[want])
+        logger.warning(f"⚠️ Log level changed to {want}")
+    elif request.method != "GET":
+        return problem(request, 405, "method-not-allowed", "Only GET, POST or PUT allowed")
+    level = {logging.DEBUG: "debug", logging.WARNING: "warn"}.get(logging.getLogger().level, "info")
+    return (json.dumps({"level": level}), 200, {"Content-Type": "application/json"})
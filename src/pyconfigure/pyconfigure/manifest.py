@@ -0,0 +1,155 @@
+"""_manifest.json reading and checking, as configure/manifest in the Go services.
+
+Version 2 adds schema_version, status and each object's compression, and is checked
+against configure/manifest/manifest.v2.schema.json, the schema the Go package embeds,
+with the same wording as manifest.Validate. A manifest without schema_version is
+version 1, read from upload_complete, so dates landed before version 2 still clean
+and load.
+"""
+import json
+import logging
+import posixpath
+import re
+
+from . import errcategory, shared_file
+
+logger = logging.getLogger(__name__)
+
+SCHEMA_VERSION = 2
+OLDEST = 1
+STATUS_COMPLETE = "complete"
+STATUS_INCOMPLETE = "incomplete"
+SCHEMA_VIOLATION = "schema_violation"
+
+with open(shared_file("manifest.v2.schema.json", "manifest/manifest.v2.schema.json"), encoding="utf-8") as f:
+    SCHEMA = json.load(f)
+
+
+class ManifestError(Exception):
+    """A manifest that breaks its schema, or doesn't match the files of its folder.
+
+    problems are {"file", "kind", "actual"} as configure/manifest.Problem; a schema
+    violation's file is _manifest.json and its actual says where.
+    """
+
+    category = errcategory.DATA_FORMAT
+
+    def __init__(self, folder: str, problems: list):
+        self.problems = problems
+        violations = [p["actual"] for p in problems if p["kind"] == SCHEMA_VIOLATION]
+        if violations:
+            super().__init__(f"manifest for {folder} does not match its schema: {', '.join(violations)}")
+            return
+        listed = ", ".join(f"{p['file']}: {p['kind']}" for p in problems)
+        super().__init__(f"manifest for {folder} does not match {len(problems)} chunk(s): {listed}")
+
+
+def validate(manifest) -> list:
+    """What a version 2 manifest breaks of the schema, one "where: what" per violation."""
+    violations = []
+    _check(SCHEMA, "", manifest, lambda at, msg: violations.append(f"{at or 'manifest'}: {msg}"))
+    return violations
+
+
+def check(manifest, folder: str) -> dict:
+    """Upgrades a version 1 manifest in place, or checks a version 2 one against the schema,
+    so status reads the same whichever version wrote it. Raises ManifestError listing the
+    schema violations, as manifest.Parse returns them."""
+    version = manifest.get("schema_version") if isinstance(manifest, dict) else None
+    if version is None:
+        version = OLDEST
+    if not isinstance(manifest, dict):
+        violations = ["manifest: must be object"]
+    elif not _is_type("integer", version):
+        violations = ["schema_version: must be integer"]
+    elif version == 1:
+        manifest["schema_version"] = 1
+        manifest["status"] = STATUS_COMPLETE if manifest.get("upload_complete") else STATUS_INCOMPLETE
+        violations = []
+    elif version == SCHEMA_VERSION:
+        violations = validate(manifest)
+    else:
+        violations = [f"schema_version: {version} is not supported (this service reads {OLDEST} to {SCHEMA_VERSION})"]
+    if violations:
+        raise ManifestError(folder, [{"file": "_manifest.json", "kind": SCHEMA_VIOLATION, "actual": v} for v in violations])
+    manifest["upload_complete"] = manifest["status"] == STATUS_COMPLETE
+    return manifest
+
+
+def load(bucket, path: str):
+    """Reads and checks the manifest at path in bucket. Returns None when there is none or
+    it isn't complete yet; raises ManifestError when it breaks its schema, and ValueError
+    when it isn't JSON."""
+    blob = bucket.blob(path)
+    if not blob.exists():
+        logger.warning(f"⚠️ No manifest found at {bucket.name}/{path}")
+        return None
+    manifest = check(json.loads(blob.download_as_text()), posixpath.dirname(path))
+    if manifest["status"] != STATUS_COMPLETE:
+        logger.info(f"⚠️ Manifest at {path} found but not marked complete")
+        return None
+    logger.info(f"📦 Loaded manifest with {len(manifest['files'])} file(s) from {path}")
+    return manifest
+
+
+def _check(schema: dict, at: str, v, fail):
+    """Reports through fail each way v, found at path at, breaks schema, in the order
+    manifest.Validate does: type, const, enum, then required fields and properties by name."""
+    kind = schema.get("type")
+    if kind and not _is_type(kind, v):
+        fail(at, f"must be {kind}")
+        return
+    if "const" in schema and not _equal(v, schema["const"]):
+        fail(at, f"must be {_format(schema['const'])}")
+    enum = schema.get("enum")
+    if enum and not any(_equal(v, e) for e in enum):
+        fail(at, "must be one of " + ", ".join(_format(e) for e in enum))
+    if isinstance(v, dict):
+        for key in schema.get("required", []):
+            if key not in v:
+                fail(_join(at, key), "required")
+        properties = schema.get("properties", {})
+        for key in sorted(properties):
+            if key in v:
+                _check(properties[key], _join(at, key), v[key], fail)
+    elif isinstance(v, list):
+        if "items" in schema:
+            for i, item in enumerate(v):
+                _check(schema["items"], f"{at}[{i}]", item, fail)
+    elif isinstance(v, (int, float)) and not isinstance(v, bool):
+        if "minimum" in schema and v < schema["minimum"]:
+            fail(at, f"must be >= {_format(schema['minimum'])}")
+    elif isinstance(v, str):
+        if len(v) < schema.get("minLength", 0):
+            fail(at, f"must be at least {schema['minLength']} character(s)")
+        if schema.get("pattern") and not re.search(schema["pattern"], v):
+            fail(at, f"must match {schema['pattern']}")
+
+
+def _is_type(kind: str, v) -> bool:
+    number = isinstance(v, (int, float)) and not isinstance(v, bool)
+    return {
+        "object": isinstance(v, dict),
+        "array": isinstance(v, list),
+        "string": isinstance(v, str),
+        "boolean": isinstance(v, bool),
+        "integer": number and float(v).is_integer(),
+        "number": number,
+    }.get(kind, True)
+
+
+def _equal(a, b) -> bool:
+    # JSON true is not 1, as it isn't in Go
+    return isinstance(a, bool) == isinstance(b, bool) and a == b
+
+
+def _format(v) -> str:
+    if isinstance(v, bool):
+        return str(v).lower()
+    if isinstance(v, float) and v.is_integer():
+        return str(int(v))
+    return str(v)
+
+
+def _join(at: str, key: str) -> str:
+    return f"{at}.{key}" if at else key
@@ -0,0 +1,88 @@
+"""OpenLineage run events, as configure/openlineage in the Go services.
+
+Events are posted to OPENLINEAGE_URL (e.g. Marquez's /api/v1/lineage) when it is set, with
+OPENLINEAGE_API_KEY as a bearer token, for jobs in OPENLINEAGE_NAMESPACE.
+"""
+import logging
+import os
+import uuid
+from datetime import datetime
+
+import requests
+
+from . import tls
+
+logger = logging.getLogger(__name__)
+
+OPENLINEAGE_URL = os.environ.get("OPENLINEAGE_URL")
+OPENLINEAGE_API_KEY = os.environ.get("OPENLINEAGE_API_KEY")
+OPENLINEAGE_NAMESPACE = os.environ.get("OPENLINEAGE_NAMESPACE", "hygiene-prediction")
+OPENLINEAGE_PRODUCER = "https://github.com/malawley/hygiene_prediction_clean"
+
+
+def post(event_type: str, job: str, run_id: str, date: str, inputs: list, outputs: list, error: Exception = None):
+    """
+    Posts an OpenLineage run event (START, COMPLETE or FAIL). inputs are
+    (namespace, name) datasets; outputs are (namespace, name) or (namespace,
+    name, lineage records[, source]), whose source fields are read from the
+    source input, by default the first. Failures are logged, never raised.
+    """
+    if not OPENLINEAGE_URL:
+        return
+
+    def column_facet(records, source):
+        source_ns, source_name = source
+        return {
+            "_producer": OPENLINEAGE_PRODUCER,
+            "_schemaURL": "https://openlineage.io/spec/facets/1-1-0/ColumnLineageDatasetFacet.json",
+            "fields": {
+                r["column"]: {
+                    "inputFields": [{"namespace": source_ns, "name": source_name, "field": f} for f in r["sources"]],
+                    "transformationDescription": "; ".join(r["transformations"]) or "copied unchanged",
+                    "transformationType": r["type"],
+                }
+                for r in records
+            },
+        }
+
+    def dataset(output):
+        d = {"namespace": output[0], "name": output[1]}
+        if len(output) > 2 and output[2]:
+            source = output[3] if len(output) > 3 else inputs[0]
+            d["facets"] = {"columnLineage": column_facet(output[2], source)}
+        return d
+
+    # OpenLineage wants UUIDs; they are derived as configure/openlineage derives
+    # them, so START and COMPLETE match and stages group under the trigger's pipeline run
+    run_facets = {}
+    if run_id:
+        run_facets["parent"] = {
+            "_producer": OPENLINEAGE_PRODUCER,
+            "_schemaURL": "https://openlineage.io/spec/facets/1-0-1/ParentRunFacet.json",
+            "job": {"namespace": OPENLINEAGE_NAMESPACE, "name": "pipeline"},
+            "run": {"runId": str(uuid.uuid5(uuid.NAMESPACE_URL, f"pipeline/{run_id}"))},
+        }
+    if event_type == "FAIL" and error is not None:
+        run_facets["errorMessage"] = {
+            "_producer": OPENLINEAGE_PRODUCER,
+            "_schemaURL": "https://openlineage.io/spec/facets/1-0-1/ErrorMessageRunFacet.json",
+            "message": str(error),
+            "programmingLanguage": "python",
+        }
+
+    event = {
+        "eventType": event_type,
+        "eventTime": datetime.utcnow().isoformat() + "Z",
+        "producer": OPENLINEAGE_PRODUCER,
+        "schemaURL": "https://openlineage.io/spec/2-0-2/OpenLineage.json#/$defs/RunEvent",
+        "run": {"runId": str(uuid.uuid5(uuid.NAMESPACE_URL, f"{job}/{run_id or date}")), "facets": run_facets},
+        "job": {"namespace": OPENLINEAGE_NAMESPACE, "name": job},
+        "inputs": [{"namespace": ns, "name": name} for ns, name in inputs],
+        "outputs": [dataset(o) for o in outputs],
+    }
+    headers = {"Authorization": f"Bearer {OPENLINEAGE_API_KEY}"} if OPENLINEAGE_API_KEY else {}
+    try:
+        response = requests.post(OPENLINEAGE_URL, json=event, headers=headers, timeout=15, **tls.client_options())
+        logger.info(f"🧬 OpenLineage {event_type} event for {job}: {response.status_code}")
+    except Exception as e:
+        logger.error(f"❌ Failed to post OpenLineage event: {e}")
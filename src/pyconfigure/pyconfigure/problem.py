@@ -0,0 +1,43 @@
+"""RFC 7807 problem responses, as configure/problem in the Go services."""
+import json
+import logging
+import uuid
+
+logger = logging.getLogger(__name__)
+
+TYPE_BASE = "urn:hygiene-prediction:problem:"
+TITLES = {
+    "invalid-json": "Request body is not valid JSON",
+    "invalid-request": "Invalid request",
+    "unauthorized": "Missing or invalid credentials",
+    "method-not-allowed": "Method not allowed",
+    "not-configured": "Service not configured",
+    "not-found": "Resource not found",
+    "conflict": "Request conflicts with the resource's state",
+    "payload-too-large": "Request body is too large",
+    "internal": "Internal error",
+}
+
+
+def correlation_id(request):
+    """The caller's X-Correlation-ID, else the Cloud Run trace ID, else a new one."""
+    cid = request.headers.get("X-Correlation-ID")
+    if not cid:
+        cid = request.headers.get("X-Cloud-Trace-Context", "").split("/")[0] or uuid.uuid4().hex[:16]
+    return cid
+
+
+def problem(request, status, kind, detail, **extensions):
+    """Builds an application/problem+json response tuple."""
+    cid = correlation_id(request)
+    body = dict(extensions)
+    body.update({
+        "type": TYPE_BASE + kind,
+        "title": TITLES.get(kind, kind),
+        "status": status,
+        "detail": detail,
+        "instance": request.path,
+        "correlation_id": cid,
+    })
+    logger.warning(f"⚠️ {status} {body['type']} at {request.path}: {detail} (correlation {cid})")
+    return (json.dumps(body), status, {"Content-Type": "application/problem+json", "X-Correlation-ID": cid})
@@ -0,0 +1,93 @@
+"""Stage events to the trigger, as configure/publish and configure/eventschema in the Go services.
+
+EVENT_PUBLISHER is "http" (POST to the trigger URL, the default), "pubsub" (publish to
+EVENT_TOPIC, projects/{project}/topics/{topic}, whose push subscription delivers to the
+trigger's /clean) or "log" (local development, the default with LOCAL_DATA_DIR set). The
+trigger URL is TRIGGER_URL, else the trigger's url in SERVICE_CONFIG_B64.
+"""
+import base64
+import json
+import logging
+import os
+from datetime import datetime
+
+import requests
+from google.auth import default
+from google.auth.transport.requests import AuthorizedSession
+
+from . import errcategory, tls
+
+logger = logging.getLogger(__name__)
+
+# Version 2 sends durations and counts as JSON numbers; the trigger still reads version 1
+EVENT_SCHEMA_VERSION = 2
+
+
+def _trigger_url():
+    url = os.environ.get("TRIGGER_URL")
+    config_b64 = os.environ.get("SERVICE_CONFIG_B64")
+    if url or not config_b64:
+        return url
+    try:
+        url = json.loads(base64.b64decode(config_b64).decode()).get("trigger", {}).get("url")
+        logger.info(f"📡 Loaded trigger URL from SERVICE_CONFIG_B64: {url}")
+    except Exception as e:
+        logger.error(f"❌ Failed to parse SERVICE_CONFIG_B64: {e}")
+    return url
+
+
+TRIGGER_URL = _trigger_url()
+EVENT_PUBLISHER = (os.environ.get("EVENT_PUBLISHER") or ("log" if os.environ.get("LOCAL_DATA_DIR") else "http")).lower()
+EVENT_TOPIC = os.environ.get("EVENT_TOPIC", "")
+_pubsub_session = None
+
+
+def configured() -> bool:
+    """Whether events have somewhere to go: anything but http needs no trigger URL."""
+    return EVENT_PUBLISHER != "http" or bool(TRIGGER_URL)
+
+
+def publish_event(payload):
+    """Delivers a stage event to the trigger over EVENT_PUBLISHER; returns whether it was accepted."""
+    global _pubsub_session
+    event = payload.get("event")
+    if EVENT_PUBLISHER == "log":
+        logger.info(f"📭 Event {event}: {json.dumps(payload, default=str)}")
+        return True
+    try:
+        if EVENT_PUBLISHER == "pubsub":
+            if _pubsub_session is None:
+                credentials, _ = default(scopes=["https://www.googleapis.com/auth/pubsub"])
+                _pubsub_session = AuthorizedSession(credentials)
+            # Attributes let subscriptions filter without decoding the data
+            attributes = {k: str(payload[k]) for k in ("event", "run_id", "date", "origin") if payload.get(k)}
+            data = base64.b64encode(json.dumps(payload, default=str).encode()).decode()
+            response = _pubsub_session.post(
+                f"https://pubsub.googleapis.com/v1/{EVENT_TOPIC}:publish",
+                json={"messages": [{"data": data, "attributes": attributes}]}, timeout=30)
+        elif not TRIGGER_URL:
+            logger.warning(f"⚠️ No trigger URL — not publishing {event}")
+            return False
+        else:
+            response = requests.post(TRIGGER_URL, json=payload, timeout=30, **tls.client_options())
+        logger.info(f"📤 Published {event}: {response.status_code} {response.text}")
+        return response.ok
+    except Exception as e:
+        logger.error(f"❌ Failed to publish {event}: {e}")
+        return False
+
+
+def failure_event(event: str, origin: str, date: str, run_id: str, error: Exception, category: str = None) -> dict:
+    """The {stage}_failed event that fails a run at the trigger at once; category defaults to
+    errcategory.of(error). Stages add their own fields before publishing it."""
+    return {
+        "event": event,
+        "schema_version": EVENT_SCHEMA_VERSION,
+        "origin": origin,
+        "run_id": run_id,
+        "date": date,
+        "status": "failed",
+        "error": str(error),
+        "error_category": category or errcategory.of(error),
+        "timestamp": datetime.utcnow().isoformat(),
+    }
@@ -0,0 +1,28 @@
+"""Checks behind /readyz, which the trigger probes before starting a run. Each returns a list
+of problems, empty when all is well."""
+
+
+def bucket_problems(*buckets) -> list:
+    """Checks that each google.cloud.storage bucket exists and can be reached."""
+    problems = []
+    for bucket in buckets:
+        try:
+            if not bucket.exists():
+                problems.append(f"bucket {bucket.name} not found")
+        except Exception as e:
+            problems.append(f"bucket {bucket.name}: {e}")
+    return problems
+
+
+def dataset_problems(new_client, dataset_id: str) -> list:
+    """Checks that the BigQuery dataset can be reached with a client from new_client. A missing
+    one is fine: loads create it."""
+    from google.api_core.exceptions import NotFound
+
+    try:
+        new_client().get_dataset(dataset_id)
+    except NotFound:
+        return []
+    except Exception as e:
+        return [f"dataset {dataset_id}: {e}"]
+    return []
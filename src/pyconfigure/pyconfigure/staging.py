@@ -0,0 +1,388 @@
+"""What the loaders share of a BigQuery load: the client, load jobs and their retries, the
+run-scoped staging table a run's files go through, column lineage and the reconciliation with
+the manifest. Only the loaders import it, so google-cloud-bigquery is theirs to install.
+"""
+import json
+import logging
+import os
+import re
+import time
+import uuid
+from datetime import datetime, timedelta, timezone
+
+from google.auth import default, impersonated_credentials
+from google.cloud import bigquery, storage
+from google.cloud.exceptions import Conflict, NotFound
+
+from . import errcategory, readiness
+from .bqchecks import LOAD_RUN_ID_COLUMN, row_checks, verify_run
+
+logger = logging.getLogger(__name__)
+
+BQ_PROJECT = os.environ.get("BQ_PROJECT", "hygiene-prediction-434")
+
+# Impersonate this service account for BigQuery (cross-project loads); the delegates, comma
+# separated, are any accounts the grant goes through
+BQ_IMPERSONATE_SERVICE_ACCOUNT = os.environ.get("BQ_IMPERSONATE_SERVICE_ACCOUNT")
+BQ_IMPERSONATE_DELEGATES = [a.strip() for a in os.environ.get("BQ_IMPERSONATE_DELEGATES", "").split(",") if a.strip()]
+CLOUD_PLATFORM_SCOPE = "https://www.googleapis.com/auth/cloud-platform"
+
+# === Column lineage ===
+# The cleaner's _lineage.json is carried on to the loaded table's columns and recorded in
+# LINEAGE_TABLE (dataset.table in BQ_PROJECT, "off" to skip)
+LINEAGE_TABLE = os.environ.get("LINEAGE_TABLE", "PipelineMonitoring.column_lineage")
+
+# === Run-scoped staging ===
+# A run's files are loaded into a staging table of its own beside the target, checked there as
+# /verify checks a run's rows, and only then added to the target in a single transaction, so a failed
+# or partial load never reaches it. The promoted rows carry the run id in LOAD_RUN_ID_COLUMN, so
+# the trigger's /runs/{id}/purge can take a run back out and a run loaded again replaces its rows
+# instead of adding them twice. STAGING_SKIP_CHECKS (comma separated)
+# leaves out checks the data can't pass, e.g. no_duplicates; a staging table that fails is kept
+# for STAGING_TTL_HOURS
+STAGING_TTL_HOURS = float(os.environ.get("STAGING_TTL_HOURS", "24"))
+STAGING_SKIP_CHECKS = {c.strip() for c in os.environ.get("STAGING_SKIP_CHECKS", "").split(",") if c.strip()}
+
+# === Load Retries ===
+# A load BigQuery turns away for rate or quota limits (rateLimitExceeded, quotaExceeded or HTTP 429)
+# is submitted again up to LOAD_RETRIES times, waiting LOAD_RETRY_BASE_SECONDS and doubling. Load
+# job ids are derived from the run id and the file, so a submission sent again after its response
+# was lost is turned away by BigQuery as a duplicate and the job it already started is awaited
+LOAD_RETRIES = int(os.environ.get("LOAD_RETRIES", "5"))
+LOAD_RETRY_BASE_SECONDS = float(os.environ.get("LOAD_RETRY_BASE_SECONDS", "2"))
+RATE_LIMIT_REASONS = {"rateLimitExceeded", "quotaExceeded"}
+
+
+# === Client ===
+def log_active_credentials():
+    credentials, project = default()
+    logger.info(f"🔐 Using ADC credentials for project: {project}")
+    logger.info(f"Credentials type: {type(credentials)}")
+    if hasattr(credentials, "quota_project_id"):
+        logger.info(f"Quota project ID: {credentials.quota_project_id}")
+    if hasattr(credentials, "service_account_email"):
+        logger.info(f"Service Account: {credentials.service_account_email}")
+    if BQ_IMPERSONATE_SERVICE_ACCOUNT:
+        logger.info(f"🎭 BigQuery calls impersonate {BQ_IMPERSONATE_SERVICE_ACCOUNT}")
+
+
+def new_bq_client():
+    """A BigQuery client acting as BQ_IMPERSONATE_SERVICE_ACCOUNT when it is set, so loads can
+    go to a BQ_PROJECT the runtime account has no access to (e.g. the shared analytics project).
+    The runtime account needs roles/iam.serviceAccountTokenCreator on the target, or on the first
+    of BQ_IMPERSONATE_DELEGATES when the grant goes through a chain of accounts. Load jobs read
+    the cleaned files as the target too, so it needs read access to the loader's bucket."""
+    if not BQ_IMPERSONATE_SERVICE_ACCOUNT:
+        return bigquery.Client()
+    source, _ = default(scopes=[CLOUD_PLATFORM_SCOPE])
+    credentials = impersonated_credentials.Credentials(
+        source_credentials=source,
+        target_principal=BQ_IMPERSONATE_SERVICE_ACCOUNT,
+        target_scopes=[CLOUD_PLATFORM_SCOPE],
+        delegates=BQ_IMPERSONATE_DELEGATES or None,
+    )
+    return bigquery.Client(project=BQ_PROJECT, credentials=credentials)
+
+
+def ensure_dataset_exists(bq_client, dataset_id: str):
+    logger.info(f"🔍 Checking for dataset: {dataset_id}")
+    try:
+        bq_client.get_dataset(dataset_id)
+        logger.info(f"✅ Dataset exists: {dataset_id}")
+    except NotFound:
+        dataset = bigquery.Dataset(dataset_id)
+        dataset.location = "US"
+        bq_client.create_dataset(dataset)
+        logger.info(f"🆕 Created dataset: {dataset_id}")
+    except Exception:
+        logger.exception(f"❌ Error checking or creating dataset: {dataset_id}")
+        raise
+
+
+def readiness_problems(bucket_name: str, dataset_id: str) -> list:
+    """Checks the bucket and dataset a loader uses; the trigger probes /readyz before starting a run."""
+    return (readiness.bucket_problems(storage.Client().bucket(bucket_name))
+            + readiness.dataset_problems(new_bq_client, dataset_id))
+
+
+# === Errors ===
+class StagingCheckFailed(Exception):
+    """A run's staging table failed its checks and was not promoted. load_errors lists the files
+    that failed to load, as load_error describes them, and category is theirs when they caused it."""
+
+    def __init__(self, message: str, load_errors: list = None, category: str = errcategory.DATA_FORMAT):
+        super().__init__(message)
+        self.load_errors = load_errors or []
+        self.category = category
+
+
+class LoadFailed(Exception):
+    """A file's load job failed for good; job_id and errors are BigQuery's account of it."""
+
+    def __init__(self, uri: str, job_id: str, error: Exception):
+        self.uri = uri
+        self.job_id = job_id
+        self.errors = [{k: v for k, v in err.items() if k in ("reason", "location", "message")}
+                       for err in (getattr(error, "errors", None) or [])[:5] if isinstance(err, dict)]
+        self.category = classify_error(error)
+        detail = self.errors[0].get("message") if self.errors else None
+        super().__init__(f"load job {job_id} for {uri} failed: {detail or error}")
+
+
+def classify_error(e: Exception) -> str:
+    """Maps an exception to an error category for failure events."""
+    if isinstance(e, (LoadFailed, StagingCheckFailed)):
+        return e.category
+    # BigQuery answers rate and quota limits with a 403; its reason tells them from permissions
+    if rate_limited(e):
+        return errcategory.QUOTA
+    return errcategory.of(e)
+
+
+def error_reasons(e: Exception) -> list:
+    """The reasons BigQuery gave for a failed call or job, e.g. rateLimitExceeded."""
+    return [err.get("reason") for err in getattr(e, "errors", None) or [] if isinstance(err, dict) and err.get("reason")]
+
+
+def rate_limited(e: Exception) -> bool:
+    return getattr(e, "code", None) == 429 or any(r in RATE_LIMIT_REASONS for r in error_reasons(e))
+
+
+def load_error(uri: str, e: Exception) -> dict:
+    """A failed file as failure events report it: its job id and BigQuery's errors when it got that far."""
+    if isinstance(e, LoadFailed):
+        return {"file": uri, "job_id": e.job_id, "error_category": e.category, "errors": e.errors, "message": str(e)}
+    return {"file": uri, "error_category": classify_error(e), "message": str(e)}
+
+
+# === Loads ===
+def run_load(bq_client, uri: str, table_id: str, job_config, job_prefix: str, since: datetime):
+    """Loads uri into table_id as job {job_prefix}_{file}_{n}, retrying rate and quota limits, and
+    returns the finished job. A job id already taken by a job created before since belongs to an
+    earlier attempt at the run, whose staging table has been replaced, so the next n is used.
+    Raises LoadFailed with BigQuery's errors when the load fails for good."""
+    base = re.sub(r"[^A-Za-z0-9_-]", "_", f"{job_prefix}_{uri.split('/', 3)[-1]}")
+    n = retries = 0
+    while True:
+        job_id = f"{base}_{n}"
+        n += 1
+        try:
+            try:
+                load_job = bq_client.load_table_from_uri(uri, table_id, job_id=job_id, job_config=job_config)
+            except Conflict:
+                load_job = bq_client.get_job(job_id, location=bq_client.location)
+                if load_job.created and load_job.created < since:
+                    continue
+                logger.info(f"🔁 {job_id} was already submitted; waiting on it")
+            load_job.result()
+            return load_job
+        except Exception as e:
+            if not rate_limited(e) or retries >= LOAD_RETRIES:
+                raise LoadFailed(uri, job_id, e) from e
+            delay = LOAD_RETRY_BASE_SECONDS * 2 ** retries
+            retries += 1
+            logger.warning(f"⏳ {job_id} hit a BigQuery rate limit, retrying in {delay:g}s ({retries}/{LOAD_RETRIES}): {e}")
+            time.sleep(delay)
+
+
+def reconcile(manifest: dict, rows_loaded: int) -> dict:
+    """Compares rows loaded with the manifest totals; the trigger reports any shortfall as data loss."""
+    result = {"rows_received": rows_loaded}
+    expected = (manifest.get("totals") or {}).get("rows")
+    if expected is not None:
+        result["rows_expected"] = expected
+        if rows_loaded != expected:
+            logger.warning(f"⚠️ Loaded {rows_loaded} rows but the manifest lists {expected}")
+    return result
+
+
+def staging_table_id(table_id: str, run_id: str, date: str) -> str:
+    """The run's staging table for table_id; a load with no run id gets one for its date."""
+    key = re.sub(r"[^A-Za-z0-9_]", "_", run_id or f"{date}_{uuid.uuid4().hex[:8]}")
+    return f"{table_id}_staging_{key}"
+
+
+def create_staging(bq_client, table_id: str, staging_id: str) -> bool:
+    """Replaces staging_id with an empty table shaped like table_id, so loads add columns and
+    check types there as they would on table_id. Returns False if table_id doesn't exist yet;
+    the first load then creates the staging table."""
+    bq_client.delete_table(staging_id, not_found_ok=True)
+    try:
+        target = bq_client.get_table(table_id)
+    except NotFound:
+        return False
+    staging = bigquery.Table(staging_id, schema=[f for f in target.schema if f.name != LOAD_RUN_ID_COLUMN])
+    staging.expires = datetime.now(timezone.utc) + timedelta(hours=STAGING_TTL_HOURS)
+    bq_client.create_table(staging)
+    logger.info(f"🧪 Staging the load in {staging_id}")
+    return True
+
+
+def expire_staging(bq_client, staging_id: str):
+    """Sets the expiry of a staging table the first load created."""
+    table = bq_client.get_table(staging_id)
+    table.expires = datetime.now(timezone.utc) + timedelta(hours=STAGING_TTL_HOURS)
+    bq_client.update_table(table, ["expires"])
+
+
+def verify_staging(bq_client, staging_id: str, manifest: dict, files_loaded: int, files_total: int, row_level: bool = True) -> dict:
+    """Checks a staging table before promotion: every file loaded, the manifest's row count when
+    it has one, and unless row_level is False the /verify checks, less STAGING_SKIP_CHECKS."""
+    if row_level:
+        result = row_checks(bq_client, staging_id)
+    else:
+        result = {"row_count": bq_client.get_table(staging_id).num_rows, "checks": {}, "bq_bytes_processed": 0}
+    checks = result["checks"]
+    checks["all_files_loaded"] = files_loaded == files_total
+    expected = (manifest.get("totals") or {}).get("rows")
+    if expected is not None:
+        checks["rows_match_manifest"] = result["row_count"] == expected
+    for name in STAGING_SKIP_CHECKS:
+        checks.pop(name, None)
+    result["passed"] = all(checks.values())
+    logger.info(f"{'✅' if result['passed'] else '⚠️'} Staging checks for {staging_id}: {result}")
+    return result
+
+
+def promote_staging(bq_client, staging_id: str, table_id: str, run_id: str, add_fields: bool) -> int:
+    """Adds staging_id to table_id, with run_id in LOAD_RUN_ID_COLUMN, and drops it. The rows an
+    earlier promotion of the run left, when its load was retried or redelivered, are deleted in
+    the same transaction as the insert, so the run's rows land once, in full or not at all.
+    add_fields first adds the staging table's new columns to an existing table_id; without it
+    table_id is created from staging_id. Returns the bytes the queries processed."""
+    params = [bigquery.ScalarQueryParameter("run_id", "STRING", run_id)]
+    if not add_fields:
+        job_config = bigquery.QueryJobConfig(
+            destination=table_id,
+            write_disposition=bigquery.WriteDisposition.WRITE_EMPTY,
+            query_parameters=params,
+        )
+        job = bq_client.query(f"SELECT *, @run_id AS `{LOAD_RUN_ID_COLUMN}` FROM `{staging_id}`", job_config=job_config)
+    else:
+        staged = bq_client.get_table(staging_id).schema
+        target = bq_client.get_table(table_id)
+        known = {f.name for f in target.schema}
+        added = [f for f in staged if f.name not in known]
+        if LOAD_RUN_ID_COLUMN not in known:
+            added.append(bigquery.SchemaField(LOAD_RUN_ID_COLUMN, "STRING"))
+        if added:
+            # DML can't add columns as a load or query job can, so the schema is widened first
+            target.schema = list(target.schema) + added
+            bq_client.update_table(target, ["schema"])
+        # Named columns, as the table's order needn't match the staging table's
+        columns = ", ".join(f"`{f.name}`" for f in staged)
+        job = bq_client.query(
+            f"""BEGIN TRANSACTION;
+DELETE FROM `{table_id}` WHERE `{LOAD_RUN_ID_COLUMN}` = @run_id;
+INSERT INTO `{table_id}` ({columns}, `{LOAD_RUN_ID_COLUMN}`) SELECT {columns}, @run_id FROM `{staging_id}`;
+COMMIT TRANSACTION;""",
+            job_config=bigquery.QueryJobConfig(query_parameters=params),
+        )
+    job.result()
+    logger.info(f"🚚 Promoted {staging_id} into {table_id}")
+    bq_client.delete_table(staging_id, not_found_ok=True)
+    return job.total_bytes_processed or 0
+
+
+LINEAGE_SCHEMA = [
+    bigquery.SchemaField("run_id", "STRING"),
+    bigquery.SchemaField("date", "STRING"),
+    bigquery.SchemaField("stage", "STRING"),
+    bigquery.SchemaField("target_table", "STRING"),
+    bigquery.SchemaField("target_column", "STRING"),
+    bigquery.SchemaField("source", "STRING"),
+    bigquery.SchemaField("source_fields", "STRING", mode="REPEATED"),
+    bigquery.SchemaField("transformations", "STRING", mode="REPEATED"),
+    bigquery.SchemaField("transformation_type", "STRING"),
+    bigquery.SchemaField("recorded_at", "TIMESTAMP"),
+]
+
+
+def record_lineage(storage_client, bq_client, bucket_name: str, prefix: str, date: str, run_id: str, table_id: str,
+                   stage: str, folder: str = "") -> list:
+    """
+    Records where each column of table_id loaded in this run came from: the raw fields and
+    cleaner steps from the _lineage.json in {prefix}/{date}/{folder} of bucket_name, then the load.
+    Returns the lineage of the recorded columns; failures are logged, never raised.
+    """
+    path = f"{prefix}/{date}/{folder}_lineage.json"
+    try:
+        blob = storage_client.bucket(bucket_name).blob(path)
+        if not blob.exists():
+            logger.warning(f"⚠️ No lineage found at: gs://{bucket_name}/{path}")
+            return []
+        doc = json.loads(blob.download_as_text())
+        table_columns = {field.name for field in bq_client.get_table(table_id).schema}
+    except Exception as e:
+        logger.error(f"❌ Failed to read lineage for {table_id}: {e}")
+        return []
+
+    records = [r for r in doc.get("columns", []) if r["column"] in table_columns]
+    load = f"{stage}: loaded from gs://{bucket_name}/{prefix}/{date}/{folder}"
+    now = datetime.utcnow().isoformat()
+    rows = [{
+        "run_id": run_id,
+        "date": date,
+        "stage": stage,
+        "target_table": table_id,
+        "target_column": r["column"],
+        "source": doc.get("source"),
+        "source_fields": r["sources"],
+        "transformations": r["transformations"] + [load],
+        "transformation_type": r["type"],
+        "recorded_at": now,
+    } for r in records]
+
+    if rows and LINEAGE_TABLE.lower() != "off":
+        lineage_table = f"{BQ_PROJECT}.{LINEAGE_TABLE}"
+        try:
+            ensure_dataset_exists(bq_client, lineage_table.rsplit(".", 1)[0])
+            table = bigquery.Table(lineage_table, schema=LINEAGE_SCHEMA)
+            table.time_partitioning = bigquery.TimePartitioning(field="recorded_at")
+            bq_client.create_table(table, exists_ok=True)
+            # Row IDs let BigQuery drop the rows of a retried load
+            row_ids = [f"{run_id or date}-{table_id}-{row['target_column']}" for row in rows]
+            errors = bq_client.insert_rows_json(lineage_table, rows, row_ids=row_ids)
+            if errors:
+                logger.error(f"❌ Failed to record lineage in {lineage_table}: {errors[:3]}")
+            else:
+                logger.info(f"🧬 Recorded lineage of {len(rows)} columns of {table_id} in {lineage_table}")
+        except Exception as e:
+            logger.error(f"❌ Failed to record lineage in {lineage_table}: {e}")
+    return records
+
+
+def loaded_columns(records: list) -> list:
+    """The load step alone, for OpenLineage: each column copied from the cleaned files, whose own steps the cleaner reports."""
+    return [{"column": r["column"], "sources": [r["column"]], "transformations": [], "type": "IDENTITY"} for r in records]
+
+
+def verify_date(bq_client, table_id: str, date: str, run_id: str = None) -> dict:
+    """Runs verify_run for each run that loaded date's files into table_id, as LINEAGE_TABLE
+    records them, or only for run_id among them. The pipeline date is the extraction's, not a
+    column, so the runs are how its rows are found. Raises LookupError when none are recorded."""
+    if LINEAGE_TABLE.lower() == "off":
+        raise LookupError("LINEAGE_TABLE is off, so a date's runs aren't recorded; pass run_id instead")
+    params = [
+        bigquery.ScalarQueryParameter("date", "STRING", date),
+        bigquery.ScalarQueryParameter("table", "STRING", table_id),
+    ]
+    query = f"SELECT DISTINCT run_id FROM `{BQ_PROJECT}.{LINEAGE_TABLE}` WHERE date = @date AND target_table = @table AND run_id IS NOT NULL"
+    if run_id:
+        query += " AND run_id = @run_id"
+        params.append(bigquery.ScalarQueryParameter("run_id", "STRING", run_id))
+    try:
+        job = bq_client.query(query, job_config=bigquery.QueryJobConfig(query_parameters=params))
+        run_ids = sorted(row["run_id"] for row in job.result())
+    except NotFound:
+        run_ids = []
+    if not run_ids:
+        raise LookupError(f"no run{' ' + run_id if run_id else ''} is recorded loading {date} into {table_id}")
+
+    runs = [verify_run(bq_client, table_id, r) for r in run_ids]
+    return {
+        "table": table_id,
+        "date": date,
+        "runs": runs,
+        "passed": all(r["passed"] for r in runs),
+    }
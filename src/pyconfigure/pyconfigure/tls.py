@@ -0,0 +1,74 @@
+"""Optional TLS and mutual TLS for the Python services, from the same TLS_* variables as
+configure/tlsconfig in the Go services, so a self-hosted deployment can turn mTLS on for every
+stage at once. On Cloud Run none of them are set and everything stays plain HTTP.
+
+Server side, applied by gunicorn_conf:
+
+    TLS_CERT_FILE, TLS_KEY_FILE  serve HTTPS with this certificate
+    TLS_CLIENT_CA_FILE           require client certificates signed by this CA (mTLS)
+    TLS_CLIENT_AUTH              "require" (default when a client CA is set) or
+                                 "optional" to verify certificates only when presented
+
+Client side, through client_options for calls to other services:
+
+    TLS_CA_FILE                  trust this CA in addition to the system roots
+    TLS_CLIENT_CERT_FILE/KEY     certificate presented to peers; defaults to the server pair
+"""
+import logging
+import os
+import ssl
+import tempfile
+
+import certifi
+
+logger = logging.getLogger(__name__)
+
+CERT_FILE = os.environ.get("TLS_CERT_FILE", "")
+KEY_FILE = os.environ.get("TLS_KEY_FILE", "")
+CLIENT_CA_FILE = os.environ.get("TLS_CLIENT_CA_FILE", "")
+CLIENT_AUTH = os.environ.get("TLS_CLIENT_AUTH", "").lower()
+CA_FILE = os.environ.get("TLS_CA_FILE", "")
+CLIENT_CERT_FILE = os.environ.get("TLS_CLIENT_CERT_FILE", "")
+CLIENT_KEY_FILE = os.environ.get("TLS_CLIENT_KEY_FILE", "")
+if not CLIENT_CERT_FILE and not CLIENT_KEY_FILE:
+    CLIENT_CERT_FILE, CLIENT_KEY_FILE = CERT_FILE, KEY_FILE
+
+
+def server_settings() -> dict:
+    """gunicorn's TLS settings, empty when TLS is off. Raises ValueError on a setup the Go
+    services would refuse too."""
+    if not (CERT_FILE and KEY_FILE):
+        if CLIENT_CA_FILE:
+            raise ValueError("TLS_CLIENT_CA_FILE is set but TLS_CERT_FILE/TLS_KEY_FILE are not")
+        return {}
+    settings = {"certfile": CERT_FILE, "keyfile": KEY_FILE}
+    if CLIENT_CA_FILE:
+        if CLIENT_AUTH not in ("", "require", "optional"):
+            raise ValueError(f"invalid TLS_CLIENT_AUTH {CLIENT_AUTH!r} (want require or optional)")
+        settings["ca_certs"] = CLIENT_CA_FILE
+        settings["cert_reqs"] = ssl.CERT_OPTIONAL if CLIENT_AUTH == "optional" else ssl.CERT_REQUIRED
+    return settings
+
+
+_ca_bundle = None
+
+
+def client_options() -> dict:
+    """The verify and cert arguments for requests calls to other services; empty when the
+    defaults apply."""
+    global _ca_bundle
+    options = {}
+    if CA_FILE:
+        if _ca_bundle is None:
+            # requests replaces the system roots with verify's bundle; keeping them in it lets
+            # calls to public APIs still verify, as the Go services' pool does
+            with open(certifi.where(), "rb") as roots, open(CA_FILE, "rb") as ca:
+                bundle = tempfile.NamedTemporaryFile(prefix="tls-ca-", suffix=".pem", delete=False)
+                bundle.write(roots.read() + b"\n" + ca.read())
+                bundle.close()
+            _ca_bundle = bundle.name
+        options["verify"] = _ca_bundle
+    if CLIENT_CERT_FILE and CLIENT_KEY_FILE:
+        # Only sent when the peer asks for one
+        options["cert"] = (CLIENT_CERT_FILE, CLIENT_KEY_FILE)
+    return options
@@ -0,0 +1,40 @@
+"""The loaders' local mode: a SQLite file standing in for BigQuery, so a pipeline run needs no
+cloud account."""
+import json
+import sqlite3
+
+
+def sqlite_value(value):
+    """A value as SQLite stores it: lists and dicts as JSON text, bools as 0/1, dates as text."""
+    if isinstance(value, (list, dict)):
+        return json.dumps(value, default=str)
+    if isinstance(value, bool):
+        return int(value)
+    if value is None or isinstance(value, (str, int, float)):
+        return value
+    return str(value)
+
+
+def write_sqlite(path: str, table: str, rows: list) -> int:
+    """Appends rows to a table of the SQLite file at path, creating it and adding any new columns
+    first (as ALLOW_FIELD_ADDITION does for the BigQuery loads). Returns the rows written."""
+    if not rows:
+        return 0
+    columns = list(dict.fromkeys(name for row in rows for name in row))
+    quoted = [f'"{c}"' for c in columns]
+    conn = sqlite3.connect(path)
+    try:
+        conn.execute(f'CREATE TABLE IF NOT EXISTS "{table}" ({", ".join(quoted)})')
+        existing = {r[1] for r in conn.execute(f'PRAGMA table_info("{table}")')}
+        for name, column in zip(columns, quoted):
+            if name not in existing:
+                conn.execute(f'ALTER TABLE "{table}" ADD COLUMN {column}')
+        placeholders = ", ".join("?" for _ in columns)
+        conn.executemany(
+            f'INSERT INTO "{table}" ({", ".join(quoted)}) VALUES ({placeholders})',
+            [[sqlite_value(row.get(c)) for c in columns] for row in rows],
+        )
+        conn.commit()
+    finally:
+        conn.close()
+    return len(rows)
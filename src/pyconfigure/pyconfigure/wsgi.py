@@ -0,0 +1,34 @@
+"""The WSGI app gunicorn serves a service's entry point with.
+
+Request bodies are capped at HTTP_MAX_BODY_BYTES, as in the Go services; gunicorn already
+bounds the request line and headers.
+"""
+import os
+
+from werkzeug.wrappers import Request, Response
+
+from .problem import problem
+
+MAX_BODY_BYTES = int(os.environ.get("HTTP_MAX_BODY_BYTES", str(10 << 20)))
+
+
+def app(entry_point, limits: dict = None):
+    """Wraps entry_point, which takes a Request and returns (body, status, headers), in a WSGI
+    app. limits maps paths that take larger bodies to their cap."""
+    limits = limits or {}
+
+    def wsgi_app(environ, start_response):
+        request = Request(environ)
+        # Reads past the cap fail, so a body without a length can't exceed it either
+        cap = limits.get(request.path, MAX_BODY_BYTES)
+        request.max_content_length = cap
+        if (request.content_length or 0) > cap:
+            response_text, status, headers = problem(
+                request, 413, "payload-too-large",
+                f"Request body is {request.content_length} bytes; the limit is {cap}")
+        else:
+            response_text, status, headers = entry_point(request)
+        response = Response(response_text, status=status, headers=headers)
+        return response(environ, start_response)
+
+    return wsgi_app
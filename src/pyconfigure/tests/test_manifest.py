@@ -0,0 +1,45 @@
+"""pyconfigure.manifest against the vectors configure/manifest's Go tests read, so the
+cleaner and loaders accept and reject the manifests the Go stages do.
+
+Run from src/pyconfigure: python -m unittest discover tests
+"""
+import copy
+import json
+import os
+import unittest
+
+from pyconfigure import manifest
+
+VECTORS = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "..", "configure", "manifest", "testdata", "manifests.json")
+
+with open(VECTORS, encoding="utf-8") as f:
+    vectors = json.load(f)
+
+
+class CheckTest(unittest.TestCase):
+    def test_vectors(self):
+        for v in vectors:
+            with self.subTest(v["name"]):
+                doc = copy.deepcopy(v["manifest"])
+                if "status" in v:
+                    got = manifest.check(doc, "2025-01-31")
+                    self.assertEqual(got["status"], v["status"])
+                    self.assertEqual(got["upload_complete"], v["status"] == manifest.STATUS_COMPLETE)
+                    continue
+                with self.assertRaises(manifest.ManifestError) as raised:
+                    manifest.check(doc, "2025-01-31")
+                if "violations" in v:
+                    self.assertEqual([p["actual"] for p in raised.exception.problems], v["violations"])
+                else:
+                    self.assertIn(v["error"], str(raised.exception))
+
+    def test_upgrade_keeps_version(self):
+        got = manifest.check({"date": "2025-01-31", "files": [], "upload_complete": True}, "2025-01-31")
+        self.assertEqual(got["schema_version"], 1)
+
+    def test_validate_not_an_object(self):
+        self.assertEqual(manifest.validate([]), ["manifest: must be object"])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,63 @@
+package alerts
+
+import (
+	"bytes"
+	"configure/logging"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Alert is a pipeline condition an operator should look at.
+type Alert struct {
+	Kind     string    `json:"kind"`
+	RunID    string    `json:"run_id,omitempty"`
+	Date     string    `json:"date,omitempty"`
+	Stage    string    `json:"stage,omitempty"`
+	Message  string    `json:"message"`
+	Category string    `json:"category,omitempty"` // errcategory of a reported failure
+	Time     time.Time `json:"time"`
+}
+
+// Notifier logs every alert and, when WebhookURL is set, posts it there.
+// The body carries a "text" field so Slack/Chat incoming webhooks render it as-is.
+type Notifier struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+func NewNotifier(webhookURL string) *Notifier {
+	return &Notifier{WebhookURL: webhookURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *Notifier) Send(a Alert) {
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	// Messages often embed upstream error text; keep credentials out of chat
+	a.Message = logging.Redact(a.Message)
+	log.Printf("🚨 ALERT [%s] run=%s stage=%s date=%s: %s", a.Kind, a.RunID, a.Stage, a.Date, a.Message)
+	if n == nil || n.WebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"text":  fmt.Sprintf("🚨 [%s] %s (run %s, stage %s)", a.Kind, a.Message, a.RunID, a.Stage),
+		"alert": a,
+	})
+	if err != nil {
+		log.Printf("❌ Failed to marshal alert: %v", err)
+		return
+	}
+	resp, err := n.Client.Post(n.WebhookURL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Printf("❌ Failed to deliver alert to webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("⚠️ Alert webhook returned %s", resp.Status)
+	}
+}
@@ -5,6 +5,6 @@ echo "=== 🛠 Building Trigger ==="
 cd "$(dirname "$0")"
 
 echo "--- Building Docker image (multi-stage)..."
-docker build -t hygiene_prediction-trigger -f Dockerfile .
+docker build -t hygiene_prediction-trigger -f Dockerfile ..
 
 echo "✅ Docker image built: hygiene_prediction-trigger"
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"app/alerts"
+	"app/configure"
+	"app/runs"
+	"configure/gcp"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// chunkAnomalyEvent is recorded on a run whose extraction stands out from
+// the runs before it.
+const chunkAnomalyEvent = "chunk_anomaly"
+
+// chunkRunStats is a run's chunk_metrics rolled up. Durations leave out
+// chunks that were never fetched or were unchanged, which take no time.
+type chunkRunStats struct {
+	RunID       string
+	Chunks      int
+	DropRate    float64 // rows dropped over rows fetched
+	AvgDuration float64 // seconds per fetched chunk
+}
+
+// chunkAnomaly is one way a run's chunk metrics stood out.
+type chunkAnomaly struct {
+	Kind      string // drop_rate_spike or duration_regression
+	Value     float64
+	Baseline  float64 // the trailing runs' mean
+	Threshold float64
+	Message   string
+}
+
+// chunkRunHistory rolls up chunk_metrics for runID and the latest trailing
+// other runs of the last 30 days. The run itself comes first when it wrote
+// any.
+func chunkRunHistory(ctx context.Context, project, location, runID string, trailing int) ([]chunkRunStats, error) {
+	sql := fmt.Sprintf("SELECT run_id, COUNT(*) AS chunks, "+
+		"SAFE_DIVIDE(SUM(rows_dropped), SUM(rows_extracted + rows_dropped)) AS drop_rate, "+
+		"AVG(IF(fetch_skipped OR skipped_unchanged, NULL, chunk_duration_seconds)) AS avg_duration "+
+		"FROM `%s.PipelineMonitoring.chunk_metrics` "+
+		"WHERE timestamp >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 30 DAY) AND run_id IS NOT NULL AND run_id != '' "+
+		"GROUP BY run_id ORDER BY run_id = '%s' DESC, MAX(timestamp) DESC LIMIT %d",
+		project, runID, trailing+1)
+	rows, err := gcp.QueryRows(ctx, project, location, sql)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]chunkRunStats, len(rows))
+	for i, row := range rows {
+		stats[i].RunID, _ = row["run_id"].(string)
+		stats[i].Chunks = int(queryFloat(row["chunks"]))
+		stats[i].DropRate = queryFloat(row["drop_rate"])
+		stats[i].AvgDuration = queryFloat(row["avg_duration"])
+	}
+	return stats, nil
+}
+
+// queryFloat reads a numeric query value, which BigQuery sends as a string;
+// NULL reads as 0.
+func queryFloat(v any) float64 {
+	s, _ := v.(string)
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// findChunkAnomalies compares a run against the mean of the trailing runs: a
+// drop rate more than DropRateIncrease above theirs is a spike, a mean chunk
+// duration more than DurationRatio times theirs a regression.
+func findChunkAnomalies(run chunkRunStats, trailing []chunkRunStats, cfg configure.AnomalyConfig) []chunkAnomaly {
+	// A run whose pages were all unchanged has no duration to average
+	var dropRate, duration float64
+	timed := 0
+	for _, t := range trailing {
+		dropRate += t.DropRate
+		if t.AvgDuration > 0 {
+			duration += t.AvgDuration
+			timed++
+		}
+	}
+	dropRate /= float64(len(trailing))
+	if timed > 0 {
+		duration /= float64(timed)
+	}
+
+	var found []chunkAnomaly
+	if limit := dropRate + cfg.DropRateIncrease; run.DropRate > limit {
+		found = append(found, chunkAnomaly{
+			Kind: "drop_rate_spike", Value: run.DropRate, Baseline: dropRate, Threshold: limit,
+			Message: fmt.Sprintf("%.1f%% of rows dropped, against %.1f%% over the last %d runs", 100*run.DropRate, 100*dropRate, len(trailing)),
+		})
+	}
+	if limit := duration * cfg.DurationRatio; duration > 0 && run.AvgDuration > limit {
+		found = append(found, chunkAnomaly{
+			Kind: "duration_regression", Value: run.AvgDuration, Baseline: duration, Threshold: limit,
+			Message: fmt.Sprintf("chunks took %.1fs on average, against %.1fs over the last %d runs", run.AvgDuration, duration, timed),
+		})
+	}
+	return found
+}
+
+// detectChunkAnomalies checks a finished run's extraction against the runs
+// before it, recording a chunk_anomaly event on the run and alerting for
+// each way it stands out. Runs without chunk metrics, self-test runs and
+// those with too short a history aren't checked, nor is anything without a
+// bootstrap project, which owns the table.
+func detectChunkAnomalies(ctx context.Context, run runs.Run) {
+	cfg := serviceConfig.Anomalies.WithDefaults()
+	project := serviceConfig.Bootstrap.Project
+	if cfg.Disabled || project == "" || run.Params["selftest"] == true || !runIDPattern.MatchString(run.ID) {
+		return
+	}
+	location := serviceConfig.Bootstrap.Location
+	if location == "" {
+		location = "US"
+	}
+	history, err := chunkRunHistory(ctx, project, location, run.ID, cfg.TrailingRuns)
+	if err != nil {
+		log.Printf("⚠️ Could not read chunk metrics for run %s: %v", run.ID, err)
+		return
+	}
+	if len(history) == 0 || history[0].RunID != run.ID {
+		return
+	}
+	current, trailing := history[0], history[1:]
+	if len(trailing) < cfg.MinRuns {
+		log.Printf("ℹ️ Only %d earlier run(s) with chunk metrics — not checking run %s for anomalies", len(trailing), run.ID)
+		return
+	}
+
+	found := findChunkAnomalies(current, trailing, cfg)
+	for _, a := range found {
+		registry.RecordEvent(run.ID, runs.Event{Name: chunkAnomalyEvent, Origin: "trigger", Fields: map[string]interface{}{
+			"kind":      a.Kind,
+			"value":     a.Value,
+			"baseline":  a.Baseline,
+			"threshold": a.Threshold,
+			"message":   a.Message,
+		}})
+		emitMetric(chunkAnomalyEvent, map[string]interface{}{
+			"run_id":    run.ID,
+			"date":      run.Date,
+			"kind":      a.Kind,
+			"value":     a.Value,
+			"baseline":  a.Baseline,
+			"threshold": a.Threshold,
+		})
+		alerter.Send(alerts.Alert{
+			Kind:    chunkAnomalyEvent,
+			RunID:   run.ID,
+			Date:    run.Date,
+			Stage:   "extractor",
+			Message: a.Kind + ": " + a.Message,
+		})
+	}
+	log.Printf("🔎 Run %s against %d earlier run(s): %d chunk(s), drop rate %.3f, %.1fs per chunk, %d flagged",
+		run.ID, len(trailing), current.Chunks, current.DropRate, current.AvgDuration, len(found))
+}
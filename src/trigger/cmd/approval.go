@@ -0,0 +1,186 @@
+package main
+
+import (
+	"app/alerts"
+	"app/routing"
+	"app/runs"
+	"configure/audit"
+	"configure/errcategory"
+	"configure/problem"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Events recorded on a run at a stage's approval gate
+const (
+	approvalRequestedEvent = "approval_requested"
+	approvalGrantedEvent   = "approval_granted"
+	approvalRejectedEvent  = "approval_rejected"
+	approvalExpiredEvent   = "approval_expired"
+)
+
+// approvalRequest is the optional body of /approve and /reject.
+type approvalRequest struct {
+	// Stage to decide; may be left out while only one stage is waiting
+	Stage string `json:"stage"`
+	// Why, recorded on the run with who decided (see decidedBy)
+	Reason string `json:"reason"`
+}
+
+// holdForApproval puts a stage whose upstream completed at its approval gate
+// instead of starting it: the run records the pending approval, an alert asks
+// for a decision, and the run fails if none comes within the stage's
+// approval timeout. The stage's SLA clock starts once it is approved.
+func holdForApproval(runID, date string, stage routing.Stage) {
+	a, ok := registry.AwaitApproval(runID, stage.Name, stage.ApprovalLimit())
+	if !ok {
+		return
+	}
+	registry.RecordEvent(runID, runs.Event{Name: approvalRequestedEvent, Origin: "trigger", Fields: map[string]interface{}{
+		"stage":      stage.Name,
+		"expires_at": a.ExpiresAt,
+	}})
+	log.Printf("✋ Run %s holds %s for approval until %s", runID, stage.Name, a.ExpiresAt.Format(time.RFC3339))
+	emitMetric(approvalRequestedEvent, map[string]interface{}{
+		"run_id": runID,
+		"date":   date,
+		"stage":  stage.Name,
+	})
+	alerter.Send(alerts.Alert{
+		Kind:    approvalRequestedEvent,
+		RunID:   runID,
+		Date:    date,
+		Stage:   stage.Name,
+		Message: fmt.Sprintf("stage %s is waiting for approval: POST /runs/%s/approve or /reject before %s", stage.Name, runID, a.ExpiresAt.Format(time.RFC3339)),
+	})
+	time.AfterFunc(time.Until(a.ExpiresAt), func() {
+		if _, err := registry.TakeApproval(runID, stage.Name); err != nil {
+			// Decided already, or the run failed meanwhile
+			return
+		}
+		err := errcategory.Errorf(errcategory.Downstream, "stage %s was not approved within %s", stage.Name, stage.ApprovalLimit())
+		closeGate(runID, date, stage.Name, approvalExpiredEvent, nil, err)
+	})
+}
+
+// closeGate records a rejected or expired approval and fails the run.
+func closeGate(runID, date, stage, event string, fields map[string]interface{}, err error) {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["stage"] = stage
+	fields["error"] = err.Error()
+	registry.RecordEvent(runID, runs.Event{Name: event, Origin: "trigger", Fields: fields})
+	log.Printf("⛔ Run %s: %v", runID, err)
+	registry.Fail(runID, err)
+	go finishRun(runID)
+	emitMetric(event, map[string]interface{}{
+		"run_id": runID,
+		"date":   date,
+		"stage":  stage,
+	})
+	alerter.Send(alerts.Alert{
+		Kind:     event,
+		RunID:    runID,
+		Date:     date,
+		Stage:    stage,
+		Message:  err.Error(),
+		Category: string(errcategory.Of(err)),
+	})
+}
+
+// handleRunApprove releases a stage held at its approval gate and starts it:
+// POST /runs/{id}/approve, with {"stage": ...} naming the stage when more
+// than one is waiting. Callers need the admin token.
+func handleRunApprove(w http.ResponseWriter, r *http.Request) {
+	run, a, req, ok := takeApproval(w, r)
+	if !ok {
+		return
+	}
+	stage, _ := run.Topology.ByName(a.Stage)
+	by := decidedBy(r)
+	registry.RecordEvent(run.ID, runs.Event{Name: approvalGrantedEvent, Origin: "trigger", Fields: map[string]interface{}{
+		"stage":  a.Stage,
+		"by":     by,
+		"reason": req.Reason,
+	}})
+	log.Printf("👍 Run %s: %s approved by %s after %s", run.ID, a.Stage, by, time.Since(a.RequestedAt).Round(time.Second))
+	emitMetric(approvalGrantedEvent, map[string]interface{}{
+		"run_id":       run.ID,
+		"date":         run.Date,
+		"stage":        a.Stage,
+		"wait_seconds": time.Since(a.RequestedAt).Seconds(),
+	})
+	watchStage(run.ID, run.Date, stage, 0)
+	go startStage(run.ID, run.Date, stage)
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"run_id":  run.ID,
+		"stage":   a.Stage,
+		"status":  run.Status,
+		"message": "✅ Stage approved and started",
+	})
+}
+
+// handleRunReject fails a run at a stage's approval gate, leaving the stage
+// unstarted: POST /runs/{id}/reject with an optional {"stage", "reason"}.
+// Callers need the admin token. POST /runs/{id}/retry holds the stage at its
+// gate again.
+func handleRunReject(w http.ResponseWriter, r *http.Request) {
+	run, a, req, ok := takeApproval(w, r)
+	if !ok {
+		return
+	}
+	by := decidedBy(r)
+	msg := fmt.Sprintf("stage %s was rejected at its approval gate by %s", a.Stage, by)
+	if req.Reason != "" {
+		msg += ": " + req.Reason
+	}
+	closeGate(run.ID, run.Date, a.Stage, approvalRejectedEvent, map[string]interface{}{"by": by, "reason": req.Reason},
+		errcategory.Errorf(errcategory.DataFormat, "%s", msg))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"run_id":  run.ID,
+		"stage":   a.Stage,
+		"status":  runs.StatusFailed,
+		"message": "⛔ " + msg,
+	})
+}
+
+// takeApproval reads an approve or reject request and ends the approval it
+// names, answering the request itself when it can't.
+func takeApproval(w http.ResponseWriter, r *http.Request) (runs.Run, runs.Approval, approvalRequest, bool) {
+	var req approvalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return runs.Run{}, runs.Approval{}, req, false
+	}
+	id := r.PathValue("id")
+	a, err := registry.TakeApproval(id, req.Stage)
+	switch {
+	case errors.Is(err, runs.ErrNotFound):
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return runs.Run{}, runs.Approval{}, req, false
+	case err != nil:
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, fmt.Sprintf("Run %s: %v", id, err))
+		return runs.Run{}, runs.Approval{}, req, false
+	}
+	run, _ := registry.Get(id)
+	return run, a, req, true
+}
+
+// decidedBy is who approved or rejected: the caller's identity once Google
+// has vouched for it (see audit.Identity). A body or an unsigned header can
+// name anyone, so without a verified identity the decision was made with
+// the shared admin token.
+func decidedBy(r *http.Request) string {
+	if caller, verified := audit.Identity(r); verified {
+		return caller
+	}
+	return "admin-token"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"app/alerts"
+	"app/runs"
+	"configure/errcategory"
+	"configure/manifest"
+	"configure/retry"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// verificationFailedEvent is recorded on a run whose extraction didn't pass the barrier.
+const verificationFailedEvent = "verification_failed"
+
+// A listing or manifest read that fails is tried again before the run fails.
+var barrierPolicy = retry.Policy{Attempts: 3, Initial: 2 * time.Second}
+
+// verifyExtraction is the barrier between the extractor and the stages after
+// it: it reads the manifest in the bucket and folder the extractor_completed
+// event names and checks it is complete and that every chunk it lists is in
+// the folder with its recorded size. It returns nil when the check passes, is
+// off (MANIFEST_BARRIER=off) or can't run because the event doesn't name the
+// folder (an older extractor).
+func verifyExtraction(fields map[string]interface{}) error {
+	if strings.EqualFold(os.Getenv("MANIFEST_BARRIER"), "off") {
+		return nil
+	}
+	bucket, _ := fields["bucket"].(string)
+	folder, _ := fields["folder"].(string)
+	if bucket == "" || folder == "" {
+		log.Printf("⚠️ extractor_completed names no manifest folder — skipping verification barrier")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	return barrierPolicy.Do(ctx, func(ctx context.Context, attempt int) error {
+		m, err := manifest.Read(ctx, bucket, folder)
+		if err == nil {
+			err = manifest.CheckListed(ctx, bucket, folder, m)
+		}
+		// A manifest that doesn't match its chunks won't on a second look either
+		if errcategory.Of(err) == errcategory.DataFormat {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+}
+
+// failVerification records a verification_failed event listing the
+// discrepancies, fails the run and alerts, leaving the cleaner unstarted.
+func failVerification(runID, date string, tracked bool, err error) {
+	var discrepancies []manifest.Problem
+	var mismatch *manifest.Error
+	if errors.As(err, &mismatch) {
+		discrepancies = mismatch.Problems
+	}
+	log.Printf("🚧 Extraction for run %s did not pass verification: %v", runID, err)
+	if tracked {
+		registry.RecordEvent(runID, runs.Event{Name: verificationFailedEvent, Origin: "trigger", Fields: map[string]interface{}{
+			"error":         err.Error(),
+			"discrepancies": discrepancies,
+		}})
+		registry.Fail(runID, err)
+		go finishRun(runID)
+	}
+	emitMetric(verificationFailedEvent, map[string]interface{}{
+		"run_id":         runID,
+		"date":           date,
+		"discrepancies":  len(discrepancies),
+		"error_category": errcategory.Of(err),
+	})
+	alerter.Send(alerts.Alert{
+		Kind:     verificationFailedEvent,
+		RunID:    runID,
+		Date:     date,
+		Stage:    "extractor",
+		Message:  err.Error(),
+		Category: string(errcategory.Of(err)),
+	})
+}
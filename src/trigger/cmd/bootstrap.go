@@ -0,0 +1,192 @@
+package main
+
+import (
+	"configure/gcp"
+	"configure/problem"
+	"configure/schemas"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Monitoring tables the extractor, loaders and trigger stream into.
+// chunk_attempts, raw_row_samples and column_lineage are also created on
+// first use; the extractor expects chunk_metrics to exist and the trigger
+// stage_metrics.
+var monitoringTables = []tableSpec{
+	{Dataset: "PipelineMonitoring", Table: "chunk_metrics", Partition: "timestamp", Columns: schemas.ChunkMetrics},
+	{Dataset: "PipelineMonitoring", Table: "stage_metrics", Partition: "recorded_at", Columns: schemas.StageMetrics},
+	{Dataset: "PipelineMonitoring", Table: "chunk_attempts", Partition: "timestamp", Columns: schemas.Schema{
+		{Name: "run_id", Type: "STRING"},
+		{Name: "date", Type: "STRING"},
+		{Name: "mode", Type: "STRING"},
+		{Name: "offset", Type: "INTEGER"},
+		{Name: "operation", Type: "STRING"},
+		{Name: "attempt", Type: "INTEGER"},
+		{Name: "outcome", Type: "STRING"},
+		{Name: "error_class", Type: "STRING"},
+		{Name: "error", Type: "STRING"},
+		{Name: "status_code", Type: "INTEGER"},
+		{Name: "latency_seconds", Type: "FLOAT"},
+		{Name: "timestamp", Type: "TIMESTAMP"},
+	}},
+	{Dataset: "PipelineMonitoring", Table: "raw_row_samples", Partition: "timestamp", Columns: schemas.Schema{
+		{Name: "run_id", Type: "STRING"},
+		{Name: "date", Type: "STRING"},
+		{Name: "mode", Type: "STRING"},
+		{Name: "offset", Type: "INTEGER"},
+		{Name: "object", Type: "STRING"},
+		{Name: "row_index", Type: "INTEGER"},
+		{Name: "row", Type: "STRING"},
+		{Name: "timestamp", Type: "TIMESTAMP"},
+	}},
+	{Dataset: "PipelineMonitoring", Table: "column_lineage", Partition: "recorded_at", Columns: schemas.Schema{
+		{Name: "run_id", Type: "STRING"},
+		{Name: "date", Type: "STRING"},
+		{Name: "stage", Type: "STRING"},
+		{Name: "target_table", Type: "STRING"},
+		{Name: "target_column", Type: "STRING"},
+		{Name: "source", Type: "STRING"},
+		{Name: "source_fields", Type: "STRING", Mode: "REPEATED"},
+		{Name: "transformations", Type: "STRING", Mode: "REPEATED"},
+		{Name: "transformation_type", Type: "STRING"},
+		{Name: "recorded_at", Type: "TIMESTAMP"},
+	}},
+}
+
+// tableSpec is a table as bootstrap creates it and the drift check expects it,
+// partitioned by day on a TIMESTAMP column.
+type tableSpec struct {
+	Dataset, Table string
+	Partition      string
+	Columns        schemas.Schema
+}
+
+func (t tableSpec) Name() string { return t.Dataset + "." + t.Table }
+
+// DDL creates the table in project unless it exists.
+func (t tableSpec) DDL(project string) string {
+	cols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = "  " + c.DDL()
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s.%s` (\n%s\n) PARTITION BY DATE(`%s`)",
+		project, t.Name(), strings.Join(cols, ",\n"), t.Partition)
+}
+
+// Permissions the pipeline's services need, checked for the trigger's own
+// service account, which is expected to share the pipeline's roles.
+var (
+	bootstrapProjectPermissions = []string{
+		"storage.buckets.create",
+		"bigquery.datasets.create",
+		"bigquery.tables.create",
+		"bigquery.tables.updateData",
+		"bigquery.jobs.create",
+	}
+	bootstrapBucketPermissions = []string{
+		"storage.objects.create",
+		"storage.objects.get",
+		"storage.objects.list",
+		"storage.objects.delete",
+	}
+)
+
+type bootstrapStep struct {
+	Resource string `json:"resource"`
+	Action   string `json:"action"` // created | exists | ensured | checked | planned | failed
+	Detail   string `json:"detail,omitempty"`
+}
+
+// handleBootstrap provisions a new project in one call: POST /admin/bootstrap
+// checks the project and bucket permissions, then creates the configured
+// buckets and datasets and the monitoring tables, leaving existing ones as
+// they are, so it is safe to repeat. ?dry_run=true only checks the project
+// permissions and lists what would be created. Stage tables (cleaned rows,
+// features, predictions) are still created by their stages on first load.
+// Callers need the admin token. It answers 200 with every step, or 502 if any
+// failed.
+func handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	cfg := serviceConfig.Bootstrap
+	if cfg.Project == "" {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "bootstrap.project is not configured")
+		return
+	}
+	location := serviceConfig.DatasetLocation()
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	var steps []bootstrapStep
+	failed := false
+	record := func(resource, action string, err error) {
+		step := bootstrapStep{Resource: resource, Action: action}
+		if err != nil {
+			step.Action, step.Detail = "failed", err.Error()
+			failed = true
+			log.Printf("❌ Bootstrap %s: %v", resource, err)
+		} else {
+			log.Printf("🏗️ Bootstrap %s: %s", resource, action)
+		}
+		steps = append(steps, step)
+	}
+
+	missing, err := gcp.MissingProjectPermissions(ctx, cfg.Project, bootstrapProjectPermissions)
+	if err == nil && len(missing) > 0 {
+		err = fmt.Errorf("missing permissions: %s", strings.Join(missing, ", "))
+	}
+	record("projects/"+cfg.Project, "checked", err)
+
+	for _, bucket := range cfg.Buckets {
+		action := "planned"
+		var err error
+		if !dryRun {
+			var created bool
+			if created, err = gcp.CreateBucket(ctx, cfg.Project, bucket, serviceConfig.BucketLocation(bucket), cfg.Lifecycle[bucket]); created {
+				action = "created"
+			} else {
+				action = "exists"
+			}
+		}
+		if err == nil && !dryRun {
+			var missing []string
+			missing, err = gcp.MissingBucketPermissions(ctx, bucket, bootstrapBucketPermissions)
+			if err == nil && len(missing) > 0 {
+				err = fmt.Errorf("missing permissions: %s", strings.Join(missing, ", "))
+			}
+		}
+		record("gs://"+bucket, action, err)
+	}
+
+	for _, dataset := range cfg.Datasets {
+		sql := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS `%s.%s` OPTIONS(location=%q)", cfg.Project, dataset, location)
+		action, err := bootstrapQuery(ctx, cfg.Project, location, dryRun, sql)
+		record(cfg.Project+"."+dataset, action, err)
+	}
+	for _, t := range monitoringTables {
+		action, err := bootstrapQuery(ctx, cfg.Project, location, dryRun, t.DDL(cfg.Project))
+		record(cfg.Project+"."+t.Name(), action, err)
+	}
+
+	status := http.StatusOK
+	if failed {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"project": cfg.Project,
+		"dry_run": dryRun,
+		"ok":      !failed,
+		"steps":   steps,
+	})
+}
+
+// bootstrapQuery runs one IF NOT EXISTS statement, returning the action and error to record.
+func bootstrapQuery(ctx context.Context, project, location string, dryRun bool, sql string) (string, error) {
+	if dryRun {
+		return "planned", nil
+	}
+	return "ensured", gcp.RunQuery(ctx, project, location, sql)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"app/routing"
+	"app/runs"
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/jobs"
+	"configure/problem"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Stages a burst can target. They read data an earlier run left in the
+// buckets, so firing many at once costs no extra Socrata calls.
+var burstStages = map[string]bool{"cleaner": true, "loader_json": true, "loader_parquet": true}
+
+// maxBurstConcurrency caps each level, so a typo can't flood a service.
+const maxBurstConcurrency = 50
+
+// Only one burst at a time, so levels don't overlap and skew each other.
+var burstMu sync.Mutex
+
+// burstJobs tracks bursts in the background, served on /jobs.
+var burstJobs = jobs.FromEnv()
+
+type burstRequest struct {
+	Stage string `json:"stage"`
+	// Date whose raw (cleaner) or cleaned (loaders) files the invocations read
+	Date string `json:"date"`
+	// Concurrency levels, run one after the other (default 1, 2, 4, 8)
+	Concurrency []int `json:"concurrency"`
+	// Invocations per level, at most Concurrency of them in flight at once
+	// (default one wave: as many as the level's concurrency)
+	Invocations int `json:"invocations"`
+	// How long an invocation may take to report completion (default 10m)
+	Timeout string `json:"timeout"`
+}
+
+// burstLatency summarises a set of latencies, in seconds.
+type burstLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// burstLevel is the outcome of one concurrency level. Accept latency is the
+// stage's answer to the request; completion latency runs until its
+// completion event reached the trigger.
+type burstLevel struct {
+	Concurrency     int            `json:"concurrency"`
+	Invocations     int            `json:"invocations"`
+	Succeeded       int            `json:"succeeded"`
+	Failed          int            `json:"failed"`
+	Errors          map[string]int `json:"errors,omitempty"`
+	AcceptLatency   burstLatency   `json:"accept_latency_seconds"`
+	CompleteLatency burstLatency   `json:"completion_latency_seconds"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	PerMinute       float64        `json:"completed_per_minute"`
+}
+
+// burstResult is one invocation: its accept and completion latencies, or
+// the kind of error that ended it.
+type burstResult struct {
+	accept, complete time.Duration
+	err              string
+}
+
+// handleBurst load-tests a downstream stage: POST /burst starts a job that
+// fires synthetic invocations of the cleaner or a loader for an already
+// extracted date at each concurrency level in turn, and answers 202 with the
+// job to poll on /jobs/{id}. The job's progress holds the latency and error
+// distribution of each level done so far. Each invocation is a run of that
+// one stage that skips the queue and is not archived, flagged selftest so
+// loaders write to their scratch tables and burst so the cleaner writes to a
+// scratch prefix. Callers need the admin token.
+func handleBurst(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+	var req burstRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if !burstStages[req.Stage] {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, fmt.Sprintf("stage %q cannot be burst (want cleaner, loader_json or loader_parquet)", req.Stage))
+		return
+	}
+	if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "date must be YYYY-MM-DD")
+		return
+	}
+	if len(req.Concurrency) == 0 {
+		req.Concurrency = []int{1, 2, 4, 8}
+	}
+	for _, c := range req.Concurrency {
+		if c < 1 || c > maxBurstConcurrency {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, fmt.Sprintf("concurrency %d is not between 1 and %d", c, maxBurstConcurrency))
+			return
+		}
+	}
+	if req.Invocations < 0 {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "invocations must not be negative")
+		return
+	}
+	timeout := 10 * time.Minute
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, fmt.Sprintf("invalid timeout %q", req.Timeout))
+			return
+		}
+		timeout = d
+	}
+
+	// Build wants the extractor first; the burst runs only the stage after it
+	t, err := routing.Build(routingConfig(), []string{"extractor", req.Stage})
+	if err != nil {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "Cannot build burst stage: "+err.Error())
+		return
+	}
+	stage := t[1]
+	// A failure should count as one, not be retried into a slow success
+	stage.OnFailure, stage.FailureRetries = "", 0
+
+	if !burstMu.TryLock() {
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, "A burst is already running")
+		return
+	}
+	ctx, job := burstJobs.Start(context.Background(), "burst", "", req.Date)
+	go func() {
+		defer burstMu.Unlock()
+		job.Finish(jobs.Safely(func() error { return runBurst(ctx, job, stage, req, timeout) }))
+	}()
+
+	w.Header().Set("Location", "/jobs/"+job.ID())
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"job":        job.ID(),
+		"stage":      stage.Name,
+		"date":       req.Date,
+		"status_url": "/jobs/" + job.ID(),
+	})
+}
+
+// runBurst runs the levels of req one after the other, reporting each as it
+// ends in the job's progress, until they are done or the job is cancelled.
+func runBurst(ctx context.Context, job *jobs.Handle, stage routing.Stage, req burstRequest, timeout time.Duration) error {
+	log.Printf("💥 Burst %s of %s for %s at concurrency %v", job.ID(), stage.Name, req.Date, req.Concurrency)
+	start := time.Now()
+	var levels []burstLevel
+	job.Progress(map[string]any{"stage": stage.Name, "levels_total": len(req.Concurrency)})
+	for _, c := range req.Concurrency {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n := req.Invocations
+		if n == 0 {
+			n = c
+		}
+		level := runBurstLevel(ctx, stage, req.Date, c, n, timeout)
+		log.Printf("💥 %s at concurrency %d: %d/%d succeeded, p50 %.1fs, p99 %.1fs to complete",
+			stage.Name, c, level.Succeeded, level.Invocations, level.CompleteLatency.P50, level.CompleteLatency.P99)
+		emitMetric("burst_level", map[string]interface{}{
+			"stage":             stage.Name,
+			"date":              req.Date,
+			"concurrency":       level.Concurrency,
+			"invocations":       level.Invocations,
+			"succeeded":         level.Succeeded,
+			"failed":            level.Failed,
+			"errors":            level.Errors,
+			"accept_p50":        level.AcceptLatency.P50,
+			"accept_p99":        level.AcceptLatency.P99,
+			"completion_p50":    level.CompleteLatency.P50,
+			"completion_p99":    level.CompleteLatency.P99,
+			"completion_max":    level.CompleteLatency.Max,
+			"completed_per_min": level.PerMinute,
+		})
+		levels = append(levels, level)
+		job.Progress(map[string]any{
+			"levels":           slices.Clone(levels),
+			"duration_seconds": eventschema.Seconds(time.Since(start).Seconds()),
+		})
+	}
+	return ctx.Err()
+}
+
+// runBurstLevel fires n invocations of stage with at most concurrency in
+// flight and waits for each to complete, fail or time out.
+func runBurstLevel(ctx context.Context, stage routing.Stage, date string, concurrency, n int, timeout time.Duration) burstLevel {
+	results := make([]burstResult, n)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range n {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = invokeBurst(ctx, stage, date, timeout)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	level := burstLevel{Concurrency: concurrency, Invocations: n, DurationSeconds: eventschema.Seconds(elapsed.Seconds())}
+	var accept, complete []time.Duration
+	for _, res := range results {
+		if res.accept > 0 {
+			accept = append(accept, res.accept)
+		}
+		if res.err != "" {
+			level.Failed++
+			if level.Errors == nil {
+				level.Errors = make(map[string]int)
+			}
+			level.Errors[res.err]++
+			continue
+		}
+		level.Succeeded++
+		complete = append(complete, res.complete)
+	}
+	level.AcceptLatency = latencies(accept)
+	level.CompleteLatency = latencies(complete)
+	level.PerMinute = eventschema.Seconds(float64(level.Succeeded) / elapsed.Minutes())
+	return level
+}
+
+// invokeBurst starts one single-stage run and waits for it. Errors are
+// reported by kind: the error category of a refused request, stage_failed
+// for a failure the stage reported, or timeout.
+func invokeBurst(ctx context.Context, stage routing.Stage, date string, timeout time.Duration) burstResult {
+	run, _ := registry.Start(date, "", routing.Topology{stage})
+	registry.SetParams(run.ID, map[string]interface{}{"run_id": run.ID, "date": date, "selftest": true, "burst": true})
+	body, _ := json.Marshal(eventschema.Stamp(stageRequest(run.ID, date)))
+
+	start := time.Now()
+	// One attempt, so refusals under load show up instead of being retried away
+	_, _, _, err := postOnce(&http.Client{Timeout: stage.TimeoutLimit()}, stage, body)
+	res := burstResult{accept: time.Since(start)}
+	if err != nil {
+		registry.Fail(run.ID, err)
+		go finishRun(run.ID)
+		res.err = string(errcategory.Of(err))
+		return res
+	}
+
+	run = awaitRun(ctx, run.ID, timeout)
+	switch run.Status {
+	case runs.StatusCompleted:
+		// The run was last updated by its completion event, which the
+		// 2s poll would otherwise round up
+		res.complete = run.UpdatedAt.Sub(start)
+	case runs.StatusFailed:
+		res.err = "stage_failed"
+	default:
+		registry.Fail(run.ID, fmt.Errorf("burst invocation did not complete within %s", timeout))
+		go finishRun(run.ID)
+		res.err = "timeout"
+	}
+	return res
+}
+
+// latencies returns the nearest-rank percentiles of ds.
+func latencies(ds []time.Duration) burstLatency {
+	if len(ds) == 0 {
+		return burstLatency{}
+	}
+	slices.Sort(ds)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(ds)))) - 1
+		return eventschema.Seconds(ds[max(i, 0)].Seconds())
+	}
+	return burstLatency{P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: eventschema.Seconds(ds[len(ds)-1].Seconds())}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"app/alerts"
+	"app/configure"
+	"bytes"
+	"configure/retry"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each service gets a few tries so a compose stack that is still starting up
+// isn't reported as down.
+const (
+	healthAttempts = 3
+	healthInterval = 5 * time.Second
+	healthTimeout  = 5 * time.Second
+)
+
+// checkServices pings the health endpoint of every configured service and
+// returns an error naming the required ones that never answered. Unreachable
+// required services raise a service_unreachable alert; optional ones are only logged.
+func checkServices(cfg *configure.ServiceURLs) error {
+	endpoints := cfg.Endpoints()
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, e configure.ServiceEndpoint) {
+			defer wg.Done()
+			results[i] = pingService(e)
+		}(i, endpoints[name])
+	}
+	wg.Wait()
+
+	var down []string
+	for i, name := range names {
+		e := endpoints[name]
+		switch err := results[i]; {
+		case err == nil:
+			log.Printf("🩺 %-15s reachable", name)
+		case e.Optional:
+			log.Printf("⚠️ %-15s unreachable (optional): %v", name, err)
+		default:
+			log.Printf("❌ %-15s unreachable: %v", name, err)
+			down = append(down, name)
+			alerter.Send(alerts.Alert{
+				Kind:    "service_unreachable",
+				Stage:   name,
+				Message: fmt.Sprintf("startup check could not reach %s: %v", name, err),
+			})
+		}
+	}
+	if len(down) > 0 {
+		return fmt.Errorf("required services unreachable: %s", strings.Join(down, ", "))
+	}
+	return nil
+}
+
+// pingService expects a 2xx from the service's health endpoint.
+func pingService(e configure.ServiceEndpoint) error {
+	healthURL, err := e.HealthURL()
+	if err != nil {
+		return err
+	}
+	return probe(e, healthURL, retry.Policy{Attempts: healthAttempts, Initial: healthInterval, Multiplier: 1})
+}
+
+// probe GETs target under policy until it answers 2xx. A failing answer's
+// body is included in the error, since readiness endpoints say what is wrong.
+func probe(e configure.ServiceEndpoint, target string, policy retry.Policy) error {
+	client := &http.Client{Timeout: healthTimeout}
+	return policy.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		if err := authorize(req, e.Audience); err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			if len(bytes.TrimSpace(msg)) > 0 {
+				return fmt.Errorf("%s returned %s: %s", target, resp.Status, bytes.TrimSpace(msg))
+			}
+			return fmt.Errorf("%s returned %s", target, resp.Status)
+		}
+		return nil
+	})
+}
+
+// runStartupCheck applies STARTUP_CHECK: "off" skips it, "strict" blocks
+// startup and exits when a required service is down, and anything else
+// (the default) runs it in the background and only logs and alerts.
+func runStartupCheck(cfg *configure.ServiceURLs) {
+	switch strings.ToLower(os.Getenv("STARTUP_CHECK")) {
+	case "off":
+		log.Println("🩺 Startup connectivity check disabled")
+	case "strict":
+		if err := checkServices(cfg); err != nil {
+			log.Fatalf("❌ Startup connectivity check failed: %v", err)
+		}
+	default:
+		go func() {
+			if err := checkServices(cfg); err != nil {
+				log.Printf("❌ Startup connectivity check: %v", err)
+			}
+		}()
+	}
+}
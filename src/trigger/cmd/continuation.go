@@ -0,0 +1,87 @@
+package main
+
+import (
+	"app/runs"
+	"configure/errcategory"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// pausedEvent is sent by an extractor whose max_minutes window ran out
+// before the end of the data; its resume state is in the run's raw folder.
+const pausedEvent = "extractor_paused"
+
+// continueRun schedules the extractor's next window for a paused run after
+// CONTINUATION_DELAY (default 10s). Runs are failed after MAX_WINDOWS
+// (default 48) windows, so a window too short to make headway can't loop forever.
+// A window that already paused is ignored: the extractor's outbox may deliver
+// its event twice, and a second continuation would run two extractors at once.
+func continueRun(run runs.Run, fields map[string]interface{}) {
+	window, _ := intField(fields, "window")
+	nextOffset, _ := intField(fields, "next_offset")
+	for _, e := range run.Events {
+		if w, _ := intField(e.Fields, "window"); e.Name == pausedEvent && w >= window {
+			log.Printf("⏭️ Run %s window %d already continued, ignoring redelivered pause", run.ID, window)
+			return
+		}
+	}
+	slaMonitor.Done(run.ID, run.Topology[0].Name)
+	registry.Update(run.ID, pausedEvent)
+	// The next window pauses under the same event name
+	registry.ForgetEvent(run.ID, pausedEvent)
+
+	maxWindows := 48
+	if n, err := strconv.Atoi(os.Getenv("MAX_WINDOWS")); err == nil && n > 0 {
+		maxWindows = n
+	}
+	if window >= maxWindows {
+		registry.Fail(run.ID, errcategory.Errorf(errcategory.Configuration, "extraction still incomplete after %d windows (offset %d); raise max_minutes or MAX_WINDOWS", window, nextOffset))
+		go finishRun(run.ID)
+		return
+	}
+
+	// Every later start of the extractor, including SLA restarts and /retry, resumes too
+	params := make(map[string]interface{}, len(run.Params)+1)
+	for k, v := range run.Params {
+		params[k] = v
+	}
+	params["continue"] = true
+	registry.SetParams(run.ID, params)
+
+	delay := 10 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("CONTINUATION_DELAY")); err == nil {
+		delay = d
+	}
+	emitMetric("run_continued", map[string]interface{}{
+		"run_id":      run.ID,
+		"date":        run.Date,
+		"window":      window,
+		"next_offset": nextOffset,
+	})
+	log.Printf("⏯️ Run %s paused after window %d at offset %d — continuing in %s", run.ID, window, nextOffset, delay)
+
+	time.AfterFunc(delay, func() {
+		current, ok := registry.Get(run.ID)
+		if !ok || current.Status == runs.StatusFailed {
+			return
+		}
+		body, err := json.Marshal(params)
+		if err != nil {
+			log.Printf("❌ Failed to marshal continuation for run %s: %v", run.ID, err)
+			return
+		}
+		stage := run.Topology[0]
+		status, _, err := postStage(stage, body)
+		if err != nil {
+			log.Printf("❌ Failed to continue run %s: %v", run.ID, err)
+			registry.Fail(run.ID, err)
+			finishRun(run.ID)
+			return
+		}
+		log.Printf("📤 Extractor window %d started for run %s: %s", window+1, run.ID, status)
+		watchStage(run.ID, run.Date, stage, 0)
+	})
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"app/runs"
+	"bytes"
+	"configure/gcp"
+	"configure/problem"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// chunkSignals is what chunk_metrics shows of one chunk of a run, without
+// the flags the extractor sets when it injects a fault.
+type chunkSignals struct {
+	Offset        int
+	RowsExtracted int
+	ChunkSize     int
+	Duration      float64
+	FetchSkipped  bool
+	WriteSkipped  bool
+	Unchanged     bool
+}
+
+// faultDetectors names, for each fault the extractor injects, the signal
+// taken as detecting it, in the order the report lists them.
+var faultDetectors = []struct{ Fault, Detector, RunAnomaly string }{
+	{"api_error", "no rows fetched", ""},
+	{"gcs_error", "rows fetched but not written", ""},
+	{"row_drop", "short chunk before the last", "drop_rate_spike"},
+	{"delay", "chunk slower than the run's median × duration_ratio", "duration_regression"},
+}
+
+// DetectionScore compares the chunks a fault was injected into with those
+// it was detected in. Precision is nil without detections, recall without
+// injections.
+type DetectionScore struct {
+	Injected       int      `json:"injected"`
+	Detected       int      `json:"detected"`
+	TruePositives  int      `json:"true_positives"`
+	FalsePositives int      `json:"false_positives"`
+	FalseNegatives int      `json:"false_negatives"`
+	Precision      *float64 `json:"precision"`
+	Recall         *float64 `json:"recall"`
+}
+
+func (s *DetectionScore) add(injected, detected bool) {
+	switch {
+	case injected && detected:
+		s.TruePositives++
+	case detected:
+		s.FalsePositives++
+	case injected:
+		s.FalseNegatives++
+	}
+	if injected {
+		s.Injected++
+	}
+	if detected {
+		s.Detected++
+	}
+}
+
+func (s *DetectionScore) finish() {
+	if s.Detected > 0 {
+		p := float64(s.TruePositives) / float64(s.Detected)
+		s.Precision = &p
+	}
+	if s.Injected > 0 {
+		r := float64(s.TruePositives) / float64(s.Injected)
+		s.Recall = &r
+	}
+}
+
+// FaultScore is the detection of one kind of fault.
+type FaultScore struct {
+	Fault    string `json:"fault"`
+	Detector string `json:"detector"`
+	DetectionScore
+	// The run-level check that should flag the fault, if any: whether the
+	// run had the fault injected and whether it raised the chunk_anomaly
+	RunAnomaly  string `json:"run_anomaly,omitempty"`
+	RunInjected bool   `json:"run_injected,omitempty"`
+	RunDetected bool   `json:"run_detected,omitempty"`
+}
+
+// ChunkFinding is a chunk where injection and detection disagree.
+type ChunkFinding struct {
+	Offset int    `json:"offset"`
+	Fault  string `json:"fault"`
+	// "missed" for an undetected fault, "false_alarm" for a detection without one
+	Outcome string `json:"outcome"`
+}
+
+// FaultDetectionReport is the answer to GET /runs/{id}/fault-report.
+type FaultDetectionReport struct {
+	RunID       string         `json:"run_id"`
+	Date        string         `json:"date,omitempty"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Chunks      int            `json:"chunks"`
+	Faults      []FaultScore   `json:"faults"`
+	Overall     DetectionScore `json:"overall"`
+	// Run-level anomalies are only known while the run is in the registry
+	RunAnomaliesKnown bool           `json:"run_anomalies_known"`
+	Findings          []ChunkFinding `json:"findings"`
+}
+
+// detectFaults marks, per fault, the offsets whose signals detect it. A
+// run's last chunk is short without any fault, and chunks whose pages were
+// unchanged weren't fetched at all.
+func detectFaults(chunks []chunkSignals, durationRatio float64) map[string]map[int]bool {
+	detected := make(map[string]map[int]bool)
+	for _, d := range faultDetectors {
+		detected[d.Fault] = make(map[int]bool)
+	}
+	last := -1
+	var durations []float64
+	for _, c := range chunks {
+		if c.RowsExtracted > 0 && c.Offset > last {
+			last = c.Offset
+		}
+		if !c.FetchSkipped && !c.Unchanged {
+			durations = append(durations, c.Duration)
+		}
+	}
+	sort.Float64s(durations)
+	var median float64
+	if len(durations) > 0 {
+		median = durations[len(durations)/2]
+	}
+
+	for _, c := range chunks {
+		if c.Unchanged {
+			continue
+		}
+		switch {
+		case c.RowsExtracted == 0 && !c.WriteSkipped:
+			detected["api_error"][c.Offset] = true
+		case c.WriteSkipped:
+			detected["gcs_error"][c.Offset] = true
+		}
+		if c.RowsExtracted > 0 && c.RowsExtracted < c.ChunkSize && c.Offset != last {
+			detected["row_drop"][c.Offset] = true
+		}
+		if !c.FetchSkipped && median > 0 && c.Duration > median*durationRatio {
+			detected["delay"][c.Offset] = true
+		}
+	}
+	return detected
+}
+
+// scoreFaults compares the injected faults (fault → offsets) with the
+// detected ones, chunk by chunk.
+func scoreFaults(injected, detected map[string]map[int]bool) ([]FaultScore, DetectionScore, []ChunkFinding) {
+	var scores []FaultScore
+	var overall DetectionScore
+	findings := []ChunkFinding{}
+	for _, d := range faultDetectors {
+		offsets := make(map[int]bool)
+		for o := range injected[d.Fault] {
+			offsets[o] = true
+		}
+		for o := range detected[d.Fault] {
+			offsets[o] = true
+		}
+		sorted := make([]int, 0, len(offsets))
+		for o := range offsets {
+			sorted = append(sorted, o)
+		}
+		sort.Ints(sorted)
+
+		score := FaultScore{Fault: d.Fault, Detector: d.Detector, RunAnomaly: d.RunAnomaly}
+		for _, o := range sorted {
+			inj, det := injected[d.Fault][o], detected[d.Fault][o]
+			score.add(inj, det)
+			overall.add(inj, det)
+			if inj && !det {
+				findings = append(findings, ChunkFinding{Offset: o, Fault: d.Fault, Outcome: "missed"})
+			} else if det && !inj {
+				findings = append(findings, ChunkFinding{Offset: o, Fault: d.Fault, Outcome: "false_alarm"})
+			}
+		}
+		score.finish()
+		scores = append(scores, score)
+	}
+	overall.finish()
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Offset < findings[j].Offset })
+	return scores, overall, findings
+}
+
+// runFaultData reads the run's injected faults from fault_log (FAULT_LOG_TABLE
+// on the extractor renames it, and here too) and its chunks from chunk_metrics.
+func runFaultData(ctx context.Context, project, location, runID string) (map[string]map[int]bool, []chunkSignals, error) {
+	table := os.Getenv("FAULT_LOG_TABLE")
+	if table == "" {
+		table = "fault_log"
+	}
+	rows, err := gcp.QueryRows(ctx, project, location, fmt.Sprintf(
+		"SELECT `offset`, fault FROM `%s.PipelineMonitoring.%s` WHERE run_id = '%s' GROUP BY 1, 2 LIMIT 100000",
+		project, table, runID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("fault_log: %w", err)
+	}
+	injected := make(map[string]map[int]bool)
+	for _, row := range rows {
+		fault, _ := row["fault"].(string)
+		if injected[fault] == nil {
+			injected[fault] = make(map[int]bool)
+		}
+		injected[fault][int(queryFloat(row["offset"]))] = true
+	}
+
+	rows, err = gcp.QueryRows(ctx, project, location, fmt.Sprintf(
+		"SELECT `offset`, rows_extracted, chunk_size, chunk_duration_seconds, fetch_skipped, gcs_write_skipped, skipped_unchanged "+
+			"FROM `%s.PipelineMonitoring.chunk_metrics` WHERE run_id = '%s' ORDER BY `offset` LIMIT 100000",
+		project, runID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("chunk_metrics: %w", err)
+	}
+	chunks := make([]chunkSignals, len(rows))
+	for i, row := range rows {
+		flag := func(name string) bool {
+			b, _ := strconv.ParseBool(fmt.Sprint(row[name]))
+			return b
+		}
+		chunks[i] = chunkSignals{
+			Offset:        int(queryFloat(row["offset"])),
+			RowsExtracted: int(queryFloat(row["rows_extracted"])),
+			ChunkSize:     int(queryFloat(row["chunk_size"])),
+			Duration:      queryFloat(row["chunk_duration_seconds"]),
+			FetchSkipped:  flag("fetch_skipped"),
+			WriteSkipped:  flag("gcs_write_skipped"),
+			Unchanged:     flag("skipped_unchanged"),
+		}
+	}
+	return injected, chunks, nil
+}
+
+// handleFaultReport scores how well monitoring caught the faults the
+// extractor injected into a run, for the simulated-fault demo:
+// GET /runs/{id}/fault-report[?format=html]. Each chunk's faults in
+// fault_log are held against what its chunk_metrics row shows, fault by
+// fault (see faultDetectors), giving precision and recall per fault and
+// overall, and the chunks where they disagree. While the run is in the
+// registry, the report also says whether its chunk_anomaly events flagged
+// the row drops and delays.
+func handleFaultReport(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	if !runIDPattern.MatchString(runID) {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid run ID")
+		return
+	}
+	project := serviceConfig.Bootstrap.Project
+	if project == "" {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "bootstrap.project is not configured")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	injected, chunks, err := runFaultData(ctx, project, serviceConfig.DatasetLocation(), runID)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Failed to read the run's monitoring tables: "+err.Error())
+		return
+	}
+	run, tracked := registry.Get(runID)
+	if len(chunks) == 0 && !tracked {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "No chunk metrics for run "+runID)
+		return
+	}
+
+	cfg := serviceConfig.Anomalies.WithDefaults()
+	report := FaultDetectionReport{RunID: runID, GeneratedAt: time.Now().UTC(), Chunks: len(chunks), RunAnomaliesKnown: tracked}
+	report.Faults, report.Overall, report.Findings = scoreFaults(injected, detectFaults(chunks, cfg.DurationRatio))
+	if tracked {
+		report.Date = run.Date
+		flagged := runAnomalyKinds(run)
+		for i := range report.Faults {
+			f := &report.Faults[i]
+			if f.RunAnomaly != "" {
+				f.RunInjected, f.RunDetected = f.Injected > 0, flagged[f.RunAnomaly]
+			}
+		}
+	}
+
+	if r.URL.Query().Get("format") == "html" {
+		var page bytes.Buffer
+		if err := faultReportPage.Execute(&page, report); err != nil {
+			problem.Write(w, r, http.StatusInternalServerError, problem.Internal, "Failed to render the report: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page.Bytes())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runAnomalyKinds lists the kinds of the run's chunk_anomaly events.
+func runAnomalyKinds(run runs.Run) map[string]bool {
+	kinds := make(map[string]bool)
+	for _, e := range run.Events {
+		if e.Name == chunkAnomalyEvent {
+			kind, _ := e.Fields["kind"].(string)
+			kinds[kind] = true
+		}
+	}
+	return kinds
+}
+
+var faultReportPage = template.Must(template.New("fault-report").Funcs(template.FuncMap{
+	"pct": func(v *float64) string {
+		if v == nil {
+			return "–"
+		}
+		return fmt.Sprintf("%.1f%%", 100**v)
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Fault detection — run {{.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child, td.text { text-align: left; }
+</style></head>
+<body>
+<h1>Fault detection — run {{.RunID}}</h1>
+<p>{{if .Date}}Date {{.Date}} · {{end}}{{.Chunks}} chunk metric row(s) · generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<table>
+<tr><th>Fault</th><th>Detector</th><th>Injected</th><th>Detected</th><th>True pos.</th><th>False pos.</th><th>Missed</th><th>Precision</th><th>Recall</th><th>Run anomaly</th></tr>
+{{range .Faults}}<tr><td>{{.Fault}}</td><td class="text">{{.Detector}}</td><td>{{.Injected}}</td><td>{{.Detected}}</td><td>{{.TruePositives}}</td><td>{{.FalsePositives}}</td><td>{{.FalseNegatives}}</td><td>{{pct .Precision}}</td><td>{{pct .Recall}}</td>
+<td class="text">{{if and .RunAnomaly $.RunAnomaliesKnown}}{{.RunAnomaly}}: {{if .RunDetected}}raised{{else}}not raised{{end}}{{if .RunInjected}} (injected){{end}}{{end}}</td></tr>
+{{end}}<tr><th>Overall</th><td></td><th>{{.Overall.Injected}}</th><th>{{.Overall.Detected}}</th><th>{{.Overall.TruePositives}}</th><th>{{.Overall.FalsePositives}}</th><th>{{.Overall.FalseNegatives}}</th><th>{{pct .Overall.Precision}}</th><th>{{pct .Overall.Recall}}</th><td></td></tr>
+</table>
+{{if .Findings}}<h2>Disagreements</h2>
+<table>
+<tr><th>Offset</th><th>Fault</th><th>Outcome</th></tr>
+{{range .Findings}}<tr><td>{{.Offset}}</td><td class="text">{{.Fault}}</td><td class="text">{{if eq .Outcome "missed"}}missed{{else}}false alarm{{end}}</td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`))
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"app/configure"
+	"app/routing"
+	"bytes"
+	"configure/errcategory"
+	"configure/gcp"
+	"configure/retry"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// postStage sends body to the stage's service under its call policy. Each
+// attempt is bounded by the stage timeout; network errors, 429s and 5xx
+// responses are retried with jittered exponential backoff up to the stage's
+// retry count. So are timeouts, but only for an idempotent stage: the call
+// may have started the work, and a stage like the cleaner would start it
+// twice. Other non-2xx responses fail straight away.
+func postStage(s routing.Stage, body []byte) (status string, respBody []byte, err error) {
+	client := &http.Client{Timeout: s.TimeoutLimit()}
+	policy := retry.Policy{
+		Attempts: s.Retries + 1,
+		Initial:  s.BackoffDelay(),
+		Max:      configure.MaxBackoff,
+		Jitter:   0.2,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			log.Printf("🔁 %s attempt %d/%d failed: %v — retrying in %s", s.Name, attempt, s.Retries+1, err, delay.Round(time.Millisecond))
+			emitMetric("forward_retry", map[string]interface{}{
+				"stage":          s.Name,
+				"attempt":        attempt,
+				"error":          err.Error(),
+				"error_category": errcategory.Of(err),
+			})
+		},
+	}
+
+	attempts := 0
+	err = policy.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		attempts = attempt
+		var retryable bool
+		status, respBody, retryable, err = postOnce(client, s, body)
+		if err != nil && !retryable {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	if err != nil && attempts > 1 {
+		err = fmt.Errorf("%w (after %d attempts)", err, attempts)
+	}
+	return status, respBody, err
+}
+
+// postOnce makes a single attempt and reports whether a failure is worth retrying.
+func postOnce(client *http.Client, s routing.Stage, body []byte) (string, []byte, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := authorize(req, s.Audience); err != nil {
+		// Usually the metadata server being briefly unavailable
+		return "", nil, true, errcategory.Wrap(errcategory.TransientNetwork, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && !s.Idempotent {
+			log.Printf("⛔ %s timed out after %s; not calling it again, the call may have started it", s.Name, s.TimeoutLimit())
+			return "", nil, false, errcategory.Wrap(errcategory.TransientNetwork, err)
+		}
+		// Connection errors are transient from here, and so are timeouts of idempotent stages
+		return "", nil, true, errcategory.Wrap(errcategory.TransientNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, readErr := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return resp.Status, respBody, true, errcategory.Errorf(errcategory.FromStatus(resp.StatusCode), "%s: %s", resp.Status, bytes.TrimSpace(respBody))
+	case resp.StatusCode >= 300:
+		return resp.Status, respBody, false, errcategory.Errorf(errcategory.FromStatus(resp.StatusCode), "%s: %s", resp.Status, bytes.TrimSpace(respBody))
+	case readErr != nil && !errors.Is(readErr, io.EOF):
+		// The stage accepted the request; a truncated body is not worth re-running it for
+		log.Printf("⚠️ Failed to read response from %s: %v", s.URL, readErr)
+	}
+	return resp.Status, respBody, false, nil
+}
+
+// authorize attaches an identity token for audience; services that allow
+// unauthenticated calls leave the audience empty.
+func authorize(req *http.Request, audience string) error {
+	if audience == "" {
+		return nil
+	}
+	token, err := gcp.IDToken(req.Context(), audience)
+	if err != nil {
+		return fmt.Errorf("identity token for %s: %w", audience, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"app/runs"
+	"configure/eventschema"
+	"configure/gcp"
+	"configure/problem"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Series is one metric over time as Grafana's JSON data sources read it:
+// datapoints are [value, unix milliseconds], oldest first.
+type Series struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// handleMetricsSeries graphs pipeline health from the runs this instance
+// tracks, without BigQuery access: GET /metrics/series[?since=24h][&metric=].
+// It returns run_duration_seconds by status, and stage_duration_seconds,
+// stage_rows_per_second and stage_failures by stage, for runs started within
+// since. metric keeps only the series of that name.
+func handleMetricsSeries(w http.ResponseWriter, r *http.Request) {
+	since := 24 * time.Hour
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid 'since' duration, e.g. 24h")
+			return
+		}
+		since = d
+	}
+	want := r.URL.Query().Get("metric")
+
+	series := map[string]*Series{}
+	add := func(name, label, value string, t time.Time, v float64) {
+		if want != "" && name != want {
+			return
+		}
+		target := fmt.Sprintf("%s{%s=%q}", name, label, value)
+		s, ok := series[target]
+		if !ok {
+			s = &Series{Target: target, Datapoints: [][2]float64{}}
+			series[target] = s
+		}
+		s.Datapoints = append(s.Datapoints, [2]float64{v, float64(t.UnixMilli())})
+	}
+
+	for _, run := range registry.Since(time.Now().Add(-since)) {
+		if run.Status == runs.StatusCompleted || run.Status == runs.StatusFailed {
+			add("run_duration_seconds", "status", string(run.Status), run.UpdatedAt, run.UpdatedAt.Sub(run.CreatedAt).Seconds())
+		}
+		for _, e := range run.Events {
+			if status, _ := e.Fields["status"].(string); status == "failed" {
+				add("stage_failures", "stage", strings.TrimSuffix(e.Name, "_failed"), e.ReceivedAt, 1)
+				continue
+			}
+			stage, ok := strings.CutSuffix(e.Name, "_completed")
+			if !ok {
+				continue
+			}
+			duration, _ := e.Fields["duration"].(float64)
+			if duration <= 0 {
+				continue
+			}
+			add("stage_duration_seconds", "stage", stage, e.ReceivedAt, duration)
+			if rows, ok := e.Fields["rows_received"].(float64); ok {
+				add("stage_rows_per_second", "stage", stage, e.ReceivedAt, rows/duration)
+			}
+		}
+	}
+
+	out := make([]Series, 0, len(series))
+	for _, s := range series {
+		sort.Slice(s.Datapoints, func(i, j int) bool { return s.Datapoints[i][1] < s.Datapoints[j][1] })
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	writeJSON(w, http.StatusOK, out)
+}
+
+// stageNamePattern is what the stage filter of /metrics/durations accepts,
+// since it is put into SQL.
+var stageNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// StageDuration is one stage's run time as PipelineMonitoring.stage_metrics
+// records it.
+type StageDuration struct {
+	RunID           string    `json:"run_id"`
+	Date            string    `json:"date"`
+	Stage           string    `json:"stage"`
+	Status          string    `json:"status"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	RowsReceived    int       `json:"rows_received,omitempty"`
+	RecordedAt      time.Time `json:"recorded_at"`
+}
+
+// StageDurationStats summarises a stage's completed durations, in seconds.
+type StageDurationStats struct {
+	Stage string  `json:"stage"`
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	burstLatency
+}
+
+// DurationsReport is the answer to GET /metrics/durations.
+type DurationsReport struct {
+	Source    string               `json:"source"` // stage_metrics | registry
+	Durations []StageDuration      `json:"durations"`
+	Stages    []StageDurationStats `json:"stages"`
+}
+
+// handleMetricsDurations lists stage durations, newest first, with
+// percentiles per stage: GET /metrics/durations[?since=168h][&stage=][&limit=500].
+// They come from PipelineMonitoring.stage_metrics, which outlives restarts and
+// covers runs started outside /run; without a bootstrap project, from the
+// runs this instance tracks.
+func handleMetricsDurations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since := 7 * 24 * time.Hour
+	if v := q.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid 'since' duration, e.g. 168h")
+			return
+		}
+		since = d
+	}
+	stage := q.Get("stage")
+	if stage != "" && !stageNamePattern.MatchString(stage) {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid stage name")
+		return
+	}
+	limit := 500
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 5000 {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "'limit' must be between 1 and 5000")
+			return
+		}
+		limit = n
+	}
+	from := time.Now().Add(-since)
+
+	report := DurationsReport{Source: "registry", Durations: []StageDuration{}}
+	if project := serviceConfig.Bootstrap.Project; project != "" {
+		location := serviceConfig.Bootstrap.Location
+		if location == "" {
+			location = "US"
+		}
+		where := fmt.Sprintf("recorded_at >= TIMESTAMP_MILLIS(%d)", from.UnixMilli())
+		if stage != "" {
+			where += fmt.Sprintf(" AND stage = '%s'", stage)
+		}
+		sql := fmt.Sprintf("SELECT run_id, date, stage, status, duration_seconds, rows_received, "+
+			"UNIX_MILLIS(recorded_at) AS recorded_ms FROM `%s.PipelineMonitoring.stage_metrics` "+
+			"WHERE %s ORDER BY recorded_at DESC LIMIT %d", project, where, limit)
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		rows, err := gcp.QueryRows(ctx, project, location, sql)
+		if err != nil {
+			log.Printf("❌ Failed to query stage metrics: %v", err)
+			problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Failed to query stage metrics: "+err.Error())
+			return
+		}
+		report.Source = "stage_metrics"
+		for _, row := range rows {
+			d := StageDuration{DurationSeconds: queryFloat(row["duration_seconds"]), RowsReceived: int(queryFloat(row["rows_received"]))}
+			d.RunID, _ = row["run_id"].(string)
+			d.Date, _ = row["date"].(string)
+			d.Stage, _ = row["stage"].(string)
+			d.Status, _ = row["status"].(string)
+			d.RecordedAt = time.UnixMilli(int64(queryFloat(row["recorded_ms"]))).UTC()
+			report.Durations = append(report.Durations, d)
+		}
+	} else {
+		for _, run := range registry.Since(from) {
+			for _, e := range run.Events {
+				name, ok := strings.CutSuffix(e.Name, "_completed")
+				duration, _ := e.Fields["duration"].(float64)
+				if !ok || duration <= 0 || (stage != "" && name != stage) {
+					continue
+				}
+				d := StageDuration{RunID: run.ID, Date: run.Date, Stage: name, Status: "completed", DurationSeconds: duration, RecordedAt: e.ReceivedAt}
+				if rows, ok := e.Fields["rows_received"].(float64); ok {
+					d.RowsReceived = int(rows)
+				}
+				report.Durations = append(report.Durations, d)
+			}
+		}
+		sort.Slice(report.Durations, func(i, j int) bool { return report.Durations[i].RecordedAt.After(report.Durations[j].RecordedAt) })
+		if len(report.Durations) > limit {
+			report.Durations = report.Durations[:limit]
+		}
+	}
+
+	byStage := map[string][]time.Duration{}
+	for _, d := range report.Durations {
+		if d.Status == "completed" && d.DurationSeconds > 0 {
+			byStage[d.Stage] = append(byStage[d.Stage], time.Duration(d.DurationSeconds*float64(time.Second)))
+		}
+	}
+	report.Stages = make([]StageDurationStats, 0, len(byStage))
+	for name, ds := range byStage {
+		var total time.Duration
+		for _, d := range ds {
+			total += d
+		}
+		mean := total.Seconds() / float64(len(ds))
+		report.Stages = append(report.Stages, StageDurationStats{Stage: name, Count: len(ds), Mean: eventschema.Seconds(mean), burstLatency: latencies(ds)})
+	}
+	sort.Slice(report.Stages, func(i, j int) bool { return report.Stages[i].Stage < report.Stages[j].Stage })
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"configure/gcp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// migrateMonitoringTables brings the monitoring tables that already exist up
+// to their schemas in monitoringTables by adding the columns they lack, so
+// rows carrying a newly added field are not rejected by an older table. Only
+// additive changes are made: new columns are added as NULLABLE (or REPEATED),
+// a REQUIRED one is reported instead, and nothing is altered or dropped.
+// Missing tables are left to /admin/bootstrap. SCHEMA_MIGRATION=off disables
+// it; nothing is migrated without a bootstrap project.
+func migrateMonitoringTables() {
+	cfg := serviceConfig.Bootstrap
+	if cfg.Project == "" || strings.EqualFold(os.Getenv("SCHEMA_MIGRATION"), "off") {
+		return
+	}
+	location := cfg.Location
+	if location == "" {
+		location = "US"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, t := range monitoringTables {
+		live, err := gcp.GetTable(ctx, cfg.Project, t.Dataset, t.Table)
+		if errors.Is(err, gcp.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("⚠️ Schema migration: %v", err)
+			continue
+		}
+		have := make([]string, len(live.Columns))
+		for i, c := range live.Columns {
+			have[i] = c.Name
+		}
+		var adds, added []string
+		for _, c := range t.Columns.Missing(have) {
+			if c.Mode == "REQUIRED" {
+				log.Printf("⚠️ Schema migration: %s.%s is REQUIRED and can't be added to an existing table", t.Name(), c.Name)
+				continue
+			}
+			adds = append(adds, "ADD COLUMN IF NOT EXISTS "+c.DDL())
+			added = append(added, c.Name)
+		}
+		if len(adds) == 0 {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE `%s.%s` %s", cfg.Project, t.Name(), strings.Join(adds, ", "))
+		if err := gcp.RunQuery(ctx, cfg.Project, location, sql); err != nil {
+			log.Printf("❌ Schema migration of %s failed: %v", t.Name(), err)
+			continue
+		}
+		log.Printf("🆕 Added %v to %s", added, t.Name())
+	}
+}
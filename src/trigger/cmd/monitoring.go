@@ -0,0 +1,125 @@
+package main
+
+import (
+	"app/runs"
+	"app/summary"
+	"configure/gcp"
+	"configure/monitoring"
+	"configure/schemas"
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// exportRunMetrics writes a finished run's duration and outcome, and each
+// completed stage's duration and throughput, to Cloud Monitoring.
+func exportRunMetrics(ctx context.Context, run runs.Run, s summary.Summary) {
+	if !monitoring.Enabled() {
+		return
+	}
+	status := string(run.Status)
+	monitoring.Count(ctx, "runs_finished", map[string]string{"status": status})
+
+	points := []monitoring.Point{{
+		Name:   "run_duration_seconds",
+		Labels: map[string]string{"status": status},
+		Value:  s.WallSeconds,
+	}}
+	for _, st := range s.Stages {
+		if st.Status != "completed" || st.DurationSeconds <= 0 {
+			continue
+		}
+		labels := map[string]string{"stage": st.Name}
+		points = append(points, monitoring.Point{Name: "stage_duration_seconds", Labels: labels, Value: st.DurationSeconds})
+		if rows, ok := stageRows(run, st.Name); ok {
+			points = append(points, monitoring.Point{Name: "stage_rows_per_second", Labels: labels, Value: rows / st.DurationSeconds})
+		}
+	}
+	monitoring.Gauge(ctx, points...)
+}
+
+// writeStageMetrics records each stage that completed or failed in a finished
+// run as a row of PipelineMonitoring.stage_metrics. Nothing is written without
+// a bootstrap project, which owns the table.
+func writeStageMetrics(ctx context.Context, run runs.Run, s summary.Summary) {
+	project := serviceConfig.Bootstrap.Project
+	if project == "" {
+		return
+	}
+	now := time.Now().UTC()
+	var rows []schemas.StageMetric
+	for _, st := range s.Stages {
+		if st.Status != "completed" && st.Status != "failed" {
+			continue
+		}
+		row := schemas.StageMetric{
+			RunID:           run.ID,
+			Date:            run.Date,
+			Stage:           st.Name,
+			Status:          st.Status,
+			DurationSeconds: st.DurationSeconds,
+			RecordedAt:      now,
+		}
+		if received, ok := stageRows(run, st.Name); ok {
+			row.RowsReceived = int(received)
+		}
+		if expected, ok := stageField(run, st.Name, "rows_expected"); ok {
+			row.RowsExpected = int(expected)
+		}
+		if st.Status == "failed" {
+			row.ErrorCategory = run.ErrorCategory
+		}
+		rows = append(rows, row)
+	}
+	if err := gcp.InsertRows(ctx, project, "PipelineMonitoring", "stage_metrics", rows); err != nil {
+		log.Printf("⚠️ Failed to write stage metrics for run %s: %v", run.ID, err)
+	}
+}
+
+// writeEventStageMetric records a stage's completion or failure event as a
+// stage_metrics row as it arrives. It is for runs the registry doesn't track
+// (started outside /run), whose stages writeStageMetrics never sees.
+func writeEventStageMetric(ctx context.Context, runID, date, event, origin string, fields map[string]interface{}) {
+	project := serviceConfig.Bootstrap.Project
+	if project == "" {
+		return
+	}
+	row := schemas.StageMetric{RunID: runID, Date: date, Stage: origin, Status: "completed", RecordedAt: time.Now().UTC()}
+	if stage, ok := strings.CutSuffix(event, "_completed"); ok {
+		row.Stage = stage
+	} else if stage, ok := strings.CutSuffix(event, "_failed"); ok {
+		row.Stage = stage
+	}
+	if status, _ := fields["status"].(string); status == "failed" {
+		row.Status = "failed"
+		row.ErrorCategory, _ = fields["error_category"].(string)
+	}
+	row.DurationSeconds, _ = fields["duration"].(float64)
+	if v, ok := fields["rows_received"].(float64); ok {
+		row.RowsReceived = int(v)
+	}
+	if v, ok := fields["rows_expected"].(float64); ok {
+		row.RowsExpected = int(v)
+	}
+	if err := gcp.InsertRows(ctx, project, "PipelineMonitoring", "stage_metrics", []schemas.StageMetric{row}); err != nil {
+		log.Printf("⚠️ Failed to write stage metric for %s (date %s): %v", event, date, err)
+	}
+}
+
+// stageRows is the rows_received a stage reported on completion.
+func stageRows(run runs.Run, stage string) (float64, bool) {
+	return stageField(run, stage, "rows_received")
+}
+
+// stageField is a numeric field of the event a stage sent on completion.
+func stageField(run runs.Run, stage, field string) (float64, bool) {
+	for _, e := range run.Events {
+		if e.Name != stage+"_completed" {
+			continue
+		}
+		v, ok := e.Fields[field].(float64)
+		return v, ok
+	}
+	return 0, false
+}
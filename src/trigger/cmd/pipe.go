@@ -0,0 +1,37 @@
+package main
+
+import (
+	"app/routing"
+	"fmt"
+	"net/url"
+)
+
+// pipeTarget is where a /run with "pipe": true has the extractor stream its
+// chunks: the cleaner's /stream, next to the /clean the trigger would call.
+// The cleaner must be the stage the trigger starts right after the extractor,
+// since the extractor's completion no longer starts it.
+func pipeTarget(topology routing.Topology) (map[string]interface{}, error) {
+	s, ok := topology.ByName("cleaner")
+	if !ok {
+		return nil, fmt.Errorf("pipe needs the cleaner stage in the run")
+	}
+	if s.After != "extractor" {
+		return nil, fmt.Errorf("pipe needs the cleaner right after the extractor, not after %s", s.After)
+	}
+	if s.Approval || s.Notified() {
+		return nil, fmt.Errorf("pipe needs a cleaner the trigger starts without approval")
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("cleaner url %q is not absolute", s.URL)
+	}
+	u.Path, u.RawQuery = "/stream", ""
+	return map[string]interface{}{"url": u.String(), "audience": s.Audience}, nil
+}
+
+// pipedStage reports whether s is the cleaner and the extractor event raw says
+// it already streamed the run's chunks to it. An extractor that couldn't
+// finish the stream reports "piped": false and the cleaner is called as usual.
+func pipedStage(s routing.Stage, raw map[string]interface{}) bool {
+	return s.Name == "cleaner" && raw["piped"] == true
+}
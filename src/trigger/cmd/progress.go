@@ -0,0 +1,69 @@
+package main
+
+import (
+	"app/alerts"
+	"app/runs"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// progressEvent is sent by the extractor while it fetches pages. It repeats
+// under the same name, so it is recorded on the run and never routed.
+const progressEvent = "extractor_progress"
+
+// recordProgress stores the extraction progress carried by an extractor
+// event, if it has the preflight row count (total_rows).
+func recordProgress(runID string, fields map[string]interface{}) (runs.Progress, bool) {
+	total, ok := intField(fields, "total_rows")
+	if !ok || total == 0 {
+		return runs.Progress{}, false
+	}
+	planned, _ := intField(fields, "rows_planned")
+	// Completion events report the rows fetched as rows_expected
+	fetched, ok := intField(fields, "rows_fetched")
+	if !ok {
+		fetched, _ = intField(fields, "rows_expected")
+	}
+	p := runs.Progress{TotalRows: total, RowsPlanned: planned, RowsExtracted: fetched}
+	registry.SetProgress(runID, p)
+	return p, true
+}
+
+// checkTruncation records the final progress of a finished extraction and
+// flags it as truncated when it fetched less than TRUNCATION_THRESHOLD
+// (default 0.9) of the rows it planned to.
+func checkTruncation(runID, date, stage string, fields map[string]interface{}) {
+	if _, ok := fields["rows_planned"]; !ok {
+		return
+	}
+	p, ok := recordProgress(runID, fields)
+	if !ok || p.RowsPlanned == 0 {
+		return
+	}
+	threshold := 0.9
+	if v, err := strconv.ParseFloat(os.Getenv("TRUNCATION_THRESHOLD"), 64); err == nil {
+		threshold = v
+	}
+	if float64(p.RowsExtracted) >= threshold*float64(p.RowsPlanned) {
+		return
+	}
+	p.Truncated = true
+	registry.SetProgress(runID, p)
+	log.Printf("✂️ Run %s extracted %d of %d planned rows — truncated", runID, p.RowsExtracted, p.RowsPlanned)
+	emitMetric("run_truncated", map[string]interface{}{
+		"run_id":         runID,
+		"date":           date,
+		"total_rows":     p.TotalRows,
+		"rows_planned":   p.RowsPlanned,
+		"rows_extracted": p.RowsExtracted,
+	})
+	alerter.Send(alerts.Alert{
+		Kind:    "run_truncated",
+		RunID:   runID,
+		Date:    date,
+		Stage:   stage,
+		Message: fmt.Sprintf("extracted %d of %d planned rows (dataset has %d)", p.RowsExtracted, p.RowsPlanned, p.TotalRows),
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"app/runs"
+	"configure/gcp"
+	"configure/problem"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runIDPattern is the shape of a run ID. The purge puts the ID into SQL, so
+// anything else is refused before a statement is built.
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PurgedLocation is what a purge did in one summary.objects location, or in
+// a bucket's checkpoint and outbox.
+type PurgedLocation struct {
+	Location string   `json:"location"` // gs://bucket/prefix
+	Objects  []string `json:"objects,omitempty"`
+	Skipped  string   `json:"skipped,omitempty"` // why nothing was deleted
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// PurgedTable is what a purge did to one table.
+type PurgedTable struct {
+	Table  string `json:"table"` // dataset.table
+	Column string `json:"column"`
+	Action string `json:"action"` // planned, deleted, reverted (a view), skipped or failed
+	Detail string `json:"detail,omitempty"`
+}
+
+// PurgeReport is the answer to POST /runs/{id}/purge.
+type PurgeReport struct {
+	RunID   string           `json:"run_id"`
+	Date    string           `json:"date"`
+	DryRun  bool             `json:"dry_run"`
+	OK      bool             `json:"ok"`
+	Objects []PurgedLocation `json:"objects"`
+	Tables  []PurgedTable    `json:"tables"`
+}
+
+// purgeObjects deletes the run's files from one "bucket/prefix/{date}/"
+// location. The location's _manifest.json must name the run: a later run for
+// the same date overwrites the files, and those aren't this run's to delete.
+// force deletes them anyway, e.g. when the run died before writing a manifest.
+func purgeObjects(ctx context.Context, loc, runID string, dryRun, force bool) PurgedLocation {
+	bucket, prefix, _ := strings.Cut(loc, "/")
+	out := PurgedLocation{Location: "gs://" + loc}
+
+	data, err := gcp.ReadObject(ctx, bucket, prefix+"_manifest.json")
+	var m struct {
+		RunID string `json:"run_id"`
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+	}
+	switch {
+	case force:
+	case err != nil:
+		out.Skipped = "no readable _manifest.json (use force=true to delete anyway)"
+		return out
+	case m.RunID != runID:
+		out.Skipped = fmt.Sprintf("written by run %q (use force=true to delete anyway)", m.RunID)
+		return out
+	}
+
+	names, err := gcp.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		out.Errors = append(out.Errors, err.Error())
+		return out
+	}
+	return deleteObjects(ctx, bucket, names, dryRun, out)
+}
+
+// purgeBookkeeping deletes what the run left at the top of a bucket: the
+// extractor's checkpoints/{date}.json for the run's date, and the run's
+// undelivered events under outbox/.
+func purgeBookkeeping(ctx context.Context, bucket, runID, date string, dryRun bool) PurgedLocation {
+	out := PurgedLocation{Location: "gs://" + bucket}
+	var names []string
+	checkpoint := fmt.Sprintf("checkpoints/%s.json", date)
+	if _, err := gcp.ReadObject(ctx, bucket, checkpoint); err == nil {
+		names = append(names, checkpoint)
+	}
+	outbox, err := gcp.ListObjects(ctx, bucket, "outbox/"+runID+"-")
+	if err != nil {
+		out.Errors = append(out.Errors, err.Error())
+	}
+	return deleteObjects(ctx, bucket, append(names, outbox...), dryRun, out)
+}
+
+func deleteObjects(ctx context.Context, bucket string, names []string, dryRun bool, out PurgedLocation) PurgedLocation {
+	for _, name := range names {
+		if !dryRun {
+			if err := gcp.DeleteObject(ctx, bucket, name); err != nil {
+				out.Errors = append(out.Errors, fmt.Sprintf("delete %s: %v", name, err))
+				continue
+			}
+		}
+		out.Objects = append(out.Objects, name)
+	}
+	return out
+}
+
+// purgeTable deletes the run's rows from dataset.table. Tables that don't
+// exist, or that predate the run ID column, are skipped, as are views such as
+// the parquet loader's blue/green alias, whose runs /runs/{id}/rollback takes
+// back out.
+func purgeTable(ctx context.Context, project, location, table, column, runID string, dryRun bool) (PurgedTable, error) {
+	out := PurgedTable{Table: table, Column: column, Action: "planned"}
+	dataset, name, ok := strings.Cut(table, ".")
+	if !ok {
+		return out, fmt.Errorf("%q is not dataset.table", table)
+	}
+	cfg, err := gcp.GetTable(ctx, project, dataset, name)
+	if errors.Is(err, gcp.ErrNotFound) {
+		out.Action, out.Detail = "skipped", "table does not exist"
+		return out, nil
+	}
+	if err != nil {
+		return out, err
+	}
+	if cfg.View {
+		out.Action, out.Detail = "skipped", "a view; POST /runs/{id}/rollback reverts it"
+		return out, nil
+	}
+	hasColumn := false
+	for _, c := range cfg.Columns {
+		hasColumn = hasColumn || c.Name == column
+	}
+	if !hasColumn {
+		out.Action, out.Detail = "skipped", "no "+column+" column"
+		return out, nil
+	}
+	return deleteRunRows(ctx, project, location, project+"."+table, column, runID, dryRun, out)
+}
+
+// handleRunPurge deletes everything a run wrote: POST
+// /runs/{id}/purge?dry_run=true&force=true. That is its files in the
+// summary.objects locations for its date, the checkpoint and outbox entries
+// it left in those buckets, and its rows in purge.tables. The run itself and
+// its summary are kept as the record of what happened. A run still in
+// progress can't be purged. Callers need the admin token (see
+// logging.RequireAdmin). Answers 200 with what was done, or 502 if anything
+// failed.
+func handleRunPurge(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	if !runIDPattern.MatchString(runID) {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid run ID")
+		return
+	}
+	run, ok := registry.Get(runID)
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return
+	}
+	if run.Status != runs.StatusCompleted && run.Status != runs.StatusFailed {
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, fmt.Sprintf("Run is %s; purge it once it has finished", run.Status))
+		return
+	}
+	project := serviceConfig.Bootstrap.Project
+	if project == "" {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "bootstrap.project is not configured")
+		return
+	}
+	location := serviceConfig.Bootstrap.Location
+	if location == "" {
+		location = "US"
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	force := r.URL.Query().Get("force") == "true"
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	report := PurgeReport{RunID: run.ID, Date: run.Date, DryRun: dryRun, OK: true}
+
+	var buckets []string
+	for _, loc := range serviceConfig.Summary.Objects {
+		loc = strings.ReplaceAll(loc, "{date}", run.Date)
+		bucket, prefix, _ := strings.Cut(loc, "/")
+		if !strings.Contains(prefix, run.Date) {
+			// Never delete outside the run date's own folders
+			continue
+		}
+		report.Objects = append(report.Objects, purgeObjects(ctx, loc, run.ID, dryRun, force))
+		if !slices.Contains(buckets, bucket) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	for _, bucket := range buckets {
+		report.Objects = append(report.Objects, purgeBookkeeping(ctx, bucket, run.ID, run.Date, dryRun))
+	}
+	deleted := 0
+	for _, l := range report.Objects {
+		deleted += len(l.Objects)
+		if len(l.Errors) > 0 {
+			report.OK = false
+			log.Printf("❌ Purge %s: %s", l.Location, strings.Join(l.Errors, "; "))
+		}
+	}
+
+	tables := serviceConfig.PurgeTables()
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	for _, table := range names {
+		column := tables[table]
+		t, err := purgeTable(ctx, project, location, table, column, run.ID, dryRun)
+		if err != nil {
+			t.Action, t.Detail = "failed", err.Error()
+			report.OK = false
+			log.Printf("❌ Purge %s: %v", table, err)
+		}
+		report.Tables = append(report.Tables, t)
+	}
+
+	log.Printf("🗑️ Purged run %s (%s): %d object(s), %d table(s), dry_run=%t", run.ID, run.Date, deleted, len(report.Tables), dryRun)
+	emitMetric("run_purged", map[string]interface{}{
+		"run_id":  run.ID,
+		"date":    run.Date,
+		"objects": deleted,
+		"dry_run": dryRun,
+		"ok":      report.OK,
+	})
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// unwrapPush returns the stage event carried by a Pub/Sub push delivery, as
+// sent when stages publish to a topic (EVENT_PUBLISHER=pubsub) whose push
+// subscription points at /clean. Anything else is a stage event posted
+// directly and is returned as it is.
+func unwrapPush(raw map[string]interface{}) (map[string]interface{}, error) {
+	msg, ok := raw["message"].(map[string]interface{})
+	if _, fromSubscription := raw["subscription"].(string); !ok || !fromSubscription {
+		return raw, nil
+	}
+	data, _ := msg["data"].(string)
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("push message data: %w", err)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(decoded, &event); err != nil {
+		return nil, fmt.Errorf("push message data: %w", err)
+	}
+	return event, nil
+}
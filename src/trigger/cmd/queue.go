@@ -0,0 +1,90 @@
+package main
+
+import (
+	"app/queue"
+	"app/runs"
+	"configure/errcategory"
+	"configure/openlineage"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Runs wait here for a slot before their extractor is started; sized from
+// the service config in main
+var runQueue = queue.New(1)
+
+// launchRun starts the first stage of a run the queue has admitted, or the
+// pending stages of one resumed via /runs/{id}/retry. If the first stage
+// can't be started the run fails and gives its slot to the next one.
+func launchRun(runID string) error {
+	run, ok := registry.Get(runID)
+	if !ok || len(run.Topology) == 0 {
+		releaseRun(runID)
+		return fmt.Errorf("run %s not found", runID)
+	}
+	if run.Retries > 0 {
+		registry.Dequeue(runID)
+		resumeStages(run, run.PendingStages())
+		return nil
+	}
+	body, err := json.Marshal(run.Params)
+	if err != nil {
+		registry.Fail(runID, err)
+		releaseRun(runID)
+		return err
+	}
+
+	registry.Dequeue(runID)
+	lineage := openlineage.Run{Job: openlineage.PipelineJob, RunID: run.ID, Date: run.Date}
+	openlineage.Emit(context.Background(), openlineage.Start, lineage, nil)
+	status, _, err := postStage(run.Topology[0], body)
+	if err != nil {
+		registry.Fail(runID, err)
+		releaseRun(runID)
+		openlineage.Emit(context.Background(), openlineage.Fail, lineage, err)
+		return err
+	}
+	log.Printf("📤 Extractor triggered for run %s: %s", runID, status)
+	watchStage(run.ID, run.Date, run.Topology[0], 0)
+	return nil
+}
+
+// releaseRun frees the slot of a run that finished or failed and launches
+// the queued runs admitted in its place.
+func releaseRun(runID string) {
+	for _, next := range runQueue.Release(runID) {
+		go func(id string) {
+			log.Printf("▶️ Run %s leaves the queue", id)
+			if err := launchRun(id); err != nil {
+				log.Printf("❌ Failed to start queued run %s: %v", id, err)
+			}
+		}(next)
+	}
+}
+
+// evictStaleRuns fails the runs that have held a queue slot for longer than
+// limit, checking every minute, so a run whose stage never reports back (a
+// crashed service, a lost event) can't keep the runs behind it waiting
+// forever. A run that ended without freeing its slot just gives it up.
+func evictStaleRuns(limit time.Duration) {
+	for range time.Tick(time.Minute) {
+		for _, id := range runQueue.Stale(limit) {
+			run, ok := registry.Get(id)
+			if !ok || run.Status == runs.StatusCompleted || run.Status == runs.StatusFailed {
+				releaseRun(id)
+				continue
+			}
+			log.Printf("⏰ Run %s has held its queue slot for over %s — failing it", id, limit)
+			registry.Fail(id, errcategory.Errorf(errcategory.Downstream, "run still %s after queue.max_run_duration %s (last event %q)", run.Status, limit, run.LastEvent))
+			emitMetric("run_evicted", map[string]interface{}{
+				"run_id":     id,
+				"date":       run.Date,
+				"last_event": run.LastEvent,
+			})
+			go finishRun(id)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"app/alerts"
+	"app/routing"
+	"app/runs"
+	"configure/errcategory"
+	"configure/retry"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A stage that is merely restarting gets one more chance before /run gives up.
+var readyPolicy = retry.Policy{Attempts: 2, Initial: 2 * time.Second}
+
+// checkReadiness probes the ready endpoint of every stage the run will call
+// after its first, which /run starts itself, and returns the required stages
+// that are not ready with the reason. Optional stages are only logged.
+func checkReadiness(topology routing.Topology) map[string]error {
+	if len(topology) < 2 {
+		return nil
+	}
+	downstream := topology[1:]
+	results := make([]error, len(downstream))
+	var wg sync.WaitGroup
+	for i, s := range downstream {
+		e, ok := serviceConfig.StageEndpoint(s.Name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target, err := e.ReadyURL()
+			if err == nil {
+				err = probe(e, target, readyPolicy)
+			}
+			results[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	notReady := make(map[string]error)
+	for i, s := range downstream {
+		e, _ := serviceConfig.StageEndpoint(s.Name)
+		switch err := results[i]; {
+		case err == nil:
+		case e.Optional:
+			log.Printf("⚠️ %s not ready (optional): %v", s.Name, err)
+		default:
+			notReady[s.Name] = err
+		}
+	}
+	return notReady
+}
+
+// gateRun applies READINESS_CHECK before a run starts: "off" skips the
+// check, "warn" only logs and alerts, and anything else (the default) refuses
+// to start a run whose downstream stages are not ready, so it can't stall
+// half-way and need a manual replay. force skips the check for one run.
+func gateRun(run runs.Run, force bool) error {
+	mode := strings.ToLower(os.Getenv("READINESS_CHECK"))
+	if mode == "off" || force {
+		return nil
+	}
+	notReady := checkReadiness(run.Topology)
+	if len(notReady) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(notReady))
+	for _, s := range run.Topology {
+		if err, ok := notReady[s.Name]; ok {
+			names = append(names, s.Name)
+			log.Printf("❌ %s not ready: %v", s.Name, err)
+		}
+	}
+	emitMetric("stage_not_ready", map[string]interface{}{
+		"run_id":  run.ID,
+		"date":    run.Date,
+		"stages":  names,
+		"blocked": mode != "warn",
+	})
+	alerter.Send(alerts.Alert{
+		Kind:     "stage_not_ready",
+		RunID:    run.ID,
+		Date:     run.Date,
+		Stage:    strings.Join(names, ","),
+		Message:  fmt.Sprintf("downstream stages not ready before run start: %s", strings.Join(names, ", ")),
+		Category: string(errcategory.Downstream),
+	})
+	if mode == "warn" {
+		log.Printf("⚠️ Starting run %s although %s not ready (READINESS_CHECK=warn)", run.ID, strings.Join(names, ", "))
+		return nil
+	}
+	return errcategory.Errorf(errcategory.Downstream, "downstream stages not ready: %s", strings.Join(names, ", "))
+}
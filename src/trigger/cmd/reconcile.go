@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// reportDataLoss compares the rows a stage expected from its input manifest
+// with the rows it actually read or loaded, as reported in its completion
+// event, and emits a data_loss metric when any went missing.
+func reportDataLoss(runID, date, stage string, fields map[string]interface{}) {
+	expected, ok1 := intField(fields, "rows_expected")
+	received, ok2 := intField(fields, "rows_received")
+	if !ok1 || !ok2 || received >= expected {
+		return
+	}
+	lost := expected - received
+	log.Printf("📉 Stage %s lost %d of %d rows for run %s", stage, lost, expected, runID)
+	emitMetric("data_loss", map[string]interface{}{
+		"run_id":        runID,
+		"date":          date,
+		"stage":         stage,
+		"rows_expected": expected,
+		"rows_received": received,
+		"rows_lost":     lost,
+		"loss_ratio":    float64(lost) / float64(expected),
+	})
+}
+
+// intField reads a count that may arrive as a JSON number or a string.
+func intField(fields map[string]interface{}, key string) (int, bool) {
+	v, ok := fields[key]
+	if !ok || v == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(n), true
+}
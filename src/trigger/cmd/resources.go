@@ -0,0 +1,226 @@
+package main
+
+import (
+	"configure/gcp"
+	"configure/schemas"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceDrift is the outcome of the last check of the live buckets,
+// datasets and monitoring tables against the bootstrap spec.
+type ResourceDrift struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Warnings  []string  `json:"warnings"`
+	// Live locations that break loads or queries, which make /readyz fail
+	LocationMismatches []string `json:"location_mismatches,omitempty"`
+}
+
+var (
+	driftMu   sync.Mutex
+	lastDrift *ResourceDrift
+)
+
+// checkResourceDrift compares the resources in serviceConfig.Bootstrap with
+// their live configuration: bucket location, uniform access and lifecycle
+// rule; dataset location; and table partitioning and the type and mode of
+// each expected column. Columns a stage added are not drift. Apart from
+// that, live locations are checked against each other: every dataset in one
+// location, as the trigger's queries run in one, and every bucket loadable
+// into it.
+func checkResourceDrift(ctx context.Context) ResourceDrift {
+	cfg := serviceConfig.Bootstrap
+	location := serviceConfig.DatasetLocation()
+	var warnings []string
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	bucketLocations := map[string]string{}
+	datasetLocations := map[string]string{}
+
+	for _, name := range cfg.Buckets {
+		b, err := gcp.GetBucket(ctx, name)
+		if err != nil {
+			warn("gs://%s: %v", name, err)
+			continue
+		}
+		bucketLocations[name] = b.Location
+		if want := serviceConfig.BucketLocation(name); !strings.EqualFold(b.Location, want) {
+			warn("gs://%s: location is %s, expected %s", name, b.Location, want)
+		}
+		if !b.UniformAccess {
+			warn("gs://%s: uniform bucket-level access is off", name)
+		}
+		if days := cfg.Lifecycle[name]; days > 0 && !slices.Contains(b.DeleteAfterDays, days) {
+			warn("gs://%s: no lifecycle rule deleting objects after %d days (found %v)", name, days, b.DeleteAfterDays)
+		}
+	}
+
+	for _, name := range cfg.Datasets {
+		loc, err := gcp.GetDatasetLocation(ctx, cfg.Project, name)
+		if err != nil {
+			warn("%s: %v", name, err)
+			continue
+		}
+		datasetLocations[name] = loc
+		if !strings.EqualFold(loc, location) {
+			warn("%s: location is %s, expected %s", name, loc, location)
+		}
+	}
+
+	for _, t := range monitoringTables {
+		live, err := gcp.GetTable(ctx, cfg.Project, t.Dataset, t.Table)
+		if err != nil {
+			warn("%s: %v", t.Name(), err)
+			continue
+		}
+		if live.PartitionField != t.Partition {
+			warn("%s: partitioned on %q, expected %q", t.Name(), live.PartitionField, t.Partition)
+		}
+		columns := make(map[string]gcp.Column, len(live.Columns))
+		for _, c := range live.Columns {
+			columns[c.Name] = c
+		}
+		for _, want := range t.Columns {
+			got, ok := columns[want.Name]
+			switch {
+			case !ok:
+				warn("%s: column %s is missing", t.Name(), want.Name)
+			case columnType(got.Type) != columnType(want.Type):
+				warn("%s: column %s is %s, expected %s", t.Name(), want.Name, got.Type, want.Type)
+			case (got.Mode == "REPEATED") != (want.Mode == "REPEATED"):
+				warn("%s: column %s has mode %s, expected %s", t.Name(), want.Name, columnMode(got.Mode), columnMode(want.Mode))
+			}
+		}
+	}
+	return ResourceDrift{
+		CheckedAt:          time.Now().UTC(),
+		Warnings:           warnings,
+		LocationMismatches: locationMismatches(bucketLocations, datasetLocations),
+	}
+}
+
+// locationMismatches lists the live locations that break the pipeline:
+// datasets split across locations, and buckets a dataset can't load from.
+func locationMismatches(buckets, datasets map[string]string) []string {
+	var mismatches []string
+	byLocation := map[string][]string{}
+	for name, loc := range datasets {
+		byLocation[strings.ToUpper(loc)] = append(byLocation[strings.ToUpper(loc)], name)
+	}
+	if len(byLocation) > 1 {
+		var parts []string
+		for loc, names := range byLocation {
+			slices.Sort(names)
+			parts = append(parts, fmt.Sprintf("%s in %s", strings.Join(names, ", "), loc))
+		}
+		slices.Sort(parts)
+		mismatches = append(mismatches, "datasets span locations ("+strings.Join(parts, "; ")+"), so queries across them fail")
+	}
+	for bucket, bloc := range buckets {
+		for dataset, dloc := range datasets {
+			if !gcp.LoadableInto(bloc, dloc) {
+				mismatches = append(mismatches, fmt.Sprintf("gs://%s in %s can't be loaded into %s in %s", bucket, bloc, dataset, dloc))
+			}
+		}
+	}
+	slices.Sort(mismatches)
+	return mismatches
+}
+
+// columnType maps GoogleSQL type names to the legacy ones the API reports.
+func columnType(t string) string {
+	for legacy, sql := range schemas.SQLTypes {
+		if t == sql {
+			return legacy
+		}
+	}
+	return t
+}
+
+func columnMode(m string) string {
+	if m == "" {
+		return "NULLABLE"
+	}
+	return m
+}
+
+// refreshResourceDrift runs the check and keeps its result for /readyz.
+func refreshResourceDrift(ctx context.Context) ResourceDrift {
+	d := checkResourceDrift(ctx)
+	for _, w := range d.Warnings {
+		log.Printf("⚠️ Resource drift: %s", w)
+	}
+	for _, m := range d.LocationMismatches {
+		log.Printf("❌ Location mismatch: %s", m)
+	}
+	driftMu.Lock()
+	lastDrift = &d
+	driftMu.Unlock()
+	return d
+}
+
+// watchResourceDrift checks for drift at startup and then every
+// RESOURCE_DRIFT_INTERVAL (default 6h; "off" disables the check). Nothing is
+// checked without a bootstrap project.
+func watchResourceDrift() {
+	v := os.Getenv("RESOURCE_DRIFT_INTERVAL")
+	if serviceConfig.Bootstrap.Project == "" || v == "off" {
+		return
+	}
+	interval := 6 * time.Hour
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		interval = d
+	}
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			refreshResourceDrift(ctx)
+			cancel()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// handleResourceDrift runs the drift check now: GET /resources/drift.
+func handleResourceDrift(w http.ResponseWriter, r *http.Request) {
+	if serviceConfig.Bootstrap.Project == "" {
+		writeJSON(w, http.StatusOK, ResourceDrift{Warnings: []string{}})
+		return
+	}
+	d := refreshResourceDrift(r.Context())
+	if d.Warnings == nil {
+		d.Warnings = []string{}
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// handleReadyz reports the trigger ready along with the warnings of the last
+// resource drift check; drift never makes it unready, but buckets and datasets
+// whose locations don't match do (503), since every load would fail.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	driftMu.Lock()
+	d := lastDrift
+	driftMu.Unlock()
+	body := map[string]interface{}{"ready": true, "warnings": []string{}}
+	status := http.StatusOK
+	if d != nil {
+		body["drift_checked_at"] = d.CheckedAt
+		if len(d.Warnings) > 0 {
+			body["warnings"] = d.Warnings
+		}
+		if len(d.LocationMismatches) > 0 {
+			body["ready"] = false
+			body["location_mismatches"] = d.LocationMismatches
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, body)
+}
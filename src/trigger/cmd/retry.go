@@ -0,0 +1,83 @@
+package main
+
+import (
+	"app/routing"
+	"app/runs"
+	"configure/problem"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// handleRunRetry resumes a failed run at its earliest unfinished stages:
+// POST /runs/{id}/retry[?force=true]. Completed stages are not re-run, so
+// their outputs (raw files, cleaned data, loaded tables) are reused. A resumed
+// run needs a slot in the run queue like a new one, unless it still holds its
+// own (?force=true on a running run), and waits in the queue at its priority
+// when none is free. A stage with an approval gate is held there again rather
+// than started.
+func handleRunRetry(w http.ResponseWriter, r *http.Request) {
+	force := r.URL.Query().Get("force") == "true"
+	run, restart, err := registry.Resume(r.PathValue("id"), force)
+	if errors.Is(err, runs.ErrNotFound) {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️ Cannot retry run %s: %v", run.ID, err)
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, err.Error())
+		return
+	}
+
+	names := make([]string, len(restart))
+	for i, s := range restart {
+		names[i] = s.Name
+	}
+	emitMetric("run_retry", map[string]interface{}{
+		"run_id":  run.ID,
+		"date":    run.Date,
+		"stages":  names,
+		"attempt": run.Retries,
+	})
+
+	if !runQueue.Holds(run.ID) {
+		if admitted, position := runQueue.Submit(run.ID, run.Priority); !admitted {
+			registry.Queue(run.ID, run.Priority)
+			log.Printf("⏳ Resumed run %s queued at position %d", run.ID, position)
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{
+				"run_id":           run.ID,
+				"status":           runs.StatusQueued,
+				"queue_position":   position,
+				"resumed_stages":   names,
+				"completed_stages": run.Completed,
+				"retries":          run.Retries,
+			})
+			return
+		}
+	}
+	resumeStages(run, restart)
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"run_id":           run.ID,
+		"status":           run.Status,
+		"resumed_stages":   names,
+		"completed_stages": run.Completed,
+		"retries":          run.Retries,
+	})
+}
+
+// resumeStages restarts a resumed run's pending stages, holding those with
+// an approval gate there again.
+func resumeStages(run runs.Run, stages []routing.Stage) {
+	for _, s := range stages {
+		if s.Approval {
+			holdForApproval(run.ID, run.Date, s)
+			continue
+		}
+		watchStage(run.ID, run.Date, s, 0)
+		go func(s routing.Stage) {
+			log.Printf("🔁 Resuming run %s at %s", run.ID, s.Name)
+			restartStage(run.ID, run.Date, s)
+		}(s)
+	}
+}
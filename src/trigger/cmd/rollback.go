@@ -0,0 +1,189 @@
+package main
+
+import (
+	"app/runs"
+	"configure/gcp"
+	"configure/problem"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Event recorded on a run once its rows are taken back out of the warehouse
+const rolledBackEvent = "rolled_back"
+
+// viewSource is the table a blue/green view selects from, as the parquet
+// loader writes it: SELECT * FROM `project.dataset.table_vKEY`.
+var viewSource = regexp.MustCompile("`([^`]+)`")
+
+// RollbackReport is the answer to POST /runs/{id}/rollback.
+type RollbackReport struct {
+	RunID  string        `json:"run_id"`
+	Date   string        `json:"date"`
+	DryRun bool          `json:"dry_run"`
+	OK     bool          `json:"ok"`
+	Tables []PurgedTable `json:"tables"`
+}
+
+// handleRunRollback takes a bad run's load back out of the warehouse: POST
+// /runs/{id}/rollback?dry_run=true. For each table in purge.tables, a
+// blue/green view the run promoted is pointed back at the version before the
+// run's, and anywhere else the rows stamped with the run's ID are deleted.
+// Unlike /purge it leaves the run's files alone, so the date can be loaded
+// again once the data is fixed. Callers need the admin token, as for the
+// loader's /rollback. Answers 200 with what was done, or 502 if anything
+// failed.
+func handleRunRollback(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	if !runIDPattern.MatchString(runID) {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid run ID")
+		return
+	}
+	run, ok := registry.Get(runID)
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return
+	}
+	if run.Status != runs.StatusCompleted && run.Status != runs.StatusFailed {
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, fmt.Sprintf("Run is %s; roll it back once it has finished", run.Status))
+		return
+	}
+	project := serviceConfig.Bootstrap.Project
+	if project == "" {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "bootstrap.project is not configured")
+		return
+	}
+	location := serviceConfig.Bootstrap.Location
+	if location == "" {
+		location = "US"
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	report := RollbackReport{RunID: run.ID, Date: run.Date, DryRun: dryRun, OK: true}
+
+	tables := serviceConfig.PurgeTables()
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	changed := 0
+	for _, table := range names {
+		t, err := rollbackTable(ctx, project, location, table, tables[table], run.ID, dryRun)
+		if err != nil {
+			t.Action, t.Detail = "failed", err.Error()
+			report.OK = false
+			log.Printf("❌ Rollback %s: %v", table, err)
+		}
+		if t.Action == "deleted" || t.Action == "reverted" {
+			changed++
+		}
+		report.Tables = append(report.Tables, t)
+	}
+
+	if !dryRun {
+		registry.RecordEvent(run.ID, runs.Event{Name: rolledBackEvent, Origin: "trigger", Fields: map[string]interface{}{
+			"tables": changed,
+			"ok":     report.OK,
+		}})
+	}
+	log.Printf("⏪ Rolled back run %s (%s): %d of %d table(s), dry_run=%t", run.ID, run.Date, changed, len(report.Tables), dryRun)
+	emitMetric("run_rolled_back", map[string]interface{}{
+		"run_id":  run.ID,
+		"date":    run.Date,
+		"tables":  changed,
+		"dry_run": dryRun,
+		"ok":      report.OK,
+	})
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, report)
+}
+
+// rollbackTable takes the run's rows out of dataset.table. A plain table has
+// them deleted as /purge would. A view is the parquet loader's blue/green
+// alias: when it reads the run's own version it is pointed back at the newest
+// version older than that; when a later run's version is live, which carries
+// the run's rows forward, they are deleted from that version.
+func rollbackTable(ctx context.Context, project, location, table, column, runID string, dryRun bool) (PurgedTable, error) {
+	out := PurgedTable{Table: table, Column: column, Action: "planned"}
+	dataset, name, ok := strings.Cut(table, ".")
+	if !ok {
+		return out, fmt.Errorf("%q is not dataset.table", table)
+	}
+	cfg, err := gcp.GetTable(ctx, project, dataset, name)
+	if errors.Is(err, gcp.ErrNotFound) {
+		out.Action, out.Detail = "skipped", "table does not exist"
+		return out, nil
+	}
+	if err != nil {
+		return out, err
+	}
+	if !cfg.View {
+		return purgeTable(ctx, project, location, table, column, runID, dryRun)
+	}
+
+	m := viewSource.FindStringSubmatch(cfg.ViewQuery)
+	if m == nil {
+		return out, fmt.Errorf("view does not read a single version: %s", cfg.ViewQuery)
+	}
+	live := m[1]
+	_, liveTable, _ := strings.Cut(strings.TrimPrefix(live, project+"."), ".")
+	// The loader names a run's version after its ID with anything but
+	// [A-Za-z0-9_] replaced, which leaves only '-' to replace here
+	own := name + "_v" + strings.ReplaceAll(runID, "-", "_")
+	if liveTable != own {
+		if !strings.HasPrefix(liveTable, name+"_v") {
+			return out, fmt.Errorf("view reads %s, which is not one of its versions", live)
+		}
+		out.Detail = "from live version " + liveTable
+		return deleteRunRows(ctx, project, location, live, column, runID, dryRun, out)
+	}
+
+	sql := fmt.Sprintf("SELECT table_name FROM `%s.%s.INFORMATION_SCHEMA.TABLES` "+
+		"WHERE STARTS_WITH(table_name, '%s_v') AND table_name != '%s' "+
+		"AND creation_time < (SELECT creation_time FROM `%s.%s.INFORMATION_SCHEMA.TABLES` WHERE table_name = '%s') "+
+		"ORDER BY creation_time DESC LIMIT 1", project, dataset, name, own, project, dataset, own)
+	rows, err := gcp.QueryRows(ctx, project, location, sql)
+	if err != nil {
+		return out, err
+	}
+	if len(rows) == 0 {
+		return out, fmt.Errorf("the run's version %s is the only one; there is nothing to revert to", own)
+	}
+	previous, _ := rows[0]["table_name"].(string)
+	out.Detail = fmt.Sprintf("view from %s back to %s", own, previous)
+	if dryRun {
+		return out, nil
+	}
+	sql = fmt.Sprintf("CREATE OR REPLACE VIEW `%s.%s` AS SELECT * FROM `%s.%s.%s`", project, table, project, dataset, previous)
+	if err := gcp.RunQuery(ctx, project, location, sql); err != nil {
+		return out, err
+	}
+	out.Action = "reverted"
+	return out, nil
+}
+
+// deleteRunRows deletes the rows column marks as runID's from the fully
+// qualified table.
+func deleteRunRows(ctx context.Context, project, location, table, column, runID string, dryRun bool, out PurgedTable) (PurgedTable, error) {
+	if dryRun {
+		return out, nil
+	}
+	sql := fmt.Sprintf("DELETE FROM `%s` WHERE `%s` = '%s'", table, column, runID)
+	if err := gcp.RunQuery(ctx, project, location, sql); err != nil {
+		return out, err
+	}
+	out.Action = "deleted"
+	return out, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"app/configure"
+	"app/routing"
+	"configure/audit"
+	"configure/problem"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PUT /admin/routes replaces the stage list at runtime; routesMu guards it
+// (serviceConfig.Pipeline.Stages), the default topology built from it and
+// who changed them last.
+var (
+	routesMu        sync.RWMutex
+	routesUpdatedAt time.Time
+	routesUpdatedBy string
+)
+
+// RoutesReport is the answer to GET and PUT /admin/routes.
+type RoutesReport struct {
+	Stages   []configure.StageConfig `json:"stages"`
+	Topology routing.Topology        `json:"topology"`
+	// "config" until the stages are changed at runtime, then "runtime"
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+	DryRun    bool       `json:"dry_run,omitempty"`
+}
+
+// currentTopology is the topology of runs that don't choose their own stages.
+func currentTopology() routing.Topology {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return defaultTopology
+}
+
+// routingConfig is the service config with the current stage list, to build a
+// run's own topology from.
+func routingConfig() *configure.ServiceURLs {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	cfg := serviceConfig
+	return &cfg
+}
+
+// routesReport describes the current routing; routesMu must be held.
+func routesReport() RoutesReport {
+	report := RoutesReport{Stages: serviceConfig.StageConfigs(), Topology: defaultTopology, Source: "config"}
+	if !routesUpdatedAt.IsZero() {
+		at := routesUpdatedAt
+		report.Source, report.UpdatedAt, report.UpdatedBy = "runtime", &at, routesUpdatedBy
+	}
+	return report
+}
+
+// handleRoutes shows the stage list the router follows: GET /admin/routes.
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	routesMu.RLock()
+	report := routesReport()
+	routesMu.RUnlock()
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleRoutesUpdate replaces the stage list without a redeploy, e.g. to skip
+// loader_json for a week: PUT /admin/routes[?dry_run=true] with
+// {"stages": [...]} in the pipeline.stages format, usually GET's stages
+// edited. The list is validated as at startup and applies to runs started
+// afterwards; running ones keep their topology. The change lasts until the
+// trigger restarts, so a permanent one belongs in the service config.
+// Callers need the admin token.
+func handleRoutesUpdate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Stages []configure.StageConfig `json:"stages"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if len(req.Stages) == 0 {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "stages is required")
+		return
+	}
+
+	cfg := routingConfig()
+	cfg.Pipeline.Stages = req.Stages
+	topology, err := validateRoutes(cfg)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid stages: "+err.Error())
+		return
+	}
+	if r.URL.Query().Get("dry_run") == "true" {
+		report := RoutesReport{Stages: req.Stages, Topology: topology, Source: "runtime", DryRun: true}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	caller := audit.Caller(r)
+	routesMu.Lock()
+	previous := defaultTopology.Names()
+	serviceConfig.Pipeline.Stages = req.Stages
+	defaultTopology = topology
+	routesUpdatedAt, routesUpdatedBy = time.Now().UTC(), caller
+	report := routesReport()
+	routesMu.Unlock()
+
+	log.Printf("🧭 Routes changed by %s: %v → %v", caller, previous, topology.Names())
+	emitMetric("routes_updated", map[string]interface{}{
+		"previous": previous,
+		"stages":   topology.Names(),
+		"by":       caller,
+	})
+	writeJSON(w, http.StatusOK, report)
+}
+
+// validateRoutes checks cfg's stage list the way startup does, and that every
+// stage is one the trigger knows and every enabled one it calls has a URL.
+func validateRoutes(cfg *configure.ServiceURLs) (routing.Topology, error) {
+	seen := make(map[string]bool)
+	for _, s := range cfg.Pipeline.Stages {
+		endpoint, ok := cfg.StageEndpoint(s.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", s.Name)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("stage %q listed twice", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Enabled && endpoint.URL == "" && s.StartedBy != "gcs_notification" {
+			return nil, fmt.Errorf("stage %q has no url in the service config", s.Name)
+		}
+	}
+	for _, s := range cfg.Pipeline.Stages {
+		if s.After != "" && !seen[s.After] {
+			return nil, fmt.Errorf("stage %q: after names unknown stage %q", s.Name, s.After)
+		}
+	}
+	return routing.Build(cfg, cfg.EnabledStages())
+}
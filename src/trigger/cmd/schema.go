@@ -0,0 +1,48 @@
+package main
+
+import (
+	"configure/eventschema"
+	"configure/problem"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Senders already warned about, by origin and version, so an old service
+// gets one deprecation warning rather than one per event
+var (
+	deprecatedMu   sync.Mutex
+	deprecatedSeen = make(map[string]bool)
+)
+
+// upgradeEvent brings a stage event to the current schema version. Older
+// versions are read with a deprecation warning; an unsupported one is
+// answered with a 422 problem and false.
+func upgradeEvent(w http.ResponseWriter, r *http.Request, raw map[string]interface{}) bool {
+	version, err := eventschema.Upgrade(raw)
+	if err != nil {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.UnsupportedSchema, err.Error())
+		return false
+	}
+	if version == eventschema.Version {
+		return true
+	}
+
+	origin := fmt.Sprint(raw["origin"])
+	key := fmt.Sprintf("%s/%d", origin, version)
+	deprecatedMu.Lock()
+	first := !deprecatedSeen[key]
+	deprecatedSeen[key] = true
+	deprecatedMu.Unlock()
+	if first {
+		log.Printf("⚠️ Deprecated: %s sent %v with %s %d (current is %d) — upgrade it before support for %d is dropped",
+			origin, raw["event"], eventschema.Field, version, eventschema.Version, version)
+		emitMetric("deprecated_schema", map[string]interface{}{
+			"origin":         origin,
+			"event":          raw["event"],
+			"schema_version": version,
+		})
+	}
+	return true
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"app/routing"
+	"app/runs"
+	"configure/eventschema"
+	"configure/gcp"
+	"configure/problem"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Self-tests run under a date no real run uses, so their raw and cleaned
+// files never mix with real ones and can be deleted wholesale afterwards.
+const selftestDate = "1970-01-01"
+
+// Stages a self-test runs, when enabled; later stages read the real tables.
+var selftestStages = map[string]bool{"extractor": true, "cleaner": true, "loader_json": true, "loader_parquet": true}
+
+// Only one self-test at a time, since they share selftestDate.
+var selftestMu sync.Mutex
+
+type selftestCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// handleSelftest smoke-tests a deployment end to end in one call: POST
+// /selftest extracts a single chunk, cleans it and loads it into the loaders'
+// <table>_selftest tables (which expire after an hour), checks every stage
+// completed and the loaders loaded every row the cleaner wrote, then deletes
+// the run's files from the summary object locations. It answers once the run
+// has finished or SELFTEST_TIMEOUT (default 15m) has passed: 200 if every
+// check passed, 503 otherwise. The run skips the queue and the readiness gate;
+// the extractor keeps no checkpoint for it, so a real run stopped part way
+// still resumes from its own. Callers need the admin token.
+func handleSelftest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
+		return
+	}
+	if !selftestMu.TryLock() {
+		problem.Write(w, r, http.StatusConflict, problem.Conflict, "A self-test is already running")
+		return
+	}
+	defer selftestMu.Unlock()
+
+	var names []string
+	for _, s := range currentTopology() {
+		if selftestStages[s.Name] {
+			names = append(names, s.Name)
+		}
+	}
+	topology, err := routing.Build(routingConfig(), names)
+	if err != nil {
+		problem.Write(w, r, http.StatusInternalServerError, problem.NotConfigured, "Cannot build self-test stages: "+err.Error())
+		return
+	}
+	// Loaders write a self-test to scratch tables, so there is nothing to approve
+	for i := range topology {
+		topology[i].Approval = false
+	}
+
+	run, _ := registry.Start(selftestDate, "", topology)
+	registry.SetParams(run.ID, eventschema.Stamp(map[string]interface{}{
+		"run_id": run.ID,
+		"date":   selftestDate,
+		// The extractor stops after the chunk that reaches max_offset
+		"max_offset": 1,
+		"selftest":   true,
+		// A self-test proves the wiring, so it never takes the FAULT_* defaults
+		"api_error_prob": 0,
+		"gcs_error_prob": 0,
+		"row_drop_prob":  0,
+		"delay_prob":     0,
+	}))
+	log.Printf("🩺 Self-test run %s started: %v", run.ID, topology.Names())
+	start := time.Now()
+	if err := launchRun(run.ID); err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, "Failed to start extractor: "+err.Error())
+		return
+	}
+
+	timeout := 15 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("SELFTEST_TIMEOUT")); err == nil && d > 0 {
+		timeout = d
+	}
+	run = awaitRun(r.Context(), run.ID, timeout)
+	if run.Status != runs.StatusCompleted && run.Status != runs.StatusFailed {
+		registry.Fail(run.ID, fmt.Errorf("self-test did not finish within %s", timeout))
+		go finishRun(run.ID)
+		run, _ = registry.Get(run.ID)
+	}
+
+	checks := selftestChecks(run)
+	passed := true
+	for _, c := range checks {
+		passed = passed && c.OK
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	deleted, cleanupErrs := cleanupSelftest(ctx)
+
+	result := "passed"
+	status := http.StatusOK
+	if !passed {
+		result, status = "failed", http.StatusServiceUnavailable
+	}
+	log.Printf("🩺 Self-test run %s %s in %s (%d files removed)", run.ID, result, time.Since(start).Round(time.Second), deleted)
+	writeJSON(w, status, map[string]interface{}{
+		"run_id":           run.ID,
+		"status":           result,
+		"run_status":       run.Status,
+		"error":            run.Error,
+		"duration_seconds": eventschema.Seconds(time.Since(start).Seconds()),
+		"checks":           checks,
+		"files_removed":    deleted,
+		"cleanup_errors":   cleanupErrs,
+	})
+}
+
+// awaitRun polls the run until it completes or fails, timeout passes or ctx is done.
+func awaitRun(ctx context.Context, runID string, timeout time.Duration) runs.Run {
+	deadline := time.After(timeout)
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+	for {
+		run, _ := registry.Get(runID)
+		if run.Status == runs.StatusCompleted || run.Status == runs.StatusFailed {
+			return run
+		}
+		select {
+		case <-ctx.Done():
+			return run
+		case <-deadline:
+			return run
+		case <-tick.C:
+		}
+	}
+}
+
+// selftestChecks checks every stage completed, the extractor got rows and
+// each loader loaded all the rows its manifest lists.
+func selftestChecks(run runs.Run) []selftestCheck {
+	done := make(map[string]bool)
+	for _, name := range run.Completed {
+		done[name] = true
+	}
+	var checks []selftestCheck
+	for _, s := range run.Topology {
+		c := selftestCheck{Name: s.Name + " completed", OK: done[s.Name]}
+		if !c.OK {
+			c.Detail = "no " + s.Event + " event"
+		}
+		checks = append(checks, c)
+	}
+
+	for _, e := range run.Events {
+		stage, ok := strings.CutSuffix(e.Name, "_completed")
+		if !ok {
+			continue
+		}
+		received, ok := e.Fields["rows_received"].(float64)
+		if !ok {
+			continue
+		}
+		c := selftestCheck{Name: stage + " rows", OK: received > 0, Detail: fmt.Sprintf("%.0f rows", received)}
+		if expected, ok := e.Fields["rows_expected"].(float64); ok && stage != "extractor" {
+			c.OK = c.OK && received == expected
+			c.Detail = fmt.Sprintf("%.0f of %.0f rows", received, expected)
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// cleanupSelftest deletes the self-test's files from the summary object
+// locations (raw and cleaned data for selftestDate) and returns how many it
+// deleted.
+func cleanupSelftest(ctx context.Context) (int, []string) {
+	deleted := 0
+	var errs []string
+	for _, loc := range serviceConfig.Summary.Objects {
+		loc = strings.ReplaceAll(loc, "{date}", selftestDate)
+		bucket, prefix, _ := strings.Cut(loc, "/")
+		if !strings.Contains(prefix, selftestDate) {
+			// Never delete outside the self-test's own folders
+			continue
+		}
+		names, err := gcp.ListObjects(ctx, bucket, prefix)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("list gs://%s: %v", loc, err))
+			continue
+		}
+		for _, name := range names {
+			if err := gcp.DeleteObject(ctx, bucket, name); err != nil {
+				errs = append(errs, fmt.Sprintf("delete gs://%s/%s: %v", bucket, name, err))
+				continue
+			}
+			deleted++
+		}
+	}
+	return deleted, errs
+}
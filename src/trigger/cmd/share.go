@@ -0,0 +1,198 @@
+package main
+
+import (
+	"app/runs"
+	"app/summary"
+	"configure/gcp"
+	"configure/problem"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultShareTTL    = time.Hour
+	defaultShareMaxTTL = 24 * time.Hour
+)
+
+// SharedObject is a signed URL for one artifact.
+type SharedObject struct {
+	Object    string    `json:"object"` // gs://bucket/name
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// shareable reports whether an object is a run artifact that may be shared:
+// a manifest, a file under exports/ or a run summary. Everything else (raw
+// and cleaned chunks, checkpoints, ledgers) stays behind bucket IAM.
+func shareable(name string) bool {
+	if path.Base(name) == "_manifest.json" || strings.HasPrefix(name, "exports/") {
+		return true
+	}
+	ok, _ := path.Match("runs/*/*/summary.json", name)
+	return ok
+}
+
+// shareBuckets are the buckets whose artifacts may be shared: share.buckets,
+// else the buckets the service config already names.
+func shareBuckets() map[string]bool {
+	buckets := make(map[string]bool)
+	if len(serviceConfig.Share.Buckets) > 0 {
+		for _, b := range serviceConfig.Share.Buckets {
+			buckets[b] = true
+		}
+		return buckets
+	}
+	for _, b := range serviceConfig.Bootstrap.Buckets {
+		buckets[b] = true
+	}
+	if b := serviceConfig.Summary.Bucket; b != "" {
+		buckets[b] = true
+	}
+	for _, loc := range serviceConfig.Summary.Objects {
+		b, _, _ := strings.Cut(loc, "/")
+		buckets[b] = true
+	}
+	return buckets
+}
+
+// shareTTL parses a requested lifetime, defaulting to an hour and capped at
+// share.max_ttl.
+func shareTTL(raw string) (time.Duration, error) {
+	limit := defaultShareMaxTTL
+	if serviceConfig.Share.MaxTTL != "" {
+		d, err := time.ParseDuration(serviceConfig.Share.MaxTTL)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid share.max_ttl %q", serviceConfig.Share.MaxTTL)
+		}
+		limit = min(d, gcp.MaxSignedURLExpiry)
+	}
+	if raw == "" {
+		return min(defaultShareTTL, limit), nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", raw)
+	}
+	if ttl > limit {
+		return 0, fmt.Errorf("ttl %s is longer than the %s allowed", ttl, limit)
+	}
+	return ttl, nil
+}
+
+// checkShareable validates a gs://bucket/name and splits it.
+func checkShareable(object string, buckets map[string]bool) (bucket, name string, err error) {
+	rest, ok := strings.CutPrefix(object, "gs://")
+	bucket, name, _ = strings.Cut(rest, "/")
+	switch {
+	case !ok || bucket == "" || name == "" || strings.HasSuffix(name, "/"):
+		return "", "", fmt.Errorf("%q is not a gs://bucket/object URI", object)
+	case !buckets[bucket]:
+		return "", "", fmt.Errorf("bucket %s is not shared", bucket)
+	case !shareable(name):
+		return "", "", fmt.Errorf("%s is not a manifest, export or run summary", object)
+	}
+	return bucket, name, nil
+}
+
+func signObjects(ctx context.Context, objects []string, ttl time.Duration) ([]SharedObject, error) {
+	expiresAt := time.Now().UTC().Add(ttl).Truncate(time.Second)
+	shared := make([]SharedObject, 0, len(objects))
+	for _, object := range objects {
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(object, "gs://"), "/")
+		url, err := gcp.SignedURL(ctx, bucket, name, serviceConfig.Share.Signer, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("sign %s: %w", object, err)
+		}
+		shared = append(shared, SharedObject{Object: object, URL: url, ExpiresAt: expiresAt})
+	}
+	log.Printf("🔗 Signed %d URL(s) valid for %s", len(shared), ttl)
+	return shared, nil
+}
+
+// handleShare signs URLs for the artifacts a reviewer should see:
+// POST /share {"objects": ["gs://bucket/name", ...], "ttl": "2h"}. Only
+// manifests, exports and run summaries in the shared buckets are signed; the
+// request fails as a whole if any object isn't one. Callers need the admin
+// token: the URLs work for anyone holding them.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []string `json:"objects"`
+		TTL     string   `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	if len(req.Objects) == 0 {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "No objects to share")
+		return
+	}
+	ttl, err := shareTTL(req.TTL)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, err.Error())
+		return
+	}
+	buckets := shareBuckets()
+	for _, object := range req.Objects {
+		if _, _, err := checkShareable(object, buckets); err != nil {
+			problem.Write(w, r, http.StatusForbidden, problem.Forbidden, err.Error())
+			return
+		}
+	}
+	shared, err := signObjects(r.Context(), req.Objects, ttl)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"objects": shared})
+}
+
+// handleRunShare signs URLs for every artifact of a run: POST
+// /runs/{id}/share?ttl=2h. That is the manifests and exports found in the
+// summary.objects locations for the run's date, and its archived summary
+// once the run has finished. Callers need the admin token, as for /share.
+func handleRunShare(w http.ResponseWriter, r *http.Request) {
+	ttl, err := shareTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, err.Error())
+		return
+	}
+	run, ok := registry.Get(r.PathValue("id"))
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return
+	}
+
+	buckets := shareBuckets()
+	var objects []string
+	add := func(object string) {
+		if _, _, err := checkShareable(object, buckets); err == nil {
+			objects = append(objects, object)
+		}
+	}
+	if b := serviceConfig.Summary.Bucket; b != "" && (run.Status == runs.StatusCompleted || run.Status == runs.StatusFailed) {
+		add("gs://" + b + "/" + summary.Path(run.Date, run.ID))
+	}
+	for _, l := range summary.ListObjects(r.Context(), serviceConfig.Summary.Objects, run.Date) {
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(l.Location, "gs://"), "/")
+		for _, o := range l.Objects {
+			add("gs://" + bucket + "/" + o.Name)
+		}
+	}
+	if len(objects) == 0 {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run has no shareable artifacts in the shared buckets")
+		return
+	}
+	shared, err := signObjects(r.Context(), objects, ttl)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadGateway, problem.Upstream, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"run_id": run.ID, "date": run.Date, "objects": shared})
+}
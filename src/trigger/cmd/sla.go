@@ -0,0 +1,179 @@
+package main
+
+import (
+	"app/alerts"
+	"app/routing"
+	"app/runs"
+	"configure/errcategory"
+	"configure/logging"
+	"configure/monitoring"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// watchStage arms the stage's SLA clock for a tracked run.
+func watchStage(runID, date string, stage routing.Stage, attempt int) {
+	slaMonitor.Watch(runID, stage.Name, stage.SLALimit(), func() {
+		handleSLAViolation(runID, date, stage, attempt)
+	})
+}
+
+// handleSLAViolation records the overrun, alerts, and applies the stage's policy.
+func handleSLAViolation(runID, date string, stage routing.Stage, attempt int) {
+	registry.RecordSLAViolation(runID, stage.Name)
+	monitoring.Count(context.Background(), "sla_violations", map[string]string{"stage": stage.Name})
+	emitMetric("sla_violation", map[string]interface{}{
+		"run_id":  runID,
+		"date":    date,
+		"stage":   stage.Name,
+		"sla":     stage.SLA,
+		"attempt": attempt,
+		"policy":  stage.OnSLAViolation,
+	})
+	alerter.Send(alerts.Alert{
+		Kind:    "sla_violation",
+		RunID:   runID,
+		Date:    date,
+		Stage:   stage.Name,
+		Message: fmt.Sprintf("stage %s exceeded its %s SLA (attempt %d)", stage.Name, stage.SLA, attempt+1),
+	})
+
+	switch stage.OnSLAViolation {
+	case "retry":
+		if attempt >= stage.SLARetries {
+			log.Printf("⛔ SLA retries exhausted for %s on run %s", stage.Name, runID)
+			return
+		}
+		log.Printf("🔁 Re-sending %s for run %s (retry %d/%d)", stage.Name, runID, attempt+1, stage.SLARetries)
+		watchStage(runID, date, stage, attempt+1)
+		go restartStage(runID, date, stage)
+
+	case "cancel":
+		registry.Fail(runID, errcategory.Errorf(errcategory.Downstream, "stage %s exceeded SLA %s", stage.Name, stage.SLA))
+		log.Printf("🛑 Run %s cancelled after %s exceeded its SLA", runID, stage.Name)
+		go finishRun(runID)
+		if stage.Name == "extractor" {
+			requestExtractorShutdown(runID)
+		}
+	}
+}
+
+// retryFailedStage applies the stage's on_failure policy to a failure it
+// reported: with "retry", a retryable failure re-sends the stage after its
+// backoff (doubling per attempt) until failure_retries are used up. It
+// reports whether a retry was scheduled; if not, the run should fail.
+func retryFailedStage(runID, date string, stage routing.Stage, category errcategory.Category) bool {
+	if stage.OnFailure != "retry" {
+		return false
+	}
+	if !errcategory.Retryable(category) {
+		log.Printf("⛔ Not retrying %s for run %s: %s failures won't succeed if repeated", stage.Name, runID, category)
+		return false
+	}
+	attempt, ok := registry.RetryStage(runID, stage.Name, stage.FailureRetries)
+	if !ok {
+		log.Printf("⛔ Failure retries exhausted for %s on run %s", stage.Name, runID)
+		return false
+	}
+	delay := stage.BackoffDelay() << (attempt - 1)
+	log.Printf("🔁 Re-sending %s for run %s in %s (retry %d/%d)", stage.Name, runID, delay, attempt, stage.FailureRetries)
+	emitMetric("stage_retry", map[string]interface{}{
+		"run_id":         runID,
+		"date":           date,
+		"stage":          stage.Name,
+		"attempt":        attempt,
+		"error_category": category,
+	})
+	time.AfterFunc(delay, func() {
+		if run, ok := registry.Get(runID); !ok || run.Status == runs.StatusFailed {
+			return
+		}
+		watchStage(runID, date, stage, 0)
+		restartStage(runID, date, stage)
+	})
+	return true
+}
+
+// restartStage re-sends the request that started a stage, failing the stage
+// as startStage does if it can't be reached.
+func restartStage(runID, date string, stage routing.Stage) {
+	if stage.Name != "extractor" {
+		startStage(runID, date, stage)
+		return
+	}
+	run, ok := registry.Get(runID)
+	if !ok || run.Params == nil {
+		log.Printf("❌ No stored extractor request for run %s — cannot retry", runID)
+		return
+	}
+	body, err := json.Marshal(run.Params)
+	if err != nil {
+		log.Printf("❌ Failed to marshal extractor payload: %v", err)
+		return
+	}
+	status, _, err := postStage(stage, body)
+	if err != nil {
+		log.Printf("❌ Failed to re-trigger extractor: %v", err)
+		failStage(runID, date, true, run.Topology, stage.Name, fmt.Sprintf("could not restart extractor: %v", err), errcategory.Of(err))
+		return
+	}
+	log.Printf("📤 Extractor re-triggered for run %s: %s", runID, status)
+}
+
+// requestExtractorShutdown asks the extractor to stop run runID's extraction
+// after its current chunk; other runs' extractions carry on.
+func requestExtractorShutdown(runID string) {
+	u, err := url.Parse(extractorURL)
+	if err != nil {
+		log.Printf("❌ Cannot derive extractor shutdown URL: %v", err)
+		return
+	}
+	u.Path = "/shutdown"
+	u.RawQuery = url.Values{"run_id": {runID}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err == nil {
+		err = authorize(req, serviceConfig.Extractor.Audience)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to build extractor shutdown request: %v", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("❌ Failed to request extractor shutdown: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("❌ Extractor refused shutdown: %s", resp.Status)
+		return
+	}
+	log.Printf("🛑 Extractor shutdown requested for run %s: %s", runID, resp.Status)
+}
+
+// emitMetric writes a single-line JSON record to stdout; Cloud Logging parses it
+// as a structured entry so log-based metrics and alert policies can key on "metric".
+// It bypasses the standard logger, so it redacts the record itself.
+func emitMetric(name string, fields map[string]interface{}) {
+	entry := map[string]interface{}{
+		"severity": "WARNING",
+		"message":  name,
+		"metric":   name,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("❌ Failed to marshal metric %s: %v", name, err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(logging.Default().Bytes(line)))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"app/events"
+	"app/runs"
+	"app/summary"
+	"configure/openlineage"
+	"configure/problem"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// buildSummary assembles the current summary of a tracked run, listing the
+// configured object locations for its date.
+func buildSummary(ctx context.Context, runID string) (summary.Summary, bool) {
+	run, ok := registry.Get(runID)
+	if !ok {
+		return summary.Summary{}, false
+	}
+	objects := summary.ListObjects(ctx, serviceConfig.Summary.Objects, run.Date)
+	return summary.Build(run, objects, summary.Prices(serviceConfig.Costs)), true
+}
+
+// archiveSummary writes the run summary once the run has completed or failed
+// and returns it with where it was stored ("" when it could not be written).
+func archiveSummary(runID string) (summary.Summary, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	s, ok := buildSummary(ctx, runID)
+	if !ok {
+		return s, ""
+	}
+	log.Printf("💰 Run %s: %s", runID, s.Cost.Estimate)
+	location, err := summary.Write(ctx, serviceConfig.Summary.Bucket, s)
+	if err != nil {
+		log.Printf("❌ Failed to write run summary for %s: %v", runID, err)
+		return s, ""
+	}
+	log.Printf("🗂️ Run summary for %s written to %s", runID, location)
+	return s, location
+}
+
+// finishRun frees the run's queue slot, checks its chunk metrics for
+// anomalies, archives the run summary, exports its metrics and announces the
+// outcome to OpenLineage and to subscribers. Only
+// the first call after the run ends does so.
+func finishRun(runID string) {
+	if !registry.Finish(runID) {
+		log.Printf("ℹ️ Run %s already finished — not archiving it again", runID)
+		return
+	}
+	releaseRun(runID)
+	if run, ok := registry.Get(runID); ok && run.Params["burst"] == true {
+		// A burst invocation is a measurement, not a pipeline run to report on
+		return
+	}
+	// Before the summary is archived, so it carries any chunk_anomaly events
+	if run, ok := registry.Get(runID); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		detectChunkAnomalies(ctx, run)
+		cancel()
+	}
+	s, location := archiveSummary(runID)
+
+	run, ok := registry.Get(runID)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	lineage := openlineage.Run{Job: openlineage.PipelineJob, RunID: run.ID, Date: run.Date}
+	if run.Status == runs.StatusFailed {
+		openlineage.Emit(ctx, openlineage.Fail, lineage, errors.New(run.Error))
+	} else {
+		openlineage.Emit(ctx, openlineage.Complete, lineage, nil)
+	}
+	exportRunMetrics(ctx, run, s)
+	writeStageMetrics(ctx, run, s)
+
+	if !publisher.Enabled() {
+		return
+	}
+	eventType := events.TypeRunCompleted
+	if run.Status == runs.StatusFailed {
+		eventType = events.TypeRunFailed
+	}
+	publisher.Publish(ctx, publisher.New(eventType, run.ID, map[string]interface{}{
+		"run_id":             run.ID,
+		"date":               run.Date,
+		"status":             run.Status,
+		"error":              run.Error,
+		"error_category":     run.ErrorCategory,
+		"stages":             run.Topology.Names(),
+		"completed_stages":   run.Completed,
+		"started_at":         run.CreatedAt,
+		"finished_at":        run.UpdatedAt,
+		"duration_seconds":   run.UpdatedAt.Sub(run.CreatedAt).Seconds(),
+		"summary":            location,
+		"estimated_cost_usd": s.Cost.TotalUSD,
+	}))
+}
+
+// handleRunSummary returns the live summary of a run: GET /runs/{id}/summary
+func handleRunSummary(w http.ResponseWriter, r *http.Request) {
+	s, ok := buildSummary(r.Context(), r.PathValue("id"))
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -1,15 +1,29 @@
 package main
 
 import (
+	"app/alerts"
 	"app/configure"
-	"bytes"
+	"app/events"
+	"app/queue"
+	"app/routing"
+	"app/runs"
+	"app/sla"
+	"configure/audit"
+	"configure/errcategory"
+	"configure/eventschema"
+	"configure/logging"
+	"configure/monitoring"
+	"configure/problem"
+	"configure/tlsconfig"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,103 +33,378 @@ var cleanerURL string
 var loaderURL string
 var loaderParquetURL string
 
-// Place this at the top, after imports but before handleTrigger
-func forwardToService(url, label string, payload map[string]string) {
-	body, err := json.Marshal(payload)
+// Parsed service config and the stage topology derived from it
+var serviceConfig configure.ServiceURLs
+var defaultTopology routing.Topology
+
+var slaMonitor = sla.NewMonitor()
+var alerter *alerts.Notifier
+
+// Completion events for external subscribers (webhook and/or Eventarc channel)
+var publisher *events.Publisher
+
+// Admin and run operations are recorded here (AUDIT_BUCKET or logs/audit.jsonl)
+var auditLog = audit.NewLogger("trigger", audit.SinkFromEnv())
+
+// Runs started via /run, keyed by run ID; idempotency keys are honored for 24h
+// and ended runs are kept for RUN_RETENTION
+var registry = runs.NewRegistry(24*time.Hour, runRetention())
+
+// runRetention is how long the registry keeps a completed or failed run, which
+// /runs/{id} and /metrics read from memory until then. RUN_RETENTION
+// (a Go duration) defaults to a week.
+func runRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RUN_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+// stageRequest is the request that starts a stage after the extractor. A
+// self-test run's requests carry "selftest" so loaders write to scratch tables,
+// and a burst's carry "burst" so the cleaner writes to a scratch prefix.
+// "loader" names the run's loader, the Parquet one when it has both, so
+// features read the table that run loaded.
+func stageRequest(runID, date string) map[string]interface{} {
+	req := map[string]interface{}{"date": date, "run_id": runID}
+	topology := currentTopology()
+	if run, ok := registry.Get(runID); ok {
+		if run.Params["selftest"] == true {
+			req["selftest"] = true
+		}
+		if run.Params["burst"] == true {
+			req["burst"] = true
+		}
+		if len(run.Topology) > 0 {
+			topology = run.Topology
+		}
+	}
+	for _, loader := range []string{"loader_parquet", "loader_json"} {
+		if _, ok := topology.ByName(loader); ok {
+			req["loader"] = loader
+			break
+		}
+	}
+	return req
+}
+
+// forwardToService starts a stage, applying its timeout and retry policy. It
+// returns the error once the retries are used up, or straight away when they
+// don't apply (e.g. a timeout of a stage that isn't idempotent).
+func forwardToService(s routing.Stage, payload map[string]interface{}) error {
+	body, err := json.Marshal(eventschema.Stamp(payload))
 	if err != nil {
-		log.Printf("❌ Failed to marshal payload for %s: %v", label, err)
-		return
+		log.Printf("❌ Failed to marshal payload for %s: %v", s.Name, err)
+		return err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	status, respBody, err := postStage(s, body)
 	if err != nil {
-		log.Printf("❌ Failed to forward to %s (%s): %v", label, url, err)
+		log.Printf("❌ Failed to forward to %s (%s): %v", s.Name, s.URL, err)
+		return err
+	}
+	log.Printf("✅ Forwarded to %s | Status: %s | Response: %s", s.Name, status, string(respBody))
+	return nil
+}
+
+// startStage forwards a run's request to stage s. A stage that can't be
+// reached fails as one reporting <stage>_failed would, so the run doesn't
+// wait out the stage's SLA for an event that won't come.
+func startStage(runID, date string, s routing.Stage) {
+	err := forwardToService(s, stageRequest(runID, date))
+	if err == nil {
 		return
 	}
-	defer resp.Body.Close()
+	topology := currentTopology()
+	run, tracked := registry.Get(runID)
+	if tracked && len(run.Topology) > 0 {
+		topology = run.Topology
+	}
+	failStage(runID, date, tracked, topology, s.Name, fmt.Sprintf("could not start %s: %v", s.Name, err), errcategory.Of(err))
+}
 
-	respBody, _ := io.ReadAll(resp.Body)
-	log.Printf("✅ Forwarded to %s | Status: %s | Response: %s", label, resp.Status, string(respBody))
+// failStage fails a run at stage: the stage's failure retries re-send it if
+// its policy allows, and otherwise the run is failed and finished and an
+// alert sent. It reports whether a retry was scheduled.
+func failStage(runID, date string, tracked bool, topology routing.Topology, stageName, msg string, category errcategory.Category) (retrying bool) {
+	if tracked {
+		slaMonitor.Done(runID, stageName)
+		if s, ok := topology.ByName(stageName); ok {
+			retrying = retryFailedStage(runID, date, s, category)
+		}
+		if !retrying {
+			registry.Fail(runID, errcategory.Errorf(category, "stage %s failed: %s", stageName, msg))
+			go finishRun(runID)
+		}
+	}
+	go monitoring.Count(context.Background(), "stage_failures", map[string]string{"stage": stageName, "error_category": string(category)})
+	emitMetric("stage_failed", map[string]interface{}{
+		"run_id":         runID,
+		"date":           date,
+		"stage":          stageName,
+		"error_category": category,
+		"retrying":       retrying,
+	})
+	if !retrying {
+		alerter.Send(alerts.Alert{
+			Kind:     "stage_failed",
+			RunID:    runID,
+			Date:     date,
+			Stage:    stageName,
+			Message:  msg,
+			Category: string(category),
+		})
+	}
+	return retrying
 }
 
 func handleRun(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
 		return
 	}
 
 	var payload struct {
-		Date         string  `json:"date"`
-		MaxOffset    int     `json:"max_offset"`
-		APIErrorProb float64 `json:"api_error_prob"`
-		GCSErrorProb float64 `json:"gcs_error_prob"`
-		RowDropProb  float64 `json:"row_drop_prob"`
-		DelayProb    float64 `json:"delay_prob"`
+		Date      string `json:"date"`
+		MaxOffset int    `json:"max_offset"`
+		// Optional fault probabilities; unset ones take the extractor's FAULT_* defaults
+		APIErrorProb *float64 `json:"api_error_prob"`
+		GCSErrorProb *float64 `json:"gcs_error_prob"`
+		RowDropProb  *float64 `json:"row_drop_prob"`
+		DelayProb    *float64 `json:"delay_prob"`
+		// Optional; the Idempotency-Key header takes precedence
+		IdempotencyKey string `json:"idempotency_key"`
+		// Optional per-run override of the enabled stages, in order
+		Stages []string `json:"stages"`
+		// "snapshot" extracts the full dataset into snapshots/{date}/ and stops
+		// there; "sample" extracts every sample_every-th inspection (default 20)
+		// into samples/{date}/ and stops there too
+		Mode        string `json:"mode"`
+		SampleEvery int    `json:"sample_every"`
+		// Queued runs start highest priority first (e.g. the daily run above backfills)
+		Priority int `json:"priority"`
+		// Optional time box per extractor window; the run continues in new windows until done
+		MaxMinutes int `json:"max_minutes"`
+		// Optional cap on the extractor's GCS uploads in KiB/s, over its GCS_UPLOAD_KBPS
+		UploadKBps int `json:"upload_kbps"`
+		// Experimental: stream the chunks to the cleaner as they're fetched, see pipe.go
+		Pipe bool `json:"pipe"`
+		// Optional preset (demo, dev, production or one from profiles) filling
+		// in the parameters above that are left out
+		Profile string `json:"profile"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		log.Println("❌ Failed to decode /run payload:", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+
+	if payload.Date == "" {
+		payload.Date = time.Now().Format("2006-01-02")
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = payload.IdempotencyKey
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	var profile map[string]interface{}
+	if payload.Profile != "" {
+		preset, ok := serviceConfig.Profile(payload.Profile)
+		if !ok {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest,
+				fmt.Sprintf("Unknown profile %q; one of %s", payload.Profile, strings.Join(serviceConfig.ProfileNames(), ", ")))
+			return
+		}
+		resolved, err := preset.Resolve(configure.Profile{
+			MaxOffset:    payload.MaxOffset,
+			APIErrorProb: payload.APIErrorProb,
+			GCSErrorProb: payload.GCSErrorProb,
+			RowDropProb:  payload.RowDropProb,
+			DelayProb:    payload.DelayProb,
+			Stages:       payload.Stages,
+			MaxMinutes:   payload.MaxMinutes,
+		}, force)
+		if err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, fmt.Sprintf("Profile %s: %v", payload.Profile, err))
+			return
+		}
+		payload.MaxOffset, payload.Stages, payload.MaxMinutes = resolved.MaxOffset, resolved.Stages, resolved.MaxMinutes
+		payload.APIErrorProb, payload.GCSErrorProb = resolved.APIErrorProb, resolved.GCSErrorProb
+		payload.RowDropProb, payload.DelayProb = resolved.RowDropProb, resolved.DelayProb
+		profile = map[string]interface{}{"name": payload.Profile, "settings": resolved}
+		log.Printf("🎛️ Profile %s: max_offset=%d api=%s gcs=%s drop=%s delay=%s strict=%t", payload.Profile, payload.MaxOffset,
+			probString(payload.APIErrorProb), probString(payload.GCSErrorProb), probString(payload.RowDropProb), probString(payload.DelayProb), resolved.Strict)
+	}
+
+	topology := currentTopology()
+	if payload.Mode == "snapshot" || payload.Mode == "sample" {
+		// Snapshots are raw archives, and samples aren't a date's data;
+		// nothing downstream consumes either
+		payload.Stages = []string{"extractor"}
+	}
+	if len(payload.Stages) > 0 {
+		t, err := routing.Build(routingConfig(), payload.Stages)
+		if err != nil {
+			log.Printf("❌ Invalid stage override %v: %v", payload.Stages, err)
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Invalid stages: "+err.Error())
+			return
+		}
+		topology = t
+	}
+	var pipe map[string]interface{}
+	if payload.Pipe {
+		target, err := pipeTarget(topology)
+		if err == nil && (payload.Mode == "snapshot" || payload.Mode == "sample") {
+			err = fmt.Errorf("%ss aren't cleaned", payload.Mode)
+		}
+		if err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.InvalidRequest, "Cannot pipe: "+err.Error())
+			return
+		}
+		pipe = target
+	}
+
+	run, created := registry.Start(payload.Date, key, topology)
+	if !created {
+		log.Printf("♻️ Idempotency key %q already used by run %s (%s) — not starting a new pipeline", key, run.ID, run.Status)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"run_id":    run.ID,
+			"status":    run.Status,
+			"topology":  run.Topology,
+			"duplicate": true,
+		})
+		return
+	}
+
+	// ?force=true starts the run even if a downstream stage is not ready
+	if err := gateRun(run, force); err != nil {
+		log.Printf("⛔ Not starting run %s: %v", run.ID, err)
+		registry.Fail(run.ID, err)
+		p := problem.New(r, http.StatusServiceUnavailable, problem.NotReady, err.Error())
+		p.Extensions = map[string]interface{}{"run_id": run.ID, "status": runs.StatusFailed}
+		problem.Send(w, p)
 		return
 	}
 
-	log.Printf("🧪 Raw struct payload: %+v", payload)
-	log.Printf("🧪 Received payload: api=%v gcs=%v drop=%v delay=%v",
-		payload.APIErrorProb, payload.GCSErrorProb, payload.RowDropProb, payload.DelayProb)
+	logging.Debugf("🧪 Raw struct payload: %+v", payload)
+	logging.Debugf("🧪 Received payload: api=%s gcs=%s drop=%s delay=%s",
+		probString(payload.APIErrorProb), probString(payload.GCSErrorProb), probString(payload.RowDropProb), probString(payload.DelayProb))
 	log.Printf("🚀 HOWDY!")
 	log.Printf("🚀 Pipeline run ONE started for date=%s with max_offset=%d", payload.Date, payload.MaxOffset)
-	log.Printf("🚀 Pipeline run TWO started for date=%s with max_offset=%d with api=%v", payload.Date, payload.MaxOffset, payload.APIErrorProb)
-	log.Printf("🧪 Raw struct payload: %+v", payload)
-	log.Printf("🧪 Received payload: api=%v gcs=%v drop=%v delay=%v",
-		payload.APIErrorProb, payload.GCSErrorProb, payload.RowDropProb, payload.DelayProb)
+	log.Printf("🚀 Pipeline run TWO started for date=%s with max_offset=%d with api=%s", payload.Date, payload.MaxOffset, probString(payload.APIErrorProb))
+	logging.Debugf("🧪 Raw struct payload: %+v", payload)
+	logging.Debugf("🧪 Received payload: api=%s gcs=%s drop=%s delay=%s",
+		probString(payload.APIErrorProb), probString(payload.GCSErrorProb), probString(payload.RowDropProb), probString(payload.DelayProb))
 
-	data := map[string]interface{}{
+	data := eventschema.Stamp(map[string]interface{}{
+		"run_id":         run.ID,
 		"date":           payload.Date,
 		"max_offset":     payload.MaxOffset,
 		"api_error_prob": payload.APIErrorProb,
 		"gcs_error_prob": payload.GCSErrorProb,
 		"row_drop_prob":  payload.RowDropProb,
 		"delay_prob":     payload.DelayProb,
+		"mode":           payload.Mode,
+		"sample_every":   payload.SampleEvery,
+		"max_minutes":    payload.MaxMinutes,
+		"upload_kbps":    payload.UploadKBps,
+	})
+	if profile != nil {
+		data["profile"] = profile
+	}
+	if pipe != nil {
+		data["pipe"] = pipe
 	}
 
-	body, err := json.Marshal(data)
-	if err != nil {
-		log.Println("❌ Failed to marshal extractor payload:", err)
-		http.Error(w, "Failed to prepare extractor request", http.StatusInternalServerError)
+	registry.SetParams(run.ID, data)
+
+	if admitted, position := runQueue.Submit(run.ID, payload.Priority); !admitted {
+		registry.Queue(run.ID, payload.Priority)
+		running, waiting := runQueue.Stats()
+		log.Printf("⏳ Run %s queued at position %d (priority %d; %d running, %d waiting)", run.ID, position, payload.Priority, running, waiting)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"run_id":         run.ID,
+			"status":         runs.StatusQueued,
+			"priority":       payload.Priority,
+			"queue_position": position,
+			"topology":       run.Topology,
+			"message":        "⏳ Pipeline queued",
+		})
 		return
 	}
 
-	resp, err := http.Post(extractorURL, "application/json", bytes.NewBuffer(body))
-	if err != nil {
+	// launchRun fails the run on a transport error or a non-2xx response alike
+	if err := launchRun(run.ID); err != nil {
 		log.Printf("❌ Failed to trigger extractor: %v", err)
-		http.Error(w, "Failed to start extractor", http.StatusBadGateway)
+		p := problem.New(r, http.StatusBadGateway, problem.Upstream, "Failed to start extractor: "+err.Error())
+		p.Extensions = map[string]interface{}{"run_id": run.ID, "status": runs.StatusFailed}
+		problem.Send(w, p)
 		return
 	}
-	defer resp.Body.Close()
 
-	log.Printf("📤 Extractor triggered: %s", resp.Status)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("✅ Pipeline started"))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"run_id":   run.ID,
+		"status":   run.Status,
+		"topology": run.Topology,
+		"message":  "✅ Pipeline started",
+	})
 }
 
-var completed = make(map[string]map[string]bool)
+// handleRunStatus returns the tracked state of a single run: GET /runs/{id}
+func handleRunStatus(w http.ResponseWriter, r *http.Request) {
+	run, ok := registry.Get(r.PathValue("id"))
+	if !ok {
+		problem.Write(w, r, http.StatusNotFound, problem.NotFound, "Run not found")
+		return
+	}
+	run.QueuePosition = runQueue.Position(run.ID)
+	writeJSON(w, http.StatusOK, run)
+}
+
+// probString formats an optional fault probability for logs.
+func probString(p *float64) string {
+	if p == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%.3f", *p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("❌ Failed to encode JSON response:", err)
+	}
+}
 
 func handleTrigger(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
 		return
 	}
 
 	var raw map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
 		log.Println("❌ Failed to decode JSON:", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid JSON")
+		return
+	}
+	raw, err := unwrapPush(raw)
+	if err != nil {
+		log.Println("❌ Failed to decode pushed event:", err)
+		problem.Write(w, r, http.StatusBadRequest, problem.InvalidJSON, "Invalid Pub/Sub message: "+err.Error())
+		return
+	}
+	if !upgradeEvent(w, r, raw) {
 		return
 	}
 
 	// Safely extract values as strings
 	get := func(key string) string {
-		if val, ok := raw[key]; ok {
+		if val, ok := raw[key]; ok && val != nil {
 			return fmt.Sprintf("%v", val)
 		}
 		return ""
@@ -125,80 +414,203 @@ func handleTrigger(w http.ResponseWriter, r *http.Request) {
 	origin := get("origin")
 	date := get("date")
 	duration := get("duration")
+	runID := get("run_id")
 
-	log.Printf("📥 Event received: %s from %s | date: %s", event, origin, date)
+	log.Printf("📥 Event received: %s from %s | date: %s | run: %s", event, origin, date, runID)
 
-	// Track and skip duplicates
-	if _, ok := completed[date]; !ok {
-		completed[date] = make(map[string]bool)
+	// Attribute the event to its run (older services only send the date)
+	if runID == "" {
+		if run, ok := registry.LatestForDate(date); ok {
+			runID = run.ID
+		}
 	}
-	if completed[date][event] {
-		log.Printf("⚠️ Duplicate event %s for date %s — ignoring", event, date)
+
+	// Progress reports share one event name, so they bypass deduplication
+	if event == progressEvent {
+		recordProgress(runID, raw)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Progress recorded"))
+		return
+	}
+
+	// Skip duplicates; each run tracks its own events, so runs of the same or
+	// different dates (a backfill next to the daily run) don't interfere.
+	// Events from runs the registry doesn't know (started outside /run) are
+	// deduplicated per date instead.
+	var first bool
+	if _, tracked := registry.Get(runID); tracked {
+		first = registry.FirstEvent(runID, event)
+	} else {
+		first = registry.FirstUntracked(date, event)
+	}
+	if !first {
+		log.Printf("⚠️ Duplicate event %s for run %s (date %s) — ignoring", event, runID, date)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Duplicate event ignored"))
 		return
 	}
-	completed[date][event] = true
-
-	// Duration logging
-	if duration != "" {
-		filename := "logs/duration_" + origin + ".log"
-		if f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
-			log.Println("❌ Failed to open duration log:", err)
-		} else {
-			logLine := fmt.Sprintf("%s,%s,%s\n", date, event, duration)
-			if _, err := f.WriteString(logLine); err != nil {
-				log.Println("❌ Failed to write duration:", err)
-			} else {
-				log.Printf("🕒 Logged duration %ss to %s", duration, filename)
-			}
-			f.Close()
-		}
+
+	// Routing follows the run's topology: each stage's completion event starts
+	// every enabled stage downstream of it, so both loaders fan out from the
+	// cleaner concurrently. Which stages run (e.g. skipping loader-json so the ML
+	// pipeline's CleanedInspectionRow stays untouched) is set in the service config
+	// or per run via /run "stages". The run completes once all its stages report in.
+	topology := currentTopology()
+	run, tracked := registry.Get(runID)
+	if tracked && len(run.Topology) > 0 {
+		topology = run.Topology
+	}
+	if tracked {
+		registry.RecordEvent(runID, runs.Event{Name: event, Origin: origin, Fields: raw})
+	} else if duration != "" || get("status") == "failed" {
+		// Tracked runs write their stages' metrics when they finish
+		go writeEventStageMetric(context.Background(), runID, date, event, origin, raw)
 	}
 
-	// === Modified Routing Logic ===
-	// This version skips the loader-JSON step to avoid writing to CleanedInspectionRow.
-	// Only the loader-parquet step is triggered after the cleaner completes.
-	// This ensures the ML pipeline (which depends on CleanedInspectionRow) remains unaffected
-	// while allowing the demo pipeline to populate CleanedInspectionColumn for monitoring.
+	if tracked && run.Status == runs.StatusFailed {
+		log.Printf("⛔ Run %s already failed (%s) — not routing %s", runID, run.Error, event)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Run already failed; event ignored"))
+		return
+	}
 
-	// Routing logic
-	switch event {
-	case "extractor_completed":
-		log.Println("📤 Forwarding to cleaner...")
-		forwardToService(cleanerURL, "Cleaner", map[string]string{"date": date})
+	// A stage that gives up reports status "failed"; fail the run instead of waiting on its SLA
+	if get("status") == "failed" {
+		msg := get("error")
+		if msg == "" {
+			msg = event
+		}
+		// Services report the category; classify the message for those that don't
+		category := errcategory.Parse(get("error_category"))
+		if get("error_category") == "" {
+			category = errcategory.Classify(msg)
+		}
+		// The event names the stage; origins don't always match stage names
+		stageName := origin
+		if strings.HasSuffix(event, "_failed") {
+			stageName = strings.TrimSuffix(event, "_failed")
+		}
+		if failStage(runID, date, tracked, topology, stageName, msg, category) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Stage failure recorded; retry scheduled"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Stage failure recorded"))
+		return
+	}
 
-	case "cleaner_completed":
-		log.Println("📤 Forwarding to loader-parquet (skipping loader-json)...")
-		forwardToService(loaderParquetURL, "Loader-Parquet", map[string]string{"date": date})
+	// A time-boxed extractor window ran out; start the next one instead of routing
+	if event == pausedEvent && tracked {
+		continueRun(run, raw)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Continuation scheduled"))
+		return
+	}
 
-	case "loader_parquet_completed":
-		log.Println("✅ Pipeline completed successfully for date:", date)
+	reportDataLoss(runID, date, origin, raw)
+	checkTruncation(runID, date, origin, raw)
+
+	// Status "alert" flags a finished stage that found something worth a look (e.g. data drift)
+	if get("status") == "alert" {
+		alerter.Send(alerts.Alert{
+			Kind:    origin + "_alert",
+			RunID:   runID,
+			Date:    date,
+			Stage:   origin,
+			Message: get("message"),
+		})
 	}
 
-	// Routing logic
-	// switch event {
-	// case "extractor_completed":
-	// 	log.Println("📤 Forwarding to cleaner...")
-	// 	forwardToService(cleanerURL, "Cleaner", map[string]string{"date": date})
+	next, ok := topology.Next(event)
+	if !ok {
+		if tracked {
+			registry.Update(runID, event)
+		}
+		log.Printf("ℹ️ Event %s does not complete a stage in topology %v — nothing to route", event, topology.Names())
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("✅ Trigger handled successfully"))
+		return
+	}
 
-	// case "cleaner_completed":
-	// 	log.Println("📤 Forwarding to loader-json...")
-	// 	forwardToService(loaderURL, "Loader-JSON", map[string]string{"date": date})
+	stage, _ := topology.Stage(event)
+	// The stages after the extractor only start once its manifest checks out
+	if stage.Name == "extractor" && len(next) > 0 {
+		if err := verifyExtraction(raw); err != nil {
+			if tracked {
+				slaMonitor.Done(runID, stage.Name)
+			}
+			failVerification(runID, date, tracked, err)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Extraction failed verification; downstream stages not started"))
+			return
+		}
+	}
+	pipelineDone := len(next) == 0
+	if tracked {
+		slaMonitor.Done(runID, stage.Name)
+		pipelineDone = registry.CompleteStage(runID, stage.Name, event)
+	}
 
-	// case "loader_json_completed":
-	// 	log.Println("📤 Forwarding to loader-parquet...")
-	// 	forwardToService(loaderParquetURL, "Loader-Parquet", map[string]string{"date": date})
+	if pipelineDone {
+		log.Println("✅ Pipeline completed successfully for date:", date)
+		if tracked {
+			go finishRun(runID)
+		}
+	} else if len(next) == 0 {
+		log.Printf("⏳ Stage %s done for date %s — waiting on remaining stages", stage.Name, date)
+	}
 
-	// case "loader_parquet_completed":
-	// 	log.Println("✅ Pipeline completed successfully for date:", date)
-	// }
+	var wg sync.WaitGroup
+	for _, s := range next {
+		wg.Add(1)
+		go func(s routing.Stage) {
+			defer wg.Done()
+			if s.Notified() {
+				// The stage may have finished before this event arrived, as
+				// the cleaner's manifest notification races its completion event
+				if tracked && !registry.StageCompleted(runID, s.Name) {
+					watchStage(runID, date, s, 0)
+				}
+				log.Printf("📭 %s starts from the GCS notification of the %s manifest", s.Name, stage.Name)
+				return
+			}
+			if pipedStage(s, raw) {
+				// Its completion usually arrives first, as the cleaner
+				// finishes when the extractor's stream ends
+				if tracked && !registry.StageCompleted(runID, s.Name) {
+					watchStage(runID, date, s, 0)
+				}
+				log.Printf("🚿 %s cleaned the chunks %s piped to it", s.Name, stage.Name)
+				return
+			}
+			if s.Approval {
+				if !tracked {
+					log.Printf("⛔ %s needs approval, which only runs started with /run can wait for — not starting it", s.Name)
+					return
+				}
+				holdForApproval(runID, date, s)
+				return
+			}
+			if tracked {
+				watchStage(runID, date, s, 0)
+			}
+			log.Printf("📤 Forwarding to %s...", s.Name)
+			startStage(runID, date, s)
+		}(s)
+	}
+	wg.Wait()
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("✅ Trigger handled successfully"))
 }
 
 func main() {
+	logging.Setup()
+	if err := tlsconfig.Setup(); err != nil {
+		log.Fatalf("❌ Invalid TLS client config: %v", err)
+	}
+
 	// Ensure log directory exists
 	_ = os.MkdirAll("logs", 0755)
 
@@ -224,24 +636,68 @@ func main() {
 	loaderURL = cfg.Loader.URL
 	loaderParquetURL = cfg.LoaderParquet.URL
 
-	log.Printf("🚀 Trigger service running on :8080")
+	serviceConfig = cfg
+	// BigQuery loads fail across locations, so don't wait for the first one
+	if conflicts := cfg.LocationConflicts(); len(conflicts) > 0 {
+		log.Fatalf("❌ Bootstrap locations don't match: %s", strings.Join(conflicts, "; "))
+	}
+	runQueue = queue.New(cfg.Queue.MaxConcurrent)
+	go evictStaleRuns(cfg.MaxRunDuration())
+	defaultTopology, err = routing.Build(&cfg, cfg.EnabledStages())
+	if err != nil {
+		log.Fatalf("❌ Invalid pipeline topology: %v", err)
+	}
+
+	addr := tlsconfig.ListenAddr()
+	log.Printf("🚀 Trigger service running on %s", addr)
 	log.Printf("🔗 Extractor:       %s", extractorURL)
 	log.Printf("🔗 Cleaner:         %s", cleanerURL)
 	log.Printf("🔗 Loader-JSON:     %s", loaderURL)
 	log.Printf("🔗 Loader-Parquet:  %s", loaderParquetURL)
-
-	http.HandleFunc("/run", handleRun)
+	log.Printf("🔗 Features:        %s", cfg.Features.URL)
+	log.Printf("🧭 Topology:        %v", defaultTopology.Names())
+	log.Printf("🚦 Max concurrent:  %d", max(cfg.Queue.MaxConcurrent, 1))
+
+	alerter = alerts.NewNotifier(cfg.Alerts.WebhookURL)
+	publisher = events.NewPublisher(cfg.Events)
+	runStartupCheck(&cfg)
+	migrateMonitoringTables()
+	watchResourceDrift()
+
+	http.HandleFunc("/run", auditLog.Wrap("run", handleRun))
+	http.HandleFunc("GET /runs/{id}", handleRunStatus)
+	http.HandleFunc("GET /runs/{id}/summary", handleRunSummary)
+	http.HandleFunc("GET /runs/{id}/fault-report", handleFaultReport)
+	http.HandleFunc("POST /runs/{id}/retry", auditLog.Wrap("retry", handleRunRetry))
+	http.HandleFunc("POST /runs/{id}/approve", auditLog.Wrap("approve", logging.RequireAdmin(handleRunApprove)))
+	http.HandleFunc("POST /runs/{id}/reject", auditLog.Wrap("reject", logging.RequireAdmin(handleRunReject)))
+	http.HandleFunc("POST /runs/{id}/share", auditLog.Wrap("share", logging.RequireAdmin(handleRunShare)))
+	http.HandleFunc("POST /runs/{id}/purge", auditLog.Wrap("run_purge", logging.RequireAdmin(handleRunPurge)))
+	http.HandleFunc("POST /runs/{id}/rollback", auditLog.Wrap("run_rollback", logging.RequireAdmin(handleRunRollback)))
+	http.HandleFunc("POST /share", auditLog.Wrap("share", logging.RequireAdmin(handleShare)))
+	http.HandleFunc("GET /metrics/series", handleMetricsSeries)
+	http.HandleFunc("GET /metrics/durations", handleMetricsDurations)
+	http.HandleFunc("/selftest", auditLog.Wrap("selftest", logging.RequireAdmin(handleSelftest)))
+	http.HandleFunc("/burst", auditLog.Wrap("burst", logging.RequireAdmin(handleBurst)))
+	burstJobs.Register(http.DefaultServeMux)
 	http.HandleFunc("/clean", handleTrigger)
-	http.HandleFunc("/purge", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/audit", auditLog.Handler())
+	http.HandleFunc("POST /admin/bootstrap", auditLog.Wrap("bootstrap", logging.RequireAdmin(handleBootstrap)))
+	http.HandleFunc("GET /admin/routes", handleRoutes)
+	http.HandleFunc("PUT /admin/routes", auditLog.Wrap("routes_update", logging.RequireAdmin(handleRoutesUpdate)))
+	http.HandleFunc("GET /resources/drift", handleResourceDrift)
+	http.HandleFunc("GET /readyz", handleReadyz)
+	http.HandleFunc("/admin/loglevel", auditLog.Wrap("loglevel", logging.AdminHandler()))
+	http.HandleFunc("/purge", auditLog.Wrap("purge", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+			problem.Write(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "Only POST allowed")
 			return
 		}
-		completed = make(map[string]map[string]bool)
+		registry.ForgetEvents()
 		log.Println("🧹 Cleared completed event cache")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("✅ Cache cleared"))
-	})
+	}))
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -249,7 +705,7 @@ func main() {
 		fmt.Fprintf(w, `{"status":"ok", "time":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(tlsconfig.ListenAndServe(addr, nil))
 }
 
 // func main() {
@@ -1,27 +1,510 @@
 package configure
 
 import (
+	"app/events"
+	"configure/gcp"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 )
 
 type ServiceURLs struct {
-	Extractor struct {
-		URL string `json:"url"`
-	} `json:"extractor"`
-	Cleaner struct {
-		URL string `json:"url"`
-	} `json:"cleaner"`
-	Trigger struct {
-		URL string `json:"url"`
-	} `json:"trigger"`
-	Loader struct {
-		URL string `json:"url"`
-	} `json:"loader"`
-	LoaderParquet struct {
-		URL string `json:"loader_parquet"`
-	} `json:"loader_parquet"`
+	Extractor     ServiceEndpoint `json:"extractor"`
+	Cleaner       ServiceEndpoint `json:"cleaner"`
+	Trigger       ServiceEndpoint `json:"trigger"`
+	Loader        ServiceEndpoint `json:"loader"`
+	LoaderParquet ServiceEndpoint `json:"loader_parquet"`
+	Features      ServiceEndpoint `json:"features"`
+	Prediction    ServiceEndpoint `json:"prediction"`
+	Drift         ServiceEndpoint `json:"drift"`
+	Export        ServiceEndpoint `json:"export"`
+	Alerts        struct {
+		// Optional Slack/Chat-compatible webhook; alerts are always logged
+		WebhookURL string `json:"webhook_url"`
+	} `json:"alerts"`
+	// Run completion/failure CloudEvents for external subscribers
+	Events  events.Config `json:"events"`
+	Summary struct {
+		// Bucket for runs/{date}/{run_id}/summary.json; without one summaries go under logs/
+		Bucket string `json:"bucket"`
+		// Objects are "bucket/prefix" locations inventoried in each summary; {date} is the run date
+		Objects []string `json:"objects"`
+	} `json:"summary"`
+	// Time-limited signed URLs /share and /runs/{id}/share hand out for run
+	// artifacts: manifests, exports and run summaries
+	Share struct {
+		// Buckets whose artifacts may be shared; defaults to bootstrap.buckets,
+		// summary.bucket and the buckets of summary.objects
+		Buckets []string `json:"buckets"`
+		// MaxTTL caps how long a URL stays valid, e.g. "24h" (the default); at most 168h
+		MaxTTL string `json:"max_ttl"`
+		// Signer is the service account that signs the URLs; defaults to the
+		// trigger's own, which then needs roles/iam.serviceAccountTokenCreator on itself
+		Signer string `json:"signer"`
+	} `json:"share"`
+	// What POST /runs/{id}/purge deletes besides the run's objects under
+	// summary.objects
+	Purge struct {
+		// Tables maps "dataset.table" in bootstrap.project to the column
+		// holding the run ID; defaults to DefaultPurgeTables
+		Tables map[string]string `json:"tables"`
+	} `json:"purge"`
+	// How a finished run's chunk_metrics are checked against the runs before it
+	Anomalies AnomalyConfig `json:"anomalies"`
+	// Unit prices in USD for the run cost estimate, overriding the defaults
+	// (gcs_storage_per_gb_month, bq_query_per_tb, bq_load_per_gb,
+	// bq_streaming_per_gb, bq_storage_per_gb_month, api_call)
+	Costs map[string]float64 `json:"costs"`
+	// Runs beyond max_concurrent (default 1, as the extractor runs a single
+	// instance) wait in a priority queue. A run still holding its slot after
+	// max_run_duration (e.g. "12h", default DefaultMaxRunDuration) is failed
+	// and its slot freed, in case a stage never reports back.
+	Queue struct {
+		MaxConcurrent  int    `json:"max_concurrent"`
+		MaxRunDuration string `json:"max_run_duration,omitempty"`
+	} `json:"queue"`
+	// Resources /admin/bootstrap provisions in Project: buckets, and datasets
+	// created in Location (default "US") along with the monitoring tables.
+	// The resource drift check compares the live ones against the same spec.
+	Bootstrap struct {
+		Project string `json:"project"`
+		// Location of the datasets, where the trigger also runs its queries,
+		// and of every bucket not in BucketLocations
+		Location string   `json:"location"`
+		Buckets  []string `json:"buckets"`
+		Datasets []string `json:"datasets"`
+		// BucketLocations places buckets elsewhere, e.g. a raw bucket in a
+		// region of the datasets' multi-region
+		BucketLocations map[string]string `json:"bucket_locations,omitempty"`
+		// Lifecycle maps a bucket to the age in days at which its objects are deleted
+		Lifecycle map[string]int `json:"lifecycle,omitempty"`
+	} `json:"bootstrap"`
+	Pipeline struct {
+		// Ordered stage list; stages with enabled=false are skipped by the router
+		Stages []StageConfig `json:"stages"`
+	} `json:"pipeline"`
+	// Named presets of /run parameters, picked with {"profile": name}; they
+	// add to DefaultProfiles and replace the ones of the same name
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Call policy defaults for endpoints that don't set their own. The loaders
+// run inside the request, so the timeout has to cover a whole load; the
+// extractor, cleaner and features accept the work and answer straight away.
+const (
+	DefaultTimeout = 15 * time.Minute
+	DefaultBackoff = 2 * time.Second
+	// An approval gate left unanswered this long fails its run
+	DefaultApprovalTimeout = 24 * time.Hour
+	MaxBackoff             = time.Minute
+	// Longer than a run waits at a default approval gate plus its stages
+	DefaultMaxRunDuration = 36 * time.Hour
+)
+
+// ServiceEndpoint is where a service is reached and how the trigger calls it.
+type ServiceEndpoint struct {
+	URL string `json:"url"`
+	// Timeout bounds each attempt, e.g. "10m"; defaults to DefaultTimeout
+	Timeout string `json:"timeout,omitempty"`
+	// Retries are extra attempts after a network error, 429 or 5xx response,
+	// and after a timeout if the endpoint is Idempotent
+	Retries int `json:"retries,omitempty"`
+	// Idempotent services do the work once however often a call is repeated.
+	// A call that timed out may still have started the work, so only these
+	// are called again after a timeout.
+	Idempotent bool `json:"idempotent,omitempty"`
+	// Backoff is the wait before the first retry, doubled for each one after; defaults to DefaultBackoff
+	Backoff string `json:"backoff,omitempty"`
+	// Health is the path pinged by the startup check; defaults to "/health"
+	Health string `json:"health,omitempty"`
+	// Ready is the path probed before a run that uses the service starts,
+	// e.g. "/readyz"; defaults to Health
+	Ready string `json:"ready,omitempty"`
+	// Audience, when set, is the expected audience of the OIDC identity token
+	// attached to every call (the receiving Cloud Run service's URL)
+	Audience string `json:"audience,omitempty"`
+	// Optional services may be unreachable without failing the startup check
+	Optional bool `json:"optional,omitempty"`
+}
+
+// HealthURL is the service's health endpoint: Health on the host of URL.
+func (e ServiceEndpoint) HealthURL() (string, error) {
+	path := e.Health
+	if path == "" {
+		path = "/health"
+	}
+	return e.hostURL("health", path)
+}
+
+// ReadyURL is the service's readiness endpoint: Ready on the host of URL,
+// or the health endpoint when no Ready path is set.
+func (e ServiceEndpoint) ReadyURL() (string, error) {
+	if e.Ready == "" {
+		return e.HealthURL()
+	}
+	return e.hostURL("ready", e.Ready)
+}
+
+func (e ServiceEndpoint) hostURL(kind, path string) (string, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("url %q is not absolute", e.URL)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("%s path %q must start with /", kind, path)
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: path}).String(), nil
+}
+
+type StageConfig struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Upstream stage whose completion starts this one; defaults to the previous enabled stage.
+	// Stages sharing an upstream run in parallel.
+	After string `json:"after,omitempty"`
+	// SLA is the longest the stage may take before it is flagged, e.g. "30m"; empty disables it
+	SLA string `json:"sla,omitempty"`
+	// OnSLAViolation is "alert" (default), "retry" (re-send the stage request) or "cancel" (fail the run)
+	OnSLAViolation string `json:"on_sla_violation,omitempty"`
+	// SLARetries caps "retry" attempts; defaults to 1
+	SLARetries int `json:"sla_retries,omitempty"`
+	// OnFailure is "fail" (default) or "retry" (re-send the stage request when it
+	// reports a failure whose error category is retryable)
+	OnFailure string `json:"on_failure,omitempty"`
+	// FailureRetries caps "retry" attempts; defaults to 1
+	FailureRetries int `json:"failure_retries,omitempty"`
+	// StartedBy is "trigger" (default: the trigger calls the stage) or
+	// "gcs_notification" for a loader started by the Pub/Sub notification of
+	// the cleaner's manifest; the trigger then only watches for its events
+	StartedBy string `json:"started_by,omitempty"`
+	// Approval holds the stage, once its upstream completes, until someone
+	// approves it with POST /runs/{id}/approve (e.g. a look at the data quality
+	// checks before a load into production tables)
+	Approval bool `json:"approval,omitempty"`
+	// ApprovalTimeout is how long an approval may wait before the run fails,
+	// e.g. "4h"; defaults to DefaultApprovalTimeout
+	ApprovalTimeout string `json:"approval_timeout,omitempty"`
+}
+
+// DefaultStages mirrors the demo topology: loader-json is skipped so the ML
+// pipeline's CleanedInspectionRow table is left untouched. Both loaders only
+// need the cleaner's output, so when enabled they fan out from it together.
+// Features runs after the parquet load and reads its CleanedInspectionColumn,
+// or CleanedInspectionRow in a run that only has loader-json.
+// Prediction and drift stay off until a model endpoint and a training baseline
+// are configured for the features service, and the CSV export until it has an
+// EXPORT_BUCKET. Export follows prediction, or the stage before it when
+// prediction is off. A stage whose service has no URL configured is left
+// off, see StageConfigs.
+var DefaultStages = []StageConfig{
+	{Name: "extractor", Enabled: true},
+	{Name: "cleaner", Enabled: true, After: "extractor"},
+	{Name: "loader_json", Enabled: false, After: "cleaner"},
+	{Name: "loader_parquet", Enabled: true, After: "cleaner"},
+	{Name: "features", Enabled: true, After: "loader_parquet"},
+	{Name: "prediction", Enabled: false, After: "features"},
+	{Name: "drift", Enabled: false, After: "features"},
+	{Name: "export", Enabled: false, After: "prediction"},
+}
+
+// DefaultPurgeTables are the tables a run writes rows to, with the column
+// that records which run wrote each row. The loaders stamp load_run_id when
+// they promote a run's staging table; rows loaded before that have none and
+// can't be purged by run.
+var DefaultPurgeTables = map[string]string{
+	"HygienePredictionRow.CleanedInspectionRow":       "load_run_id",
+	"HygienePredictionColumn.CleanedInspectionColumn": "load_run_id",
+	"HygienePredictionColumn.Violations":              "load_run_id",
+	"HygienePredictionRow.Features":                   "run_id",
+	"HygienePredictionRow.Predictions":                "run_id",
+	"HygienePredictionRow.DriftScores":                "run_id",
+	"PipelineMonitoring.chunk_metrics":                "run_id",
+	"PipelineMonitoring.stage_metrics":                "run_id",
+	"PipelineMonitoring.chunk_attempts":               "run_id",
+	"PipelineMonitoring.raw_row_samples":              "run_id",
+	"PipelineMonitoring.column_lineage":               "run_id",
+}
+
+// MaxRunDuration returns the parsed queue.max_run_duration, or
+// DefaultMaxRunDuration.
+func (c *ServiceURLs) MaxRunDuration() time.Duration {
+	if d, err := time.ParseDuration(c.Queue.MaxRunDuration); err == nil && d > 0 {
+		return d
+	}
+	return DefaultMaxRunDuration
+}
+
+// PurgeTables returns purge.tables, or DefaultPurgeTables when none are set.
+func (c *ServiceURLs) PurgeTables() map[string]string {
+	if len(c.Purge.Tables) == 0 {
+		return DefaultPurgeTables
+	}
+	return c.Purge.Tables
+}
+
+// Profile is a named preset of /run parameters. Fields a /run request sets
+// itself take precedence over the profile's, unless the profile is strict.
+type Profile struct {
+	MaxOffset    int      `json:"max_offset,omitempty"`
+	APIErrorProb *float64 `json:"api_error_prob,omitempty"`
+	GCSErrorProb *float64 `json:"gcs_error_prob,omitempty"`
+	RowDropProb  *float64 `json:"row_drop_prob,omitempty"`
+	DelayProb    *float64 `json:"delay_prob,omitempty"`
+	Stages       []string `json:"stages,omitempty"`
+	MaxMinutes   int      `json:"max_minutes,omitempty"`
+	// Strict refuses a request that caps max_offset, injects faults, picks its
+	// own stages or forces past the readiness check
+	Strict bool `json:"strict,omitempty"`
+}
+
+func prob(p float64) *float64 { return &p }
+
+// DefaultProfiles are the presets every trigger knows. The fault
+// probabilities are set even where they are zero so the extractor's FAULT_*
+// defaults don't apply.
+var DefaultProfiles = map[string]Profile{
+	// A few chunks with every kind of fault, to show retries and the quality checks at work
+	"demo": {MaxOffset: 2000, APIErrorProb: prob(0.1), GCSErrorProb: prob(0.05), RowDropProb: prob(0.02), DelayProb: prob(0.1)},
+	// A small, clean slice for trying out changes
+	"dev": {MaxOffset: 5000, APIErrorProb: prob(0), GCSErrorProb: prob(0), RowDropProb: prob(0), DelayProb: prob(0)},
+	// The full dataset as configured, without faults
+	"production": {APIErrorProb: prob(0), GCSErrorProb: prob(0), RowDropProb: prob(0), DelayProb: prob(0), Strict: true},
+}
+
+// Profile returns the named profile from profiles, or from DefaultProfiles.
+func (c *ServiceURLs) Profile(name string) (Profile, bool) {
+	if p, ok := c.Profiles[name]; ok {
+		return p, true
+	}
+	p, ok := DefaultProfiles[name]
+	return p, ok
+}
+
+// ProfileNames lists the profiles a /run request can pick, sorted.
+func (c *ServiceURLs) ProfileNames() []string {
+	var names []string
+	for name := range DefaultProfiles {
+		names = append(names, name)
+	}
+	for name := range c.Profiles {
+		if _, ok := DefaultProfiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve returns the settings of a run started with the profile by req, a
+// request's own parameters, with force set when it asks to skip the
+// readiness check. A strict profile refuses a request that would loosen it.
+func (p Profile) Resolve(req Profile, force bool) (Profile, error) {
+	if p.Strict {
+		var loosened []string
+		if req.MaxOffset > 0 {
+			loosened = append(loosened, "max_offset")
+		}
+		for _, f := range []struct {
+			name string
+			prob *float64
+		}{
+			{"api_error_prob", req.APIErrorProb},
+			{"gcs_error_prob", req.GCSErrorProb},
+			{"row_drop_prob", req.RowDropProb},
+			{"delay_prob", req.DelayProb},
+		} {
+			if f.prob != nil && *f.prob > 0 {
+				loosened = append(loosened, f.name)
+			}
+		}
+		if len(req.Stages) > 0 {
+			loosened = append(loosened, "stages")
+		}
+		if force {
+			loosened = append(loosened, "force")
+		}
+		if len(loosened) > 0 {
+			return p, fmt.Errorf("the profile is strict and does not allow %s", strings.Join(loosened, ", "))
+		}
+	}
+	if req.MaxOffset > 0 {
+		p.MaxOffset = req.MaxOffset
+	}
+	if req.APIErrorProb != nil {
+		p.APIErrorProb = req.APIErrorProb
+	}
+	if req.GCSErrorProb != nil {
+		p.GCSErrorProb = req.GCSErrorProb
+	}
+	if req.RowDropProb != nil {
+		p.RowDropProb = req.RowDropProb
+	}
+	if req.DelayProb != nil {
+		p.DelayProb = req.DelayProb
+	}
+	if len(req.Stages) > 0 {
+		p.Stages = req.Stages
+	}
+	if req.MaxMinutes > 0 {
+		p.MaxMinutes = req.MaxMinutes
+	}
+	return p, nil
+}
+
+// AnomalyConfig sets when a run's extraction is flagged as out of line with
+// the trailing runs. Unset fields take the defaults WithDefaults fills in.
+type AnomalyConfig struct {
+	// Disabled turns the check off
+	Disabled bool `json:"disabled,omitempty"`
+	// TrailingRuns is how many earlier runs (of the last 30 days) make the baseline; default 10
+	TrailingRuns int `json:"trailing_runs,omitempty"`
+	// MinRuns is the fewest earlier runs worth comparing against; default 3
+	MinRuns int `json:"min_runs,omitempty"`
+	// DropRateIncrease is how far the share of dropped rows may rise above the
+	// baseline's, e.g. 0.05 (the default) for five percentage points
+	DropRateIncrease float64 `json:"drop_rate_increase,omitempty"`
+	// DurationRatio is how many times the baseline's mean chunk duration a
+	// run's may reach; default 1.5
+	DurationRatio float64 `json:"duration_ratio,omitempty"`
+}
+
+// WithDefaults returns the config with unset fields defaulted.
+func (c AnomalyConfig) WithDefaults() AnomalyConfig {
+	if c.TrailingRuns <= 0 {
+		c.TrailingRuns = 10
+	}
+	if c.MinRuns <= 0 {
+		c.MinRuns = 3
+	}
+	if c.DropRateIncrease <= 0 {
+		c.DropRateIncrease = 0.05
+	}
+	if c.DurationRatio <= 0 {
+		c.DurationRatio = 1.5
+	}
+	return c
+}
+
+// DatasetLocation is where the bootstrap datasets are: bootstrap.location, or "US".
+func (c *ServiceURLs) DatasetLocation() string {
+	if c.Bootstrap.Location == "" {
+		return "US"
+	}
+	return c.Bootstrap.Location
+}
+
+// BucketLocation is where a bootstrap bucket is: its bucket_locations entry,
+// or DatasetLocation.
+func (c *ServiceURLs) BucketLocation(bucket string) string {
+	if loc := c.Bootstrap.BucketLocations[bucket]; loc != "" {
+		return loc
+	}
+	return c.DatasetLocation()
+}
+
+// LocationConflicts lists what in the bootstrap locations can't work:
+// buckets BigQuery can't load from into the datasets' location, and
+// bucket_locations entries for buckets that aren't bootstrapped.
+func (c *ServiceURLs) LocationConflicts() []string {
+	var conflicts []string
+	datasets := c.DatasetLocation()
+	for _, bucket := range c.Bootstrap.Buckets {
+		if loc := c.BucketLocation(bucket); !gcp.LoadableInto(loc, datasets) {
+			conflicts = append(conflicts, fmt.Sprintf("bucket %s is in %s, which datasets in %s can't load from", bucket, loc, datasets))
+		}
+	}
+	for bucket := range c.Bootstrap.BucketLocations {
+		if !slices.Contains(c.Bootstrap.Buckets, bucket) {
+			conflicts = append(conflicts, fmt.Sprintf("bucket_locations names %s, which is not in bootstrap.buckets", bucket))
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// StageConfigs returns the configured stages, or DefaultStages when none are
+// set, with those whose service has no URL disabled (e.g. features in a
+// config that only lists the extractor, cleaner and loaders).
+func (c *ServiceURLs) StageConfigs() []StageConfig {
+	if len(c.Pipeline.Stages) == 0 {
+		stages := slices.Clone(DefaultStages)
+		for i, s := range stages {
+			if url, _ := c.StageURL(s.Name); url == "" {
+				stages[i].Enabled = false
+			}
+		}
+		return stages
+	}
+	return c.Pipeline.Stages
+}
+
+// EnabledStages returns the names of enabled stages in configured order.
+func (c *ServiceURLs) EnabledStages() []string {
+	var names []string
+	for _, s := range c.StageConfigs() {
+		if s.Enabled {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// Endpoints lists the services the trigger calls, keyed by config name.
+// Services without a URL are left out.
+func (c *ServiceURLs) Endpoints() map[string]ServiceEndpoint {
+	all := map[string]ServiceEndpoint{
+		"extractor":      c.Extractor,
+		"cleaner":        c.Cleaner,
+		"loader":         c.Loader,
+		"loader_parquet": c.LoaderParquet,
+		"features":       c.Features,
+		"prediction":     c.Prediction,
+		"drift":          c.Drift,
+		"export":         c.Export,
+	}
+	for name, e := range all {
+		if e.URL == "" {
+			delete(all, name)
+		}
+	}
+	return all
+}
+
+// StageEndpoint maps a stage name to the service endpoint it is forwarded to.
+func (c *ServiceURLs) StageEndpoint(stage string) (ServiceEndpoint, bool) {
+	switch stage {
+	case "extractor":
+		return c.Extractor, true
+	case "cleaner":
+		return c.Cleaner, true
+	case "loader_json":
+		return c.Loader, true
+	case "loader_parquet":
+		return c.LoaderParquet, true
+	case "features":
+		return c.Features, true
+	case "prediction":
+		return c.Prediction, true
+	case "drift":
+		return c.Drift, true
+	case "export":
+		return c.Export, true
+	}
+	return ServiceEndpoint{}, false
+}
+
+// StageURL maps a stage name to the service URL it is forwarded to.
+func (c *ServiceURLs) StageURL(stage string) (string, bool) {
+	e, ok := c.StageEndpoint(stage)
+	return e.URL, ok
 }
 
 func LoadServiceConfig(path string) (*ServiceURLs, error) {
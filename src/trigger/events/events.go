@@ -0,0 +1,165 @@
+// Package events publishes pipeline lifecycle events as CloudEvents 1.0, so
+// external systems (model retraining, reporting, Cloud Workflows) can react
+// to finished runs without polling the trigger.
+package events
+
+import (
+	"bytes"
+	"configure/gcp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event types emitted by the trigger.
+const (
+	TypeRunCompleted = "com.hygiene.pipeline.run.completed"
+	TypeRunFailed    = "com.hygiene.pipeline.run.failed"
+)
+
+const eventarcPublishingAPI = "https://eventarcpublishing.googleapis.com/v1"
+
+// CloudEvent is the JSON (structured mode) form of a CloudEvents 1.0 event.
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// Config says where events go. Both targets may be set; neither disables publishing.
+type Config struct {
+	// WebhookURL receives each event as an application/cloudevents+json POST
+	WebhookURL string `json:"webhook_url"`
+	// Audience, when set, adds an OIDC identity token to webhook calls
+	// (e.g. a Cloud Run or Cloud Functions receiver that requires auth)
+	Audience string `json:"audience,omitempty"`
+	// Channel is an Eventarc channel, projects/{p}/locations/{l}/channels/{c};
+	// Eventarc triggers on it can start Cloud Workflows or other services
+	Channel string `json:"channel,omitempty"`
+	// Source is the CloudEvents source attribute; defaults to "//hygiene-prediction/trigger"
+	Source string `json:"source,omitempty"`
+}
+
+// Publisher sends CloudEvents to the configured targets.
+type Publisher struct {
+	Config Config
+	Client *http.Client
+}
+
+func NewPublisher(cfg Config) *Publisher {
+	if cfg.Source == "" {
+		cfg.Source = "//hygiene-prediction/trigger"
+	}
+	return &Publisher{Config: cfg, Client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// Enabled reports whether any target is configured.
+func (p *Publisher) Enabled() bool {
+	return p != nil && (p.Config.WebhookURL != "" || p.Config.Channel != "")
+}
+
+// New builds an event of type t about subject.
+func (p *Publisher) New(t, subject string, data interface{}) CloudEvent {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              hex.EncodeToString(b),
+		Source:          p.Config.Source,
+		Type:            t,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// Publish delivers e to every configured target, logging failures.
+func (p *Publisher) Publish(ctx context.Context, e CloudEvent) {
+	if !p.Enabled() {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("❌ Failed to marshal event %s: %v", e.Type, err)
+		return
+	}
+	if p.Config.WebhookURL != "" {
+		if err := p.postWebhook(ctx, body); err != nil {
+			log.Printf("❌ Failed to deliver %s to webhook: %v", e.Type, err)
+		} else {
+			log.Printf("📣 Event %s (%s) delivered to webhook", e.Type, e.Subject)
+		}
+	}
+	if p.Config.Channel != "" {
+		if err := p.publishEventarc(ctx, body); err != nil {
+			log.Printf("❌ Failed to publish %s to Eventarc: %v", e.Type, err)
+		} else {
+			log.Printf("📣 Event %s (%s) published to %s", e.Type, e.Subject, p.Config.Channel)
+		}
+	}
+}
+
+func (p *Publisher) postWebhook(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	if p.Config.Audience != "" {
+		token, err := gcp.IDToken(ctx, p.Config.Audience)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return p.do(req)
+}
+
+// publishEventarc uses the Eventarc Publishing API, which takes events in
+// their CloudEvents JSON text form.
+func (p *Publisher) publishEventarc(ctx context.Context, body []byte) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"channel":    p.Config.Channel,
+		"textEvents": []string{string(body)},
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/%s:publishEvents", eventarcPublishingAPI, p.Config.Channel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token, err := gcp.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return p.do(req)
+}
+
+func (p *Publisher) do(req *http.Request) error {
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
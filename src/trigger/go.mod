@@ -3,3 +3,7 @@ module app
 go 1.22.3
 
 toolchain go1.24.2
+
+require configure v0.0.0-00010101000000-000000000000
+
+replace configure => ../configure
@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Queue admits at most limit runs at a time. Runs submitted while it is
+// full wait, highest priority first and in submission order within a
+// priority, until a running one is released.
+type Queue struct {
+	mu      sync.Mutex
+	limit   int
+	running map[string]time.Time // admitted at
+	waiting []entry
+	seq     int
+}
+
+type entry struct {
+	id       string
+	priority int
+	seq      int
+}
+
+// New returns a queue running at most limit runs at once; limit < 1 means 1.
+func New(limit int) *Queue {
+	return &Queue{limit: max(limit, 1), running: make(map[string]time.Time)}
+}
+
+// Submit admits id if a slot is free, otherwise queues it. It returns
+// whether id may start now and, if not, its 1-based position in the queue.
+func (q *Queue) Submit(id string, priority int) (admitted bool, position int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.running) < q.limit && len(q.waiting) == 0 {
+		q.running[id] = time.Now()
+		return true, 0
+	}
+	q.seq++
+	q.waiting = append(q.waiting, entry{id: id, priority: priority, seq: q.seq})
+	sort.SliceStable(q.waiting, func(i, j int) bool {
+		a, b := q.waiting[i], q.waiting[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.seq < b.seq
+	})
+	return false, q.position(id)
+}
+
+// Release frees id's slot, or drops it from the queue if it never started,
+// and returns the runs admitted in its place. Unknown IDs are ignored.
+func (q *Queue) Release(id string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.running[id]; !ok {
+		for i, e := range q.waiting {
+			if e.id == id {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+	delete(q.running, id)
+
+	var admitted []string
+	for len(q.running) < q.limit && len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running[next.id] = time.Now()
+		admitted = append(admitted, next.id)
+	}
+	return admitted
+}
+
+// Holds reports whether id has a slot.
+func (q *Queue) Holds(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.running[id]
+	return ok
+}
+
+// Stale lists the runs admitted more than limit ago, oldest first.
+func (q *Queue) Stale(limit time.Duration) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var stale []string
+	for id, at := range q.running {
+		if time.Since(at) > limit {
+			stale = append(stale, id)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return q.running[stale[i]].Before(q.running[stale[j]]) })
+	return stale
+}
+
+// Position is id's 1-based place in the queue, or 0 if it isn't waiting.
+func (q *Queue) Position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.position(id)
+}
+
+func (q *Queue) position(id string) int {
+	for i, e := range q.waiting {
+		if e.id == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Stats reports how many runs are running and waiting.
+func (q *Queue) Stats() (running, waiting int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.running), len(q.waiting)
+}
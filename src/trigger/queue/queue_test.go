@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSubmitAdmitsUpToLimit(t *testing.T) {
+	q := New(2)
+	for _, id := range []string{"a", "b"} {
+		if admitted, _ := q.Submit(id, 0); !admitted {
+			t.Fatalf("%s not admitted with a free slot", id)
+		}
+	}
+	admitted, position := q.Submit("c", 0)
+	if admitted || position != 1 {
+		t.Fatalf("third run: admitted=%t position=%d, want queued at 1", admitted, position)
+	}
+	if running, waiting := q.Stats(); running != 2 || waiting != 1 {
+		t.Errorf("stats %d running, %d waiting; want 2, 1", running, waiting)
+	}
+	if !q.Holds("a") || q.Holds("c") {
+		t.Errorf("Holds: a=%t c=%t, want true, false", q.Holds("a"), q.Holds("c"))
+	}
+}
+
+func TestLimitBelowOneMeansOne(t *testing.T) {
+	q := New(0)
+	q.Submit("a", 0)
+	if admitted, _ := q.Submit("b", 0); admitted {
+		t.Fatal("second run admitted with limit 0")
+	}
+}
+
+func TestReleaseAdmitsByPriorityThenOrder(t *testing.T) {
+	q := New(1)
+	q.Submit("running", 0)
+	q.Submit("low", 0)
+	q.Submit("high", 5)
+	q.Submit("low2", 0)
+	q.Submit("high2", 5)
+	if p := q.Position("high2"); p != 2 {
+		t.Errorf("high2 at position %d, want 2", p)
+	}
+
+	var order []string
+	for _, id := range []string{"running", "high", "high2", "low", "low2"} {
+		order = append(order, q.Release(id)...)
+	}
+	want := []string{"high", "high2", "low", "low2"}
+	if !slices.Equal(order, want) {
+		t.Errorf("admitted %v, want %v", order, want)
+	}
+	if running, waiting := q.Stats(); running != 0 || waiting != 0 {
+		t.Errorf("stats %d running, %d waiting after releasing all", running, waiting)
+	}
+}
+
+func TestReleaseWaitingOrUnknown(t *testing.T) {
+	q := New(1)
+	q.Submit("a", 0)
+	q.Submit("b", 0)
+	q.Submit("c", 0)
+	if admitted := q.Release("b"); admitted != nil {
+		t.Errorf("dropping a waiting run admitted %v", admitted)
+	}
+	if p := q.Position("c"); p != 1 {
+		t.Errorf("c at position %d after b left, want 1", p)
+	}
+	if admitted := q.Release("nope"); admitted != nil {
+		t.Errorf("releasing an unknown run admitted %v", admitted)
+	}
+	if admitted := q.Release("a"); !slices.Equal(admitted, []string{"c"}) {
+		t.Errorf("releasing a admitted %v, want [c]", admitted)
+	}
+}
+
+func TestStale(t *testing.T) {
+	q := New(3)
+	q.Submit("old", 0)
+	q.Submit("older", 0)
+	q.Submit("new", 0)
+	q.running["old"] = time.Now().Add(-2 * time.Hour)
+	q.running["older"] = time.Now().Add(-3 * time.Hour)
+
+	if stale := q.Stale(time.Hour); !slices.Equal(stale, []string{"older", "old"}) {
+		t.Errorf("stale %v, want [older old]", stale)
+	}
+	q.Release("older")
+	if stale := q.Stale(time.Hour); !slices.Equal(stale, []string{"old"}) {
+		t.Errorf("stale %v after release, want [old]", stale)
+	}
+}
@@ -0,0 +1,243 @@
+package routing
+
+import (
+	"app/configure"
+	"fmt"
+	"time"
+)
+
+// Stage is one hop in a pipeline; it is considered done when its
+// completion event ("<name>_completed") arrives at /clean.
+type Stage struct {
+	Name  string `json:"name"`
+	Event string `json:"event"`
+	URL   string `json:"url"`
+	// Upstream stage that starts this one; empty for the root (extractor)
+	After string `json:"after,omitempty"`
+
+	SLA            string `json:"sla,omitempty"`
+	OnSLAViolation string `json:"on_sla_violation,omitempty"`
+	SLARetries     int    `json:"sla_retries,omitempty"`
+
+	// Policy for a failure the stage reports ("<name>_failed")
+	OnFailure      string `json:"on_failure,omitempty"`
+	FailureRetries int    `json:"failure_retries,omitempty"`
+
+	// "gcs_notification" when a GCS notification, not the trigger, starts the stage
+	StartedBy string `json:"started_by,omitempty"`
+
+	// Call policy for forwarding to the stage's service
+	Timeout    string `json:"timeout,omitempty"`
+	Retries    int    `json:"retries,omitempty"`
+	Backoff    string `json:"backoff,omitempty"`
+	Idempotent bool   `json:"idempotent,omitempty"`
+	// OIDC audience for the identity token sent with each call; empty sends none
+	Audience string `json:"audience,omitempty"`
+
+	// Hold the stage until it is approved, for at most ApprovalTimeout
+	Approval        bool   `json:"approval,omitempty"`
+	ApprovalTimeout string `json:"approval_timeout,omitempty"`
+}
+
+// Notified reports whether a GCS notification, not the trigger, starts the stage.
+func (s Stage) Notified() bool {
+	return s.StartedBy == "gcs_notification"
+}
+
+// SLALimit returns the parsed SLA, or zero when none is configured.
+func (s Stage) SLALimit() time.Duration {
+	d, _ := time.ParseDuration(s.SLA)
+	return d
+}
+
+// TimeoutLimit returns the per-attempt timeout, or configure.DefaultTimeout.
+func (s Stage) TimeoutLimit() time.Duration {
+	if d, err := time.ParseDuration(s.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return configure.DefaultTimeout
+}
+
+// ApprovalLimit returns how long the stage's approval may wait, or
+// configure.DefaultApprovalTimeout.
+func (s Stage) ApprovalLimit() time.Duration {
+	if d, err := time.ParseDuration(s.ApprovalTimeout); err == nil && d > 0 {
+		return d
+	}
+	return configure.DefaultApprovalTimeout
+}
+
+// BackoffDelay returns the wait before the first retry, or configure.DefaultBackoff.
+func (s Stage) BackoffDelay() time.Duration {
+	if d, err := time.ParseDuration(s.Backoff); err == nil && d > 0 {
+		return d
+	}
+	return configure.DefaultBackoff
+}
+
+// Topology is the ordered list of enabled stages for a run. Stages that share
+// an upstream stage are started concurrently when it completes.
+type Topology []Stage
+
+// Build resolves stage names against the service config. The extractor must
+// come first since /run always starts there, and every stage the trigger
+// starts needs its service URL. Each stage hangs off its configured
+// upstream when that stage is part of the run, otherwise off the stage before it.
+func Build(cfg *configure.ServiceURLs, names []string) (Topology, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("topology has no enabled stages")
+	}
+	if names[0] != "extractor" {
+		return nil, fmt.Errorf("topology must start with extractor, got %q", names[0])
+	}
+
+	declared := make(map[string]configure.StageConfig)
+	for _, s := range cfg.StageConfigs() {
+		declared[s.Name] = s
+	}
+
+	seen := make(map[string]bool)
+	var t Topology
+	for i, name := range names {
+		endpoint, ok := cfg.StageEndpoint(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("stage %q listed twice", name)
+		}
+		sc := declared[name]
+		if endpoint.URL == "" && sc.StartedBy != "gcs_notification" {
+			return nil, fmt.Errorf("stage %q has no service URL configured", name)
+		}
+		after := ""
+		if i > 0 {
+			after = sc.After
+			if !seen[after] {
+				after = names[i-1]
+			}
+		}
+		if sc.SLA != "" {
+			if _, err := time.ParseDuration(sc.SLA); err != nil {
+				return nil, fmt.Errorf("stage %q: invalid sla %q: %w", name, sc.SLA, err)
+			}
+		}
+		for field, v := range map[string]string{"timeout": endpoint.Timeout, "backoff": endpoint.Backoff} {
+			if v == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+				return nil, fmt.Errorf("stage %q: invalid %s %q", name, field, v)
+			}
+		}
+		if endpoint.Retries < 0 {
+			return nil, fmt.Errorf("stage %q: retries must not be negative", name)
+		}
+		switch sc.OnSLAViolation {
+		case "", "alert", "retry", "cancel":
+		default:
+			return nil, fmt.Errorf("stage %q: unknown on_sla_violation policy %q", name, sc.OnSLAViolation)
+		}
+		retries := sc.SLARetries
+		if sc.OnSLAViolation == "retry" && retries == 0 {
+			retries = 1
+		}
+		switch sc.OnFailure {
+		case "", "fail", "retry":
+		default:
+			return nil, fmt.Errorf("stage %q: unknown on_failure policy %q", name, sc.OnFailure)
+		}
+		if sc.FailureRetries < 0 {
+			return nil, fmt.Errorf("stage %q: failure_retries must not be negative", name)
+		}
+		failureRetries := sc.FailureRetries
+		if sc.OnFailure == "retry" && failureRetries == 0 {
+			failureRetries = 1
+		}
+		switch sc.StartedBy {
+		case "", "trigger":
+		case "gcs_notification":
+			if name != "loader_json" && name != "loader_parquet" {
+				return nil, fmt.Errorf("stage %q: only loaders can be started by gcs_notification", name)
+			}
+		default:
+			return nil, fmt.Errorf("stage %q: unknown started_by %q", name, sc.StartedBy)
+		}
+		if sc.Approval {
+			// Only a stage the trigger starts can be held back
+			if i == 0 || sc.StartedBy == "gcs_notification" {
+				return nil, fmt.Errorf("stage %q: approval needs a stage the trigger starts after another", name)
+			}
+			if sc.ApprovalTimeout != "" {
+				if d, err := time.ParseDuration(sc.ApprovalTimeout); err != nil || d <= 0 {
+					return nil, fmt.Errorf("stage %q: invalid approval_timeout %q", name, sc.ApprovalTimeout)
+				}
+			}
+		}
+		seen[name] = true
+		t = append(t, Stage{
+			Name:            name,
+			Event:           name + "_completed",
+			URL:             endpoint.URL,
+			After:           after,
+			SLA:             sc.SLA,
+			OnSLAViolation:  sc.OnSLAViolation,
+			SLARetries:      retries,
+			OnFailure:       sc.OnFailure,
+			FailureRetries:  failureRetries,
+			StartedBy:       sc.StartedBy,
+			Timeout:         endpoint.Timeout,
+			Retries:         endpoint.Retries,
+			Backoff:         endpoint.Backoff,
+			Idempotent:      endpoint.Idempotent,
+			Audience:        endpoint.Audience,
+			Approval:        sc.Approval,
+			ApprovalTimeout: sc.ApprovalTimeout,
+		})
+	}
+	return t, nil
+}
+
+// Stage returns the stage completed by event.
+func (t Topology) Stage(event string) (Stage, bool) {
+	for _, s := range t {
+		if s.Event == event {
+			return s, true
+		}
+	}
+	return Stage{}, false
+}
+
+// ByName returns the stage called name.
+func (t Topology) ByName(name string) (Stage, bool) {
+	for _, s := range t {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Stage{}, false
+}
+
+// Next returns every stage that starts once the stage emitting event completes.
+// ok is false when event does not complete any stage of the topology.
+func (t Topology) Next(event string) (next []Stage, ok bool) {
+	done, ok := t.Stage(event)
+	if !ok {
+		return nil, false
+	}
+	for _, s := range t {
+		if s.After == done.Name {
+			next = append(next, s)
+		}
+	}
+	return next, true
+}
+
+// Names lists the stage names in order.
+func (t Topology) Names() []string {
+	names := make([]string, len(t))
+	for i, s := range t {
+		names[i] = s.Name
+	}
+	return names
+}
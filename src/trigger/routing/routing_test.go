@@ -0,0 +1,162 @@
+package routing
+
+import (
+	"app/configure"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// config sets every stage's service URL, and the stages when given.
+func config(stages ...configure.StageConfig) *configure.ServiceURLs {
+	cfg := &configure.ServiceURLs{}
+	for name, e := range map[string]*configure.ServiceEndpoint{
+		"extractor": &cfg.Extractor, "cleaner": &cfg.Cleaner, "loader": &cfg.Loader, "loader_parquet": &cfg.LoaderParquet,
+		"features": &cfg.Features, "prediction": &cfg.Prediction, "drift": &cfg.Drift, "export": &cfg.Export,
+	} {
+		e.URL = "http://" + name + ":8080/"
+	}
+	cfg.Pipeline.Stages = stages
+	return cfg
+}
+
+func TestBuildDefaultTopology(t *testing.T) {
+	cfg := config()
+	topology, err := Build(cfg, cfg.EnabledStages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topology[0].Name != "extractor" || topology[0].After != "" {
+		t.Errorf("root %+v, want the extractor with no upstream", topology[0])
+	}
+	for _, s := range topology {
+		if s.Event != s.Name+"_completed" {
+			t.Errorf("%s completes on %q", s.Name, s.Event)
+		}
+	}
+}
+
+// The default stages leave out services with no URL, so a config without
+// the features service runs without it.
+func TestBuildDefaultTopologyWithoutURL(t *testing.T) {
+	cfg := config()
+	cfg.Features.URL = ""
+	topology, err := Build(cfg, cfg.EnabledStages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := topology.ByName("features"); ok {
+		t.Errorf("features enabled with no URL: %v", topology.Names())
+	}
+}
+
+// Stages sharing an upstream fan out from it; a stage whose configured
+// upstream isn't in the run hangs off the stage before it.
+func TestBuildAfter(t *testing.T) {
+	cfg := config(
+		configure.StageConfig{Name: "extractor", Enabled: true},
+		configure.StageConfig{Name: "cleaner", Enabled: true, After: "extractor"},
+		configure.StageConfig{Name: "loader_json", Enabled: true, After: "cleaner"},
+		configure.StageConfig{Name: "loader_parquet", Enabled: true, After: "cleaner"},
+		configure.StageConfig{Name: "features", Enabled: true, After: "loader_json"},
+	)
+	topology, err := Build(cfg, []string{"extractor", "cleaner", "loader_parquet", "features"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"extractor": "", "cleaner": "extractor", "loader_parquet": "cleaner", "features": "loader_parquet"}
+	for _, s := range topology {
+		if s.After != want[s.Name] {
+			t.Errorf("%s after %q, want %q", s.Name, s.After, want[s.Name])
+		}
+	}
+
+	topology, err = Build(cfg, cfg.EnabledStages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, ok := topology.Next("cleaner_completed")
+	names := make([]string, len(next))
+	for i, s := range next {
+		names[i] = s.Name
+	}
+	if !ok || !slices.Equal(names, []string{"loader_json", "loader_parquet"}) {
+		t.Errorf("after the cleaner: %v, want both loaders", names)
+	}
+}
+
+func TestBuildPolicyDefaults(t *testing.T) {
+	cfg := config(
+		configure.StageConfig{Name: "extractor", Enabled: true, SLA: "30m", OnSLAViolation: "retry"},
+		configure.StageConfig{Name: "cleaner", Enabled: true, OnFailure: "retry", Approval: true},
+	)
+	cfg.Cleaner.Timeout = "20m"
+	topology, err := Build(cfg, cfg.EnabledStages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor, cleaner := topology[0], topology[1]
+	if extractor.SLARetries != 1 || cleaner.FailureRetries != 1 {
+		t.Errorf("retries %d and %d, want 1 by default for a retry policy", extractor.SLARetries, cleaner.FailureRetries)
+	}
+	if cleaner.TimeoutLimit().String() != "20m0s" || extractor.TimeoutLimit() != configure.DefaultTimeout {
+		t.Errorf("timeouts %s and %s", extractor.TimeoutLimit(), cleaner.TimeoutLimit())
+	}
+	if !cleaner.Approval || cleaner.ApprovalLimit() != configure.DefaultApprovalTimeout {
+		t.Errorf("cleaner approval %t for %s", cleaner.Approval, cleaner.ApprovalLimit())
+	}
+}
+
+func TestBuildRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []configure.StageConfig
+		names  []string
+		want   string
+	}{
+		{"empty", nil, nil, "no enabled stages"},
+		{"not extractor first", nil, []string{"cleaner"}, "must start with extractor"},
+		{"unknown", nil, []string{"extractor", "scorer"}, "unknown stage"},
+		{"twice", nil, []string{"extractor", "cleaner", "cleaner"}, "listed twice"},
+		{"sla", []configure.StageConfig{{Name: "extractor", SLA: "soon"}}, []string{"extractor"}, "invalid sla"},
+		{"sla policy", []configure.StageConfig{{Name: "extractor", OnSLAViolation: "panic"}}, []string{"extractor"}, "on_sla_violation"},
+		{"failure policy", []configure.StageConfig{{Name: "extractor", OnFailure: "ignore"}}, []string{"extractor"}, "on_failure"},
+		{"failure retries", []configure.StageConfig{{Name: "extractor", FailureRetries: -1}}, []string{"extractor"}, "failure_retries"},
+		{"notified cleaner", []configure.StageConfig{{Name: "cleaner", StartedBy: "gcs_notification"}}, []string{"extractor", "cleaner"}, "only loaders"},
+		{"started_by", []configure.StageConfig{{Name: "cleaner", StartedBy: "cron"}}, []string{"extractor", "cleaner"}, "unknown started_by"},
+		{"root approval", []configure.StageConfig{{Name: "extractor", Approval: true}}, []string{"extractor"}, "approval needs"},
+		{"notified approval", []configure.StageConfig{{Name: "loader_parquet", StartedBy: "gcs_notification", Approval: true}}, []string{"extractor", "loader_parquet"}, "approval needs"},
+		{"approval timeout", []configure.StageConfig{{Name: "cleaner", Approval: true, ApprovalTimeout: "-1h"}}, []string{"extractor", "cleaner"}, "approval_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Build(config(tt.stages...), tt.names)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRejectsEndpointPolicy(t *testing.T) {
+	cfg := config()
+	cfg.Cleaner.Backoff = "0s"
+	if _, err := Build(cfg, []string{"extractor", "cleaner"}); err == nil || !strings.Contains(err.Error(), "invalid backoff") {
+		t.Errorf("error %v, want invalid backoff", err)
+	}
+	cfg = config()
+	cfg.Extractor.Retries = -1
+	if _, err := Build(cfg, []string{"extractor"}); err == nil || !strings.Contains(err.Error(), "retries") {
+		t.Errorf("error %v, want negative retries refused", err)
+	}
+
+	// A stage the trigger starts needs a URL; one started by the GCS notification doesn't
+	cfg = config(configure.StageConfig{Name: "loader_parquet", StartedBy: "gcs_notification"})
+	cfg.Features.URL, cfg.LoaderParquet.URL = "", ""
+	if _, err := Build(cfg, []string{"extractor", "features"}); err == nil || !strings.Contains(err.Error(), "no service URL") {
+		t.Errorf("error %v, want features refused without a URL", err)
+	}
+	if _, err := Build(cfg, []string{"extractor", "loader_parquet"}); err != nil {
+		t.Errorf("notified loader without a URL: %v", err)
+	}
+}
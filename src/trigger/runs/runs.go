@@ -0,0 +1,598 @@
+package runs
+
+import (
+	"app/routing"
+	"configure/errcategory"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued" // waiting for a slot in the run queue
+	StatusStarted   Status = "started"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+)
+
+// ErrNotFound is returned for an unknown run ID.
+var ErrNotFound = errors.New("run not found")
+
+// ErrNoApproval is returned when no approval the request could mean is pending.
+var ErrNoApproval = errors.New("no approval pending")
+
+// Run is the trigger's view of a single pipeline execution started via /run.
+type Run struct {
+	ID             string           `json:"run_id"`
+	Date           string           `json:"date"`
+	IdempotencyKey string           `json:"idempotency_key,omitempty"`
+	Status         Status           `json:"status"`
+	Topology       routing.Topology `json:"topology"`
+	Completed      []string         `json:"completed_stages"`
+	LastEvent      string           `json:"last_event,omitempty"`
+	SLAViolations  []string         `json:"sla_violations,omitempty"`
+	StageRetries   map[string]int   `json:"stage_retries,omitempty"` // re-sends of stages that reported a failure
+	Events         []Event          `json:"events,omitempty"`
+	EventsDropped  int              `json:"events_dropped,omitempty"`    // oldest events past MaxEvents
+	Retries        int              `json:"retries,omitempty"`           // resumes via /runs/{id}/retry
+	ErrorCategory  string           `json:"error_category,omitempty"`    // classifies Error, see configure/errcategory
+	Priority       int              `json:"priority,omitempty"`          // higher runs first when queued
+	QueuePosition  int              `json:"queue_position,omitempty"`    // 1-based while queued, filled in by the status handler
+	Progress       *Progress        `json:"progress,omitempty"`          // extraction progress, once the dataset size is known
+	Approvals      []Approval       `json:"pending_approvals,omitempty"` // stages held at their approval gate
+	// Params is the request the extractor was started with, kept so stages can be re-sent
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+
+	// seen holds the events already handled, so a redelivered callback is dropped
+	// for this run without affecting other runs of the same date
+	seen map[string]bool
+	// finished is set once the run's end has been handled, see Finish
+	finished bool
+}
+
+// Progress is how far a run's extraction has got, measured against the
+// dataset row count the extractor took before fetching any pages.
+type Progress struct {
+	TotalRows     int     `json:"total_rows"`
+	RowsPlanned   int     `json:"rows_planned"` // of TotalRows, given the run's start offset and max_offset
+	RowsExtracted int     `json:"rows_extracted"`
+	Percent       float64 `json:"percent"`
+	Truncated     bool    `json:"truncated,omitempty"` // finished well short of RowsPlanned
+}
+
+// Approval is a stage held at its approval gate until it is approved,
+// rejected or ExpiresAt passes.
+type Approval struct {
+	Stage       string    `json:"stage"`
+	RequestedAt time.Time `json:"requested_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Event is one stage event received for a run at /clean, with its payload.
+// Fields larger than MaxFieldBytes (e.g. the cleaner's file_timings) are
+// replaced by a note of their size.
+type Event struct {
+	Name       string                 `json:"event"`
+	Origin     string                 `json:"origin,omitempty"`
+	ReceivedAt time.Time              `json:"received_at"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Limits on the events a run keeps. The summary and reports only read the
+// events' scalar fields and small details, and runs live in memory.
+const (
+	MaxEvents     = 500
+	MaxFieldBytes = 16 << 10
+)
+
+// Registry tracks runs and the idempotency keys that created them.
+// Keys are remembered for keyTTL so scheduler retries map back to the original run.
+// Completed and failed runs are dropped retention after they ended.
+// All run state the trigger's handlers share lives here, behind one lock.
+type Registry struct {
+	mu        sync.Mutex
+	runs      map[string]*Run
+	byKey     map[string]string
+	keyTTL    time.Duration
+	retention time.Duration
+	// untracked holds the events seen per date from runs the registry
+	// doesn't know (started outside /run), which are deduplicated by date
+	untracked map[string]map[string]bool
+}
+
+// NewRegistry keeps ended runs for retention; zero keeps them for good.
+func NewRegistry(keyTTL, retention time.Duration) *Registry {
+	return &Registry{
+		runs:      make(map[string]*Run),
+		byKey:     make(map[string]string),
+		keyTTL:    keyTTL,
+		retention: retention,
+		untracked: make(map[string]map[string]bool),
+	}
+}
+
+// Start registers a new run for date with the given stage topology unless key
+// already maps to a live run, in which case the original run is returned with created=false.
+func (r *Registry) Start(date, key string, topology routing.Topology) (run Run, created bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	r.evict(now)
+	if key != "" {
+		if id, ok := r.byKey[key]; ok {
+			if existing, ok := r.runs[id]; ok && now.Sub(existing.CreatedAt) < r.keyTTL {
+				return *existing, false
+			}
+			delete(r.byKey, key)
+		}
+	}
+
+	run = Run{
+		ID:             newRunID(now),
+		Date:           date,
+		IdempotencyKey: key,
+		Status:         StatusStarted,
+		Topology:       topology,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		seen:           make(map[string]bool),
+	}
+	r.runs[run.ID] = &run
+	if key != "" {
+		r.byKey[key] = run.ID
+	}
+	return run, true
+}
+
+// Get returns a copy of the run with the given ID.
+func (r *Registry) Get(id string) (Run, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return Run{}, false
+	}
+	return *run, true
+}
+
+// LatestForDate returns the most recently created run for date, preferring
+// runs still in progress. Used to attribute events from services that don't
+// echo run_id.
+func (r *Registry) LatestForDate(date string) (Run, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var latest *Run
+	for _, run := range r.runs {
+		if run.Date != date {
+			continue
+		}
+		if latest == nil || active(run) && !active(latest) ||
+			active(run) == active(latest) && run.CreatedAt.After(latest.CreatedAt) {
+			latest = run
+		}
+	}
+	if latest == nil {
+		return Run{}, false
+	}
+	return *latest, true
+}
+
+// Since returns copies of the runs created at or after t, oldest first.
+func (r *Registry) Since(t time.Time) []Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []Run
+	for _, run := range r.runs {
+		if !run.CreatedAt.Before(t) {
+			out = append(out, *run)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func active(run *Run) bool {
+	return run.Status == StatusStarted || run.Status == StatusRunning
+}
+
+// FirstEvent records that run id received event and reports whether it is
+// the first time; a duplicate returns false. Unknown runs return true.
+func (r *Registry) FirstEvent(id, event string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return true
+	}
+	if run.seen[event] {
+		return false
+	}
+	run.seen[event] = true
+	return true
+}
+
+// FirstUntracked records that the untracked pipeline of date received event
+// and reports whether it is the first time.
+func (r *Registry) FirstUntracked(date, event string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.untracked[date]; !ok {
+		r.untracked[date] = make(map[string]bool)
+	}
+	if r.untracked[date][event] {
+		return false
+	}
+	r.untracked[date][event] = true
+	return true
+}
+
+// ForgetEvent lets run id receive event again.
+func (r *Registry) ForgetEvent(id, event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		delete(run.seen, event)
+	}
+}
+
+// ForgetEvents lets every run, and every untracked date, receive all its
+// events again.
+func (r *Registry) ForgetEvents() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, run := range r.runs {
+		run.seen = make(map[string]bool)
+	}
+	r.untracked = make(map[string]map[string]bool)
+}
+
+// Update records the latest event for a run and marks it running.
+func (r *Registry) Update(id string, event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		run.Status = StatusRunning
+		run.LastEvent = event
+		run.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// CompleteStage records that stage finished. Once every stage of the run's
+// topology has completed the run is marked completed and allDone is true.
+func (r *Registry) CompleteStage(id, stage, event string) (allDone bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return false
+	}
+	done := make(map[string]bool)
+	for _, name := range run.Completed {
+		done[name] = true
+	}
+	if !done[stage] {
+		run.Completed = append(run.Completed, stage)
+		done[stage] = true
+	}
+	run.LastEvent = event
+	run.UpdatedAt = time.Now().UTC()
+
+	allDone = true
+	for _, s := range run.Topology {
+		if !done[s.Name] {
+			allDone = false
+			break
+		}
+	}
+	if allDone {
+		run.Status = StatusCompleted
+	} else {
+		run.Status = StatusRunning
+	}
+	return allDone
+}
+
+// StageCompleted reports whether the run has recorded stage as completed.
+func (r *Registry) StageCompleted(id, stage string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	return ok && slices.Contains(run.Completed, stage)
+}
+
+// Queue marks a run as waiting for a slot at priority.
+func (r *Registry) Queue(id string, priority int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		run.Status = StatusQueued
+		run.Priority = priority
+		run.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// Dequeue marks a queued run as started.
+func (r *Registry) Dequeue(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok && run.Status == StatusQueued {
+		run.Status = StatusStarted
+		run.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// SetParams stores the extractor request for the run.
+func (r *Registry) SetParams(id string, params map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		run.Params = params
+	}
+}
+
+// RecordEvent appends a received stage event to the run's history, trimming
+// its large fields and dropping the oldest event once the run has MaxEvents.
+func (r *Registry) RecordEvent(id string, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		if e.ReceivedAt.IsZero() {
+			e.ReceivedAt = time.Now().UTC()
+		}
+		e.Fields = trimFields(e.Fields)
+		if len(run.Events) >= MaxEvents {
+			n := len(run.Events) - MaxEvents + 1
+			run.Events = append(run.Events[:0:0], run.Events[n:]...)
+			run.EventsDropped += n
+		}
+		run.Events = append(run.Events, e)
+	}
+}
+
+// trimFields copies fields, replacing each list or object encoding to more
+// than MaxFieldBytes with a note of its size.
+func trimFields(fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		return nil
+	}
+	trimmed := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			if data, err := json.Marshal(v); err == nil && len(data) > MaxFieldBytes {
+				v = fmt.Sprintf("(%d bytes, not kept)", len(data))
+			}
+		}
+		trimmed[k] = v
+	}
+	return trimmed
+}
+
+// SetProgress records the run's extraction progress, working out Percent.
+func (r *Registry) SetProgress(id string, p Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return
+	}
+	p.Percent = 100
+	if p.RowsPlanned > 0 {
+		p.Percent = math.Min(math.Round(1000*float64(p.RowsExtracted)/float64(p.RowsPlanned))/10, 100)
+	}
+	// Replaced rather than updated in place, since copies returned by Get share it
+	run.Progress = &p
+	run.UpdatedAt = time.Now().UTC()
+}
+
+// AwaitApproval holds stage at its approval gate for up to timeout. It
+// returns false if the run is unknown, has failed or already holds the stage.
+func (r *Registry) AwaitApproval(id, stage string, timeout time.Duration) (Approval, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok || run.Status == StatusFailed || slices.ContainsFunc(run.Approvals, func(a Approval) bool { return a.Stage == stage }) {
+		return Approval{}, false
+	}
+	now := time.Now().UTC()
+	a := Approval{Stage: stage, RequestedAt: now, ExpiresAt: now.Add(timeout)}
+	// Replaced rather than appended to, since copies returned by Get share it
+	run.Approvals = append(slices.Clip(run.Approvals), a)
+	run.UpdatedAt = now
+	return a, true
+}
+
+// TakeApproval ends the pending approval of stage, or of the only stage
+// waiting when stage is empty, and returns it for the caller to act on.
+// Only one caller gets it, so an approval racing its expiry is decided once.
+func (r *Registry) TakeApproval(id, stage string) (Approval, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return Approval{}, ErrNotFound
+	}
+	i := slices.IndexFunc(run.Approvals, func(a Approval) bool { return a.Stage == stage })
+	if stage == "" {
+		if len(run.Approvals) > 1 {
+			names := make([]string, len(run.Approvals))
+			for j, a := range run.Approvals {
+				names[j] = a.Stage
+			}
+			return Approval{}, fmt.Errorf("%d approvals are pending; name the stage, one of %v", len(names), names)
+		}
+		i = len(run.Approvals) - 1
+	}
+	if i < 0 {
+		return Approval{}, ErrNoApproval
+	}
+	a := run.Approvals[i]
+	run.Approvals = slices.Delete(slices.Clone(run.Approvals), i, i+1)
+	if len(run.Approvals) == 0 {
+		run.Approvals = nil
+	}
+	run.UpdatedAt = time.Now().UTC()
+	return a, nil
+}
+
+// RecordSLAViolation notes that stage overran its SLA.
+func (r *Registry) RecordSLAViolation(id, stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		run.SLAViolations = append(run.SLAViolations, stage)
+		run.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// RetryStage counts another attempt at a stage that reported a failure and
+// lets its events through again. It returns the attempt number (1 for the
+// first retry), or false once max retries have been used.
+func (r *Registry) RetryStage(id, stage string, max int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok || run.StageRetries[stage] >= max {
+		return 0, false
+	}
+	// Copied rather than updated in place, since Get hands out the map
+	retries := make(map[string]int, len(run.StageRetries)+1)
+	for k, v := range run.StageRetries {
+		retries[k] = v
+	}
+	retries[stage]++
+	run.StageRetries = retries
+	delete(run.seen, stage+"_completed")
+	delete(run.seen, stage+"_failed")
+	run.UpdatedAt = time.Now().UTC()
+	return run.StageRetries[stage], true
+}
+
+// Resume prepares a run to continue from where it stopped and returns the
+// stages to restart: those not yet completed whose upstream stage has.
+// Stages further down are started by routing as usual. A run still in
+// progress is only resumed when force is set, since its stages may yet report in.
+func (r *Registry) Resume(id string, force bool) (Run, []routing.Stage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return Run{}, nil, ErrNotFound
+	}
+	switch run.Status {
+	case StatusCompleted:
+		return *run, nil, fmt.Errorf("run %s already completed", id)
+	case StatusQueued:
+		return *run, nil, fmt.Errorf("run %s is still queued", id)
+	case StatusStarted, StatusRunning:
+		if !force {
+			return *run, nil, fmt.Errorf("run %s is still %s; retry with force to restart its pending stages", id, run.Status)
+		}
+	}
+
+	restart := run.PendingStages()
+	if len(restart) == 0 {
+		return *run, nil, fmt.Errorf("run %s has no stage to resume", id)
+	}
+	// Let the unfinished stages' events through again
+	for _, s := range run.Topology {
+		if !slices.Contains(run.Completed, s.Name) {
+			delete(run.seen, s.Event)
+			delete(run.seen, s.Name+"_failed")
+		}
+	}
+
+	run.Status = StatusRunning
+	run.Error = ""
+	run.ErrorCategory = ""
+	run.finished = false
+	run.Retries++
+	run.UpdatedAt = time.Now().UTC()
+	return *run, restart, nil
+}
+
+// PendingStages are the stages a resumed run starts from: those not yet
+// completed whose upstream stage has.
+func (run Run) PendingStages() []routing.Stage {
+	var pending []routing.Stage
+	for _, s := range run.Topology {
+		if !slices.Contains(run.Completed, s.Name) && (s.After == "" || slices.Contains(run.Completed, s.After)) {
+			pending = append(pending, s)
+		}
+	}
+	return pending
+}
+
+// Fail marks a run failed and releases its idempotency key so a retry can
+// start fresh. A run that has already completed stays completed: an SLA timer
+// or a late failure report can race the event that completed it.
+func (r *Registry) Fail(id string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok || run.Status == StatusCompleted {
+		return
+	}
+	run.Status = StatusFailed
+	run.Error = err.Error()
+	run.ErrorCategory = string(errcategory.Of(err))
+	// A failed run starts nothing more, so its gates are closed
+	run.Approvals = nil
+	run.UpdatedAt = time.Now().UTC()
+	if run.IdempotencyKey != "" {
+		delete(r.byKey, run.IdempotencyKey)
+	}
+}
+
+// Finish reports whether the caller is the first to handle the end of a
+// completed or failed run since it started or was last resumed. A run can be
+// ended from several goroutines at once (a stage's failure report, its SLA
+// timer, a continuation that couldn't start); only one should archive and
+// announce it.
+func (r *Registry) Finish(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok || run.finished || (run.Status != StatusCompleted && run.Status != StatusFailed) {
+		return false
+	}
+	run.finished = true
+	return true
+}
+
+// evict drops the runs that completed or failed more than retention ago, with
+// their idempotency keys; r.mu must be held. Their summaries are archived by then.
+func (r *Registry) evict(now time.Time) {
+	if r.retention <= 0 {
+		return
+	}
+	for id, run := range r.runs {
+		ended := run.Status == StatusCompleted || run.Status == StatusFailed
+		if ended && now.Sub(run.UpdatedAt) > r.retention {
+			delete(r.runs, id)
+			if r.byKey[run.IdempotencyKey] == id {
+				delete(r.byKey, run.IdempotencyKey)
+			}
+		}
+	}
+}
+
+func newRunID(now time.Time) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return now.Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
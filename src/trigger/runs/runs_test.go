@@ -0,0 +1,305 @@
+package runs
+
+import (
+	"app/routing"
+	"configure/errcategory"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeline is extractor → cleaner → loader_parquet.
+var pipeline = routing.Topology{
+	{Name: "extractor", Event: "extractor_completed"},
+	{Name: "cleaner", Event: "cleaner_completed", After: "extractor"},
+	{Name: "loader_parquet", Event: "loader_parquet_completed", After: "cleaner"},
+}
+
+// Concurrent /retry calls on a failed run resume it once: the others find it
+// running again, so the unfinished stages aren't restarted twice.
+func TestResumeConcurrent(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	run, _ := r.Start("2025-01-31", "", pipeline)
+	r.CompleteStage(run.ID, "extractor", "extractor_completed")
+	r.FirstEvent(run.ID, "cleaner_completed")
+	r.Fail(run.ID, errors.New("cleaner failed"))
+
+	var resumed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, restart, err := r.Resume(run.ID, false); err == nil {
+				resumed.Add(1)
+				if len(restart) != 1 || restart[0].Name != "cleaner" {
+					t.Errorf("restarted %v, want the cleaner", restart)
+				}
+			}
+			r.FirstEvent(run.ID, "cleaner_completed")
+		}()
+	}
+	wg.Wait()
+
+	if n := resumed.Load(); n != 1 {
+		t.Fatalf("run resumed %d times, want 1", n)
+	}
+	got, _ := r.Get(run.ID)
+	if got.Status != StatusRunning || got.Retries != 1 {
+		t.Errorf("status %s after %d retries, want running after 1", got.Status, got.Retries)
+	}
+}
+
+func TestStartIdempotencyKey(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	first, created := r.Start("2025-01-31", "key", pipeline)
+	if !created || first.Status != StatusStarted {
+		t.Fatalf("first start: created=%t status=%s", created, first.Status)
+	}
+	again, created := r.Start("2025-01-31", "key", pipeline)
+	if created || again.ID != first.ID {
+		t.Fatalf("same key started %s (created=%t), want %s back", again.ID, created, first.ID)
+	}
+
+	// A failed run gives its key up, so a scheduler retry starts afresh
+	r.Fail(first.ID, errors.New("extractor unreachable"))
+	retry, created := r.Start("2025-01-31", "key", pipeline)
+	if !created || retry.ID == first.ID {
+		t.Errorf("start after failure: created=%t id=%s", created, retry.ID)
+	}
+}
+
+func TestStartKeyExpires(t *testing.T) {
+	r := NewRegistry(0, 0)
+	first, _ := r.Start("2025-01-31", "key", pipeline)
+	if again, created := r.Start("2025-01-31", "key", pipeline); !created || again.ID == first.ID {
+		t.Errorf("expired key returned run %s (created=%t)", again.ID, created)
+	}
+}
+
+// Starting a run drops the runs that ended over retention ago; runs still
+// going are kept however old.
+func TestStartEvictsEndedRuns(t *testing.T) {
+	r := NewRegistry(time.Hour, 24*time.Hour)
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	completed, _ := r.Start("2025-01-28", "", routing.Topology{{Name: "extractor", Event: "extractor_completed"}})
+	r.CompleteStage(completed.ID, "extractor", "extractor_completed")
+	failed, _ := r.Start("2025-01-29", "nightly", pipeline)
+	r.Fail(failed.ID, errors.New("extractor unreachable"))
+	queued, _ := r.Start("2025-01-30", "", pipeline)
+	r.Queue(queued.ID, 0)
+	running, _ := r.Start("2025-01-31", "", pipeline)
+	recent, _ := r.Start("2025-02-01", "", pipeline)
+	r.Fail(recent.ID, errors.New("loader unreachable"))
+	for _, id := range []string{completed.ID, failed.ID, queued.ID, running.ID} {
+		r.runs[id].UpdatedAt = old
+	}
+
+	r.Start("2025-02-02", "", pipeline)
+	tests := []struct {
+		name string
+		id   string
+		kept bool
+	}{
+		{"completed", completed.ID, false},
+		{"failed", failed.ID, false},
+		{"queued", queued.ID, true},
+		{"running", running.ID, true},
+		{"failed recently", recent.ID, true},
+	}
+	for _, tt := range tests {
+		if _, ok := r.Get(tt.id); ok != tt.kept {
+			t.Errorf("%s run kept=%t, want %t", tt.name, ok, tt.kept)
+		}
+	}
+	if len(r.byKey) != 0 {
+		t.Errorf("evicted run's key kept: %v", r.byKey)
+	}
+}
+
+func TestFirstEvent(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	a, _ := r.Start("2025-01-31", "", pipeline)
+	b, _ := r.Start("2025-01-31", "", pipeline)
+	if !r.FirstEvent(a.ID, "extractor_completed") || r.FirstEvent(a.ID, "extractor_completed") {
+		t.Error("a redelivered event was not dropped")
+	}
+	if !r.FirstEvent(b.ID, "extractor_completed") {
+		t.Error("another run of the same date lost its event")
+	}
+	if !r.FirstEvent("unknown", "extractor_completed") || !r.FirstEvent("unknown", "extractor_completed") {
+		t.Error("events of unknown runs must always pass")
+	}
+	r.ForgetEvent(a.ID, "extractor_completed")
+	if !r.FirstEvent(a.ID, "extractor_completed") {
+		t.Error("a forgotten event was dropped")
+	}
+	if !r.FirstUntracked("2025-01-31", "cleaner_completed") || r.FirstUntracked("2025-01-31", "cleaner_completed") {
+		t.Error("untracked events are not deduplicated by date")
+	}
+}
+
+func TestCompleteStageAndFinish(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	run, _ := r.Start("2025-01-31", "", pipeline)
+	if r.Finish(run.ID) {
+		t.Fatal("a running run finished")
+	}
+	for i, s := range pipeline {
+		allDone := r.CompleteStage(run.ID, s.Name, s.Event)
+		if allDone != (i == len(pipeline)-1) {
+			t.Fatalf("after %s allDone=%t", s.Name, allDone)
+		}
+	}
+	got, _ := r.Get(run.ID)
+	if got.Status != StatusCompleted || !slices.Equal(got.Completed, pipeline.Names()) {
+		t.Fatalf("status %s with %v completed", got.Status, got.Completed)
+	}
+
+	// A late failure report can't fail a completed run
+	r.Fail(run.ID, errors.New("SLA timer"))
+	if got, _ := r.Get(run.ID); got.Status != StatusCompleted || got.Error != "" {
+		t.Errorf("completed run became %s: %s", got.Status, got.Error)
+	}
+	if !r.Finish(run.ID) || r.Finish(run.ID) {
+		t.Error("the end of a run must be handled exactly once")
+	}
+}
+
+func TestFailAndResume(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	run, _ := r.Start("2025-01-31", "", pipeline)
+	r.CompleteStage(run.ID, "extractor", "extractor_completed")
+	r.FirstEvent(run.ID, "cleaner_failed")
+	r.Fail(run.ID, errcategory.Errorf(errcategory.Quota, "429 from the cleaner"))
+
+	got, _ := r.Get(run.ID)
+	if got.Status != StatusFailed || got.ErrorCategory != string(errcategory.Quota) {
+		t.Fatalf("status %s, category %s", got.Status, got.ErrorCategory)
+	}
+	if !r.Finish(run.ID) {
+		t.Fatal("failed run not finished")
+	}
+
+	resumed, restart, err := r.Resume(run.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Status != StatusRunning || resumed.Error != "" || resumed.Retries != 1 {
+		t.Errorf("resumed run %s (%q) after %d retries", resumed.Status, resumed.Error, resumed.Retries)
+	}
+	if len(restart) != 1 || restart[0].Name != "cleaner" {
+		t.Errorf("restarting %v, want the cleaner", restart)
+	}
+	if !r.FirstEvent(run.ID, "cleaner_failed") {
+		t.Error("the resumed stage's failure would be dropped as a duplicate")
+	}
+	if _, _, err := r.Resume(run.ID, false); err == nil {
+		t.Error("a running run was resumed without force")
+	}
+	if _, _, err := r.Resume(run.ID, true); err != nil {
+		t.Errorf("forced resume: %v", err)
+	}
+
+	// The resumed run can end, and be finished, again
+	r.Fail(run.ID, errors.New("again"))
+	if !r.Finish(run.ID) {
+		t.Error("resumed run not finished after failing again")
+	}
+	if _, _, err := r.Resume("unknown", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown run: %v", err)
+	}
+}
+
+func TestQueueAndDequeue(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	run, _ := r.Start("2025-01-31", "", pipeline)
+	r.Queue(run.ID, 3)
+	if got, _ := r.Get(run.ID); got.Status != StatusQueued || got.Priority != 3 {
+		t.Fatalf("status %s, priority %d", got.Status, got.Priority)
+	}
+	if _, _, err := r.Resume(run.ID, true); err == nil {
+		t.Error("a queued run was resumed")
+	}
+	r.Dequeue(run.ID)
+	if got, _ := r.Get(run.ID); got.Status != StatusStarted {
+		t.Errorf("dequeued run is %s", got.Status)
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	run, _ := r.Start("2025-01-31", "", pipeline)
+	if _, err := r.TakeApproval(run.ID, ""); !errors.Is(err, ErrNoApproval) {
+		t.Errorf("nothing pending: %v", err)
+	}
+
+	a, ok := r.AwaitApproval(run.ID, "cleaner", time.Hour)
+	if !ok || a.Stage != "cleaner" || a.ExpiresAt.Sub(a.RequestedAt) != time.Hour {
+		t.Fatalf("await: ok=%t %+v", ok, a)
+	}
+	if _, ok := r.AwaitApproval(run.ID, "cleaner", time.Hour); ok {
+		t.Error("a stage was held at its gate twice")
+	}
+	before, _ := r.Get(run.ID)
+	r.AwaitApproval(run.ID, "loader_parquet", time.Hour)
+	if len(before.Approvals) != 1 {
+		t.Error("a copy from Get changed with the registry")
+	}
+
+	if _, err := r.TakeApproval(run.ID, ""); err == nil || errors.Is(err, ErrNoApproval) {
+		t.Errorf("two pending without a stage named: %v", err)
+	}
+	if a, err := r.TakeApproval(run.ID, "loader_parquet"); err != nil || a.Stage != "loader_parquet" {
+		t.Fatalf("take loader_parquet: %+v, %v", a, err)
+	}
+	// Approval racing expiry: only one taker gets it
+	if a, err := r.TakeApproval(run.ID, ""); err != nil || a.Stage != "cleaner" {
+		t.Fatalf("take the only one left: %+v, %v", a, err)
+	}
+	if _, err := r.TakeApproval(run.ID, "cleaner"); !errors.Is(err, ErrNoApproval) {
+		t.Errorf("taken twice: %v", err)
+	}
+	if _, err := r.TakeApproval("unknown", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown run: %v", err)
+	}
+
+	// A failed run closes its gates and holds no more stages
+	r.AwaitApproval(run.ID, "cleaner", time.Hour)
+	r.Fail(run.ID, errors.New("rejected"))
+	if got, _ := r.Get(run.ID); got.Approvals != nil {
+		t.Errorf("failed run still waits on %v", got.Approvals)
+	}
+	if _, ok := r.AwaitApproval(run.ID, "cleaner", time.Hour); ok {
+		t.Error("a failed run was held at a gate")
+	}
+}
+
+func TestRecordEventLimits(t *testing.T) {
+	r := NewRegistry(time.Hour, 0)
+	run, _ := r.Start("2025-01-31", "", pipeline)
+	timings := make([]interface{}, 2000)
+	for i := range timings {
+		timings[i] = map[string]interface{}{"file": "chunk.json", "seconds": 1.5}
+	}
+	r.RecordEvent(run.ID, Event{Name: "cleaner_completed", Fields: map[string]interface{}{"duration": 12.5, "file_timings": timings}})
+	got, _ := r.Get(run.ID)
+	fields := got.Events[0].Fields
+	if fields["duration"] != 12.5 {
+		t.Errorf("scalar field lost: %v", fields["duration"])
+	}
+	if _, ok := fields["file_timings"].(string); !ok {
+		t.Errorf("file_timings kept whole")
+	}
+
+	for i := 0; i < MaxEvents+10; i++ {
+		r.RecordEvent(run.ID, Event{Name: "chunk_anomaly"})
+	}
+	got, _ = r.Get(run.ID)
+	if len(got.Events) != MaxEvents || got.EventsDropped != 11 {
+		t.Errorf("%d events kept, %d dropped; want %d, 11", len(got.Events), got.EventsDropped, MaxEvents)
+	}
+}
@@ -0,0 +1,55 @@
+package sla
+
+import (
+	"sync"
+	"time"
+)
+
+// Monitor arms one timer per (run, stage); if the stage hasn't been marked
+// done before its limit elapses the violation callback fires.
+type Monitor struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{timers: make(map[string]*time.Timer)}
+}
+
+// Watch starts (or restarts) the SLA clock for a stage. A zero limit disables it.
+func (m *Monitor) Watch(runID, stage string, limit time.Duration, onViolation func()) {
+	if limit <= 0 {
+		return
+	}
+	key := runID + "/" + stage
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.timers[key]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(limit, func() {
+		m.mu.Lock()
+		current := m.timers[key] == t
+		if current {
+			delete(m.timers, key)
+		}
+		m.mu.Unlock()
+		if current {
+			onViolation()
+		}
+	})
+	m.timers[key] = t
+}
+
+// Done stops the SLA clock for a stage that finished.
+func (m *Monitor) Done(runID, stage string) {
+	key := runID + "/" + stage
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.timers[key]; ok {
+		t.Stop()
+		delete(m.timers, key)
+	}
+}
@@ -0,0 +1,107 @@
+package summary
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DefaultPrices are on-demand list prices in USD for the US multi-region.
+// The services.json "costs" section overrides individual entries.
+var DefaultPrices = map[string]float64{
+	"gcs_storage_per_gb_month": 0.020,
+	"bq_query_per_tb":          6.25,
+	"bq_load_per_gb":           0, // batch load jobs are free
+	"bq_streaming_per_gb":      0.05,
+	"bq_storage_per_gb_month":  0.020,
+	"api_call":                 0, // the city's open data API is free
+}
+
+// Usage fields the services report in their stage events
+var usageFields = []string{"api_calls", "gcs_bytes_written", "bq_bytes_loaded", "bq_bytes_streamed", "bq_bytes_processed"}
+
+const (
+	gb = 1 << 30
+	tb = 1 << 40
+)
+
+// Cost is the estimated spend of a run. Storage is priced for one month.
+type Cost struct {
+	Usage    map[string]float64 `json:"usage"`
+	Lines    []CostLine         `json:"lines"`
+	TotalUSD float64            `json:"total_usd"`
+	// Estimate is the one-line form shown in logs and the dashboard
+	Estimate string `json:"estimate"`
+}
+
+// CostLine prices one kind of usage.
+type CostLine struct {
+	Item      string  `json:"item"`
+	Quantity  float64 `json:"quantity"`
+	Unit      string  `json:"unit"`
+	UnitPrice float64 `json:"unit_price_usd"`
+	USD       float64 `json:"usd"`
+}
+
+// Prices overlays configured prices on DefaultPrices.
+func Prices(configured map[string]float64) map[string]float64 {
+	prices := make(map[string]float64, len(DefaultPrices))
+	for k, v := range DefaultPrices {
+		prices[k] = v
+	}
+	for k, v := range configured {
+		prices[k] = v
+	}
+	return prices
+}
+
+// EstimateCost totals the usage fields of every event and prices them.
+// When no stage reports GCS bytes, the run's object listing stands in.
+func EstimateCost(s Summary, prices map[string]float64) Cost {
+	c := Cost{Usage: make(map[string]float64)}
+	for _, f := range usageFields {
+		c.Usage[f] = 0
+	}
+	for _, e := range s.Events {
+		for _, f := range usageFields {
+			if n, ok := number(e.Fields[f]); ok {
+				c.Usage[f] += n
+			}
+		}
+	}
+	if c.Usage["gcs_bytes_written"] == 0 {
+		for _, l := range s.Objects {
+			c.Usage["gcs_bytes_written"] += float64(l.Bytes)
+		}
+	}
+
+	add := func(item string, qty float64, unit, price string) {
+		p := prices[price]
+		c.Lines = append(c.Lines, CostLine{Item: item, Quantity: round(qty, 6), Unit: unit, UnitPrice: p, USD: round(qty*p, 6)})
+		c.TotalUSD += qty * p
+	}
+	add("GCS storage", c.Usage["gcs_bytes_written"]/gb, "GB-month", "gcs_storage_per_gb_month")
+	add("BigQuery queries", c.Usage["bq_bytes_processed"]/tb, "TB", "bq_query_per_tb")
+	add("BigQuery loads", c.Usage["bq_bytes_loaded"]/gb, "GB", "bq_load_per_gb")
+	add("BigQuery streaming inserts", c.Usage["bq_bytes_streamed"]/gb, "GB", "bq_streaming_per_gb")
+	add("BigQuery storage", (c.Usage["bq_bytes_loaded"]+c.Usage["bq_bytes_streamed"])/gb, "GB-month", "bq_storage_per_gb_month")
+	add("API calls", c.Usage["api_calls"], "calls", "api_call")
+	c.TotalUSD = round(c.TotalUSD, 6)
+
+	var parts []string
+	for _, l := range c.Lines {
+		if l.USD > 0 {
+			parts = append(parts, fmt.Sprintf("%s $%.4f", l.Item, l.USD))
+		}
+	}
+	c.Estimate = fmt.Sprintf("Estimated cost: $%.4f", c.TotalUSD)
+	if len(parts) > 0 {
+		c.Estimate += " (" + strings.Join(parts, ", ") + ")"
+	}
+	return c
+}
+
+func round(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
@@ -0,0 +1,269 @@
+// Package summary assembles the machine-readable record of a finished pipeline
+// run: every stage event, aggregated metrics, data quality results and a listing
+// of the objects the run produced. Summaries are archived to
+// runs/{date}/{run_id}/summary.json for later review and automated grading.
+package summary
+
+import (
+	"app/runs"
+	"configure/errcategory"
+	"configure/gcp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Summary is the archived record of one run.
+type Summary struct {
+	RunID         string    `json:"run_id"`
+	Date          string    `json:"date"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	ErrorCategory string    `json:"error_category,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	WallSeconds   float64   `json:"wall_clock_seconds"`
+	GeneratedAt   time.Time `json:"generated_at"`
+	// Profile is the /run profile the run was started with, by name, and the
+	// settings it resolved to
+	Profile interface{} `json:"profile,omitempty"`
+
+	Stages        []Stage            `json:"stages"`
+	Metrics       map[string]float64 `json:"metrics"`
+	Quality       []QualityResult    `json:"quality"`
+	Objects       []Listing          `json:"objects"`
+	Cost          Cost               `json:"cost"`
+	SLAViolations []string           `json:"sla_violations"`
+	Events        []runs.Event       `json:"events"`
+}
+
+// Stage is the outcome of one stage of the run's topology.
+type Stage struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"` // completed | failed | missing
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	CompletedAt     string  `json:"completed_at,omitempty"`
+}
+
+// QualityResult is a data quality finding reported by a stage, such as a
+// contract violation or drift.
+type QualityResult struct {
+	Stage    string      `json:"stage"`
+	Event    string      `json:"event"`
+	Status   string      `json:"status"`
+	Message  string      `json:"message,omitempty"`
+	Category string      `json:"category,omitempty"` // errcategory of a failure
+	Detail   interface{} `json:"detail,omitempty"`
+}
+
+// Listing inventories one bucket/prefix location.
+type Listing struct {
+	Location string           `json:"location"`
+	Count    int              `json:"count"`
+	Bytes    int64            `json:"bytes"`
+	Objects  []gcp.ObjectInfo `json:"objects,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// Fields an event carries that describe data quality rather than throughput
+var qualityFields = []string{"report", "drifted", "violations"}
+
+// Build assembles the summary of run from its recorded events, pricing its
+// usage with prices (see Prices).
+func Build(run runs.Run, objects []Listing, prices map[string]float64) Summary {
+	s := Summary{
+		RunID:         run.ID,
+		Date:          run.Date,
+		Status:        string(run.Status),
+		Error:         run.Error,
+		ErrorCategory: run.ErrorCategory,
+		StartedAt:     run.CreatedAt,
+		FinishedAt:    run.UpdatedAt,
+		GeneratedAt:   time.Now().UTC(),
+		Metrics:       make(map[string]float64),
+		Quality:       []QualityResult{},
+		Objects:       objects,
+		SLAViolations: run.SLAViolations,
+		Events:        run.Events,
+		Profile:       run.Params["profile"],
+	}
+	s.WallSeconds = s.FinishedAt.Sub(s.StartedAt).Seconds()
+	if s.Objects == nil {
+		s.Objects = []Listing{}
+	}
+	if s.SLAViolations == nil {
+		s.SLAViolations = []string{}
+	}
+	if s.Events == nil {
+		s.Events = []runs.Event{}
+	}
+
+	done := make(map[string]bool)
+	for _, name := range run.Completed {
+		done[name] = true
+	}
+	completions := make(map[string]runs.Event)
+	failed := make(map[string]bool)
+
+	for _, e := range run.Events {
+		s.Metrics["events"]++
+		status, _ := e.Fields["status"].(string)
+		if status == "failed" {
+			failed[e.Origin] = true
+			failed[strings.TrimSuffix(e.Name, "_failed")] = true
+			s.Metrics["failures."+category(e)]++
+		}
+		if strings.HasSuffix(e.Name, "_completed") {
+			completions[strings.TrimSuffix(e.Name, "_completed")] = e
+		}
+
+		// Sum every numeric field per stage, e.g. cleaner.files_cleaned
+		for k, v := range e.Fields {
+			if n, ok := number(v); ok && !isIdentifier(k) {
+				s.Metrics[e.Origin+"."+k] += n
+			}
+		}
+
+		if q, ok := quality(e, status); ok {
+			s.Quality = append(s.Quality, q)
+		}
+	}
+
+	for _, st := range run.Topology {
+		stage := Stage{Name: st.Name, Status: "missing"}
+		switch {
+		case done[st.Name]:
+			stage.Status = "completed"
+		case failed[st.Name]:
+			stage.Status = "failed"
+		}
+		if e, ok := completions[st.Name]; ok {
+			stage.DurationSeconds, _ = number(e.Fields["duration"])
+			stage.CompletedAt = e.ReceivedAt.Format(time.RFC3339)
+		}
+		s.Metrics["stage_seconds_total"] += stage.DurationSeconds
+		if stage.Status == "completed" {
+			s.Metrics["stages_completed"]++
+		}
+		s.Stages = append(s.Stages, stage)
+	}
+	s.Metrics["stages_total"] = float64(len(run.Topology))
+	s.Metrics["sla_violations"] = float64(len(run.SLAViolations))
+	s.Metrics["quality_findings"] = float64(len(s.Quality))
+	for _, l := range s.Objects {
+		s.Metrics["objects_total"] += float64(l.Count)
+		s.Metrics["object_bytes_total"] += float64(l.Bytes)
+	}
+	s.Cost = EstimateCost(s, prices)
+	s.Metrics["estimated_cost_usd"] = s.Cost.TotalUSD
+	return s
+}
+
+func quality(e runs.Event, status string) (QualityResult, bool) {
+	q := QualityResult{Stage: e.Origin, Event: e.Name, Status: status}
+	q.Message, _ = e.Fields["message"].(string)
+	if msg, ok := e.Fields["error"].(string); ok && q.Message == "" {
+		q.Message = msg
+	}
+	if status == "failed" {
+		q.Category = category(e)
+	}
+	for _, f := range qualityFields {
+		if v, ok := e.Fields[f]; ok && v != nil {
+			q.Detail = v
+			break
+		}
+	}
+	if q.Detail == nil && status != "failed" && status != "alert" {
+		return q, false
+	}
+	if q.Status == "" {
+		q.Status = "ok"
+	}
+	return q, true
+}
+
+// category is the errcategory a failure event reports, or one inferred from its error.
+func category(e runs.Event) string {
+	if c, ok := e.Fields["error_category"].(string); ok && c != "" {
+		return string(errcategory.Parse(c))
+	}
+	msg, _ := e.Fields["error"].(string)
+	return string(errcategory.Classify(msg))
+}
+
+// number accepts JSON numbers and the numeric strings the Python services send.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// isIdentifier skips numeric-looking fields that are not measurements.
+func isIdentifier(field string) bool {
+	switch field {
+	case "date", "run_id", "timestamp", "max_offset":
+		return true
+	}
+	return false
+}
+
+// ListObjects inventories each "bucket/prefix" location, with {date}
+// replaced by the run date. Failures are recorded per location.
+func ListObjects(ctx context.Context, locations []string, date string) []Listing {
+	var out []Listing
+	for _, loc := range locations {
+		loc = strings.ReplaceAll(loc, "{date}", date)
+		l := Listing{Location: "gs://" + loc}
+		bucket, prefix, _ := strings.Cut(loc, "/")
+		objects, err := gcp.ListObjectInfo(ctx, bucket, prefix)
+		if err != nil {
+			l.Error = err.Error()
+		}
+		sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+		for _, o := range objects {
+			l.Count++
+			l.Bytes += o.Size
+		}
+		l.Objects = objects
+		out = append(out, l)
+	}
+	return out
+}
+
+// Path is where a run's summary is stored, relative to the bucket or log directory.
+func Path(date, runID string) string {
+	return fmt.Sprintf("runs/%s/%s/summary.json", date, runID)
+}
+
+// Write stores s in bucket, or under logs/ when no bucket is configured, and
+// returns where it went. Rewriting a summary (e.g. after a retried run) replaces it.
+func Write(ctx context.Context, bucket string, s Summary) (string, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := Path(s.Date, s.RunID)
+	if bucket != "" {
+		if err := gcp.UploadObject(ctx, bucket, name, data, "application/json", false); err != nil {
+			return "", err
+		}
+		return "gs://" + bucket + "/" + name, nil
+	}
+	path := filepath.Join("logs", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, 0644)
+}